@@ -2,18 +2,24 @@ package handlers
 
 import (
 	"context"
+	"database/sql"
+	"errors"
 	"fmt"
 	"log/slog"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
+	"github.com/humanlayer/humanlayer/hld/internal/apierror"
 	"github.com/humanlayer/humanlayer/hld/store"
+	"golang.org/x/sync/errgroup"
 )
 
 // APISessionHandlers handles lightweight API-only sessions that don't launch Claude CLI
 type APISessionHandlers struct {
 	store store.ConversationStore
+	// usage totals a session's usage logs when it is finalized
+	usage SessionUsageFunc
 }
 
 func NewAPISessionHandlers(store store.ConversationStore) *APISessionHandlers {
@@ -46,14 +52,27 @@ func (h *APISessionHandlers) CreateAPISession(c *gin.Context) {
 			slog.Warn("Invalid JSON in create session request",
 				"error", err,
 				"content_type", c.GetHeader("Content-Type"))
-			c.JSON(400, gin.H{
-				"error": "Invalid JSON format",
-				"details": err.Error(),
+			apierror.Abort(c, 400, apierror.Envelope{
+				Code:    apierror.CodeInvalidJSON,
+				Message: "Invalid JSON format",
+				Details: map[string]interface{}{"error": err.Error()},
 			})
 			return
 		}
 	}
 
+	session, err := h.createSession(req)
+	if err != nil {
+		apierror.AbortWithError(c, 500, apierror.CodeInternalError, "Failed to create session")
+		return
+	}
+
+	// Return session details
+	c.JSON(200, session)
+}
+
+// createSession stores a new API-only session for req
+func (h *APISessionHandlers) createSession(req CreateAPISessionRequest) (*CreateAPISessionResponse, error) {
 	// Generate unique session ID
 	sessionID := uuid.New().String()
 	
@@ -84,21 +103,204 @@ func (h *APISessionHandlers) CreateAPISession(c *gin.Context) {
 		slog.Error("Failed to create API session",
 			"session_id", sessionID,
 			"error", err)
-		c.JSON(500, gin.H{
-			"error": "Failed to create session",
-		})
-		return
+		return nil, err
 	}
 
 	slog.Info("Created API-only session",
 		"session_id", sessionID,
 		"title", title)
 
-	// Return session details
-	c.JSON(200, CreateAPISessionResponse{
+	return &CreateAPISessionResponse{
 		ID:        sessionID,
 		CreatedAt: session.CreatedAt,
 		Status:    session.Status,
-	})
+	}, nil
+}
+
+// maxBatchSessions caps the sessions one batch request may create
+const maxBatchSessions = 50
+
+// batchSessionConcurrency caps the sessions a batch creates at once
+const batchSessionConcurrency = 10
+
+// BatchCreateAPISessionResult is the outcome of one session in a batch,
+// in the position of its request
+type BatchCreateAPISessionResult struct {
+	Index   int                       `json:"index"`
+	Success bool                      `json:"success"`
+	Session *CreateAPISessionResponse `json:"session,omitempty"`
+	Error   string                    `json:"error,omitempty"`
+}
+
+// BatchCreateAPISessionsResponse lists the outcome of every session in a batch
+type BatchCreateAPISessionsResponse struct {
+	Created int                           `json:"created"`
+	Failed  int                           `json:"failed"`
+	Results []BatchCreateAPISessionResult `json:"results"`
+}
+
+// BatchCreateAPISessions creates up to maxBatchSessions API-only sessions
+// from an array of CreateAPISessionRequest, for provisioning test and demo
+// environments. Sessions are created concurrently; one failing doesn't stop
+// the others, and each result reports its own outcome.
+func (h *APISessionHandlers) BatchCreateAPISessions(c *gin.Context) {
+	var reqs []CreateAPISessionRequest
+	if err := c.ShouldBindJSON(&reqs); err != nil {
+		apierror.Abort(c, 400, apierror.Envelope{
+			Code:    apierror.CodeInvalidJSON,
+			Message: "Request body must be an array of sessions",
+			Details: map[string]interface{}{"error": err.Error()},
+		})
+		return
+	}
+	if len(reqs) == 0 || len(reqs) > maxBatchSessions {
+		apierror.Abort(c, 400, apierror.Envelope{
+			Code:    apierror.CodeInvalidRequest,
+			Message: fmt.Sprintf("A batch must contain between 1 and %d sessions", maxBatchSessions),
+			Details: map[string]interface{}{"count": len(reqs), "max": maxBatchSessions},
+		})
+		return
+	}
+
+	results := make([]BatchCreateAPISessionResult, len(reqs))
+	var g errgroup.Group
+	g.SetLimit(batchSessionConcurrency)
+	for i, req := range reqs {
+		g.Go(func() error {
+			results[i].Index = i
+			session, err := h.createSession(req)
+			if err != nil {
+				results[i].Error = "Failed to create session"
+				return nil
+			}
+			results[i].Success, results[i].Session = true, session
+			return nil
+		})
+	}
+	_ = g.Wait()
+
+	resp := BatchCreateAPISessionsResponse{Results: results}
+	for _, res := range results {
+		if res.Success {
+			resp.Created++
+		} else {
+			resp.Failed++
+		}
+	}
+
+	slog.Info("Created API-only session batch",
+		"requested", len(reqs),
+		"created", resp.Created,
+		"failed", resp.Failed)
+	c.JSON(200, resp)
+}
+
+// SessionUsage is the usage logged against a session
+type SessionUsage struct {
+	Requests     int `json:"requests"`
+	InputTokens  int `json:"input_tokens"`
+	OutputTokens int `json:"output_tokens"`
+	PointsSpent  int `json:"points_spent"`
+	// CacheCreationTokens and CacheReadTokens are the prompt tokens
+	// written to and read from the prompt cache
+	CacheCreationTokens int `json:"cache_creation_tokens,omitempty"`
+	CacheReadTokens     int `json:"cache_read_tokens,omitempty"`
 }
 
+// SessionUsageFunc totals the usage logs of a session created at since,
+// e.g. with firebase.Client.GetUsageSummary filtered by session ID
+type SessionUsageFunc func(ctx context.Context, sessionID string, since time.Time) (SessionUsage, error)
+
+// SetSessionUsage sets where FinalizeAPISession reads session usage from.
+// Without it a finalized session keeps the token counts already stored on
+// it and reports no points spent.
+func (h *APISessionHandlers) SetSessionUsage(usage SessionUsageFunc) {
+	h.usage = usage
+}
+
+// FinalizeAPISessionResponse summarizes a finalized session
+type FinalizeAPISessionResponse struct {
+	ID          string    `json:"id"`
+	Status      string    `json:"status"`
+	CompletedAt time.Time `json:"completed_at"`
+	SessionUsage
+}
+
+// FinalizeAPISession handles POST /api_sessions/:id/finalize. It totals the
+// session's usage logs, stores the token totals on the session and marks it
+// completed, and returns the summary. Sessions that don't exist or are
+// already completed are refused.
+func (h *APISessionHandlers) FinalizeAPISession(c *gin.Context) {
+	ctx := c.Request.Context()
+	sessionID := c.Param("id")
+
+	session, err := h.store.GetSession(ctx, sessionID)
+	if errors.Is(err, sql.ErrNoRows) {
+		apierror.AbortWithError(c, 404, apierror.CodeSessionNotFound, "Session not found")
+		return
+	}
+	if err != nil {
+		slog.Error("Failed to get API session",
+			"session_id", sessionID,
+			"error", err)
+		apierror.AbortWithError(c, 500, apierror.CodeInternalError, "Failed to get session")
+		return
+	}
+	if session.Status == store.SessionStatusCompleted {
+		apierror.Abort(c, 409, apierror.Envelope{
+			Code:    apierror.CodeSessionCompleted,
+			Message: "Session is already completed",
+			Details: map[string]interface{}{"completed_at": session.CompletedAt},
+		})
+		return
+	}
+
+	var usage SessionUsage
+	if h.usage != nil {
+		usage, err = h.usage(ctx, sessionID, session.CreatedAt)
+		if err != nil {
+			slog.Error("Failed to total API session usage",
+				"session_id", sessionID,
+				"error", err)
+			apierror.AbortWithError(c, 500, apierror.CodeInternalError, "Failed to total session usage")
+			return
+		}
+	} else {
+		if session.InputTokens != nil {
+			usage.InputTokens = *session.InputTokens
+		}
+		if session.OutputTokens != nil {
+			usage.OutputTokens = *session.OutputTokens
+		}
+	}
+
+	now := time.Now()
+	status := store.SessionStatusCompleted
+	err = h.store.UpdateSession(ctx, sessionID, store.SessionUpdate{
+		Status:         &status,
+		CompletedAt:    &now,
+		LastActivityAt: &now,
+		InputTokens:    &usage.InputTokens,
+		OutputTokens:   &usage.OutputTokens,
+	})
+	if err != nil {
+		slog.Error("Failed to finalize API session",
+			"session_id", sessionID,
+			"error", err)
+		apierror.AbortWithError(c, 500, apierror.CodeInternalError, "Failed to finalize session")
+		return
+	}
+
+	slog.Info("Finalized API session",
+		"session_id", sessionID,
+		"input_tokens", usage.InputTokens,
+		"output_tokens", usage.OutputTokens,
+		"points_spent", usage.PointsSpent)
+
+	c.JSON(200, FinalizeAPISessionResponse{
+		ID:           sessionID,
+		Status:       status,
+		CompletedAt:  now,
+		SessionUsage: usage,
+	})
+}
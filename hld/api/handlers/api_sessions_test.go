@@ -0,0 +1,191 @@
+package handlers_test
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/humanlayer/humanlayer/hld/api/handlers"
+	"github.com/humanlayer/humanlayer/hld/internal/requestid"
+	"github.com/humanlayer/humanlayer/hld/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/mock/gomock"
+)
+
+func TestAPISessionHandlers_CreateAPISessionErrors(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockStore := store.NewMockConversationStore(ctrl)
+	h := handlers.NewAPISessionHandlers(mockStore)
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(handlers.RequestIDMiddleware())
+	router.POST("/api/v1/api-sessions", h.CreateAPISession)
+
+	send := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/api-sessions", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set(requestid.Header, "req-123")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	t.Run("invalid json", func(t *testing.T) {
+		w := send(`{"title":`)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.JSONEq(t, `{
+			"code": "invalid_json",
+			"message": "Invalid JSON format",
+			"details": {"error": "unexpected EOF"},
+			"request_id": "req-123"
+		}`, w.Body.String())
+	})
+
+	t.Run("store failure", func(t *testing.T) {
+		mockStore.EXPECT().CreateSession(gomock.Any(), gomock.Any()).Return(errors.New("disk full"))
+
+		w := send(`{"title":"t"}`)
+		assert.Equal(t, http.StatusInternalServerError, w.Code)
+		assert.JSONEq(t, `{
+			"code": "internal_error",
+			"message": "Failed to create session",
+			"request_id": "req-123"
+		}`, w.Body.String())
+	})
+}
+
+func TestAPISessionHandlers_BatchCreateAPISessions(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockStore := store.NewMockConversationStore(ctrl)
+	h := handlers.NewAPISessionHandlers(mockStore)
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.POST("/api/v1/sessions/batch", h.BatchCreateAPISessions)
+
+	send := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/sessions/batch", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	t.Run("per-session results", func(t *testing.T) {
+		mockStore.EXPECT().CreateSession(gomock.Any(), gomock.Any()).DoAndReturn(
+			func(_ context.Context, session *store.Session) error {
+				if session.Title == "bad" {
+					return errors.New("disk full")
+				}
+				return nil
+			}).Times(3)
+
+		w := send(`[{"title":"one"},{"title":"bad"},{"metadata":{"user_id":"u1"}}]`)
+		require.Equal(t, http.StatusOK, w.Code)
+
+		var resp handlers.BatchCreateAPISessionsResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		assert.Equal(t, 2, resp.Created)
+		assert.Equal(t, 1, resp.Failed)
+		require.Len(t, resp.Results, 3)
+		for i, res := range resp.Results {
+			assert.Equal(t, i, res.Index)
+		}
+		assert.True(t, resp.Results[0].Success)
+		assert.NotEmpty(t, resp.Results[0].Session.ID)
+		assert.False(t, resp.Results[1].Success)
+		assert.Equal(t, "Failed to create session", resp.Results[1].Error)
+		assert.Nil(t, resp.Results[1].Session)
+		assert.True(t, resp.Results[2].Success)
+	})
+
+	t.Run("too many sessions", func(t *testing.T) {
+		body := "[" + strings.Repeat(`{},`, 50) + "{}]"
+		w := send(body)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.Contains(t, w.Body.String(), `"invalid_request"`)
+	})
+
+	t.Run("empty and invalid bodies", func(t *testing.T) {
+		for _, body := range []string{`[]`, `{"title":"t"}`, `[`} {
+			w := send(body)
+			assert.Equal(t, http.StatusBadRequest, w.Code, fmt.Sprintf("body %s", body))
+		}
+	})
+}
+
+func TestAPISessionHandlers_FinalizeAPISession(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockStore := store.NewMockConversationStore(ctrl)
+	h := handlers.NewAPISessionHandlers(mockStore)
+	createdAt := time.Now().Add(-time.Hour)
+	h.SetSessionUsage(func(_ context.Context, sessionID string, since time.Time) (handlers.SessionUsage, error) {
+		assert.Equal(t, "sess-1", sessionID)
+		assert.Equal(t, createdAt, since)
+		return handlers.SessionUsage{Requests: 3, InputTokens: 1200, OutputTokens: 300, PointsSpent: 42}, nil
+	})
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.POST("/api/v1/api_sessions/:id/finalize", h.FinalizeAPISession)
+
+	send := func(id string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/api_sessions/"+id+"/finalize", nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	t.Run("stores and returns the totals", func(t *testing.T) {
+		mockStore.EXPECT().GetSession(gomock.Any(), "sess-1").
+			Return(&store.Session{ID: "sess-1", Status: "draft", CreatedAt: createdAt}, nil)
+		mockStore.EXPECT().UpdateSession(gomock.Any(), "sess-1", gomock.Any()).DoAndReturn(
+			func(_ context.Context, _ string, update store.SessionUpdate) error {
+				assert.Equal(t, store.SessionStatusCompleted, *update.Status)
+				assert.NotNil(t, update.CompletedAt)
+				assert.Equal(t, 1200, *update.InputTokens)
+				assert.Equal(t, 300, *update.OutputTokens)
+				return nil
+			})
+
+		w := send("sess-1")
+		require.Equal(t, http.StatusOK, w.Code)
+		var resp handlers.FinalizeAPISessionResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		assert.Equal(t, "sess-1", resp.ID)
+		assert.Equal(t, store.SessionStatusCompleted, resp.Status)
+		assert.False(t, resp.CompletedAt.IsZero())
+		assert.Equal(t, handlers.SessionUsage{Requests: 3, InputTokens: 1200, OutputTokens: 300, PointsSpent: 42}, resp.SessionUsage)
+	})
+
+	t.Run("already completed", func(t *testing.T) {
+		completedAt := time.Now()
+		mockStore.EXPECT().GetSession(gomock.Any(), "sess-1").
+			Return(&store.Session{ID: "sess-1", Status: store.SessionStatusCompleted, CompletedAt: &completedAt}, nil)
+
+		w := send("sess-1")
+		assert.Equal(t, http.StatusConflict, w.Code)
+		assert.Contains(t, w.Body.String(), `"session_completed"`)
+	})
+
+	t.Run("missing session", func(t *testing.T) {
+		mockStore.EXPECT().GetSession(gomock.Any(), "missing").Return(nil, sql.ErrNoRows)
+
+		w := send("missing")
+		assert.Equal(t, http.StatusNotFound, w.Code)
+		assert.Contains(t, w.Body.String(), `"session_not_found"`)
+	})
+}
@@ -6,18 +6,19 @@ import (
 	"strings"
 
 	"github.com/gin-gonic/gin"
-	"github.com/google/uuid"
+	"github.com/humanlayer/humanlayer/hld/internal/requestid"
 )
 
-// RequestIDMiddleware adds a unique request ID to each request
+// RequestIDMiddleware adds a unique request ID to each request. A
+// well-formed X-Request-ID from the client is kept; otherwise a new ID is
+// generated. The ID is also stored on the request context, where
+// requestid.FromContext finds it.
 func RequestIDMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		requestID := c.GetHeader("X-Request-ID")
-		if requestID == "" {
-			requestID = uuid.New().String()
-		}
+		requestID := requestid.FromHeader(c.GetHeader(requestid.Header))
 		c.Set("request-id", requestID)
-		c.Header("X-Request-ID", requestID)
+		c.Request = c.Request.WithContext(requestid.NewContext(c.Request.Context(), requestID))
+		c.Header(requestid.Header, requestID)
 		c.Next()
 	}
 }
@@ -8,6 +8,7 @@ import (
 	"testing"
 
 	"github.com/gin-gonic/gin"
+	"github.com/humanlayer/humanlayer/hld/internal/requestid"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -51,6 +52,39 @@ func TestRequestIDMiddleware(t *testing.T) {
 		assert.Equal(t, 200, w.Code)
 		assert.Equal(t, "test-request-id", w.Header().Get("X-Request-ID"))
 	})
+
+	t.Run("replaces malformed request ID", func(t *testing.T) {
+		router := gin.New()
+		router.Use(RequestIDMiddleware())
+		router.GET("/test", func(c *gin.Context) {
+			c.String(200, "ok")
+		})
+
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/test", nil)
+		req.Header.Set("X-Request-ID", "bad id\"with quotes")
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, 200, w.Code)
+		assert.NotEqual(t, "bad id\"with quotes", w.Header().Get("X-Request-ID"))
+		assert.NotEmpty(t, w.Header().Get("X-Request-ID"))
+	})
+
+	t.Run("stores request ID on the request context", func(t *testing.T) {
+		router := gin.New()
+		router.Use(RequestIDMiddleware())
+		router.GET("/test", func(c *gin.Context) {
+			assert.Equal(t, "ctx-request-id", requestid.FromContext(c.Request.Context()))
+			c.String(200, "ok")
+		})
+
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/test", nil)
+		req.Header.Set("X-Request-ID", "ctx-request-id")
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, 200, w.Code)
+	})
 }
 
 func TestCompressionMiddleware(t *testing.T) {
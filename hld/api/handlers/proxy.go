@@ -13,6 +13,7 @@ import (
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/humanlayer/humanlayer/hld/internal/requestid"
 	"github.com/humanlayer/humanlayer/hld/session"
 	"github.com/humanlayer/humanlayer/hld/store"
 )
@@ -21,6 +22,8 @@ type ProxyHandler struct {
 	sessionManager session.SessionManager
 	store          store.ConversationStore
 	httpClient     *http.Client
+	// cache replays responses to repeated prompts; nil when disabled
+	cache *SessionCache
 }
 
 func NewProxyHandler(sessionManager session.SessionManager, store store.ConversationStore) *ProxyHandler {
@@ -28,6 +31,7 @@ func NewProxyHandler(sessionManager session.SessionManager, store store.Conversa
 		sessionManager: sessionManager,
 		store:          store,
 		httpClient:     &http.Client{},
+		cache:          NewSessionCacheFromEnv(),
 	}
 }
 
@@ -91,8 +95,11 @@ func (h *ProxyHandler) ProxyAnthropicRequest(c *gin.Context) {
 	startTime := time.Now()
 	sessionID := c.Param("session_id")
 
+	requestID := requestid.FromContext(c.Request.Context())
+
 	slog.Info("🟢 PROXY REQUEST RECEIVED",
 		"session_id", sessionID,
+		"request_id", requestID,
 		"method", c.Request.Method,
 		"path", c.Request.URL.Path,
 		"remote_addr", c.Request.RemoteAddr,
@@ -135,6 +142,24 @@ func (h *ProxyHandler) ProxyAnthropicRequest(c *gin.Context) {
 		return
 	}
 
+	// Answer a request repeated within the session from the cache
+	cacheKey := ""
+	if h.cache != nil && !cacheBypassed(c.GetHeader("Cache-Control")) {
+		cacheKey = responseCacheKey(sessionID, requestBody)
+		if cached, ok := h.cache.Get(cacheKey); ok {
+			slog.Info("proxy response served from cache",
+				"session_id", sessionID,
+				"request_id", requestID,
+				"model", requestBody["model"],
+				"input_tokens", 0,
+				"output_tokens", 0,
+				"reason", "cache_hit")
+			c.Header(ResponseCacheHeader, "hit")
+			c.Data(http.StatusOK, cached.contentType, cached.body)
+			return
+		}
+	}
+
 	// Determine target URL based on session config
 	var targetURL string
 	var needsTransform bool
@@ -209,17 +234,18 @@ func (h *ProxyHandler) ProxyAnthropicRequest(c *gin.Context) {
 		"elapsed_ms", time.Since(startTime).Milliseconds())
 
 	if stream {
-		h.handleStreamingProxy(c, sessionID, targetURL, forwardBytes, needsTransform)
+		h.handleStreamingProxy(c, sessionID, targetURL, forwardBytes, needsTransform, cacheKey)
 	} else {
-		h.handleNonStreamingProxy(c, sessionID, targetURL, forwardBytes, needsTransform)
+		h.handleNonStreamingProxy(c, sessionID, targetURL, forwardBytes, needsTransform, cacheKey)
 	}
 
 	slog.Info("proxy request completed",
 		"session_id", sessionID,
+		"request_id", requestID,
 		"total_duration_ms", time.Since(startTime).Milliseconds())
 }
 
-func (h *ProxyHandler) handleNonStreamingProxy(c *gin.Context, sessionID string, url string, body []byte, needsTransform bool) {
+func (h *ProxyHandler) handleNonStreamingProxy(c *gin.Context, sessionID string, url string, body []byte, needsTransform bool, cacheKey string) {
 	handlerStart := time.Now()
 	slog.Debug("starting non-streaming proxy",
 		"session_id", sessionID,
@@ -317,6 +343,9 @@ func (h *ProxyHandler) handleNonStreamingProxy(c *gin.Context, sessionID string,
 
 	// Forward response
 	c.Data(resp.StatusCode, "application/json", respBody)
+	if cacheKey != "" && resp.StatusCode == http.StatusOK {
+		h.cache.Set(cacheKey, "application/json", respBody)
+	}
 
 	slog.Info("non-streaming proxy completed",
 		"session_id", sessionID,
@@ -324,7 +353,7 @@ func (h *ProxyHandler) handleNonStreamingProxy(c *gin.Context, sessionID string,
 		"response_size", len(respBody))
 }
 
-func (h *ProxyHandler) handleStreamingProxy(c *gin.Context, sessionID string, url string, body []byte, needsTransform bool) {
+func (h *ProxyHandler) handleStreamingProxy(c *gin.Context, sessionID string, url string, body []byte, needsTransform bool, cacheKey string) {
 	handlerStart := time.Now()
 	slog.Debug("starting streaming proxy",
 		"session_id", sessionID,
@@ -389,9 +418,13 @@ func (h *ProxyHandler) handleStreamingProxy(c *gin.Context, sessionID string, ur
 		return
 	}
 
-	// Stream response
+	// Stream response, keeping a copy of successful streams for the cache
 	scanner := bufio.NewScanner(resp.Body)
 	chunkCount := 0
+	var replay *bytes.Buffer
+	if cacheKey != "" && resp.StatusCode == http.StatusOK {
+		replay = &bytes.Buffer{}
+	}
 
 	for scanner.Scan() {
 		line := scanner.Text()
@@ -410,6 +443,13 @@ func (h *ProxyHandler) handleStreamingProxy(c *gin.Context, sessionID string, ur
 
 		_, _ = fmt.Fprintf(c.Writer, "%s\n", line)
 		flusher.Flush()
+		if line == "event: error" {
+			// Streams that failed part way aren't worth replaying
+			replay = nil
+		}
+		if replay != nil {
+			_, _ = fmt.Fprintf(replay, "%s\n", line)
+		}
 	}
 
 	if err := scanner.Err(); err != nil {
@@ -418,6 +458,8 @@ func (h *ProxyHandler) handleStreamingProxy(c *gin.Context, sessionID string, ur
 			"error", fmt.Sprintf("%v", err))
 		_, _ = fmt.Fprintf(c.Writer, "event: error\ndata: %s\n\n", err.Error())
 		flusher.Flush()
+	} else if replay != nil {
+		h.cache.Set(cacheKey, "text/event-stream", replay.Bytes())
 	}
 
 	slog.Info("streaming proxy completed",
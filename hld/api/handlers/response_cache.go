@@ -0,0 +1,132 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ResponseCacheHeader is set to "hit" on responses served from the
+// SessionCache, so usage tracking logs them as zero tokens instead of
+// billing the original usage again
+const ResponseCacheHeader = "X-Response-Cache"
+
+// cachedResponse is an upstream response kept for replay
+type cachedResponse struct {
+	contentType string
+	body        []byte
+	expiresAt   time.Time
+}
+
+// SessionCache keeps successful upstream responses for a short time so a
+// request sent twice in the same session is answered once. Entries are keyed
+// by session and request body; see responseCacheKey. Error responses,
+// including streams that end in an error event, aren't cached, and requests
+// sent with "Cache-Control: no-store" neither read nor fill the cache. A nil
+// SessionCache caches nothing.
+type SessionCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	entries map[string]cachedResponse
+}
+
+// NewSessionCache creates a cache keeping responses for ttl
+func NewSessionCache(ttl time.Duration) *SessionCache {
+	return &SessionCache{ttl: ttl, entries: make(map[string]cachedResponse)}
+}
+
+// NewSessionCacheFromEnv creates a cache keeping responses for
+// RESPONSE_CACHE_TTL_SECONDS, or returns nil when it is unset or zero
+func NewSessionCacheFromEnv() *SessionCache {
+	raw := os.Getenv("RESPONSE_CACHE_TTL_SECONDS")
+	if raw == "" {
+		return nil
+	}
+	seconds, err := strconv.Atoi(raw)
+	if err != nil || seconds < 0 {
+		slog.Warn("invalid RESPONSE_CACHE_TTL_SECONDS, response cache disabled", "value", raw)
+		return nil
+	}
+	if seconds == 0 {
+		return nil
+	}
+	slog.Info("response cache enabled", "ttl_seconds", seconds)
+	return NewSessionCache(time.Duration(seconds) * time.Second)
+}
+
+// responseCacheKey hashes the parts of a request that decide its response:
+// the session and the request body, normalized so that key order and
+// whitespace don't matter. Every parameter counts, so requests differing
+// only in system prompt, temperature or stream are kept apart; metadata,
+// which only tags the request, is left out.
+func responseCacheKey(sessionID string, requestBody map[string]interface{}) string {
+	normalized := make(map[string]interface{}, len(requestBody))
+	for k, v := range requestBody {
+		if k != "metadata" {
+			normalized[k] = v
+		}
+	}
+	// Map keys are marshalled in sorted order, so equal bodies hash equally
+	body, _ := json.Marshal(normalized)
+	bodyHash := sha256.Sum256(body)
+
+	h := sha256.New()
+	for _, part := range []string{sessionID, hex.EncodeToString(bodyHash[:])} {
+		h.Write([]byte(part))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// cacheBypassed reports whether a request's Cache-Control header asks for
+// its response not to be stored
+func cacheBypassed(cacheControl string) bool {
+	for _, directive := range strings.Split(cacheControl, ",") {
+		if strings.EqualFold(strings.TrimSpace(directive), "no-store") {
+			return true
+		}
+	}
+	return false
+}
+
+// Get returns the unexpired response cached under key
+func (c *SessionCache) Get(key string) (cachedResponse, bool) {
+	if c == nil {
+		return cachedResponse{}, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[key]
+	if !ok {
+		return cachedResponse{}, false
+	}
+	if time.Now().After(entry.expiresAt) {
+		delete(c.entries, key)
+		return cachedResponse{}, false
+	}
+	return entry, true
+}
+
+// Set caches a response under key, dropping any expired entries
+func (c *SessionCache) Set(key, contentType string, body []byte) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	for k, entry := range c.entries {
+		if now.After(entry.expiresAt) {
+			delete(c.entries, k)
+		}
+	}
+	c.entries[key] = cachedResponse{contentType: contentType, body: body, expiresAt: now.Add(c.ttl)}
+}
@@ -0,0 +1,87 @@
+package handlers
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResponseCacheKey(t *testing.T) {
+	body := func(model string, stream bool, text string) map[string]interface{} {
+		return map[string]interface{}{
+			"model":  model,
+			"stream": stream,
+			"messages": []interface{}{
+				map[string]interface{}{"role": "user", "content": text},
+			},
+			"max_tokens": 1024,
+		}
+	}
+
+	key := responseCacheKey("sess-1", body("claude-3-5-haiku-20241022", false, "hello"))
+	assert.Equal(t, key, responseCacheKey("sess-1", body("claude-3-5-haiku-20241022", false, "hello")))
+	assert.NotEqual(t, key, responseCacheKey("sess-2", body("claude-3-5-haiku-20241022", false, "hello")))
+	assert.NotEqual(t, key, responseCacheKey("sess-1", body("claude-sonnet-4-20250514", false, "hello")))
+	assert.NotEqual(t, key, responseCacheKey("sess-1", body("claude-3-5-haiku-20241022", true, "hello")))
+	assert.NotEqual(t, key, responseCacheKey("sess-1", body("claude-3-5-haiku-20241022", false, "hello again")))
+
+	// Every parameter counts except metadata
+	withSystem := body("claude-3-5-haiku-20241022", false, "hello")
+	withSystem["system"] = "Answer in French."
+	assert.NotEqual(t, key, responseCacheKey("sess-1", withSystem))
+	withMetadata := body("claude-3-5-haiku-20241022", false, "hello")
+	withMetadata["metadata"] = map[string]interface{}{"user_id": "u1"}
+	assert.Equal(t, key, responseCacheKey("sess-1", withMetadata))
+}
+
+func TestCacheBypassed(t *testing.T) {
+	assert.True(t, cacheBypassed("no-store"))
+	assert.True(t, cacheBypassed("max-age=0, No-Store"))
+	assert.False(t, cacheBypassed("no-cache"))
+	assert.False(t, cacheBypassed(""))
+}
+
+func TestSessionCacheGetSet(t *testing.T) {
+	cache := NewSessionCache(time.Minute)
+
+	_, ok := cache.Get("k")
+	assert.False(t, ok)
+
+	cache.Set("k", "application/json", []byte(`{"id":"msg_1"}`))
+	cached, ok := cache.Get("k")
+	require.True(t, ok)
+	assert.Equal(t, "application/json", cached.contentType)
+	assert.Equal(t, `{"id":"msg_1"}`, string(cached.body))
+}
+
+func TestSessionCacheExpires(t *testing.T) {
+	cache := NewSessionCache(time.Millisecond)
+	cache.Set("k", "application/json", []byte(`{}`))
+	time.Sleep(5 * time.Millisecond)
+
+	_, ok := cache.Get("k")
+	assert.False(t, ok)
+	assert.Empty(t, cache.entries)
+}
+
+func TestSessionCacheFromEnv(t *testing.T) {
+	t.Setenv("RESPONSE_CACHE_TTL_SECONDS", "")
+	assert.Nil(t, NewSessionCacheFromEnv())
+	t.Setenv("RESPONSE_CACHE_TTL_SECONDS", "0")
+	assert.Nil(t, NewSessionCacheFromEnv())
+	t.Setenv("RESPONSE_CACHE_TTL_SECONDS", "abc")
+	assert.Nil(t, NewSessionCacheFromEnv())
+
+	t.Setenv("RESPONSE_CACHE_TTL_SECONDS", "30")
+	cache := NewSessionCacheFromEnv()
+	require.NotNil(t, cache)
+	assert.Equal(t, 30*time.Second, cache.ttl)
+
+	// A nil cache caches nothing
+	var none *SessionCache
+	none.Set("k", "application/json", []byte(`{}`))
+	_, ok := none.Get("k")
+	assert.False(t, ok)
+}
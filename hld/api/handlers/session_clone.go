@@ -0,0 +1,176 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/humanlayer/humanlayer/hld/api"
+	"github.com/humanlayer/humanlayer/hld/store"
+)
+
+// CloneSessionRequest represents the optional body of a clone request
+type CloneSessionRequest struct {
+	CopyMessages bool `json:"copy_messages,omitempty"`
+}
+
+// CloneSession handles POST /sessions/:id/clone. It creates a draft session
+// with the original's configuration and a "Copy of" title, optionally
+// copying the stored conversation. Results, cost and token counts are not
+// carried over.
+func (h *SessionHandlers) CloneSession(c *gin.Context) {
+	ctx := c.Request.Context()
+	sessionID := c.Param("id")
+
+	var req CloneSessionRequest
+	// Allow an empty body
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, api.ErrorResponse{
+				Error: api.ErrorDetail{
+					Code:    "HLD-3001",
+					Message: fmt.Sprintf("Invalid request body: %v", err),
+				},
+			})
+			return
+		}
+	}
+
+	original, err := h.store.GetSession(ctx, sessionID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			c.JSON(http.StatusNotFound, api.ErrorResponse{
+				Error: api.ErrorDetail{
+					Code:    "HLD-1002",
+					Message: "Session not found",
+				},
+			})
+			return
+		}
+		slog.Error("Failed to get session",
+			"error", fmt.Sprintf("%v", err),
+			"session_id", sessionID,
+			"operation", "CloneSession",
+		)
+		c.JSON(http.StatusInternalServerError, api.ErrorResponse{
+			Error: api.ErrorDetail{Code: "HLD-4001", Message: err.Error()},
+		})
+		return
+	}
+
+	// Read the conversation before creating anything so a failure here
+	// doesn't leave an empty clone behind
+	var events []*store.ConversationEvent
+	if req.CopyMessages {
+		events, err = h.store.GetSessionConversation(ctx, sessionID)
+		if err != nil {
+			slog.Error("Failed to get session conversation",
+				"error", fmt.Sprintf("%v", err),
+				"session_id", sessionID,
+				"operation", "CloneSession",
+			)
+			c.JSON(http.StatusInternalServerError, api.ErrorResponse{
+				Error: api.ErrorDetail{Code: "HLD-4001", Message: err.Error()},
+			})
+			return
+		}
+	}
+
+	clone := cloneSession(original)
+	if err := h.store.CreateSession(ctx, clone); err != nil {
+		slog.Error("Failed to create cloned session",
+			"error", fmt.Sprintf("%v", err),
+			"session_id", sessionID,
+			"operation", "CloneSession",
+		)
+		c.JSON(http.StatusInternalServerError, api.ErrorResponse{
+			Error: api.ErrorDetail{Code: "HLD-4001", Message: err.Error()},
+		})
+		return
+	}
+
+	if err := h.copyEvents(ctx, clone, events); err != nil {
+		slog.Error("Failed to copy conversation event",
+			"error", fmt.Sprintf("%v", err),
+			"session_id", sessionID,
+			"clone_id", clone.ID,
+			"operation", "CloneSession",
+		)
+		c.JSON(http.StatusInternalServerError, api.ErrorResponse{
+			Error: api.ErrorDetail{Code: "HLD-4001", Message: err.Error()},
+		})
+		return
+	}
+
+	slog.Info("Cloned session",
+		"session_id", sessionID,
+		"clone_id", clone.ID,
+		"messages_copied", len(events))
+
+	c.JSON(http.StatusCreated, api.SessionResponse{
+		Data: h.mapper.SessionToAPI(*clone),
+	})
+}
+
+// copyEvents adds copies of events to the conversation of clone
+func (h *SessionHandlers) copyEvents(ctx context.Context, clone *store.Session, events []*store.ConversationEvent) error {
+	for _, event := range events {
+		copied := *event
+		copied.ID = 0
+		copied.SessionID = clone.ID
+		copied.ClaudeSessionID = clone.ClaudeSessionID
+		// Approvals belong to the original session
+		copied.ApprovalID = ""
+		if err := h.store.AddConversationEvent(ctx, &copied); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cloneSession returns a new draft session with s's title and configuration
+func cloneSession(s *store.Session) *store.Session {
+	id := uuid.New().String()
+	now := time.Now()
+
+	title := s.Title
+	if title != "" {
+		title = "Copy of " + title
+	}
+
+	return &store.Session{
+		ID:                    id,
+		RunID:                 id,
+		ClaudeSessionID:       id,
+		ParentSessionID:       s.ParentSessionID,
+		Query:                 s.Query,
+		Summary:               s.Summary,
+		Title:                 title,
+		Model:                 s.Model,
+		ModelID:               s.ModelID,
+		WorkingDir:            s.WorkingDir,
+		MaxTurns:              s.MaxTurns,
+		SystemPrompt:          s.SystemPrompt,
+		AppendSystemPrompt:    s.AppendSystemPrompt,
+		CustomInstructions:    s.CustomInstructions,
+		PermissionPromptTool:  s.PermissionPromptTool,
+		AllowedTools:          s.AllowedTools,
+		DisallowedTools:       s.DisallowedTools,
+		AdditionalDirectories: s.AdditionalDirectories,
+		Status:                store.SessionStatusDraft,
+		CreatedAt:             now,
+		LastActivityAt:        now,
+		AutoAcceptEdits:       s.AutoAcceptEdits,
+		ProxyEnabled:          s.ProxyEnabled,
+		ProxyBaseURL:          s.ProxyBaseURL,
+		ProxyModelOverride:    s.ProxyModelOverride,
+		ProxyAPIKey:           s.ProxyAPIKey,
+		EditorState:           s.EditorState,
+	}
+}
@@ -0,0 +1,119 @@
+package handlers_test
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/humanlayer/humanlayer/hld/api"
+	"github.com/humanlayer/humanlayer/hld/api/handlers"
+	"github.com/humanlayer/humanlayer/hld/approval"
+	"github.com/humanlayer/humanlayer/hld/session"
+	"github.com/humanlayer/humanlayer/hld/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/mock/gomock"
+)
+
+func TestSessionHandlers_CloneSession(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockManager := session.NewMockSessionManager(ctrl)
+	mockStore := store.NewMockConversationStore(ctrl)
+	mockApprovalManager := approval.NewMockManager(ctrl)
+
+	h := handlers.NewSessionHandlers(mockManager, mockStore, mockApprovalManager)
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.POST("/api/v1/sessions/:id/clone", h.CloneSession)
+
+	original := &store.Session{
+		ID:              "sess-123",
+		RunID:           "run-456",
+		ClaudeSessionID: "claude-789",
+		Title:           "Refactor parser",
+		Query:           "Refactor the parser",
+		Model:           "sonnet",
+		WorkingDir:      "/home/user/project",
+		AllowedTools:    `["Read"]`,
+		Status:          store.SessionStatusCompleted,
+		CostUSD:         floatPtr(0.05),
+		CreatedAt:       time.Now().Add(-time.Hour),
+		LastActivityAt:  time.Now().Add(-time.Hour),
+		AutoAcceptEdits: true,
+	}
+
+	t.Run("clone without messages", func(t *testing.T) {
+		var created *store.Session
+		mockStore.EXPECT().GetSession(gomock.Any(), "sess-123").Return(original, nil)
+		mockStore.EXPECT().CreateSession(gomock.Any(), gomock.Any()).
+			DoAndReturn(func(_ interface{}, s *store.Session) error {
+				created = s
+				return nil
+			})
+
+		w := makeRequest(t, router, "POST", "/api/v1/sessions/sess-123/clone", nil)
+		require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+
+		var resp api.SessionResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+
+		require.NotNil(t, created)
+		assert.NotEqual(t, original.ID, created.ID)
+		assert.Equal(t, created.ID, resp.Data.Id)
+		assert.Equal(t, "Copy of Refactor parser", created.Title)
+		assert.Equal(t, "sonnet", created.Model)
+		assert.Equal(t, "/home/user/project", created.WorkingDir)
+		assert.Equal(t, `["Read"]`, created.AllowedTools)
+		assert.True(t, created.AutoAcceptEdits)
+		assert.Equal(t, store.SessionStatusDraft, created.Status)
+		assert.Nil(t, created.CostUSD)
+	})
+
+	t.Run("clone with messages", func(t *testing.T) {
+		events := []*store.ConversationEvent{
+			{ID: 1, SessionID: "sess-123", ClaudeSessionID: "claude-789", EventType: "message", Role: "user", Content: "Hi"},
+			{ID: 2, SessionID: "sess-123", ClaudeSessionID: "claude-789", EventType: "message", Role: "assistant", Content: "Hello"},
+		}
+		var created *store.Session
+		var copied []store.ConversationEvent
+
+		mockStore.EXPECT().GetSession(gomock.Any(), "sess-123").Return(original, nil)
+		mockStore.EXPECT().GetSessionConversation(gomock.Any(), "sess-123").Return(events, nil)
+		mockStore.EXPECT().CreateSession(gomock.Any(), gomock.Any()).
+			DoAndReturn(func(_ interface{}, s *store.Session) error {
+				created = s
+				return nil
+			})
+		mockStore.EXPECT().AddConversationEvent(gomock.Any(), gomock.Any()).
+			DoAndReturn(func(_ interface{}, e *store.ConversationEvent) error {
+				copied = append(copied, *e)
+				return nil
+			}).Times(2)
+
+		w := makeRequest(t, router, "POST", "/api/v1/sessions/sess-123/clone", map[string]bool{"copy_messages": true})
+		require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+
+		require.Len(t, copied, 2)
+		for i, e := range copied {
+			assert.Equal(t, created.ID, e.SessionID)
+			assert.Equal(t, created.ClaudeSessionID, e.ClaudeSessionID)
+			assert.Equal(t, events[i].Content, e.Content)
+		}
+		// The original events are untouched
+		assert.Equal(t, "sess-123", events[0].SessionID)
+	})
+
+	t.Run("session not found", func(t *testing.T) {
+		mockStore.EXPECT().GetSession(gomock.Any(), "sess-999").Return(nil, sql.ErrNoRows)
+
+		w := makeRequest(t, router, "POST", "/api/v1/sessions/sess-999/clone", nil)
+
+		assert.Equal(t, http.StatusNotFound, w.Code)
+		assertErrorResponse(t, w, "HLD-1002", "Session not found")
+	})
+}
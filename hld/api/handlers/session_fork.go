@@ -0,0 +1,147 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/humanlayer/humanlayer/hld/api"
+	"github.com/humanlayer/humanlayer/hld/store"
+)
+
+// ForkSessionRequest represents the body of a fork request
+type ForkSessionRequest struct {
+	// AtMessageIndex is the message the fork branches at; messages before
+	// it are copied
+	AtMessageIndex *int `json:"at_message_index"`
+}
+
+// ForkSession handles POST /sessions/:id/fork. It creates a draft session
+// like CloneSession, copying the conversation up to, but not including,
+// message at_message_index, so a different response can be explored from
+// that point. Messages are counted from zero; tool calls and other events
+// are copied along with the messages they precede. at_message_index may be
+// at most the number of stored messages.
+func (h *SessionHandlers) ForkSession(c *gin.Context) {
+	ctx := c.Request.Context()
+	sessionID := c.Param("id")
+
+	var req ForkSessionRequest
+	if err := c.ShouldBindJSON(&req); err != nil || req.AtMessageIndex == nil {
+		message := "at_message_index is required"
+		if err != nil {
+			message = fmt.Sprintf("Invalid request body: %v", err)
+		}
+		c.JSON(http.StatusBadRequest, api.ErrorResponse{
+			Error: api.ErrorDetail{Code: "HLD-3001", Message: message},
+		})
+		return
+	}
+
+	original, err := h.store.GetSession(ctx, sessionID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			c.JSON(http.StatusNotFound, api.ErrorResponse{
+				Error: api.ErrorDetail{
+					Code:    "HLD-1002",
+					Message: "Session not found",
+				},
+			})
+			return
+		}
+		slog.Error("Failed to get session",
+			"error", fmt.Sprintf("%v", err),
+			"session_id", sessionID,
+			"operation", "ForkSession",
+		)
+		c.JSON(http.StatusInternalServerError, api.ErrorResponse{
+			Error: api.ErrorDetail{Code: "HLD-4001", Message: err.Error()},
+		})
+		return
+	}
+
+	events, err := h.store.GetSessionConversation(ctx, sessionID)
+	if err != nil {
+		slog.Error("Failed to get session conversation",
+			"error", fmt.Sprintf("%v", err),
+			"session_id", sessionID,
+			"operation", "ForkSession",
+		)
+		c.JSON(http.StatusInternalServerError, api.ErrorResponse{
+			Error: api.ErrorDetail{Code: "HLD-4001", Message: err.Error()},
+		})
+		return
+	}
+
+	prefix, messages, ok := eventsBeforeMessage(events, *req.AtMessageIndex)
+	if !ok {
+		c.JSON(http.StatusBadRequest, api.ErrorResponse{
+			Error: api.ErrorDetail{
+				Code:    "HLD-3001",
+				Message: fmt.Sprintf("at_message_index must be between 0 and %d", messages),
+			},
+		})
+		return
+	}
+
+	fork := cloneSession(original)
+	if original.Title != "" {
+		fork.Title = "Fork of " + original.Title
+	}
+	if err := h.store.CreateSession(ctx, fork); err != nil {
+		slog.Error("Failed to create forked session",
+			"error", fmt.Sprintf("%v", err),
+			"session_id", sessionID,
+			"operation", "ForkSession",
+		)
+		c.JSON(http.StatusInternalServerError, api.ErrorResponse{
+			Error: api.ErrorDetail{Code: "HLD-4001", Message: err.Error()},
+		})
+		return
+	}
+
+	if err := h.copyEvents(ctx, fork, prefix); err != nil {
+		slog.Error("Failed to copy conversation event",
+			"error", fmt.Sprintf("%v", err),
+			"session_id", sessionID,
+			"fork_id", fork.ID,
+			"operation", "ForkSession",
+		)
+		c.JSON(http.StatusInternalServerError, api.ErrorResponse{
+			Error: api.ErrorDetail{Code: "HLD-4001", Message: err.Error()},
+		})
+		return
+	}
+
+	slog.Info("Forked session",
+		"session_id", sessionID,
+		"fork_id", fork.ID,
+		"at_message_index", *req.AtMessageIndex,
+		"events_copied", len(prefix))
+
+	c.JSON(http.StatusCreated, api.SessionResponse{
+		Data: h.mapper.SessionToAPI(*fork),
+	})
+}
+
+// eventsBeforeMessage returns the events preceding message index n of
+// events, and the number of messages. ok is false when n is out of bounds.
+func eventsBeforeMessage(events []*store.ConversationEvent, n int) (prefix []*store.ConversationEvent, messages int, ok bool) {
+	end := len(events)
+	for i, event := range events {
+		if event.EventType != store.EventTypeMessage {
+			continue
+		}
+		if messages == n {
+			end = i
+		}
+		messages++
+	}
+	if n < 0 || n > messages {
+		return nil, messages, false
+	}
+	return events[:end], messages, true
+}
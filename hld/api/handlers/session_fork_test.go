@@ -0,0 +1,105 @@
+package handlers_test
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/humanlayer/humanlayer/hld/api"
+	"github.com/humanlayer/humanlayer/hld/api/handlers"
+	"github.com/humanlayer/humanlayer/hld/approval"
+	"github.com/humanlayer/humanlayer/hld/session"
+	"github.com/humanlayer/humanlayer/hld/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/mock/gomock"
+)
+
+func TestSessionHandlers_ForkSession(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockManager := session.NewMockSessionManager(ctrl)
+	mockStore := store.NewMockConversationStore(ctrl)
+	mockApprovalManager := approval.NewMockManager(ctrl)
+
+	h := handlers.NewSessionHandlers(mockManager, mockStore, mockApprovalManager)
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.POST("/api/v1/sessions/:id/fork", h.ForkSession)
+
+	original := &store.Session{
+		ID:              "sess-123",
+		ClaudeSessionID: "claude-789",
+		Title:           "Refactor parser",
+		Model:           "sonnet",
+		Status:          store.SessionStatusCompleted,
+	}
+	events := []*store.ConversationEvent{
+		{ID: 1, SessionID: "sess-123", EventType: store.EventTypeMessage, Role: "user", Content: "Find the parser"},
+		{ID: 2, SessionID: "sess-123", EventType: store.EventTypeToolCall, ToolName: "Grep"},
+		{ID: 3, SessionID: "sess-123", EventType: store.EventTypeToolResult, ToolResultContent: "parser.go"},
+		{ID: 4, SessionID: "sess-123", EventType: store.EventTypeMessage, Role: "assistant", Content: "It's in parser.go"},
+		{ID: 5, SessionID: "sess-123", EventType: store.EventTypeMessage, Role: "user", Content: "Refactor it"},
+	}
+
+	t.Run("copies the messages before the index", func(t *testing.T) {
+		var created *store.Session
+		var copied []store.ConversationEvent
+		mockStore.EXPECT().GetSession(gomock.Any(), "sess-123").Return(original, nil)
+		mockStore.EXPECT().GetSessionConversation(gomock.Any(), "sess-123").Return(events, nil)
+		mockStore.EXPECT().CreateSession(gomock.Any(), gomock.Any()).
+			DoAndReturn(func(_ interface{}, s *store.Session) error {
+				created = s
+				return nil
+			})
+		mockStore.EXPECT().AddConversationEvent(gomock.Any(), gomock.Any()).
+			DoAndReturn(func(_ interface{}, e *store.ConversationEvent) error {
+				copied = append(copied, *e)
+				return nil
+			}).Times(4)
+
+		w := makeRequest(t, router, "POST", "/api/v1/sessions/sess-123/fork", map[string]int{"at_message_index": 2})
+		require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+
+		var resp api.SessionResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		require.NotNil(t, created)
+		assert.Equal(t, created.ID, resp.Data.Id)
+		assert.NotEqual(t, original.ID, created.ID)
+		assert.Equal(t, "Fork of Refactor parser", created.Title)
+		assert.Equal(t, store.SessionStatusDraft, created.Status)
+
+		require.Len(t, copied, 4)
+		for i, e := range copied {
+			assert.Equal(t, created.ID, e.SessionID)
+			assert.Equal(t, events[i].EventType, e.EventType)
+		}
+		assert.Equal(t, "It's in parser.go", copied[3].Content)
+	})
+
+	t.Run("index out of bounds", func(t *testing.T) {
+		mockStore.EXPECT().GetSession(gomock.Any(), "sess-123").Return(original, nil)
+		mockStore.EXPECT().GetSessionConversation(gomock.Any(), "sess-123").Return(events, nil)
+
+		w := makeRequest(t, router, "POST", "/api/v1/sessions/sess-123/fork", map[string]int{"at_message_index": 4})
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assertErrorResponse(t, w, "HLD-3001", "at_message_index must be between 0 and 3")
+	})
+
+	t.Run("index missing", func(t *testing.T) {
+		w := makeRequest(t, router, "POST", "/api/v1/sessions/sess-123/fork", map[string]int{})
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assertErrorResponse(t, w, "HLD-3001", "at_message_index is required")
+	})
+
+	t.Run("session not found", func(t *testing.T) {
+		mockStore.EXPECT().GetSession(gomock.Any(), "sess-999").Return(nil, sql.ErrNoRows)
+
+		w := makeRequest(t, router, "POST", "/api/v1/sessions/sess-999/fork", map[string]int{"at_message_index": 0})
+		assert.Equal(t, http.StatusNotFound, w.Code)
+		assertErrorResponse(t, w, "HLD-1002", "Session not found")
+	})
+}
@@ -0,0 +1,1011 @@
+package middleware
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"your-project/hld/firebase"
+	"your-project/hld/internal/apierror"
+)
+
+// maxImportBodyBytes caps the size of a bulk import upload
+const maxImportBodyBytes = 10 << 20
+
+// AdminHandlers exposes operational endpoints backed by the Firebase client
+type AdminHandlers struct {
+	firebaseClient *firebase.Client
+	plans          Plans
+}
+
+// NewAdminHandlers creates admin handlers for the given Firebase client
+func NewAdminHandlers(fbClient *firebase.Client, plans Plans) *AdminHandlers {
+	return &AdminHandlers{firebaseClient: fbClient, plans: plans}
+}
+
+// client returns the Firebase client for the request's tenant
+func (h *AdminHandlers) client(r *http.Request) *firebase.Client {
+	return clientFromContext(r.Context(), h.firebaseClient)
+}
+
+// RegisterRoutes mounts the admin endpoints on mux. The handlers don't
+// check who is calling, so serve mux behind CheckAuth and RequireAdmin:
+//
+//	handler := m.CheckAuth(RequireAdmin(mux))
+func (h *AdminHandlers) RegisterRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("/admin/users", h.ListUsers)
+	mux.HandleFunc("/admin/users/import", h.ImportUsers)
+	mux.HandleFunc("/admin/users/by-email", h.GetUserByEmail)
+	mux.HandleFunc("/admin/usage/export", h.ExportUsage)
+	mux.HandleFunc("/admin/usage/compact", h.CompactUsage)
+	mux.HandleFunc("/admin/sessions/{id}/transfer", h.TransferSession)
+	mux.HandleFunc("/admin/users/{id}/status", h.SetUserStatus)
+	mux.HandleFunc("/admin/users/{id}/reserve", h.SetReservedPoints)
+	mux.HandleFunc("/admin/users/{id}/admin", h.SetAdmin)
+	mux.HandleFunc("/admin/users/{id}/points", h.UserPoints)
+	mux.HandleFunc("/admin/users/{id}/ledger", h.Ledger)
+	mux.HandleFunc("/admin/users/{id}/pricing", h.PricingOverride)
+	mux.HandleFunc("/admin/flagged-usage", h.ListFlaggedUsage)
+	mux.HandleFunc("/admin/maintenance", h.Maintenance)
+	mux.HandleFunc("/admin/impersonate", h.Impersonate)
+	mux.HandleFunc("/admin/nonces", h.CreateNonce)
+}
+
+// ImportUsersResponse summarizes a bulk import
+type ImportUsersResponse struct {
+	Total   int                       `json:"total"`
+	Created int                       `json:"created"`
+	Skipped int                       `json:"skipped"`
+	Failed  int                       `json:"failed"`
+	Results []firebase.UserInitResult `json:"results"`
+}
+
+// ImportUsers provisions users from a CSV (text/csv) or JSON upload of at
+// most maxImportBodyBytes.
+// CSV uploads must have a header row with user_id, email, plan and points columns.
+// JSON uploads are either an array of users or {"users": [...]}.
+func (h *AdminHandlers) ImportUsers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, APIError{Code: apierror.CodeMethodNotAllowed, Message: "POST required"})
+		return
+	}
+
+	body := http.MaxBytesReader(w, r.Body, maxImportBodyBytes)
+
+	var users []firebase.UserInit
+	var err error
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "text/csv") {
+		users, err = parseUserCSV(body)
+	} else {
+		users, err = parseUserJSON(body)
+	}
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		writeError(w, http.StatusRequestEntityTooLarge, APIError{
+			Code:    apierror.CodeRequestTooLarge,
+			Message: "Import is too large",
+			Details: map[string]interface{}{"max_bytes": tooLarge.Limit},
+		})
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, APIError{
+			Code:    apierror.CodeInvalidImport,
+			Message: err.Error(),
+		})
+		return
+	}
+
+	results, err := h.client(r).BulkInitializeUsers(r.Context(), users)
+	if err != nil {
+		logger().Error("bulk user import interrupted", "error", err)
+	}
+
+	resp := ImportUsersResponse{Total: len(users), Results: results}
+	for _, res := range results {
+		switch {
+		case res.Error != "":
+			resp.Failed++
+		case res.Created:
+			resp.Created++
+		default:
+			resp.Skipped++
+		}
+	}
+
+	logger().Info("bulk user import completed",
+		"total", resp.Total,
+		"created", resp.Created,
+		"skipped", resp.Skipped,
+		"failed", resp.Failed)
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// Pagination bounds for admin listings
+const (
+	defaultListLimit = 50
+	maxListLimit     = 500
+)
+
+// ListUsersResponse is a page of users
+type ListUsersResponse struct {
+	Users  []firebase.UserData `json:"users"`
+	Total  int64               `json:"total"`
+	Offset int                 `json:"offset"`
+	Limit  int                 `json:"limit"`
+}
+
+// ListUsers lists users filtered by plan and points range.
+// Query params: plan, min_points, max_points, sort_by (total_used, created_at,
+// last_request), order (asc, desc; default desc), offset, limit.
+func (h *AdminHandlers) ListUsers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, APIError{Code: apierror.CodeMethodNotAllowed, Message: "GET required"})
+		return
+	}
+
+	q := r.URL.Query()
+	filter := firebase.UserFilter{
+		Plan:       q.Get("plan"),
+		SortBy:     q.Get("sort_by"),
+		Descending: q.Get("order") != "asc",
+		Limit:      defaultListLimit,
+	}
+
+	var err error
+	if filter.MinPoints, err = optionalIntParam(q.Get("min_points")); err != nil {
+		writeBadParam(w, "min_points", err)
+		return
+	}
+	if filter.MaxPoints, err = optionalIntParam(q.Get("max_points")); err != nil {
+		writeBadParam(w, "max_points", err)
+		return
+	}
+	if raw := q.Get("offset"); raw != "" {
+		if filter.Offset, err = strconv.Atoi(raw); err != nil || filter.Offset < 0 {
+			writeBadParam(w, "offset", fmt.Errorf("must be a non-negative integer"))
+			return
+		}
+	}
+	if raw := q.Get("limit"); raw != "" {
+		if filter.Limit, err = strconv.Atoi(raw); err != nil || filter.Limit < 1 || filter.Limit > maxListLimit {
+			writeBadParam(w, "limit", fmt.Errorf("must be between 1 and %d", maxListLimit))
+			return
+		}
+	}
+	switch filter.SortBy {
+	case "", firebase.SortByTotalUsed, firebase.SortByCreatedAt, firebase.SortByLastRequest:
+	default:
+		writeBadParam(w, "sort_by", fmt.Errorf("must be one of total_used, created_at, last_request"))
+		return
+	}
+
+	users, total, err := h.client(r).ListUsers(r.Context(), filter)
+	if err != nil {
+		logger().Error("failed to list users", "error", err)
+		writeError(w, http.StatusInternalServerError, APIError{
+			Code:    apierror.CodeInternalError,
+			Message: "Failed to list users",
+		})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, ListUsersResponse{
+		Users:  users,
+		Total:  total,
+		Offset: filter.Offset,
+		Limit:  filter.Limit,
+	})
+}
+
+// GetUserByEmail returns the record of the user with the given email.
+// Query params: email.
+func (h *AdminHandlers) GetUserByEmail(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, APIError{Code: apierror.CodeMethodNotAllowed, Message: "GET required"})
+		return
+	}
+
+	email := strings.TrimSpace(r.URL.Query().Get("email"))
+	if email == "" {
+		writeBadParam(w, "email", fmt.Errorf("is required"))
+		return
+	}
+
+	user, err := h.client(r).GetUserByEmail(r.Context(), email)
+	switch {
+	case errors.Is(err, firebase.ErrUserNotFound):
+		writeError(w, http.StatusNotFound, APIError{Code: apierror.CodeUserNotFound, Message: "User not found"})
+		return
+	case err != nil:
+		logger().Error("failed to look up user by email", "error", err)
+		writeError(w, http.StatusInternalServerError, APIError{
+			Code:    apierror.CodeInternalError,
+			Message: "Failed to look up user",
+		})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, user)
+}
+
+// ListFlaggedUsageResponse is the newest flagged usage entries
+type ListFlaggedUsageResponse struct {
+	Entries []firebase.FlaggedUsage `json:"entries"`
+	Limit   int                     `json:"limit"`
+}
+
+// ListFlaggedUsage lists requests flagged for exceeding
+// SUSPICIOUS_TOKEN_THRESHOLD, newest first.
+// Query params: user_id, limit.
+func (h *AdminHandlers) ListFlaggedUsage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, APIError{Code: apierror.CodeMethodNotAllowed, Message: "GET required"})
+		return
+	}
+
+	q := r.URL.Query()
+	limit := defaultListLimit
+	if raw := q.Get("limit"); raw != "" {
+		var err error
+		if limit, err = strconv.Atoi(raw); err != nil || limit < 1 || limit > maxListLimit {
+			writeBadParam(w, "limit", fmt.Errorf("must be between 1 and %d", maxListLimit))
+			return
+		}
+	}
+
+	entries, err := h.client(r).ListFlaggedUsage(r.Context(), q.Get("user_id"), limit)
+	if err != nil {
+		logger().Error("failed to list flagged usage", "error", err)
+		writeError(w, http.StatusInternalServerError, APIError{
+			Code:    apierror.CodeInternalError,
+			Message: "Failed to list flagged usage",
+		})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, ListFlaggedUsageResponse{Entries: entries, Limit: limit})
+}
+
+// ExportUsage streams usage logs as a file download.
+// Query params: format (csv or jsonl, default csv), user_id, model,
+// from and to (RFC3339 or YYYY-MM-DD), success_only, include_anonymous,
+// include_service. Anonymous trial and service account usage are left out
+// unless include_anonymous=true and include_service=true.
+func (h *AdminHandlers) ExportUsage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, APIError{Code: apierror.CodeMethodNotAllowed, Message: "GET required"})
+		return
+	}
+
+	q := r.URL.Query()
+	format := q.Get("format")
+	if format == "" {
+		format = firebase.ExportFormatCSV
+	}
+
+	var contentType string
+	switch format {
+	case firebase.ExportFormatCSV:
+		contentType = "text/csv"
+	case firebase.ExportFormatJSONL:
+		contentType = "application/x-ndjson"
+	default:
+		writeBadParam(w, "format", fmt.Errorf("must be csv or jsonl"))
+		return
+	}
+
+	filter := firebase.UsageFilter{
+		UserID:      q.Get("user_id"),
+		Model:       q.Get("model"),
+		SuccessOnly: q.Get("success_only") == "true",
+
+		IncludeAnonymous: q.Get("include_anonymous") == "true",
+		IncludeService:   q.Get("include_service") == "true",
+	}
+	var err error
+	if filter.From, err = parseTimeParam(q.Get("from"), false); err != nil {
+		writeBadParam(w, "from", err)
+		return
+	}
+	if filter.To, err = parseTimeParam(q.Get("to"), true); err != nil {
+		writeBadParam(w, "to", err)
+		return
+	}
+
+	filename := fmt.Sprintf("usage-%s.%s", time.Now().UTC().Format("20060102-150405"), format)
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, filename))
+	w.WriteHeader(http.StatusOK)
+
+	// Headers are already sent, so failures can only be logged
+	store := usageStoreFromContext(r.Context(), h.client(r))
+	if err := store.ExportUsage(r.Context(), filter, w, format); err != nil {
+		logger().Error("usage export failed", "format", format, "error", err)
+		return
+	}
+
+	logger().Info("usage export completed", "format", format, "user_id", filter.UserID)
+}
+
+// CompactUsage rolls raw usage logs into monthly aggregates and deletes
+// them, as the background compaction does.
+// Query params: older_than_days (default USAGE_LOG_RETENTION_DAYS or 90),
+// dry_run (true reports what would be compacted without changing anything).
+func (h *AdminHandlers) CompactUsage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, APIError{Code: apierror.CodeMethodNotAllowed, Message: "POST required"})
+		return
+	}
+
+	q := r.URL.Query()
+	olderThan := usageLogRetentionFromEnv()
+	if raw := q.Get("older_than_days"); raw != "" {
+		days, err := strconv.Atoi(raw)
+		if err != nil || days < 1 {
+			writeBadParam(w, "older_than_days", fmt.Errorf("must be a positive integer"))
+			return
+		}
+		olderThan = time.Duration(days) * 24 * time.Hour
+	}
+	dryRun := q.Get("dry_run") == "true"
+
+	var opts []firebase.CompactOption
+	if dryRun {
+		opts = append(opts, firebase.CompactDryRun())
+	}
+	report, err := h.client(r).CompactUsageLogs(r.Context(), olderThan, opts...)
+	switch {
+	case errors.Is(err, firebase.ErrCompactionRunning):
+		writeError(w, http.StatusConflict, APIError{Code: apierror.CodeCompactionRunning, Message: "A compaction is already running"})
+		return
+	case err != nil:
+		logger().Error("usage compaction failed", "dry_run", dryRun, "error", err)
+		writeError(w, http.StatusInternalServerError, APIError{Code: apierror.CodeInternalError, Message: "Failed to compact usage logs"})
+		return
+	}
+
+	if !dryRun {
+		err := h.client(r).LogAdminAction(r.Context(), firebase.AdminAuditEntry{
+			Action:  "compact_usage",
+			ActorID: adminActor(r.Context()),
+			Details: map[string]string{
+				"cutoff":         report.Cutoff.Format(time.RFC3339),
+				"logs_compacted": strconv.Itoa(report.LogsCompacted),
+			},
+		})
+		if err != nil {
+			logger().Error("usage compaction not audited", "error", err)
+		}
+	}
+
+	writeJSON(w, http.StatusOK, report)
+}
+
+// TransferSessionRequest is the body for a session transfer
+type TransferSessionRequest struct {
+	ToUserID string `json:"to_user_id"`
+}
+
+// TransferSession moves a session to another user. The target user must
+// exist and be on the same or a higher plan tier than the current owner.
+// Requires a nonce; see CreateNonce.
+func (h *AdminHandlers) TransferSession(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, APIError{Code: apierror.CodeMethodNotAllowed, Message: "POST required"})
+		return
+	}
+
+	sessionID := r.PathValue("id")
+
+	var req TransferSessionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ToUserID == "" {
+		writeError(w, http.StatusBadRequest, APIError{
+			Code:    apierror.CodeInvalidRequest,
+			Message: "to_user_id is required",
+		})
+		return
+	}
+
+	session, err := h.client(r).GetSession(r.Context(), sessionID)
+	if errors.Is(err, firebase.ErrSessionNotFound) {
+		writeError(w, http.StatusNotFound, APIError{Code: apierror.CodeSessionNotFound, Message: "Session not found"})
+		return
+	}
+	if err != nil {
+		logger().Error("failed to get session for transfer", "session_id", sessionID, "error", err)
+		writeError(w, http.StatusInternalServerError, APIError{Code: apierror.CodeInternalError, Message: "Failed to load session"})
+		return
+	}
+	if session.UserID == req.ToUserID {
+		writeError(w, http.StatusConflict, APIError{Code: apierror.CodeAlreadyOwner, Message: "Session already belongs to this user"})
+		return
+	}
+
+	target, err := h.client(r).GetUserData(r.Context(), req.ToUserID)
+	if err != nil {
+		logger().Error("failed to get target user for transfer", "user_id", req.ToUserID, "error", err)
+		writeError(w, http.StatusInternalServerError, APIError{Code: apierror.CodeInternalError, Message: "Failed to load target user"})
+		return
+	}
+	if target.CreatedAt.IsZero() {
+		writeError(w, http.StatusNotFound, APIError{Code: apierror.CodeUserNotFound, Message: "Target user does not exist"})
+		return
+	}
+
+	sourcePlan, err := h.client(r).GetUserPlan(r.Context(), session.UserID)
+	if err != nil {
+		logger().Error("failed to get owner plan for transfer", "user_id", session.UserID, "error", err)
+		writeError(w, http.StatusInternalServerError, APIError{Code: apierror.CodeInternalError, Message: "Failed to load current owner"})
+		return
+	}
+	targetPlan := target.Plan
+	if targetPlan == "" {
+		targetPlan = "free"
+	}
+	if h.plans.Tier(targetPlan) < h.plans.Tier(sourcePlan) {
+		writeError(w, http.StatusUnprocessableEntity, APIError{
+			Code:    apierror.CodePlanTierTooLow,
+			Message: "Target user's plan is lower than the current owner's",
+			Details: map[string]interface{}{"from_plan": sourcePlan, "to_plan": targetPlan},
+		})
+		return
+	}
+
+	if !h.consumeNonce(w, r) {
+		return
+	}
+	transferredBy := adminActor(r.Context())
+	transfer, err := h.client(r).TransferSession(r.Context(), sessionID, session.UserID, req.ToUserID, transferredBy)
+	if errors.Is(err, firebase.ErrSessionOwnerChanged) {
+		writeError(w, http.StatusConflict, APIError{Code: apierror.CodeOwnerChanged, Message: "Session owner changed during transfer, please retry"})
+		return
+	}
+	if err != nil && transfer == nil {
+		logger().Error("failed to transfer session", "session_id", sessionID, "error", err)
+		writeError(w, http.StatusInternalServerError, APIError{Code: apierror.CodeInternalError, Message: "Failed to transfer session"})
+		return
+	}
+	if err != nil {
+		// Ownership changed; only the audit record failed
+		logger().Error("session transfer not recorded", "session_id", sessionID, "error", err)
+	}
+
+	logger().Info("session transferred",
+		"session_id", sessionID,
+		"from_user_id", transfer.FromUserID,
+		"to_user_id", transfer.ToUserID,
+		"transferred_by", transferredBy)
+
+	writeJSON(w, http.StatusOK, transfer)
+}
+
+// parseTimeParam parses an RFC3339 timestamp or a YYYY-MM-DD date. Dates used
+// as an upper bound cover the whole day.
+func parseTimeParam(raw string, endOfDay bool) (time.Time, error) {
+	if raw == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, raw); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse("2006-01-02", raw)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("must be RFC3339 or YYYY-MM-DD")
+	}
+	if endOfDay {
+		t = t.Add(24*time.Hour - time.Nanosecond)
+	}
+	return t, nil
+}
+
+// optionalIntParam parses an optional integer query parameter
+func optionalIntParam(raw string) (*int, error) {
+	if raw == "" {
+		return nil, nil
+	}
+	v, err := strconv.Atoi(raw)
+	if err != nil {
+		return nil, fmt.Errorf("must be an integer")
+	}
+	return &v, nil
+}
+
+// writeBadParam reports an invalid query parameter
+func writeBadParam(w http.ResponseWriter, param string, err error) {
+	writeError(w, http.StatusBadRequest, APIError{
+		Code:    apierror.CodeInvalidParameter,
+		Message: fmt.Sprintf("%s %v", param, err),
+		Details: map[string]interface{}{"parameter": param},
+	})
+}
+
+// parseUserJSON accepts either a bare array or an object with a users field
+func parseUserJSON(r io.Reader) ([]firebase.UserInit, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read body: %w", err)
+	}
+
+	var users []firebase.UserInit
+	if err := json.Unmarshal(data, &users); err == nil {
+		return users, nil
+	}
+
+	var wrapped struct {
+		Users []firebase.UserInit `json:"users"`
+	}
+	if err := json.Unmarshal(data, &wrapped); err != nil {
+		return nil, fmt.Errorf("invalid JSON: %w", err)
+	}
+	return wrapped.Users, nil
+}
+
+// parseUserCSV reads users from a CSV with a header row
+func parseUserCSV(r io.Reader) ([]firebase.UserInit, error) {
+	reader := csv.NewReader(r)
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CSV header: %w", err)
+	}
+
+	columns := make(map[string]int, len(header))
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	if _, ok := columns["user_id"]; !ok {
+		return nil, fmt.Errorf("CSV header must include user_id")
+	}
+
+	field := func(record []string, name string) string {
+		if i, ok := columns[name]; ok && i < len(record) {
+			return strings.TrimSpace(record[i])
+		}
+		return ""
+	}
+
+	var users []firebase.UserInit
+	for line := 2; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CSV line %d: %w", line, err)
+		}
+
+		u := firebase.UserInit{
+			UserID: field(record, "user_id"),
+			Email:  field(record, "email"),
+			Plan:   field(record, "plan"),
+		}
+		if raw := field(record, "points"); raw != "" {
+			points, err := strconv.Atoi(raw)
+			if err != nil {
+				return nil, fmt.Errorf("invalid points on CSV line %d: %w", line, err)
+			}
+			u.Points = &points
+		}
+		users = append(users, u)
+	}
+
+	return users, nil
+}
+
+// writeJSON writes v as a JSON response with the given status code
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logger().Error("failed to encode JSON response", "error", err)
+	}
+}
+
+// statusReasonPattern restricts reason codes, which are shown to the user,
+// to short identifiers so free-form notes can't leak through them
+var statusReasonPattern = regexp.MustCompile(`^[a-z0-9_]{1,64}$`)
+
+// SetUserStatusRequest is the body for changing a user's status
+type SetUserStatusRequest struct {
+	Status string `json:"status"`
+	// Reason is a short code returned to the user, e.g. "abuse"
+	Reason string `json:"reason,omitempty"`
+	// Note is kept in the audit log only and never shown to the user
+	Note string `json:"note,omitempty"`
+}
+
+// SetUserStatus suspends, bans or reactivates a user and records the change
+// in the admin audit log
+func (h *AdminHandlers) SetUserStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, APIError{Code: apierror.CodeMethodNotAllowed, Message: "POST required"})
+		return
+	}
+
+	userID := r.PathValue("id")
+
+	var req SetUserStatusRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || !firebase.IsValidUserStatus(req.Status) {
+		writeError(w, http.StatusBadRequest, APIError{
+			Code:    apierror.CodeInvalidRequest,
+			Message: "status must be one of active, suspended or banned",
+		})
+		return
+	}
+	if req.Reason != "" && !statusReasonPattern.MatchString(req.Reason) {
+		writeError(w, http.StatusBadRequest, APIError{
+			Code:    apierror.CodeInvalidRequest,
+			Message: "reason must be a short code of lowercase letters, digits and underscores",
+		})
+		return
+	}
+
+	err := h.client(r).SetUserStatus(r.Context(), userID, req.Status, req.Reason)
+	if errors.Is(err, firebase.ErrUserNotFound) {
+		writeError(w, http.StatusNotFound, APIError{Code: apierror.CodeUserNotFound, Message: "User not found"})
+		return
+	}
+	if err != nil {
+		logger().Error("failed to set user status", "user_id", userID, "status", req.Status, "error", err)
+		writeError(w, http.StatusInternalServerError, APIError{Code: apierror.CodeInternalError, Message: "Failed to update user status"})
+		return
+	}
+
+	actorID := adminActor(r.Context())
+	details := map[string]string{"status": req.Status}
+	if req.Reason != "" {
+		details["reason"] = req.Reason
+	}
+	if req.Note != "" {
+		details["note"] = req.Note
+	}
+	err = h.client(r).LogAdminAction(r.Context(), firebase.AdminAuditEntry{
+		Action:       "set_user_status",
+		TargetUserID: userID,
+		ActorID:      actorID,
+		Details:      details,
+	})
+	if err != nil {
+		// The status change stands; only the audit record failed
+		logger().Error("user status change not audited", "user_id", userID, "error", err)
+	}
+
+	logger().Info("user status changed",
+		"user_id", userID,
+		"status", req.Status,
+		"reason", req.Reason,
+		"actor_id", actorID)
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"user_id": userID,
+		"status":  req.Status,
+		"reason":  req.Reason,
+	})
+}
+
+// SetReservedPointsRequest is the body for changing a user's points reserve
+type SetReservedPointsRequest struct {
+	ReservedPoints *int `json:"reserved_points"`
+}
+
+// SetReservedPoints sets how many of a user's points are kept back from
+// normal API traffic and records the change in the admin audit log
+func (h *AdminHandlers) SetReservedPoints(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, APIError{Code: apierror.CodeMethodNotAllowed, Message: "POST required"})
+		return
+	}
+
+	userID := r.PathValue("id")
+
+	var req SetReservedPointsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ReservedPoints == nil || *req.ReservedPoints < 0 {
+		writeError(w, http.StatusBadRequest, APIError{
+			Code:    apierror.CodeInvalidRequest,
+			Message: "reserved_points must be a non-negative integer",
+		})
+		return
+	}
+	reserved := *req.ReservedPoints
+
+	err := h.client(r).SetReservedPoints(r.Context(), userID, reserved)
+	if errors.Is(err, firebase.ErrUserNotFound) {
+		writeError(w, http.StatusNotFound, APIError{Code: apierror.CodeUserNotFound, Message: "User not found"})
+		return
+	}
+	if err != nil {
+		logger().Error("failed to set reserved points", "user_id", userID, "reserved_points", reserved, "error", err)
+		writeError(w, http.StatusInternalServerError, APIError{Code: apierror.CodeInternalError, Message: "Failed to update reserved points"})
+		return
+	}
+
+	actorID := adminActor(r.Context())
+	err = h.client(r).LogAdminAction(r.Context(), firebase.AdminAuditEntry{
+		Action:       "set_reserved_points",
+		TargetUserID: userID,
+		ActorID:      actorID,
+		Details:      map[string]string{"reserved_points": strconv.Itoa(reserved)},
+	})
+	if err != nil {
+		logger().Error("reserved points change not audited", "user_id", userID, "error", err)
+	}
+
+	logger().Info("reserved points changed", "user_id", userID, "reserved_points", reserved, "actor_id", actorID)
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"user_id":         userID,
+		"reserved_points": reserved,
+	})
+}
+
+// UserPoints adjusts a user's balance by a delta (POST, see AdjustPoints) or
+// sets it to an exact value (PUT, see SetPoints)
+func (h *AdminHandlers) UserPoints(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+		h.AdjustPoints(w, r)
+	case http.MethodPut:
+		h.SetPoints(w, r)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, APIError{Code: apierror.CodeMethodNotAllowed, Message: "POST or PUT required"})
+	}
+}
+
+// AdjustPointsRequest is the body for a manual points adjustment
+type AdjustPointsRequest struct {
+	// Delta credits the user when positive and debits when negative
+	Delta  int    `json:"delta"`
+	Reason string `json:"reason"`
+}
+
+// AdjustPoints manually credits or debits a user's points, e.g. for refunds
+// or corrections, and records the admin, reason and balances in
+// admin_adjustments. Debits may not take the balance below
+// POINTS_OVERDRAFT_LIMIT. Requires a nonce; see CreateNonce.
+func (h *AdminHandlers) AdjustPoints(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, APIError{Code: apierror.CodeMethodNotAllowed, Message: "POST required"})
+		return
+	}
+
+	userID := r.PathValue("id")
+
+	var req AdjustPointsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Delta == 0 {
+		writeError(w, http.StatusBadRequest, APIError{
+			Code:    apierror.CodeInvalidRequest,
+			Message: "delta must be a non-zero integer",
+		})
+		return
+	}
+	req.Reason = strings.TrimSpace(req.Reason)
+	if req.Reason == "" {
+		writeError(w, http.StatusBadRequest, APIError{
+			Code:    apierror.CodeInvalidRequest,
+			Message: "reason is required",
+		})
+		return
+	}
+
+	if !h.consumeNonce(w, r) {
+		return
+	}
+	actorID := adminActor(r.Context())
+	adj, err := h.client(r).AdjustPoints(r.Context(), userID, req.Delta, actorID, req.Reason)
+	switch {
+	case errors.Is(err, firebase.ErrUserNotFound):
+		writeError(w, http.StatusNotFound, APIError{Code: apierror.CodeUserNotFound, Message: "User not found"})
+		return
+	case errors.Is(err, firebase.ErrOverdraftLimit):
+		writeError(w, http.StatusUnprocessableEntity, APIError{
+			Code:    apierror.CodeOverdraftLimitExceeded,
+			Message: "Adjustment would take the balance below the overdraft limit",
+		})
+		return
+	case err != nil && adj == nil:
+		logger().Error("failed to adjust points", "user_id", userID, "delta", req.Delta, "error", err)
+		writeError(w, http.StatusInternalServerError, APIError{Code: apierror.CodeInternalError, Message: "Failed to adjust points"})
+		return
+	case err != nil:
+		// The balance changed; only the adjustment record failed
+		logger().Error("points adjustment not audited", "user_id", userID, "delta", req.Delta, "error", err)
+	}
+
+	logger().Info("points adjusted",
+		"user_id", userID,
+		"delta", req.Delta,
+		"balance", adj.BalanceAfter,
+		"actor_id", actorID)
+	writeJSON(w, http.StatusOK, adj)
+}
+
+// SetPointsRequest is the body for setting a user's exact balance
+type SetPointsRequest struct {
+	Points *int   `json:"points"`
+	Reason string `json:"reason"`
+}
+
+// SetPoints sets a user's balance to an exact value for customer support,
+// recording the admin, reason and old and new balances in
+// admin_adjustments. Requires a nonce (see CreateNonce), so failed
+// requests are retried with a new one.
+func (h *AdminHandlers) SetPoints(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		writeError(w, http.StatusMethodNotAllowed, APIError{Code: apierror.CodeMethodNotAllowed, Message: "PUT required"})
+		return
+	}
+
+	userID := r.PathValue("id")
+
+	var req SetPointsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Points == nil || *req.Points < 0 {
+		writeError(w, http.StatusBadRequest, APIError{
+			Code:    apierror.CodeInvalidRequest,
+			Message: "points must be a non-negative integer",
+		})
+		return
+	}
+	req.Reason = strings.TrimSpace(req.Reason)
+	if req.Reason == "" {
+		writeError(w, http.StatusBadRequest, APIError{
+			Code:    apierror.CodeInvalidRequest,
+			Message: "reason is required",
+		})
+		return
+	}
+	points := *req.Points
+
+	if !h.consumeNonce(w, r) {
+		return
+	}
+	actorID := adminActor(r.Context())
+	err := h.client(r).SetPoints(r.Context(), userID, points, actorID, req.Reason)
+	switch {
+	case errors.Is(err, firebase.ErrUserNotFound):
+		writeError(w, http.StatusNotFound, APIError{Code: apierror.CodeUserNotFound, Message: "User not found"})
+		return
+	case err != nil:
+		logger().Error("failed to set points", "user_id", userID, "points", points, "error", err)
+		writeError(w, http.StatusInternalServerError, APIError{Code: apierror.CodeInternalError, Message: "Failed to set points"})
+		return
+	}
+
+	logger().Info("points set", "user_id", userID, "points", points, "actor_id", actorID)
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"user_id": userID,
+		"points":  points,
+	})
+}
+
+// SetAdminRequest is the body for granting or revoking admin access
+type SetAdminRequest struct {
+	Admin *bool `json:"admin"`
+}
+
+// SetAdmin grants or revokes a user's admin custom claim and records the
+// change in the admin audit log. Users listed in ADMIN_UIDS stay admins
+// regardless of the claim.
+func (h *AdminHandlers) SetAdmin(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, APIError{Code: apierror.CodeMethodNotAllowed, Message: "POST required"})
+		return
+	}
+
+	userID := r.PathValue("id")
+
+	var req SetAdminRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Admin == nil {
+		writeError(w, http.StatusBadRequest, APIError{
+			Code:    apierror.CodeInvalidRequest,
+			Message: "admin must be true or false",
+		})
+		return
+	}
+	admin := *req.Admin
+
+	actorID := adminActor(r.Context())
+	if !admin && userID == actorID {
+		writeError(w, http.StatusBadRequest, APIError{
+			Code:    apierror.CodeInvalidRequest,
+			Message: "Admins can't revoke their own access",
+		})
+		return
+	}
+
+	if err := h.client(r).SetAdminClaim(r.Context(), userID, admin); err != nil {
+		logger().Error("failed to set admin claim", "user_id", userID, "admin", admin, "error", err)
+		writeError(w, http.StatusInternalServerError, APIError{Code: apierror.CodeInternalError, Message: "Failed to update admin access"})
+		return
+	}
+
+	err := h.client(r).LogAdminAction(r.Context(), firebase.AdminAuditEntry{
+		Action:       "set_admin",
+		TargetUserID: userID,
+		ActorID:      actorID,
+		Details:      map[string]string{"admin": strconv.FormatBool(admin)},
+	})
+	if err != nil {
+		logger().Error("admin access change not audited", "user_id", userID, "error", err)
+	}
+
+	logger().Info("admin access changed", "user_id", userID, "admin", admin, "actor_id", actorID)
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"user_id": userID,
+		"admin":   admin,
+	})
+}
+
+// SetMaintenanceRequest is the body for turning maintenance mode on or off
+type SetMaintenanceRequest struct {
+	Enabled           *bool  `json:"enabled"`
+	Message           string `json:"message"`
+	RetryAfterSeconds int    `json:"retry_after_seconds"`
+}
+
+// Maintenance reads (GET) or sets (PUT) the service-wide maintenance flag.
+// While it is on, every instance refuses billable requests with 503 within
+// MAINTENANCE_POLL_INTERVAL of the change.
+func (h *AdminHandlers) Maintenance(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		mode, err := h.firebaseClient.GetMaintenanceMode(r.Context())
+		if err != nil {
+			logger().Error("failed to read maintenance mode", "error", err)
+			writeError(w, http.StatusInternalServerError, APIError{Code: apierror.CodeInternalError, Message: "Failed to read maintenance mode"})
+			return
+		}
+		writeJSON(w, http.StatusOK, mode)
+	case http.MethodPut:
+		h.setMaintenance(w, r)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, APIError{Code: apierror.CodeMethodNotAllowed, Message: "GET or PUT required"})
+	}
+}
+
+// setMaintenance turns maintenance mode on or off
+func (h *AdminHandlers) setMaintenance(w http.ResponseWriter, r *http.Request) {
+	var req SetMaintenanceRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Enabled == nil || req.RetryAfterSeconds < 0 {
+		writeError(w, http.StatusBadRequest, APIError{
+			Code:    apierror.CodeInvalidRequest,
+			Message: "enabled is required and retry_after_seconds must be non-negative",
+		})
+		return
+	}
+
+	actorID := adminActor(r.Context())
+	mode := firebase.MaintenanceMode{
+		Enabled:           *req.Enabled,
+		Message:           req.Message,
+		RetryAfterSeconds: req.RetryAfterSeconds,
+		UpdatedBy:         actorID,
+	}
+	// The flag is service-wide, so it lives in the default project rather
+	// than the tenant's
+	if err := h.firebaseClient.SetMaintenanceMode(r.Context(), mode); err != nil {
+		logger().Error("failed to set maintenance mode", "enabled", mode.Enabled, "error", err)
+		writeError(w, http.StatusInternalServerError, APIError{Code: apierror.CodeInternalError, Message: "Failed to set maintenance mode"})
+		return
+	}
+
+	err := h.firebaseClient.LogAdminAction(r.Context(), firebase.AdminAuditEntry{
+		Action:  "set_maintenance",
+		ActorID: actorID,
+		Details: map[string]string{"enabled": strconv.FormatBool(mode.Enabled), "message": mode.Message},
+	})
+	if err != nil {
+		logger().Error("maintenance mode change not audited", "enabled", mode.Enabled, "error", err)
+	}
+
+	logger().Info("maintenance mode changed", "enabled", mode.Enabled, "actor_id", actorID)
+	writeJSON(w, http.StatusOK, mode)
+}
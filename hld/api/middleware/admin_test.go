@@ -0,0 +1,241 @@
+package middleware
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"your-project/hld/firebase"
+	"your-project/hld/internal/apierror"
+	"your-project/hld/internal/testutil"
+)
+
+func TestTransferSession(t *testing.T) {
+	plans := Plans{"free": {Tier: 0}, "pro": {Tier: 1}}
+	now := time.Now()
+
+	tests := []struct {
+		name     string
+		toUserID string
+		// setup adjusts the database after it is seeded with the session
+		// s1 owned by owner, a pro user with 100 points
+		setup func(t *testing.T, db *testutil.RealtimeDatabase)
+		// fail makes writes to matching paths fail
+		fail       func(path string) bool
+		wantStatus int
+		wantCode   string
+		// wantOwner is the session's owner afterwards
+		wantOwner    string
+		wantRecorded bool
+	}{
+		{
+			name:     "moves the session",
+			toUserID: "target",
+			setup: func(t *testing.T, db *testutil.RealtimeDatabase) {
+				db.Set(t, "users/target", firebase.UserData{Points: 50, Plan: "pro", CreatedAt: now})
+			},
+			wantStatus:   http.StatusOK,
+			wantOwner:    "target",
+			wantRecorded: true,
+		},
+		{
+			// Usage already logged stays with the owner, so no points
+			// move and the target needs none
+			name:     "target with an empty balance",
+			toUserID: "target",
+			setup: func(t *testing.T, db *testutil.RealtimeDatabase) {
+				db.Set(t, "users/target", firebase.UserData{Points: 0, Plan: "pro", CreatedAt: now})
+			},
+			wantStatus:   http.StatusOK,
+			wantOwner:    "target",
+			wantRecorded: true,
+		},
+		{
+			name:       "self transfer",
+			toUserID:   "owner",
+			wantStatus: http.StatusConflict,
+			wantCode:   apierror.CodeAlreadyOwner,
+			wantOwner:  "owner",
+		},
+		{
+			name:     "lower plan tier",
+			toUserID: "target",
+			setup: func(t *testing.T, db *testutil.RealtimeDatabase) {
+				db.Set(t, "users/target", firebase.UserData{Points: 500, Plan: "free", CreatedAt: now})
+			},
+			wantStatus: http.StatusUnprocessableEntity,
+			wantCode:   apierror.CodePlanTierTooLow,
+			wantOwner:  "owner",
+		},
+		{
+			name:       "unknown target",
+			toUserID:   "nobody",
+			wantStatus: http.StatusNotFound,
+			wantCode:   apierror.CodeUserNotFound,
+			wantOwner:  "owner",
+		},
+		{
+			name:     "unknown session",
+			toUserID: "target",
+			setup: func(t *testing.T, db *testutil.RealtimeDatabase) {
+				db.Set(t, "sessions/s1", nil)
+			},
+			wantStatus: http.StatusNotFound,
+			wantCode:   apierror.CodeSessionNotFound,
+		},
+		{
+			name:     "ownership write fails",
+			toUserID: "target",
+			setup: func(t *testing.T, db *testutil.RealtimeDatabase) {
+				db.Set(t, "users/target", firebase.UserData{Points: 50, Plan: "pro", CreatedAt: now})
+			},
+			fail:       func(path string) bool { return path == "sessions/s1" },
+			wantStatus: http.StatusInternalServerError,
+			wantCode:   apierror.CodeInternalError,
+			wantOwner:  "owner",
+		},
+		{
+			// The ownership change stands; only the audit record is lost
+			name:     "transfer record fails",
+			toUserID: "target",
+			setup: func(t *testing.T, db *testutil.RealtimeDatabase) {
+				db.Set(t, "users/target", firebase.UserData{Points: 50, Plan: "pro", CreatedAt: now})
+			},
+			fail:       func(path string) bool { return path == "session_transfers" },
+			wantStatus: http.StatusOK,
+			wantOwner:  "target",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, db := newTestFirebaseClient(t)
+			db.Set(t, "users/owner", firebase.UserData{Points: 100, Plan: "pro", CreatedAt: now})
+			db.Set(t, "sessions/s1", firebase.SessionRecord{UserID: "owner", Status: "active"})
+			if tt.setup != nil {
+				tt.setup(t, db)
+			}
+			nonce, _, err := client.CreateNonce(context.Background(), "admin-1")
+			require.NoError(t, err)
+			db.FailWrites(tt.fail)
+
+			req := httptest.NewRequest(http.MethodPost, "/admin/sessions/s1/transfer",
+				strings.NewReader(`{"to_user_id":"`+tt.toUserID+`"}`))
+			req.SetPathValue("id", "s1")
+			req.Header.Set(headerAdminNonce, nonce)
+			req = req.WithContext(context.WithValue(req.Context(), "admin_id", "admin-1"))
+			w := httptest.NewRecorder()
+			NewAdminHandlers(client, plans).TransferSession(w, req)
+
+			if tt.wantCode != "" {
+				assertEnvelope(t, w, tt.wantStatus, tt.wantCode)
+			} else {
+				require.Equal(t, tt.wantStatus, w.Code, w.Body.String())
+				var transfer firebase.SessionTransfer
+				require.NoError(t, json.Unmarshal(w.Body.Bytes(), &transfer))
+				assert.Equal(t, "owner", transfer.FromUserID)
+				assert.Equal(t, tt.toUserID, transfer.ToUserID)
+				assert.Equal(t, "admin-1", transfer.TransferredBy)
+			}
+
+			var session firebase.SessionRecord
+			db.Get(t, "sessions/s1", &session)
+			assert.Equal(t, tt.wantOwner, session.UserID)
+
+			var transfers map[string]firebase.SessionTransfer
+			db.Get(t, "session_transfers", &transfers)
+			if tt.wantRecorded {
+				require.Len(t, transfers, 1)
+			} else {
+				assert.Empty(t, transfers)
+			}
+
+			// A transfer never moves points
+			var owner firebase.UserData
+			db.Get(t, "users/owner", &owner)
+			assert.Equal(t, 100, owner.Points)
+		})
+	}
+}
+
+func TestImportUsers(t *testing.T) {
+	client, db := newTestFirebaseClient(t)
+	db.Set(t, "users/existing", firebase.UserData{Points: 7, Plan: "pro", CreatedAt: time.Now()})
+	h := NewAdminHandlers(client, nil)
+
+	importUsers := func(contentType string, body io.Reader) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/admin/users/import", body)
+		req.Header.Set("Content-Type", contentType)
+		w := httptest.NewRecorder()
+		h.ImportUsers(w, req)
+		return w
+	}
+
+	t.Run("csv", func(t *testing.T) {
+		w := importUsers("text/csv", strings.NewReader(
+			"user_id,email,plan,points\nnew-csv,a@example.com,pro,30\nexisting,b@example.com,,\nvictim/points,,,\nnegative,,,-5\n"))
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		var resp ImportUsersResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		assert.Equal(t, 4, resp.Total)
+		assert.Equal(t, 1, resp.Created)
+		assert.Equal(t, 1, resp.Skipped)
+		assert.Equal(t, 2, resp.Failed)
+		assert.NotEmpty(t, resp.Results[2].Error)
+		assert.NotEmpty(t, resp.Results[3].Error)
+	})
+
+	t.Run("json", func(t *testing.T) {
+		w := importUsers("application/json", strings.NewReader(`{"users":[{"user_id":"new-json","points":5},{"user_id":"existing"}]}`))
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		var resp ImportUsersResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		assert.Equal(t, ImportUsersResponse{Total: 2, Created: 1, Skipped: 1, Results: []firebase.UserInitResult{
+			{UserID: "new-json", Created: true},
+			{UserID: "existing", Skipped: true},
+		}}, resp)
+	})
+
+	t.Run("csv without a user_id header", func(t *testing.T) {
+		w := importUsers("text/csv", strings.NewReader("new-csv,a@example.com,pro,30\n"))
+		assertEnvelope(t, w, http.StatusBadRequest, apierror.CodeInvalidImport)
+	})
+
+	t.Run("malformed json", func(t *testing.T) {
+		w := importUsers("application/json", strings.NewReader(`{"users":`))
+		assertEnvelope(t, w, http.StatusBadRequest, apierror.CodeInvalidImport)
+	})
+
+	t.Run("body over the limit", func(t *testing.T) {
+		body := io.MultiReader(strings.NewReader("user_id\n"), strings.NewReader(strings.Repeat("x", maxImportBodyBytes)))
+		w := importUsers("text/csv", body)
+		assertEnvelope(t, w, http.StatusRequestEntityTooLarge, apierror.CodeRequestTooLarge)
+	})
+
+	var existing firebase.UserData
+	db.Get(t, "users/existing", &existing)
+	assert.Equal(t, 7, existing.Points)
+}
+
+func TestSetUserStatusUnknownUser(t *testing.T) {
+	client, db := newTestFirebaseClient(t)
+
+	req := httptest.NewRequest(http.MethodPost, "/admin/users/nobody/status", strings.NewReader(`{"status":"banned"}`))
+	req.SetPathValue("id", "nobody")
+	w := httptest.NewRecorder()
+	NewAdminHandlers(client, nil).SetUserStatus(w, req)
+
+	assertEnvelope(t, w, http.StatusNotFound, apierror.CodeUserNotFound)
+	var record map[string]interface{}
+	db.Get(t, "users/nobody", &record)
+	assert.Nil(t, record)
+}
@@ -0,0 +1,209 @@
+package middleware
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"your-project/hld/firebase"
+	"your-project/hld/internal/apierror"
+)
+
+// deviceCookieName is the cookie identifying an anonymous trial device
+const deviceCookieName = "hld_device"
+
+// deviceCookieMaxAge keeps the device cookie for a year
+const deviceCookieMaxAge = 365 * 24 * 60 * 60
+
+// deviceIDLength is the length of the hex device IDs derived from IPs
+const deviceIDLength = 32
+
+// Default anonymous trial limits
+const (
+	defaultAnonymousRequestLimit = 10
+	defaultAnonymousTrialPoints  = 50
+)
+
+// anonymousPolicy lets requests without credentials through as anonymous
+// trial users. Each device gets a record under anon_users that is charged
+// like any account but admits a fixed number of requests, all on the
+// cheapest model. Devices are identified by a signed cookie, or by a keyed
+// hash of the client IP until they present one. The cookie is issued with
+// the IP-derived ID, so clearing cookies doesn't reset a trial.
+type anonymousPolicy struct {
+	secret []byte
+	trial  firebase.AnonymousTrial
+	// model is the only model anonymous requests may use
+	model string
+}
+
+// anonymousPolicyFromEnv reads ALLOW_ANONYMOUS, ANONYMOUS_COOKIE_SECRET,
+// ANONYMOUS_REQUEST_LIMIT and ANONYMOUS_TRIAL_POINTS. It returns nil when
+// anonymous access is off, or when no secret is set to sign device cookies.
+func anonymousPolicyFromEnv() *anonymousPolicy {
+	if os.Getenv("ALLOW_ANONYMOUS") != "true" {
+		return nil
+	}
+	secret := []byte(os.Getenv("ANONYMOUS_COOKIE_SECRET"))
+	if len(secret) == 0 {
+		logger().Warn("ALLOW_ANONYMOUS set without ANONYMOUS_COOKIE_SECRET, anonymous access disabled")
+		return nil
+	}
+
+	p := &anonymousPolicy{
+		secret: secret,
+		trial: firebase.AnonymousTrial{
+			Requests: getEnvInt("ANONYMOUS_REQUEST_LIMIT"),
+			Points:   getEnvInt("ANONYMOUS_TRIAL_POINTS"),
+		},
+		model: firebase.CheapestModel(),
+	}
+	if p.trial.Requests <= 0 {
+		p.trial.Requests = defaultAnonymousRequestLimit
+	}
+	if p.trial.Points <= 0 {
+		p.trial.Points = defaultAnonymousTrialPoints
+	}
+
+	logger().Info("anonymous access enabled",
+		"request_limit", p.trial.Requests,
+		"trial_points", p.trial.Points,
+		"model", p.model)
+	return p
+}
+
+// sign returns the HMAC of value under the policy's secret, hex encoded
+func (p *anonymousPolicy) sign(value string) string {
+	mac := hmac.New(sha256.New, p.secret)
+	mac.Write([]byte(value))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// deviceCookieValue returns the signed cookie value for a device ID
+func (p *anonymousPolicy) deviceCookieValue(deviceID string) string {
+	return deviceID + "." + p.sign("device:"+deviceID)
+}
+
+// verifyDeviceCookie returns the device ID from a signed cookie value
+func (p *anonymousPolicy) verifyDeviceCookie(value string) (string, bool) {
+	deviceID, sig, ok := strings.Cut(value, ".")
+	if !ok || deviceID == "" {
+		return "", false
+	}
+	if !hmac.Equal([]byte(sig), []byte(p.sign("device:"+deviceID))) {
+		return "", false
+	}
+	return deviceID, true
+}
+
+// ipDeviceID derives a device ID from a client IP. The hash is keyed so IDs
+// can't be reversed into addresses.
+func (p *anonymousPolicy) ipDeviceID(ip string) string {
+	return p.sign("ip:" + ip)[:deviceIDLength]
+}
+
+// cookieDeviceID returns the device ID of a valid device cookie on r
+func (p *anonymousPolicy) cookieDeviceID(r *http.Request) (string, bool) {
+	cookie, err := r.Cookie(deviceCookieName)
+	if err != nil {
+		return "", false
+	}
+	return p.verifyDeviceCookie(cookie.Value)
+}
+
+// caller resolves an unauthenticated request to its anonymous trial user,
+// issuing a device cookie when the request didn't present a valid one
+func (p *anonymousPolicy) caller(w http.ResponseWriter, r *http.Request) authCaller {
+	deviceID, ok := p.cookieDeviceID(r)
+	if !ok {
+		deviceID = p.ipDeviceID(getClientIP(r))
+		http.SetCookie(w, &http.Cookie{
+			Name:     deviceCookieName,
+			Value:    p.deviceCookieValue(deviceID),
+			Path:     "/",
+			MaxAge:   deviceCookieMaxAge,
+			HttpOnly: true,
+			Secure:   true,
+			SameSite: http.SameSiteLaxMode,
+		})
+	}
+	return authCaller{userID: firebase.AnonymousUserID(deviceID), anonymous: true}
+}
+
+// initOptions returns the InitializeUser options that convert the trial
+// named by the request's device cookie into the new account
+func (p *anonymousPolicy) initOptions(r *http.Request) []firebase.InitOption {
+	if p == nil {
+		return nil
+	}
+	deviceID, ok := p.cookieDeviceID(r)
+	if !ok {
+		return nil
+	}
+	return []firebase.InitOption{firebase.WithAnonymousTrial(firebase.AnonymousUserID(deviceID))}
+}
+
+// admit checks an anonymous request against the trial's model and request
+// limits, counting it when allowed. On refusal it writes the error response
+// and returns false.
+func (p *anonymousPolicy) admit(w http.ResponseWriter, r *http.Request, fb *firebase.Client, userID string) bool {
+	log := requestLogger(r.Context())
+
+	if model := firebase.ResolveModelAlias(requestModel(r)); model != p.model {
+		log.Warn("rejected anonymous request for model", "user_id", userID, "model", model)
+		writeError(w, http.StatusForbidden, APIError{
+			Code:    apierror.CodeModelNotAllowed,
+			Message: "Anonymous requests must use " + p.model + "; sign in to use other models",
+			Details: map[string]interface{}{"model": p.model},
+		})
+		return false
+	}
+
+	_, err := fb.AdmitAnonymousRequest(r.Context(), userID, p.trial)
+	switch {
+	case errors.Is(err, firebase.ErrTrialExhausted):
+		log.Warn("anonymous trial exhausted", "user_id", userID)
+		writeError(w, http.StatusPaymentRequired, APIError{
+			Code:    apierror.CodeTrialExhausted,
+			Message: "The anonymous trial has ended; sign in to continue",
+			Details: map[string]interface{}{"request_limit": p.trial.Requests},
+		})
+		return false
+	case err != nil:
+		log.Error("failed to admit anonymous request", "user_id", userID, "error", err)
+		writeError(w, http.StatusServiceUnavailable, APIError{
+			Code:    apierror.CodeBalanceUnavailable,
+			Message: "Failed to check trial quota",
+		})
+		return false
+	}
+	return true
+}
+
+// requestModel returns the model named in a JSON request body, restoring
+// the body for downstream handlers
+func requestModel(r *http.Request) string {
+	if r.Body == nil {
+		return ""
+	}
+	bodyBytes, err := io.ReadAll(r.Body)
+	r.Body = io.NopCloser(bytes.NewReader(bodyBytes))
+	if err != nil {
+		return ""
+	}
+
+	var reqBody struct {
+		Model string `json:"model"`
+	}
+	if err := json.Unmarshal(bodyBytes, &reqBody); err != nil {
+		return ""
+	}
+	return reqBody.Model
+}
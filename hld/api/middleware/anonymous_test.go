@@ -0,0 +1,82 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"your-project/hld/firebase"
+)
+
+func TestDeviceCookieRoundTrip(t *testing.T) {
+	p := &anonymousPolicy{secret: []byte("secret")}
+
+	value := p.deviceCookieValue("device-1")
+	deviceID, ok := p.verifyDeviceCookie(value)
+	require.True(t, ok)
+	assert.Equal(t, "device-1", deviceID)
+
+	// Tampered IDs and cookies signed with another secret are rejected
+	_, ok = p.verifyDeviceCookie(strings.Replace(value, "device-1", "device-2", 1))
+	assert.False(t, ok)
+	other := &anonymousPolicy{secret: []byte("other")}
+	_, ok = other.verifyDeviceCookie(value)
+	assert.False(t, ok)
+	_, ok = p.verifyDeviceCookie("device-1")
+	assert.False(t, ok)
+}
+
+func TestAnonymousCallerIssuesCookieFromIP(t *testing.T) {
+	p := &anonymousPolicy{secret: []byte("secret")}
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/messages", nil)
+	req.RemoteAddr = "203.0.113.7:4321"
+	w := httptest.NewRecorder()
+	caller := p.caller(w, req)
+	assert.True(t, caller.anonymous)
+	assert.Equal(t, firebase.AnonymousUserID(p.ipDeviceID("203.0.113.7")), caller.userID)
+	assert.NotContains(t, caller.userID, "203.0.113.7")
+
+	// The issued cookie keeps the same trial from another address
+	cookies := w.Result().Cookies()
+	require.Len(t, cookies, 1)
+	assert.Equal(t, deviceCookieName, cookies[0].Name)
+	assert.True(t, cookies[0].HttpOnly)
+
+	req = httptest.NewRequest(http.MethodPost, "/v1/messages", nil)
+	req.RemoteAddr = "198.51.100.1:4321"
+	req.AddCookie(cookies[0])
+	w = httptest.NewRecorder()
+	assert.Equal(t, caller.userID, p.caller(w, req).userID)
+	assert.Empty(t, w.Result().Cookies())
+	require.Len(t, p.initOptions(req), 1)
+}
+
+func TestAuthenticateAnonymous(t *testing.T) {
+	m := &UsageMiddleware{anonymous: &anonymousPolicy{secret: []byte("secret")}}
+
+	caller, ok := m.authenticate(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/v1/messages", nil))
+	require.True(t, ok)
+	assert.True(t, caller.anonymous)
+	assert.True(t, firebase.IsAnonymousUser(caller.userID))
+}
+
+func TestAnonymousAdmitRejectsOtherModels(t *testing.T) {
+	p := &anonymousPolicy{secret: []byte("secret"), model: "claude-3-haiku-20240307"}
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/messages", strings.NewReader(`{"model":"opus"}`))
+	w := httptest.NewRecorder()
+	assert.False(t, p.admit(w, req, nil, firebase.AnonymousUserID("d1")))
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Contains(t, w.Body.String(), "model_not_allowed")
+}
+
+func TestRequestModelRestoresBody(t *testing.T) {
+	req := httptest.NewRequest(http.MethodPost, "/v1/messages", strings.NewReader(`{"model":"haiku"}`))
+	assert.Equal(t, "haiku", requestModel(req))
+	assert.Equal(t, "haiku", requestModel(req))
+}
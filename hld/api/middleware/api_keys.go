@@ -0,0 +1,142 @@
+package middleware
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"your-project/hld/firebase"
+	"your-project/hld/internal/apierror"
+)
+
+// maxAPIKeyNameLength caps the display name of an API key
+const maxAPIKeyNameLength = 100
+
+// CreateAPIKeyRequest is the body of POST /api-keys
+type CreateAPIKeyRequest struct {
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes,omitempty"`
+	// ExpiresInSeconds sets an expiry; zero means the key never expires
+	ExpiresInSeconds int64 `json:"expires_in_seconds,omitempty"`
+}
+
+// CreateAPIKeyResponse returns the plaintext key, which is shown only once
+type CreateAPIKeyResponse struct {
+	Key    string           `json:"key"`
+	APIKey *firebase.APIKey `json:"api_key"`
+}
+
+// APIKeys handles GET /api-keys, listing the caller's keys, and POST
+// /api-keys, creating a new one
+func (h *UserHandlers) APIKeys(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		h.listAPIKeys(w, r)
+	case http.MethodPost:
+		h.createAPIKey(w, r)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, APIError{Code: apierror.CodeMethodNotAllowed, Message: "GET or POST required"})
+	}
+}
+
+func (h *UserHandlers) listAPIKeys(w http.ResponseWriter, r *http.Request) {
+	userID, _ := r.Context().Value("user_id").(string)
+
+	keys, err := h.client(r).ListAPIKeys(r.Context(), userID)
+	if err != nil {
+		logger().Error("failed to list api keys", "user_id", userID, "error", err)
+		writeError(w, http.StatusInternalServerError, APIError{
+			Code:    apierror.CodeInternalError,
+			Message: "Failed to list API keys",
+		})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"api_keys": keys})
+}
+
+func (h *UserHandlers) createAPIKey(w http.ResponseWriter, r *http.Request) {
+	userID, _ := r.Context().Value("user_id").(string)
+
+	// A key must not be able to mint keys, or scope restrictions could be
+	// escaped by creating an unrestricted one
+	if _, ok := r.Context().Value("api_key").(*firebase.APIKey); ok {
+		writeError(w, http.StatusForbidden, APIError{
+			Code:    apierror.CodeTokenRequired,
+			Message: "API keys can only be created with a Firebase ID token",
+		})
+		return
+	}
+
+	var req CreateAPIKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, APIError{
+			Code:    apierror.CodeInvalidRequest,
+			Message: "Invalid JSON body",
+		})
+		return
+	}
+	if req.Name == "" || len(req.Name) > maxAPIKeyNameLength {
+		writeError(w, http.StatusBadRequest, APIError{
+			Code:    apierror.CodeInvalidRequest,
+			Message: "name is required and must be at most 100 characters",
+		})
+		return
+	}
+	if req.ExpiresInSeconds < 0 {
+		writeError(w, http.StatusBadRequest, APIError{
+			Code:    apierror.CodeInvalidRequest,
+			Message: "expires_in_seconds must not be negative",
+		})
+		return
+	}
+
+	plaintext, key, err := h.client(r).GenerateAPIKey(r.Context(), userID, firebase.APIKeyOptions{
+		Name:   req.Name,
+		Scopes: req.Scopes,
+		TTL:    time.Duration(req.ExpiresInSeconds) * time.Second,
+	})
+	if err != nil {
+		logger().Error("failed to create api key", "user_id", userID, "error", err)
+		writeError(w, http.StatusInternalServerError, APIError{
+			Code:    apierror.CodeInternalError,
+			Message: "Failed to create API key",
+		})
+		return
+	}
+
+	logger().Info("api key created", "user_id", userID, "key_prefix", key.Prefix)
+	writeJSON(w, http.StatusCreated, CreateAPIKeyResponse{Key: plaintext, APIKey: key})
+}
+
+// RevokeAPIKey handles DELETE /api-keys/:id. Users may only revoke their
+// own keys; the key record is kept for auditing.
+func (h *UserHandlers) RevokeAPIKey(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		writeError(w, http.StatusMethodNotAllowed, APIError{Code: apierror.CodeMethodNotAllowed, Message: "DELETE required"})
+		return
+	}
+
+	userID, _ := r.Context().Value("user_id").(string)
+	keyID := r.PathValue("id")
+
+	if err := h.client(r).RevokeAPIKey(r.Context(), userID, keyID); err != nil {
+		if errors.Is(err, firebase.ErrAPIKeyNotFound) {
+			writeError(w, http.StatusNotFound, APIError{
+				Code:    apierror.CodeNotFound,
+				Message: "API key not found",
+			})
+			return
+		}
+		logger().Error("failed to revoke api key", "user_id", userID, "error", err)
+		writeError(w, http.StatusInternalServerError, APIError{
+			Code:    apierror.CodeInternalError,
+			Message: "Failed to revoke API key",
+		})
+		return
+	}
+
+	logger().Info("api key revoked", "user_id", userID, "key_id", keyID)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,65 @@
+package middleware
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"your-project/hld/internal/apierror"
+)
+
+// AuthStatusResponse tells a client whether its credentials are good and
+// what it can spend
+type AuthStatusResponse struct {
+	UserID string `json:"user_id"`
+	// Email is taken from the ID token; empty for API keys
+	Email  string `json:"email"`
+	Points int    `json:"points"`
+	Plan   string `json:"plan"`
+	// DailyRequestsRemaining is null when the plan has no daily limit
+	DailyRequestsRemaining *int `json:"daily_requests_remaining"`
+}
+
+// GetAuthStatus is a pre-flight check for clients starting up: it verifies
+// the caller's credentials as CheckAuth does and returns their balance and
+// plan. Nothing is held or deducted, no request body is read, and callers
+// out of points still get a 200, so mount it without CheckAuthGin.
+func (m *UsageMiddleware) GetAuthStatus(c *gin.Context) {
+	if !m.enabled {
+		writeError(c.Writer, http.StatusNotFound, APIError{
+			Code:    apierror.CodeNotFound,
+			Message: "Usage tracking is disabled",
+		})
+		c.Abort()
+		return
+	}
+
+	r, caller, ok := m.authenticateOnly(c.Writer, c.Request)
+	if !ok {
+		c.Abort()
+		return
+	}
+	userID := caller.userID
+
+	account, err := m.client(r.Context()).GetUserAccount(r.Context(), userID)
+	if err != nil {
+		requestLogger(r.Context()).Error("failed to get user account", "user_id", userID, "error", err)
+		writeError(c.Writer, http.StatusServiceUnavailable, APIError{
+			Code:    apierror.CodeBalanceUnavailable,
+			Message: "Failed to read account",
+		})
+		c.Abort()
+		return
+	}
+
+	resp := AuthStatusResponse{
+		UserID: userID,
+		Email:  caller.email,
+		Points: account.SpendablePoints(),
+		Plan:   account.Plan,
+	}
+	if remaining, ok := m.plans.DailyRequestsRemaining(account); ok {
+		resp.DailyRequestsRemaining = &remaining
+	}
+	c.JSON(http.StatusOK, resp)
+}
@@ -0,0 +1,47 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+
+	"your-project/hld/firebase"
+	"your-project/hld/internal/apierror"
+)
+
+func TestGetAuthStatusRequiresCredentials(t *testing.T) {
+	m := &UsageMiddleware{enabled: true}
+	router := gin.New()
+	router.GET("/v1/auth/status", m.GetAuthStatus)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/v1/auth/status", nil))
+	assertEnvelope(t, w, http.StatusUnauthorized, apierror.CodeMissingAuthorization)
+}
+
+func TestDailyRequestsRemaining(t *testing.T) {
+	plans := Plans{"free": {MaxRequestsPerDay: 10}}
+
+	remaining, ok := plans.DailyRequestsRemaining(&firebase.UserAccount{Plan: "free", RequestsToday: 4})
+	assert.True(t, ok)
+	assert.Equal(t, 6, remaining)
+
+	remaining, ok = plans.DailyRequestsRemaining(&firebase.UserAccount{Plan: "free", RequestsToday: 12})
+	assert.True(t, ok)
+	assert.Zero(t, remaining)
+
+	_, ok = plans.DailyRequestsRemaining(&firebase.UserAccount{Plan: "pro"})
+	assert.False(t, ok, "plans without a limit are unlimited")
+	_, ok = plans.DailyRequestsRemaining(nil)
+	assert.False(t, ok)
+}
+
+func TestWriteDailyRequestLimit(t *testing.T) {
+	w := httptest.NewRecorder()
+	writeDailyRequestLimit(w, 10)
+	assertEnvelope(t, w, http.StatusTooManyRequests, apierror.CodeDailyRequestLimit)
+	assert.NotEmpty(t, w.Header().Get("Retry-After"))
+}
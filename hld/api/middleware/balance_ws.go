@@ -0,0 +1,226 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"your-project/hld/internal/apierror"
+)
+
+const (
+	// defaultMaxBalanceStreamsPerUser caps concurrent balance WebSockets per user
+	defaultMaxBalanceStreamsPerUser = 5
+
+	// balanceStreamPongWait is how long a client may go without answering a ping
+	balanceStreamPongWait = 60 * time.Second
+	// balanceStreamPingPeriod must be shorter than balanceStreamPongWait
+	balanceStreamPingPeriod = 30 * time.Second
+	// balanceStreamWriteWait bounds each write to the client
+	balanceStreamWriteWait = 10 * time.Second
+)
+
+// BalanceMessage is pushed to balance stream clients whenever their balance
+// changes
+type BalanceMessage struct {
+	Type   string `json:"type"`
+	Points int    `json:"points"`
+}
+
+// connLimiter counts open connections per user
+type connLimiter struct {
+	mu    sync.Mutex
+	max   int
+	conns map[string]int
+}
+
+// newConnLimiter creates a limiter allowing max connections per user
+func newConnLimiter(max int) *connLimiter {
+	return &connLimiter{max: max, conns: make(map[string]int)}
+}
+
+// connLimiterFromEnv reads WS_MAX_CONNECTIONS_PER_USER
+func connLimiterFromEnv() *connLimiter {
+	max := getEnvInt("WS_MAX_CONNECTIONS_PER_USER")
+	if max <= 0 {
+		max = defaultMaxBalanceStreamsPerUser
+	}
+	return newConnLimiter(max)
+}
+
+// acquire reserves a connection slot for userID. The returned release func
+// must be called once the connection closes.
+func (l *connLimiter) acquire(userID string) (release func(), ok bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.conns[userID] >= l.max {
+		return nil, false
+	}
+	l.conns[userID]++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			if l.conns[userID]--; l.conns[userID] <= 0 {
+				delete(l.conns, userID)
+			}
+		})
+	}, true
+}
+
+// BalanceUpdates handles GET /balance/stream, upgrading to a WebSocket that
+// pushes the caller's balance on connect and whenever it changes. Browsers
+// can't set headers on WebSocket requests, so an ID token may also be passed
+// as the access_token query parameter.
+func (m *UsageMiddleware) BalanceUpdates(w http.ResponseWriter, r *http.Request) {
+	if !m.enabled {
+		writeError(w, http.StatusNotFound, APIError{
+			Code:    apierror.CodeNotFound,
+			Message: "Usage tracking is disabled",
+		})
+		return
+	}
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, APIError{Code: apierror.CodeMethodNotAllowed, Message: "GET required"})
+		return
+	}
+
+	if token := r.URL.Query().Get("access_token"); token != "" && r.Header.Get("Authorization") == "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	r, caller, ok := m.authenticateOnly(w, r)
+	if !ok {
+		return
+	}
+	userID := caller.userID
+
+	release, ok := m.balanceStreams.acquire(userID)
+	if !ok {
+		writeError(w, http.StatusTooManyRequests, APIError{
+			Code:    apierror.CodeTooManyConnections,
+			Message: "Too many open balance streams",
+			Details: map[string]interface{}{"max_connections": m.balanceStreams.max},
+		})
+		return
+	}
+	defer release()
+
+	// Subscribe before upgrading so failures are still plain HTTP errors
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	updates, err := m.client(ctx).WatchUserPoints(ctx, userID)
+	if err != nil {
+		logger().Error("failed to watch balance", "user_id", userID, "error", err)
+		writeError(w, http.StatusServiceUnavailable, APIError{
+			Code:    apierror.CodeBalanceUnavailable,
+			Message: "Unable to subscribe to balance updates, please try again",
+		})
+		return
+	}
+
+	// Browsers don't preflight WebSockets, so check the origin here against
+	// ALLOWED_ORIGINS
+	upgrader := websocket.Upgrader{
+		ReadBufferSize:  512,
+		WriteBufferSize: 1024,
+		CheckOrigin:     m.cors.checkOrigin,
+	}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// Upgrade has already written the error response
+		logger().Warn("balance stream upgrade failed", "user_id", userID, "error", err)
+		return
+	}
+	defer conn.Close()
+
+	logger().Info("balance stream opened", "user_id", userID)
+	m.streamBalance(ctx, cancel, conn, updates)
+	logger().Info("balance stream closed", "user_id", userID)
+}
+
+// streamBalance writes balance updates and keepalive pings to conn until the
+// client disconnects, stops answering pings, or the subscription ends
+func (m *UsageMiddleware) streamBalance(ctx context.Context, cancel context.CancelFunc, conn *websocket.Conn, updates <-chan int) {
+	// Clients only send control frames; reading processes pongs and closes
+	conn.SetReadLimit(512)
+	conn.SetReadDeadline(time.Now().Add(balanceStreamPongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(balanceStreamPongWait))
+	})
+	go func() {
+		defer cancel()
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	ping := time.NewTicker(balanceStreamPingPeriod)
+	defer ping.Stop()
+
+	for {
+		select {
+		case points, ok := <-updates:
+			if !ok {
+				if ctx.Err() == nil {
+					// Tell the client to reconnect for a fresh subscription
+					closeBalanceStream(conn, websocket.CloseTryAgainLater, "balance stream ended")
+				}
+				return
+			}
+			conn.SetWriteDeadline(time.Now().Add(balanceStreamWriteWait))
+			if err := conn.WriteJSON(BalanceMessage{Type: "balance", Points: points}); err != nil {
+				return
+			}
+		case <-ping.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(balanceStreamWriteWait)); err != nil {
+				return
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// closeBalanceStream sends a close frame before the connection is torn down
+func closeBalanceStream(conn *websocket.Conn, code int, reason string) {
+	msg := websocket.FormatCloseMessage(code, reason)
+	conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(balanceStreamWriteWait))
+}
+
+// authenticateOnly identifies the caller for endpoints that don't go through
+// CheckAuth, applying the same tenant routing and auth failure throttling but
+// no balance checks. The returned request carries the tenant's client.
+func (m *UsageMiddleware) authenticateOnly(w http.ResponseWriter, r *http.Request) (*http.Request, authCaller, bool) {
+	clientIP := getClientIP(r)
+	if m.authFailures != nil {
+		if allowed, wait := m.authFailures.check(clientIP); !allowed {
+			writeAuthThrottled(w, clientIP, wait)
+			return r, authCaller{}, false
+		}
+	}
+
+	if m.clients != nil {
+		client, ok := m.tenantClient(w, r)
+		if !ok {
+			return r, authCaller{}, false
+		}
+		r = r.WithContext(context.WithValue(r.Context(), "firebase_client", client))
+	}
+
+	caller, ok := m.authenticate(w, r)
+	if !ok {
+		if m.authFailures != nil {
+			m.authFailures.recordFailure(clientIP)
+		}
+		return r, authCaller{}, false
+	}
+	return r, caller, true
+}
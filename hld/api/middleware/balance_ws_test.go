@@ -0,0 +1,43 @@
+package middleware
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConnLimiter(t *testing.T) {
+	l := newConnLimiter(2)
+
+	r1, ok := l.acquire("u1")
+	require.True(t, ok)
+	r2, ok := l.acquire("u1")
+	require.True(t, ok)
+
+	// Third connection is over the cap, other users are unaffected
+	_, ok = l.acquire("u1")
+	assert.False(t, ok)
+	r3, ok := l.acquire("u2")
+	require.True(t, ok)
+
+	// Releasing twice only frees one slot
+	r1()
+	r1()
+	r4, ok := l.acquire("u1")
+	require.True(t, ok)
+	_, ok = l.acquire("u1")
+	assert.False(t, ok)
+
+	r2()
+	r3()
+	r4()
+	assert.Empty(t, l.conns)
+}
+
+func TestConnLimiterFromEnv(t *testing.T) {
+	assert.Equal(t, defaultMaxBalanceStreamsPerUser, connLimiterFromEnv().max)
+
+	t.Setenv("WS_MAX_CONNECTIONS_PER_USER", "1")
+	assert.Equal(t, 1, connLimiterFromEnv().max)
+}
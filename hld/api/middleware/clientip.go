@@ -0,0 +1,82 @@
+package middleware
+
+import (
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+// trustedProxies lists the proxies whose forwarding headers getClientIP
+// honors, read from TRUSTED_PROXIES, a comma separated list of IPs and
+// CIDRs, on first use
+var trustedProxies = sync.OnceValue(func() proxyList {
+	return proxyList(parseIPList(splitList(os.Getenv("TRUSTED_PROXIES"))))
+})
+
+// proxyList is a set of trusted proxy ranges
+type proxyList []*net.IPNet
+
+// contains reports whether ip is a trusted proxy
+func (p proxyList) contains(ip net.IP) bool {
+	for _, n := range p {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// getClientIP extracts the client's IP address from the request. Forwarding
+// headers are only honored when the connection comes from a trusted proxy.
+func getClientIP(r *http.Request) string {
+	return trustedProxies().clientIP(r)
+}
+
+// clientIP returns the address of the client r came from. The connection's
+// address is used unless it is a trusted proxy, in which case
+// X-Forwarded-For is walked from the right past trusted hops to the first
+// untrusted address, the one the nearest trusted proxy saw. Without
+// X-Forwarded-For, X-Real-IP is used.
+func (p proxyList) clientIP(r *http.Request) string {
+	remote := remoteIP(r.RemoteAddr)
+	parsed := net.ParseIP(remote)
+	if parsed == nil || !p.contains(parsed) {
+		return remote
+	}
+
+	if xff := r.Header.Values("X-Forwarded-For"); len(xff) > 0 {
+		hops := strings.Split(strings.Join(xff, ","), ",")
+		client := parsed
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := net.ParseIP(strings.TrimSpace(hops[i]))
+			if hop == nil {
+				// Unparseable entries can't be trusted past; the last
+				// trusted hop is as far as the chain can be followed
+				break
+			}
+			client = hop
+			if !p.contains(hop) {
+				break
+			}
+		}
+		return client.String()
+	}
+
+	if xri := net.ParseIP(strings.TrimSpace(r.Header.Get("X-Real-IP"))); xri != nil {
+		return xri.String()
+	}
+	return remote
+}
+
+// remoteIP strips the port from a RemoteAddr, including the brackets around
+// IPv6 literals such as "[::1]:443"
+func remoteIP(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		// No port
+		return strings.Trim(addr, "[]")
+	}
+	return host
+}
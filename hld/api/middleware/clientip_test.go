@@ -0,0 +1,75 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func clientIPRequest(remoteAddr string, headers map[string]string) *http.Request {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = remoteAddr
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	return req
+}
+
+func TestClientIPDirectConnection(t *testing.T) {
+	proxies := proxyList(parseIPList([]string{"10.0.0.0/8"}))
+
+	assert.Equal(t, "203.0.113.7", proxies.clientIP(clientIPRequest("203.0.113.7:5000", nil)))
+	assert.Equal(t, "2001:db8::1", proxies.clientIP(clientIPRequest("[2001:db8::1]:443", nil)))
+	assert.Equal(t, "::1", proxies.clientIP(clientIPRequest("[::1]:443", nil)))
+	assert.Equal(t, "203.0.113.7", proxies.clientIP(clientIPRequest("203.0.113.7", nil)))
+}
+
+func TestClientIPSingleProxy(t *testing.T) {
+	proxies := proxyList(parseIPList([]string{"10.0.0.0/8"}))
+
+	req := clientIPRequest("10.0.0.5:5000", map[string]string{"X-Forwarded-For": "203.0.113.7"})
+	assert.Equal(t, "203.0.113.7", proxies.clientIP(req))
+
+	req = clientIPRequest("10.0.0.5:5000", map[string]string{"X-Real-IP": "203.0.113.8"})
+	assert.Equal(t, "203.0.113.8", proxies.clientIP(req))
+
+	// No forwarding headers leaves the proxy's own address
+	assert.Equal(t, "10.0.0.5", proxies.clientIP(clientIPRequest("10.0.0.5:5000", nil)))
+}
+
+func TestClientIPChainedProxies(t *testing.T) {
+	proxies := proxyList(parseIPList([]string{"10.0.0.0/8", "192.0.2.10"}))
+
+	req := clientIPRequest("10.0.0.5:5000", map[string]string{"X-Forwarded-For": "203.0.113.7, 192.0.2.10, 10.1.2.3"})
+	assert.Equal(t, "203.0.113.7", proxies.clientIP(req))
+
+	// Every hop trusted: the leftmost is the best guess
+	req = clientIPRequest("10.0.0.5:5000", map[string]string{"X-Forwarded-For": "10.9.9.9, 10.1.2.3"})
+	assert.Equal(t, "10.9.9.9", proxies.clientIP(req))
+}
+
+func TestClientIPSpoofAttempts(t *testing.T) {
+	proxies := proxyList(parseIPList([]string{"10.0.0.0/8"}))
+
+	// Headers from untrusted clients are ignored
+	req := clientIPRequest("203.0.113.7:5000", map[string]string{
+		"X-Forwarded-For": "1.2.3.4",
+		"X-Real-IP":       "1.2.3.4",
+	})
+	assert.Equal(t, "203.0.113.7", proxies.clientIP(req))
+
+	// A client prepending a fake address through a trusted proxy is still
+	// identified by the address the proxy saw
+	req = clientIPRequest("10.0.0.5:5000", map[string]string{"X-Forwarded-For": "1.2.3.4, 203.0.113.7"})
+	assert.Equal(t, "203.0.113.7", proxies.clientIP(req))
+
+	// Garbage stops the walk at the last trusted hop
+	req = clientIPRequest("10.0.0.5:5000", map[string]string{"X-Forwarded-For": "not-an-ip, 10.1.2.3"})
+	assert.Equal(t, "10.1.2.3", proxies.clientIP(req))
+
+	// With no trusted proxies configured, forwarding headers are never used
+	req = clientIPRequest("10.0.0.5:5000", map[string]string{"X-Forwarded-For": "203.0.113.7"})
+	assert.Equal(t, "10.0.0.5", proxyList(nil).clientIP(req))
+}
@@ -0,0 +1,70 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"os"
+	"time"
+
+	"your-project/hld/firebase"
+)
+
+// defaultUsageLogRetentionDays is how long raw usage logs are kept before
+// being rolled up
+const defaultUsageLogRetentionDays = 90
+
+// defaultUsageCompactionInterval is how often old usage logs are compacted
+const defaultUsageCompactionInterval = 24 * time.Hour
+
+// usageLogRetentionFromEnv reads USAGE_LOG_RETENTION_DAYS, how many days of
+// raw usage logs to keep
+func usageLogRetentionFromEnv() time.Duration {
+	days := getEnvInt("USAGE_LOG_RETENTION_DAYS")
+	if days <= 0 {
+		days = defaultUsageLogRetentionDays
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+// usageCompactionIntervalFromEnv reads USAGE_COMPACTION_INTERVAL
+func usageCompactionIntervalFromEnv() time.Duration {
+	interval := defaultUsageCompactionInterval
+	if raw := os.Getenv("USAGE_COMPACTION_INTERVAL"); raw != "" {
+		if d, err := time.ParseDuration(raw); err == nil && d > 0 {
+			interval = d
+		} else {
+			logger().Warn("invalid USAGE_COMPACTION_INTERVAL, using default", "value", raw, "default", interval)
+		}
+	}
+	return interval
+}
+
+// runUsageCompaction periodically rolls usage logs older than retention into
+// monthly aggregates until ctx is cancelled. Every instance may run it; the
+// compaction lease lets one at a time through.
+func runUsageCompaction(ctx context.Context, client *firebase.Client, interval, retention time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			report, err := client.CompactUsageLogs(ctx, retention)
+			switch {
+			case errors.Is(err, firebase.ErrCompactionRunning):
+				logger().Debug("usage log compaction running elsewhere, skipping")
+				continue
+			case err != nil:
+				logger().Error("failed to compact usage logs", "error", err)
+			}
+			if report != nil && report.LogsCompacted > 0 {
+				logger().Info("usage log compaction completed",
+					"logs_compacted", report.LogsCompacted,
+					"rollups", report.Rollups,
+					"cutoff", report.Cutoff)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
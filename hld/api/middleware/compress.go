@@ -0,0 +1,249 @@
+package middleware
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// defaultCompressionMinSize is the smallest response worth compressing
+const defaultCompressionMinSize = 1024
+
+// incompressibleTypes are content types that are already compressed
+var incompressibleTypes = []string{
+	"image/", "video/", "audio/", "font/woff",
+	"application/gzip", "application/x-gzip", "application/zip",
+	"application/zstd", "application/x-brotli", "application/pdf",
+}
+
+// CompressionConfig controls response compression
+type CompressionConfig struct {
+	// MinSize is the smallest body compressed. Streamed responses are
+	// compressed from their first flush whatever their size.
+	MinSize int
+}
+
+// CompressionConfigFromEnv reads COMPRESSION_MIN_SIZE in bytes
+func CompressionConfigFromEnv() (CompressionConfig, error) {
+	cfg := CompressionConfig{MinSize: defaultCompressionMinSize}
+	if raw := os.Getenv("COMPRESSION_MIN_SIZE"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 0 {
+			return CompressionConfig{}, fmt.Errorf("invalid COMPRESSION_MIN_SIZE %q", raw)
+		}
+		cfg.MinSize = n
+	}
+	return cfg, nil
+}
+
+// Handler compresses responses with gzip or deflate when the client accepts
+// them. Mount it outside TrackUsage so usage is read from the uncompressed
+// body:
+//
+//	handler := compression.Handler(m.CheckAuth(m.TrackUsage(proxy)))
+//
+// Flushes are passed through, so SSE streams still arrive event by event.
+// WebSocket upgrades and responses that already set Content-Encoding are
+// left alone.
+func (c CompressionConfig) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		encoding := negotiateEncoding(r.Header.Get("Accept-Encoding"))
+		if encoding == "" || r.Method == http.MethodHead || r.Header.Get("Upgrade") != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// The response varies on Accept-Encoding whether or not this one
+		// ends up compressed
+		w.Header().Add("Vary", "Accept-Encoding")
+		cw := &compressWriter{ResponseWriter: w, encoding: encoding, minSize: c.MinSize}
+		defer cw.close()
+		next.ServeHTTP(cw, r)
+	})
+}
+
+// negotiateEncoding picks gzip or deflate from an Accept-Encoding header,
+// preferring gzip at equal quality. A "*" entry stands in for gzip when gzip
+// isn't listed. It returns "" if neither is acceptable.
+func negotiateEncoding(header string) string {
+	q := map[string]float64{}
+	for _, part := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		weight := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			parsed, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				continue
+			}
+			weight = parsed
+		}
+		q[name] = weight
+	}
+
+	gzipQ, ok := q["gzip"]
+	if !ok {
+		gzipQ = q["*"]
+	}
+	switch {
+	case gzipQ > 0 && gzipQ >= q["deflate"]:
+		return "gzip"
+	case q["deflate"] > 0:
+		return "deflate"
+	}
+	return ""
+}
+
+// compressible reports whether a response of contentType benefits from
+// compression
+func compressible(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType = strings.ToLower(contentType)
+	}
+	for _, prefix := range incompressibleTypes {
+		if strings.HasPrefix(mediaType, prefix) {
+			return false
+		}
+	}
+	return true
+}
+
+// compressWriter buffers the start of a response until it knows whether to
+// compress it: once MinSize bytes are written, on the first flush, or when
+// the handler returns
+type compressWriter struct {
+	http.ResponseWriter
+	encoding string
+	minSize  int
+
+	status  int
+	buf     []byte
+	decided bool
+	// enc is set once the response is being compressed
+	enc interface {
+		io.WriteCloser
+		Flush() error
+	}
+}
+
+func (cw *compressWriter) WriteHeader(code int) {
+	// Informational responses, and anything after the decision, go
+	// straight out
+	if cw.decided || code < 200 {
+		cw.ResponseWriter.WriteHeader(code)
+		return
+	}
+	if cw.status == 0 {
+		cw.status = code
+	}
+}
+
+func (cw *compressWriter) Write(b []byte) (int, error) {
+	if !cw.decided {
+		cw.buf = append(cw.buf, b...)
+		if len(cw.buf) == 0 || len(cw.buf) < cw.minSize {
+			return len(b), nil
+		}
+		if err := cw.decide(); err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	}
+	if cw.enc != nil {
+		return cw.enc.Write(b)
+	}
+	return cw.ResponseWriter.Write(b)
+}
+
+// Flush sends everything written so far, compressing from here on if the
+// response qualifies
+func (cw *compressWriter) Flush() {
+	if !cw.decided {
+		if err := cw.decide(); err != nil {
+			return
+		}
+	}
+	if cw.enc != nil {
+		if err := cw.enc.Flush(); err != nil {
+			return
+		}
+	}
+	_ = http.NewResponseController(cw.ResponseWriter).Flush()
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (cw *compressWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+// decide writes the header, compressed or not, followed by any buffered body
+func (cw *compressWriter) decide() error {
+	cw.decided = true
+	status := cw.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+
+	h := cw.Header()
+	if h.Get("Content-Type") == "" && len(cw.buf) > 0 {
+		h.Set("Content-Type", http.DetectContentType(cw.buf))
+	}
+	if status != http.StatusNoContent && status != http.StatusNotModified &&
+		h.Get("Content-Encoding") == "" && compressible(h.Get("Content-Type")) {
+		h.Set("Content-Encoding", cw.encoding)
+		h.Del("Content-Length")
+		if cw.encoding == "gzip" {
+			cw.enc = gzip.NewWriter(cw.ResponseWriter)
+		} else {
+			// Only fails for invalid levels
+			cw.enc, _ = flate.NewWriter(cw.ResponseWriter, flate.DefaultCompression)
+		}
+	}
+
+	cw.ResponseWriter.WriteHeader(status)
+	buf := cw.buf
+	cw.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	var err error
+	if cw.enc != nil {
+		_, err = cw.enc.Write(buf)
+	} else {
+		_, err = cw.ResponseWriter.Write(buf)
+	}
+	return err
+}
+
+// close finishes the response once the handler returns. Small responses
+// that never reached MinSize are sent uncompressed.
+func (cw *compressWriter) close() {
+	if !cw.decided {
+		if len(cw.buf) == 0 || len(cw.buf) < cw.minSize {
+			// Not worth compressing; send as is
+			cw.decided = true
+			if cw.status != 0 {
+				cw.ResponseWriter.WriteHeader(cw.status)
+			}
+			if len(cw.buf) > 0 {
+				_, _ = cw.ResponseWriter.Write(cw.buf)
+			}
+			return
+		}
+		if err := cw.decide(); err != nil {
+			return
+		}
+	}
+	if cw.enc != nil {
+		if err := cw.enc.Close(); err != nil {
+			logger().Debug("failed to finish compressed response", "error", err)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package middleware
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// decompress decodes a response body sent with encoding
+func decompress(t *testing.T, encoding string, body []byte) string {
+	t.Helper()
+	var r io.Reader
+	switch encoding {
+	case "gzip":
+		zr, err := gzip.NewReader(bytes.NewReader(body))
+		require.NoError(t, err)
+		r = zr
+	case "deflate":
+		r = flate.NewReader(bytes.NewReader(body))
+	default:
+		return string(body)
+	}
+	out, err := io.ReadAll(r)
+	require.NoError(t, err)
+	return string(out)
+}
+
+func TestNegotiateEncoding(t *testing.T) {
+	tests := map[string]string{
+		"":                        "",
+		"gzip":                    "gzip",
+		"deflate":                 "deflate",
+		"deflate, gzip":           "gzip",
+		"gzip;q=0.5, deflate":     "deflate",
+		"gzip;q=0, deflate;q=0.1": "deflate",
+		"br":                      "",
+		"br, *":                   "gzip",
+		"*, gzip;q=0":             "",
+		"identity":                "",
+	}
+	for header, want := range tests {
+		assert.Equal(t, want, negotiateEncoding(header), header)
+	}
+}
+
+func TestCompressionConfigFromEnv(t *testing.T) {
+	cfg, err := CompressionConfigFromEnv()
+	require.NoError(t, err)
+	assert.Equal(t, defaultCompressionMinSize, cfg.MinSize)
+
+	t.Setenv("COMPRESSION_MIN_SIZE", "-1")
+	_, err = CompressionConfigFromEnv()
+	assert.Error(t, err)
+}
+
+func TestCompressionHandler(t *testing.T) {
+	large := strings.Repeat(`{"model":"claude","points":1}`, 100)
+	cfg := CompressionConfig{MinSize: 256}
+
+	serve := func(acceptEncoding string, h http.HandlerFunc) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/admin/usage/export", nil)
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+		w := httptest.NewRecorder()
+		cfg.Handler(h).ServeHTTP(w, req)
+		return w
+	}
+	jsonHandler := func(body string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Content-Length", "999")
+			w.WriteHeader(http.StatusCreated)
+			_, _ = io.WriteString(w, body)
+		}
+	}
+
+	for _, encoding := range []string{"gzip", "deflate"} {
+		w := serve(encoding, jsonHandler(large))
+		assert.Equal(t, http.StatusCreated, w.Code)
+		assert.Equal(t, encoding, w.Header().Get("Content-Encoding"))
+		assert.Empty(t, w.Header().Get("Content-Length"))
+		assert.Equal(t, "Accept-Encoding", w.Header().Get("Vary"))
+		assert.Less(t, w.Body.Len(), len(large))
+		assert.Equal(t, large, decompress(t, encoding, w.Body.Bytes()))
+	}
+
+	// Small responses, clients without gzip and compressed types pass through
+	w := serve("gzip", jsonHandler(`{"ok":true}`))
+	assert.Equal(t, http.StatusCreated, w.Code)
+	assert.Empty(t, w.Header().Get("Content-Encoding"))
+	assert.Equal(t, `{"ok":true}`, w.Body.String())
+
+	w = serve("", jsonHandler(large))
+	assert.Empty(t, w.Header().Get("Content-Encoding"))
+	assert.Equal(t, large, w.Body.String())
+
+	w = serve("gzip", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		_, _ = io.WriteString(w, large)
+	})
+	assert.Empty(t, w.Header().Get("Content-Encoding"))
+	assert.Equal(t, large, w.Body.String())
+}
+
+func TestCompressionHandlerFlushes(t *testing.T) {
+	flushed := make(chan string, 1)
+	handler := CompressionConfig{MinSize: 1024}.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		_, _ = io.WriteString(w, "event: ping\ndata: {}\n\n")
+		w.(http.Flusher).Flush()
+		rec := w.(*compressWriter).ResponseWriter.(*httptest.ResponseRecorder)
+		// The event is readable before the handler returns
+		flushed <- decompressPartial(t, rec.Body.Bytes())
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/v1/messages", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	assert.True(t, w.Flushed)
+	assert.Equal(t, "gzip", w.Header().Get("Content-Encoding"))
+	assert.Equal(t, "event: ping\ndata: {}\n\n", <-flushed)
+	assert.Equal(t, "event: ping\ndata: {}\n\n", decompress(t, "gzip", w.Body.Bytes()))
+}
+
+// decompressPartial reads what a gzip stream has flushed so far
+func decompressPartial(t *testing.T, body []byte) string {
+	t.Helper()
+	zr, err := gzip.NewReader(bytes.NewReader(body))
+	require.NoError(t, err)
+	buf := make([]byte, 1024)
+	n, _ := io.ReadAtLeast(zr, buf, 1)
+	return string(buf[:n])
+}
+
+func TestCompressionComposesWithTrackUsage(t *testing.T) {
+	// TrackUsage's writer sees the uncompressed body and passes flushes
+	// through to the compressor
+	var seen []byte
+	inner := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, strings.Repeat("a", 2048))
+		w.(http.Flusher).Flush()
+		seen = w.(*responseWriter).capture.body()
+	})
+	track := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rw := &responseWriter{ResponseWriter: w, statusCode: http.StatusOK}
+		inner.ServeHTTP(rw, r)
+	})
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/messages", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	w := httptest.NewRecorder()
+	CompressionConfig{MinSize: 1024}.Handler(track).ServeHTTP(w, req)
+
+	assert.Equal(t, strings.Repeat("a", 2048), string(seen))
+	assert.True(t, w.Flushed)
+	assert.Equal(t, strings.Repeat("a", 2048), decompress(t, "gzip", w.Body.Bytes()))
+}
@@ -0,0 +1,228 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"your-project/hld/internal/apierror"
+)
+
+// defaultMaxConcurrentRequests is how many requests a user may have in
+// flight at once unless their plan says otherwise
+const defaultMaxConcurrentRequests = 5
+
+// errConcurrencyLimit is returned when no slot frees up within the wait timeout
+var errConcurrencyLimit = errors.New("too many concurrent requests")
+
+// concurrencySlots tracks one user's in-flight requests and the requests
+// queued behind them
+type concurrencySlots struct {
+	inFlight int
+	// waiters are woken in arrival order; a closed channel hands the
+	// receiver the slot its sender released
+	waiters []chan struct{}
+}
+
+// ConcurrencyLimiter caps how many requests each user has in flight. Excess
+// requests wait up to a timeout for a slot before being rejected. Users
+// without in-flight or queued requests take no memory.
+type ConcurrencyLimiter struct {
+	mu    sync.Mutex
+	users map[string]*concurrencySlots
+	total int
+
+	defaultMax int
+	wait       time.Duration
+	plans      Plans
+	lookupPlan PlanLookupFunc
+
+	rejected *Counter
+}
+
+// NewConcurrencyLimiter creates a limiter from MAX_CONCURRENT_REQUESTS and
+// CONCURRENCY_WAIT_TIMEOUT, with per-plan overrides from plans. Without a
+// wait timeout excess requests are rejected immediately.
+func NewConcurrencyLimiter(plans Plans, lookupPlan PlanLookupFunc, metrics *Metrics) *ConcurrencyLimiter {
+	max := defaultMaxConcurrentRequests
+	if raw := getEnvInt("MAX_CONCURRENT_REQUESTS"); raw > 0 {
+		max = raw
+	}
+	var wait time.Duration
+	if raw := os.Getenv("CONCURRENCY_WAIT_TIMEOUT"); raw != "" {
+		if d, err := time.ParseDuration(raw); err == nil && d >= 0 {
+			wait = d
+		} else {
+			logger().Warn("invalid CONCURRENCY_WAIT_TIMEOUT, not queueing", "value", raw)
+		}
+	}
+
+	l := &ConcurrencyLimiter{
+		users:      make(map[string]*concurrencySlots),
+		defaultMax: max,
+		wait:       wait,
+		plans:      plans,
+		lookupPlan: lookupPlan,
+		rejected:   metrics.Counter("hld_concurrency_rejected_total", "Requests rejected by the per-user concurrency limit"),
+	}
+	metrics.RegisterGaugeFunc("hld_requests_in_flight",
+		"Requests currently holding a per-user concurrency slot",
+		func(ctx context.Context) (float64, error) {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			return float64(l.total), nil
+		})
+	return l
+}
+
+// Limit returns the number of concurrent requests allowed for userID
+func (l *ConcurrencyLimiter) Limit(ctx context.Context, userID string) int {
+	if len(l.plans) == 0 || l.lookupPlan == nil {
+		return l.defaultMax
+	}
+	plan, err := l.lookupPlan(ctx, userID)
+	if err != nil {
+		logger().Warn("failed to look up plan for concurrency limit", "user_id", userID, "error", err)
+		return l.defaultMax
+	}
+	if p, ok := l.plans[plan]; ok && p.MaxConcurrentRequests > 0 {
+		return p.MaxConcurrentRequests
+	}
+	return l.defaultMax
+}
+
+// InFlight returns the number of requests userID currently has in flight
+func (l *ConcurrencyLimiter) InFlight(userID string) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if s, ok := l.users[userID]; ok {
+		return s.inFlight
+	}
+	return 0
+}
+
+// Acquire takes one of userID's max slots, waiting up to the limiter's
+// timeout for one to free up. The returned release func must be called
+// exactly once when the request finishes; extra calls are ignored.
+func (l *ConcurrencyLimiter) Acquire(ctx context.Context, userID string, max int) (release func(), err error) {
+	l.mu.Lock()
+	s, ok := l.users[userID]
+	if !ok {
+		s = &concurrencySlots{}
+		l.users[userID] = s
+	}
+	// Queued requests go first so a steady stream of new arrivals can't
+	// starve them
+	if s.inFlight < max && len(s.waiters) == 0 {
+		s.inFlight++
+		l.total++
+		l.mu.Unlock()
+		return l.releaser(userID, max), nil
+	}
+	if l.wait <= 0 {
+		l.forget(userID, s)
+		l.mu.Unlock()
+		l.rejected.Inc()
+		return nil, errConcurrencyLimit
+	}
+	ready := make(chan struct{})
+	s.waiters = append(s.waiters, ready)
+	l.mu.Unlock()
+
+	timer := time.NewTimer(l.wait)
+	defer timer.Stop()
+
+	select {
+	case <-ready:
+		return l.releaser(userID, max), nil
+	case <-timer.C:
+		err = errConcurrencyLimit
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	l.mu.Lock()
+	for i, w := range s.waiters {
+		if w == ready {
+			s.waiters = append(s.waiters[:i], s.waiters[i+1:]...)
+			l.forget(userID, s)
+			l.mu.Unlock()
+			l.rejected.Inc()
+			return nil, err
+		}
+	}
+	l.mu.Unlock()
+
+	// A slot was handed over as we gave up; pass it on
+	l.releaser(userID, max)()
+	l.rejected.Inc()
+	return nil, err
+}
+
+// releaser returns a func that frees one of userID's slots, handing it
+// straight to the next queued request if there is one and the user is
+// still under max
+func (l *ConcurrencyLimiter) releaser(userID string, max int) func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			s := l.users[userID]
+			if len(s.waiters) > 0 && s.inFlight <= max {
+				close(s.waiters[0])
+				s.waiters = s.waiters[1:]
+				return
+			}
+			s.inFlight--
+			l.total--
+			l.forget(userID, s)
+		})
+	}
+}
+
+// forget drops s once it has nothing in flight or queued. Callers must hold
+// l.mu.
+func (l *ConcurrencyLimiter) forget(userID string, s *concurrencySlots) {
+	if s.inFlight == 0 && len(s.waiters) == 0 {
+		delete(l.users, userID)
+	}
+}
+
+// LimitConcurrency caps each authenticated user's in-flight requests. It
+// must run after CheckAuth so the user ID is in context. Slots are released
+// when the wrapped handler returns, including when it panics or the client
+// disconnects.
+func (m *UsageMiddleware) LimitConcurrency(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userID, ok := r.Context().Value("user_id").(string)
+		if m.concurrency == nil || !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		log := requestLogger(r.Context())
+
+		max := m.concurrency.Limit(r.Context(), userID)
+		release, err := m.concurrency.Acquire(r.Context(), userID, max)
+		if err != nil {
+			if r.Context().Err() != nil {
+				// The client went away while queued
+				return
+			}
+			log.Warn("user over concurrency limit", "user_id", userID, "max_concurrent", max)
+			w.Header().Set("Retry-After", "1")
+			writeError(w, http.StatusTooManyRequests, APIError{
+				Code:    apierror.CodeTooManyConcurrentRequests,
+				Message: "Too many requests in progress. Wait for one to finish and retry.",
+				Details: map[string]interface{}{"max_concurrent_requests": max},
+			})
+			return
+		}
+		defer release()
+
+		next.ServeHTTP(w, r)
+	})
+}
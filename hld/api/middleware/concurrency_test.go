@@ -0,0 +1,149 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConcurrencyLimiterRejectsWithoutWait(t *testing.T) {
+	metrics := NewMetrics()
+	l := NewConcurrencyLimiter(nil, nil, metrics)
+	ctx := context.Background()
+
+	r1, err := l.Acquire(ctx, "u1", 2)
+	require.NoError(t, err)
+	r2, err := l.Acquire(ctx, "u1", 2)
+	require.NoError(t, err)
+
+	// Third request is over the cap, other users are unaffected
+	_, err = l.Acquire(ctx, "u1", 2)
+	assert.ErrorIs(t, err, errConcurrencyLimit)
+	r3, err := l.Acquire(ctx, "u2", 2)
+	require.NoError(t, err)
+	assert.Equal(t, 2, l.InFlight("u1"))
+
+	// Releasing twice only frees one slot
+	r1()
+	r1()
+	assert.Equal(t, 1, l.InFlight("u1"))
+
+	r2()
+	r3()
+	assert.Empty(t, l.users)
+	assert.Equal(t, 0, l.total)
+	assert.Equal(t, int64(1), l.rejected.Value())
+}
+
+func TestConcurrencyLimiterQueues(t *testing.T) {
+	t.Setenv("CONCURRENCY_WAIT_TIMEOUT", "2s")
+	l := NewConcurrencyLimiter(nil, nil, NewMetrics())
+	ctx := context.Background()
+
+	release, err := l.Acquire(ctx, "u1", 1)
+	require.NoError(t, err)
+
+	acquired := make(chan func())
+	go func() {
+		r, err := l.Acquire(ctx, "u1", 1)
+		assert.NoError(t, err)
+		acquired <- r
+	}()
+
+	// The queued request gets the slot once it is released
+	time.Sleep(20 * time.Millisecond)
+	release()
+	select {
+	case r := <-acquired:
+		assert.Equal(t, 1, l.InFlight("u1"))
+		r()
+	case <-time.After(time.Second):
+		t.Fatal("queued request was not granted the released slot")
+	}
+	assert.Empty(t, l.users)
+}
+
+func TestConcurrencyLimiterWaitTimeout(t *testing.T) {
+	t.Setenv("CONCURRENCY_WAIT_TIMEOUT", "20ms")
+	l := NewConcurrencyLimiter(nil, nil, NewMetrics())
+
+	release, err := l.Acquire(context.Background(), "u1", 1)
+	require.NoError(t, err)
+
+	_, err = l.Acquire(context.Background(), "u1", 1)
+	assert.ErrorIs(t, err, errConcurrencyLimit)
+
+	// A cancelled request leaves the queue too
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = l.Acquire(ctx, "u1", 1)
+	assert.ErrorIs(t, err, context.Canceled)
+
+	release()
+	assert.Empty(t, l.users)
+}
+
+func TestConcurrencyLimiterPlanOverrides(t *testing.T) {
+	plans := Plans{"pro": {MaxConcurrentRequests: 20}}
+	lookup := func(ctx context.Context, userID string) (string, error) {
+		if userID == "pro-user" {
+			return "pro", nil
+		}
+		return "free", nil
+	}
+	l := NewConcurrencyLimiter(plans, lookup, NewMetrics())
+
+	assert.Equal(t, 20, l.Limit(context.Background(), "pro-user"))
+	assert.Equal(t, defaultMaxConcurrentRequests, l.Limit(context.Background(), "free-user"))
+}
+
+func TestLimitConcurrencyMiddleware(t *testing.T) {
+	t.Setenv("MAX_CONCURRENT_REQUESTS", "1")
+	metrics := NewMetrics()
+	m := &UsageMiddleware{enabled: true, concurrency: NewConcurrencyLimiter(nil, nil, metrics)}
+
+	entered := make(chan struct{})
+	unblock := make(chan struct{})
+	handler := m.LimitConcurrency(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/panic" {
+			panic("boom")
+		}
+		close(entered)
+		<-unblock
+		w.WriteHeader(http.StatusOK)
+	}))
+	newReq := func(path string) *http.Request {
+		req := httptest.NewRequest(http.MethodPost, path, nil)
+		return req.WithContext(context.WithValue(req.Context(), "user_id", "user-1"))
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		handler.ServeHTTP(httptest.NewRecorder(), newReq("/v1/messages"))
+	}()
+	<-entered
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, newReq("/v1/messages"))
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Contains(t, w.Body.String(), `"too_many_concurrent_requests"`)
+	assert.Equal(t, "1", w.Header().Get("Retry-After"))
+
+	// The in-flight gauge reports the running request
+	mw := httptest.NewRecorder()
+	metrics.ServeHTTP(mw, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	assert.Contains(t, mw.Body.String(), "hld_requests_in_flight 1\n")
+
+	close(unblock)
+	<-done
+
+	// A panicking handler still frees its slot
+	assert.Panics(t, func() { handler.ServeHTTP(httptest.NewRecorder(), newReq("/panic")) })
+	assert.Equal(t, 0, m.concurrency.InFlight("user-1"))
+}
@@ -0,0 +1,130 @@
+package middleware
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultCORSMaxAge is how long browsers may cache a preflight response
+const defaultCORSMaxAge = 10 * time.Minute
+
+// corsAllowedMethods are the methods the API serves
+const corsAllowedMethods = "GET, POST, PUT, PATCH, DELETE, OPTIONS"
+
+// corsExposedHeaders are response headers the web client needs to read
+const corsExposedHeaders = "Retry-After, X-Points-Remaining, X-Estimated-Requests-Remaining, X-Low-Balance-Warning"
+
+// CORSConfig controls which browser origins may call the API directly
+type CORSConfig struct {
+	// Origins are allowed origins such as "https://app.example.com". An
+	// entry like "https://*.example.com" allows any subdomain, and "*"
+	// allows every origin.
+	Origins []string
+	// MaxAge is sent as Access-Control-Max-Age on preflight responses
+	MaxAge time.Duration
+}
+
+// CORSConfigFromEnv reads the comma separated ALLOWED_ORIGINS and
+// CORS_MAX_AGE. With no origins configured no CORS headers are sent.
+func CORSConfigFromEnv() (CORSConfig, error) {
+	cfg := CORSConfig{
+		Origins: splitList(os.Getenv("ALLOWED_ORIGINS")),
+		MaxAge:  defaultCORSMaxAge,
+	}
+	for _, origin := range cfg.Origins {
+		if origin == "*" {
+			continue
+		}
+		u, err := url.Parse(origin)
+		if err != nil || u.Scheme == "" || u.Host == "" || (u.Path != "" && u.Path != "/") {
+			return CORSConfig{}, fmt.Errorf("invalid ALLOWED_ORIGINS entry %q: must be scheme://host", origin)
+		}
+	}
+	if raw := os.Getenv("CORS_MAX_AGE"); raw != "" {
+		d, err := time.ParseDuration(raw)
+		if err != nil || d < 0 {
+			return CORSConfig{}, fmt.Errorf("invalid CORS_MAX_AGE %q", raw)
+		}
+		cfg.MaxAge = d
+	}
+	return cfg, nil
+}
+
+// allows reports whether origin matches an allowed origin. Wildcards match
+// one or more subdomain labels but not the bare domain.
+func (c CORSConfig) allows(origin string) bool {
+	if origin == "" {
+		return false
+	}
+	origin = strings.ToLower(origin)
+	for _, allowed := range c.Origins {
+		allowed = strings.ToLower(strings.TrimRight(allowed, "/"))
+		if allowed == "*" || allowed == origin {
+			return true
+		}
+		scheme, host, ok := strings.Cut(allowed, "://*.")
+		if !ok {
+			continue
+		}
+		sub, found := strings.CutSuffix(strings.TrimPrefix(origin, scheme+"://"), "."+host)
+		if found && strings.HasPrefix(origin, scheme+"://") && sub != "" && !strings.ContainsAny(sub, "/:") {
+			return true
+		}
+	}
+	return false
+}
+
+// Handler adds CORS headers for allowed origins and answers preflight
+// requests itself, so it must wrap CheckAuth for preflights not to 401.
+// Disallowed origins get no CORS headers, which makes the browser block the
+// response without the server returning an error.
+func (c CORSConfig) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		preflight := r.Method == http.MethodOptions && origin != "" &&
+			r.Header.Get("Access-Control-Request-Method") != ""
+
+		h := w.Header()
+		h.Add("Vary", "Origin")
+		if c.allows(origin) {
+			h.Set("Access-Control-Allow-Origin", origin)
+			if preflight {
+				h.Set("Access-Control-Allow-Methods", corsAllowedMethods)
+				// Echo the requested headers, which covers Authorization and
+				// the X-Usage-Metadata-* family without listing every key
+				if reqHeaders := r.Header.Get("Access-Control-Request-Headers"); reqHeaders != "" {
+					h.Set("Access-Control-Allow-Headers", reqHeaders)
+				}
+				h.Set("Access-Control-Max-Age", strconv.Itoa(int(c.MaxAge.Seconds())))
+				h.Add("Vary", "Access-Control-Request-Method")
+				h.Add("Vary", "Access-Control-Request-Headers")
+			} else {
+				h.Set("Access-Control-Expose-Headers", corsExposedHeaders)
+			}
+		}
+
+		if preflight {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// checkOrigin accepts WebSocket handshakes from the same host or an allowed
+// origin. Requests without an Origin header don't come from a browser.
+func (c CORSConfig) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if u, err := url.Parse(origin); err == nil && strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	return c.allows(origin)
+}
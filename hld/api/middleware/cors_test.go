@@ -0,0 +1,96 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCORSConfigAllows(t *testing.T) {
+	cfg := CORSConfig{Origins: []string{"https://app.example.com", "https://*.example.org"}}
+
+	tests := []struct {
+		origin string
+		want   bool
+	}{
+		{origin: "https://app.example.com", want: true},
+		{origin: "https://APP.example.com", want: true},
+		{origin: "http://app.example.com", want: false},
+		{origin: "https://evil.com", want: false},
+		{origin: "https://a.example.org", want: true},
+		{origin: "https://a.b.example.org", want: true},
+		{origin: "https://example.org", want: false},
+		{origin: "https://a.example.org:8443", want: false},
+		{origin: "https://evilexample.org", want: false},
+		{origin: "", want: false},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, cfg.allows(tt.origin), tt.origin)
+	}
+
+	assert.True(t, CORSConfig{Origins: []string{"*"}}.allows("https://anything.test"))
+}
+
+func TestCORSConfigFromEnv(t *testing.T) {
+	t.Setenv("ALLOWED_ORIGINS", "https://app.example.com, https://*.example.org")
+	cfg, err := CORSConfigFromEnv()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"https://app.example.com", "https://*.example.org"}, cfg.Origins)
+	assert.Equal(t, defaultCORSMaxAge, cfg.MaxAge)
+
+	t.Setenv("ALLOWED_ORIGINS", "app.example.com")
+	_, err = CORSConfigFromEnv()
+	assert.Error(t, err)
+}
+
+func TestCORSPreflightSkipsNext(t *testing.T) {
+	called := false
+	handler := CORSConfig{Origins: []string{"https://app.example.com"}, MaxAge: defaultCORSMaxAge}.
+		Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			called = true
+			w.WriteHeader(http.StatusUnauthorized)
+		}))
+
+	req := httptest.NewRequest(http.MethodOptions, "/v1/messages", nil)
+	req.Header.Set("Origin", "https://app.example.com")
+	req.Header.Set("Access-Control-Request-Method", "POST")
+	req.Header.Set("Access-Control-Request-Headers", "authorization, content-type")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	assert.False(t, called)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Equal(t, "https://app.example.com", w.Header().Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "authorization, content-type", w.Header().Get("Access-Control-Allow-Headers"))
+	assert.Equal(t, "600", w.Header().Get("Access-Control-Max-Age"))
+
+	// Disallowed origins get a bare response
+	req.Header.Set("Origin", "https://evil.com")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	assert.False(t, called)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Empty(t, w.Header().Get("Access-Control-Allow-Origin"))
+	assert.Empty(t, w.Header().Get("Access-Control-Allow-Headers"))
+}
+
+func TestCORSSimpleRequest(t *testing.T) {
+	handler := CORSConfig{Origins: []string{"https://app.example.com"}}.
+		Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusUnauthorized)
+		}))
+
+	req := httptest.NewRequest(http.MethodGet, "/me", nil)
+	req.Header.Set("Origin", "https://app.example.com")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	// Errors from the wrapped handler stay readable by the browser
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Equal(t, "https://app.example.com", w.Header().Get("Access-Control-Allow-Origin"))
+	assert.Contains(t, w.Header().Get("Access-Control-Expose-Headers"), "X-Points-Remaining")
+}
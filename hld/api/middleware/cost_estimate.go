@@ -0,0 +1,69 @@
+package middleware
+
+import (
+	"errors"
+	"net/http"
+
+	"your-project/hld/firebase"
+	"your-project/hld/internal/apierror"
+)
+
+// CostEstimateResponse previews the points a Messages request would cost
+type CostEstimateResponse struct {
+	// EstimatedPoints is an upper estimate based on the request size and
+	// max_tokens; the actual charge is usually lower
+	EstimatedPoints  int  `json:"estimated_points"`
+	Affordable       bool `json:"affordable"`
+	Balance          int  `json:"balance"`
+	SpendableBalance int  `json:"spendable_balance"`
+	// BalanceAfter is the balance left if the estimate were charged, or the
+	// current balance when it isn't affordable
+	BalanceAfter int `json:"balance_after"`
+	Shortfall    int `json:"shortfall,omitempty"`
+}
+
+// CostEstimate handles POST /cost-estimate. The body is a Messages request,
+// which is estimated and checked against the caller's balance with a dry-run
+// deduction; nothing is forwarded or charged.
+func (m *UsageMiddleware) CostEstimate(w http.ResponseWriter, r *http.Request) {
+	if !m.enabled {
+		writeError(w, http.StatusNotFound, APIError{
+			Code:    apierror.CodeNotFound,
+			Message: "Usage tracking is disabled",
+		})
+		return
+	}
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, APIError{Code: apierror.CodeMethodNotAllowed, Message: "POST required"})
+		return
+	}
+
+	r, caller, ok := m.authenticateOnly(w, r)
+	if !ok {
+		return
+	}
+	userID := caller.userID
+
+	estimate := m.estimateCost(r, userID)
+	preview, err := m.client(r.Context()).DryRunDeductPoints(r.Context(), userID, estimate)
+	if err != nil && !errors.Is(err, firebase.ErrInsufficientPoints) {
+		requestLogger(r.Context()).Error("failed to preview deduction", "user_id", userID, "error", err)
+		writeError(w, http.StatusServiceUnavailable, APIError{
+			Code:    apierror.CodeBalanceUnavailable,
+			Message: "Failed to check balance",
+		})
+		return
+	}
+
+	resp := CostEstimateResponse{
+		EstimatedPoints:  estimate,
+		Affordable:       err == nil,
+		Balance:          preview.Balance,
+		SpendableBalance: preview.SpendableBalance,
+		BalanceAfter:     preview.NewBalance,
+	}
+	if !resp.Affordable {
+		resp.Shortfall = estimate - preview.SpendableBalance
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
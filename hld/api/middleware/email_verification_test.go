@@ -0,0 +1,68 @@
+package middleware
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"your-project/hld/firebase"
+)
+
+func TestEmailVerificationPolicy(t *testing.T) {
+	t.Setenv("REQUIRE_VERIFIED_EMAIL", "true")
+	t.Setenv("UNVERIFIED_EMAIL_ALLOWED_PATHS", "/api/v1/balance")
+	policy := emailVerificationPolicyFromEnv()
+
+	unverified := authCaller{userID: "u1", signInProvider: "password"}
+	get := httptest.NewRequest(http.MethodGet, "/api/v1/balance", nil)
+	post := httptest.NewRequest(http.MethodPost, "/api/v1/sessions", nil)
+
+	assert.False(t, policy.allows(unverified, post))
+	assert.True(t, policy.allows(unverified, get), "allowlisted read-only route")
+	assert.False(t, policy.allows(unverified, httptest.NewRequest(http.MethodPost, "/api/v1/balance", nil)),
+		"allowlist only covers reads")
+
+	verified := unverified
+	verified.emailVerified = true
+	assert.True(t, policy.allows(verified, post))
+
+	assert.True(t, policy.allows(authCaller{userID: "u2", signInProvider: "google.com"}, post),
+		"trusted OAuth provider")
+	assert.True(t, policy.allows(authCaller{userID: "u3", apiKey: &firebase.APIKey{UserID: "u3"}}, post))
+
+	t.Setenv("REQUIRE_VERIFIED_EMAIL", "")
+	assert.True(t, emailVerificationPolicyFromEnv().allows(unverified, post))
+}
+
+func TestEmailVerificationGraceModels(t *testing.T) {
+	t.Setenv("REQUIRE_VERIFIED_EMAIL", "true")
+	t.Setenv("UNVERIFIED_EMAIL_ALLOWED_MODELS", "claude-3-5-haiku-20241022")
+	policy := emailVerificationPolicyFromEnv()
+
+	unverified := authCaller{userID: "u1", signInProvider: "password"}
+	messages := func(model string) *http.Request {
+		return httptest.NewRequest(http.MethodPost, "/v1/messages",
+			strings.NewReader(`{"model":"`+model+`","max_tokens":10}`))
+	}
+
+	assert.True(t, policy.allows(unverified, messages("claude-3-5-haiku-20241022")), "free-tier model")
+	assert.False(t, policy.allows(unverified, messages("claude-sonnet-4-20250514")), "paid model")
+	assert.False(t, policy.allows(unverified, httptest.NewRequest(http.MethodPost, "/api/v1/sessions", nil)),
+		"requests without a model")
+	assert.True(t, policy.allows(authCaller{userID: "u1", impersonatorID: "admin-1"}, messages("claude-sonnet-4-20250514")),
+		"admins impersonating the user")
+
+	w := httptest.NewRecorder()
+	policy.writeEmailNotVerified(w)
+	require.Equal(t, http.StatusForbidden, w.Code)
+	var body struct {
+		Details map[string]interface{} `json:"details"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+	assert.Equal(t, []interface{}{"claude-3-5-haiku-20241022"}, body.Details["allowed_models"])
+}
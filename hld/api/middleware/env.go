@@ -0,0 +1,36 @@
+package middleware
+
+import (
+	"os"
+	"strconv"
+)
+
+// getEnvInt parses an integer environment variable, returning 0 when unset
+// or invalid
+func getEnvInt(key string) int {
+	raw := os.Getenv(key)
+	if raw == "" {
+		return 0
+	}
+	v, err := strconv.Atoi(raw)
+	if err != nil {
+		logger().Warn("invalid integer in environment, ignoring", "key", key, "value", raw)
+		return 0
+	}
+	return v
+}
+
+// getEnvFloat parses a float environment variable, returning 0 when unset
+// or invalid
+func getEnvFloat(key string) float64 {
+	raw := os.Getenv(key)
+	if raw == "" {
+		return 0
+	}
+	v, err := strconv.ParseFloat(raw, 64)
+	if err != nil {
+		logger().Warn("invalid number in environment, ignoring", "key", key, "value", raw)
+		return 0
+	}
+	return v
+}
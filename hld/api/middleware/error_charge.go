@@ -0,0 +1,125 @@
+package middleware
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Modes for billing failed requests, set with CHARGE_ON_ERROR
+const (
+	// ErrorChargeNone bills nothing
+	ErrorChargeNone = "none"
+	// ErrorChargeInput bills the input tokens the upstream consumed
+	ErrorChargeInput = "input"
+	// ErrorChargeFull bills all the usage the failed response reported
+	ErrorChargeFull = "full"
+)
+
+// Classes of failed upstream responses, recorded on their usage logs
+const (
+	// ErrorClassClient is a 4xx other than 429, caused by the request
+	ErrorClassClient = "client_error"
+	// ErrorClassRateLimited is a 429
+	ErrorClassRateLimited = "rate_limited"
+	// ErrorClassServer is a 5xx other than 529
+	ErrorClassServer = "server_error"
+	// ErrorClassOverloaded is a 529 from an overloaded upstream
+	ErrorClassOverloaded = "overloaded"
+)
+
+// statusOverloaded is the status Anthropic returns when it is overloaded
+const statusOverloaded = 529
+
+// errorClass classifies a failed response's status, or returns "" for
+// statuses that aren't errors
+func errorClass(status int) string {
+	switch {
+	case status == http.StatusTooManyRequests:
+		return ErrorClassRateLimited
+	case status == statusOverloaded:
+		return ErrorClassOverloaded
+	case status >= 500:
+		return ErrorClassServer
+	case status >= 400:
+		return ErrorClassClient
+	}
+	return ""
+}
+
+// errorChargePolicy maps error classes to the mode they are billed in;
+// classes it doesn't name are free
+type errorChargePolicy map[string]string
+
+// mode returns how failed requests of class are billed
+func (p errorChargePolicy) mode(class string) string {
+	if mode, ok := p[class]; ok {
+		return mode
+	}
+	return ErrorChargeNone
+}
+
+// errorChargePolicyFromEnv parses CHARGE_ON_ERROR, a mode applied to the
+// upstream-caused classes, class=mode pairs, or both, e.g. "input" or
+// "input,overloaded=full,client_error=input". Client errors stay free
+// unless named. Unset, no failed request is billed.
+func errorChargePolicyFromEnv() (errorChargePolicy, error) {
+	policy := errorChargePolicy{}
+	for _, item := range splitList(os.Getenv("CHARGE_ON_ERROR")) {
+		class, mode, named := strings.Cut(item, "=")
+		if !named {
+			mode = class
+		}
+		class, mode = strings.TrimSpace(class), strings.TrimSpace(mode)
+
+		switch mode {
+		case ErrorChargeNone, ErrorChargeInput, ErrorChargeFull:
+		default:
+			return nil, fmt.Errorf("invalid CHARGE_ON_ERROR entry %q: mode must be %s, %s or %s",
+				item, ErrorChargeNone, ErrorChargeInput, ErrorChargeFull)
+		}
+		if !named {
+			for _, c := range []string{ErrorClassRateLimited, ErrorClassServer, ErrorClassOverloaded} {
+				policy[c] = mode
+			}
+			continue
+		}
+		switch class {
+		case ErrorClassClient, ErrorClassRateLimited, ErrorClassServer, ErrorClassOverloaded:
+			policy[class] = mode
+		default:
+			return nil, fmt.Errorf("invalid CHARGE_ON_ERROR entry %q: unknown error class %q", item, class)
+		}
+	}
+	return policy, nil
+}
+
+// errorUsage returns the tokens to bill for a failed request in mode: the
+// usage its response reported, or else the input estimated from the
+// request body. Output is only billed in ErrorChargeFull mode.
+func errorUsage(mode, model string, respBody, reqBody []byte) (inputTokens, outputTokens int) {
+	usage, ok := responseUsage(respBody)
+	inputTokens, outputTokens = usage.input, usage.output
+	if !ok {
+		inputTokens, outputTokens = requestInputTokens(model, reqBody), 0
+	}
+	if mode != ErrorChargeFull {
+		outputTokens = 0
+	}
+	return inputTokens, outputTokens
+}
+
+// requestInputTokens estimates the input tokens of a request body
+func requestInputTokens(model string, body []byte) int {
+	var reqBody struct {
+		System   json.RawMessage `json:"system"`
+		Messages []Message       `json:"messages"`
+		Tools    json.RawMessage `json:"tools"`
+	}
+	if err := json.Unmarshal(body, &reqBody); err != nil {
+		return len(body) / bytesPerToken
+	}
+	return estimateInputTokens(model, reqBody.System, reqBody.Messages, reqBody.Tools, len(body))
+}
@@ -0,0 +1,111 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"your-project/hld/firebase"
+)
+
+func TestErrorChargePolicyFromEnv(t *testing.T) {
+	t.Setenv("CHARGE_ON_ERROR", "")
+	policy, err := errorChargePolicyFromEnv()
+	require.NoError(t, err)
+	for _, class := range []string{ErrorClassClient, ErrorClassRateLimited, ErrorClassServer, ErrorClassOverloaded} {
+		assert.Equal(t, ErrorChargeNone, policy.mode(class))
+	}
+
+	t.Setenv("CHARGE_ON_ERROR", "input, overloaded=full")
+	policy, err = errorChargePolicyFromEnv()
+	require.NoError(t, err)
+	assert.Equal(t, ErrorChargeNone, policy.mode(ErrorClassClient))
+	assert.Equal(t, ErrorChargeInput, policy.mode(ErrorClassRateLimited))
+	assert.Equal(t, ErrorChargeInput, policy.mode(ErrorClassServer))
+	assert.Equal(t, ErrorChargeFull, policy.mode(ErrorClassOverloaded))
+
+	for _, raw := range []string{"some", "client_error=all", "teapot=input"} {
+		t.Setenv("CHARGE_ON_ERROR", raw)
+		_, err := errorChargePolicyFromEnv()
+		assert.Error(t, err, raw)
+	}
+}
+
+func TestErrorClass(t *testing.T) {
+	assert.Equal(t, ErrorClassClient, errorClass(http.StatusBadRequest))
+	assert.Equal(t, ErrorClassRateLimited, errorClass(http.StatusTooManyRequests))
+	assert.Equal(t, ErrorClassServer, errorClass(http.StatusInternalServerError))
+	assert.Equal(t, ErrorClassOverloaded, errorClass(statusOverloaded))
+	assert.Empty(t, errorClass(http.StatusOK))
+}
+
+func TestErrorUsage(t *testing.T) {
+	reported := []byte(`{"type":"error","usage":{"input_tokens":900,"output_tokens":40}}`)
+	in, out := errorUsage(ErrorChargeInput, "claude-3-5-haiku-20241022", reported, nil)
+	assert.Equal(t, 900, in)
+	assert.Zero(t, out)
+	in, out = errorUsage(ErrorChargeFull, "claude-3-5-haiku-20241022", reported, nil)
+	assert.Equal(t, 900, in)
+	assert.Equal(t, 40, out)
+
+	// Without reported usage the input is estimated from the request
+	req := []byte(`{"messages":[{"role":"user","content":"hello"}]}`)
+	in, out = errorUsage(ErrorChargeFull, "claude-3-5-haiku-20241022", []byte(`{"type":"error"}`), req)
+	assert.Equal(t, requestOverheadTokens+messageOverheadTokens+1, in)
+	assert.Zero(t, out)
+}
+
+func TestTrackUsageChargesErrorsByClass(t *testing.T) {
+	const body = `{"model":"claude-3-5-haiku-20241022","messages":[{"role":"user","content":"hello"}]}`
+	input := requestOverheadTokens + messageOverheadTokens + 1
+
+	tests := []struct {
+		status int
+		policy string
+		class  string
+		input  int
+	}{
+		{http.StatusBadRequest, "input", ErrorClassClient, 0},
+		{http.StatusBadRequest, "input,client_error=input", ErrorClassClient, input},
+		{http.StatusTooManyRequests, "input", ErrorClassRateLimited, input},
+		{http.StatusTooManyRequests, "none", ErrorClassRateLimited, 0},
+		{http.StatusInternalServerError, "input", ErrorClassServer, input},
+		{http.StatusInternalServerError, "overloaded=input", ErrorClassServer, 0},
+		{statusOverloaded, "overloaded=input", ErrorClassOverloaded, input},
+		{statusOverloaded, "", ErrorClassOverloaded, 0},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%d %s", tt.status, tt.policy), func(t *testing.T) {
+			t.Setenv("CHARGE_ON_ERROR", tt.policy)
+			m := newTestTrackingMiddleware()
+			var err error
+			m.errorCharges, err = errorChargePolicyFromEnv()
+			require.NoError(t, err)
+			store := &usageRecorder{}
+			m.usageLogger = firebase.NewAsyncLogger(store)
+
+			handler := m.TrackUsage(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+				_, _ = w.Write([]byte(`{"type":"error","error":{"type":"overloaded_error"}}`))
+			}))
+			// Service accounts are logged without being billed, so the
+			// billed tokens can be checked without a Firebase client
+			req := authenticatedRequest(body)
+			ctx := context.WithValue(req.Context(), "usage_store", firebase.UsageStore(store))
+			ctx = context.WithValue(ctx, "service_account", true)
+			handler.ServeHTTP(httptest.NewRecorder(), req.WithContext(ctx))
+
+			require.NoError(t, m.usageLogger.Shutdown(context.Background()))
+			require.Len(t, store.logs, 1)
+			assert.False(t, store.logs[0].Success)
+			assert.Equal(t, tt.class, store.logs[0].ErrorClass)
+			assert.Equal(t, tt.input, store.logs[0].InputTokens)
+			assert.Zero(t, store.logs[0].OutputTokens)
+		})
+	}
+}
@@ -0,0 +1,17 @@
+package middleware
+
+import (
+	"net/http"
+
+	"your-project/hld/internal/apierror"
+)
+
+// APIError is the JSON error body returned by the usage middleware, the
+// envelope shared with the daemon's handlers
+type APIError = apierror.Envelope
+
+// writeError writes an APIError with the given status code, tagged with the
+// request's ID
+func writeError(w http.ResponseWriter, status int, apiErr APIError) {
+	apierror.Write(w, status, apiErr)
+}
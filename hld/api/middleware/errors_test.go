@@ -0,0 +1,175 @@
+package middleware
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"your-project/hld/firebase"
+	"your-project/hld/internal/apierror"
+	"your-project/hld/internal/requestid"
+)
+
+// assertEnvelope checks that w holds an error envelope with status and code,
+// tagged with the request ID the response was sent with
+func assertEnvelope(t *testing.T, w *httptest.ResponseRecorder, status int, code string) APIError {
+	t.Helper()
+	assert.Equal(t, status, w.Code)
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+
+	var env APIError
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &env), w.Body.String())
+	assert.Equal(t, code, env.Code)
+	assert.NotEmpty(t, env.Message)
+	assert.Equal(t, w.Header().Get(requestid.Header), env.RequestID)
+	return env
+}
+
+// serveWithRequestID runs h behind RequestID so responses carry an ID
+func serveWithRequestID(h http.Handler, req *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	RequestID(h).ServeHTTP(w, req)
+	return w
+}
+
+func TestCheckAuthErrorEnvelopes(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Fatal("request should have been rejected")
+	})
+
+	t.Run("missing authorization", func(t *testing.T) {
+		m := &UsageMiddleware{enabled: true}
+		req := httptest.NewRequest(http.MethodPost, "/v1/messages", nil)
+		w := serveWithRequestID(m.CheckAuth(next), req)
+		env := assertEnvelope(t, w, http.StatusUnauthorized, apierror.CodeMissingAuthorization)
+		assert.NotEmpty(t, env.RequestID)
+	})
+
+	t.Run("invalid authorization", func(t *testing.T) {
+		m := &UsageMiddleware{enabled: true}
+		req := httptest.NewRequest(http.MethodPost, "/v1/messages", nil)
+		req.Header.Set("Authorization", "Basic dXNlcjpwYXNz")
+		req.Header.Set(requestid.Header, "req-42")
+		w := serveWithRequestID(m.CheckAuth(next), req)
+		env := assertEnvelope(t, w, http.StatusUnauthorized, apierror.CodeInvalidAuthorization)
+		assert.Equal(t, "req-42", env.RequestID)
+	})
+
+	t.Run("too many auth failures", func(t *testing.T) {
+		t.Setenv("AUTH_FAILURE_LIMIT", "1")
+		m := &UsageMiddleware{enabled: true, authFailures: newAuthFailureLimiter(NewMetrics())}
+		req := httptest.NewRequest(http.MethodPost, "/v1/messages", nil)
+		req.RemoteAddr = "203.0.113.7:1234"
+		serveWithRequestID(m.CheckAuth(next), req)
+
+		w := serveWithRequestID(m.CheckAuth(next), req)
+		env := assertEnvelope(t, w, http.StatusTooManyRequests, apierror.CodeTooManyAuthFailures)
+		assert.Contains(t, env.Details, "retry_after_seconds")
+	})
+
+	t.Run("invalid tenant", func(t *testing.T) {
+		m := &UsageMiddleware{
+			enabled: true,
+			clients: firebase.NewClientPool(nil, nil),
+			tenants: tenantResolver{header: defaultTenantHeader},
+		}
+		req := httptest.NewRequest(http.MethodPost, "/v1/messages", nil)
+		req.Header.Set(defaultTenantHeader, "../acme")
+		w := serveWithRequestID(m.CheckAuth(next), req)
+		assertEnvelope(t, w, http.StatusBadRequest, apierror.CodeInvalidTenant)
+	})
+
+	t.Run("unknown tenant", func(t *testing.T) {
+		m := &UsageMiddleware{
+			enabled: true,
+			clients: firebase.NewClientPool(nil, nil),
+			tenants: tenantResolver{header: defaultTenantHeader},
+		}
+		req := httptest.NewRequest(http.MethodPost, "/v1/messages", nil)
+		req.Header.Set(defaultTenantHeader, "acme")
+		w := serveWithRequestID(m.CheckAuth(next), req)
+		env := assertEnvelope(t, w, http.StatusNotFound, apierror.CodeUnknownTenant)
+		assert.Equal(t, "acme", env.Details["tenant_id"])
+	})
+}
+
+// The remaining CheckAuth rejections need a live Firebase project to reach,
+// so their writers are checked directly
+func TestCheckAuthRejectionWriters(t *testing.T) {
+	t.Run("account suspended", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		writeAccountBlocked(w, &firebase.UserAccount{Status: firebase.UserStatusSuspended, StatusReason: "abuse"})
+		env := assertEnvelope(t, w, http.StatusForbidden, apierror.CodeAccountSuspended)
+		assert.Equal(t, "abuse", env.Details["reason"])
+	})
+
+	t.Run("account banned", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		writeAccountBlocked(w, &firebase.UserAccount{Status: firebase.UserStatusBanned})
+		env := assertEnvelope(t, w, http.StatusForbidden, apierror.CodeAccountBanned)
+		assert.Nil(t, env.Details)
+	})
+
+	t.Run("insufficient points", func(t *testing.T) {
+		m := &UsageMiddleware{purchaseURL: "https://example.com/buy"}
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/v1/messages", nil)
+		m.writeInsufficientPoints(w, req, "user-1", 3, 10)
+		env := assertEnvelope(t, w, http.StatusPaymentRequired, apierror.CodeInsufficientPoints)
+		assert.EqualValues(t, 7, env.Details["shortfall"])
+		assert.Equal(t, "https://example.com/buy", env.Details["purchase_url"])
+	})
+
+	t.Run("email not verified", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		emailVerificationPolicy{}.writeEmailNotVerified(w)
+		assertEnvelope(t, w, http.StatusForbidden, apierror.CodeEmailNotVerified)
+	})
+
+	t.Run("invalid messages request", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		writeSchemaErrors(w, []string{"model is required"})
+		env := assertEnvelope(t, w, http.StatusBadRequest, apierror.CodeInvalidRequest)
+		assert.Equal(t, []interface{}{"model is required"}, env.Details["errors"])
+	})
+}
+
+// failingReader fails every read
+type failingReader struct{}
+
+func (failingReader) Read([]byte) (int, error) { return 0, errors.New("connection reset") }
+
+func TestTrackUsageErrorEnvelopes(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Fatal("request should have been rejected")
+	})
+
+	t.Run("unreadable body", func(t *testing.T) {
+		m := newTestTrackingMiddleware()
+		req := authenticatedRequest("")
+		req.Body = io.NopCloser(failingReader{})
+		w := serveWithRequestID(m.TrackUsage(next), req)
+		assertEnvelope(t, w, http.StatusBadRequest, apierror.CodeInvalidRequest)
+	})
+
+	t.Run("invalid json", func(t *testing.T) {
+		m := newTestTrackingMiddleware()
+		w := serveWithRequestID(m.TrackUsage(next), authenticatedRequest(`{"model":`))
+		assertEnvelope(t, w, http.StatusBadRequest, apierror.CodeInvalidJSON)
+	})
+
+	t.Run("upstream timeout", func(t *testing.T) {
+		m := newTestTrackingMiddleware()
+		m.upstreamTimeout = 0
+		hung := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			<-r.Context().Done()
+		})
+		w := serveWithRequestID(m.TrackUsage(hung), authenticatedRequest(`{"model":"claude-3-5-haiku-20241022"}`))
+		assertEnvelope(t, w, http.StatusGatewayTimeout, apierror.CodeUpstreamTimeout)
+	})
+}
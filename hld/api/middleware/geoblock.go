@@ -0,0 +1,118 @@
+package middleware
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/oschwald/geoip2-golang"
+
+	"your-project/hld/internal/apierror"
+)
+
+// countryLookup resolves an IP address to its ISO 3166-1 alpha-2 country
+// code, or "" if the address isn't in the database
+type countryLookup func(ip net.IP) (string, error)
+
+// GeoBlocker refuses requests from clients outside a set of countries, for
+// deployments that mustn't be reachable from elsewhere
+type GeoBlocker struct {
+	lookup  countryLookup
+	allowed map[string]bool
+	close   func() error
+}
+
+// NewGeoBlocker allows requests from allowedCountries, given as ISO 3166-1
+// alpha-2 codes such as "US", looking clients up in the MaxMind GeoLite2
+// (or GeoIP2) Country or City database at dbPath
+func NewGeoBlocker(dbPath string, allowedCountries []string) (*GeoBlocker, error) {
+	if dbPath == "" {
+		return nil, fmt.Errorf("GeoIP database path is required")
+	}
+	db, err := geoip2.Open(dbPath)
+	if err != nil {
+		return nil, fmt.Errorf("error opening GeoIP database: %w", err)
+	}
+	lookup := func(ip net.IP) (string, error) {
+		record, err := db.Country(ip)
+		if err != nil {
+			return "", err
+		}
+		return record.Country.IsoCode, nil
+	}
+	b := newGeoBlocker(lookup, allowedCountries)
+	b.close = db.Close
+	return b, nil
+}
+
+func newGeoBlocker(lookup countryLookup, allowedCountries []string) *GeoBlocker {
+	allowed := make(map[string]bool, len(allowedCountries))
+	for _, code := range allowedCountries {
+		if code = strings.ToUpper(strings.TrimSpace(code)); code != "" {
+			allowed[code] = true
+		}
+	}
+	return &GeoBlocker{lookup: lookup, allowed: allowed}
+}
+
+// GeoBlockMiddleware refuses requests from countries not in
+// allowedCountries with 403 geo_blocked, using the GeoIP database at
+// GEOIP_DB_PATH. It panics if the database can't be opened, since serving
+// without the restriction could breach it; use NewGeoBlocker to handle the
+// error instead.
+func GeoBlockMiddleware(allowedCountries []string) gin.HandlerFunc {
+	b, err := NewGeoBlocker(os.Getenv("GEOIP_DB_PATH"), allowedCountries)
+	if err != nil {
+		panic(fmt.Sprintf("geo-blocking: %v (set GEOIP_DB_PATH)", err))
+	}
+	logger().Info("geo-blocking enabled", "allowed_countries", allowedCountries)
+	return b.Handler()
+}
+
+// Handler returns the gin middleware refusing blocked requests
+func (b *GeoBlocker) Handler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		country, ok := b.allow(getClientIP(c.Request))
+		if ok {
+			c.Next()
+			return
+		}
+		logger().Warn("request geo-blocked", "country", country, "path", c.Request.URL.Path)
+		writeError(c.Writer, http.StatusForbidden, APIError{
+			Code:    apierror.CodeGeoBlocked,
+			Message: "This service is not available in your region",
+			Details: map[string]interface{}{"country": country},
+		})
+		c.Abort()
+	}
+}
+
+// allow reports whether a client at ip may be served, and its country.
+// Private and loopback addresses belong to internal traffic and are
+// allowed; addresses that can't be located are refused.
+func (b *GeoBlocker) allow(ip string) (string, bool) {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return "", false
+	}
+	if parsed.IsLoopback() || parsed.IsPrivate() {
+		return "", true
+	}
+	country, err := b.lookup(parsed)
+	if err != nil {
+		logger().Warn("GeoIP lookup failed", "error", err)
+		return "", false
+	}
+	return country, b.allowed[country]
+}
+
+// Close closes the GeoIP database
+func (b *GeoBlocker) Close() error {
+	if b.close == nil {
+		return nil
+	}
+	return b.close()
+}
@@ -0,0 +1,62 @@
+package middleware
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+
+	"your-project/hld/internal/apierror"
+)
+
+// testCountries locates the documentation ranges for tests
+func testCountries(ip net.IP) (string, error) {
+	switch {
+	case ip.Equal(net.ParseIP("203.0.113.7")):
+		return "US", nil
+	case ip.Equal(net.ParseIP("198.51.100.7")):
+		return "KP", nil
+	case ip.Equal(net.ParseIP("192.0.2.7")):
+		return "", errors.New("database unavailable")
+	}
+	return "", nil
+}
+
+func TestGeoBlocker(t *testing.T) {
+	b := newGeoBlocker(testCountries, []string{"us", " DE "})
+	router := gin.New()
+	router.GET("/v1/models", b.Handler(), func(c *gin.Context) {
+		c.Status(http.StatusNoContent)
+	})
+	serve := func(remoteAddr string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/v1/models", nil)
+		req.RemoteAddr = remoteAddr
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	assert.Equal(t, http.StatusNoContent, serve("203.0.113.7:5000").Code)
+	// Internal traffic isn't located
+	assert.Equal(t, http.StatusNoContent, serve("10.1.2.3:5000").Code)
+	assert.Equal(t, http.StatusNoContent, serve("[::1]:5000").Code)
+
+	env := assertEnvelope(t, serve("198.51.100.7:5000"), http.StatusForbidden, apierror.CodeGeoBlocked)
+	assert.Equal(t, "KP", env.Details["country"])
+
+	// Clients that can't be located are refused
+	assertEnvelope(t, serve("198.51.100.8:5000"), http.StatusForbidden, apierror.CodeGeoBlocked)
+	assertEnvelope(t, serve("192.0.2.7:5000"), http.StatusForbidden, apierror.CodeGeoBlocked)
+}
+
+func TestNewGeoBlockerRequiresDatabase(t *testing.T) {
+	_, err := NewGeoBlocker("", []string{"US"})
+	assert.Error(t, err)
+
+	_, err = NewGeoBlocker(t.TempDir()+"/missing.mmdb", []string{"US"})
+	assert.ErrorContains(t, err, "error opening GeoIP database")
+}
@@ -0,0 +1,142 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"your-project/hld/firebase"
+)
+
+// Keys CheckAuthGin sets on the gin context for downstream handlers. The
+// same values are in the request context under the same names.
+const (
+	GinKeyUserID     = "user_id"
+	GinKeyUserPoints = "user_points"
+	GinKeyAPIKey     = "api_key"
+	GinKeyAdmin      = "admin_claim"
+	// GinKeyImpersonatorID is set only for admins using an impersonation
+	// token, to the admin's UID
+	GinKeyImpersonatorID = "impersonator_id"
+)
+
+// CheckAuthGin is CheckAuth for gin routes. Refused requests are aborted;
+// otherwise the caller is set on the gin context (see GinUserID) as well as
+// in the request context. Route thresholds and surcharges can also be
+// configured by the gin route pattern, e.g. "/api/v1/sessions/:id".
+func (m *UsageMiddleware) CheckAuthGin() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if m.instruments != nil {
+			defer func() { m.instruments.request(c.FullPath(), c.Writer.Status()) }()
+		}
+		r, ok := m.checkAuth(c.Writer, withMatchedRoute(c))
+		if !ok {
+			c.Abort()
+			return
+		}
+		c.Request = r
+
+		ctx := r.Context()
+		if userID, ok := ctx.Value("user_id").(string); ok {
+			c.Set(GinKeyUserID, userID)
+		}
+		if points, ok := ctx.Value("user_points").(int); ok {
+			c.Set(GinKeyUserPoints, points)
+		}
+		if key, ok := ctx.Value("api_key").(*firebase.APIKey); ok {
+			c.Set(GinKeyAPIKey, key)
+		}
+		if admin, ok := ctx.Value("admin_claim").(bool); ok {
+			c.Set(GinKeyAdmin, admin)
+		}
+		if impersonator := impersonatorID(ctx); impersonator != "" {
+			c.Set(GinKeyImpersonatorID, impersonator)
+		}
+		c.Next()
+		m.releaseUnclaimedHold(r)
+	}
+}
+
+// TrackUsageGin is TrackUsage for gin routes. The rest of the chain runs
+// with a writer that captures the response for billing, streamed responses
+// included; requests refused before reaching it are aborted.
+func (m *UsageMiddleware) TrackUsageGin() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		called := false
+		m.trackUsage(c.Writer, withMatchedRoute(c), func(w http.ResponseWriter, r *http.Request) {
+			called = true
+			writer, req := c.Writer, c.Request
+			c.Writer = &ginCaptureWriter{ResponseWriter: writer, capture: w}
+			c.Request = r
+			c.Next()
+			c.Writer, c.Request = writer, req
+		})
+		if !called {
+			c.Abort()
+		}
+	}
+}
+
+// GinUserID returns the user CheckAuthGin authenticated
+func GinUserID(c *gin.Context) (string, bool) {
+	v, ok := c.Get(GinKeyUserID)
+	if !ok {
+		return "", false
+	}
+	userID, ok := v.(string)
+	return userID, ok
+}
+
+// GinAPIKey returns the API key the caller authenticated with, if any
+func GinAPIKey(c *gin.Context) (*firebase.APIKey, bool) {
+	v, ok := c.Get(GinKeyAPIKey)
+	if !ok {
+		return nil, false
+	}
+	key, ok := v.(*firebase.APIKey)
+	return key, ok
+}
+
+// withMatchedRoute returns the request with the gin route pattern it
+// matched in its context
+func withMatchedRoute(c *gin.Context) *http.Request {
+	route := c.FullPath()
+	if route == "" {
+		return c.Request
+	}
+	return c.Request.WithContext(context.WithValue(c.Request.Context(), "route_pattern", route))
+}
+
+// matchedRoute returns the gin route pattern a request matched, or an empty
+// string for requests not routed by gin
+func matchedRoute(r *http.Request) string {
+	route, _ := r.Context().Value("route_pattern").(string)
+	return route
+}
+
+// ginCaptureWriter sends a gin handler's output through TrackUsage's
+// capturing writer while keeping the rest of gin's ResponseWriter API
+type ginCaptureWriter struct {
+	gin.ResponseWriter
+	capture http.ResponseWriter
+}
+
+func (w *ginCaptureWriter) WriteHeader(code int) {
+	w.capture.WriteHeader(code)
+}
+
+func (w *ginCaptureWriter) Write(b []byte) (int, error) {
+	return w.capture.Write(b)
+}
+
+func (w *ginCaptureWriter) WriteString(s string) (int, error) {
+	return w.capture.Write([]byte(s))
+}
+
+// Flush keeps streamed responses flowing as they are captured
+func (w *ginCaptureWriter) Flush() {
+	if f, ok := w.capture.(http.Flusher); ok {
+		f.Flush()
+	}
+}
@@ -0,0 +1,109 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func init() {
+	gin.SetMode(gin.TestMode)
+}
+
+func TestCheckAuthGinAbortsUnauthenticated(t *testing.T) {
+	m := &UsageMiddleware{enabled: true}
+
+	called := false
+	router := gin.New()
+	router.POST("/api/v1/sessions/:id", m.CheckAuthGin(), func(c *gin.Context) {
+		called = true
+	})
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/v1/sessions/s1", nil))
+	assert.False(t, called)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Contains(t, w.Body.String(), "missing_authorization")
+}
+
+func TestCheckAuthGinReleasesUnclaimedHold(t *testing.T) {
+	m, db, key := newTestBillingMiddleware(t, 100)
+
+	router := gin.New()
+	router.GET("/admin/users", m.CheckAuthGin(), func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/admin/users", nil)
+	req.Header.Set("X-API-Key", key)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	points, holds := userBalance(t, db)
+	assert.Equal(t, 100, points)
+	assert.Zero(t, holds)
+}
+
+func TestTrackUsageGinCapturesResponse(t *testing.T) {
+	m := newTestTrackingMiddleware()
+
+	var captured bool
+	router := gin.New()
+	router.Use(func(c *gin.Context) {
+		// Stand in for CheckAuthGin
+		c.Request = c.Request.WithContext(context.WithValue(c.Request.Context(), "user_id", "user-1"))
+		c.Set(GinKeyUserID, "user-1")
+	})
+	router.POST("/api/v1/anthropic_proxy/:session/*path", m.TrackUsageGin(), func(c *gin.Context) {
+		_, captured = c.Writer.(*ginCaptureWriter)
+		userID, _ := GinUserID(c)
+		c.Status(http.StatusBadGateway)
+		_, _ = c.Writer.WriteString("event: error\n")
+		c.Writer.Flush()
+		_, _ = c.Writer.WriteString("data: " + userID + "\n\n")
+	})
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/anthropic_proxy/sess-1/v1/messages",
+		strings.NewReader(`{"model":"claude-3-5-haiku-20241022"}`))
+	router.ServeHTTP(w, req)
+	assert.True(t, captured)
+	assert.True(t, w.Flushed)
+	assert.Equal(t, http.StatusBadGateway, w.Code)
+	assert.Equal(t, "event: error\ndata: user-1\n\n", w.Body.String())
+}
+
+func TestTrackUsageGinAbortsRefusedRequests(t *testing.T) {
+	m := newTestTrackingMiddleware()
+
+	called := false
+	router := gin.New()
+	router.Use(func(c *gin.Context) {
+		c.Request = c.Request.WithContext(context.WithValue(c.Request.Context(), "user_id", "user-1"))
+	})
+	router.POST("/api/v1/messages", m.TrackUsageGin(), func(c *gin.Context) {
+		called = true
+	})
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/v1/messages", strings.NewReader("not json")))
+	assert.False(t, called)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "invalid_json")
+}
+
+func TestRouteThresholdByGinPattern(t *testing.T) {
+	m := &UsageMiddleware{}
+	m.SetRouteMinPoints("/api/v1/sessions/:id", 7)
+
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/sessions/s1", nil)
+	assert.Equal(t, minRequiredPoints, m.requiredPoints(req, 0))
+
+	req = req.WithContext(context.WithValue(req.Context(), "route_pattern", "/api/v1/sessions/:id"))
+	assert.Equal(t, 7, m.requiredPoints(req, 0))
+}
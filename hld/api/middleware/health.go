@@ -0,0 +1,40 @@
+package middleware
+
+import (
+	"net/http"
+)
+
+// HealthResponse reports the state of the usage tracking subsystem
+type HealthResponse struct {
+	Status         string `json:"status"`
+	UsageTracking  bool   `json:"usage_tracking"`
+	ActiveSessions *int   `json:"active_sessions,omitempty"`
+	Error          string `json:"error,omitempty"`
+}
+
+// Health reports whether usage tracking is enabled and how many sessions are
+// currently active. Firebase errors degrade the status instead of failing.
+func (m *UsageMiddleware) Health(w http.ResponseWriter, r *http.Request) {
+	resp := HealthResponse{
+		Status:        "ok",
+		UsageTracking: m.enabled,
+	}
+
+	if m.enabled {
+		count, err := m.firebaseClient.GetActiveSessionCount(r.Context())
+		if err != nil {
+			logger().Warn("failed to get active session count", "error", err)
+			resp.Status = "degraded"
+			resp.Error = "failed to query active sessions"
+		} else {
+			resp.ActiveSessions = &count
+		}
+	}
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// Metrics returns the metrics registry, which serves Prometheus text format
+func (m *UsageMiddleware) Metrics() *Metrics {
+	return m.metrics
+}
@@ -0,0 +1,173 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"sync/atomic"
+
+	"your-project/hld/firebase"
+)
+
+// defaultHoldMaxTokens is the output size assumed for requests that don't
+// set max_tokens when estimating how many points to hold
+const defaultHoldMaxTokens = 4096
+
+// holdMaxTokensFromEnv reads HOLD_DEFAULT_MAX_TOKENS
+func holdMaxTokensFromEnv() int {
+	n := defaultHoldMaxTokens
+	if raw := os.Getenv("HOLD_DEFAULT_MAX_TOKENS"); raw != "" {
+		if v, err := strconv.Atoi(raw); err == nil && v > 0 {
+			n = v
+		} else {
+			logger().Warn("invalid HOLD_DEFAULT_MAX_TOKENS, using default", "value", raw, "default", n)
+		}
+	}
+	return n
+}
+
+// defaultMaxTokens returns the output size assumed for requests without
+// max_tokens
+func (m *UsageMiddleware) defaultMaxTokens() int {
+	if m.holdMaxTokens <= 0 {
+		return defaultHoldMaxTokens
+	}
+	return m.holdMaxTokens
+}
+
+// bytesPerToken approximates the tokenizer for estimating input tokens from
+// the request body size when its messages can't be counted
+const bytesPerToken = 4
+
+// estimateCost returns an upper estimate of a request's points cost from its
+// model, input tokens counted locally, and max_tokens, at the user's
+// contracted rates if they have them. Streaming requests are estimated the
+// same way, so their hold is taken before the first event. The body is
+// restored so downstream handlers can read it again; bodies over the limit
+// are left for TrackUsage to refuse. Requests without a JSON body are
+// estimated at the minimum charge.
+func (m *UsageMiddleware) estimateCost(r *http.Request, userID string) int {
+	cost, _ := m.estimateRequest(r, userID)
+	return cost
+}
+
+// estimateRequest is estimateCost that also returns the input tokens it
+// counted, or zero when the body couldn't be read
+func (m *UsageMiddleware) estimateRequest(r *http.Request, userID string) (cost, inputTokens int) {
+	if r.Body == nil {
+		return minRequiredPoints, 0
+	}
+	limit := m.bodyLimit()
+	bodyBytes, err := io.ReadAll(io.LimitReader(r.Body, limit+1))
+	if err != nil || int64(len(bodyBytes)) > limit {
+		// Leave the rest unread for TrackUsage to refuse
+		r.Body = readCloser{io.MultiReader(bytes.NewReader(bodyBytes), r.Body), r.Body}
+		return minRequiredPoints, 0
+	}
+	restoreBody(r, bodyBytes)
+
+	var reqBody struct {
+		Model               string          `json:"model"`
+		MaxTokens           int             `json:"max_tokens"`
+		MaxCompletionTokens int             `json:"max_completion_tokens"`
+		System              json.RawMessage `json:"system"`
+		Messages            []Message       `json:"messages"`
+		Tools               json.RawMessage `json:"tools"`
+	}
+	if err := json.Unmarshal(bodyBytes, &reqBody); err != nil {
+		return minRequiredPoints, 0
+	}
+
+	model := reqBody.Model
+	if model == "" {
+		model = m.defaultModel(r.Context(), userID)
+	}
+	maxTokens := reqBody.MaxTokens
+	if reqBody.MaxCompletionTokens > 0 {
+		maxTokens = reqBody.MaxCompletionTokens
+	}
+	if maxTokens <= 0 {
+		maxTokens = m.defaultMaxTokens()
+	}
+
+	inputTokens = estimateInputTokens(model, reqBody.System, reqBody.Messages, reqBody.Tools, len(bodyBytes))
+	return firebase.CalculatePointsCostFor(model, inputTokens, maxTokens, m.pricingOverride(r.Context(), userID)), inputTokens
+}
+
+// estimateInputTokens counts a request's system prompt, messages and tool
+// definitions, falling back to the body size if the messages can't be read
+func estimateInputTokens(model string, system json.RawMessage, messages []Message, tools json.RawMessage, bodySize int) int {
+	return countRequestTokens(model, system, messages, tools, bodySize, countTextTokens)
+}
+
+// countRequestTokens is estimateInputTokens with the text counted by
+// countText
+func countRequestTokens(model string, system json.RawMessage, messages []Message, tools json.RawMessage, bodySize int, countText func(string) int) int {
+	tokens, err := countMessagesTokens(model, messages, countText)
+	if err != nil {
+		return bodySize / bytesPerToken
+	}
+	if n, err := countContentTokens(system, countText); err == nil {
+		tokens += n
+	}
+	if len(tools) > 0 && string(tools) != "null" {
+		tokens += countText(string(tools))
+	}
+	return tokens
+}
+
+// holdClaim marks whether TrackUsage has taken over settling the hold
+// CheckAuth placed for a request. Routes served by CheckAuth alone aren't
+// billed, so their hold is released once the handler returns rather than
+// left to expire.
+type holdClaim struct {
+	taken atomic.Bool
+}
+
+// take claims the hold, reporting whether it was still unclaimed
+func (c *holdClaim) take() bool {
+	return c.taken.CompareAndSwap(false, true)
+}
+
+// releaseUnclaimedHold releases the hold CheckAuth placed for r unless
+// TrackUsage claimed it
+func (m *UsageMiddleware) releaseUnclaimedHold(r *http.Request) {
+	claim, ok := r.Context().Value("points_hold_claim").(*holdClaim)
+	if !ok || !claim.take() {
+		return
+	}
+	holdID, _ := r.Context().Value("points_hold").(string)
+	userID, _ := r.Context().Value("user_id").(string)
+	m.releaseHold(r.Context(), userID, holdID)
+}
+
+// settleHold captures cost against the request's hold, or releases it when
+// cost is zero. If the hold has expired in the meantime the cost is deducted
+// directly instead. Settlement outlives client disconnects so that served
+// requests are always billed.
+func (m *UsageMiddleware) settleHold(ctx context.Context, userID, holdID string, cost int) error {
+	ctx = context.WithoutCancel(ctx)
+
+	if cost == 0 {
+		err := m.client(ctx).ReleaseHold(ctx, holdID)
+		if errors.Is(err, firebase.ErrHoldNotFound) {
+			// Already refunded by expiry
+			return nil
+		}
+		return err
+	}
+
+	err := m.client(ctx).CapturePoints(ctx, holdID, cost)
+	if errors.Is(err, firebase.ErrHoldNotFound) {
+		requestLogger(ctx).Warn("points hold expired before capture, deducting directly",
+			"user_id", userID,
+			"points", cost)
+		return m.client(ctx).DeductPoints(ctx, userID, cost)
+	}
+	return err
+}
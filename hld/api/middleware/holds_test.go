@@ -0,0 +1,93 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"your-project/hld/firebase"
+	"your-project/hld/internal/testutil"
+)
+
+// newTestFirebaseClient returns a client backed by an in-memory database
+func newTestFirebaseClient(t *testing.T) (*firebase.Client, *testutil.RealtimeDatabase) {
+	t.Helper()
+	db := testutil.NewRealtimeDatabase(t)
+	client, err := firebase.NewClient(context.Background(), firebase.Config{
+		ProjectID:   "test-project",
+		PrivateKey:  testutil.PrivateKeyPEM(t),
+		ClientEmail: "test@test-project.iam.gserviceaccount.com",
+		DatabaseURL: db.DatabaseURL(),
+	})
+	require.NoError(t, err)
+	return client, db
+}
+
+// newTestBillingMiddleware returns an enabled middleware authenticating
+// user-1 by API key against an in-memory database, with the key to send
+func newTestBillingMiddleware(t *testing.T, points int) (*UsageMiddleware, *testutil.RealtimeDatabase, string) {
+	t.Helper()
+	client, db := newTestFirebaseClient(t)
+	db.Set(t, "users/user-1", firebase.UserData{Points: points, Plan: "free", CreatedAt: time.Now()})
+	key, _, err := client.GenerateAPIKey(context.Background(), "user-1", firebase.APIKeyOptions{Name: "test"})
+	require.NoError(t, err)
+
+	m := newTestTrackingMiddleware()
+	m.firebaseClient = client
+	return m, db, key
+}
+
+func userBalance(t *testing.T, db *testutil.RealtimeDatabase) (points int, holds int) {
+	t.Helper()
+	var user firebase.UserData
+	db.Get(t, "users/user-1", &user)
+	return user.Points, len(user.Holds)
+}
+
+func TestCheckAuthReleasesUnclaimedHold(t *testing.T) {
+	m, db, key := newTestBillingMiddleware(t, 100)
+
+	var held int
+	handler := m.CheckAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		held, _ = r.Context().Value("points_held").(int)
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/admin/users", nil)
+	req.Header.Set("X-API-Key", key)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	assert.Positive(t, held, "CheckAuth holds points while the handler runs")
+	points, holds := userBalance(t, db)
+	assert.Equal(t, 100, points, "the balance is unchanged once the handler returns")
+	assert.Zero(t, holds)
+}
+
+func TestCheckAuthLeavesClaimedHoldToTrackUsage(t *testing.T) {
+	m, db, key := newTestBillingMiddleware(t, 100)
+
+	handler := m.CheckAuth(m.TrackUsage(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"usage":{"input_tokens":1000,"output_tokens":1000}}`))
+	})))
+
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/anthropic_proxy/sess-1/v1/messages",
+		strings.NewReader(`{"model":"claude-3-5-haiku-20241022","max_tokens":1000,"messages":[{"role":"user","content":"hi"}]}`))
+	req.Header.Set("X-API-Key", key)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	require.NoError(t, m.usageLogger.Shutdown(context.Background()))
+
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	cost := firebase.CalculatePointsCostFor("claude-3-5-haiku-20241022", 1000, 1000, nil)
+	points, holds := userBalance(t, db)
+	assert.Equal(t, 100-cost, points, "TrackUsage captures the hold at the actual cost")
+	assert.Zero(t, holds)
+}
@@ -0,0 +1,82 @@
+package middleware
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"your-project/hld/firebase"
+	"your-project/hld/internal/apierror"
+)
+
+// ImpersonateRequest is the body of POST /admin/impersonate
+type ImpersonateRequest struct {
+	TargetUserID string `json:"target_user_id"`
+	Reason       string `json:"reason"`
+}
+
+// ImpersonateResponse returns the plaintext token, which is shown only once
+type ImpersonateResponse struct {
+	Token         string                  `json:"token"`
+	Impersonation *firebase.Impersonation `json:"impersonation"`
+}
+
+// Impersonate issues a token with which the calling admin makes requests as
+// another user, for support engineers reproducing a user's configuration.
+// The token is sent as "Authorization: Bearer <token>" and expires after
+// firebase.ImpersonationTTL. Usage it incurs is billed to the user and
+// logged with is_impersonated set.
+func (h *AdminHandlers) Impersonate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, APIError{Code: apierror.CodeMethodNotAllowed, Message: "POST required"})
+		return
+	}
+
+	var req ImpersonateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || strings.TrimSpace(req.TargetUserID) == "" {
+		writeError(w, http.StatusBadRequest, APIError{
+			Code:    apierror.CodeInvalidRequest,
+			Message: "target_user_id is required",
+		})
+		return
+	}
+	req.Reason = strings.TrimSpace(req.Reason)
+	if req.Reason == "" {
+		writeError(w, http.StatusBadRequest, APIError{
+			Code:    apierror.CodeInvalidRequest,
+			Message: "reason is required",
+		})
+		return
+	}
+
+	actorID := adminActor(r.Context())
+	token, imp, err := h.client(r).CreateImpersonationToken(r.Context(), actorID, req.TargetUserID, req.Reason)
+	switch {
+	case errors.Is(err, firebase.ErrUserNotFound):
+		writeError(w, http.StatusNotFound, APIError{Code: apierror.CodeUserNotFound, Message: "User not found"})
+		return
+	case err != nil:
+		logger().Error("failed to create impersonation token", "user_id", req.TargetUserID, "error", err)
+		writeError(w, http.StatusInternalServerError, APIError{
+			Code:    apierror.CodeInternalError,
+			Message: "Failed to create impersonation token",
+		})
+		return
+	}
+
+	logger().Info("impersonation token issued",
+		"user_id", req.TargetUserID,
+		"actor_id", actorID,
+		"reason", req.Reason,
+		"expires_at", imp.ExpiresAt)
+	writeJSON(w, http.StatusCreated, ImpersonateResponse{Token: token, Impersonation: imp})
+}
+
+// impersonatorID returns the admin acting as the caller with an
+// impersonation token, or "" for requests made by the user themselves
+func impersonatorID(ctx context.Context) string {
+	id, _ := ctx.Value("impersonator_id").(string)
+	return id
+}
@@ -0,0 +1,36 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestImpersonateValidatesRequest(t *testing.T) {
+	h := NewAdminHandlers(nil, nil)
+
+	for _, body := range []string{
+		`not json`,
+		`{"reason": "ticket 42"}`,
+		`{"target_user_id": "user-1"}`,
+		`{"target_user_id": "user-1", "reason": "  "}`,
+	} {
+		w := httptest.NewRecorder()
+		h.Impersonate(w, httptest.NewRequest(http.MethodPost, "/admin/impersonate", strings.NewReader(body)))
+		assert.Equal(t, http.StatusBadRequest, w.Code, body)
+	}
+
+	w := httptest.NewRecorder()
+	h.Impersonate(w, httptest.NewRequest(http.MethodGet, "/admin/impersonate", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+}
+
+func TestImpersonatorID(t *testing.T) {
+	assert.Empty(t, impersonatorID(context.Background()))
+	ctx := context.WithValue(context.Background(), "impersonator_id", "admin-1")
+	assert.Equal(t, "admin-1", impersonatorID(ctx))
+}
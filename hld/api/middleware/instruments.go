@@ -0,0 +1,140 @@
+package middleware
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"your-project/hld/firebase"
+	"your-project/hld/internal/apierror"
+)
+
+// firebaseOpBuckets are the upper bounds, in seconds, of the Firebase
+// operation latency histogram
+var firebaseOpBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// instruments are the request, billing and Firebase metrics recorded when
+// METRICS_ENABLED is set. A nil *instruments records nothing, so with
+// metrics off the hot path pays a nil check and no allocations.
+type instruments struct {
+	requests       *CounterVec
+	authFailures   *CounterVec
+	pointsDeducted *Counter
+	tokens         *CounterVec
+	firebaseOps    *HistogramVec
+}
+
+// instrumentsFromEnv registers the instruments on metrics when
+// METRICS_ENABLED is "true", and returns nil otherwise
+func instrumentsFromEnv(metrics *Metrics) *instruments {
+	if os.Getenv("METRICS_ENABLED") != "true" {
+		return nil
+	}
+	return &instruments{
+		requests: metrics.CounterVec("hld_requests_total",
+			"Requests through CheckAuth, by route and response status", "route", "status"),
+		authFailures: metrics.CounterVec("hld_auth_failures_total",
+			"Requests refused because authentication failed, by reason", "reason"),
+		pointsDeducted: metrics.Counter("hld_points_deducted_total",
+			"Points charged for successful requests"),
+		tokens: metrics.CounterVec("hld_tokens_total",
+			"Tokens used by successful requests, by model and direction (input or output)", "model", "direction"),
+		firebaseOps: metrics.Histogram("hld_firebase_operation_duration_seconds",
+			"Duration of Firebase client operations, by operation and outcome", firebaseOpBuckets, "op", "outcome"),
+	}
+}
+
+// request counts a request for route answered with status
+func (in *instruments) request(route string, status int) {
+	if in == nil {
+		return
+	}
+	in.requests.Add(1, route, strconv.Itoa(status))
+}
+
+// authFailure counts a request refused for reason, an apierror code
+func (in *instruments) authFailure(reason string) {
+	if in == nil {
+		return
+	}
+	in.authFailures.Add(1, reason)
+}
+
+// usage counts the tokens and points of a successful request
+func (in *instruments) usage(model string, inputTokens, outputTokens, points int) {
+	if in == nil {
+		return
+	}
+	in.tokens.Add(int64(inputTokens), model, "input")
+	in.tokens.Add(int64(outputTokens), model, "output")
+	in.pointsDeducted.Add(int64(points))
+}
+
+// firebaseOp is the firebase.OpObserver recording operation latency
+func (in *instruments) firebaseOp(op string, err error, d time.Duration) {
+	outcome := "ok"
+	switch {
+	case errors.Is(err, firebase.ErrUserNotFound):
+		outcome = "not_found"
+	case err != nil:
+		outcome = "error"
+	}
+	in.firebaseOps.Observe(d.Seconds(), op, outcome)
+}
+
+// requestRoute names the route of r for metrics: the gin route pattern or
+// mux pattern it matched, falling back to the path
+func requestRoute(r *http.Request) string {
+	if route := matchedRoute(r); route != "" {
+		return route
+	}
+	return latencyEndpoint(r)
+}
+
+// statusRecorder remembers the status code written through it
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusRecorder) WriteHeader(code int) {
+	w.status = code
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// Flush passes flushes through so streamed responses aren't held back
+func (w *statusRecorder) Flush() {
+	_ = http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (w *statusRecorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// MetricsHandler serves the metrics registry in Prometheus text format.
+// When METRICS_BEARER_TOKEN is set, scrapes must send it as
+// "Authorization: Bearer <token>".
+func (m *UsageMiddleware) MetricsHandler() http.Handler {
+	token := os.Getenv("METRICS_BEARER_TOKEN")
+	if token == "" {
+		return m.metrics
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sent, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(sent), []byte(token)) != 1 {
+			writeError(w, http.StatusUnauthorized, APIError{Code: apierror.CodeInvalidToken, Message: "Metrics token required"})
+			return
+		}
+		m.metrics.ServeHTTP(w, r)
+	})
+}
+
+// RegisterMetricsRoute mounts MetricsHandler on mux at /metrics
+func (m *UsageMiddleware) RegisterMetricsRoute(mux *http.ServeMux) {
+	mux.Handle("/metrics", m.MetricsHandler())
+}
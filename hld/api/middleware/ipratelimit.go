@@ -0,0 +1,185 @@
+package middleware
+
+import (
+	"container/list"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"your-project/hld/internal/apierror"
+)
+
+// Defaults for the pre-auth failure limiter, overridable via environment
+const (
+	defaultAuthFailureLimit  = 30
+	defaultAuthFailureWindow = time.Minute
+	defaultAuthFailureMaxIPs = 50000
+)
+
+// authFailureLimiter throttles client IPs that repeatedly fail or skip
+// authentication, so bogus tokens are rejected before reaching Firebase.
+// Each IP gets a token bucket that only failures drain.
+type authFailureLimiter struct {
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+	maxIPs  int
+
+	limit  float64
+	window time.Duration
+
+	allowlist []*net.IPNet
+	rejected  *Counter
+}
+
+// ipBucket is a failure bucket keyed by client IP
+type ipBucket struct {
+	ip     string
+	bucket tokenBucket
+}
+
+// newAuthFailureLimiter configures the limiter from AUTH_FAILURE_LIMIT,
+// AUTH_FAILURE_WINDOW, AUTH_FAILURE_MAX_IPS and AUTH_FAILURE_ALLOWLIST (a
+// comma separated list of IPs and CIDRs that are never throttled)
+func newAuthFailureLimiter(metrics *Metrics) *authFailureLimiter {
+	limit := defaultAuthFailureLimit
+	if raw := getEnvInt("AUTH_FAILURE_LIMIT"); raw > 0 {
+		limit = raw
+	}
+	window := defaultAuthFailureWindow
+	if raw := os.Getenv("AUTH_FAILURE_WINDOW"); raw != "" {
+		if d, err := time.ParseDuration(raw); err == nil && d > 0 {
+			window = d
+		} else {
+			logger().Warn("invalid AUTH_FAILURE_WINDOW, using default", "value", raw)
+		}
+	}
+	maxIPs := defaultAuthFailureMaxIPs
+	if raw := getEnvInt("AUTH_FAILURE_MAX_IPS"); raw > 0 {
+		maxIPs = raw
+	}
+
+	return &authFailureLimiter{
+		entries:   make(map[string]*list.Element),
+		lru:       list.New(),
+		maxIPs:    maxIPs,
+		limit:     float64(limit),
+		window:    window,
+		allowlist: parseIPList(splitList(os.Getenv("AUTH_FAILURE_ALLOWLIST"))),
+		rejected:  metrics.Counter("hld_auth_failure_rejected_total", "Requests rejected because the client IP had too many failed authentications"),
+	}
+}
+
+// check reports whether ip may attempt authentication, and if not, how long
+// until it may retry
+func (l *authFailureLimiter) check(ip string) (bool, time.Duration) {
+	if l.allowlisted(ip) {
+		return true, 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	el, ok := l.entries[ip]
+	if !ok {
+		return true, 0
+	}
+
+	b := &el.Value.(*ipBucket).bucket
+	b.refill(time.Now())
+	if b.tokens >= 1 {
+		return true, 0
+	}
+
+	l.rejected.Inc()
+	return false, b.wait()
+}
+
+// recordFailure drains one token from the IP's bucket
+func (l *authFailureLimiter) recordFailure(ip string) {
+	if l.allowlisted(ip) {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	el, ok := l.entries[ip]
+	if ok {
+		l.lru.MoveToFront(el)
+	} else {
+		el = l.lru.PushFront(&ipBucket{
+			ip: ip,
+			bucket: tokenBucket{
+				tokens: l.limit,
+				last:   time.Now(),
+				rate:   l.limit / l.window.Seconds(),
+				burst:  l.limit,
+			},
+		})
+		l.entries[ip] = el
+
+		for l.lru.Len() > l.maxIPs {
+			oldest := l.lru.Back()
+			l.lru.Remove(oldest)
+			delete(l.entries, oldest.Value.(*ipBucket).ip)
+		}
+	}
+
+	el.Value.(*ipBucket).bucket.take(time.Now())
+}
+
+// allowlisted reports whether ip is exempt from throttling
+func (l *authFailureLimiter) allowlisted(ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, n := range l.allowlist {
+		if n.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseIPList parses IPs and CIDRs, treating bare IPs as single-host ranges
+func parseIPList(items []string) []*net.IPNet {
+	var nets []*net.IPNet
+	for _, item := range items {
+		if _, n, err := net.ParseCIDR(item); err == nil {
+			nets = append(nets, n)
+			continue
+		}
+		ip := net.ParseIP(item)
+		if ip == nil {
+			logger().Warn("ignoring invalid IP in allowlist", "value", item)
+			continue
+		}
+		bits := 32
+		if ip.To4() == nil {
+			bits = 128
+		}
+		nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+	}
+	return nets
+}
+
+// writeAuthThrottled sends a 429 for an IP with too many failed attempts
+func writeAuthThrottled(w http.ResponseWriter, ip string, wait time.Duration) {
+	retryAfter := int(math.Ceil(wait.Seconds()))
+	if retryAfter < 1 {
+		retryAfter = 1
+	}
+	logger().Warn("client throttled after repeated auth failures", "ip", ip, "retry_after", retryAfter)
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	writeError(w, http.StatusTooManyRequests, APIError{
+		Code:    apierror.CodeTooManyAuthFailures,
+		Message: "Too many failed authentication attempts. Please try again later.",
+		Details: map[string]interface{}{"retry_after_seconds": retryAfter},
+	})
+}
@@ -0,0 +1,59 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuthFailureLimiter(t *testing.T) {
+	t.Setenv("AUTH_FAILURE_LIMIT", "2")
+	t.Setenv("AUTH_FAILURE_ALLOWLIST", "10.0.0.0/8,192.168.1.5")
+	l := newAuthFailureLimiter(NewMetrics())
+
+	t.Run("throttles after repeated failures", func(t *testing.T) {
+		ok, _ := l.check("203.0.113.1")
+		assert.True(t, ok)
+
+		l.recordFailure("203.0.113.1")
+		l.recordFailure("203.0.113.1")
+
+		ok, wait := l.check("203.0.113.1")
+		assert.False(t, ok)
+		assert.Greater(t, wait.Seconds(), 0.0)
+
+		ok, _ = l.check("203.0.113.2")
+		assert.True(t, ok)
+	})
+
+	t.Run("never throttles allowlisted addresses", func(t *testing.T) {
+		for i := 0; i < 5; i++ {
+			l.recordFailure("10.1.2.3")
+			l.recordFailure("192.168.1.5")
+		}
+		ok, _ := l.check("10.1.2.3")
+		assert.True(t, ok)
+		ok, _ = l.check("192.168.1.5")
+		assert.True(t, ok)
+	})
+}
+
+func TestCheckAuthThrottlesFailingIP(t *testing.T) {
+	t.Setenv("AUTH_FAILURE_LIMIT", "1")
+	m := &UsageMiddleware{enabled: true, authFailures: newAuthFailureLimiter(NewMetrics())}
+	handler := m.CheckAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/messages", nil)
+	req.RemoteAddr = "203.0.113.9:1234"
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.NotEmpty(t, w.Header().Get("Retry-After"))
+}
@@ -0,0 +1,221 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultLatencyWindow is how far back percentiles look
+	defaultLatencyWindow = 5 * time.Minute
+	// defaultLatencyLogInterval is how often percentiles are logged
+	defaultLatencyLogInterval = 60 * time.Second
+	// maxLatencySamples bounds the samples kept per endpoint and model; the
+	// oldest are overwritten first
+	maxLatencySamples = 1024
+	// maxLatencySeries bounds the number of endpoint and model pairs, so
+	// unexpected paths can't grow memory or metric cardinality unbounded
+	maxLatencySeries = 256
+)
+
+// latencyOverflowLabel replaces the endpoint and model of series observed
+// after maxLatencySeries is reached
+const latencyOverflowLabel = "other"
+
+// LatencyTracker keeps a sliding window of request durations per endpoint
+// and model and reports their percentiles
+type LatencyTracker struct {
+	mu     sync.Mutex
+	window time.Duration
+	series map[latencyKey]*latencySeries
+}
+
+type latencyKey struct {
+	endpoint string
+	model    string
+}
+
+// latencySeries is a ring buffer of recent samples
+type latencySeries struct {
+	samples []latencySample
+	next    int
+}
+
+type latencySample struct {
+	at       time.Time
+	duration time.Duration
+}
+
+// LatencySummary holds the percentiles of one endpoint and model over the
+// window
+type LatencySummary struct {
+	Endpoint string
+	Model    string
+	Count    int
+	Sum      time.Duration
+	P50      time.Duration
+	P95      time.Duration
+	P99      time.Duration
+}
+
+// NewLatencyTracker creates a tracker with the given sliding window
+func NewLatencyTracker(window time.Duration) *LatencyTracker {
+	return &LatencyTracker{
+		window: window,
+		series: make(map[latencyKey]*latencySeries),
+	}
+}
+
+// latencyDurationFromEnv reads a positive duration, falling back to def
+func latencyDurationFromEnv(key string, def time.Duration) time.Duration {
+	raw := os.Getenv(key)
+	if raw == "" {
+		return def
+	}
+	d, err := time.ParseDuration(raw)
+	if err != nil || d <= 0 {
+		logger().Warn("invalid duration in environment, using default", "key", key, "value", raw, "default", def)
+		return def
+	}
+	return d
+}
+
+// Observe records a request duration. A nil tracker discards it.
+func (t *LatencyTracker) Observe(endpoint, model string, d time.Duration) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	key := latencyKey{endpoint: endpoint, model: model}
+	s, ok := t.series[key]
+	if !ok {
+		if len(t.series) >= maxLatencySeries {
+			key = latencyKey{endpoint: latencyOverflowLabel, model: latencyOverflowLabel}
+			s, ok = t.series[key]
+		}
+		if !ok {
+			s = &latencySeries{}
+			t.series[key] = s
+		}
+	}
+
+	sample := latencySample{at: time.Now(), duration: d}
+	if len(s.samples) < maxLatencySamples {
+		s.samples = append(s.samples, sample)
+		return
+	}
+	s.samples[s.next] = sample
+	s.next = (s.next + 1) % maxLatencySamples
+}
+
+// Summaries returns percentiles for every endpoint and model with samples in
+// the window, sorted by endpoint then model. Series without recent samples
+// are dropped.
+func (t *LatencyTracker) Summaries() []LatencySummary {
+	if t == nil {
+		return nil
+	}
+	cutoff := time.Now().Add(-t.window)
+
+	t.mu.Lock()
+	var summaries []LatencySummary
+	for key, s := range t.series {
+		var durations []time.Duration
+		var sum time.Duration
+		for _, sample := range s.samples {
+			if sample.at.After(cutoff) {
+				durations = append(durations, sample.duration)
+				sum += sample.duration
+			}
+		}
+		if len(durations) == 0 {
+			delete(t.series, key)
+			continue
+		}
+
+		sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+		summaries = append(summaries, LatencySummary{
+			Endpoint: key.endpoint,
+			Model:    key.model,
+			Count:    len(durations),
+			Sum:      sum,
+			P50:      percentile(durations, 0.5),
+			P95:      percentile(durations, 0.95),
+			P99:      percentile(durations, 0.99),
+		})
+	}
+	t.mu.Unlock()
+
+	sort.Slice(summaries, func(i, j int) bool {
+		if summaries[i].Endpoint != summaries[j].Endpoint {
+			return summaries[i].Endpoint < summaries[j].Endpoint
+		}
+		return summaries[i].Model < summaries[j].Model
+	})
+	return summaries
+}
+
+// percentile returns the nearest-rank percentile q of sorted durations
+func percentile(sorted []time.Duration, q float64) time.Duration {
+	rank := int(q*float64(len(sorted))+0.5) - 1
+	rank = max(0, min(rank, len(sorted)-1))
+	return sorted[rank]
+}
+
+// Run logs the percentiles of every endpoint and model each interval until
+// ctx is cancelled
+func (t *LatencyTracker) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			for _, s := range t.Summaries() {
+				logger().Info("request latency",
+					"endpoint", s.Endpoint,
+					"model", s.Model,
+					"count", s.Count,
+					"p50_ms", s.P50.Milliseconds(),
+					"p95_ms", s.P95.Milliseconds(),
+					"p99_ms", s.P99.Milliseconds(),
+					"window", t.window)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// metricSummaries adapts Summaries for the Prometheus registry
+func (t *LatencyTracker) metricSummaries() []SummaryValue {
+	var values []SummaryValue
+	for _, s := range t.Summaries() {
+		values = append(values, SummaryValue{
+			Labels: map[string]string{"endpoint": s.Endpoint, "model": s.Model},
+			Quantiles: map[float64]float64{
+				0.5:  s.P50.Seconds(),
+				0.95: s.P95.Seconds(),
+				0.99: s.P99.Seconds(),
+			},
+			Count: int64(s.Count),
+			Sum:   s.Sum.Seconds(),
+		})
+	}
+	return values
+}
+
+// latencyEndpoint names the route for latency tracking. The mux pattern is
+// preferred, since raw paths embed IDs.
+func latencyEndpoint(r *http.Request) string {
+	if r.Pattern != "" {
+		return r.Pattern
+	}
+	return r.URL.Path
+}
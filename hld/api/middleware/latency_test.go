@@ -0,0 +1,84 @@
+package middleware
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLatencyTrackerPercentiles(t *testing.T) {
+	tr := NewLatencyTracker(time.Minute)
+	for i := 1; i <= 100; i++ {
+		tr.Observe("/v1/messages", "haiku", time.Duration(i)*time.Millisecond)
+	}
+	tr.Observe("/v1/messages", "sonnet", 500*time.Millisecond)
+
+	summaries := tr.Summaries()
+	require.Len(t, summaries, 2)
+
+	haiku := summaries[0]
+	assert.Equal(t, "haiku", haiku.Model)
+	assert.Equal(t, 100, haiku.Count)
+	assert.Equal(t, 50*time.Millisecond, haiku.P50)
+	assert.Equal(t, 95*time.Millisecond, haiku.P95)
+	assert.Equal(t, 99*time.Millisecond, haiku.P99)
+	assert.Equal(t, 5050*time.Millisecond, haiku.Sum)
+
+	// A single sample is every percentile
+	sonnet := summaries[1]
+	assert.Equal(t, 500*time.Millisecond, sonnet.P50)
+	assert.Equal(t, 500*time.Millisecond, sonnet.P99)
+}
+
+func TestLatencyTrackerWindow(t *testing.T) {
+	tr := NewLatencyTracker(10 * time.Millisecond)
+	tr.Observe("/a", "m", time.Second)
+	time.Sleep(20 * time.Millisecond)
+	tr.Observe("/b", "m", time.Second)
+
+	summaries := tr.Summaries()
+	require.Len(t, summaries, 1)
+	assert.Equal(t, "/b", summaries[0].Endpoint)
+}
+
+func TestLatencyTrackerBounds(t *testing.T) {
+	tr := NewLatencyTracker(time.Minute)
+	for i := 0; i < maxLatencySamples+10; i++ {
+		tr.Observe("/a", "m", time.Millisecond)
+	}
+	assert.Equal(t, maxLatencySamples, tr.Summaries()[0].Count)
+
+	for i := 0; i < maxLatencySeries+5; i++ {
+		tr.Observe("/path", fmt.Sprintf("model-%d", i), time.Millisecond)
+	}
+	assert.LessOrEqual(t, len(tr.series), maxLatencySeries+1)
+	_, ok := tr.series[latencyKey{endpoint: latencyOverflowLabel, model: latencyOverflowLabel}]
+	assert.True(t, ok)
+
+	// A nil tracker is a no-op
+	var nilTracker *LatencyTracker
+	nilTracker.Observe("/a", "m", time.Second)
+	assert.Nil(t, nilTracker.Summaries())
+}
+
+func TestMetricsSummary(t *testing.T) {
+	tr := NewLatencyTracker(time.Minute)
+	tr.Observe("/v1/messages", `we"ird`, 2*time.Second)
+
+	m := NewMetrics()
+	m.RegisterSummaryFunc("hld_request_duration_seconds", "Request latency", tr.metricSummaries)
+
+	w := httptest.NewRecorder()
+	m.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	body := w.Body.String()
+	assert.Contains(t, body, "# TYPE hld_request_duration_seconds summary\n")
+	assert.Contains(t, body, `hld_request_duration_seconds{endpoint="/v1/messages",model="we\"ird",quantile="0.95"} 2`+"\n")
+	assert.Contains(t, body, `hld_request_duration_seconds_count{endpoint="/v1/messages",model="we\"ird"} 1`+"\n")
+	assert.Contains(t, body, `hld_request_duration_seconds_sum{endpoint="/v1/messages",model="we\"ird"} 2`+"\n")
+}
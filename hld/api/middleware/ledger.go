@@ -0,0 +1,100 @@
+package middleware
+
+import (
+	"net/http"
+	"time"
+
+	"your-project/hld/firebase"
+	"your-project/hld/internal/apierror"
+)
+
+// LedgerResponse is a user's points statement: every credit and billed
+// request in the period, oldest first
+type LedgerResponse struct {
+	UserID  string                 `json:"user_id"`
+	From    *time.Time             `json:"from,omitempty"`
+	To      *time.Time             `json:"to,omitempty"`
+	Credits int                    `json:"credits"`
+	Debits  int                    `json:"debits"`
+	Entries []firebase.LedgerEntry `json:"entries"`
+}
+
+// Ledger handles GET /users/:id/ledger, the user's points statement between
+// the optional from and to query parameters. Users may only read their own.
+func (h *UserHandlers) Ledger(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, APIError{Code: apierror.CodeMethodNotAllowed, Message: "GET required"})
+		return
+	}
+
+	userID := r.PathValue("id")
+	if callerID, _ := r.Context().Value("user_id").(string); callerID != userID {
+		writeError(w, http.StatusForbidden, APIError{
+			Code:    apierror.CodeForbidden,
+			Message: "Cannot read another user's ledger",
+		})
+		return
+	}
+
+	serveLedger(w, r, h.client(r), userID)
+}
+
+// Ledger handles GET /admin/users/:id/ledger, so support can walk a user
+// through their points statement
+func (h *AdminHandlers) Ledger(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, APIError{Code: apierror.CodeMethodNotAllowed, Message: "GET required"})
+		return
+	}
+	serveLedger(w, r, h.client(r), r.PathValue("id"))
+}
+
+// serveLedger writes userID's statement for the from and to query
+// parameters, each RFC3339 or YYYY-MM-DD
+func serveLedger(w http.ResponseWriter, r *http.Request, client *firebase.Client, userID string) {
+	q := r.URL.Query()
+	from, err := parseTimeParam(q.Get("from"), false)
+	if err != nil {
+		writeBadParam(w, "from", err)
+		return
+	}
+	to, err := parseTimeParam(q.Get("to"), true)
+	if err != nil {
+		writeBadParam(w, "to", err)
+		return
+	}
+
+	grants, err := client.GetPointGrants(r.Context(), userID, from, to)
+	if err != nil {
+		logger().Error("failed to get point grants", "user_id", userID, "error", err)
+		writeError(w, http.StatusInternalServerError, APIError{Code: apierror.CodeInternalError, Message: "Failed to load ledger"})
+		return
+	}
+	debits, err := client.GetPointDebits(r.Context(), userID, from, to)
+	if err != nil {
+		logger().Error("failed to get point debits", "user_id", userID, "error", err)
+		writeError(w, http.StatusInternalServerError, APIError{Code: apierror.CodeInternalError, Message: "Failed to load ledger"})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, newLedgerResponse(userID, from, to, grants, debits))
+}
+
+// newLedgerResponse totals the credits and debits of a statement
+func newLedgerResponse(userID string, from, to time.Time, grants []firebase.PointGrant, debits []firebase.PointDebit) LedgerResponse {
+	resp := LedgerResponse{UserID: userID, Entries: firebase.BuildLedger(grants, debits)}
+	if !from.IsZero() {
+		resp.From = &from
+	}
+	if !to.IsZero() {
+		resp.To = &to
+	}
+	for _, entry := range resp.Entries {
+		if entry.Type == firebase.LedgerCredit {
+			resp.Credits += entry.Points
+		} else {
+			resp.Debits -= entry.Points
+		}
+	}
+	return resp
+}
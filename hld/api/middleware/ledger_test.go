@@ -0,0 +1,49 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"your-project/hld/firebase"
+)
+
+func TestUserLedgerOwnOnly(t *testing.T) {
+	h := NewUserHandlers(nil)
+
+	req := httptest.NewRequest(http.MethodGet, "/users/user-2/ledger", nil)
+	req.SetPathValue("id", "user-2")
+	req = req.WithContext(context.WithValue(req.Context(), "user_id", "user-1"))
+	w := httptest.NewRecorder()
+	h.Ledger(w, req)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	w = httptest.NewRecorder()
+	h.Ledger(w, httptest.NewRequest(http.MethodPost, "/users/user-2/ledger", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+}
+
+func TestLedgerRejectsBadRange(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/admin/users/user-1/ledger?from=yesterday", nil)
+	req.SetPathValue("id", "user-1")
+	w := httptest.NewRecorder()
+	NewAdminHandlers(nil, nil).Ledger(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestNewLedgerResponse(t *testing.T) {
+	now := time.Now()
+	resp := newLedgerResponse("user-1", time.Time{}, now,
+		[]firebase.PointGrant{{ID: "g1", Amount: 100, GrantedAt: now.Add(-time.Hour)}},
+		[]firebase.PointDebit{{ID: "u1", Points: 7, Timestamp: now}, {ID: "u2", Points: 3, Timestamp: now}})
+
+	assert.Equal(t, 100, resp.Credits)
+	assert.Equal(t, 10, resp.Debits)
+	assert.Nil(t, resp.From)
+	assert.Equal(t, &now, resp.To)
+	assert.Len(t, resp.Entries, 3)
+}
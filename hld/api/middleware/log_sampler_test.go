@@ -0,0 +1,68 @@
+package middleware
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"your-project/hld/internal/requestid"
+)
+
+func TestLogSamplerRate(t *testing.T) {
+	assert.True(t, NewLogSampler(1).Sampled("req-1"))
+	assert.False(t, NewLogSampler(0).Sampled("req-1"))
+	assert.True(t, NewLogSampler(0).Sampled(""), "requests without an ID are always logged")
+
+	var nilSampler *LogSampler
+	assert.True(t, nilSampler.Sampled("req-1"))
+
+	s := NewLogSampler(0.25)
+	sampled := 0
+	for i := 0; i < 10000; i++ {
+		id := fmt.Sprintf("req-%d", i)
+		if s.Sampled(id) {
+			sampled++
+		}
+		assert.Equal(t, s.Sampled(id), s.Sampled(id), "sampling must be deterministic")
+	}
+	assert.InDelta(t, 2500, sampled, 300)
+}
+
+func TestLogSamplerFromEnv(t *testing.T) {
+	t.Setenv("LOG_SAMPLE_RATE", "")
+	assert.Nil(t, LogSamplerFromEnv())
+
+	t.Setenv("LOG_SAMPLE_RATE", "0.1")
+	assert.Equal(t, 0.1, LogSamplerFromEnv().rate)
+
+	t.Setenv("LOG_SAMPLE_RATE", "3")
+	assert.Equal(t, 1.0, LogSamplerFromEnv().rate)
+
+	t.Setenv("LOG_SAMPLE_RATE", "often")
+	assert.Nil(t, LogSamplerFromEnv())
+}
+
+func TestLogSamplerErrorsOnly(t *testing.T) {
+	var buf bytes.Buffer
+	prev := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(&buf, nil)))
+	defer slog.SetDefault(prev)
+
+	handler := NewLogSampler(0).Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		log := requestLogger(r.Context())
+		log.Info("routine")
+		log.Error("broken")
+	}))
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req = req.WithContext(requestid.NewContext(req.Context(), "req-42"))
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	assert.NotContains(t, buf.String(), "routine")
+	assert.Contains(t, buf.String(), "broken")
+	assert.Contains(t, buf.String(), "request_id=req-42")
+}
@@ -0,0 +1,95 @@
+package middleware
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+// Log output formats for LoggerConfig
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+)
+
+// LoggerConfig chooses where the package's logs go. The zero value reads
+// LOG_LEVEL and LOG_FORMAT, and keeps using slog.Default() when neither is
+// set.
+type LoggerConfig struct {
+	// Logger receives every log line when set; Level, Format and Output
+	// are then ignored
+	Logger *slog.Logger
+	// Level is debug, info, warn or error; empty reads LOG_LEVEL and
+	// defaults to info
+	Level string
+	// Format is text or json; empty reads LOG_FORMAT and defaults to text
+	Format string
+	// Output is where the built handler writes; nil is stderr
+	Output io.Writer
+}
+
+// pkgLogger is the logger configured by NewUsageMiddleware, shared by
+// middleware handlers and background jobs that run without a request
+var pkgLogger atomic.Pointer[slog.Logger]
+
+// logger returns the configured logger, or slog.Default() before
+// NewUsageMiddleware has run
+func logger() *slog.Logger {
+	if l := pkgLogger.Load(); l != nil {
+		return l
+	}
+	return slog.Default()
+}
+
+// build returns the logger described by c, or nil to follow slog.Default()
+func (c LoggerConfig) build() (*slog.Logger, error) {
+	if c.Logger != nil {
+		return c.Logger, nil
+	}
+	if c.Level == "" {
+		c.Level = os.Getenv("LOG_LEVEL")
+	}
+	if c.Format == "" {
+		c.Format = os.Getenv("LOG_FORMAT")
+	}
+	if c.Level == "" && c.Format == "" {
+		return nil, nil
+	}
+
+	level, err := parseLogLevel(c.Level)
+	if err != nil {
+		return nil, err
+	}
+	out := c.Output
+	if out == nil {
+		out = os.Stderr
+	}
+	opts := &slog.HandlerOptions{Level: level}
+	switch strings.ToLower(c.Format) {
+	case "", LogFormatText:
+		return slog.New(slog.NewTextHandler(out, opts)), nil
+	case LogFormatJSON:
+		return slog.New(slog.NewJSONHandler(out, opts)), nil
+	default:
+		return nil, fmt.Errorf("invalid log format %q: must be text or json", c.Format)
+	}
+}
+
+// parseLogLevel parses debug, info, warn or error; empty is info
+func parseLogLevel(raw string) (slog.Level, error) {
+	switch strings.ToLower(raw) {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "", "info":
+		return slog.LevelInfo, nil
+	case "warn", "warning":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	default:
+		return 0, fmt.Errorf("invalid log level %q: must be debug, info, warn or error", raw)
+	}
+}
@@ -0,0 +1,57 @@
+package middleware
+
+import (
+	"bytes"
+	"log/slog"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoggerConfigBuild(t *testing.T) {
+	t.Setenv("LOG_LEVEL", "")
+	t.Setenv("LOG_FORMAT", "")
+
+	log, err := LoggerConfig{}.build()
+	require.NoError(t, err)
+	assert.Nil(t, log, "unset config should follow slog.Default()")
+
+	var buf bytes.Buffer
+	log, err = LoggerConfig{Level: "warn", Format: LogFormatJSON, Output: &buf}.build()
+	require.NoError(t, err)
+	log.Info("quiet")
+	log.Warn("loud", "user_id", "u1")
+	assert.NotContains(t, buf.String(), "quiet")
+	assert.Contains(t, buf.String(), `"msg":"loud"`)
+	assert.Contains(t, buf.String(), `"user_id":"u1"`)
+
+	_, err = LoggerConfig{Level: "verbose"}.build()
+	assert.Error(t, err)
+	_, err = LoggerConfig{Format: "xml"}.build()
+	assert.Error(t, err)
+}
+
+func TestLoggerConfigFromEnv(t *testing.T) {
+	t.Setenv("LOG_LEVEL", "debug")
+	t.Setenv("LOG_FORMAT", "")
+
+	var buf bytes.Buffer
+	log, err := LoggerConfig{Output: &buf}.build()
+	require.NoError(t, err)
+	log.Debug("detail")
+	assert.Contains(t, buf.String(), "msg=detail")
+}
+
+func TestInjectedLogger(t *testing.T) {
+	var buf bytes.Buffer
+	injected := slog.New(slog.NewTextHandler(&buf, nil))
+	log, err := LoggerConfig{Logger: injected, Format: "xml"}.build()
+	require.NoError(t, err)
+	assert.Same(t, injected, log)
+
+	pkgLogger.Store(injected)
+	defer pkgLogger.Store(nil)
+	requestLogger(t.Context()).Info("routed")
+	assert.Contains(t, buf.String(), "msg=routed")
+}
@@ -0,0 +1,139 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"your-project/hld/firebase"
+	"your-project/hld/internal/apierror"
+)
+
+// defaultMaintenancePollInterval is how often each instance re-reads the
+// maintenance flag, bounding how long a change takes to apply everywhere
+const defaultMaintenancePollInterval = 5 * time.Second
+
+// defaultMaintenanceRetryAfter is sent as Retry-After when the flag doesn't
+// set one
+const defaultMaintenanceRetryAfter = 60
+
+// defaultMaintenanceMessage is shown when the flag doesn't set a message
+const defaultMaintenanceMessage = "The service is undergoing maintenance. Please retry later."
+
+// maintenanceState holds this instance's copy of the maintenance flag and
+// decides which requests it refuses. Reads (GET, HEAD and OPTIONS) are
+// always let through, so health checks, pricing, balances and sessions stay
+// available; so are the admin endpoints, which turn maintenance off, and
+// paths in MAINTENANCE_ALLOW_PATHS and MAINTENANCE_ALLOW_PREFIXES.
+type maintenanceState struct {
+	mode  atomic.Pointer[firebase.MaintenanceMode]
+	allow skipRules
+}
+
+// maintenanceStateFromEnv reads the paths allowed during maintenance
+func maintenanceStateFromEnv() *maintenanceState {
+	s := &maintenanceState{}
+	s.allow.addPrefixes("/admin")
+	s.allow.addPaths(splitList(os.Getenv("MAINTENANCE_ALLOW_PATHS"))...)
+	s.allow.addPrefixes(splitList(os.Getenv("MAINTENANCE_ALLOW_PREFIXES"))...)
+	return s
+}
+
+// maintenancePollIntervalFromEnv reads MAINTENANCE_POLL_INTERVAL
+func maintenancePollIntervalFromEnv() time.Duration {
+	interval := defaultMaintenancePollInterval
+	if raw := os.Getenv("MAINTENANCE_POLL_INTERVAL"); raw != "" {
+		if d, err := time.ParseDuration(raw); err == nil && d > 0 {
+			interval = d
+		} else {
+			logger().Warn("invalid MAINTENANCE_POLL_INTERVAL, using default", "value", raw, "default", interval)
+		}
+	}
+	return interval
+}
+
+// set replaces the flag, logging when maintenance starts or ends
+func (s *maintenanceState) set(mode *firebase.MaintenanceMode) {
+	prev := s.mode.Swap(mode)
+	wasEnabled := prev != nil && prev.Enabled
+	switch {
+	case mode.Enabled && !wasEnabled:
+		logger().Warn("maintenance mode enabled, refusing billable requests", "updated_by", mode.UpdatedBy)
+	case !mode.Enabled && wasEnabled:
+		logger().Info("maintenance mode disabled", "updated_by", mode.UpdatedBy)
+	}
+}
+
+// active returns the flag if maintenance is on, or nil
+func (s *maintenanceState) active() *firebase.MaintenanceMode {
+	if s == nil {
+		return nil
+	}
+	if mode := s.mode.Load(); mode != nil && mode.Enabled {
+		return mode
+	}
+	return nil
+}
+
+// allows reports whether r may be served during maintenance
+func (s *maintenanceState) allows(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+	return s.allow.match(r.URL.Path)
+}
+
+// refuse writes the 503 for a request refused during maintenance. It
+// returns false if the request may be served.
+func (s *maintenanceState) refuse(w http.ResponseWriter, r *http.Request) bool {
+	mode := s.active()
+	if mode == nil || s.allows(r) {
+		return false
+	}
+
+	retryAfter := mode.RetryAfterSeconds
+	if retryAfter <= 0 {
+		retryAfter = defaultMaintenanceRetryAfter
+	}
+	message := mode.Message
+	if message == "" {
+		message = defaultMaintenanceMessage
+	}
+
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	writeError(w, http.StatusServiceUnavailable, APIError{
+		Code:    apierror.CodeMaintenance,
+		Message: message,
+		Details: map[string]interface{}{"retry_after_seconds": retryAfter},
+	})
+	return true
+}
+
+// runMaintenanceWatch keeps state in sync with the maintenance flag in
+// Firebase until ctx is cancelled. If a read fails the last known flag is
+// kept.
+func runMaintenanceWatch(ctx context.Context, client *firebase.Client, state *maintenanceState, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		mode, err := client.GetMaintenanceMode(ctx)
+		if err != nil {
+			if ctx.Err() == nil {
+				logger().Warn("failed to read maintenance mode", "error", err)
+			}
+		} else {
+			state.set(mode)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
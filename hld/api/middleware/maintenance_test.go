@@ -0,0 +1,74 @@
+package middleware
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"your-project/hld/firebase"
+	"your-project/hld/internal/apierror"
+)
+
+func TestMaintenanceRefusesBillableRequests(t *testing.T) {
+	t.Setenv("MAINTENANCE_ALLOW_PATHS", "/api/v1/webhooks")
+	s := maintenanceStateFromEnv()
+	s.set(&firebase.MaintenanceMode{Enabled: true, Message: "Upstream incident", RetryAfterSeconds: 120})
+
+	m := &UsageMiddleware{enabled: true, maintenance: s}
+	handler := m.CheckAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Fatal("handler should not be called")
+	}))
+
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/anthropic_proxy/v1/messages", strings.NewReader(`{}`))
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, "120", w.Header().Get("Retry-After"))
+	var body APIError
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+	assert.Equal(t, apierror.CodeMaintenance, body.Code)
+	assert.Equal(t, "Upstream incident", body.Message)
+}
+
+func TestMaintenanceAllowsReads(t *testing.T) {
+	t.Setenv("MAINTENANCE_ALLOW_PATHS", "/api/v1/webhooks")
+	s := maintenanceStateFromEnv()
+	s.set(&firebase.MaintenanceMode{Enabled: true})
+
+	for _, tc := range []struct {
+		method, path string
+	}{
+		{http.MethodGet, "/api/v1/sessions/sess-1"},
+		{http.MethodHead, "/healthz"},
+		{http.MethodPut, "/admin/maintenance"},
+		{http.MethodPost, "/api/v1/webhooks"},
+	} {
+		w := httptest.NewRecorder()
+		assert.False(t, s.refuse(w, httptest.NewRequest(tc.method, tc.path, nil)), "%s %s", tc.method, tc.path)
+	}
+}
+
+func TestMaintenanceDefaultsAndDisabled(t *testing.T) {
+	s := maintenanceStateFromEnv()
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/anthropic_proxy/v1/messages", nil)
+
+	// Nothing refused before the flag is read or when it is off
+	assert.False(t, s.refuse(httptest.NewRecorder(), req))
+	s.set(&firebase.MaintenanceMode{})
+	assert.False(t, s.refuse(httptest.NewRecorder(), req))
+
+	s.set(&firebase.MaintenanceMode{Enabled: true})
+	w := httptest.NewRecorder()
+	assert.True(t, s.refuse(w, req))
+	assert.Equal(t, "60", w.Header().Get("Retry-After"))
+	assert.Contains(t, w.Body.String(), defaultMaintenanceMessage)
+
+	var none *maintenanceState
+	assert.False(t, none.refuse(httptest.NewRecorder(), req))
+}
@@ -0,0 +1,67 @@
+package middleware
+
+import (
+	"net/http"
+
+	"your-project/hld/internal/apierror"
+)
+
+// MeResponse describes the authenticated caller's account
+type MeResponse struct {
+	UserID          string `json:"user_id"`
+	Plan            string `json:"plan"`
+	Status          string `json:"status"`
+	Points          int    `json:"points"`
+	ReservedPoints  int    `json:"reserved_points"`
+	SpendablePoints int    `json:"spendable_points"`
+	// InFlightRequests counts the caller's requests currently being served
+	InFlightRequests      int `json:"in_flight_requests"`
+	MaxConcurrentRequests int `json:"max_concurrent_requests,omitempty"`
+}
+
+// Me handles GET /v1/me, returning the caller's balance, plan and current
+// concurrency. It authenticates on its own rather than behind CheckAuth, so
+// users can check their account even when out of points.
+func (m *UsageMiddleware) Me(w http.ResponseWriter, r *http.Request) {
+	if !m.enabled {
+		writeError(w, http.StatusNotFound, APIError{
+			Code:    apierror.CodeNotFound,
+			Message: "Usage tracking is disabled",
+		})
+		return
+	}
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, APIError{Code: apierror.CodeMethodNotAllowed, Message: "GET required"})
+		return
+	}
+
+	r, caller, ok := m.authenticateOnly(w, r)
+	if !ok {
+		return
+	}
+	userID := caller.userID
+
+	account, err := m.client(r.Context()).GetUserAccount(r.Context(), userID)
+	if err != nil {
+		requestLogger(r.Context()).Error("failed to get user account", "user_id", userID, "error", err)
+		writeError(w, http.StatusServiceUnavailable, APIError{
+			Code:    apierror.CodeBalanceUnavailable,
+			Message: "Failed to read account",
+		})
+		return
+	}
+
+	resp := MeResponse{
+		UserID:          userID,
+		Plan:            account.Plan,
+		Status:          account.Status,
+		Points:          account.Points,
+		ReservedPoints:  account.ReservedPoints,
+		SpendablePoints: account.SpendablePoints(),
+	}
+	if m.concurrency != nil {
+		resp.InFlightRequests = m.concurrency.InFlight(userID)
+		resp.MaxConcurrentRequests = m.concurrency.Limit(r.Context(), userID)
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
@@ -0,0 +1,59 @@
+package middleware
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// usageMetadataHeaderPrefix marks request headers copied onto the usage log.
+// X-Usage-Metadata-Experiment-Id: exp-42 is stored as experiment-id=exp-42.
+const usageMetadataHeaderPrefix = "X-Usage-Metadata-"
+
+// Limits on custom usage metadata, to keep usage log entries small
+const (
+	maxUsageMetadataKeys     = 10
+	maxUsageMetadataValueLen = 256
+)
+
+// usageMetadataFromHeaders collects X-Usage-Metadata-* headers into a tag
+// map. Keys are lowercased with the prefix stripped; keys Firebase can't
+// store are dropped. Only the first 10 keys in sorted order are kept and
+// values longer than 256 characters are truncated.
+func usageMetadataFromHeaders(h http.Header) map[string]string {
+	var keys []string
+	values := make(map[string]string)
+	for name, vals := range h {
+		canonical := http.CanonicalHeaderKey(name)
+		if !strings.HasPrefix(canonical, usageMetadataHeaderPrefix) || len(vals) == 0 {
+			continue
+		}
+
+		key := strings.ToLower(strings.TrimPrefix(canonical, usageMetadataHeaderPrefix))
+		if key == "" || strings.ContainsAny(key, ".$#[]/") {
+			continue
+		}
+
+		keys = append(keys, key)
+		values[key] = vals[0]
+	}
+
+	if len(keys) == 0 {
+		return nil
+	}
+
+	sort.Strings(keys)
+	if len(keys) > maxUsageMetadataKeys {
+		keys = keys[:maxUsageMetadataKeys]
+	}
+
+	metadata := make(map[string]string, len(keys))
+	for _, key := range keys {
+		value := values[key]
+		if len(value) > maxUsageMetadataValueLen {
+			value = value[:maxUsageMetadataValueLen]
+		}
+		metadata[key] = value
+	}
+	return metadata
+}
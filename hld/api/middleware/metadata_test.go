@@ -0,0 +1,47 @@
+package middleware
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUsageMetadataFromHeaders(t *testing.T) {
+	t.Run("strips prefix and lowercases keys", func(t *testing.T) {
+		h := http.Header{}
+		h.Set("X-Usage-Metadata-Experiment-Id", "exp-42")
+		h.Set("X-Usage-Metadata-Feature-Flag", "new-ui")
+		h.Set("Content-Type", "application/json")
+
+		assert.Equal(t, map[string]string{
+			"experiment-id": "exp-42",
+			"feature-flag":  "new-ui",
+		}, usageMetadataFromHeaders(h))
+	})
+
+	t.Run("returns nil without metadata headers", func(t *testing.T) {
+		assert.Nil(t, usageMetadataFromHeaders(http.Header{"Accept": {"*/*"}}))
+	})
+
+	t.Run("enforces key and value limits", func(t *testing.T) {
+		h := http.Header{}
+		for i := 0; i < 15; i++ {
+			h.Set(fmt.Sprintf("X-Usage-Metadata-Key%02d", i), strings.Repeat("v", 300))
+		}
+
+		metadata := usageMetadataFromHeaders(h)
+		assert.Len(t, metadata, maxUsageMetadataKeys)
+		assert.Contains(t, metadata, "key00")
+		assert.NotContains(t, metadata, "key14")
+		assert.Len(t, metadata["key00"], maxUsageMetadataValueLen)
+	})
+
+	t.Run("drops keys firebase cannot store", func(t *testing.T) {
+		h := http.Header{}
+		h.Set("X-Usage-Metadata-A.B", "x")
+		assert.Nil(t, usageMetadataFromHeaders(h))
+	})
+}
@@ -0,0 +1,397 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// maxMetricSeries bounds the label combinations of a CounterVec or
+// HistogramVec, so unexpected label values can't grow memory or metric
+// cardinality unbounded. Later combinations are counted under
+// latencyOverflowLabel.
+const maxMetricSeries = 256
+
+// Metrics is a minimal registry that renders the Prometheus text exposition
+// format, so the usage middleware can be scraped without extra dependencies
+type Metrics struct {
+	mu          sync.Mutex
+	gauges      map[string]gaugeFunc
+	counters    map[string]*Counter
+	counterVecs map[string]*CounterVec
+	histograms  map[string]*HistogramVec
+	summaries   map[string]summaryFunc
+}
+
+// Counter is a monotonically increasing metric
+type Counter struct {
+	help  string
+	value atomic.Int64
+}
+
+// Inc increments the counter by one
+func (c *Counter) Inc() {
+	c.value.Add(1)
+}
+
+// Add increments the counter by n
+func (c *Counter) Add(n int64) {
+	c.value.Add(n)
+}
+
+// Value returns the current count
+func (c *Counter) Value() int64 {
+	return c.value.Load()
+}
+
+// gaugeFunc is a gauge whose value is computed at scrape time
+type gaugeFunc struct {
+	help  string
+	value func(ctx context.Context) (float64, error)
+}
+
+// SummaryValue is one labelled series of a summary metric
+type SummaryValue struct {
+	Labels    map[string]string
+	Quantiles map[float64]float64
+	Count     int64
+	Sum       float64
+}
+
+// summaryFunc is a summary whose series are computed at scrape time
+type summaryFunc struct {
+	help  string
+	value func() []SummaryValue
+}
+
+// NewMetrics creates an empty metrics registry
+func NewMetrics() *Metrics {
+	return &Metrics{
+		gauges:      make(map[string]gaugeFunc),
+		counters:    make(map[string]*Counter),
+		counterVecs: make(map[string]*CounterVec),
+		histograms:  make(map[string]*HistogramVec),
+		summaries:   make(map[string]summaryFunc),
+	}
+}
+
+// Counter returns the counter registered under name, creating it if needed
+func (m *Metrics) Counter(name, help string) *Counter {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if c, ok := m.counters[name]; ok {
+		return c
+	}
+	c := &Counter{help: help}
+	m.counters[name] = c
+	return c
+}
+
+// CounterVec returns the counter vector registered under name, creating it
+// with the given label names if needed
+func (m *Metrics) CounterVec(name, help string, labels ...string) *CounterVec {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if v, ok := m.counterVecs[name]; ok {
+		return v
+	}
+	v := &CounterVec{help: help, labels: labels, series: make(map[string]*vecSeries)}
+	m.counterVecs[name] = v
+	return v
+}
+
+// Histogram returns the histogram registered under name, creating it with
+// the given upper bucket bounds, in increasing order, and label names if
+// needed
+func (m *Metrics) Histogram(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if h, ok := m.histograms[name]; ok {
+		return h
+	}
+	h := &HistogramVec{
+		series:  CounterVec{help: help, labels: labels, series: make(map[string]*vecSeries)},
+		buckets: buckets,
+	}
+	m.histograms[name] = h
+	return h
+}
+
+// RegisterGaugeFunc registers a gauge evaluated on every scrape
+func (m *Metrics) RegisterGaugeFunc(name, help string, value func(ctx context.Context) (float64, error)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.gauges[name] = gaugeFunc{help: help, value: value}
+}
+
+// RegisterSummaryFunc registers a summary evaluated on every scrape
+func (m *Metrics) RegisterSummaryFunc(name, help string, value func() []SummaryValue) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.summaries[name] = summaryFunc{help: help, value: value}
+}
+
+// ServeHTTP renders all registered metrics in Prometheus text format
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	names := make([]string, 0, len(m.gauges))
+	for name := range m.gauges {
+		names = append(names, name)
+	}
+	gauges := make(map[string]gaugeFunc, len(m.gauges))
+	for name, g := range m.gauges {
+		gauges[name] = g
+	}
+	counterNames := make([]string, 0, len(m.counters))
+	counters := make(map[string]*Counter, len(m.counters))
+	for name, c := range m.counters {
+		counterNames = append(counterNames, name)
+		counters[name] = c
+	}
+	counterVecNames := make([]string, 0, len(m.counterVecs))
+	counterVecs := make(map[string]*CounterVec, len(m.counterVecs))
+	for name, v := range m.counterVecs {
+		counterVecNames = append(counterVecNames, name)
+		counterVecs[name] = v
+	}
+	histogramNames := make([]string, 0, len(m.histograms))
+	histograms := make(map[string]*HistogramVec, len(m.histograms))
+	for name, h := range m.histograms {
+		histogramNames = append(histogramNames, name)
+		histograms[name] = h
+	}
+	summaryNames := make([]string, 0, len(m.summaries))
+	summaries := make(map[string]summaryFunc, len(m.summaries))
+	for name, s := range m.summaries {
+		summaryNames = append(summaryNames, name)
+		summaries[name] = s
+	}
+	m.mu.Unlock()
+
+	sort.Strings(names)
+	sort.Strings(counterNames)
+	sort.Strings(counterVecNames)
+	sort.Strings(histogramNames)
+	sort.Strings(summaryNames)
+
+	var b strings.Builder
+	for _, name := range counterNames {
+		c := counters[name]
+		fmt.Fprintf(&b, "# HELP %s %s\n", name, c.help)
+		fmt.Fprintf(&b, "# TYPE %s counter\n", name)
+		fmt.Fprintf(&b, "%s %d\n", name, c.Value())
+	}
+	for _, name := range counterVecNames {
+		v := counterVecs[name]
+		fmt.Fprintf(&b, "# HELP %s %s\n", name, v.help)
+		fmt.Fprintf(&b, "# TYPE %s counter\n", name)
+		for _, s := range v.snapshot() {
+			fmt.Fprintf(&b, "%s%s %d\n", name, formatLabels(v.labelMap(s)), s.count.Load())
+		}
+	}
+	for _, name := range histogramNames {
+		h := histograms[name]
+		fmt.Fprintf(&b, "# HELP %s %s\n", name, h.series.help)
+		fmt.Fprintf(&b, "# TYPE %s histogram\n", name)
+		for _, s := range h.series.snapshot() {
+			labels := h.series.labelMap(s)
+			cumulative := int64(0)
+			for i, bound := range h.buckets {
+				cumulative += s.buckets[i].Load()
+				fmt.Fprintf(&b, "%s_bucket%s %d\n", name, formatLabels(labels, "le", strconv.FormatFloat(bound, 'g', -1, 64)), cumulative)
+			}
+			fmt.Fprintf(&b, "%s_bucket%s %d\n", name, formatLabels(labels, "le", "+Inf"), s.count.Load())
+			fmt.Fprintf(&b, "%s_sum%s %g\n", name, formatLabels(labels), math.Float64frombits(s.sum.Load()))
+			fmt.Fprintf(&b, "%s_count%s %d\n", name, formatLabels(labels), s.count.Load())
+		}
+	}
+	for _, name := range names {
+		g := gauges[name]
+		value, err := g.value(r.Context())
+		if err != nil {
+			logger().Warn("failed to collect metric", "metric", name, "error", err)
+			continue
+		}
+		fmt.Fprintf(&b, "# HELP %s %s\n", name, g.help)
+		fmt.Fprintf(&b, "# TYPE %s gauge\n", name)
+		fmt.Fprintf(&b, "%s %g\n", name, value)
+	}
+	for _, name := range summaryNames {
+		s := summaries[name]
+		fmt.Fprintf(&b, "# HELP %s %s\n", name, s.help)
+		fmt.Fprintf(&b, "# TYPE %s summary\n", name)
+		for _, v := range s.value() {
+			quantiles := make([]float64, 0, len(v.Quantiles))
+			for q := range v.Quantiles {
+				quantiles = append(quantiles, q)
+			}
+			sort.Float64s(quantiles)
+			for _, q := range quantiles {
+				fmt.Fprintf(&b, "%s%s %g\n", name, formatLabels(v.Labels, "quantile", fmt.Sprintf("%g", q)), v.Quantiles[q])
+			}
+			fmt.Fprintf(&b, "%s_sum%s %g\n", name, formatLabels(v.Labels), v.Sum)
+			fmt.Fprintf(&b, "%s_count%s %d\n", name, formatLabels(v.Labels), v.Count)
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_, _ = w.Write([]byte(b.String()))
+}
+
+// CounterVec is a counter partitioned by label values. A nil CounterVec
+// counts nothing, so optional metrics cost a nil check when disabled.
+type CounterVec struct {
+	help   string
+	labels []string
+
+	mu     sync.Mutex
+	series map[string]*vecSeries
+}
+
+// vecSeries is one label combination of a CounterVec or HistogramVec.
+// Histograms also keep a count per bucket and the sum of observations.
+type vecSeries struct {
+	values  []string
+	count   atomic.Int64
+	buckets []atomic.Int64
+	sum     atomic.Uint64
+}
+
+// Add increments the counter for the label values, given in the order the
+// labels were registered, by n
+func (v *CounterVec) Add(n int64, values ...string) {
+	if v == nil {
+		return
+	}
+	v.get(0, values).count.Add(n)
+}
+
+// Value returns the count for the label values
+func (v *CounterVec) Value(values ...string) int64 {
+	if v == nil {
+		return 0
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	s, ok := v.series[strings.Join(values, "\xff")]
+	if !ok {
+		return 0
+	}
+	return s.count.Load()
+}
+
+// get returns the series for values, creating it with the given number of
+// buckets if needed
+func (v *CounterVec) get(buckets int, values []string) *vecSeries {
+	key := strings.Join(values, "\xff")
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if s, ok := v.series[key]; ok {
+		return s
+	}
+	if len(v.series) >= maxMetricSeries {
+		values = make([]string, len(v.labels))
+		for i := range values {
+			values[i] = latencyOverflowLabel
+		}
+		key = strings.Join(values, "\xff")
+		if s, ok := v.series[key]; ok {
+			return s
+		}
+	}
+	s := &vecSeries{values: append([]string(nil), values...), buckets: make([]atomic.Int64, buckets)}
+	v.series[key] = s
+	return s
+}
+
+// snapshot returns the series sorted by label values
+func (v *CounterVec) snapshot() []*vecSeries {
+	v.mu.Lock()
+	keys := make([]string, 0, len(v.series))
+	for key := range v.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	series := make([]*vecSeries, len(keys))
+	for i, key := range keys {
+		series[i] = v.series[key]
+	}
+	v.mu.Unlock()
+	return series
+}
+
+// labelMap pairs a series' values with the label names
+func (v *CounterVec) labelMap(s *vecSeries) map[string]string {
+	labels := make(map[string]string, len(v.labels))
+	for i, name := range v.labels {
+		if i < len(s.values) {
+			labels[name] = s.values[i]
+		}
+	}
+	return labels
+}
+
+// HistogramVec is a histogram partitioned by label values. A nil
+// HistogramVec observes nothing.
+type HistogramVec struct {
+	// series keeps the observation count of each label combination
+	series  CounterVec
+	buckets []float64
+}
+
+// Observe records value in the histogram for the label values
+func (h *HistogramVec) Observe(value float64, values ...string) {
+	if h == nil {
+		return
+	}
+	s := h.series.get(len(h.buckets), values)
+	if i := sort.SearchFloat64s(h.buckets, value); i < len(h.buckets) {
+		s.buckets[i].Add(1)
+	}
+	s.count.Add(1)
+	for {
+		old := s.sum.Load()
+		if s.sum.CompareAndSwap(old, math.Float64bits(math.Float64frombits(old)+value)) {
+			return
+		}
+	}
+}
+
+// Count returns the number of observations for the label values
+func (h *HistogramVec) Count(values ...string) int64 {
+	if h == nil {
+		return 0
+	}
+	return h.series.Value(values...)
+}
+
+// labelValueEscaper escapes label values per the text exposition format
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// formatLabels renders labels in sorted order, followed by any extra
+// name/value pairs, as a Prometheus label set
+func formatLabels(labels map[string]string, extra ...string) string {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var parts []string
+	for _, k := range keys {
+		parts = append(parts, k+`="`+labelValueEscaper.Replace(labels[k])+`"`)
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		parts = append(parts, extra[i]+`="`+labelValueEscaper.Replace(extra[i+1])+`"`)
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
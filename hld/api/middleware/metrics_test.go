@@ -0,0 +1,127 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"your-project/hld/firebase"
+)
+
+func scrape(t *testing.T, h http.Handler, token string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	return w
+}
+
+func TestCounterVec(t *testing.T) {
+	m := NewMetrics()
+	v := m.CounterVec("hld_test_total", "Test counter", "route", "status")
+	v.Add(1, "/v1/messages", "200")
+	v.Add(2, "/v1/messages", "200")
+	v.Add(1, "/v1/messages", "402")
+
+	assert.Equal(t, int64(3), v.Value("/v1/messages", "200"))
+	assert.Same(t, v, m.CounterVec("hld_test_total", "Test counter", "route", "status"))
+
+	body := scrape(t, m, "").Body.String()
+	assert.Contains(t, body, "# TYPE hld_test_total counter\n")
+	assert.Contains(t, body, `hld_test_total{route="/v1/messages",status="200"} 3`)
+	assert.Contains(t, body, `hld_test_total{route="/v1/messages",status="402"} 1`)
+}
+
+func TestCounterVecOverflow(t *testing.T) {
+	v := NewMetrics().CounterVec("hld_test_total", "Test counter", "route")
+	for i := 0; i < maxMetricSeries; i++ {
+		v.Add(1, time.Duration(i).String())
+	}
+	v.Add(1, "/one-too-many")
+	v.Add(1, "/another")
+
+	assert.Zero(t, v.Value("/one-too-many"))
+	assert.Equal(t, int64(2), v.Value(latencyOverflowLabel))
+}
+
+func TestHistogram(t *testing.T) {
+	m := NewMetrics()
+	h := m.Histogram("hld_test_seconds", "Test histogram", []float64{0.1, 1}, "op")
+	h.Observe(0.05, "GetUserAccount")
+	h.Observe(0.5, "GetUserAccount")
+	h.Observe(5, "GetUserAccount")
+
+	assert.Equal(t, int64(3), h.Count("GetUserAccount"))
+
+	body := scrape(t, m, "").Body.String()
+	assert.Contains(t, body, "# TYPE hld_test_seconds histogram\n")
+	assert.Contains(t, body, `hld_test_seconds_bucket{op="GetUserAccount",le="0.1"} 1`)
+	assert.Contains(t, body, `hld_test_seconds_bucket{op="GetUserAccount",le="1"} 2`)
+	assert.Contains(t, body, `hld_test_seconds_bucket{op="GetUserAccount",le="+Inf"} 3`)
+	assert.Contains(t, body, `hld_test_seconds_sum{op="GetUserAccount"} 5.55`)
+	assert.Contains(t, body, `hld_test_seconds_count{op="GetUserAccount"} 3`)
+}
+
+func TestInstrumentsDisabled(t *testing.T) {
+	t.Setenv("METRICS_ENABLED", "")
+	in := instrumentsFromEnv(NewMetrics())
+	require.Nil(t, in)
+
+	allocs := testing.AllocsPerRun(100, func() {
+		in.request("/v1/messages", http.StatusOK)
+		in.authFailure("invalid_token")
+		in.usage("claude-3-5-haiku-20241022", 100, 50, 3)
+	})
+	assert.Zero(t, allocs)
+}
+
+func TestCheckAuthRecordsMetrics(t *testing.T) {
+	t.Setenv("METRICS_ENABLED", "true")
+	metrics := NewMetrics()
+	m := &UsageMiddleware{enabled: true, metrics: metrics, instruments: instrumentsFromEnv(metrics)}
+	handler := m.CheckAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	mux := http.NewServeMux()
+	mux.Handle("/v1/messages", handler)
+	mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/v1/messages", nil))
+
+	assert.Equal(t, int64(1), m.instruments.requests.Value("/v1/messages", "401"))
+	assert.Equal(t, int64(1), m.instruments.authFailures.Value("missing_authorization"))
+}
+
+func TestInstrumentsFirebaseOp(t *testing.T) {
+	t.Setenv("METRICS_ENABLED", "true")
+	in := instrumentsFromEnv(NewMetrics())
+
+	in.firebaseOp("GetUserAccount", nil, 20*time.Millisecond)
+	in.firebaseOp("GetUserAccount", firebase.ErrUserNotFound, time.Millisecond)
+	in.firebaseOp("HoldPoints", assert.AnError, time.Second)
+
+	assert.Equal(t, int64(1), in.firebaseOps.Count("GetUserAccount", "ok"))
+	assert.Equal(t, int64(1), in.firebaseOps.Count("GetUserAccount", "not_found"))
+	assert.Equal(t, int64(1), in.firebaseOps.Count("HoldPoints", "error"))
+}
+
+func TestMetricsHandlerToken(t *testing.T) {
+	m := &UsageMiddleware{metrics: NewMetrics()}
+	m.metrics.Counter("hld_test_total", "Test counter").Inc()
+
+	t.Setenv("METRICS_BEARER_TOKEN", "")
+	assert.Equal(t, http.StatusOK, scrape(t, m.MetricsHandler(), "").Code)
+
+	t.Setenv("METRICS_BEARER_TOKEN", "s3cret")
+	h := m.MetricsHandler()
+	assert.Equal(t, http.StatusUnauthorized, scrape(t, h, "").Code)
+	assert.Equal(t, http.StatusUnauthorized, scrape(t, h, "wrong").Code)
+
+	w := scrape(t, h, "s3cret")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "hld_test_total 1")
+}
@@ -0,0 +1,95 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"your-project/hld/firebase"
+	"your-project/hld/internal/apierror"
+)
+
+// headerAdminNonce carries a nonce from POST /admin/nonces on privileged
+// mutations
+const headerAdminNonce = "X-Admin-Nonce"
+
+// nonceCleanupInterval is how often expired nonces are deleted
+const nonceCleanupInterval = time.Hour
+
+// CreateNonceResponse returns a nonce for one privileged mutation
+type CreateNonceResponse struct {
+	Nonce     string    `json:"nonce"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// CreateNonce issues a one-time nonce to the calling admin. Points
+// adjustments, balance changes and session transfers require one in the
+// X-Admin-Nonce header, so a replayed request is refused rather than
+// applied twice. Nonces expire after firebase.NonceTTL.
+func (h *AdminHandlers) CreateNonce(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, APIError{Code: apierror.CodeMethodNotAllowed, Message: "POST required"})
+		return
+	}
+
+	nonce, record, err := h.client(r).CreateNonce(r.Context(), adminActor(r.Context()))
+	if err != nil {
+		logger().Error("failed to create nonce", "error", err)
+		writeError(w, http.StatusInternalServerError, APIError{Code: apierror.CodeInternalError, Message: "Failed to create nonce"})
+		return
+	}
+	writeJSON(w, http.StatusCreated, CreateNonceResponse{Nonce: nonce, ExpiresAt: record.ExpiresAt})
+}
+
+// consumeNonce consumes the request's nonce for the calling admin, writing
+// the error response and returning false if it is missing, unknown, expired
+// or already used
+func (h *AdminHandlers) consumeNonce(w http.ResponseWriter, r *http.Request) bool {
+	nonce := strings.TrimSpace(r.Header.Get(headerAdminNonce))
+	if nonce == "" {
+		writeError(w, http.StatusPreconditionRequired, APIError{
+			Code:    apierror.CodeNonceRequired,
+			Message: "A nonce from POST /admin/nonces is required in the " + headerAdminNonce + " header",
+		})
+		return false
+	}
+
+	err := h.client(r).ConsumeNonce(r.Context(), nonce, adminActor(r.Context()))
+	switch {
+	case err == nil:
+		return true
+	case errors.Is(err, firebase.ErrNonceUsed):
+		logger().Warn("replayed admin nonce refused", "actor_id", adminActor(r.Context()), "path", r.URL.Path)
+		writeError(w, http.StatusConflict, APIError{Code: apierror.CodeNonceReused, Message: "Nonce has already been used"})
+	case errors.Is(err, firebase.ErrNonceNotFound), errors.Is(err, firebase.ErrNonceExpired):
+		writeError(w, http.StatusBadRequest, APIError{Code: apierror.CodeInvalidNonce, Message: "Nonce is invalid or expired"})
+	default:
+		logger().Error("failed to consume nonce", "error", err)
+		writeError(w, http.StatusInternalServerError, APIError{Code: apierror.CodeInternalError, Message: "Failed to check nonce"})
+	}
+	return false
+}
+
+// runNonceCleanup deletes expired nonces every interval until ctx is
+// cancelled
+func runNonceCleanup(ctx context.Context, client *firebase.Client, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			deleted, err := client.DeleteExpiredNonces(ctx)
+			if err != nil {
+				logger().Error("failed to delete expired nonces", "error", err)
+			}
+			if deleted > 0 {
+				logger().Info("expired nonces deleted", "count", deleted)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,32 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"your-project/hld/internal/apierror"
+)
+
+func TestPointsMutationsRequireNonce(t *testing.T) {
+	h := NewAdminHandlers(nil, nil)
+
+	req := httptest.NewRequest(http.MethodPost, "/admin/users/u1/points", strings.NewReader(`{"delta": 50, "reason": "refund"}`))
+	req.SetPathValue("id", "u1")
+	w := httptest.NewRecorder()
+	h.UserPoints(w, req)
+	assertEnvelope(t, w, http.StatusPreconditionRequired, apierror.CodeNonceRequired)
+
+	req = httptest.NewRequest(http.MethodPut, "/admin/users/u1/points", strings.NewReader(`{"points": 50, "reason": "correction"}`))
+	req.SetPathValue("id", "u1")
+	w = httptest.NewRecorder()
+	h.UserPoints(w, req)
+	assertEnvelope(t, w, http.StatusPreconditionRequired, apierror.CodeNonceRequired)
+}
+
+func TestCreateNonceRequiresPost(t *testing.T) {
+	w := httptest.NewRecorder()
+	NewAdminHandlers(nil, nil).CreateNonce(w, httptest.NewRequest(http.MethodGet, "/admin/nonces", nil))
+	assertEnvelope(t, w, http.StatusMethodNotAllowed, apierror.CodeMethodNotAllowed)
+}
@@ -0,0 +1,477 @@
+package middleware
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// defaultOpenAIMaxTokens is sent upstream when an OpenAI request doesn't set
+// max_tokens, which is optional there but required by Anthropic
+const defaultOpenAIMaxTokens = defaultHoldMaxTokens
+
+// OpenAIRequest is the subset of the OpenAI chat completions request that
+// can be expressed as an Anthropic messages request
+type OpenAIRequest struct {
+	Model               string          `json:"model"`
+	Messages            []OpenAIMessage `json:"messages"`
+	MaxTokens           int             `json:"max_tokens,omitempty"`
+	MaxCompletionTokens int             `json:"max_completion_tokens,omitempty"`
+	Temperature         *float64        `json:"temperature,omitempty"`
+	TopP                *float64        `json:"top_p,omitempty"`
+	// Stop is a string or a list of strings
+	Stop       json.RawMessage `json:"stop,omitempty"`
+	N          int             `json:"n,omitempty"`
+	Stream     bool            `json:"stream,omitempty"`
+	Tools      []OpenAITool    `json:"tools,omitempty"`
+	ToolChoice json.RawMessage `json:"tool_choice,omitempty"`
+	User       string          `json:"user,omitempty"`
+}
+
+// OpenAIMessage is a chat message. Content is either a string or a list of
+// content parts.
+type OpenAIMessage struct {
+	Role       string           `json:"role"`
+	Content    json.RawMessage  `json:"content,omitempty"`
+	ToolCalls  []OpenAIToolCall `json:"tool_calls,omitempty"`
+	ToolCallID string           `json:"tool_call_id,omitempty"`
+}
+
+// OpenAIContentPart is one element of a multi-part message
+type OpenAIContentPart struct {
+	Type     string `json:"type"`
+	Text     string `json:"text,omitempty"`
+	ImageURL *struct {
+		URL string `json:"url"`
+	} `json:"image_url,omitempty"`
+}
+
+// OpenAITool declares a function the model may call
+type OpenAITool struct {
+	Type     string `json:"type"`
+	Function struct {
+		Name        string          `json:"name"`
+		Description string          `json:"description,omitempty"`
+		Parameters  json.RawMessage `json:"parameters,omitempty"`
+	} `json:"function"`
+}
+
+// OpenAIToolCall is a function call made by the assistant
+type OpenAIToolCall struct {
+	ID       string `json:"id"`
+	Type     string `json:"type"`
+	Function struct {
+		Name      string `json:"name"`
+		Arguments string `json:"arguments"`
+	} `json:"function"`
+}
+
+// OpenAIResponse is a non-streaming chat completion
+type OpenAIResponse struct {
+	ID      string         `json:"id"`
+	Object  string         `json:"object"`
+	Created int64          `json:"created"`
+	Model   string         `json:"model"`
+	Choices []OpenAIChoice `json:"choices"`
+	Usage   OpenAIUsage    `json:"usage"`
+}
+
+// OpenAIChoice is a single completion choice
+type OpenAIChoice struct {
+	Index        int                   `json:"index"`
+	Message      OpenAIResponseMessage `json:"message"`
+	FinishReason string                `json:"finish_reason"`
+}
+
+// OpenAIResponseMessage is the assistant message in a completion
+type OpenAIResponseMessage struct {
+	Role      string           `json:"role"`
+	Content   *string          `json:"content"`
+	ToolCalls []OpenAIToolCall `json:"tool_calls,omitempty"`
+}
+
+// OpenAIUsage reports token counts in OpenAI's naming
+type OpenAIUsage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+}
+
+// AnthropicRequest is an Anthropic messages API request
+type AnthropicRequest struct {
+	Model         string               `json:"model"`
+	System        string               `json:"system,omitempty"`
+	Messages      []AnthropicMessage   `json:"messages"`
+	MaxTokens     int                  `json:"max_tokens"`
+	Temperature   *float64             `json:"temperature,omitempty"`
+	TopP          *float64             `json:"top_p,omitempty"`
+	StopSequences []string             `json:"stop_sequences,omitempty"`
+	Tools         []AnthropicTool      `json:"tools,omitempty"`
+	ToolChoice    *AnthropicToolChoice `json:"tool_choice,omitempty"`
+	Metadata      *AnthropicMetadata   `json:"metadata,omitempty"`
+}
+
+// AnthropicMessage is a user or assistant turn
+type AnthropicMessage struct {
+	Role    string                  `json:"role"`
+	Content []AnthropicContentBlock `json:"content"`
+}
+
+// AnthropicContentBlock is a text, image, tool_use or tool_result block
+type AnthropicContentBlock struct {
+	Type string `json:"type"`
+	Text string `json:"text,omitempty"`
+
+	// Image blocks
+	Source *AnthropicImageSource `json:"source,omitempty"`
+
+	// tool_use blocks
+	ID    string          `json:"id,omitempty"`
+	Name  string          `json:"name,omitempty"`
+	Input json.RawMessage `json:"input,omitempty"`
+
+	// tool_result blocks
+	ToolUseID string `json:"tool_use_id,omitempty"`
+	Content   string `json:"content,omitempty"`
+}
+
+// AnthropicImageSource is an inline base64 image or an image URL
+type AnthropicImageSource struct {
+	Type      string `json:"type"`
+	MediaType string `json:"media_type,omitempty"`
+	Data      string `json:"data,omitempty"`
+	URL       string `json:"url,omitempty"`
+}
+
+// AnthropicTool declares a tool the model may use
+type AnthropicTool struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	InputSchema json.RawMessage `json:"input_schema"`
+}
+
+// AnthropicToolChoice controls whether and which tool the model uses
+type AnthropicToolChoice struct {
+	Type string `json:"type"`
+	Name string `json:"name,omitempty"`
+}
+
+// AnthropicMetadata carries the end user ID for abuse detection
+type AnthropicMetadata struct {
+	UserID string `json:"user_id,omitempty"`
+}
+
+// AnthropicResponse is a non-streaming messages API response
+type AnthropicResponse struct {
+	ID         string                  `json:"id"`
+	Model      string                  `json:"model"`
+	Content    []AnthropicContentBlock `json:"content"`
+	StopReason string                  `json:"stop_reason"`
+	Usage      struct {
+		InputTokens  int `json:"input_tokens"`
+		OutputTokens int `json:"output_tokens"`
+	} `json:"usage"`
+}
+
+// errUnsupportedOpenAIRequest wraps requests that use features with no
+// Anthropic equivalent
+var errUnsupportedOpenAIRequest = errors.New("unsupported request")
+
+// TranslateOpenAIRequest converts an OpenAI chat completions request to an
+// Anthropic messages request. System and developer messages are combined
+// into the system prompt, tool messages become tool_result blocks, and
+// consecutive messages with the same role are merged since Anthropic
+// requires user and assistant turns to alternate.
+func TranslateOpenAIRequest(req OpenAIRequest) (AnthropicRequest, error) {
+	if req.N > 1 {
+		return AnthropicRequest{}, fmt.Errorf("%w: n must be 1", errUnsupportedOpenAIRequest)
+	}
+
+	out := AnthropicRequest{
+		Model:       req.Model,
+		MaxTokens:   req.MaxCompletionTokens,
+		Temperature: req.Temperature,
+		TopP:        req.TopP,
+	}
+	if out.MaxTokens <= 0 {
+		out.MaxTokens = req.MaxTokens
+	}
+	if out.MaxTokens <= 0 {
+		out.MaxTokens = defaultOpenAIMaxTokens
+	}
+	if req.User != "" {
+		out.Metadata = &AnthropicMetadata{UserID: req.User}
+	}
+
+	stop, err := parseOpenAIStop(req.Stop)
+	if err != nil {
+		return AnthropicRequest{}, err
+	}
+	out.StopSequences = stop
+
+	var system []string
+	for i, msg := range req.Messages {
+		var role string
+		var blocks []AnthropicContentBlock
+		switch msg.Role {
+		case "system", "developer":
+			text, err := openAIContentText(msg.Content)
+			if err != nil {
+				return AnthropicRequest{}, fmt.Errorf("messages[%d]: %w", i, err)
+			}
+			system = append(system, text)
+			continue
+		case "user":
+			role = "user"
+			blocks, err = openAIContentBlocks(msg.Content)
+		case "assistant":
+			role = "assistant"
+			blocks, err = openAIAssistantBlocks(msg)
+		case "tool":
+			role = "user"
+			var text string
+			text, err = openAIContentText(msg.Content)
+			blocks = []AnthropicContentBlock{{Type: "tool_result", ToolUseID: msg.ToolCallID, Content: text}}
+		default:
+			err = fmt.Errorf("%w: role %q", errUnsupportedOpenAIRequest, msg.Role)
+		}
+		if err != nil {
+			return AnthropicRequest{}, fmt.Errorf("messages[%d]: %w", i, err)
+		}
+		if len(blocks) == 0 {
+			continue
+		}
+
+		if n := len(out.Messages); n > 0 && out.Messages[n-1].Role == role {
+			out.Messages[n-1].Content = append(out.Messages[n-1].Content, blocks...)
+		} else {
+			out.Messages = append(out.Messages, AnthropicMessage{Role: role, Content: blocks})
+		}
+	}
+	out.System = strings.Join(system, "\n\n")
+
+	for _, tool := range req.Tools {
+		if tool.Type != "function" {
+			return AnthropicRequest{}, fmt.Errorf("%w: tool type %q", errUnsupportedOpenAIRequest, tool.Type)
+		}
+		schema := tool.Function.Parameters
+		if len(schema) == 0 {
+			schema = json.RawMessage(`{"type":"object","properties":{}}`)
+		}
+		out.Tools = append(out.Tools, AnthropicTool{
+			Name:        tool.Function.Name,
+			Description: tool.Function.Description,
+			InputSchema: schema,
+		})
+	}
+
+	choice, err := parseOpenAIToolChoice(req.ToolChoice)
+	if err != nil {
+		return AnthropicRequest{}, err
+	}
+	out.ToolChoice = choice
+
+	return out, nil
+}
+
+// parseOpenAIStop accepts stop as a string or a list of strings
+func parseOpenAIStop(raw json.RawMessage) ([]string, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return nil, nil
+	}
+	var one string
+	if err := json.Unmarshal(raw, &one); err == nil {
+		return []string{one}, nil
+	}
+	var many []string
+	if err := json.Unmarshal(raw, &many); err != nil {
+		return nil, fmt.Errorf("%w: stop must be a string or list of strings", errUnsupportedOpenAIRequest)
+	}
+	return many, nil
+}
+
+// parseOpenAIToolChoice maps "auto", "none", "required" and named function
+// choices to their Anthropic equivalents
+func parseOpenAIToolChoice(raw json.RawMessage) (*AnthropicToolChoice, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return nil, nil
+	}
+	var mode string
+	if err := json.Unmarshal(raw, &mode); err == nil {
+		switch mode {
+		case "auto":
+			return &AnthropicToolChoice{Type: "auto"}, nil
+		case "none":
+			return &AnthropicToolChoice{Type: "none"}, nil
+		case "required":
+			return &AnthropicToolChoice{Type: "any"}, nil
+		}
+		return nil, fmt.Errorf("%w: tool_choice %q", errUnsupportedOpenAIRequest, mode)
+	}
+
+	var named struct {
+		Function struct {
+			Name string `json:"name"`
+		} `json:"function"`
+	}
+	if err := json.Unmarshal(raw, &named); err != nil || named.Function.Name == "" {
+		return nil, fmt.Errorf("%w: invalid tool_choice", errUnsupportedOpenAIRequest)
+	}
+	return &AnthropicToolChoice{Type: "tool", Name: named.Function.Name}, nil
+}
+
+// openAIContentParts decodes message content, wrapping plain strings as a
+// single text part
+func openAIContentParts(raw json.RawMessage) ([]OpenAIContentPart, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return nil, nil
+	}
+	var text string
+	if err := json.Unmarshal(raw, &text); err == nil {
+		return []OpenAIContentPart{{Type: "text", Text: text}}, nil
+	}
+	var parts []OpenAIContentPart
+	if err := json.Unmarshal(raw, &parts); err != nil {
+		return nil, fmt.Errorf("%w: content must be a string or list of parts", errUnsupportedOpenAIRequest)
+	}
+	return parts, nil
+}
+
+// openAIContentText joins the text parts of message content, for roles that
+// only accept text
+func openAIContentText(raw json.RawMessage) (string, error) {
+	parts, err := openAIContentParts(raw)
+	if err != nil {
+		return "", err
+	}
+	var texts []string
+	for _, part := range parts {
+		if part.Type != "text" {
+			return "", fmt.Errorf("%w: %s content in a text-only message", errUnsupportedOpenAIRequest, part.Type)
+		}
+		texts = append(texts, part.Text)
+	}
+	return strings.Join(texts, "\n"), nil
+}
+
+// openAIContentBlocks converts text and image_url parts to content blocks
+func openAIContentBlocks(raw json.RawMessage) ([]AnthropicContentBlock, error) {
+	parts, err := openAIContentParts(raw)
+	if err != nil {
+		return nil, err
+	}
+	var blocks []AnthropicContentBlock
+	for _, part := range parts {
+		switch part.Type {
+		case "text":
+			if part.Text != "" {
+				blocks = append(blocks, AnthropicContentBlock{Type: "text", Text: part.Text})
+			}
+		case "image_url":
+			if part.ImageURL == nil {
+				return nil, fmt.Errorf("%w: image_url part without a url", errUnsupportedOpenAIRequest)
+			}
+			source, err := anthropicImageSource(part.ImageURL.URL)
+			if err != nil {
+				return nil, err
+			}
+			blocks = append(blocks, AnthropicContentBlock{Type: "image", Source: source})
+		default:
+			return nil, fmt.Errorf("%w: content part type %q", errUnsupportedOpenAIRequest, part.Type)
+		}
+	}
+	return blocks, nil
+}
+
+// anthropicImageSource converts a data: URL to an inline base64 source and
+// passes other URLs through
+func anthropicImageSource(url string) (*AnthropicImageSource, error) {
+	rest, ok := strings.CutPrefix(url, "data:")
+	if !ok {
+		return &AnthropicImageSource{Type: "url", URL: url}, nil
+	}
+	mediaType, data, ok := strings.Cut(rest, ";base64,")
+	if !ok {
+		return nil, fmt.Errorf("%w: image data URLs must be base64 encoded", errUnsupportedOpenAIRequest)
+	}
+	return &AnthropicImageSource{Type: "base64", MediaType: mediaType, Data: data}, nil
+}
+
+// openAIAssistantBlocks converts an assistant message, including any tool
+// calls it made
+func openAIAssistantBlocks(msg OpenAIMessage) ([]AnthropicContentBlock, error) {
+	blocks, err := openAIContentBlocks(msg.Content)
+	if err != nil {
+		return nil, err
+	}
+	for _, call := range msg.ToolCalls {
+		input := json.RawMessage(call.Function.Arguments)
+		if strings.TrimSpace(call.Function.Arguments) == "" {
+			input = json.RawMessage(`{}`)
+		} else if !json.Valid(input) {
+			return nil, fmt.Errorf("%w: tool call %s has invalid arguments", errUnsupportedOpenAIRequest, call.ID)
+		}
+		blocks = append(blocks, AnthropicContentBlock{
+			Type:  "tool_use",
+			ID:    call.ID,
+			Name:  call.Function.Name,
+			Input: input,
+		})
+	}
+	return blocks, nil
+}
+
+// TranslateAnthropicResponse converts an Anthropic messages response to an
+// OpenAI chat completion
+func TranslateAnthropicResponse(resp AnthropicResponse) OpenAIResponse {
+	msg := OpenAIResponseMessage{Role: "assistant"}
+	var texts []string
+	for _, block := range resp.Content {
+		switch block.Type {
+		case "text":
+			texts = append(texts, block.Text)
+		case "tool_use":
+			call := OpenAIToolCall{ID: block.ID, Type: "function"}
+			call.Function.Name = block.Name
+			call.Function.Arguments = string(block.Input)
+			msg.ToolCalls = append(msg.ToolCalls, call)
+		}
+	}
+	if len(texts) > 0 || len(msg.ToolCalls) == 0 {
+		content := strings.Join(texts, "")
+		msg.Content = &content
+	}
+
+	return OpenAIResponse{
+		ID:      resp.ID,
+		Object:  "chat.completion",
+		Created: time.Now().Unix(),
+		Model:   resp.Model,
+		Choices: []OpenAIChoice{{
+			Index:        0,
+			Message:      msg,
+			FinishReason: openAIFinishReason(resp.StopReason),
+		}},
+		Usage: OpenAIUsage{
+			PromptTokens:     resp.Usage.InputTokens,
+			CompletionTokens: resp.Usage.OutputTokens,
+			TotalTokens:      resp.Usage.InputTokens + resp.Usage.OutputTokens,
+		},
+	}
+}
+
+// openAIFinishReason maps an Anthropic stop_reason to an OpenAI finish_reason
+func openAIFinishReason(stopReason string) string {
+	switch stopReason {
+	case "max_tokens":
+		return "length"
+	case "tool_use":
+		return "tool_calls"
+	case "refusal":
+		return "content_filter"
+	default:
+		return "stop"
+	}
+}
@@ -0,0 +1,145 @@
+package middleware
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+)
+
+const (
+	// defaultAnthropicBaseURL is where translated requests are sent
+	defaultAnthropicBaseURL = "https://api.anthropic.com"
+	// anthropicVersion is the messages API version requests are written for
+	anthropicVersion = "2023-06-01"
+)
+
+// OpenAIProxy serves the OpenAI chat completions API on top of Anthropic's
+// messages API. It responds with OpenAI-style usage, which TrackUsage bills
+// like Anthropic usage, so mount it behind the usage middleware:
+//
+//	mux.Handle("/v1/chat/completions", m.CheckAuth(m.TrackUsage(proxy)))
+type OpenAIProxy struct {
+	baseURL    string
+	apiKey     string
+	httpClient *http.Client
+}
+
+// NewOpenAIProxyFromEnv creates a proxy using ANTHROPIC_API_KEY and
+// optionally ANTHROPIC_BASE_URL
+func NewOpenAIProxyFromEnv() (*OpenAIProxy, error) {
+	apiKey := os.Getenv("ANTHROPIC_API_KEY")
+	if apiKey == "" {
+		return nil, errors.New("ANTHROPIC_API_KEY is required for the OpenAI compatible endpoint")
+	}
+	baseURL := os.Getenv("ANTHROPIC_BASE_URL")
+	if baseURL == "" {
+		baseURL = defaultAnthropicBaseURL
+	}
+	return &OpenAIProxy{
+		baseURL:    strings.TrimRight(baseURL, "/"),
+		apiKey:     apiKey,
+		httpClient: &http.Client{},
+	}, nil
+}
+
+// RegisterRoutes mounts POST /v1/chat/completions on mux, wrapped in m's
+// auth and usage tracking
+func (p *OpenAIProxy) RegisterRoutes(mux *http.ServeMux, m *UsageMiddleware) {
+	mux.Handle("/v1/chat/completions", m.CheckAuth(m.TrackUsage(p)))
+}
+
+// ServeHTTP handles POST /v1/chat/completions. Errors are returned in
+// OpenAI's format so existing client libraries can surface them.
+func (p *OpenAIProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeOpenAIError(w, http.StatusMethodNotAllowed, "invalid_request_error", "POST required")
+		return
+	}
+
+	var req OpenAIRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeOpenAIError(w, http.StatusBadRequest, "invalid_request_error", "Invalid JSON body")
+		return
+	}
+	if req.Model == "" {
+		writeOpenAIError(w, http.StatusBadRequest, "invalid_request_error", "model is required")
+		return
+	}
+	// Usage is only billed from complete JSON responses
+	if req.Stream {
+		writeOpenAIError(w, http.StatusBadRequest, "invalid_request_error", "stream is not supported on this endpoint")
+		return
+	}
+
+	anthReq, err := TranslateOpenAIRequest(req)
+	if err != nil {
+		writeOpenAIError(w, http.StatusBadRequest, "invalid_request_error", err.Error())
+		return
+	}
+	body, err := json.Marshal(anthReq)
+	if err != nil {
+		writeOpenAIError(w, http.StatusInternalServerError, "api_error", "Failed to encode request")
+		return
+	}
+
+	upstream, err := http.NewRequestWithContext(r.Context(), http.MethodPost, p.baseURL+"/v1/messages", bytes.NewReader(body))
+	if err != nil {
+		writeOpenAIError(w, http.StatusInternalServerError, "api_error", "Failed to create request")
+		return
+	}
+	upstream.Header.Set("Content-Type", "application/json")
+	upstream.Header.Set("anthropic-version", anthropicVersion)
+	upstream.Header.Set("x-api-key", p.apiKey)
+
+	resp, err := p.httpClient.Do(upstream)
+	if err != nil {
+		logger().Error("openai proxy upstream request failed", "model", req.Model, "error", err)
+		writeOpenAIError(w, http.StatusBadGateway, "api_error", "Upstream request failed")
+		return
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		writeOpenAIError(w, http.StatusBadGateway, "api_error", "Failed to read upstream response")
+		return
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		var anthErr struct {
+			Error struct {
+				Type    string `json:"type"`
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		if err := json.Unmarshal(respBody, &anthErr); err != nil || anthErr.Error.Message == "" {
+			anthErr.Error.Type = "api_error"
+			anthErr.Error.Message = fmt.Sprintf("Upstream returned status %d", resp.StatusCode)
+		}
+		writeOpenAIError(w, resp.StatusCode, anthErr.Error.Type, anthErr.Error.Message)
+		return
+	}
+
+	var anthResp AnthropicResponse
+	if err := json.Unmarshal(respBody, &anthResp); err != nil {
+		logger().Error("failed to decode upstream response", "model", req.Model, "error", err)
+		writeOpenAIError(w, http.StatusBadGateway, "api_error", "Invalid upstream response")
+		return
+	}
+	writeJSON(w, http.StatusOK, TranslateAnthropicResponse(anthResp))
+}
+
+// writeOpenAIError writes an error body in OpenAI's format
+func writeOpenAIError(w http.ResponseWriter, status int, errType, message string) {
+	writeJSON(w, status, map[string]interface{}{
+		"error": map[string]interface{}{
+			"message": message,
+			"type":    errType,
+		},
+	})
+}
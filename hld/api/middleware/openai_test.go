@@ -0,0 +1,231 @@
+package middleware
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// translate decodes an OpenAI request body and translates it
+func translate(t *testing.T, body string) (AnthropicRequest, error) {
+	t.Helper()
+	var req OpenAIRequest
+	require.NoError(t, json.Unmarshal([]byte(body), &req))
+	return TranslateOpenAIRequest(req)
+}
+
+func TestTranslateOpenAIRequestSimple(t *testing.T) {
+	got, err := translate(t, `{
+		"model": "claude-3-5-haiku-20241022",
+		"messages": [
+			{"role": "system", "content": "Be brief."},
+			{"role": "user", "content": "Hello"}
+		],
+		"temperature": 0.2,
+		"stop": "END",
+		"user": "user-1"
+	}`)
+	require.NoError(t, err)
+
+	assert.Equal(t, "claude-3-5-haiku-20241022", got.Model)
+	assert.Equal(t, "Be brief.", got.System)
+	assert.Equal(t, defaultOpenAIMaxTokens, got.MaxTokens)
+	assert.Equal(t, []string{"END"}, got.StopSequences)
+	require.NotNil(t, got.Temperature)
+	assert.Equal(t, 0.2, *got.Temperature)
+	assert.Equal(t, &AnthropicMetadata{UserID: "user-1"}, got.Metadata)
+	assert.Equal(t, []AnthropicMessage{
+		{Role: "user", Content: []AnthropicContentBlock{{Type: "text", Text: "Hello"}}},
+	}, got.Messages)
+}
+
+func TestTranslateOpenAIRequestConversation(t *testing.T) {
+	got, err := translate(t, `{
+		"model": "m",
+		"max_tokens": 100,
+		"max_completion_tokens": 200,
+		"stop": ["a", "b"],
+		"messages": [
+			{"role": "system", "content": "One."},
+			{"role": "developer", "content": [{"type": "text", "text": "Two."}]},
+			{"role": "user", "content": "Hi"},
+			{"role": "user", "content": [
+				{"type": "text", "text": "Look"},
+				{"type": "image_url", "image_url": {"url": "data:image/png;base64,iVBOR"}},
+				{"type": "image_url", "image_url": {"url": "https://example.com/cat.jpg"}}
+			]},
+			{"role": "assistant", "content": "Hello!"}
+		]
+	}`)
+	require.NoError(t, err)
+
+	assert.Equal(t, "One.\n\nTwo.", got.System)
+	assert.Equal(t, 200, got.MaxTokens)
+	assert.Equal(t, []string{"a", "b"}, got.StopSequences)
+
+	// Consecutive user messages are merged into one turn
+	require.Len(t, got.Messages, 2)
+	assert.Equal(t, "user", got.Messages[0].Role)
+	assert.Equal(t, []AnthropicContentBlock{
+		{Type: "text", Text: "Hi"},
+		{Type: "text", Text: "Look"},
+		{Type: "image", Source: &AnthropicImageSource{Type: "base64", MediaType: "image/png", Data: "iVBOR"}},
+		{Type: "image", Source: &AnthropicImageSource{Type: "url", URL: "https://example.com/cat.jpg"}},
+	}, got.Messages[0].Content)
+	assert.Equal(t, AnthropicMessage{
+		Role:    "assistant",
+		Content: []AnthropicContentBlock{{Type: "text", Text: "Hello!"}},
+	}, got.Messages[1])
+}
+
+func TestTranslateOpenAIRequestTools(t *testing.T) {
+	got, err := translate(t, `{
+		"model": "m",
+		"tools": [{"type": "function", "function": {
+			"name": "get_weather",
+			"description": "Current weather",
+			"parameters": {"type": "object", "properties": {"city": {"type": "string"}}}
+		}}],
+		"tool_choice": {"type": "function", "function": {"name": "get_weather"}},
+		"messages": [
+			{"role": "user", "content": "Weather in Paris and Rome?"},
+			{"role": "assistant", "content": null, "tool_calls": [
+				{"id": "call_1", "type": "function", "function": {"name": "get_weather", "arguments": "{\"city\":\"Paris\"}"}},
+				{"id": "call_2", "type": "function", "function": {"name": "get_weather", "arguments": "{\"city\":\"Rome\"}"}}
+			]},
+			{"role": "tool", "tool_call_id": "call_1", "content": "18C"},
+			{"role": "tool", "tool_call_id": "call_2", "content": "24C"}
+		]
+	}`)
+	require.NoError(t, err)
+
+	require.Len(t, got.Tools, 1)
+	assert.Equal(t, "get_weather", got.Tools[0].Name)
+	assert.JSONEq(t, `{"type":"object","properties":{"city":{"type":"string"}}}`, string(got.Tools[0].InputSchema))
+	assert.Equal(t, &AnthropicToolChoice{Type: "tool", Name: "get_weather"}, got.ToolChoice)
+
+	require.Len(t, got.Messages, 3)
+	assert.Equal(t, []AnthropicContentBlock{
+		{Type: "tool_use", ID: "call_1", Name: "get_weather", Input: json.RawMessage(`{"city":"Paris"}`)},
+		{Type: "tool_use", ID: "call_2", Name: "get_weather", Input: json.RawMessage(`{"city":"Rome"}`)},
+	}, got.Messages[1].Content)
+
+	// Both tool results go back in a single user turn
+	assert.Equal(t, AnthropicMessage{Role: "user", Content: []AnthropicContentBlock{
+		{Type: "tool_result", ToolUseID: "call_1", Content: "18C"},
+		{Type: "tool_result", ToolUseID: "call_2", Content: "24C"},
+	}}, got.Messages[2])
+}
+
+func TestTranslateOpenAIRequestToolChoice(t *testing.T) {
+	tests := map[string]*AnthropicToolChoice{
+		`"auto"`:     {Type: "auto"},
+		`"none"`:     {Type: "none"},
+		`"required"`: {Type: "any"},
+	}
+	for raw, want := range tests {
+		got, err := translate(t, `{"model":"m","messages":[],"tool_choice":`+raw+`}`)
+		require.NoError(t, err, raw)
+		assert.Equal(t, want, got.ToolChoice, raw)
+	}
+}
+
+func TestTranslateOpenAIRequestUnsupported(t *testing.T) {
+	bodies := []string{
+		`{"model":"m","n":2,"messages":[]}`,
+		`{"model":"m","messages":[{"role":"function","content":"x"}]}`,
+		`{"model":"m","messages":[{"role":"user","content":[{"type":"input_audio"}]}]}`,
+		`{"model":"m","messages":[{"role":"assistant","tool_calls":[{"id":"c","function":{"name":"f","arguments":"{bad"}}]}]}`,
+		`{"model":"m","messages":[],"tool_choice":"sometimes"}`,
+	}
+	for _, body := range bodies {
+		_, err := translate(t, body)
+		assert.ErrorIs(t, err, errUnsupportedOpenAIRequest, body)
+	}
+}
+
+func TestTranslateAnthropicResponse(t *testing.T) {
+	var resp AnthropicResponse
+	require.NoError(t, json.Unmarshal([]byte(`{
+		"id": "msg_1",
+		"model": "claude-3-5-haiku-20241022",
+		"content": [
+			{"type": "text", "text": "Checking."},
+			{"type": "tool_use", "id": "toolu_1", "name": "get_weather", "input": {"city": "Paris"}}
+		],
+		"stop_reason": "tool_use",
+		"usage": {"input_tokens": 12, "output_tokens": 30}
+	}`), &resp))
+
+	got := TranslateAnthropicResponse(resp)
+	assert.Equal(t, "msg_1", got.ID)
+	assert.Equal(t, "chat.completion", got.Object)
+	require.Len(t, got.Choices, 1)
+	assert.Equal(t, "tool_calls", got.Choices[0].FinishReason)
+	require.NotNil(t, got.Choices[0].Message.Content)
+	assert.Equal(t, "Checking.", *got.Choices[0].Message.Content)
+	require.Len(t, got.Choices[0].Message.ToolCalls, 1)
+	assert.Equal(t, "toolu_1", got.Choices[0].Message.ToolCalls[0].ID)
+	assert.JSONEq(t, `{"city":"Paris"}`, got.Choices[0].Message.ToolCalls[0].Function.Arguments)
+	assert.Equal(t, OpenAIUsage{PromptTokens: 12, CompletionTokens: 30, TotalTokens: 42}, got.Usage)
+}
+
+func TestOpenAIProxy(t *testing.T) {
+	var upstreamReq AnthropicRequest
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v1/messages", r.URL.Path)
+		assert.Equal(t, "test-key", r.Header.Get("x-api-key"))
+		body, _ := io.ReadAll(r.Body)
+		require.NoError(t, json.Unmarshal(body, &upstreamReq))
+		_, _ = w.Write([]byte(`{"id":"msg_1","model":"claude-3-5-haiku-20241022",
+			"content":[{"type":"text","text":"Hi!"}],"stop_reason":"end_turn",
+			"usage":{"input_tokens":10,"output_tokens":5}}`))
+	}))
+	defer upstream.Close()
+
+	proxy := &OpenAIProxy{baseURL: upstream.URL, apiKey: "test-key", httpClient: upstream.Client()}
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions",
+		strings.NewReader(`{"model":"claude-3-5-haiku-20241022","messages":[{"role":"user","content":"Hello"}]}`))
+	w := httptest.NewRecorder()
+	proxy.ServeHTTP(w, req)
+
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, "claude-3-5-haiku-20241022", upstreamReq.Model)
+	require.Len(t, upstreamReq.Messages, 1)
+
+	var resp OpenAIResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Equal(t, "stop", resp.Choices[0].FinishReason)
+	assert.Equal(t, "Hi!", *resp.Choices[0].Message.Content)
+	assert.Equal(t, 15, resp.Usage.TotalTokens)
+}
+
+func TestOpenAIProxyUpstreamError(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTooManyRequests)
+		_, _ = w.Write([]byte(`{"type":"error","error":{"type":"rate_limit_error","message":"Slow down"}}`))
+	}))
+	defer upstream.Close()
+
+	proxy := &OpenAIProxy{baseURL: upstream.URL, apiKey: "k", httpClient: upstream.Client()}
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions",
+		strings.NewReader(`{"model":"m","messages":[{"role":"user","content":"Hello"}]}`))
+	w := httptest.NewRecorder()
+	proxy.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.JSONEq(t, `{"error":{"type":"rate_limit_error","message":"Slow down"}}`, w.Body.String())
+
+	// Streaming isn't translated, so it's rejected up front
+	req = httptest.NewRequest(http.MethodPost, "/v1/chat/completions",
+		strings.NewReader(`{"model":"m","stream":true,"messages":[]}`))
+	w = httptest.NewRecorder()
+	proxy.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
@@ -0,0 +1,87 @@
+package middleware
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"your-project/hld/firebase"
+)
+
+// RateLimitConfig configures a per-user token bucket
+type RateLimitConfig struct {
+	RequestsPerSecond float64 `json:"requests_per_second"`
+	Burst             int     `json:"burst"`
+}
+
+// Plan holds the per-plan overrides applied by the usage middleware
+type Plan struct {
+	// Tier ranks plans for comparisons such as session transfers; higher is better
+	Tier      int              `json:"tier"`
+	RateLimit *RateLimitConfig `json:"rate_limit,omitempty"`
+	// DefaultModel is used for requests that don't name a model, unless the
+	// user has their own preference
+	DefaultModel string `json:"default_model,omitempty"`
+	// MaxConcurrentRequests overrides MAX_CONCURRENT_REQUESTS when positive
+	MaxConcurrentRequests int `json:"max_concurrent_requests,omitempty"`
+	// MaxRequestsPerDay caps the user's requests per calendar day when
+	// positive
+	MaxRequestsPerDay int `json:"max_requests_per_day,omitempty"`
+	// MaxInputTokensPerRequest refuses requests whose estimated input
+	// tokens exceed it, when positive
+	MaxInputTokensPerRequest int `json:"max_input_tokens_per_request,omitempty"`
+}
+
+// Plans maps a plan name (as stored on the user record) to its overrides
+type Plans map[string]Plan
+
+// Tier returns the tier for plan. Unconfigured plans rank lowest.
+func (p Plans) Tier(plan string) int {
+	return p[plan].Tier
+}
+
+// DailyRequestsRemaining returns how many more requests the account's plan
+// allows today. ok is false when the plan has no daily limit.
+func (p Plans) DailyRequestsRemaining(account *firebase.UserAccount) (remaining int, ok bool) {
+	if account == nil {
+		return 0, false
+	}
+	limit := p[account.Plan].MaxRequestsPerDay
+	if limit <= 0 {
+		return 0, false
+	}
+	return max(limit-account.RequestsToday, 0), true
+}
+
+// MaxInputTokens returns the account's plan limit on input tokens per
+// request, or zero for none
+func (p Plans) MaxInputTokens(account *firebase.UserAccount) int {
+	if account == nil {
+		return 0
+	}
+	return max(p[account.Plan].MaxInputTokensPerRequest, 0)
+}
+
+// LoadPlans reads plan overrides from USAGE_PLANS_FILE (a path to a JSON
+// file) or USAGE_PLANS (inline JSON). Missing configuration yields no
+// overrides.
+func LoadPlans() (Plans, error) {
+	var data []byte
+	if path := os.Getenv("USAGE_PLANS_FILE"); path != "" {
+		var err error
+		data, err = os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read plans file: %w", err)
+		}
+	} else if inline := os.Getenv("USAGE_PLANS"); inline != "" {
+		data = []byte(inline)
+	} else {
+		return Plans{}, nil
+	}
+
+	var plans Plans
+	if err := json.Unmarshal(data, &plans); err != nil {
+		return nil, fmt.Errorf("failed to parse plans config: %w", err)
+	}
+	return plans, nil
+}
@@ -0,0 +1,102 @@
+package middleware
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"your-project/hld/firebase"
+	"your-project/hld/internal/apierror"
+)
+
+// pricingOverride returns the user's contracted pricing, or nil to charge
+// the public rates. A failed read falls back to the public rates rather
+// than failing the request.
+func (m *UsageMiddleware) pricingOverride(ctx context.Context, userID string) *firebase.PricingOverride {
+	client := m.client(ctx)
+	if client == nil {
+		return nil
+	}
+	override, err := client.GetPricingOverride(ctx, userID)
+	if err != nil {
+		requestLogger(ctx).Warn("failed to read pricing override, using public rates", "user_id", userID, "error", err)
+		return nil
+	}
+	return override
+}
+
+// PricingOverrideResponse is a user's pricing override; PricingOverride is
+// null for users paying the public rates
+type PricingOverrideResponse struct {
+	UserID          string                    `json:"user_id"`
+	PricingOverride *firebase.PricingOverride `json:"pricing_override"`
+}
+
+// PricingOverride reads (GET), sets (PUT) or removes (DELETE) a user's
+// contracted pricing. A PUT body is a firebase.PricingOverride, e.g.
+// {"rates": {"claude-3-5-sonnet-20241022": {"input": 2.4, "output": 12}},
+// "multiplier": 0.9, "contract_id": "acme-2026"}.
+func (h *AdminHandlers) PricingOverride(w http.ResponseWriter, r *http.Request) {
+	userID := r.PathValue("id")
+
+	var override *firebase.PricingOverride
+	switch r.Method {
+	case http.MethodGet:
+		current, err := h.client(r).GetPricingOverride(r.Context(), userID)
+		if err != nil {
+			logger().Error("failed to get pricing override", "user_id", userID, "error", err)
+			writeError(w, http.StatusInternalServerError, APIError{Code: apierror.CodeInternalError, Message: "Failed to get pricing override"})
+			return
+		}
+		writeJSON(w, http.StatusOK, PricingOverrideResponse{UserID: userID, PricingOverride: current})
+		return
+	case http.MethodPut:
+		if err := json.NewDecoder(r.Body).Decode(&override); err != nil || override == nil {
+			writeError(w, http.StatusBadRequest, APIError{Code: apierror.CodeInvalidRequest, Message: "Body must be a pricing override"})
+			return
+		}
+		if err := override.Validate(); err != nil {
+			writeError(w, http.StatusBadRequest, APIError{Code: apierror.CodeInvalidRequest, Message: err.Error()})
+			return
+		}
+		override.UpdatedBy = adminActor(r.Context())
+	case http.MethodDelete:
+	default:
+		writeError(w, http.StatusMethodNotAllowed, APIError{Code: apierror.CodeMethodNotAllowed, Message: "GET, PUT or DELETE required"})
+		return
+	}
+
+	err := h.client(r).SetPricingOverride(r.Context(), userID, override)
+	if errors.Is(err, firebase.ErrUserNotFound) {
+		writeError(w, http.StatusNotFound, APIError{Code: apierror.CodeUserNotFound, Message: "User not found"})
+		return
+	}
+	if err != nil {
+		logger().Error("failed to set pricing override", "user_id", userID, "error", err)
+		writeError(w, http.StatusInternalServerError, APIError{Code: apierror.CodeInternalError, Message: "Failed to update pricing override"})
+		return
+	}
+
+	actorID := adminActor(r.Context())
+	entry := firebase.AdminAuditEntry{
+		Action:       "clear_pricing_override",
+		TargetUserID: userID,
+		ActorID:      actorID,
+	}
+	if override != nil {
+		entry.Action = "set_pricing_override"
+		entry.Details = map[string]string{
+			"contract_id": override.ContractID,
+			"multiplier":  strconv.FormatFloat(override.Multiplier, 'f', -1, 64),
+			"models":      strconv.Itoa(len(override.Rates)),
+		}
+	}
+	if err := h.client(r).LogAdminAction(r.Context(), entry); err != nil {
+		logger().Error("pricing override change not audited", "user_id", userID, "error", err)
+	}
+
+	logger().Info("pricing override changed", "user_id", userID, "action", entry.Action, "actor_id", actorID)
+	writeJSON(w, http.StatusOK, PricingOverrideResponse{UserID: userID, PricingOverride: override})
+}
@@ -0,0 +1,25 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"your-project/hld/internal/apierror"
+)
+
+func TestPricingOverrideRejectsInvalidOverrides(t *testing.T) {
+	h := NewAdminHandlers(nil, nil)
+	for _, body := range []string{`not json`, `null`, `{}`, `{"multiplier": -2}`, `{"rates": {"opus": {"input": -1, "output": 1}}}`} {
+		req := httptest.NewRequest(http.MethodPut, "/admin/users/u1/pricing", strings.NewReader(body))
+		req.SetPathValue("id", "u1")
+		w := httptest.NewRecorder()
+		h.PricingOverride(w, req)
+		assertEnvelope(t, w, http.StatusBadRequest, apierror.CodeInvalidRequest)
+	}
+
+	w := httptest.NewRecorder()
+	h.PricingOverride(w, httptest.NewRequest(http.MethodPost, "/admin/users/u1/pricing", nil))
+	assertEnvelope(t, w, http.StatusMethodNotAllowed, apierror.CodeMethodNotAllowed)
+}
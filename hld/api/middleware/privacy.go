@@ -0,0 +1,193 @@
+package middleware
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+)
+
+// Redaction modes for PrivacyConfig fields
+const (
+	// RedactNone keeps the value as is
+	RedactNone = "none"
+	// RedactOmit drops the value entirely
+	RedactOmit = "omit"
+	// RedactHash replaces the value with a salted SHA-256 digest, so records
+	// for the same address can still be correlated
+	RedactHash = "hash"
+	// RedactTruncate zeroes the host part of an IP address: the last octet
+	// for IPv4 and all but the /48 prefix for IPv6. IP addresses only.
+	RedactTruncate = "truncate"
+)
+
+// redactedHashLength is the number of hex characters kept from a digest
+const redactedHashLength = 16
+
+// logIPKeys and logEmailKeys are the slog attribute keys redacted in log lines
+var (
+	logIPKeys    = map[string]struct{}{"ip": {}, "ip_address": {}, "client_ip": {}, "remote_addr": {}}
+	logEmailKeys = map[string]struct{}{"email": {}}
+)
+
+// PrivacyConfig controls how personal data is redacted before it is written
+// to usage_logs or log output. Raw values remain available while a request
+// is processed, e.g. for auth failure throttling; only what is persisted is
+// redacted.
+type PrivacyConfig struct {
+	// IPMode is one of none, omit, hash or truncate
+	IPMode string
+	// EmailMode is one of none, omit or hash
+	EmailMode string
+	// HashSalt is mixed into hashed values so they can't be reversed by
+	// hashing candidate addresses
+	HashSalt string
+}
+
+// PrivacyConfigFromEnv reads PRIVACY_IP_MODE, PRIVACY_EMAIL_MODE and
+// PRIVACY_HASH_SALT. Unset modes default to none.
+func PrivacyConfigFromEnv() (PrivacyConfig, error) {
+	cfg := PrivacyConfig{
+		IPMode:    os.Getenv("PRIVACY_IP_MODE"),
+		EmailMode: os.Getenv("PRIVACY_EMAIL_MODE"),
+		HashSalt:  os.Getenv("PRIVACY_HASH_SALT"),
+	}
+	if cfg.IPMode == "" {
+		cfg.IPMode = RedactNone
+	}
+	if cfg.EmailMode == "" {
+		cfg.EmailMode = RedactNone
+	}
+
+	switch cfg.IPMode {
+	case RedactNone, RedactOmit, RedactHash, RedactTruncate:
+	default:
+		return PrivacyConfig{}, fmt.Errorf("invalid PRIVACY_IP_MODE %q", cfg.IPMode)
+	}
+	switch cfg.EmailMode {
+	case RedactNone, RedactOmit, RedactHash:
+	default:
+		return PrivacyConfig{}, fmt.Errorf("invalid PRIVACY_EMAIL_MODE %q", cfg.EmailMode)
+	}
+	if (cfg.IPMode == RedactHash || cfg.EmailMode == RedactHash) && cfg.HashSalt == "" {
+		logger().Warn("PRIVACY_HASH_SALT not set, hashed values can be reversed by brute force")
+	}
+
+	return cfg, nil
+}
+
+// enabled reports whether any field is redacted
+func (c PrivacyConfig) enabled() bool {
+	redacts := func(mode string) bool { return mode != "" && mode != RedactNone }
+	return redacts(c.IPMode) || redacts(c.EmailMode)
+}
+
+// RedactIP applies IPMode to an IP address
+func (c PrivacyConfig) RedactIP(ip string) string {
+	switch c.IPMode {
+	case RedactOmit:
+		return ""
+	case RedactHash:
+		return c.hash(ip)
+	case RedactTruncate:
+		return truncateIP(ip)
+	default:
+		return ip
+	}
+}
+
+// RedactEmail applies EmailMode to an email address
+func (c PrivacyConfig) RedactEmail(email string) string {
+	switch c.EmailMode {
+	case RedactOmit:
+		return ""
+	case RedactHash:
+		return c.hash(email)
+	default:
+		return email
+	}
+}
+
+func (c PrivacyConfig) hash(value string) string {
+	if value == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(c.HashSalt + value))
+	return hex.EncodeToString(sum[:])[:redactedHashLength]
+}
+
+// truncateIP zeroes the host part of ip. Values that don't parse as an IP
+// are dropped rather than risk persisting them.
+func truncateIP(ip string) string {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return ""
+	}
+	if v4 := parsed.To4(); v4 != nil {
+		return v4.Mask(net.CIDRMask(24, 32)).String()
+	}
+	return parsed.Mask(net.CIDRMask(48, 128)).String()
+}
+
+// WrapHandler returns a slog handler that redacts IP and email attributes
+// before passing records to h. h is returned unchanged when nothing is
+// redacted.
+func (c PrivacyConfig) WrapHandler(h slog.Handler) slog.Handler {
+	if !c.enabled() {
+		return h
+	}
+	return &redactingHandler{next: h, privacy: c}
+}
+
+// redactingHandler applies a PrivacyConfig to log attributes
+type redactingHandler struct {
+	next    slog.Handler
+	privacy PrivacyConfig
+}
+
+func (h *redactingHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.next.Enabled(ctx, level)
+}
+
+func (h *redactingHandler) Handle(ctx context.Context, r slog.Record) error {
+	redacted := slog.NewRecord(r.Time, r.Level, r.Message, r.PC)
+	r.Attrs(func(a slog.Attr) bool {
+		redacted.AddAttrs(h.redact(a))
+		return true
+	})
+	return h.next.Handle(ctx, redacted)
+}
+
+func (h *redactingHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	redacted := make([]slog.Attr, len(attrs))
+	for i, a := range attrs {
+		redacted[i] = h.redact(a)
+	}
+	return &redactingHandler{next: h.next.WithAttrs(redacted), privacy: h.privacy}
+}
+
+func (h *redactingHandler) WithGroup(name string) slog.Handler {
+	return &redactingHandler{next: h.next.WithGroup(name), privacy: h.privacy}
+}
+
+// redact rewrites a single attribute, descending into groups
+func (h *redactingHandler) redact(a slog.Attr) slog.Attr {
+	if a.Value.Kind() == slog.KindGroup {
+		group := a.Value.Group()
+		redacted := make([]any, len(group))
+		for i, ga := range group {
+			redacted[i] = h.redact(ga)
+		}
+		return slog.Group(a.Key, redacted...)
+	}
+	if _, ok := logIPKeys[a.Key]; ok {
+		return slog.String(a.Key, h.privacy.RedactIP(a.Value.String()))
+	}
+	if _, ok := logEmailKeys[a.Key]; ok {
+		return slog.String(a.Key, h.privacy.RedactEmail(a.Value.String()))
+	}
+	return a
+}
@@ -0,0 +1,71 @@
+package middleware
+
+import (
+	"bytes"
+	"log/slog"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPrivacyConfigRedactIP(t *testing.T) {
+	tests := []struct {
+		mode string
+		ip   string
+		want string
+	}{
+		{mode: RedactNone, ip: "203.0.113.57", want: "203.0.113.57"},
+		{mode: RedactOmit, ip: "203.0.113.57", want: ""},
+		{mode: RedactTruncate, ip: "203.0.113.57", want: "203.0.113.0"},
+		{mode: RedactTruncate, ip: "2001:db8:abcd:12::1", want: "2001:db8:abcd::"},
+		{mode: RedactTruncate, ip: "not-an-ip", want: ""},
+	}
+	for _, tt := range tests {
+		cfg := PrivacyConfig{IPMode: tt.mode}
+		assert.Equal(t, tt.want, cfg.RedactIP(tt.ip), "%s %s", tt.mode, tt.ip)
+	}
+
+	hashed := PrivacyConfig{IPMode: RedactHash, HashSalt: "salt"}
+	assert.Len(t, hashed.RedactIP("203.0.113.57"), redactedHashLength)
+	assert.Equal(t, hashed.RedactIP("203.0.113.57"), hashed.RedactIP("203.0.113.57"))
+	assert.NotEqual(t, hashed.RedactIP("203.0.113.57"),
+		PrivacyConfig{IPMode: RedactHash, HashSalt: "other"}.RedactIP("203.0.113.57"))
+}
+
+func TestPrivacyConfigFromEnv(t *testing.T) {
+	t.Setenv("PRIVACY_IP_MODE", "truncate")
+	t.Setenv("PRIVACY_EMAIL_MODE", "")
+	cfg, err := PrivacyConfigFromEnv()
+	require.NoError(t, err)
+	assert.Equal(t, RedactTruncate, cfg.IPMode)
+	assert.Equal(t, RedactNone, cfg.EmailMode)
+
+	// Emails can't be truncated
+	t.Setenv("PRIVACY_EMAIL_MODE", "truncate")
+	_, err = PrivacyConfigFromEnv()
+	assert.Error(t, err)
+}
+
+func TestRedactingHandler(t *testing.T) {
+	var buf bytes.Buffer
+	cfg := PrivacyConfig{IPMode: RedactTruncate, EmailMode: RedactOmit}
+	logger := slog.New(cfg.WrapHandler(slog.NewTextHandler(&buf, nil)))
+
+	logger.With("email", "user@example.com").Info("throttled",
+		"ip", "203.0.113.57",
+		slog.Group("req", "ip_address", "198.51.100.9"),
+		"user_id", "u1")
+
+	out := buf.String()
+	assert.NotContains(t, out, "user@example.com")
+	assert.NotContains(t, out, "203.0.113.57")
+	assert.NotContains(t, out, "198.51.100.9")
+	assert.Contains(t, out, "ip=203.0.113.0")
+	assert.Contains(t, out, "req.ip_address=198.51.100.0")
+	assert.Contains(t, out, "user_id=u1")
+
+	// Nothing to redact leaves the handler untouched
+	h := slog.NewTextHandler(&buf, nil)
+	assert.Same(t, h, PrivacyConfig{}.WrapHandler(h))
+}
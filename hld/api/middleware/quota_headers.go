@@ -0,0 +1,83 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+
+	"your-project/hld/firebase"
+)
+
+// Quota headers let clients see how close they are to their limits without
+// calling the balance endpoint.
+//
+// As headers they carry pre-request values, since headers go out before the
+// upstream response is streamed:
+//
+//   - X-Points-Remaining: the spendable balance CheckAuth read, before any
+//     points were held or charged for this request
+//   - X-Requests-Today: requests logged today, not counting this one
+//   - X-RateLimit-Remaining: requests left in the rate limit burst after
+//     this one, set by RateLimit
+//   - X-Estimated-Requests-Remaining: how many requests X-Points-Remaining
+//     funds at the user's average charge, once they have one
+//   - X-Low-Balance-Warning: "true" when that is fewer than
+//     lowBalanceRequests
+//
+// Billable requests also get post-request values as HTTP trailers of the same
+// names, once TrackUsage has charged them: X-Points-Remaining and the
+// estimate after the deduction, and X-Requests-Today including this request.
+// Trailers are only delivered on chunked responses, which covers streamed
+// ones.
+const (
+	headerPointsRemaining    = "X-Points-Remaining"
+	headerRequestsToday      = "X-Requests-Today"
+	headerRateLimitRemaining = "X-RateLimit-Remaining"
+	headerRequestsRemaining  = "X-Estimated-Requests-Remaining"
+	headerLowBalanceWarning  = "X-Low-Balance-Warning"
+)
+
+// lowBalanceRequests is the estimated requests remaining below which
+// X-Low-Balance-Warning is sent
+const lowBalanceRequests = 5
+
+// setQuotaHeaders sets the pre-request quota headers
+func setQuotaHeaders(h http.Header, account *firebase.UserAccount, points int) {
+	h.Set(headerPointsRemaining, strconv.Itoa(points))
+	h.Set(headerRequestsToday, strconv.Itoa(account.RequestsToday))
+	setBalanceForecast(h, "", points, account.AvgPointsPerRequest)
+}
+
+// setBalanceForecast sets the requests points funds at avgPoints each, and
+// the low balance warning, with names prefixed by prefix. Nothing is set
+// before the user's first charge, when there is no average.
+func setBalanceForecast(h http.Header, prefix string, points int, avgPoints float64) {
+	if avgPoints <= 0 {
+		return
+	}
+	remaining := int(float64(points) / avgPoints)
+	h.Set(prefix+headerRequestsRemaining, strconv.Itoa(remaining))
+	if remaining < lowBalanceRequests {
+		h.Set(prefix+headerLowBalanceWarning, "true")
+	}
+}
+
+// setQuotaTrailers sets the post-request values of a billed request as
+// trailers, re-reading the balance the deduction just cached
+func (m *UsageMiddleware) setQuotaTrailers(ctx context.Context, w http.ResponseWriter, userID string) {
+	client := m.client(ctx)
+	if client == nil {
+		return
+	}
+	account, err := client.GetUserAccount(context.WithoutCancel(ctx), userID)
+	if err != nil {
+		requestLogger(ctx).Warn("failed to read balance for quota trailers", "user_id", userID, "error", err)
+		return
+	}
+
+	// The request is logged in the background, so count it here
+	requestsToday, _ := ctx.Value("requests_today").(int)
+	w.Header().Set(http.TrailerPrefix+headerPointsRemaining, strconv.Itoa(account.SpendablePoints()))
+	w.Header().Set(http.TrailerPrefix+headerRequestsToday, strconv.Itoa(requestsToday+1))
+	setBalanceForecast(w.Header(), http.TrailerPrefix, account.SpendablePoints(), account.AvgPointsPerRequest)
+}
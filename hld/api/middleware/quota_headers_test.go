@@ -0,0 +1,32 @@
+package middleware
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"your-project/hld/firebase"
+)
+
+func TestSetQuotaHeaders(t *testing.T) {
+	h := http.Header{}
+	setQuotaHeaders(h, &firebase.UserAccount{RequestsToday: 7}, 42)
+	assert.Equal(t, "42", h.Get(headerPointsRemaining))
+	assert.Equal(t, "7", h.Get(headerRequestsToday))
+	// No charges yet, so no average to estimate from
+	assert.Empty(t, h.Get(headerRequestsRemaining))
+	assert.Empty(t, h.Get(headerLowBalanceWarning))
+}
+
+func TestSetBalanceForecast(t *testing.T) {
+	h := http.Header{}
+	setQuotaHeaders(h, &firebase.UserAccount{AvgPointsPerRequest: 4}, 42)
+	assert.Equal(t, "10", h.Get(headerRequestsRemaining))
+	assert.Empty(t, h.Get(headerLowBalanceWarning))
+
+	h = http.Header{}
+	setBalanceForecast(h, http.TrailerPrefix, 18, 4)
+	assert.Equal(t, "4", h.Get(http.TrailerPrefix+headerRequestsRemaining))
+	assert.Equal(t, "true", h.Get(http.TrailerPrefix+headerLowBalanceWarning))
+}
@@ -0,0 +1,253 @@
+package middleware
+
+import (
+	"container/list"
+	"context"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"your-project/hld/internal/apierror"
+)
+
+// Defaults for per-user rate limiting, overridable via environment
+const (
+	defaultRateLimitRPS      = 5.0
+	defaultRateLimitBurst    = 10
+	defaultRateLimitMaxUsers = 10000
+
+	// planRefreshInterval is how long a cached user plan is trusted before
+	// the limiter looks it up again
+	planRefreshInterval = 5 * time.Minute
+)
+
+// PlanLookupFunc resolves the plan name for a user
+type PlanLookupFunc func(ctx context.Context, userID string) (string, error)
+
+// tokenBucket is a classic token bucket refilled continuously at rate tokens
+// per second up to burst
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+	rate   float64
+	burst  float64
+}
+
+// refill adds the tokens accrued since the last update
+func (b *tokenBucket) refill(now time.Time) {
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens = math.Min(b.burst, b.tokens+elapsed*b.rate)
+		b.last = now
+	}
+}
+
+// wait returns how long until a full token is available
+func (b *tokenBucket) wait() time.Duration {
+	if b.tokens >= 1 {
+		return 0
+	}
+	if b.rate <= 0 {
+		return time.Minute
+	}
+	return time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+}
+
+// take consumes a token if one is available. Otherwise it reports how long
+// until the next token is available.
+func (b *tokenBucket) take(now time.Time) (bool, time.Duration) {
+	b.refill(now)
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+
+	return false, b.wait()
+}
+
+// limiterEntry is a user's bucket along with the plan it was sized for
+type limiterEntry struct {
+	userID        string
+	plan          string
+	planFetchedAt time.Time
+	bucket        tokenBucket
+}
+
+// RateLimiter enforces per-user token buckets. Buckets are kept in an LRU so
+// memory stays bounded no matter how many distinct users are seen.
+type RateLimiter struct {
+	mu       sync.Mutex
+	entries  map[string]*list.Element
+	lru      *list.List
+	maxUsers int
+
+	defaults   RateLimitConfig
+	plans      Plans
+	lookupPlan PlanLookupFunc
+
+	allowed  *Counter
+	rejected *Counter
+}
+
+// NewRateLimiter creates a rate limiter from RATE_LIMIT_RPS, RATE_LIMIT_BURST
+// and RATE_LIMIT_MAX_USERS, with per-plan overrides from plans
+func NewRateLimiter(plans Plans, lookupPlan PlanLookupFunc, metrics *Metrics) *RateLimiter {
+	defaults := RateLimitConfig{
+		RequestsPerSecond: defaultRateLimitRPS,
+		Burst:             defaultRateLimitBurst,
+	}
+	if raw := getEnvFloat("RATE_LIMIT_RPS"); raw > 0 {
+		defaults.RequestsPerSecond = raw
+	}
+	if raw := getEnvInt("RATE_LIMIT_BURST"); raw > 0 {
+		defaults.Burst = raw
+	}
+	maxUsers := defaultRateLimitMaxUsers
+	if raw := getEnvInt("RATE_LIMIT_MAX_USERS"); raw > 0 {
+		maxUsers = raw
+	}
+
+	return &RateLimiter{
+		entries:    make(map[string]*list.Element),
+		lru:        list.New(),
+		maxUsers:   maxUsers,
+		defaults:   defaults,
+		plans:      plans,
+		lookupPlan: lookupPlan,
+		allowed:    metrics.Counter("hld_rate_limit_allowed_total", "Requests allowed by the per-user rate limiter"),
+		rejected:   metrics.Counter("hld_rate_limit_rejected_total", "Requests rejected by the per-user rate limiter"),
+	}
+}
+
+// Allow consumes a token for userID, returning the wait before a retry would
+// succeed when the bucket is empty
+func (l *RateLimiter) Allow(ctx context.Context, userID string) (bool, time.Duration) {
+	now := time.Now()
+
+	l.mu.Lock()
+	entry := l.entry(userID)
+	needsPlan := len(l.plans) > 0 && l.lookupPlan != nil && now.Sub(entry.planFetchedAt) > planRefreshInterval
+	l.mu.Unlock()
+
+	// Look up the plan outside the lock so a slow Firebase read doesn't
+	// stall every other user
+	if needsPlan {
+		plan, err := l.lookupPlan(ctx, userID)
+		if err != nil {
+			logger().Warn("failed to look up plan for rate limit", "user_id", userID, "error", err)
+		}
+
+		l.mu.Lock()
+		entry = l.entry(userID)
+		if err == nil && plan != entry.plan {
+			cfg := l.configFor(plan)
+			entry.bucket.rate = cfg.RequestsPerSecond
+			entry.bucket.burst = float64(cfg.Burst)
+			if entry.plan == "" {
+				// First lookup for a fresh bucket, start with the plan's full burst
+				entry.bucket.tokens = entry.bucket.burst
+			} else {
+				entry.bucket.tokens = math.Min(entry.bucket.tokens, entry.bucket.burst)
+			}
+			entry.plan = plan
+		}
+		entry.planFetchedAt = now
+		l.mu.Unlock()
+	}
+
+	l.mu.Lock()
+	ok, wait := l.entry(userID).bucket.take(now)
+	l.mu.Unlock()
+
+	if ok {
+		l.allowed.Inc()
+	} else {
+		l.rejected.Inc()
+	}
+	return ok, wait
+}
+
+// Remaining returns how many requests userID could make right now without
+// being limited
+func (l *RateLimiter) Remaining(userID string) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	el, ok := l.entries[userID]
+	if !ok {
+		return l.defaults.Burst
+	}
+	bucket := &el.Value.(*limiterEntry).bucket
+	bucket.refill(time.Now())
+	return int(bucket.tokens)
+}
+
+// entry returns the user's limiter entry, creating it and evicting the least
+// recently used entry if needed. Callers must hold l.mu.
+func (l *RateLimiter) entry(userID string) *limiterEntry {
+	if el, ok := l.entries[userID]; ok {
+		l.lru.MoveToFront(el)
+		return el.Value.(*limiterEntry)
+	}
+
+	cfg := l.defaults
+	entry := &limiterEntry{
+		userID: userID,
+		bucket: tokenBucket{
+			tokens: float64(cfg.Burst),
+			last:   time.Now(),
+			rate:   cfg.RequestsPerSecond,
+			burst:  float64(cfg.Burst),
+		},
+	}
+	l.entries[userID] = l.lru.PushFront(entry)
+
+	for l.lru.Len() > l.maxUsers {
+		oldest := l.lru.Back()
+		l.lru.Remove(oldest)
+		delete(l.entries, oldest.Value.(*limiterEntry).userID)
+	}
+
+	return entry
+}
+
+// configFor returns the rate limit for plan, falling back to the defaults
+func (l *RateLimiter) configFor(plan string) RateLimitConfig {
+	if p, ok := l.plans[plan]; ok && p.RateLimit != nil {
+		return *p.RateLimit
+	}
+	return l.defaults
+}
+
+// RateLimit middleware throttles authenticated users with a per-user token
+// bucket. It must run after CheckAuth so the user ID is in context.
+func (m *UsageMiddleware) RateLimit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userID, ok := r.Context().Value("user_id").(string)
+		if m.rateLimiter == nil || !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		allowed, wait := m.rateLimiter.Allow(r.Context(), userID)
+		w.Header().Set(headerRateLimitRemaining, strconv.Itoa(m.rateLimiter.Remaining(userID)))
+		if !allowed {
+			retryAfter := int(math.Ceil(wait.Seconds()))
+			if retryAfter < 1 {
+				retryAfter = 1
+			}
+			logger().Warn("user rate limited", "user_id", userID, "retry_after", retryAfter)
+			w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+			writeError(w, http.StatusTooManyRequests, APIError{
+				Code:    apierror.CodeRateLimited,
+				Message: "Too many requests. Please slow down.",
+				Details: map[string]interface{}{"retry_after_seconds": retryAfter},
+			})
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
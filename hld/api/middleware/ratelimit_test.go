@@ -0,0 +1,105 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTokenBucketTake(t *testing.T) {
+	now := time.Now()
+	b := tokenBucket{tokens: 2, last: now, rate: 1, burst: 2}
+
+	ok, _ := b.take(now)
+	assert.True(t, ok)
+	ok, _ = b.take(now)
+	assert.True(t, ok)
+
+	ok, wait := b.take(now)
+	assert.False(t, ok)
+	assert.InDelta(t, time.Second, wait, float64(10*time.Millisecond))
+
+	ok, _ = b.take(now.Add(time.Second))
+	assert.True(t, ok)
+}
+
+func TestRateLimiterPlanOverrides(t *testing.T) {
+	t.Setenv("RATE_LIMIT_RPS", "1")
+	t.Setenv("RATE_LIMIT_BURST", "1")
+
+	plans := Plans{"pro": {RateLimit: &RateLimitConfig{RequestsPerSecond: 10, Burst: 3}}}
+	lookup := func(ctx context.Context, userID string) (string, error) {
+		if userID == "pro-user" {
+			return "pro", nil
+		}
+		return "free", nil
+	}
+	l := NewRateLimiter(plans, lookup, NewMetrics())
+
+	ok, _ := l.Allow(context.Background(), "free-user")
+	assert.True(t, ok)
+	ok, _ = l.Allow(context.Background(), "free-user")
+	assert.False(t, ok)
+
+	for i := 0; i < 3; i++ {
+		ok, _ = l.Allow(context.Background(), "pro-user")
+		assert.True(t, ok)
+	}
+
+	assert.Equal(t, int64(4), l.allowed.Value())
+	assert.Equal(t, int64(1), l.rejected.Value())
+}
+
+func TestRateLimiterEvictsLeastRecentlyUsed(t *testing.T) {
+	t.Setenv("RATE_LIMIT_MAX_USERS", "2")
+	l := NewRateLimiter(nil, nil, NewMetrics())
+
+	l.Allow(context.Background(), "a")
+	l.Allow(context.Background(), "b")
+	l.Allow(context.Background(), "c")
+
+	assert.Len(t, l.entries, 2)
+	assert.NotContains(t, l.entries, "a")
+}
+
+func TestRateLimitMiddlewareReturns429(t *testing.T) {
+	t.Setenv("RATE_LIMIT_RPS", "0.5")
+	t.Setenv("RATE_LIMIT_BURST", "1")
+	m := &UsageMiddleware{enabled: true, rateLimiter: NewRateLimiter(nil, nil, NewMetrics())}
+
+	handler := m.RateLimit(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/messages", nil)
+	req = req.WithContext(context.WithValue(req.Context(), "user_id", "user-1"))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "0", w.Header().Get(headerRateLimitRemaining))
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "2", w.Header().Get("Retry-After"))
+	assert.Equal(t, "0", w.Header().Get(headerRateLimitRemaining))
+	assert.Contains(t, w.Body.String(), `"rate_limited"`)
+}
+
+func TestRateLimiterRemaining(t *testing.T) {
+	t.Setenv("RATE_LIMIT_RPS", "0.001")
+	t.Setenv("RATE_LIMIT_BURST", "3")
+	l := NewRateLimiter(nil, nil, NewMetrics())
+	ctx := context.Background()
+
+	assert.Equal(t, 3, l.Remaining("user-1"))
+	l.Allow(ctx, "user-1")
+	assert.Equal(t, 2, l.Remaining("user-1"))
+	l.Allow(ctx, "user-1")
+	assert.Equal(t, 1, l.Remaining("user-1"))
+}
@@ -0,0 +1,51 @@
+package middleware
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+)
+
+// defaultMaxRequestBodyBytes caps how much of a request body is buffered
+// to read the model and estimate its cost
+const defaultMaxRequestBodyBytes = 10 << 20
+
+// maxRequestBodyFromEnv reads MAX_REQUEST_BODY_BYTES
+func maxRequestBodyFromEnv() int64 {
+	limit := int64(defaultMaxRequestBodyBytes)
+	if raw := os.Getenv("MAX_REQUEST_BODY_BYTES"); raw != "" {
+		if n, err := strconv.ParseInt(raw, 10, 64); err == nil && n > 0 {
+			limit = n
+		} else {
+			logger().Warn("invalid MAX_REQUEST_BODY_BYTES, using default", "value", raw, "default", limit)
+		}
+	}
+	return limit
+}
+
+// bodyLimit returns the largest request body the middleware buffers
+func (m *UsageMiddleware) bodyLimit() int64 {
+	if m.maxBodyBytes <= 0 {
+		return defaultMaxRequestBodyBytes
+	}
+	return m.maxBodyBytes
+}
+
+// restoreBody replaces r's consumed body with the buffered bytes, setting
+// ContentLength and GetBody to match so the downstream handler, and any
+// proxy retrying the request, sees the original body
+func restoreBody(r *http.Request, body []byte) {
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	r.ContentLength = int64(len(body))
+	r.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(body)), nil
+	}
+}
+
+// readCloser reads from a partly consumed body while closing the original
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
@@ -0,0 +1,88 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"your-project/hld/internal/apierror"
+)
+
+func TestTrackUsageRestoresRequestBody(t *testing.T) {
+	body := `{"model":"claude-3-5-haiku-20241022","max_tokens":64,"messages":[{"role":"user","content":"hello"}]}`
+
+	m := newTestTrackingMiddleware()
+	type received struct {
+		body, retried []byte
+		length        int64
+	}
+	got := make(chan received, 1)
+	handler := m.TrackUsage(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var rec received
+		rec.body, _ = io.ReadAll(r.Body)
+		rec.length = r.ContentLength
+		if r.GetBody != nil {
+			retry, err := r.GetBody()
+			if assert.NoError(t, err) {
+				rec.retried, _ = io.ReadAll(retry)
+			}
+		}
+		got <- rec
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"usage":{"input_tokens":1,"output_tokens":1}}`))
+	}))
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), "user_id", "user-1")
+		ctx = context.WithValue(ctx, "service_account", true)
+		// CheckAuth estimates the hold from the body before TrackUsage reads it
+		m.estimateCost(r, "user-1")
+		handler.ServeHTTP(w, r.WithContext(ctx))
+	}))
+	defer server.Close()
+
+	resp, err := http.Post(server.URL+"/v1/messages", "application/json", strings.NewReader(body))
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	rec := <-got
+	assert.Equal(t, body, string(rec.body))
+	assert.Equal(t, body, string(rec.retried))
+	assert.Equal(t, int64(len(body)), rec.length)
+}
+
+func TestTrackUsageRejectsOversizedBody(t *testing.T) {
+	m := newTestTrackingMiddleware()
+	m.maxBodyBytes = 16
+	called := false
+	handler := m.TrackUsage(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	}))
+
+	req := authenticatedRequest(`{"model":"claude-3-5-haiku-20241022"}`)
+	assert.Equal(t, minRequiredPoints, m.estimateCost(req, "user-1"))
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	assert.False(t, called)
+	apiErr := assertEnvelope(t, w, http.StatusRequestEntityTooLarge, apierror.CodeRequestTooLarge)
+	assert.EqualValues(t, 16, apiErr.Details["max_bytes"])
+}
+
+func TestEstimateCostLeavesOversizedBodyIntact(t *testing.T) {
+	m := &UsageMiddleware{maxBodyBytes: 4}
+	body := `{"model":"claude-3-5-haiku-20241022"}`
+	req := httptest.NewRequest(http.MethodPost, "/v1/messages", strings.NewReader(body))
+
+	assert.Equal(t, minRequiredPoints, m.estimateCost(req, "user-1"))
+	rest, err := io.ReadAll(req.Body)
+	require.NoError(t, err)
+	assert.True(t, bytes.Equal([]byte(body), rest))
+}
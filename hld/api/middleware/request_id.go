@@ -0,0 +1,39 @@
+package middleware
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+
+	"your-project/hld/internal/requestid"
+)
+
+// RequestID assigns every request an ID, keeping a well-formed X-Request-ID
+// sent by the client. The ID is echoed in the response header, stored on the
+// request context for logs and usage records, and forwarded in the request
+// header to downstream handlers. Mount it outside CheckAuth and TrackUsage.
+func RequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := requestid.FromContext(r.Context())
+		if id == "" {
+			id = requestid.FromHeader(r.Header.Get(requestid.Header))
+		}
+
+		w.Header().Set(requestid.Header, id)
+		r.Header.Set(requestid.Header, id)
+		next.ServeHTTP(w, r.WithContext(requestid.NewContext(r.Context(), id)))
+	})
+}
+
+// requestLogger returns the package logger tagged with the request's ID.
+// Requests left out by the LogSampler only log errors.
+func requestLogger(ctx context.Context) *slog.Logger {
+	log := logger()
+	if unsampled, _ := ctx.Value("logs_unsampled").(bool); unsampled {
+		log = slog.New(errorsOnly{log.Handler()})
+	}
+	if id := requestid.FromContext(ctx); id != "" {
+		return log.With("request_id", id)
+	}
+	return log
+}
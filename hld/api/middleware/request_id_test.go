@@ -0,0 +1,46 @@
+package middleware
+
+import (
+	"bytes"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"your-project/hld/internal/requestid"
+)
+
+func TestRequestID(t *testing.T) {
+	var seen string
+	handler := RequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = requestid.FromContext(r.Context())
+		assert.Equal(t, seen, r.Header.Get(requestid.Header))
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set(requestid.Header, "client-req-1")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	assert.Equal(t, "client-req-1", seen)
+	assert.Equal(t, "client-req-1", w.Header().Get(requestid.Header))
+
+	// Malformed IDs are replaced rather than echoed
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set(requestid.Header, "bad\nid")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	assert.NotEqual(t, "bad\nid", seen)
+	assert.Equal(t, seen, w.Header().Get(requestid.Header))
+}
+
+func TestRequestLogger(t *testing.T) {
+	var buf bytes.Buffer
+	prev := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(&buf, nil)))
+	defer slog.SetDefault(prev)
+
+	ctx := requestid.NewContext(httptest.NewRequest(http.MethodGet, "/", nil).Context(), "req-42")
+	requestLogger(ctx).Info("hello")
+	assert.Contains(t, buf.String(), "request_id=req-42")
+}
@@ -0,0 +1,68 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"os"
+
+	"your-project/hld/firebase"
+	"your-project/hld/internal/apierror"
+)
+
+// RequireAdmin rejects callers who aren't administrators. It must run after
+// CheckAuth. Admins are users whose ID token carries the admin custom claim,
+// or whose UID is listed in the comma separated ADMIN_UIDS, which lets the
+// first admin be designated before anyone holds the claim. API keys and
+// impersonation tokens never grant admin access.
+//
+// Admitted requests carry the admin's UID as "admin_id" in context, which
+// the admin handlers record as the actor in the audit log.
+func RequireAdmin(next http.Handler) http.Handler {
+	bootstrap := adminUIDsFromEnv()
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isAdmin(r.Context(), bootstrap) {
+			userID, _ := r.Context().Value("user_id").(string)
+			_, viaAPIKey := r.Context().Value("api_key").(*firebase.APIKey)
+			logger().Warn("non-admin denied admin endpoint",
+				"user_id", userID,
+				"api_key", viaAPIKey,
+				"impersonated", impersonatorID(r.Context()) != "",
+				"path", r.URL.Path)
+			writeError(w, http.StatusForbidden, APIError{
+				Code:    apierror.CodeAdminRequired,
+				Message: "This endpoint requires administrator access",
+			})
+			return
+		}
+
+		userID, _ := r.Context().Value("user_id").(string)
+		ctx := context.WithValue(r.Context(), "admin_id", userID)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// adminUIDsFromEnv reads the bootstrap admins listed in ADMIN_UIDS
+func adminUIDsFromEnv() map[string]bool {
+	admins := make(map[string]bool)
+	for _, uid := range splitList(os.Getenv("ADMIN_UIDS")) {
+		admins[uid] = true
+	}
+	return admins
+}
+
+// isAdmin reports whether the authenticated caller is an administrator, by
+// claim or by being listed in bootstrap, as RequireAdmin decides
+func isAdmin(ctx context.Context, bootstrap map[string]bool) bool {
+	userID, _ := ctx.Value("user_id").(string)
+	_, viaAPIKey := ctx.Value("api_key").(*firebase.APIKey)
+	claim, _ := ctx.Value("admin_claim").(bool)
+	impersonated := impersonatorID(ctx) != ""
+	return userID != "" && !viaAPIKey && !impersonated && (claim || bootstrap[userID])
+}
+
+// adminActor returns the admin acting on a request, for audit entries
+func adminActor(ctx context.Context) string {
+	actorID, _ := ctx.Value("admin_id").(string)
+	return actorID
+}
@@ -0,0 +1,52 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"your-project/hld/firebase"
+)
+
+func TestRequireAdmin(t *testing.T) {
+	t.Setenv("ADMIN_UIDS", "founder, ops")
+
+	var actor string
+	handler := RequireAdmin(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		actor = adminActor(r.Context())
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	serve := func(values map[string]interface{}) int {
+		actor = ""
+		req := httptest.NewRequest(http.MethodGet, "/admin/users", nil)
+		ctx := req.Context()
+		for k, v := range values {
+			ctx = context.WithValue(ctx, k, v)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req.WithContext(ctx))
+		return w.Code
+	}
+
+	// Admitted by the custom claim or the bootstrap list
+	assert.Equal(t, http.StatusOK, serve(map[string]interface{}{"user_id": "alice", "admin_claim": true}))
+	assert.Equal(t, "alice", actor)
+	assert.Equal(t, http.StatusOK, serve(map[string]interface{}{"user_id": "ops"}))
+	assert.Equal(t, "ops", actor)
+
+	// Everyone else, API keys included, is refused
+	assert.Equal(t, http.StatusForbidden, serve(map[string]interface{}{"user_id": "bob"}))
+	assert.Equal(t, http.StatusForbidden, serve(nil))
+	assert.Equal(t, http.StatusForbidden, serve(map[string]interface{}{
+		"user_id": "founder",
+		"api_key": &firebase.APIKey{UserID: "founder"},
+	}))
+	assert.Equal(t, http.StatusForbidden, serve(map[string]interface{}{
+		"user_id":         "founder",
+		"impersonator_id": "alice",
+	}))
+	assert.Empty(t, actor)
+}
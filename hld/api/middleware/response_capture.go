@@ -0,0 +1,142 @@
+package middleware
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime"
+	"strings"
+	"unicode/utf8"
+
+	"your-project/hld/firebase"
+)
+
+// defaultResponseCaptureBytes is how much TrackUsage keeps from each end of
+// a response to read its usage from
+const defaultResponseCaptureBytes = 64 << 10
+
+// maxErrorMessageBytes caps the error response stored in a usage log
+const maxErrorMessageBytes = 4 << 10
+
+// responseCaptureFromEnv reads RESPONSE_CAPTURE_KB, the kilobytes kept from
+// each end of a JSON response. Zero means the default.
+func responseCaptureFromEnv() int {
+	kb := getEnvInt("RESPONSE_CAPTURE_KB")
+	if kb < 0 {
+		logger().Warn("RESPONSE_CAPTURE_KB must not be negative, using default", "value", kb)
+		return 0
+	}
+	return kb << 10
+}
+
+// responseCaptureLimit returns the bytes kept from each end of a response
+func (m *UsageMiddleware) responseCaptureLimit() int {
+	if m.responseCapture <= 0 {
+		return defaultResponseCaptureBytes
+	}
+	return m.responseCapture
+}
+
+// bodyCapture keeps the first and last limit bytes of a response, so a
+// large completion isn't held in memory just to find the usage object at
+// its end. Bodies of up to twice limit are kept whole.
+type bodyCapture struct {
+	limit int
+	head  []byte
+	// tail grows to twice limit before being cut back to the last limit
+	// bytes, so cutting is amortized over the writes
+	tail []byte
+	// size counts every byte written, kept or not
+	size int64
+}
+
+func newBodyCapture(limit int) *bodyCapture {
+	return &bodyCapture{limit: limit}
+}
+
+func (c *bodyCapture) Write(b []byte) {
+	c.size += int64(len(b))
+	if room := c.limit - len(c.head); room > 0 {
+		n := min(room, len(b))
+		c.head = append(c.head, b[:n]...)
+		b = b[n:]
+	}
+	c.tail = append(c.tail, b...)
+	if len(c.tail) > 2*c.limit {
+		c.tail = append(c.tail[:0], c.tail[len(c.tail)-c.limit:]...)
+	}
+}
+
+// complete reports whether every byte written was kept
+func (c *bodyCapture) complete() bool {
+	return c == nil || c.size == int64(len(c.head)+len(c.tail))
+}
+
+// body returns the whole body if it was kept, or else its start
+func (c *bodyCapture) body() []byte {
+	if c == nil {
+		return nil
+	}
+	if !c.complete() || len(c.tail) == 0 {
+		return c.head
+	}
+	return append(c.head[:len(c.head):len(c.head)], c.tail...)
+}
+
+// truncatedUsage reads the usage object from the end of a JSON response too
+// large to keep whole. Anthropic and OpenAI responses both put usage after
+// the content. A "usage" key inside the content is escaped, so it isn't
+// mistaken for the object.
+func truncatedUsage(tail []byte) (usage tokenUsage, ok bool) {
+	i := bytes.LastIndex(tail, []byte(`"usage"`))
+	if i < 0 {
+		return tokenUsage{}, false
+	}
+	rest := bytes.TrimLeft(tail[i+len(`"usage"`):], " \t\r\n")
+	rest, found := bytes.CutPrefix(rest, []byte(":"))
+	if !found {
+		return tokenUsage{}, false
+	}
+
+	var object responseUsageObject
+	if err := json.NewDecoder(bytes.NewReader(rest)).Decode(&object); err != nil {
+		return tokenUsage{}, false
+	}
+	return object.tokens(), true
+}
+
+// errorMessage returns an error response for a usage log, cut on a rune
+// boundary at maxErrorMessageBytes
+func errorMessage(body []byte) string {
+	if len(body) <= maxErrorMessageBytes {
+		return string(body)
+	}
+	cut := maxErrorMessageBytes
+	for cut > 0 && !utf8.RuneStart(body[cut]) {
+		cut--
+	}
+	return string(body[:cut]) + "..."
+}
+
+// hasUsageContentType reports whether a response of contentType may carry
+// token usage: JSON, an event stream, or a body whose type wasn't set
+func hasUsageContentType(contentType string) bool {
+	if contentType == "" {
+		return true
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json") ||
+		mediaType == "text/event-stream"
+}
+
+// opaqueResponseCost is the charge for a successful response that was
+// neither JSON nor an event stream: OPAQUE_RESPONSE_CHARGE if set, else
+// the model's minimum
+func (m *UsageMiddleware) opaqueResponseCost(model string, pricing *firebase.PricingOverride) int {
+	if m.opaqueResponseCharge > 0 {
+		return m.opaqueResponseCharge
+	}
+	return firebase.CalculatePointsCostFor(model, 0, 0, pricing)
+}
@@ -0,0 +1,247 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"your-project/hld/firebase"
+)
+
+func TestBodyCapture(t *testing.T) {
+	c := newBodyCapture(4)
+	c.Write([]byte("abc"))
+	c.Write([]byte("defgh"))
+	assert.True(t, c.complete())
+	assert.Equal(t, "abcdefgh", string(c.body()))
+
+	for i := 0; i < 10; i++ {
+		c.Write([]byte("0123456789"))
+	}
+	assert.False(t, c.complete())
+	assert.Equal(t, int64(108), c.size)
+	assert.Equal(t, "abcd", string(c.body()))
+	assert.True(t, strings.HasSuffix(string(c.tail), "6789"))
+	assert.LessOrEqual(t, len(c.tail), 8)
+
+	var none *bodyCapture
+	assert.True(t, none.complete())
+	assert.Nil(t, none.body())
+}
+
+func TestTruncatedUsage(t *testing.T) {
+	tail := []byte(`lo \"usage\": 99"}],"usage":{"input_tokens":12,"output_tokens":34}}`)
+	usage, ok := truncatedUsage(tail)
+	require.True(t, ok)
+	assert.Equal(t, tokenUsage{input: 12, output: 34}, usage)
+
+	usage, ok = truncatedUsage([]byte(`,"usage":{"prompt_tokens":5,"completion_tokens":6}}`))
+	require.True(t, ok)
+	assert.Equal(t, tokenUsage{input: 5, output: 6}, usage)
+
+	_, ok = truncatedUsage([]byte(`"text":"no usage here"}`))
+	assert.False(t, ok)
+	_, ok = truncatedUsage([]byte(`"usage":{"input_tok`))
+	assert.False(t, ok)
+}
+
+func TestErrorMessage(t *testing.T) {
+	assert.Equal(t, "short", errorMessage([]byte("short")))
+
+	msg := errorMessage([]byte(strings.Repeat("é", maxErrorMessageBytes)))
+	assert.LessOrEqual(t, len(msg), maxErrorMessageBytes+len("..."))
+	assert.True(t, strings.HasSuffix(msg, "..."))
+}
+
+// largeResponse is a JSON completion of about size bytes with its usage at
+// the end
+func largeResponse(size int) string {
+	text := strings.Repeat("x", size)
+	return fmt.Sprintf(`{"content":[{"type":"text","text":%q}],"usage":{"input_tokens":12,"output_tokens":34}}`, text)
+}
+
+func TestTrackUsageReadsLargeResponses(t *testing.T) {
+	m := newTestTrackingMiddleware()
+	m.responseCapture = 1024
+	store := &usageRecorder{}
+	m.usageLogger = firebase.NewAsyncLogger(store)
+	body := largeResponse(64 << 10)
+	handler := m.TrackUsage(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		for chunk := range slicesOf(body, 4096) {
+			_, _ = w.Write([]byte(chunk))
+		}
+	}))
+
+	req := authenticatedRequest(`{"model":"claude-3-5-haiku-20241022"}`)
+	ctx := context.WithValue(req.Context(), "service_account", true)
+	ctx = context.WithValue(ctx, "usage_store", firebase.UsageStore(store))
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req.WithContext(ctx))
+
+	assert.Equal(t, body, w.Body.String())
+	require.NoError(t, m.usageLogger.Shutdown(context.Background()))
+	require.Len(t, store.logs, 1)
+	assert.Equal(t, 12, store.logs[0].InputTokens)
+	assert.Equal(t, 34, store.logs[0].OutputTokens)
+}
+
+func TestTrackUsageTruncatesErrorMessages(t *testing.T) {
+	m := newTestTrackingMiddleware()
+	store := &usageRecorder{}
+	m.usageLogger = firebase.NewAsyncLogger(store)
+	handler := m.TrackUsage(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+		_, _ = w.Write([]byte(strings.Repeat("<html>", 10000)))
+	}))
+
+	req := authenticatedRequest(`{"model":"claude-3-5-haiku-20241022"}`)
+	ctx := context.WithValue(req.Context(), "service_account", true)
+	ctx = context.WithValue(ctx, "usage_store", firebase.UsageStore(store))
+	handler.ServeHTTP(httptest.NewRecorder(), req.WithContext(ctx))
+
+	require.NoError(t, m.usageLogger.Shutdown(context.Background()))
+	require.Len(t, store.logs, 1)
+	assert.LessOrEqual(t, len(store.logs[0].ErrorMessage), maxErrorMessageBytes+len("..."))
+}
+
+func TestHasUsageContentType(t *testing.T) {
+	for _, ct := range []string{"", "application/json", "application/json; charset=utf-8", "application/problem+json", "text/event-stream"} {
+		assert.True(t, hasUsageContentType(ct), ct)
+	}
+	for _, ct := range []string{"text/html; charset=utf-8", "application/octet-stream", "image/png", "not a type;;"} {
+		assert.False(t, hasUsageContentType(ct), ct)
+	}
+}
+
+func TestTrackUsageOpaqueResponses(t *testing.T) {
+	serve := func(m *UsageMiddleware, status int, contentType, body string) firebase.UsageLog {
+		store := &usageRecorder{}
+		m.usageLogger = firebase.NewAsyncLogger(store)
+		handler := m.TrackUsage(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", contentType)
+			w.WriteHeader(status)
+			_, _ = w.Write([]byte(body))
+		}))
+		req := authenticatedRequest(`{"model":"claude-3-5-haiku-20241022"}`)
+		ctx := context.WithValue(req.Context(), "service_account", true)
+		ctx = context.WithValue(ctx, "usage_store", firebase.UsageStore(store))
+		handler.ServeHTTP(httptest.NewRecorder(), req.WithContext(ctx))
+		require.NoError(t, m.usageLogger.Shutdown(context.Background()))
+		require.Len(t, store.logs, 1)
+		return store.logs[0]
+	}
+
+	t.Run("error page isn't stored", func(t *testing.T) {
+		log := serve(newTestTrackingMiddleware(), http.StatusBadGateway, "text/html", "<html>secret</html>")
+		assert.NotContains(t, log.ErrorMessage, "secret")
+		assert.Equal(t, "502 Bad Gateway (text/html, 19 bytes)", log.ErrorMessage)
+		assert.Equal(t, "text/html", log.ContentType)
+		assert.Equal(t, int64(19), log.ResponseBytes)
+	})
+
+	t.Run("binary body isn't read", func(t *testing.T) {
+		m := newTestTrackingMiddleware()
+		log := serve(m, http.StatusOK, "application/octet-stream", `{"usage":{"input_tokens":9}}`)
+		assert.True(t, log.Success)
+		assert.Zero(t, log.InputTokens)
+		assert.False(t, log.TokensEstimated)
+		assert.Equal(t, "application/octet-stream", log.ContentType)
+		assert.Equal(t, int64(28), log.ResponseBytes)
+	})
+}
+
+func TestOpaqueResponseCost(t *testing.T) {
+	m := &UsageMiddleware{}
+	assert.Equal(t, firebase.CalculatePointsCost("claude-3-5-haiku-20241022", 0, 0), m.opaqueResponseCost("claude-3-5-haiku-20241022", nil))
+	m.opaqueResponseCharge = 7
+	assert.Equal(t, 7, m.opaqueResponseCost("claude-3-5-haiku-20241022", nil))
+}
+
+func TestIsMessagesRequest(t *testing.T) {
+	assert.True(t, isMessagesRequest(httptest.NewRequest(http.MethodPost, "/api/v1/anthropic_proxy/sess-1/v1/messages", nil)))
+	assert.False(t, isMessagesRequest(httptest.NewRequest(http.MethodGet, "/api/v1/anthropic_proxy/sess-1/v1/messages", nil)))
+	assert.False(t, isMessagesRequest(httptest.NewRequest(http.MethodPost, "/api/v1/uploads", nil)))
+}
+
+// slicesOf yields s in chunks of n bytes
+func slicesOf(s string, n int) func(yield func(string) bool) {
+	return func(yield func(string) bool) {
+		for len(s) > 0 {
+			chunk := s[:min(n, len(s))]
+			if !yield(chunk) {
+				return
+			}
+			s = s[len(chunk):]
+		}
+	}
+}
+
+// discardWriter is a ResponseWriter that drops the body, so benchmarks
+// measure only what the capturing writer keeps
+type discardWriter struct {
+	header http.Header
+}
+
+func (w *discardWriter) Header() http.Header         { return w.header }
+func (w *discardWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (w *discardWriter) WriteHeader(int)             {}
+
+// BenchmarkResponseWriterLargeStream writes a 50MB event stream. Usage is
+// read as it streams, so bytes allocated per op stay far below the
+// response size; compare BenchmarkResponseWriterBufferedStream, which keeps
+// the whole body as the writer used to.
+func BenchmarkResponseWriterLargeStream(b *testing.B) {
+	chunk := []byte(`data: {"type":"content_block_delta","delta":{"type":"text_delta","text":"` + strings.Repeat("x", 4000) + `"}}` + "\n\n")
+	chunks := (50 << 20) / len(chunk)
+	b.ReportAllocs()
+	b.SetBytes(int64(chunks * len(chunk)))
+	for i := 0; i < b.N; i++ {
+		w := &discardWriter{header: http.Header{"Content-Type": {"text/event-stream"}}}
+		rw := &responseWriter{ResponseWriter: w, statusCode: http.StatusOK}
+		for j := 0; j < chunks; j++ {
+			_, _ = rw.Write(chunk)
+		}
+	}
+}
+
+func BenchmarkResponseWriterBufferedStream(b *testing.B) {
+	chunk := []byte(`data: {"type":"content_block_delta","delta":{"type":"text_delta","text":"` + strings.Repeat("x", 4000) + `"}}` + "\n\n")
+	chunks := (50 << 20) / len(chunk)
+	b.ReportAllocs()
+	b.SetBytes(int64(chunks * len(chunk)))
+	for i := 0; i < b.N; i++ {
+		var body []byte
+		for j := 0; j < chunks; j++ {
+			body = append(body, chunk...)
+		}
+		_ = body
+	}
+}
+
+// BenchmarkResponseWriterLargeJSON writes a 50MB JSON response, of which
+// only the ends are kept
+func BenchmarkResponseWriterLargeJSON(b *testing.B) {
+	body := []byte(largeResponse(50 << 20))
+	b.ReportAllocs()
+	b.SetBytes(int64(len(body)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		w := &discardWriter{header: http.Header{"Content-Type": {"application/json"}}}
+		rw := &responseWriter{ResponseWriter: w, statusCode: http.StatusOK}
+		for rest := body; len(rest) > 0; {
+			n := min(32<<10, len(rest))
+			_, _ = rw.Write(rest[:n])
+			rest = rest[n:]
+		}
+		if _, ok := truncatedUsage(rw.capture.tail); !ok {
+			b.Fatal("usage not found")
+		}
+	}
+}
@@ -0,0 +1,347 @@
+package middleware
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"mime"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/andybalholm/brotli"
+)
+
+// maxLoggedBodySnippet caps how much of an unparseable response is logged
+const maxLoggedBodySnippet = 256
+
+// maxDecodedBodySize caps how large a compressed response may expand when
+// decoded to read its usage
+const maxDecodedBodySize = 64 << 20
+
+// headerResponseCache is set to "hit" by the proxy on responses replayed
+// from its response cache, which are logged as zero tokens and billed at
+// the cache rate
+const headerResponseCache = "X-Response-Cache"
+
+// cacheHitRateFromEnv reads RESPONSE_CACHE_HIT_RATE, the fraction of the
+// original cost charged for a cached response. It defaults to zero, making
+// cache hits free, and is capped at one.
+func cacheHitRateFromEnv() float64 {
+	rate := getEnvFloat("RESPONSE_CACHE_HIT_RATE")
+	if rate < 0 || rate > 1 {
+		logger().Warn("RESPONSE_CACHE_HIT_RATE must be between 0 and 1, clamping", "value", rate)
+		rate = min(max(rate, 0), 1)
+	}
+	return rate
+}
+
+// cacheHitCost is the charge for replaying a response that originally cost
+// points, rounded up so a non-zero rate always charges something
+func (m *UsageMiddleware) cacheHitCost(points int) int {
+	if m.cacheHitRate <= 0 {
+		return 0
+	}
+	return int(math.Ceil(float64(points) * m.cacheHitRate))
+}
+
+// tokenUsage is the token usage a response reported
+type tokenUsage struct {
+	input, output int
+	// cacheCreation and cacheRead count the prompt tokens written to and
+	// read from the prompt cache. Anthropic reports them apart from input;
+	// OpenAI's cached tokens are also counted in input.
+	cacheCreation, cacheRead int
+}
+
+// responseUsage reads the token usage of a successful response, either a
+// JSON body with a usage object, in Anthropic or OpenAI naming, or a
+// Messages API event stream. ok is false when neither yields usage.
+func responseUsage(body []byte) (usage tokenUsage, ok bool) {
+	var respBody struct {
+		Usage *responseUsageObject `json:"usage"`
+	}
+	if err := json.Unmarshal(body, &respBody); err == nil {
+		if respBody.Usage == nil {
+			return tokenUsage{}, false
+		}
+		return respBody.Usage.tokens(), true
+	}
+
+	// Streamed responses report usage in their events
+	return streamUsage(body)
+}
+
+// responseUsageObject is the usage object of a JSON response
+type responseUsageObject struct {
+	InputTokens              int `json:"input_tokens"`
+	OutputTokens             int `json:"output_tokens"`
+	CacheCreationInputTokens int `json:"cache_creation_input_tokens"`
+	CacheReadInputTokens     int `json:"cache_read_input_tokens"`
+	PromptTokens             int `json:"prompt_tokens"`
+	CompletionTokens         int `json:"completion_tokens"`
+	PromptTokensDetails      struct {
+		CachedTokens int `json:"cached_tokens"`
+	} `json:"prompt_tokens_details"`
+}
+
+// tokens returns the reported usage. OpenAI compatible responses name the
+// counts differently.
+func (u *responseUsageObject) tokens() tokenUsage {
+	usage := tokenUsage{
+		input:         u.InputTokens,
+		output:        u.OutputTokens,
+		cacheCreation: u.CacheCreationInputTokens,
+		cacheRead:     u.CacheReadInputTokens,
+	}
+	if usage.input == 0 {
+		usage.input = u.PromptTokens
+	}
+	if usage.output == 0 {
+		usage.output = u.CompletionTokens
+	}
+	if usage.cacheRead == 0 {
+		usage.cacheRead = u.PromptTokensDetails.CachedTokens
+	}
+	return usage
+}
+
+// streamUsage reads the token usage from a complete Messages API event
+// stream; see streamUsageParser
+func streamUsage(body []byte) (usage tokenUsage, ok bool) {
+	var p streamUsageParser
+	p.Write(body)
+	return p.usage()
+}
+
+// isEventStream reports whether a response of contentType is a server-sent
+// event stream
+func isEventStream(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err == nil && mediaType == "text/event-stream"
+}
+
+// isEncoded reports whether a Content-Encoding header names an encoding
+// other than identity
+func isEncoded(contentEncoding string) bool {
+	for _, encoding := range strings.Split(contentEncoding, ",") {
+		if e := strings.TrimSpace(encoding); e != "" && !strings.EqualFold(e, "identity") {
+			return true
+		}
+	}
+	return false
+}
+
+// decodeBody undoes a response's Content-Encoding, gzip or br, so usage
+// can be read from a copy of a compressed body. Encodings applied in turn,
+// such as "gzip, br", are removed in reverse order.
+func decodeBody(contentEncoding string, body []byte) ([]byte, error) {
+	encodings := strings.Split(contentEncoding, ",")
+	for i := len(encodings) - 1; i >= 0; i-- {
+		var r io.Reader
+		switch encoding := strings.ToLower(strings.TrimSpace(encodings[i])); encoding {
+		case "", "identity":
+			continue
+		case "gzip", "x-gzip":
+			zr, err := gzip.NewReader(bytes.NewReader(body))
+			if err != nil {
+				return nil, fmt.Errorf("error decoding %s: %w", encoding, err)
+			}
+			r = zr
+		case "br":
+			r = brotli.NewReader(bytes.NewReader(body))
+		default:
+			return nil, fmt.Errorf("unsupported content encoding %q", encoding)
+		}
+
+		decoded, err := io.ReadAll(io.LimitReader(r, maxDecodedBodySize+1))
+		if err != nil {
+			return nil, fmt.Errorf("error decoding %s: %w", strings.TrimSpace(encodings[i]), err)
+		}
+		if len(decoded) > maxDecodedBodySize {
+			return nil, fmt.Errorf("decoded body exceeds %d bytes", maxDecodedBodySize)
+		}
+		body = decoded
+	}
+	return body, nil
+}
+
+// streamUsageParser reads the token usage from a Messages API event stream
+// as it is written, so usage is counted even when the stream is cut short.
+// Input and cache tokens come from message_start and output tokens from the
+// last message_delta, which carries the running total.
+type streamUsageParser struct {
+	// partial is the unterminated line at the end of the last write
+	partial []byte
+
+	tokens   tokenUsage
+	sawUsage bool
+	// stopped is set by message_stop, the last event of a complete stream
+	stopped bool
+	// malformed is set when a data line couldn't be decoded
+	malformed bool
+}
+
+// Write parses the complete lines in b, keeping any trailing partial line
+// for the next call
+func (p *streamUsageParser) Write(b []byte) {
+	data := b
+	if len(p.partial) > 0 {
+		data = append(p.partial, b...)
+		p.partial = nil
+	}
+	for {
+		line, rest, found := bytes.Cut(data, []byte("\n"))
+		if !found {
+			p.partial = append(p.partial, data...)
+			return
+		}
+		p.line(line)
+		data = rest
+	}
+}
+
+// line handles one line of the stream; only data lines carry events
+func (p *streamUsageParser) line(line []byte) {
+	data, found := bytes.CutPrefix(bytes.TrimSpace(line), []byte("data:"))
+	if !found {
+		return
+	}
+	data = bytes.TrimSpace(data)
+	if len(data) == 0 {
+		return
+	}
+
+	var event struct {
+		Type    string `json:"type"`
+		Message struct {
+			Usage streamEventUsage `json:"usage"`
+		} `json:"message"`
+		Usage *streamEventUsage `json:"usage"`
+	}
+	if err := json.Unmarshal(data, &event); err != nil {
+		p.malformed = true
+		return
+	}
+	switch event.Type {
+	case "message_start":
+		p.tokens = event.Message.Usage.tokens()
+		p.sawUsage = true
+	case "message_delta":
+		if event.Usage == nil {
+			return
+		}
+		// Deltas may repeat the input and cache counts; zero means absent
+		delta := event.Usage.tokens()
+		if delta.input > 0 {
+			p.tokens.input = delta.input
+		}
+		if delta.cacheCreation > 0 {
+			p.tokens.cacheCreation = delta.cacheCreation
+		}
+		if delta.cacheRead > 0 {
+			p.tokens.cacheRead = delta.cacheRead
+		}
+		p.tokens.output = delta.output
+		p.sawUsage = true
+	case "message_stop":
+		p.stopped = true
+	}
+}
+
+// usage returns the usage seen so far, counting a final unterminated line.
+// ok is false when the stream reported no usage at all.
+func (p *streamUsageParser) usage() (usage tokenUsage, ok bool) {
+	if len(p.partial) > 0 {
+		p.line(p.partial)
+		p.partial = nil
+	}
+	return p.tokens, p.sawUsage
+}
+
+// incomplete reports whether the stream ended before message_stop or had
+// events that couldn't be decoded, so its usage may be understated. Call it
+// after usage.
+func (p *streamUsageParser) incomplete() bool {
+	return !p.stopped || p.malformed
+}
+
+// streamEventUsage is the usage object in stream events
+type streamEventUsage struct {
+	InputTokens              int `json:"input_tokens"`
+	OutputTokens             int `json:"output_tokens"`
+	CacheCreationInputTokens int `json:"cache_creation_input_tokens"`
+	CacheReadInputTokens     int `json:"cache_read_input_tokens"`
+}
+
+// tokens returns the usage the event reported
+func (u streamEventUsage) tokens() tokenUsage {
+	return tokenUsage{
+		input:         u.InputTokens,
+		output:        u.OutputTokens,
+		cacheCreation: u.CacheCreationInputTokens,
+		cacheRead:     u.CacheReadInputTokens,
+	}
+}
+
+// reportUnparsedUsage logs and counts a successful response whose token usage
+// couldn't be read, which would otherwise be billed as zero tokens
+func (m *UsageMiddleware) reportUnparsedUsage(ctx context.Context, contentType string, body []byte, userID, model string) {
+	if m.metrics != nil {
+		m.metrics.Counter("hld_usage_unparsed_total",
+			"Successful responses whose token usage could not be read").Inc()
+	}
+	requestLogger(ctx).Warn("could not read token usage from response",
+		"user_id", userID,
+		"model", model,
+		"content_type", contentType,
+		"body_bytes", len(body),
+		"body", bodySnippet(contentType, body),
+		"fallback_charge", m.unparsedUsageCharge,
+		"estimating", m.usageEstimator != nil)
+}
+
+// bodySnippet returns the start of a response body for logging. Binary
+// bodies are summarized rather than logged.
+func bodySnippet(contentType string, body []byte) string {
+	if len(body) == 0 {
+		return ""
+	}
+	if !isTextContentType(contentType) || !utf8.Valid(body) {
+		return fmt.Sprintf("<%d bytes of binary data>", len(body))
+	}
+	if len(body) <= maxLoggedBodySnippet {
+		return string(body)
+	}
+
+	// Cut on a rune boundary
+	cut := maxLoggedBodySnippet
+	for cut > 0 && !utf8.RuneStart(body[cut]) {
+		cut--
+	}
+	return string(body[:cut]) + "..."
+}
+
+// isTextContentType reports whether a response of contentType is safe to
+// log as text. A missing content type is treated as text and left to the
+// UTF-8 check.
+func isTextContentType(contentType string) bool {
+	if contentType == "" {
+		return true
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	if strings.HasPrefix(mediaType, "text/") {
+		return true
+	}
+	switch mediaType {
+	case "application/json", "application/xml", "application/javascript", "application/problem+json":
+		return true
+	}
+	return strings.HasSuffix(mediaType, "+json") || strings.HasSuffix(mediaType, "+xml")
+}
@@ -0,0 +1,282 @@
+package middleware
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"your-project/hld/firebase"
+)
+
+func TestResponseUsage(t *testing.T) {
+	usage, ok := responseUsage([]byte(`{"usage":{"input_tokens":12,"output_tokens":34}}`))
+	assert.True(t, ok)
+	assert.Equal(t, tokenUsage{input: 12, output: 34}, usage)
+
+	usage, ok = responseUsage([]byte(`{"usage":{"prompt_tokens":5,"completion_tokens":6}}`))
+	assert.True(t, ok)
+	assert.Equal(t, tokenUsage{input: 5, output: 6}, usage)
+
+	// Prompt cache tokens are counted apart
+	usage, ok = responseUsage([]byte(`{"usage":{"input_tokens":3,"cache_creation_input_tokens":2048,"cache_read_input_tokens":1024,"output_tokens":34}}`))
+	assert.True(t, ok)
+	assert.Equal(t, tokenUsage{input: 3, output: 34, cacheCreation: 2048, cacheRead: 1024}, usage)
+	usage, ok = responseUsage([]byte(`{"usage":{"prompt_tokens":2000,"completion_tokens":6,"prompt_tokens_details":{"cached_tokens":1536}}}`))
+	assert.True(t, ok)
+	assert.Equal(t, tokenUsage{input: 2000, output: 6, cacheRead: 1536}, usage)
+
+	// JSON without usage, and bodies that are neither JSON nor a stream
+	_, ok = responseUsage([]byte(`{"id":"msg_1"}`))
+	assert.False(t, ok)
+	_, ok = responseUsage([]byte("<html><body>Bad Gateway</body></html>"))
+	assert.False(t, ok)
+	_, ok = responseUsage(nil)
+	assert.False(t, ok)
+}
+
+func TestBodySnippet(t *testing.T) {
+	assert.Equal(t, "<html>oops</html>", bodySnippet("text/html; charset=utf-8", []byte("<html>oops</html>")))
+
+	long := strings.Repeat("é", maxLoggedBodySnippet)
+	snippet := bodySnippet("text/plain", []byte(long))
+	assert.True(t, strings.HasSuffix(snippet, "..."))
+	assert.LessOrEqual(t, len(snippet), maxLoggedBodySnippet+3)
+	assert.True(t, strings.HasPrefix(long, strings.TrimSuffix(snippet, "...")))
+
+	// Binary bodies are never logged
+	assert.Equal(t, "<4 bytes of binary data>", bodySnippet("image/png", []byte{0x89, 'P', 'N', 'G'}))
+	assert.Equal(t, "<2 bytes of binary data>", bodySnippet("", []byte{0xff, 0xfe}))
+}
+
+func TestReportUnparsedUsageCounts(t *testing.T) {
+	m := newTestTrackingMiddleware()
+	m.reportUnparsedUsage(context.Background(), "text/html", []byte("<html></html>"), "user-1", "claude-3-5-haiku-20241022")
+	m.reportUnparsedUsage(context.Background(), "text/html", []byte("<html></html>"), "user-1", "claude-3-5-haiku-20241022")
+
+	assert.EqualValues(t, 2, m.metrics.Counter("hld_usage_unparsed_total", "").Value())
+}
+
+// testStream is a complete Messages API event stream
+const testStream = "event: message_start\n" +
+	`data: {"type":"message_start","message":{"id":"msg_1","usage":{"input_tokens":25,"output_tokens":1}}}` + "\n\n" +
+	"event: content_block_delta\n" +
+	`data: {"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"Hi"}}` + "\n\n" +
+	"event: message_delta\n" +
+	`data: {"type":"message_delta","delta":{"stop_reason":"end_turn"},"usage":{"output_tokens":15}}` + "\n\n" +
+	"event: message_stop\n" +
+	`data: {"type":"message_stop"}` + "\n\n"
+
+func TestStreamUsageParserAcrossChunks(t *testing.T) {
+	// Split the stream mid-line at every few bytes
+	var p streamUsageParser
+	for rest := testStream; rest != ""; {
+		n := min(7, len(rest))
+		p.Write([]byte(rest[:n]))
+		rest = rest[n:]
+	}
+
+	usage, ok := p.usage()
+	require.True(t, ok)
+	assert.Equal(t, tokenUsage{input: 25, output: 15}, usage)
+	assert.False(t, p.incomplete())
+}
+
+func TestStreamUsageParserTruncated(t *testing.T) {
+	// Cut off before the final message_delta: only message_start counts
+	cut := strings.Index(testStream, "event: message_delta")
+	var p streamUsageParser
+	p.Write([]byte(testStream[:cut]))
+
+	usage, ok := p.usage()
+	require.True(t, ok)
+	assert.Equal(t, tokenUsage{input: 25, output: 1}, usage)
+	assert.True(t, p.incomplete())
+
+	// Nothing usable at all
+	var empty streamUsageParser
+	empty.Write([]byte("event: ping\ndata: {\"type\":\"ping\"}\n\n"))
+	_, ok = empty.usage()
+	assert.False(t, ok)
+	assert.True(t, empty.incomplete())
+}
+
+func TestStreamUsageParserMalformed(t *testing.T) {
+	stream := strings.Replace(testStream, `"type":"content_block_delta",`, `"type":`, 1)
+	var p streamUsageParser
+	p.Write([]byte(stream))
+
+	usage, ok := p.usage()
+	require.True(t, ok)
+	assert.Equal(t, tokenUsage{input: 25, output: 15}, usage)
+	assert.True(t, p.incomplete())
+}
+
+func TestResponseWriterDetectsEventStream(t *testing.T) {
+	rec := httptest.NewRecorder()
+	rw := &responseWriter{ResponseWriter: rec, statusCode: http.StatusOK}
+	rw.Header().Set("Content-Type", "text/event-stream; charset=utf-8")
+	rw.WriteHeader(http.StatusOK)
+	_, _ = rw.Write([]byte(testStream))
+
+	require.NotNil(t, rw.stream)
+	usage, ok := rw.stream.usage()
+	require.True(t, ok)
+	assert.Equal(t, tokenUsage{input: 25, output: 15}, usage)
+	assert.Equal(t, testStream, rec.Body.String())
+
+	rw = &responseWriter{ResponseWriter: httptest.NewRecorder(), statusCode: http.StatusOK}
+	rw.Header().Set("Content-Type", "application/json")
+	_, _ = rw.Write([]byte(`{"usage":{"input_tokens":1,"output_tokens":2}}`))
+	assert.Nil(t, rw.stream)
+}
+
+func gzipped(t *testing.T, b []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	_, err := zw.Write(b)
+	require.NoError(t, err)
+	require.NoError(t, zw.Close())
+	return buf.Bytes()
+}
+
+func brotlied(t *testing.T, b []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	bw := brotli.NewWriter(&buf)
+	_, err := bw.Write(b)
+	require.NoError(t, err)
+	require.NoError(t, bw.Close())
+	return buf.Bytes()
+}
+
+func TestDecodeBody(t *testing.T) {
+	plain := []byte(`{"usage":{"input_tokens":12,"output_tokens":34}}`)
+
+	for _, tc := range []struct {
+		encoding string
+		body     []byte
+	}{
+		{"", plain},
+		{"identity", plain},
+		{"gzip", gzipped(t, plain)},
+		{"x-gzip", gzipped(t, plain)},
+		{"br", brotlied(t, plain)},
+		{"gzip, br", brotlied(t, gzipped(t, plain))},
+	} {
+		decoded, err := decodeBody(tc.encoding, tc.body)
+		require.NoError(t, err, tc.encoding)
+		assert.Equal(t, plain, decoded, tc.encoding)
+	}
+
+	_, err := decodeBody("gzip", plain)
+	assert.Error(t, err)
+	_, err = decodeBody("zstd", plain)
+	assert.ErrorContains(t, err, "unsupported content encoding")
+
+	assert.True(t, isEncoded("gzip"))
+	assert.False(t, isEncoded(""))
+	assert.False(t, isEncoded("identity"))
+}
+
+func TestTrackUsageReadsCompressedResponses(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		encoding string
+		body     []byte
+	}{
+		{"gzip", "gzip", gzipped(t, []byte(`{"usage":{"input_tokens":12,"output_tokens":34}}`))},
+		{"br", "br", brotlied(t, []byte(`{"usage":{"input_tokens":12,"output_tokens":34}}`))},
+		{"gzip stream", "gzip", gzipped(t, []byte(testStream))},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m := newTestTrackingMiddleware()
+			store := &usageRecorder{}
+			m.usageLogger = firebase.NewAsyncLogger(store)
+			contentType := "application/json"
+			if strings.Contains(tc.name, "stream") {
+				contentType = "text/event-stream"
+			}
+			handler := m.TrackUsage(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", contentType)
+				w.Header().Set("Content-Encoding", tc.encoding)
+				_, _ = w.Write(tc.body)
+			}))
+
+			req := authenticatedRequest(`{"model":"claude-3-5-haiku-20241022"}`)
+			ctx := context.WithValue(req.Context(), "service_account", true)
+			ctx = context.WithValue(ctx, "usage_store", firebase.UsageStore(store))
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req.WithContext(ctx))
+
+			// The client gets the compressed bytes untouched
+			assert.Equal(t, tc.body, w.Body.Bytes())
+			require.NoError(t, m.usageLogger.Shutdown(context.Background()))
+			require.Len(t, store.logs, 1)
+			assert.Positive(t, store.logs[0].InputTokens)
+			assert.Positive(t, store.logs[0].OutputTokens)
+			assert.False(t, store.logs[0].StreamIncomplete)
+		})
+	}
+}
+
+func TestStreamUsageParserCacheTokens(t *testing.T) {
+	stream := strings.Replace(testStream, `"usage":{"input_tokens":25,"output_tokens":1}`,
+		`"usage":{"input_tokens":25,"cache_creation_input_tokens":1500,"cache_read_input_tokens":0,"output_tokens":1}`, 1)
+	var p streamUsageParser
+	p.Write([]byte(stream))
+
+	usage, ok := p.usage()
+	require.True(t, ok)
+	assert.Equal(t, tokenUsage{input: 25, output: 15, cacheCreation: 1500}, usage)
+}
+
+func TestTrackUsageLogsCacheTokens(t *testing.T) {
+	m := newTestTrackingMiddleware()
+	store := &usageRecorder{}
+	m.usageLogger = firebase.NewAsyncLogger(store)
+	handler := m.TrackUsage(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"usage":{"input_tokens":12,"cache_creation_input_tokens":100,"cache_read_input_tokens":2000,"output_tokens":34}}`))
+	}))
+
+	req := authenticatedRequest(`{"model":"claude-3-5-haiku-20241022"}`)
+	ctx := context.WithValue(req.Context(), "service_account", true)
+	ctx = context.WithValue(ctx, "usage_store", firebase.UsageStore(store))
+	handler.ServeHTTP(httptest.NewRecorder(), req.WithContext(ctx))
+
+	require.NoError(t, m.usageLogger.Shutdown(context.Background()))
+	require.Len(t, store.logs, 1)
+	assert.Equal(t, 12, store.logs[0].InputTokens)
+	assert.Equal(t, 100, store.logs[0].CacheCreationTokens)
+	assert.Equal(t, 2000, store.logs[0].CacheReadTokens)
+}
+
+func TestTrackUsageEstimatesUndecodableResponses(t *testing.T) {
+	m := newTestTrackingMiddleware()
+	m.usageEstimator = &usageEstimator{defaultRatio: 1}
+	store := &usageRecorder{}
+	m.usageLogger = firebase.NewAsyncLogger(store)
+	handler := m.TrackUsage(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Encoding", "gzip")
+		_, _ = w.Write([]byte("not actually gzip"))
+	}))
+
+	req := authenticatedRequest(`{"model":"claude-3-5-haiku-20241022"}`)
+	ctx := context.WithValue(req.Context(), "service_account", true)
+	ctx = context.WithValue(ctx, "usage_store", firebase.UsageStore(store))
+	handler.ServeHTTP(httptest.NewRecorder(), req.WithContext(ctx))
+
+	require.NoError(t, m.usageLogger.Shutdown(context.Background()))
+	require.Len(t, store.logs, 1)
+	assert.True(t, store.logs[0].TokensEstimated)
+	assert.Equal(t, len("not actually gzip"), store.logs[0].OutputTokens)
+}
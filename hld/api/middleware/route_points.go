@@ -0,0 +1,140 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// EstimatedPoints as a route threshold requires the request's estimated
+// worst-case cost, from its model and max_tokens, instead of a fixed amount
+const EstimatedPoints = -1
+
+// routePattern is an exact path or, written with a trailing "/*", a path
+// prefix
+type routePattern struct {
+	path   string
+	prefix bool
+}
+
+// parseRoutePattern parses an exact path or a prefix ending in "/*"
+func parseRoutePattern(pattern string) routePattern {
+	if p, ok := strings.CutSuffix(pattern, "/*"); ok {
+		return routePattern{path: normalizePath(p), prefix: true}
+	}
+	return routePattern{path: normalizePath(pattern)}
+}
+
+// specificity reports how closely p matches a normalized path: exact paths
+// beat prefixes and longer prefixes beat shorter ones. It is negative when p
+// doesn't match.
+func (p routePattern) specificity(path string) int {
+	if !p.prefix {
+		if p.path == path {
+			return math.MaxInt
+		}
+		return -1
+	}
+	if p.path == "/" || path == p.path || strings.HasPrefix(path, p.path+"/") {
+		return len(p.path)
+	}
+	return -1
+}
+
+// routeThreshold is a minimum balance for an exact path or a path prefix
+type routeThreshold struct {
+	routePattern
+	points int
+}
+
+// SetRouteMinPoints requires a minimum balance for requests to pattern, an
+// exact path or a prefix ending in "/*". points may be EstimatedPoints. When
+// several patterns match, the most specific wins. Must be called before the
+// middleware starts serving requests.
+func (m *UsageMiddleware) SetRouteMinPoints(pattern string, points int) {
+	m.routePoints = append(m.routePoints, routeThreshold{routePattern: parseRoutePattern(pattern), points: points})
+}
+
+// routePointsFromEnv parses ROUTE_MIN_POINTS, a comma separated list of
+// pattern=points pairs where points is a number or "estimate", e.g.
+// "/api/v1/anthropic_proxy/*=estimate,/api/v1/sessions=1"
+func (m *UsageMiddleware) routePointsFromEnv() error {
+	for _, item := range splitList(os.Getenv("ROUTE_MIN_POINTS")) {
+		pattern, raw, ok := strings.Cut(item, "=")
+		if !ok {
+			return fmt.Errorf("invalid ROUTE_MIN_POINTS entry %q: expected pattern=points", item)
+		}
+
+		points := EstimatedPoints
+		if raw = strings.TrimSpace(raw); raw != "estimate" {
+			n, err := strconv.Atoi(raw)
+			if err != nil || n < 0 {
+				return fmt.Errorf("invalid ROUTE_MIN_POINTS entry %q: points must be a non-negative integer or estimate", item)
+			}
+			points = n
+		}
+		m.SetRouteMinPoints(strings.TrimSpace(pattern), points)
+	}
+	return nil
+}
+
+// routeMinPoints returns the threshold of the most specific pattern matching
+// path. Exact paths beat prefixes, and longer prefixes beat shorter ones.
+func (m *UsageMiddleware) routeMinPoints(path string) (int, bool) {
+	path = normalizePath(path)
+
+	best, bestLen, found := 0, -1, false
+	for _, t := range m.routePoints {
+		if n := t.specificity(path); n > bestLen {
+			best, bestLen, found = t.points, n, true
+		}
+	}
+	return best, found
+}
+
+// RequirePoints raises the minimum balance CheckAuth requires for the wrapped
+// route to n. Wrap it around CheckAuth:
+//
+//	mux.Handle("/api/v1/expensive", RequirePoints(50)(m.CheckAuth(handler)))
+func RequirePoints(n int) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := context.WithValue(r.Context(), "required_points", n)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// requestRouteMinPoints returns the threshold for r, preferring one set for
+// the gin route pattern it matched over one for its URL path
+func (m *UsageMiddleware) requestRouteMinPoints(r *http.Request) (int, bool) {
+	if route := matchedRoute(r); route != "" {
+		if n, ok := m.routeMinPoints(route); ok {
+			return n, true
+		}
+	}
+	return m.routeMinPoints(r.URL.Path)
+}
+
+// requiredPoints returns the balance needed for r: the largest of the global
+// minimum, a RequirePoints wrapper and the route's threshold. estimate is the
+// request's estimated cost, used for EstimatedPoints thresholds.
+func (m *UsageMiddleware) requiredPoints(r *http.Request, estimate int) int {
+	required := minRequiredPoints
+	if n, ok := r.Context().Value("required_points").(int); ok && n > required {
+		required = n
+	}
+	if n, ok := m.requestRouteMinPoints(r); ok {
+		if n == EstimatedPoints {
+			n = estimate
+		}
+		if n > required {
+			required = n
+		}
+	}
+	return required
+}
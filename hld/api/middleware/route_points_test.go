@@ -0,0 +1,53 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRequiredPoints(t *testing.T) {
+	m := &UsageMiddleware{}
+	m.SetRouteMinPoints("/api/v1/anthropic_proxy/*", EstimatedPoints)
+	m.SetRouteMinPoints("/api/v1/anthropic_proxy/cheap/*", 5)
+	m.SetRouteMinPoints("/api/v1/sessions", 2)
+
+	required := func(path string, estimate int) int {
+		return m.requiredPoints(httptest.NewRequest(http.MethodPost, path, nil), estimate)
+	}
+
+	assert.Equal(t, minRequiredPoints, required("/api/v1/health", 80))
+	assert.Equal(t, 2, required("/api/v1/sessions/", 80))
+	assert.Equal(t, 80, required("/api/v1/anthropic_proxy/sess-1/v1/messages", 80))
+	// The longest matching prefix wins
+	assert.Equal(t, 5, required("/api/v1/anthropic_proxy/cheap/count", 80))
+	// Thresholds never go below the global minimum
+	assert.Equal(t, minRequiredPoints, required("/api/v1/anthropic_proxy/sess-1", 0))
+
+	// RequirePoints raises the threshold for the wrapped route
+	var got int
+	handler := RequirePoints(30)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = m.requiredPoints(r, 0)
+	}))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/api/v1/sessions", nil))
+	assert.Equal(t, 30, got)
+}
+
+func TestRoutePointsFromEnv(t *testing.T) {
+	t.Setenv("ROUTE_MIN_POINTS", "/api/v1/anthropic_proxy/*=estimate, /api/v1/sessions=3")
+	m := &UsageMiddleware{}
+	require.NoError(t, m.routePointsFromEnv())
+
+	n, ok := m.routeMinPoints("/api/v1/anthropic_proxy/x")
+	assert.True(t, ok)
+	assert.Equal(t, EstimatedPoints, n)
+	n, ok = m.routeMinPoints("/api/v1/sessions")
+	assert.True(t, ok)
+	assert.Equal(t, 3, n)
+
+	t.Setenv("ROUTE_MIN_POINTS", "/api/v1/sessions=lots")
+	assert.Error(t, (&UsageMiddleware{}).routePointsFromEnv())
+}
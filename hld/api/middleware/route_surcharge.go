@@ -0,0 +1,133 @@
+package middleware
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// headerPointsBreakdown reports how a billed request's cost was made up, as
+// "base=<points>, surcharge=<points>". It is sent as a trailer, since the
+// cost is only known once the response has been read.
+const headerPointsBreakdown = "X-Points-Breakdown"
+
+// Surcharge modes
+const (
+	// SurchargeAdditive adds a fixed number of points to the token cost
+	SurchargeAdditive = "add"
+	// SurchargeMultiplicative scales the token cost, rounding up
+	SurchargeMultiplicative = "multiply"
+)
+
+// routeSurcharge is an extra charge for an exact path or a path prefix
+type routeSurcharge struct {
+	routePattern
+	mode  string
+	value float64
+}
+
+// apply returns the surcharge on a request whose token cost is base
+func (s routeSurcharge) apply(base int) int {
+	if s.mode == SurchargeAdditive {
+		return int(s.value)
+	}
+	return int(math.Ceil(float64(base)*s.value)) - base
+}
+
+// SetRouteSurcharge charges requests to pattern, an exact path or a prefix
+// ending in "/*", on top of their token cost. In SurchargeAdditive mode
+// value is a number of points; in SurchargeMultiplicative mode it is a
+// factor of at least 1 applied to the token cost. When several patterns
+// match, the most specific wins. Must be called before the middleware starts
+// serving requests.
+func (m *UsageMiddleware) SetRouteSurcharge(pattern, mode string, value float64) error {
+	switch {
+	case mode == SurchargeAdditive && (value < 0 || value != math.Trunc(value)):
+		return fmt.Errorf("additive surcharge for %s must be a non-negative integer", pattern)
+	case mode == SurchargeMultiplicative && value < 1:
+		return fmt.Errorf("multiplicative surcharge for %s must be at least 1", pattern)
+	case mode != SurchargeAdditive && mode != SurchargeMultiplicative:
+		return fmt.Errorf("unknown surcharge mode %q", mode)
+	}
+	m.routeSurcharges = append(m.routeSurcharges, routeSurcharge{
+		routePattern: parseRoutePattern(pattern),
+		mode:         mode,
+		value:        value,
+	})
+	return nil
+}
+
+// routeSurchargesFromEnv parses ROUTE_SURCHARGES, a comma separated list of
+// pattern=+points or pattern=xfactor pairs, e.g.
+// "/api/v1/images/*=+50,/api/v1/anthropic_proxy/long/*=x1.5"
+func (m *UsageMiddleware) routeSurchargesFromEnv() error {
+	for _, item := range splitList(os.Getenv("ROUTE_SURCHARGES")) {
+		pattern, raw, ok := strings.Cut(item, "=")
+		if !ok {
+			return fmt.Errorf("invalid ROUTE_SURCHARGES entry %q: expected pattern=+points or pattern=xfactor", item)
+		}
+
+		raw = strings.TrimSpace(raw)
+		mode := SurchargeAdditive
+		if factor, ok := strings.CutPrefix(raw, "x"); ok {
+			mode, raw = SurchargeMultiplicative, factor
+		} else {
+			raw = strings.TrimPrefix(raw, "+")
+		}
+		value, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return fmt.Errorf("invalid ROUTE_SURCHARGES entry %q: %w", item, err)
+		}
+		if err := m.SetRouteSurcharge(strings.TrimSpace(pattern), mode, value); err != nil {
+			return fmt.Errorf("invalid ROUTE_SURCHARGES entry %q: %w", item, err)
+		}
+	}
+	return nil
+}
+
+// routeSurcharge returns the surcharge on a request to path whose token cost
+// is base, from the most specific matching pattern
+func (m *UsageMiddleware) routeSurcharge(path string, base int) int {
+	if s := m.matchSurcharge(path); s != nil {
+		return s.apply(base)
+	}
+	return 0
+}
+
+// requestSurcharge returns the surcharge on r given its token cost base,
+// preferring one set for the gin route pattern it matched over one for its
+// URL path
+func (m *UsageMiddleware) requestSurcharge(r *http.Request, base int) int {
+	if route := matchedRoute(r); route != "" {
+		if s := m.matchSurcharge(route); s != nil {
+			return s.apply(base)
+		}
+	}
+	return m.routeSurcharge(r.URL.Path, base)
+}
+
+// matchSurcharge returns the most specific surcharge matching path, or nil
+func (m *UsageMiddleware) matchSurcharge(path string) *routeSurcharge {
+	path = normalizePath(path)
+
+	var best *routeSurcharge
+	bestLen := -1
+	for i, s := range m.routeSurcharges {
+		if n := s.specificity(path); n > bestLen {
+			best, bestLen = &m.routeSurcharges[i], n
+		}
+	}
+	return best
+}
+
+// setPointsBreakdownTrailer reports a billed request's cost breakdown when
+// POINTS_BREAKDOWN_HEADER is enabled
+func (m *UsageMiddleware) setPointsBreakdownTrailer(w http.ResponseWriter, base, surcharge int) {
+	if !m.pointsBreakdownHeader {
+		return
+	}
+	w.Header().Set(http.TrailerPrefix+headerPointsBreakdown, fmt.Sprintf("base=%d, surcharge=%d", base, surcharge))
+}
@@ -0,0 +1,59 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRouteSurchargeAdditive(t *testing.T) {
+	m := &UsageMiddleware{}
+	require.NoError(t, m.SetRouteSurcharge("/api/v1/images/*", SurchargeAdditive, 50))
+
+	assert.Equal(t, 50, m.routeSurcharge("/api/v1/images/generate", 12))
+	assert.Equal(t, 50, m.routeSurcharge("/api/v1/images", 0))
+	assert.Zero(t, m.routeSurcharge("/api/v1/sessions", 12))
+}
+
+func TestRouteSurchargeMultiplicative(t *testing.T) {
+	m := &UsageMiddleware{}
+	require.NoError(t, m.SetRouteSurcharge("/api/v1/anthropic_proxy/*", SurchargeMultiplicative, 1.5))
+	require.NoError(t, m.SetRouteSurcharge("/api/v1/anthropic_proxy/cheap/*", SurchargeMultiplicative, 1))
+
+	// Rounded up on the total
+	assert.Equal(t, 6, m.routeSurcharge("/api/v1/anthropic_proxy/sess-1/v1/messages", 11))
+	// The most specific pattern wins
+	assert.Zero(t, m.routeSurcharge("/api/v1/anthropic_proxy/cheap/count", 11))
+}
+
+func TestSetRouteSurchargeValidates(t *testing.T) {
+	m := &UsageMiddleware{}
+	assert.Error(t, m.SetRouteSurcharge("/a", SurchargeAdditive, -1))
+	assert.Error(t, m.SetRouteSurcharge("/a", SurchargeAdditive, 1.5))
+	assert.Error(t, m.SetRouteSurcharge("/a", SurchargeMultiplicative, 0.5))
+	assert.Error(t, m.SetRouteSurcharge("/a", "percent", 10))
+	assert.Empty(t, m.routeSurcharges)
+}
+
+func TestRouteSurchargesFromEnv(t *testing.T) {
+	t.Setenv("ROUTE_SURCHARGES", "/api/v1/images/*=+50, /api/v1/long=x2")
+	m := &UsageMiddleware{}
+	require.NoError(t, m.routeSurchargesFromEnv())
+	assert.Equal(t, 50, m.routeSurcharge("/api/v1/images/x", 10))
+	assert.Equal(t, 10, m.routeSurcharge("/api/v1/long", 10))
+
+	t.Setenv("ROUTE_SURCHARGES", "/api/v1/images=fifty")
+	assert.Error(t, (&UsageMiddleware{}).routeSurchargesFromEnv())
+}
+
+func TestPointsBreakdownTrailer(t *testing.T) {
+	w := httptest.NewRecorder()
+	(&UsageMiddleware{}).setPointsBreakdownTrailer(w, 10, 5)
+	assert.Empty(t, w.Header().Get(http.TrailerPrefix+headerPointsBreakdown))
+
+	(&UsageMiddleware{pointsBreakdownHeader: true}).setPointsBreakdownTrailer(w, 10, 5)
+	assert.Equal(t, "base=10, surcharge=5", w.Header().Get(http.TrailerPrefix+headerPointsBreakdown))
+}
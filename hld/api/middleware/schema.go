@@ -0,0 +1,288 @@
+package middleware
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	"your-project/hld/internal/apierror"
+)
+
+// defaultMessagesSchema describes the Anthropic Messages request fields the
+// upstream rejects when missing or mistyped
+const defaultMessagesSchema = `{
+	"type": "object",
+	"required": ["model", "messages", "max_tokens"],
+	"properties": {
+		"model": {"type": "string", "minLength": 1},
+		"max_tokens": {"type": "integer", "minimum": 1},
+		"messages": {
+			"type": "array",
+			"minItems": 1,
+			"items": {
+				"type": "object",
+				"required": ["role", "content"],
+				"properties": {
+					"role": {"type": "string", "enum": ["user", "assistant"]},
+					"content": {"type": ["string", "array"]}
+				}
+			}
+		},
+		"system": {"type": ["string", "array"]},
+		"stream": {"type": "boolean"},
+		"temperature": {"type": "number", "minimum": 0, "maximum": 1},
+		"stop_sequences": {"type": "array", "items": {"type": "string"}}
+	}
+}`
+
+// maxSchemaErrors caps the validation errors returned to the client
+const maxSchemaErrors = 10
+
+// JSONSchema is the subset of JSON Schema used to validate request bodies:
+// type, enum, required, properties, additionalProperties (boolean only),
+// items, minItems, maxItems, minLength, maxLength, minimum and maximum.
+// Other keywords are ignored.
+type JSONSchema struct {
+	Type                 schemaTypes            `json:"type,omitempty"`
+	Enum                 []interface{}          `json:"enum,omitempty"`
+	Required             []string               `json:"required,omitempty"`
+	Properties           map[string]*JSONSchema `json:"properties,omitempty"`
+	AdditionalProperties *bool                  `json:"additionalProperties,omitempty"`
+	Items                *JSONSchema            `json:"items,omitempty"`
+	MinItems             *int                   `json:"minItems,omitempty"`
+	MaxItems             *int                   `json:"maxItems,omitempty"`
+	MinLength            *int                   `json:"minLength,omitempty"`
+	MaxLength            *int                   `json:"maxLength,omitempty"`
+	Minimum              *float64               `json:"minimum,omitempty"`
+	Maximum              *float64               `json:"maximum,omitempty"`
+}
+
+// schemaTypes accepts "type" as a single name or a list of names
+type schemaTypes []string
+
+func (t *schemaTypes) UnmarshalJSON(data []byte) error {
+	var one string
+	if err := json.Unmarshal(data, &one); err == nil {
+		*t = schemaTypes{one}
+		return nil
+	}
+	var many []string
+	if err := json.Unmarshal(data, &many); err != nil {
+		return fmt.Errorf("type must be a string or list of strings")
+	}
+	*t = many
+	return nil
+}
+
+// ParseJSONSchema parses a schema document
+func ParseJSONSchema(data []byte) (*JSONSchema, error) {
+	var schema JSONSchema
+	if err := json.Unmarshal(data, &schema); err != nil {
+		return nil, fmt.Errorf("invalid JSON schema: %w", err)
+	}
+	return &schema, nil
+}
+
+// Validate checks a decoded JSON value against the schema and returns one
+// message per violation, each prefixed with the path of the offending field
+func (s *JSONSchema) Validate(value interface{}) []string {
+	var errs []string
+	s.validate("$", value, &errs)
+	return errs
+}
+
+func (s *JSONSchema) validate(path string, value interface{}, errs *[]string) {
+	if len(*errs) >= maxSchemaErrors {
+		return
+	}
+	fail := func(format string, args ...interface{}) {
+		*errs = append(*errs, path+": "+fmt.Sprintf(format, args...))
+	}
+
+	if len(s.Type) > 0 && !s.Type.matches(value) {
+		fail("must be %s", strings.Join(s.Type, " or "))
+		return
+	}
+	if len(s.Enum) > 0 && !schemaEnumContains(s.Enum, value) {
+		fail("must be one of %v", s.Enum)
+	}
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for _, name := range s.Required {
+			if _, ok := v[name]; !ok {
+				fail("missing required field %q", name)
+			}
+		}
+		names := make([]string, 0, len(v))
+		for name := range v {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if prop, ok := s.Properties[name]; ok {
+				prop.validate(path+"."+name, v[name], errs)
+			} else if s.AdditionalProperties != nil && !*s.AdditionalProperties {
+				fail("unknown field %q", name)
+			}
+		}
+	case []interface{}:
+		if s.MinItems != nil && len(v) < *s.MinItems {
+			fail("must have at least %d items", *s.MinItems)
+		}
+		if s.MaxItems != nil && len(v) > *s.MaxItems {
+			fail("must have at most %d items", *s.MaxItems)
+		}
+		if s.Items != nil {
+			for i, item := range v {
+				s.Items.validate(fmt.Sprintf("%s[%d]", path, i), item, errs)
+			}
+		}
+	case string:
+		n := len([]rune(v))
+		if s.MinLength != nil && n < *s.MinLength {
+			fail("must be at least %d characters", *s.MinLength)
+		}
+		if s.MaxLength != nil && n > *s.MaxLength {
+			fail("must be at most %d characters", *s.MaxLength)
+		}
+	case float64:
+		if s.Minimum != nil && v < *s.Minimum {
+			fail("must be at least %g", *s.Minimum)
+		}
+		if s.Maximum != nil && v > *s.Maximum {
+			fail("must be at most %g", *s.Maximum)
+		}
+	}
+}
+
+// matches reports whether value has one of the schema's types
+func (t schemaTypes) matches(value interface{}) bool {
+	for _, name := range t {
+		switch v := value.(type) {
+		case map[string]interface{}:
+			if name == "object" {
+				return true
+			}
+		case []interface{}:
+			if name == "array" {
+				return true
+			}
+		case string:
+			if name == "string" {
+				return true
+			}
+		case bool:
+			if name == "boolean" {
+				return true
+			}
+		case float64:
+			if name == "number" || (name == "integer" && v == math.Trunc(v)) {
+				return true
+			}
+		case nil:
+			if name == "null" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func schemaEnumContains(enum []interface{}, value interface{}) bool {
+	for _, allowed := range enum {
+		if allowed == value {
+			return true
+		}
+	}
+	return false
+}
+
+// requestValidator validates Messages request bodies before they are
+// billed. The schema can be swapped at runtime; without one nothing is
+// validated.
+type requestValidator struct {
+	schema atomic.Pointer[JSONSchema]
+}
+
+// requestValidatorFromEnv enables validation when VALIDATE_MESSAGES_SCHEMA
+// is true, using the schema in MESSAGES_SCHEMA_FILE or the built-in one
+func requestValidatorFromEnv() (*requestValidator, error) {
+	v := &requestValidator{}
+	if os.Getenv("VALIDATE_MESSAGES_SCHEMA") != "true" {
+		return v, nil
+	}
+
+	data := []byte(defaultMessagesSchema)
+	if path := os.Getenv("MESSAGES_SCHEMA_FILE"); path != "" {
+		var err error
+		if data, err = os.ReadFile(path); err != nil {
+			return nil, fmt.Errorf("error reading MESSAGES_SCHEMA_FILE: %w", err)
+		}
+	}
+	schema, err := ParseJSONSchema(data)
+	if err != nil {
+		return nil, err
+	}
+
+	v.schema.Store(schema)
+	logger().Info("messages request validation enabled", "schema_file", os.Getenv("MESSAGES_SCHEMA_FILE"))
+	return v, nil
+}
+
+// appliesTo reports whether r is a Messages API call
+func (v *requestValidator) appliesTo(r *http.Request) bool {
+	return v != nil && v.schema.Load() != nil && isMessagesRequest(r)
+}
+
+// isMessagesRequest reports whether r calls the Messages API
+func isMessagesRequest(r *http.Request) bool {
+	return r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, "/v1/messages")
+}
+
+// validate checks r's body against the schema, restoring the body for
+// downstream handlers. It returns the violations, if any.
+func (v *requestValidator) validate(r *http.Request) []string {
+	bodyBytes, err := io.ReadAll(r.Body)
+	r.Body = io.NopCloser(bytes.NewReader(bodyBytes))
+	if err != nil {
+		return []string{"$: failed to read request body"}
+	}
+
+	var body interface{}
+	if err := json.Unmarshal(bodyBytes, &body); err != nil {
+		return []string{"$: invalid JSON"}
+	}
+	return v.schema.Load().Validate(body)
+}
+
+// SetMessagesSchema replaces the schema used to validate Messages requests,
+// enabling validation if it was off. It is safe to call while serving;
+// requests already validated are unaffected.
+func (m *UsageMiddleware) SetMessagesSchema(data []byte) error {
+	schema, err := ParseJSONSchema(data)
+	if err != nil {
+		return err
+	}
+	if m.validator == nil {
+		return fmt.Errorf("usage tracking is disabled")
+	}
+	m.validator.schema.Store(schema)
+	return nil
+}
+
+// writeSchemaErrors sends the 400 for requests that fail validation
+func writeSchemaErrors(w http.ResponseWriter, errs []string) {
+	writeError(w, http.StatusBadRequest, APIError{
+		Code:    apierror.CodeInvalidRequest,
+		Message: "Request body does not match the Messages API schema",
+		Details: map[string]interface{}{"errors": errs},
+	})
+}
@@ -0,0 +1,97 @@
+package middleware
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// validateBody checks body against the default Messages schema
+func validateBody(t *testing.T, body string) []string {
+	t.Helper()
+	schema, err := ParseJSONSchema([]byte(defaultMessagesSchema))
+	require.NoError(t, err)
+
+	var value interface{}
+	require.NoError(t, json.Unmarshal([]byte(body), &value))
+	return schema.Validate(value)
+}
+
+func TestMessagesSchemaAcceptsValidRequest(t *testing.T) {
+	errs := validateBody(t, `{
+		"model": "claude-3-5-haiku-20241022",
+		"max_tokens": 1024,
+		"system": "Be brief.",
+		"messages": [
+			{"role": "user", "content": "Hello"},
+			{"role": "assistant", "content": [{"type": "text", "text": "Hi"}]}
+		],
+		"metadata": {"user_id": "u1"}
+	}`)
+	assert.Empty(t, errs)
+}
+
+func TestMessagesSchemaRejectsInvalidRequests(t *testing.T) {
+	tests := []struct {
+		body string
+		want []string
+	}{
+		{
+			body: `{"messages": [{"role": "user", "content": "Hi"}]}`,
+			want: []string{`$: missing required field "model"`, `$: missing required field "max_tokens"`},
+		},
+		{
+			body: `{"model": "m", "max_tokens": 1.5, "messages": []}`,
+			want: []string{"$.max_tokens: must be integer", "$.messages: must have at least 1 items"},
+		},
+		{
+			body: `{"model": "", "max_tokens": 0, "messages": [{"role": "system", "content": 3}]}`,
+			want: []string{
+				"$.max_tokens: must be at least 1",
+				"$.messages[0].content: must be string or array",
+				"$.messages[0].role: must be one of [user assistant]",
+				"$.model: must be at least 1 characters",
+			},
+		},
+		{
+			body: `[]`,
+			want: []string{"$: must be object"},
+		},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, validateBody(t, tt.body), tt.body)
+	}
+}
+
+func TestRequestValidator(t *testing.T) {
+	m := &UsageMiddleware{enabled: true, validator: &requestValidator{}}
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/anthropic_proxy/s1/v1/messages",
+		strings.NewReader(`{"model":"m","messages":[]}`))
+
+	// Without a schema nothing is validated
+	assert.False(t, m.validator.appliesTo(req))
+
+	require.NoError(t, m.SetMessagesSchema([]byte(defaultMessagesSchema)))
+	require.True(t, m.validator.appliesTo(req))
+	assert.Equal(t, []string{
+		`$: missing required field "max_tokens"`,
+		"$.messages: must have at least 1 items",
+	}, m.validator.validate(req))
+
+	// The body is restored for downstream handlers
+	body, err := io.ReadAll(req.Body)
+	require.NoError(t, err)
+	assert.Equal(t, `{"model":"m","messages":[]}`, string(body))
+
+	// Other routes and methods are not validated
+	assert.False(t, m.validator.appliesTo(httptest.NewRequest(http.MethodGet, "/api/v1/anthropic_proxy/s1/v1/messages", nil)))
+	assert.False(t, m.validator.appliesTo(httptest.NewRequest(http.MethodPost, "/api/v1/sessions", nil)))
+
+	assert.Error(t, m.SetMessagesSchema([]byte(`{"type": 3}`)))
+}
@@ -0,0 +1,31 @@
+package middleware
+
+import (
+	"net/http"
+
+	"your-project/hld/firebase"
+	"your-project/hld/internal/apierror"
+)
+
+// RequireScope rejects requests authenticated with an API key that lacks
+// scope. Requests authenticated with a Firebase ID token act as the user and
+// are not scope-restricted.
+func RequireScope(scope string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if key, ok := r.Context().Value("api_key").(*firebase.APIKey); ok && !key.HasScope(scope) {
+				logger().Warn("api key missing required scope",
+					"user_id", key.UserID,
+					"key_prefix", key.Prefix,
+					"scope", scope)
+				writeError(w, http.StatusForbidden, APIError{
+					Code:    apierror.CodeInsufficientScope,
+					Message: "API key does not grant the required scope",
+					Details: map[string]interface{}{"required_scope": scope},
+				})
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
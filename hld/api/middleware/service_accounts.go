@@ -0,0 +1,63 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"os"
+)
+
+// serviceAccounts lists the user IDs, from SERVICE_ACCOUNT_UIDS, that are
+// treated as service accounts. Users with the service_account custom claim
+// are service accounts too.
+type serviceAccounts map[string]struct{}
+
+// serviceAccountsFromEnv reads SERVICE_ACCOUNT_UIDS, a comma separated list
+// of user IDs
+func serviceAccountsFromEnv() serviceAccounts {
+	uids := splitList(os.Getenv("SERVICE_ACCOUNT_UIDS"))
+	if len(uids) == 0 {
+		return nil
+	}
+	s := make(serviceAccounts, len(uids))
+	for _, uid := range uids {
+		s[uid] = struct{}{}
+	}
+	return s
+}
+
+// includes reports whether caller is a service account, by claim or by
+// allowlist. Anonymous trial users never are.
+func (s serviceAccounts) includes(caller authCaller) bool {
+	if caller.anonymous {
+		return false
+	}
+	if caller.service {
+		return true
+	}
+	_, ok := s[caller.userID]
+	return ok
+}
+
+// serviceRequest returns r with a service account caller in its context.
+// Service accounts are authenticated like anyone else but have no balance
+// checked or held, and TrackUsage doesn't bill them.
+func serviceRequest(r *http.Request, caller authCaller) *http.Request {
+	ctx := context.WithValue(r.Context(), "user_id", caller.userID)
+	ctx = context.WithValue(ctx, "service_account", true)
+	if caller.apiKey != nil {
+		ctx = context.WithValue(ctx, "api_key", caller.apiKey)
+	}
+	if caller.admin {
+		ctx = context.WithValue(ctx, "admin_claim", true)
+	}
+	if caller.impersonatorID != "" {
+		ctx = context.WithValue(ctx, "impersonator_id", caller.impersonatorID)
+	}
+	return r.WithContext(ctx)
+}
+
+// isServiceRequest reports whether CheckAuth admitted r as a service account
+func isServiceRequest(r *http.Request) bool {
+	service, _ := r.Context().Value("service_account").(bool)
+	return service
+}
@@ -0,0 +1,59 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"your-project/hld/firebase"
+)
+
+func TestServiceAccountsIncludes(t *testing.T) {
+	t.Setenv("SERVICE_ACCOUNT_UIDS", "monitor-1, monitor-2")
+	s := serviceAccountsFromEnv()
+
+	assert.True(t, s.includes(authCaller{userID: "monitor-2"}))
+	assert.True(t, s.includes(authCaller{userID: "probe", service: true}))
+	assert.False(t, s.includes(authCaller{userID: "user-1"}))
+	assert.False(t, s.includes(authCaller{userID: "monitor-1", anonymous: true}))
+
+	var none serviceAccounts
+	assert.False(t, none.includes(authCaller{userID: "monitor-1"}))
+}
+
+func TestCallerFromClaimsServiceAccount(t *testing.T) {
+	caller := callerFromClaims(&firebase.TokenInfo{UID: "probe", ServiceAccount: true})
+	assert.True(t, caller.service)
+}
+
+func TestServiceRequestContext(t *testing.T) {
+	req := serviceRequest(httptest.NewRequest(http.MethodPost, "/v1/messages", nil), authCaller{userID: "monitor-1"})
+
+	assert.Equal(t, "monitor-1", req.Context().Value("user_id"))
+	assert.True(t, isServiceRequest(req))
+	assert.Nil(t, req.Context().Value("user_points"))
+	assert.False(t, isServiceRequest(httptest.NewRequest(http.MethodPost, "/v1/messages", nil)))
+}
+
+func TestTrackUsageDoesNotBillServiceAccounts(t *testing.T) {
+	budget := 0
+	m := newTestTrackingMiddleware()
+	m.sessionBudgets = fakeSessionBudgets{
+		"sess-1": {UserID: "user-1", PointBudget: &budget},
+	}
+
+	// A billed request would deduct through the (nil) Firebase client or be
+	// refused for the spent session budget
+	handler := m.TrackUsage(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"usage":{"input_tokens":100,"output_tokens":50}}`))
+	}))
+	req := authenticatedRequest(`{"model":"claude-3-5-haiku-20241022"}`)
+	req = req.WithContext(context.WithValue(req.Context(), "service_account", true))
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+}
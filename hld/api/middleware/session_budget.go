@@ -0,0 +1,146 @@
+package middleware
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"your-project/hld/firebase"
+	"your-project/hld/internal/apierror"
+)
+
+// sessionBudgetStore reads and charges per-session point budgets.
+// *firebase.Client implements it.
+type sessionBudgetStore interface {
+	GetSession(ctx context.Context, sessionID string) (*firebase.SessionRecord, error)
+	AddSessionSpend(ctx context.Context, sessionID string, points int) (*firebase.SessionRecord, error)
+}
+
+// sessionIDFromPath extracts the session a request is made in. Proxy
+// requests name it after anthropic_proxy; otherwise the last path segment is
+// used, as for /sessions/{id}.
+func sessionIDFromPath(path string) string {
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	for i, part := range parts {
+		if part == "anthropic_proxy" && i+1 < len(parts) {
+			return parts[i+1]
+		}
+	}
+	if last := parts[len(parts)-1]; last != "" {
+		return last
+	}
+	return "unknown"
+}
+
+// budgetStore returns the store for the request's tenant, or nil when there
+// is none
+func (m *UsageMiddleware) budgetStore(ctx context.Context) sessionBudgetStore {
+	if m.sessionBudgets != nil {
+		return m.sessionBudgets
+	}
+	if client := m.client(ctx); client != nil {
+		return client
+	}
+	return nil
+}
+
+// sessionForBudget returns the caller's session record when the request can
+// be associated with one. Lookup failures are logged and treated as no
+// session, so an unreachable sessions node never blocks requests.
+func (m *UsageMiddleware) sessionForBudget(ctx context.Context, userID, sessionID string) *firebase.SessionRecord {
+	store := m.budgetStore(ctx)
+	if store == nil || sessionID == "unknown" {
+		return nil
+	}
+
+	session, err := store.GetSession(ctx, sessionID)
+	if err != nil {
+		if !errors.Is(err, firebase.ErrSessionNotFound) {
+			requestLogger(ctx).Warn("failed to read session budget", "session_id", sessionID, "error", err)
+		}
+		return nil
+	}
+	// Spend only counts against sessions the caller owns
+	if session.UserID != userID {
+		return nil
+	}
+	return session
+}
+
+// chargeSession adds points to the session's spend once a request is billed
+func (m *UsageMiddleware) chargeSession(ctx context.Context, sessionID string, points int) {
+	if points <= 0 {
+		return
+	}
+	ctx = context.WithoutCancel(ctx)
+	if _, err := m.budgetStore(ctx).AddSessionSpend(ctx, sessionID, points); err != nil {
+		requestLogger(ctx).Error("failed to record session spend",
+			"session_id", sessionID,
+			"points", points,
+			"error", err)
+	}
+}
+
+// writeSessionBudgetExhausted sends the 402 for a session that has spent its
+// budget, whatever the account balance
+func writeSessionBudgetExhausted(w http.ResponseWriter, sessionID string, session *firebase.SessionRecord) {
+	writeError(w, http.StatusPaymentRequired, APIError{
+		Code:    apierror.CodeSessionBudgetExhausted,
+		Message: "This session has used its point budget",
+		Details: map[string]interface{}{
+			"session_id":   sessionID,
+			"point_budget": *session.PointBudget,
+			"points_spent": session.PointsSpent,
+		},
+	})
+}
+
+// SetSessionBudgetRequest is the body for setting a session's point budget.
+// A null point_budget removes the budget.
+type SetSessionBudgetRequest struct {
+	PointBudget *int `json:"point_budget"`
+}
+
+// SetSessionBudget handles PUT /sessions/{id}/budget, capping how many
+// points one of the caller's sessions may spend. Requests in the session
+// are refused with 402 session_budget_exhausted once the budget is used up.
+// Requests already in flight when the cap is reached still complete, so
+// spend can end slightly above the budget.
+func (h *UserHandlers) SetSessionBudget(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		writeError(w, http.StatusMethodNotAllowed, APIError{Code: apierror.CodeMethodNotAllowed, Message: "PUT required"})
+		return
+	}
+
+	userID, _ := r.Context().Value("user_id").(string)
+	sessionID := r.PathValue("id")
+
+	var req SetSessionBudgetRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || (req.PointBudget != nil && *req.PointBudget < 0) {
+		writeError(w, http.StatusBadRequest, APIError{
+			Code:    apierror.CodeInvalidRequest,
+			Message: "point_budget must be a non-negative integer or null",
+		})
+		return
+	}
+
+	session, err := h.client(r).SetSessionBudget(r.Context(), sessionID, userID, req.PointBudget)
+	switch {
+	case errors.Is(err, firebase.ErrSessionNotFound), errors.Is(err, firebase.ErrSessionOwnerChanged):
+		// Other users' sessions are indistinguishable from missing ones
+		writeError(w, http.StatusNotFound, APIError{Code: apierror.CodeSessionNotFound, Message: "Session not found"})
+		return
+	case err != nil:
+		logger().Error("failed to set session budget", "session_id", sessionID, "user_id", userID, "error", err)
+		writeError(w, http.StatusInternalServerError, APIError{Code: apierror.CodeInternalError, Message: "Failed to update session budget"})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"session_id":   sessionID,
+		"point_budget": session.PointBudget,
+		"points_spent": session.PointsSpent,
+	})
+}
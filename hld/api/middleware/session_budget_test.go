@@ -0,0 +1,74 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"your-project/hld/firebase"
+	"your-project/hld/internal/apierror"
+)
+
+// fakeSessionBudgets is an in-memory sessionBudgetStore
+type fakeSessionBudgets map[string]*firebase.SessionRecord
+
+func (f fakeSessionBudgets) GetSession(_ context.Context, sessionID string) (*firebase.SessionRecord, error) {
+	session, ok := f[sessionID]
+	if !ok {
+		return nil, firebase.ErrSessionNotFound
+	}
+	copied := *session
+	return &copied, nil
+}
+
+func (f fakeSessionBudgets) AddSessionSpend(_ context.Context, sessionID string, points int) (*firebase.SessionRecord, error) {
+	session, ok := f[sessionID]
+	if !ok {
+		return nil, firebase.ErrSessionNotFound
+	}
+	session.PointsSpent += points
+	return session, nil
+}
+
+func TestSessionIDFromPath(t *testing.T) {
+	assert.Equal(t, "sess-1", sessionIDFromPath("/api/v1/anthropic_proxy/sess-1/v1/messages"))
+	assert.Equal(t, "sess-2", sessionIDFromPath("/api/v1/sessions/sess-2"))
+	assert.Equal(t, "unknown", sessionIDFromPath("/"))
+}
+
+func TestTrackUsageRefusesExhaustedSessionBudget(t *testing.T) {
+	budget := 10
+	m := newTestTrackingMiddleware()
+	m.sessionBudgets = fakeSessionBudgets{
+		"sess-1": {UserID: "user-1", PointBudget: &budget, PointsSpent: 10},
+	}
+
+	handler := m.TrackUsage(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Fatal("request should have been refused")
+	}))
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, authenticatedRequest(`{"model":"claude-3-5-haiku-20241022"}`))
+
+	env := assertEnvelope(t, w, http.StatusPaymentRequired, apierror.CodeSessionBudgetExhausted)
+	assert.Equal(t, "sess-1", env.Details["session_id"])
+	assert.EqualValues(t, 10, env.Details["point_budget"])
+}
+
+func TestTrackUsageIgnoresOtherUsersSessionBudget(t *testing.T) {
+	budget := 0
+	m := newTestTrackingMiddleware()
+	m.sessionBudgets = fakeSessionBudgets{
+		"sess-1": {UserID: "someone-else", PointBudget: &budget},
+	}
+
+	called := false
+	handler := m.TrackUsage(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+		// Fail upstream so nothing is billed
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	handler.ServeHTTP(httptest.NewRecorder(), authenticatedRequest(`{"model":"claude-3-5-haiku-20241022"}`))
+	assert.True(t, called)
+}
@@ -0,0 +1,51 @@
+package middleware
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"time"
+
+	"your-project/hld/firebase"
+)
+
+// sessionExpiryInterval is how often inactive sessions are expired
+const sessionExpiryInterval = 10 * time.Minute
+
+// defaultSessionExpiry is how long an active session may go without
+// activity before it is expired
+const defaultSessionExpiry = 60 * time.Minute
+
+// sessionExpiryFromEnv reads SESSION_EXPIRY_MINUTES
+func sessionExpiryFromEnv() time.Duration {
+	idle := defaultSessionExpiry
+	if raw := os.Getenv("SESSION_EXPIRY_MINUTES"); raw != "" {
+		if n, err := strconv.Atoi(raw); err == nil && n > 0 {
+			idle = time.Duration(n) * time.Minute
+		} else {
+			logger().Warn("invalid SESSION_EXPIRY_MINUTES, using default", "value", raw, "default", idle)
+		}
+	}
+	return idle
+}
+
+// runSessionExpiry moves active sessions idle for longer than idle to
+// "expired" every interval until ctx is cancelled. Every instance may run
+// it; each transition is transactional.
+func runSessionExpiry(ctx context.Context, client *firebase.Client, interval, idle time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			expired, err := client.ExpireInactiveSessions(ctx, idle)
+			if err != nil {
+				logger().Error("failed to expire inactive sessions", "error", err)
+			}
+			logger().Info("session expiry completed", "expired_sessions", expired)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package middleware
+
+import (
+	"net/http"
+	"os"
+	"strings"
+)
+
+// skipRules holds the routes that bypass authentication and billing
+type skipRules struct {
+	paths    map[string]struct{}
+	prefixes []string
+}
+
+// skipRulesFromEnv builds skip rules from the comma separated
+// USAGE_SKIP_PATHS and USAGE_SKIP_PREFIXES environment variables
+func skipRulesFromEnv() skipRules {
+	var rules skipRules
+	rules.addPaths(splitList(os.Getenv("USAGE_SKIP_PATHS"))...)
+	rules.addPrefixes(splitList(os.Getenv("USAGE_SKIP_PREFIXES"))...)
+	return rules
+}
+
+func (s *skipRules) addPaths(paths ...string) {
+	if s.paths == nil {
+		s.paths = make(map[string]struct{}, len(paths))
+	}
+	for _, p := range paths {
+		s.paths[normalizePath(p)] = struct{}{}
+	}
+}
+
+func (s *skipRules) addPrefixes(prefixes ...string) {
+	for _, p := range prefixes {
+		s.prefixes = append(s.prefixes, normalizePath(p))
+	}
+}
+
+// match reports whether path is an exact skip path or falls under a skip
+// prefix. Prefixes match on segment boundaries, so "/webhooks" matches
+// "/webhooks" and "/webhooks/stripe" but not "/webhooksx".
+func (s *skipRules) match(path string) bool {
+	path = normalizePath(path)
+
+	if _, ok := s.paths[path]; ok {
+		return true
+	}
+
+	for _, prefix := range s.prefixes {
+		if prefix == "/" || path == prefix || strings.HasPrefix(path, prefix+"/") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// normalizePath strips trailing slashes so "/healthz/" and "/healthz" match
+func normalizePath(p string) string {
+	p = strings.TrimSpace(p)
+	if !strings.HasPrefix(p, "/") {
+		p = "/" + p
+	}
+	if trimmed := strings.TrimRight(p, "/"); trimmed != "" {
+		return trimmed
+	}
+	return "/"
+}
+
+// splitList splits a comma separated list, dropping empty entries
+func splitList(raw string) []string {
+	var out []string
+	for _, item := range strings.Split(raw, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
+
+// SkipPaths adds exact routes that bypass CheckAuth and TrackUsage.
+// Must be called before the middleware starts serving requests.
+func (m *UsageMiddleware) SkipPaths(paths ...string) {
+	m.skip.addPaths(paths...)
+}
+
+// SkipPrefixes adds route prefixes that bypass CheckAuth and TrackUsage.
+// Must be called before the middleware starts serving requests.
+func (m *UsageMiddleware) SkipPrefixes(prefixes ...string) {
+	m.skip.addPrefixes(prefixes...)
+}
+
+// shouldSkip reports whether the request is exempt from auth and billing
+func (m *UsageMiddleware) shouldSkip(r *http.Request) bool {
+	return m.skip.match(r.URL.Path)
+}
@@ -0,0 +1,58 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSkipRulesMatch(t *testing.T) {
+	var rules skipRules
+	rules.addPaths("/healthz", "/v1/pricing/")
+	rules.addPrefixes("/webhooks")
+
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{"/healthz", true},
+		{"/healthz/", true},
+		{"/v1/pricing", true},
+		{"/v1/pricing/", true},
+		{"/v1/pricing/extra", false},
+		{"/webhooks", true},
+		{"/webhooks/", true},
+		{"/webhooks/stripe", true},
+		{"/webhooksx", false},
+		{"/v1/messages", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			assert.Equal(t, tt.want, rules.match(tt.path))
+		})
+	}
+}
+
+func TestSkippedRoutesBypassAuth(t *testing.T) {
+	m := &UsageMiddleware{enabled: true}
+	m.SkipPaths("/healthz")
+
+	var sawUserID bool
+	handler := m.CheckAuth(m.TrackUsage(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, sawUserID = r.Context().Value("user_id").(string)
+		w.WriteHeader(http.StatusOK)
+	})))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/healthz/", nil))
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.False(t, sawUserID)
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/v1/messages", nil))
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
@@ -0,0 +1,86 @@
+package middleware
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+
+	"your-project/hld/firebase"
+)
+
+// defaultTenantHeader carries the tenant ID when it isn't in the subdomain
+const defaultTenantHeader = "X-Tenant-ID"
+
+// tenantIDPattern restricts tenant IDs to a DNS label
+var tenantIDPattern = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+
+// tenantResolver picks the tenant for a request from a header or, failing
+// that, the subdomain under baseDomain
+type tenantResolver struct {
+	header     string
+	baseDomain string
+}
+
+// tenantResolverFromEnv reads TENANT_HEADER (default X-Tenant-ID) and
+// TENANT_BASE_DOMAIN, e.g. "example.com" to resolve "acme.example.com" to
+// the tenant "acme"
+func tenantResolverFromEnv() tenantResolver {
+	header := os.Getenv("TENANT_HEADER")
+	if header == "" {
+		header = defaultTenantHeader
+	}
+	return tenantResolver{
+		header:     header,
+		baseDomain: strings.ToLower(strings.Trim(os.Getenv("TENANT_BASE_DOMAIN"), ".")),
+	}
+}
+
+// resolve returns the tenant ID for r, or "" for the default tenant. ok is
+// false when the request names a malformed tenant.
+func (t tenantResolver) resolve(r *http.Request) (tenantID string, ok bool) {
+	if v := strings.TrimSpace(r.Header.Get(t.header)); v != "" {
+		v = strings.ToLower(v)
+		return v, tenantIDPattern.MatchString(v)
+	}
+
+	if t.baseDomain == "" {
+		return "", true
+	}
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(host)
+
+	sub, found := strings.CutSuffix(host, "."+t.baseDomain)
+	if !found || strings.Contains(sub, ".") {
+		return "", true
+	}
+	return sub, tenantIDPattern.MatchString(sub)
+}
+
+// clientFromContext returns the tenant's Firebase client selected by
+// CheckAuth, or fallback when the request carries none
+func clientFromContext(ctx context.Context, fallback *firebase.Client) *firebase.Client {
+	if client, ok := ctx.Value("firebase_client").(*firebase.Client); ok {
+		return client
+	}
+	return fallback
+}
+
+// client returns the Firebase client for the request's tenant
+func (m *UsageMiddleware) client(ctx context.Context) *firebase.Client {
+	return clientFromContext(ctx, m.firebaseClient)
+}
+
+// usageStoreFromContext returns where the request's usage logs are kept:
+// the store selected by CheckAuth, or else the tenant's Firebase client
+func usageStoreFromContext(ctx context.Context, client *firebase.Client) firebase.UsageStore {
+	if store, ok := ctx.Value("usage_store").(firebase.UsageStore); ok {
+		return store
+	}
+	return client
+}
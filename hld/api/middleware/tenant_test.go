@@ -0,0 +1,46 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTenantResolver(t *testing.T) {
+	resolver := tenantResolver{header: defaultTenantHeader, baseDomain: "example.com"}
+
+	tests := []struct {
+		name   string
+		host   string
+		header string
+		want   string
+		ok     bool
+	}{
+		{name: "header", host: "api.other.net", header: "Acme", want: "acme", ok: true},
+		{name: "header wins over subdomain", host: "globex.example.com", header: "acme", want: "acme", ok: true},
+		{name: "subdomain", host: "acme.example.com", want: "acme", ok: true},
+		{name: "subdomain with port", host: "acme.example.com:8443", want: "acme", ok: true},
+		{name: "apex is default tenant", host: "example.com", want: "", ok: true},
+		{name: "nested subdomain is default tenant", host: "a.b.example.com", want: "", ok: true},
+		{name: "other domain is default tenant", host: "acme.example.org", want: "", ok: true},
+		{name: "malformed header", host: "example.com", header: "../acme", ok: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/api/v1/sessions", nil)
+			req.Host = tt.host
+			if tt.header != "" {
+				req.Header.Set(defaultTenantHeader, tt.header)
+			}
+
+			got, ok := resolver.resolve(req)
+			assert.Equal(t, tt.ok, ok)
+			if tt.ok {
+				assert.Equal(t, tt.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,34 @@
+package middleware
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"your-project/hld/firebase"
+)
+
+// verifyOptionsFromEnv reads how ID tokens are verified: TOKEN_AUDIENCES, a
+// comma separated list of further Firebase project IDs whose tokens are
+// accepted; TOKEN_CLOCK_LEEWAY, extra tolerated clock skew such as "30s";
+// and TOKEN_REQUIRED_CLAIM, a custom claim every token must carry
+func verifyOptionsFromEnv() (firebase.VerifyOptions, error) {
+	opts := firebase.VerifyOptions{
+		Audiences:     splitList(os.Getenv("TOKEN_AUDIENCES")),
+		RequiredClaim: os.Getenv("TOKEN_REQUIRED_CLAIM"),
+	}
+	if raw := os.Getenv("TOKEN_CLOCK_LEEWAY"); raw != "" {
+		d, err := time.ParseDuration(raw)
+		if err != nil || d < 0 || d > firebase.MaxVerifyLeeway {
+			return firebase.VerifyOptions{}, fmt.Errorf("invalid TOKEN_CLOCK_LEEWAY %q: must be a duration between 0 and %s", raw, firebase.MaxVerifyLeeway)
+		}
+		opts.Leeway = d
+	}
+	if len(opts.Audiences) > 0 || opts.Leeway > 0 || opts.RequiredClaim != "" {
+		logger().Info("token verification configured",
+			"extra_audiences", opts.Audiences,
+			"leeway", opts.Leeway,
+			"required_claim", opts.RequiredClaim)
+	}
+	return opts, nil
+}
@@ -0,0 +1,27 @@
+package middleware
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerifyOptionsFromEnv(t *testing.T) {
+	t.Setenv("TOKEN_AUDIENCES", "old-project, staging-project")
+	t.Setenv("TOKEN_CLOCK_LEEWAY", "30s")
+	t.Setenv("TOKEN_REQUIRED_CLAIM", "beta")
+
+	opts, err := verifyOptionsFromEnv()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"old-project", "staging-project"}, opts.Audiences)
+	assert.Equal(t, 30*time.Second, opts.Leeway)
+	assert.Equal(t, "beta", opts.RequiredClaim)
+
+	for _, raw := range []string{"soon", "-1s", "1h"} {
+		t.Setenv("TOKEN_CLOCK_LEEWAY", raw)
+		_, err := verifyOptionsFromEnv()
+		assert.Error(t, err, raw)
+	}
+}
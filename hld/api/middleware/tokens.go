@@ -0,0 +1,152 @@
+package middleware
+
+import (
+	"encoding/json"
+	"fmt"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Token approximation constants. They are tuned to overestimate slightly
+// for English text and code, since the count sizes points holds.
+const (
+	// charsPerWordToken is how many letters of a word fit in one token
+	charsPerWordToken = 5
+	// digitsPerToken matches tokenizers that split numbers into short runs
+	digitsPerToken = 3
+	// imageTokens is charged per image, the most a downscaled image costs
+	imageTokens = 1600
+	// messageOverheadTokens covers the role and turn markers of a message
+	messageOverheadTokens = 4
+	// requestOverheadTokens covers the fixed framing of a request
+	requestOverheadTokens = 3
+)
+
+// Message is a Messages API message whose content is either a string or a
+// list of content blocks
+type Message struct {
+	Role    string          `json:"role"`
+	Content json.RawMessage `json:"content"`
+}
+
+// CountInputTokens approximates the input tokens of messages without calling
+// the API. It is close enough to size points holds up front; the charge is
+// still taken from the usage the API reports. All current Claude models
+// share one approximation, so model only needs to be set for the error
+// messages to be useful.
+func CountInputTokens(model string, messages []Message) (int, error) {
+	return countMessagesTokens(model, messages, countTextTokens)
+}
+
+// countMessagesTokens is CountInputTokens with the text of the messages
+// counted by countText
+func countMessagesTokens(model string, messages []Message, countText func(string) int) (int, error) {
+	total := requestOverheadTokens
+	for i, msg := range messages {
+		n, err := countContentTokens(msg.Content, countText)
+		if err != nil {
+			return 0, fmt.Errorf("counting tokens for %s: message %d: %w", model, i, err)
+		}
+		total += messageOverheadTokens + n
+	}
+	return total, nil
+}
+
+// countContentTokens counts a string or content block list, with the text
+// counted by countText. Null or missing content counts as empty.
+func countContentTokens(content json.RawMessage, countText func(string) int) (int, error) {
+	if len(content) == 0 || string(content) == "null" {
+		return 0, nil
+	}
+
+	var text string
+	if err := json.Unmarshal(content, &text); err == nil {
+		return countText(text), nil
+	}
+
+	var blocks []map[string]json.RawMessage
+	if err := json.Unmarshal(content, &blocks); err != nil {
+		return 0, fmt.Errorf("content must be a string or a list of blocks")
+	}
+	total := 0
+	for _, block := range blocks {
+		total += countBlockTokens(block, countText)
+	}
+	return total, nil
+}
+
+// countBlockTokens counts one content block. Images cost a flat amount; for
+// other blocks every text-bearing field is counted, which covers text,
+// tool_use input, tool_result content and OpenAI style parts alike.
+func countBlockTokens(block map[string]json.RawMessage, countText func(string) int) int {
+	var blockType string
+	_ = json.Unmarshal(block["type"], &blockType)
+	if blockType == "image" || blockType == "image_url" {
+		return imageTokens
+	}
+
+	total := 0
+	for key, raw := range block {
+		switch key {
+		case "type", "id", "tool_use_id", "cache_control":
+			continue
+		case "content":
+			// tool_result content may itself be blocks
+			n, err := countContentTokens(raw, countText)
+			if err != nil {
+				n = countText(string(raw))
+			}
+			total += n
+		default:
+			var s string
+			if err := json.Unmarshal(raw, &s); err == nil {
+				total += countText(s)
+			} else {
+				// Structured values such as tool input are sent as JSON
+				total += countText(string(raw))
+			}
+		}
+	}
+	return total
+}
+
+// countTextTokens approximates the tokens in s. Words cost one token per
+// charsPerWordToken letters, numbers one per digitsPerToken digits, and
+// every other non-space character, including each non-Latin rune, one
+// token. Runs of spaces are free but each line break costs a token.
+func countTextTokens(s string) int {
+	total := 0
+	letters, digits := 0, 0
+	flush := func() {
+		total += (letters + charsPerWordToken - 1) / charsPerWordToken
+		total += (digits + digitsPerToken - 1) / digitsPerToken
+		letters, digits = 0, 0
+	}
+
+	for len(s) > 0 {
+		r, size := utf8.DecodeRuneInString(s)
+		s = s[size:]
+		switch {
+		case r < utf8.RuneSelf && unicode.IsLetter(r):
+			if digits > 0 {
+				flush()
+			}
+			letters++
+		case unicode.IsDigit(r):
+			if letters > 0 {
+				flush()
+			}
+			digits++
+		case r == '\n':
+			flush()
+			total++
+		case unicode.IsSpace(r):
+			flush()
+		default:
+			flush()
+			total++
+		}
+	}
+	flush()
+	return total
+}
@@ -0,0 +1,114 @@
+package middleware
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"your-project/hld/firebase"
+)
+
+func TestCountTextTokens(t *testing.T) {
+	tests := map[string]int{
+		"":                      0,
+		"Hello":                 1,
+		"Hello, world!":         4,
+		"internationalization":  4,
+		"2024":                  2,
+		"a\nb":                  3,
+		"x := map[string]int{}": 11,
+		"日本語":                   3,
+	}
+	for text, want := range tests {
+		assert.Equal(t, want, countTextTokens(text), text)
+	}
+}
+
+func TestCountInputTokens(t *testing.T) {
+	var messages []Message
+	require.NoError(t, json.Unmarshal([]byte(`[
+		{"role": "user", "content": "Hello there"},
+		{"role": "assistant", "content": [
+			{"type": "text", "text": "Checking"},
+			{"type": "tool_use", "id": "toolu_1", "name": "lookup", "input": {"q": "x"}}
+		]},
+		{"role": "user", "content": [
+			{"type": "tool_result", "tool_use_id": "toolu_1", "content": [{"type": "text", "text": "Found"}]},
+			{"type": "image", "source": {"type": "base64", "media_type": "image/png", "data": "iVBOR"}}
+		]}
+	]`), &messages))
+
+	got, err := CountInputTokens("claude-3-5-haiku-20241022", messages)
+	require.NoError(t, err)
+	// Framing, three messages, "Hello there", "Checking", "lookup",
+	// {"q":"x"}, "Found" and one image
+	assert.Equal(t, requestOverheadTokens+3*messageOverheadTokens+2+2+2+9+1+imageTokens, got)
+
+	_, err = CountInputTokens("m", []Message{{Role: "user", Content: json.RawMessage(`42`)}})
+	assert.Error(t, err)
+}
+
+func TestEstimateCostCountsMessages(t *testing.T) {
+	m := &UsageMiddleware{}
+	long := strings.Repeat("word ", 2000)
+	body := `{"model":"claude-3-5-haiku-20241022","max_tokens":100,"stream":true,
+		"system":"Be brief.","messages":[{"role":"user","content":"` + long + `"}]}`
+	req := httptest.NewRequest(http.MethodPost, "/v1/messages", strings.NewReader(body))
+
+	input := requestOverheadTokens + messageOverheadTokens + 2000 + 3
+	assert.Equal(t, firebase.CalculatePointsCost("claude-3-5-haiku-20241022", input, 100), m.estimateCost(req, "user-1"))
+}
+
+func TestEstimateRequestInputTokens(t *testing.T) {
+	m := &UsageMiddleware{}
+	body := `{"model":"claude-3-5-haiku-20241022","max_tokens":100,"messages":[{"role":"user","content":"hi"}]}`
+	req := httptest.NewRequest(http.MethodPost, "/v1/messages", strings.NewReader(body))
+	_, input := m.estimateRequest(req, "user-1")
+	assert.Equal(t, requestOverheadTokens+messageOverheadTokens+1, input)
+
+	req = httptest.NewRequest(http.MethodPost, "/v1/messages", strings.NewReader("not json"))
+	cost, input := m.estimateRequest(req, "user-1")
+	assert.Equal(t, minRequiredPoints, cost)
+	assert.Zero(t, input)
+
+	plans := Plans{"free": {MaxInputTokensPerRequest: 1000}}
+	assert.Equal(t, 1000, plans.MaxInputTokens(&firebase.UserAccount{Plan: "free"}))
+	assert.Zero(t, plans.MaxInputTokens(&firebase.UserAccount{Plan: "pro"}))
+	assert.Zero(t, plans.MaxInputTokens(nil))
+}
+
+func TestEstimateCostDefaultMaxTokens(t *testing.T) {
+	body := `{"model":"claude-3-5-haiku-20241022","messages":[{"role":"user","content":"hi"}]}`
+	input := requestOverheadTokens + messageOverheadTokens + 1
+
+	t.Setenv("HOLD_DEFAULT_MAX_TOKENS", "512")
+	m := &UsageMiddleware{holdMaxTokens: holdMaxTokensFromEnv()}
+	req := httptest.NewRequest(http.MethodPost, "/v1/messages", strings.NewReader(body))
+	assert.Equal(t, firebase.CalculatePointsCost("claude-3-5-haiku-20241022", input, 512), m.estimateCost(req, "user-1"))
+
+	m = &UsageMiddleware{}
+	req = httptest.NewRequest(http.MethodPost, "/v1/messages", strings.NewReader(body))
+	assert.Equal(t, firebase.CalculatePointsCost("claude-3-5-haiku-20241022", input, defaultHoldMaxTokens), m.estimateCost(req, "user-1"))
+}
+
+func TestStreamUsage(t *testing.T) {
+	body := []byte("event: message_start\n" +
+		`data: {"type":"message_start","message":{"id":"msg_1","usage":{"input_tokens":25,"output_tokens":1}}}` + "\n\n" +
+		"event: content_block_delta\n" +
+		`data: {"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"Hi"}}` + "\n\n" +
+		"event: message_delta\n" +
+		`data: {"type":"message_delta","delta":{"stop_reason":"end_turn"},"usage":{"output_tokens":15}}` + "\n\n" +
+		"event: message_stop\n" +
+		`data: {"type":"message_stop"}` + "\n\n")
+
+	usage, ok := streamUsage(body)
+	require.True(t, ok)
+	assert.Equal(t, tokenUsage{input: 25, output: 15}, usage)
+
+	_, ok = streamUsage([]byte("not a stream"))
+	assert.False(t, ok)
+}
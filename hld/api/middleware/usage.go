@@ -1,271 +1,1524 @@
 package middleware
 
 import (
+	"bufio"
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"log/slog"
+	"net"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
 	"your-project/hld/firebase"
+	"your-project/hld/internal/apierror"
+	"your-project/hld/internal/requestid"
 )
 
+// Bounds for the downstream call timeout. Long generations can legitimately
+// take several minutes, but a hung upstream must not hold a goroutine forever.
+const (
+	defaultUpstreamTimeout = 10 * time.Minute
+	maxUpstreamTimeout     = 30 * time.Minute
+)
+
+// defaultPointsExpiryInterval is how often expired point grants are swept
+const defaultPointsExpiryInterval = time.Hour
+
+// sessionCookieName is the cookie holding a Firebase session cookie. Firebase
+// Hosting only forwards cookies with this name to backends.
+const sessionCookieName = "__session"
+
+// minRequiredPoints is the balance a user must hold to make a request
+const minRequiredPoints = 1
+
+// defaultInsufficientPointsRetryAfter is the Retry-After hint sent with 402s,
+// giving the user time to complete a purchase before retrying
+const defaultInsufficientPointsRetryAfter = 60 * time.Second
+
+// CheckoutLinkFunc generates a per-user checkout URL (e.g. a Stripe Checkout
+// session) for a user who needs at least needed more points
+type CheckoutLinkFunc func(ctx context.Context, userID string, needed int) (string, error)
+
 // UsageMiddleware handles Firebase authentication and usage tracking
 type UsageMiddleware struct {
+	// firebaseClient serves requests that don't name a tenant
 	firebaseClient *firebase.Client
+	clients        *firebase.ClientPool
+	tenants        tenantResolver
+	usageLogger    *firebase.AsyncLogger
+	audit          *firebase.AuditExporter
+	requestCounter *firebase.RequestCounter
+	// postgresUsage, when configured, keeps the default project's usage
+	// logs in place of Firebase
+	postgresUsage *firebase.PostgresUsageStore
+	metrics        *Metrics
 	enabled        bool
+
+	// purchaseURL is the top-up page returned with insufficient points errors
+	purchaseURL string
+	// checkoutLink optionally overrides purchaseURL with a per-user link
+	checkoutLink CheckoutLinkFunc
+	// insufficientRetryAfter is sent as Retry-After on 402 responses
+	insufficientRetryAfter time.Duration
+
+	// skip lists routes that bypass auth and billing entirely
+	skip skipRules
+
+	plans        Plans
+	rateLimiter  *RateLimiter
+	concurrency  *ConcurrencyLimiter
+	authFailures *authFailureLimiter
+
+	// upstreamTimeout bounds how long TrackUsage waits on the wrapped handler
+	upstreamTimeout time.Duration
+	// holdMaxTokens is the output size assumed when holding points for
+	// requests without max_tokens; see defaultMaxTokens
+	holdMaxTokens int
+	// maxBodyBytes caps the request bodies buffered; see bodyLimit
+	maxBodyBytes int64
+
+	// failOpen lets requests through when the balance can't be read
+	failOpen bool
+
+	emailVerification emailVerificationPolicy
+
+	// privacy redacts personal data before it is persisted
+	privacy PrivacyConfig
+
+	// routePoints raise the minimum balance for specific routes
+	routePoints []routeThreshold
+	// routeSurcharges add to the token cost of specific routes
+	routeSurcharges []routeSurcharge
+	// pointsBreakdownHeader sends the X-Points-Breakdown trailer
+	pointsBreakdownHeader bool
+
+	// balanceStreams caps open balance WebSockets per user
+	balanceStreams *connLimiter
+	// cors decides which cross-origin pages may open balance streams
+	cors CORSConfig
+
+	// latency tracks request duration percentiles per endpoint and model
+	latency *LatencyTracker
+
+	// validator rejects malformed Messages requests before they are billed
+	validator *requestValidator
+
+	// unparsedUsageCharge is billed for successful responses whose token
+	// usage can't be read; zero charges the minimum as for zero tokens
+	unparsedUsageCharge int
+	// opaqueResponseCharge is billed for successful responses that are
+	// neither JSON nor event streams; zero charges the minimum
+	opaqueResponseCharge int
+	// cacheHitRate is the fraction of the original cost charged for
+	// responses replayed from the proxy's cache
+	cacheHitRate float64
+	// errorCharges says which failed requests are billed, and for what
+	errorCharges errorChargePolicy
+	// usageEstimator estimates tokens from the request and response when
+	// usage can't be read; nil when estimation is off
+	usageEstimator *usageEstimator
+
+	// sessionBudgets overrides the tenant's Firebase client for session
+	// budgets; tests set it
+	sessionBudgets sessionBudgetStore
+
+	// anonymous admits requests without credentials as trial users; nil
+	// when anonymous access is off
+	anonymous *anonymousPolicy
+
+	// serviceAccounts are authenticated but never billed
+	serviceAccounts serviceAccounts
+
+	// maintenance refuses billable requests while the maintenance flag is
+	// set
+	maintenance *maintenanceState
+
+	// responseCapture is the bytes kept from each end of a response to
+	// read its usage; zero means defaultResponseCaptureBytes
+	responseCapture int
+
+	// instruments record request, billing and Firebase metrics; nil
+	// unless METRICS_ENABLED is set
+	instruments *instruments
+
+	// logSampler limits unsampled requests to error logs; nil logs every
+	// request in full
+	logSampler *LogSampler
 }
 
-// NewUsageMiddleware creates a new usage tracking middleware
-func NewUsageMiddleware(ctx context.Context) (*UsageMiddleware, error) {
+// NewUsageMiddleware creates a new usage tracking middleware.
+// Usage logs are written in the background until ctx is cancelled, at which
+// point any queued entries are flushed; Shutdown does the same within a
+// deadline and reports entries it couldn't write. The package logs through
+// the logger described by logCfg.
+func NewUsageMiddleware(ctx context.Context, logCfg LoggerConfig) (*UsageMiddleware, error) {
+	log, err := logCfg.build()
+	if err != nil {
+		return nil, err
+	}
+	pkgLogger.Store(log)
+
 	// Check if usage tracking is enabled
 	enabled := os.Getenv("ENABLE_USAGE_TRACKING") == "true"
 	if !enabled {
-		slog.Info("Usage tracking is disabled")
-		return &UsageMiddleware{enabled: false}, nil
+		logger().Info("Usage tracking is disabled")
+		return &UsageMiddleware{metrics: NewMetrics(), enabled: false}, nil
+	}
+
+	// Initialize Firebase client, reading credentials from Secret Manager
+	// when FIREBASE_SECRET_NAMES_JSON is set
+	fbClient, err := firebase.NewClientFromSecretManager(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// Tokens from other projects, skewed clocks and required claims are
+	// configured for the default project only
+	verifyOpts, err := verifyOptionsFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	if err := fbClient.SetVerifyOptions(verifyOpts); err != nil {
+		return nil, err
+	}
+
+	// Tenants with their own Firebase project get a client on first use
+	tenantConfigs, err := firebase.LoadTenantConfigs()
+	if err != nil {
+		return nil, err
 	}
 
-	// Initialize Firebase client
-	fbClient, err := firebase.NewClient(ctx)
+	// Observe Firebase latency before any background worker uses the client
+	metrics := NewMetrics()
+	instruments := instrumentsFromEnv(metrics)
+	if instruments != nil {
+		fbClient.SetOpObserver(instruments.firebaseOp)
+	}
+
+	// Optionally archive usage logs to GCS as well as Firebase. Tenants
+	// with their own project keep their usage there only.
+	audit, err := firebase.NewAuditExporterFromEnv(ctx)
+	if err != nil {
+		return nil, err
+	}
+	fbClient.SetAuditExporter(audit)
+	go audit.Run(ctx)
+
+	// Optionally batch request counter increments rather than writing one
+	// per request
+	requestCounter := firebase.NewRequestCounterFromEnv(fbClient)
+	fbClient.SetRequestCounter(requestCounter)
+	go requestCounter.Run(ctx)
+
+	// Optionally keep usage logs in Postgres. Tenants with their own
+	// project keep their usage there only.
+	postgresUsage, err := firebase.NewPostgresUsageStoreFromEnv(ctx, fbClient)
+	if err != nil {
+		return nil, err
+	}
+
+	usageLogger := firebase.NewAsyncLogger(fbClient)
+	usageLogger.OnDrop(metrics.Counter("hld_usage_logs_dropped_total",
+		"Usage logs dropped because the write queue was full").Inc)
+	usageLogger.Start(ctx)
+
+	go runPointsExpiry(ctx, fbClient, pointsExpiryIntervalFromEnv())
+	go runUsageCompaction(ctx, fbClient, usageCompactionIntervalFromEnv(), usageLogRetentionFromEnv())
+	go runNonceCleanup(ctx, fbClient, nonceCleanupInterval)
+	go runSessionExpiry(ctx, fbClient, sessionExpiryInterval, sessionExpiryFromEnv())
+
+	maintenance := maintenanceStateFromEnv()
+	go runMaintenanceWatch(ctx, fbClient, maintenance, maintenancePollIntervalFromEnv())
+
+	latency := NewLatencyTracker(latencyDurationFromEnv("LATENCY_WINDOW", defaultLatencyWindow))
+	metrics.RegisterSummaryFunc("hld_request_duration_seconds",
+		"Request duration percentiles over the recent window, by endpoint and model",
+		latency.metricSummaries)
+	go latency.Run(ctx, latencyDurationFromEnv("LATENCY_LOG_INTERVAL", defaultLatencyLogInterval))
+	metrics.RegisterGaugeFunc("hld_active_sessions",
+		"Number of sessions active within the last five minutes",
+		func(ctx context.Context) (float64, error) {
+			count, err := fbClient.GetActiveSessionCount(ctx)
+			return float64(count), err
+		})
+
+	plans, err := LoadPlans()
+	if err != nil {
+		return nil, err
+	}
+
+	failOpen, err := failureModeFromEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	privacy, err := PrivacyConfigFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	if privacy.enabled() {
+		// Redact log output process-wide, since IPs are logged outside this
+		// middleware too
+		if log != nil {
+			pkgLogger.Store(slog.New(privacy.WrapHandler(log.Handler())))
+		}
+		slog.SetDefault(slog.New(privacy.WrapHandler(slog.Default().Handler())))
+	}
+
+	cors, err := CORSConfigFromEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	validator, err := requestValidatorFromEnv()
 	if err != nil {
 		return nil, err
 	}
 
-	slog.Info("Usage tracking middleware initialized")
-	return &UsageMiddleware{
-		firebaseClient: fbClient,
-		enabled:        true,
-	}, nil
+	estimator, err := usageEstimatorFromEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	retryAfter := defaultInsufficientPointsRetryAfter
+	if raw := os.Getenv("INSUFFICIENT_POINTS_RETRY_AFTER"); raw != "" {
+		if d, err := time.ParseDuration(raw); err == nil && d > 0 {
+			retryAfter = d
+		} else {
+			logger().Warn("invalid INSUFFICIENT_POINTS_RETRY_AFTER, using default", "value", raw)
+		}
+	}
+
+	logger().Info("Usage tracking middleware initialized", "tenants", len(tenantConfigs))
+	m := &UsageMiddleware{
+		firebaseClient:         fbClient,
+		clients:                firebase.NewClientPool(fbClient, tenantConfigs),
+		tenants:                tenantResolverFromEnv(),
+		usageLogger:            usageLogger,
+		audit:                  audit,
+		requestCounter:         requestCounter,
+		postgresUsage:          postgresUsage,
+		metrics:                metrics,
+		enabled:                true,
+		purchaseURL:            os.Getenv("PURCHASE_URL"),
+		insufficientRetryAfter: retryAfter,
+		skip:                   skipRulesFromEnv(),
+		plans:                  plans,
+		authFailures:           newAuthFailureLimiter(metrics),
+		upstreamTimeout:        upstreamTimeoutFromEnv(),
+		maxBodyBytes:           maxRequestBodyFromEnv(),
+		holdMaxTokens:          holdMaxTokensFromEnv(),
+		failOpen:               failOpen,
+		emailVerification:      emailVerificationPolicyFromEnv(),
+		privacy:                privacy,
+		balanceStreams:         connLimiterFromEnv(),
+		cors:                   cors,
+		latency:                latency,
+		validator:              validator,
+		unparsedUsageCharge:    getEnvInt("UNPARSED_USAGE_CHARGE"),
+		opaqueResponseCharge:   getEnvInt("OPAQUE_RESPONSE_CHARGE"),
+		cacheHitRate:           cacheHitRateFromEnv(),
+		responseCapture:        responseCaptureFromEnv(),
+		usageEstimator:         estimator,
+		anonymous:              anonymousPolicyFromEnv(),
+		serviceAccounts:        serviceAccountsFromEnv(),
+		pointsBreakdownHeader:  os.Getenv("POINTS_BREAKDOWN_HEADER") == "true",
+		maintenance:            maintenance,
+		instruments:            instruments,
+		logSampler:             LogSamplerFromEnv(),
+	}
+	if instruments != nil {
+		m.clients.SetOpObserver(instruments.firebaseOp)
+	}
+	if err := m.routePointsFromEnv(); err != nil {
+		return nil, err
+	}
+	if err := m.routeSurchargesFromEnv(); err != nil {
+		return nil, err
+	}
+	if m.errorCharges, err = errorChargePolicyFromEnv(); err != nil {
+		return nil, err
+	}
+	lookupPlan := func(ctx context.Context, userID string) (string, error) {
+		return m.client(ctx).GetUserPlan(ctx, userID)
+	}
+	m.rateLimiter = NewRateLimiter(plans, lookupPlan, metrics)
+	m.concurrency = NewConcurrencyLimiter(plans, lookupPlan, metrics)
+	return m, nil
+}
+
+// failureModeFromEnv reads FIREBASE_FAILURE_MODE. In "open" mode requests are
+// served when the balance check fails; in "closed" mode (the default) they are
+// rejected with 503.
+func failureModeFromEnv() (bool, error) {
+	mode := os.Getenv("FIREBASE_FAILURE_MODE")
+	switch mode {
+	case "", "closed":
+		logger().Info("Firebase failure mode configured", "mode", "closed")
+		return false, nil
+	case "open":
+		logger().Info("Firebase failure mode configured", "mode", "open")
+		return true, nil
+	default:
+		return false, fmt.Errorf("invalid FIREBASE_FAILURE_MODE %q: must be open or closed", mode)
+	}
+}
+
+// pointsExpiryIntervalFromEnv reads POINTS_EXPIRY_INTERVAL, how often expired
+// point grants are swept
+func pointsExpiryIntervalFromEnv() time.Duration {
+	interval := defaultPointsExpiryInterval
+	if raw := os.Getenv("POINTS_EXPIRY_INTERVAL"); raw != "" {
+		if d, err := time.ParseDuration(raw); err == nil && d > 0 {
+			interval = d
+		} else {
+			logger().Warn("invalid POINTS_EXPIRY_INTERVAL, using default", "value", raw, "default", interval)
+		}
+	}
+	return interval
+}
+
+// runPointsExpiry periodically expires unspent point grants, and balances
+// left unused for longer than STALE_POINTS_POLICY allows, until ctx is
+// cancelled. Every instance may run it; expiry is transactional per user.
+func runPointsExpiry(ctx context.Context, client *firebase.Client, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			expired, err := client.ExpirePoints(ctx)
+			if err != nil {
+				logger().Error("failed to expire points", "error", err)
+			}
+			if expired > 0 {
+				logger().Info("points expiry completed", "expired_points", expired)
+			}
+			stale, err := client.ExpireStalePoints(ctx)
+			if err != nil {
+				logger().Error("failed to expire stale points", "error", err)
+			}
+			if stale > 0 {
+				logger().Info("stale points expiry completed", "expired_points", stale)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// upstreamTimeoutFromEnv reads UPSTREAM_TIMEOUT, clamped to maxUpstreamTimeout
+func upstreamTimeoutFromEnv() time.Duration {
+	timeout := defaultUpstreamTimeout
+	if raw := os.Getenv("UPSTREAM_TIMEOUT"); raw != "" {
+		if d, err := time.ParseDuration(raw); err == nil && d > 0 {
+			timeout = d
+		} else {
+			logger().Warn("invalid UPSTREAM_TIMEOUT, using default", "value", raw, "default", timeout)
+		}
+	}
+	if timeout > maxUpstreamTimeout {
+		logger().Warn("UPSTREAM_TIMEOUT exceeds maximum, clamping", "value", timeout, "max", maxUpstreamTimeout)
+		timeout = maxUpstreamTimeout
+	}
+	return timeout
+}
+
+// Shutdown stops accepting usage logs and flushes those still queued, and
+// any request counts and audit records they produce, within ctx's deadline.
+//
+// The hld daemon doesn't serve this middleware, so its signal handling in
+// cmd/hld never calls Shutdown; the server that embeds the middleware owns
+// the process lifecycle and must. On SIGTERM/SIGINT, call it once
+// http.Server.Shutdown has returned, so requests still in flight have
+// queued their logs, with a deadline inside the platform's termination
+// grace period. Cancelling the context passed to NewUsageMiddleware also
+// flushes the queue, but with no deadline and no error reported.
+func (m *UsageMiddleware) Shutdown(ctx context.Context) error {
+	if m.usageLogger == nil {
+		return nil
+	}
+	if err := m.usageLogger.Shutdown(ctx); err != nil {
+		return err
+	}
+	if err := m.requestCounter.Flush(ctx); err != nil {
+		return err
+	}
+	if err := m.audit.Flush(ctx); err != nil {
+		return err
+	}
+	if m.postgresUsage != nil {
+		return m.postgresUsage.Close()
+	}
+	return nil
+}
+
+// SetCheckoutLinkFunc configures a generator for per-user checkout links that
+// takes precedence over PURCHASE_URL in insufficient points responses
+func (m *UsageMiddleware) SetCheckoutLinkFunc(fn CheckoutLinkFunc) {
+	m.checkoutLink = fn
 }
 
-// CheckAuth middleware verifies Firebase token and checks points balance
+// CheckAuth middleware verifies Firebase token and checks points balance.
+// The points it holds are settled by TrackUsage, or released once next
+// returns on routes TrackUsage doesn't wrap.
 func (m *UsageMiddleware) CheckAuth(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// Skip if usage tracking is disabled
-		if !m.enabled {
+		if m.instruments != nil {
+			rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+			defer func() { m.instruments.request(requestRoute(r), rec.status) }()
+			w = rec
+		}
+		if r, ok := m.checkAuth(w, r); ok {
 			next.ServeHTTP(w, r)
-			return
+			m.releaseUnclaimedHold(r)
 		}
+	})
+}
 
-		// Extract Authorization header
-		authHeader := r.Header.Get("Authorization")
-		if authHeader == "" {
-			http.Error(w, `{"error":"missing_authorization","message":"Authorization header required"}`, http.StatusUnauthorized)
-			return
+// checkAuth authenticates r and reserves points for it, returning the
+// request with the caller in its context. When the request is refused it
+// writes the error response and returns ok=false. Requests that bypass
+// tracking are returned unchanged.
+func (m *UsageMiddleware) checkAuth(w http.ResponseWriter, r *http.Request) (*http.Request, bool) {
+	// Skip if usage tracking is disabled or the route is allowlisted
+	if !m.enabled || m.shouldSkip(r) {
+		return r, true
+	}
+	r = m.logSampler.apply(r)
+	log := requestLogger(r.Context())
+
+	// Refuse billable requests during maintenance before touching Firebase
+	if m.maintenance.refuse(w, r) {
+		log.Info("request refused during maintenance", "path", r.URL.Path)
+		return r, false
+	}
+
+	// Throttle IPs with repeated auth failures before touching Firebase
+	clientIP := getClientIP(r)
+	if m.authFailures != nil {
+		if allowed, wait := m.authFailures.check(clientIP); !allowed {
+			m.instruments.authFailure(apierror.CodeTooManyAuthFailures)
+			writeAuthThrottled(w, clientIP, wait)
+			return r, false
 		}
+	}
 
-		// Extract token
-		token := strings.TrimPrefix(authHeader, "Bearer ")
-		if token == authHeader {
-			http.Error(w, `{"error":"invalid_authorization","message":"Bearer token required"}`, http.StatusUnauthorized)
-			return
+	// Select the Firebase project for the request's tenant
+	if m.clients != nil {
+		client, ok := m.tenantClient(w, r)
+		if !ok {
+			return r, false
+		}
+		r = r.WithContext(context.WithValue(r.Context(), "firebase_client", client))
+	}
+	fb := m.client(r.Context())
+	if m.postgresUsage != nil && fb == m.firebaseClient {
+		r = r.WithContext(context.WithValue(r.Context(), "usage_store", m.postgresUsage))
+	}
+
+	// Resolve the caller from an API key or a Firebase ID token
+	caller, ok := m.authenticate(w, r)
+	if !ok {
+		if m.authFailures != nil {
+			m.authFailures.recordFailure(clientIP)
+		}
+		return r, false
+	}
+	userID, apiKey := caller.userID, caller.apiKey
+	caller.service = m.serviceAccounts.includes(caller)
+
+	// Optionally keep unverified accounts from spending free points
+	if !m.emailVerification.allows(caller, r) {
+		log.Warn("rejected unverified email",
+			"user_id", userID,
+			"provider", caller.signInProvider,
+			"path", r.URL.Path)
+		m.emailVerification.writeEmailNotVerified(w)
+		return r, false
+	}
+
+	// Reject requests the upstream would refuse before reading the
+	// balance or holding points
+	if m.validator.appliesTo(r) {
+		if errs := m.validator.validate(r); len(errs) > 0 {
+			log.Warn("rejected invalid messages request", "user_id", userID, "errors", errs)
+			writeSchemaErrors(w, errs)
+			return r, false
+		}
+	}
+
+	// Service accounts, such as monitoring probes, skip the balance
+	if caller.service {
+		log.Debug("service account authenticated", "user_id", userID, "path", r.URL.Path)
+		return serviceRequest(r, caller), true
+	}
+
+	// Anonymous trial users are held to the trial's model and request
+	// limits; their record is created on the first request
+	if caller.anonymous && !m.anonymous.admit(w, r, fb, userID) {
+		return r, false
+	}
+
+	// Get user's current points and account status in one read. Only
+	// the unreserved part of the balance counts towards this request.
+	balanceUnverified := false
+	points, reserved := 0, 0
+	account, err := fb.GetUserAccount(r.Context(), userID)
+	if err != nil {
+		if !m.failOpen || r.Context().Err() != nil {
+			log.Error("failed to get user points", "user_id", userID, "error", err)
+			writeError(w, http.StatusServiceUnavailable, APIError{
+				Code:    apierror.CodeBalanceUnavailable,
+				Message: "Failed to check balance",
+			})
+			return r, false
 		}
 
-		// Verify Firebase token
-		userID, err := m.firebaseClient.VerifyToken(r.Context(), token)
+		// Fail open: serve the request and reconcile billing later
+		log.Warn("balance check failed, failing open",
+			"user_id", userID,
+			"path", r.URL.Path,
+			"error", err)
+		balanceUnverified = true
+	} else {
+		points, reserved = account.SpendablePoints(), account.ReservedPoints
+	}
+
+	// Suspended and banned users keep their history but can't make requests
+	if account != nil && account.Status != firebase.UserStatusActive {
+		log.Warn("rejected blocked user", "user_id", userID, "status", account.Status)
+		writeAccountBlocked(w, account)
+		return r, false
+	}
+
+	// Plans may cap requests per day
+	if remaining, limited := m.plans.DailyRequestsRemaining(account); limited && remaining == 0 {
+		log.Warn("user reached daily request limit", "user_id", userID, "plan", account.Plan)
+		writeDailyRequestLimit(w, m.plans[account.Plan].MaxRequestsPerDay)
+		return r, false
+	}
+
+	// The balance needed for this route, at least minRequiredPoints
+	estimate, inputTokens := m.estimateRequest(r, userID)
+	if limit := m.plans.MaxInputTokens(account); limit > 0 && inputTokens > limit {
+		log.Warn("request exceeds plan input token limit",
+			"user_id", userID,
+			"plan", account.Plan,
+			"input_tokens", inputTokens,
+			"limit", limit)
+		writeError(w, http.StatusBadRequest, APIError{
+			Code:    apierror.CodePlanLimitExceeded,
+			Message: "The request's input exceeds your plan's per-request token limit",
+			Details: map[string]interface{}{"input_tokens": inputTokens, "limit": limit},
+		})
+		return r, false
+	}
+	estimate += m.requestSurcharge(r, estimate)
+	required := m.requiredPoints(r, estimate)
+
+	// First-time users signing in with a token have no record yet; grant
+	// them the starting balance. Users with a record and an empty balance
+	// are left alone, as InitializeUser never overwrites. A device cookie
+	// from an anonymous trial carries its remaining points over.
+	if !balanceUnverified && points < required && apiKey == nil && !caller.anonymous {
+		created, err := fb.InitializeUser(r.Context(), userID, caller.email, m.anonymous.initOptions(r)...)
 		if err != nil {
-			slog.Error("token verification failed", "error", err)
-			http.Error(w, `{"error":"invalid_token","message":"Authentication failed"}`, http.StatusUnauthorized)
-			return
+			log.Error("failed to initialize user", "user_id", userID, "error", err)
+		} else if created {
+			log.Info("initialized new user", "user_id", userID)
+			if points, err = fb.GetUserPoints(r.Context(), userID); err != nil {
+				log.Error("failed to get user points", "user_id", userID, "error", err)
+				writeError(w, http.StatusServiceUnavailable, APIError{
+					Code:    apierror.CodeBalanceUnavailable,
+					Message: "Failed to check balance",
+				})
+				return r, false
+			}
+		}
+	}
+
+	// Check if user has enough points
+	if !balanceUnverified && points < required {
+		// Points held by crashed requests are returned once the holds expire
+		if refreshed, err := fb.ReleaseExpiredHolds(r.Context(), userID); err == nil {
+			points = max(refreshed-reserved, 0)
+		} else if !errors.Is(err, firebase.ErrUserNotFound) {
+			log.Warn("failed to release expired holds", "user_id", userID, "error", err)
+		}
+	}
+	if !balanceUnverified && points < required {
+		log.Warn("user has insufficient points", "user_id", userID, "points", points, "required", required)
+		m.writeInsufficientPoints(w, r, userID, points, required)
+		return r, false
+	}
+
+	// Reserve the estimated cost so concurrent requests can't spend the
+	// same points. The hold is capped at the balance; TrackUsage charges
+	// any overage when it captures the actual cost.
+	holdID, holdAmount := "", 0
+	if !balanceUnverified {
+		amount := estimate
+		if amount > points {
+			amount = points
+		}
+
+		holdID, err = fb.HoldPoints(r.Context(), userID, amount)
+		holdAmount = amount
+		switch {
+		case errors.Is(err, firebase.ErrInsufficientPoints):
+			// Concurrent requests reserved the balance since it was read
+			log.Warn("user has insufficient points to hold", "user_id", userID, "points", points, "hold", amount)
+			m.writeInsufficientPoints(w, r, userID, points, amount)
+			return r, false
+		case errors.Is(err, firebase.ErrVelocityExceeded):
+			log.Warn("user exceeded spending velocity", "user_id", userID, "hold", amount)
+			retryAfter := int(firebase.VelocityWindow.Seconds())
+			w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+			writeError(w, http.StatusTooManyRequests, APIError{
+				Code:    apierror.CodeVelocityExceeded,
+				Message: "Spending too many points too quickly. Please slow down.",
+				Details: map[string]interface{}{"retry_after_seconds": retryAfter},
+			})
+			return r, false
+		case err != nil && (!m.failOpen || r.Context().Err() != nil):
+			log.Error("failed to hold points", "user_id", userID, "error", err)
+			writeError(w, http.StatusServiceUnavailable, APIError{
+				Code:    apierror.CodeBalanceUnavailable,
+				Message: "Failed to reserve points",
+			})
+			return r, false
+		case err != nil:
+			log.Warn("points hold failed, failing open",
+				"user_id", userID,
+				"path", r.URL.Path,
+				"error", err)
+			balanceUnverified = true
 		}
+	}
+
+	// Report the pre-request quota; see quota_headers.go
+	if !balanceUnverified {
+		setQuotaHeaders(w.Header(), account, points)
+	}
+
+	// Add user ID to context
+	ctx := context.WithValue(r.Context(), "user_id", userID)
+	ctx = context.WithValue(ctx, "user_points", points)
+	if account != nil {
+		ctx = context.WithValue(ctx, "requests_today", account.RequestsToday)
+	}
+	if apiKey != nil {
+		ctx = context.WithValue(ctx, "api_key", apiKey)
+	}
+	if caller.admin {
+		ctx = context.WithValue(ctx, "admin_claim", true)
+	}
+	if caller.impersonatorID != "" {
+		ctx = context.WithValue(ctx, "impersonator_id", caller.impersonatorID)
+	}
+	if balanceUnverified {
+		ctx = context.WithValue(ctx, "balance_unverified", true)
+	}
+	if holdID != "" {
+		ctx = context.WithValue(ctx, "points_hold", holdID)
+		ctx = context.WithValue(ctx, "points_held", holdAmount)
+		ctx = context.WithValue(ctx, "points_hold_claim", &holdClaim{})
+	}
+
+	log.Debug("user authenticated", 
+		"user_id", userID, 
+		"points", points,
+		"path", r.URL.Path)
+
+	// Continue to handler
+	return r.WithContext(ctx), true
+}
+
+// writeDailyRequestLimit sends the 429 for users who have made their plan's
+// daily requests, retryable once the day's counter rolls over at midnight
+func writeDailyRequestLimit(w http.ResponseWriter, limit int) {
+	now := time.Now()
+	midnight := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, now.Location())
+	retryAfter := int(midnight.Sub(now)/time.Second) + 1
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	writeError(w, http.StatusTooManyRequests, APIError{
+		Code:    apierror.CodeDailyRequestLimit,
+		Message: "Your plan's daily request limit has been reached",
+		Details: map[string]interface{}{"limit": limit, "retry_after_seconds": retryAfter},
+	})
+}
+
+// writeAccountBlocked sends the 403 for suspended or banned users. Only the
+// reason code is exposed; internal notes live in the admin audit log.
+func writeAccountBlocked(w http.ResponseWriter, account *firebase.UserAccount) {
+	apiErr := APIError{
+		Code:    apierror.CodeAccountSuspended,
+		Message: "This account has been suspended",
+	}
+	if account.Status == firebase.UserStatusBanned {
+		apiErr.Code = apierror.CodeAccountBanned
+		apiErr.Message = "This account has been banned"
+	}
+	if account.StatusReason != "" {
+		apiErr.Details = map[string]interface{}{"reason": account.StatusReason}
+	}
+	writeError(w, http.StatusForbidden, apiErr)
+}
 
-		// Get user's current points
-		points, err := m.firebaseClient.GetUserPoints(r.Context(), userID)
+// authCaller identifies the user behind a request
+type authCaller struct {
+	userID string
+	// email is taken from the ID token claims; empty for API keys
+	email          string
+	emailVerified  bool
+	signInProvider string
+	// admin is set by the token's admin custom claim
+	admin bool
+	// apiKey is set when the request authenticated with an API key
+	apiKey *firebase.APIKey
+	// anonymous is set for trial users admitted without credentials
+	anonymous bool
+	// service is set by the token's service_account custom claim
+	service bool
+	// impersonatorID is the admin acting as the user with an
+	// impersonation token
+	impersonatorID string
+}
+
+// authenticate resolves the caller from an API key, sent either in the
+// X-API-Key header or as "Authorization: ApiKey <key>", or otherwise from a
+// Firebase ID token or admin impersonation token sent as
+// "Authorization: Bearer <token>", or from a Firebase session cookie when no
+// Authorization header is sent. Callers with
+// no credentials at all become anonymous trial users when ALLOW_ANONYMOUS is
+// set. On failure it writes the error response and returns ok=false.
+func (m *UsageMiddleware) authenticate(w http.ResponseWriter, r *http.Request) (authCaller, bool) {
+	log := requestLogger(r.Context())
+
+	// API keys are used by server-to-server integrations
+	rawKey := r.Header.Get("X-API-Key")
+	if key, ok := strings.CutPrefix(r.Header.Get("Authorization"), "ApiKey "); ok && rawKey == "" {
+		rawKey = strings.TrimSpace(key)
+	}
+	if rawKey != "" {
+		key, err := m.client(r.Context()).VerifyAPIKey(r.Context(), rawKey)
 		if err != nil {
-			slog.Error("failed to get user points", "user_id", userID, "error", err)
-			http.Error(w, `{"error":"internal_error","message":"Failed to check balance"}`, http.StatusInternalServerError)
-			return
+			log.Warn("api key verification failed", "error", err)
+			m.instruments.authFailure(apierror.CodeInvalidAPIKey)
+			writeError(w, http.StatusUnauthorized, APIError{Code: apierror.CodeInvalidAPIKey, Message: "Authentication failed"})
+			return authCaller{}, false
 		}
+		return authCaller{userID: key.UserID, apiKey: key}, true
+	}
 
-		// Check if user has enough points (minimum 1)
-		if points < 1 {
-			slog.Warn("user has insufficient points", "user_id", userID, "points", points)
-			http.Error(w, `{"error":"insufficient_points","message":"Not enough points. Please purchase more."}`, http.StatusPaymentRequired)
-			return
+	// Extract Authorization header
+	authHeader := r.Header.Get("Authorization")
+	if authHeader == "" {
+		// Server-rendered pages authenticate with a Firebase session
+		// cookie instead; the header wins when both are sent
+		if cookie, err := r.Cookie(sessionCookieName); err == nil && cookie.Value != "" {
+			claims, err := m.client(r.Context()).VerifySessionCookie(r.Context(), cookie.Value)
+			if err != nil {
+				log.Error("session cookie verification failed", "error", err)
+				m.instruments.authFailure(apierror.CodeInvalidSession)
+				writeError(w, http.StatusUnauthorized, APIError{Code: apierror.CodeInvalidSession, Message: "Authentication failed"})
+				return authCaller{}, false
+			}
+			return callerFromClaims(claims), true
+		}
+		// Without any credentials, callers may get an anonymous trial
+		if m.anonymous != nil {
+			return m.anonymous.caller(w, r), true
 		}
+		m.instruments.authFailure(apierror.CodeMissingAuthorization)
+		writeError(w, http.StatusUnauthorized, APIError{Code: apierror.CodeMissingAuthorization, Message: "Authorization header required"})
+		return authCaller{}, false
+	}
 
-		// Add user ID to context
-		ctx := context.WithValue(r.Context(), "user_id", userID)
-		ctx = context.WithValue(ctx, "user_points", points)
+	// Extract token
+	token := strings.TrimPrefix(authHeader, "Bearer ")
+	if token == authHeader {
+		m.instruments.authFailure(apierror.CodeInvalidAuthorization)
+		writeError(w, http.StatusUnauthorized, APIError{Code: apierror.CodeInvalidAuthorization, Message: "Bearer token required"})
+		return authCaller{}, false
+	}
 
-		slog.Debug("user authenticated", 
-			"user_id", userID, 
-			"points", points,
+	// Admins debugging a user's setup act as the user with an
+	// impersonation token
+	if firebase.IsImpersonationToken(token) {
+		imp, err := m.client(r.Context()).VerifyImpersonationToken(r.Context(), token)
+		if err != nil {
+			log.Warn("impersonation token verification failed", "error", err)
+			m.instruments.authFailure(apierror.CodeInvalidToken)
+			writeError(w, http.StatusUnauthorized, APIError{Code: apierror.CodeInvalidToken, Message: "Authentication failed"})
+			return authCaller{}, false
+		}
+		log.Info("impersonated request",
+			"user_id", imp.TargetUserID,
+			"impersonator_id", imp.ImpersonatorID,
 			"path", r.URL.Path)
+		return authCaller{userID: imp.TargetUserID, impersonatorID: imp.ImpersonatorID}, true
+	}
+
+	// Verify Firebase token
+	claims, err := m.client(r.Context()).VerifyToken(r.Context(), token)
+	if err != nil {
+		log.Error("token verification failed", "error", err)
+		m.instruments.authFailure(apierror.CodeInvalidToken)
+		writeError(w, http.StatusUnauthorized, APIError{Code: apierror.CodeInvalidToken, Message: "Authentication failed"})
+		return authCaller{}, false
+	}
+
+	return callerFromClaims(claims), true
+}
+
+// callerFromClaims identifies a caller authenticated by an ID token or
+// session cookie
+func callerFromClaims(claims *firebase.TokenInfo) authCaller {
+	return authCaller{
+		userID:         claims.UID,
+		email:          claims.Email,
+		emailVerified:  claims.EmailVerified,
+		signInProvider: claims.SignInProvider,
+		admin:          claims.Admin,
+		service:        claims.ServiceAccount,
+	}
+}
 
-		// Continue to handler
-		next.ServeHTTP(w, r.WithContext(ctx))
+// writeInsufficientPoints sends a 402 with the user's balance and a link to
+// purchase more points
+func (m *UsageMiddleware) writeInsufficientPoints(w http.ResponseWriter, r *http.Request, userID string, balance, required int) {
+	details := map[string]interface{}{
+		"balance":         balance,
+		"required_points": required,
+		"shortfall":       required - balance,
+	}
+
+	purchaseURL := m.purchaseURL
+	if m.checkoutLink != nil {
+		link, err := m.checkoutLink(r.Context(), userID, required-balance)
+		if err != nil {
+			logger().Error("failed to create checkout link", "user_id", userID, "error", err)
+		} else if link != "" {
+			purchaseURL = link
+		}
+	}
+	if purchaseURL != "" {
+		details["purchase_url"] = purchaseURL
+	}
+
+	w.Header().Set("Retry-After", strconv.Itoa(int(m.insufficientRetryAfter.Seconds())))
+	writeError(w, http.StatusPaymentRequired, APIError{
+		Code:    apierror.CodeInsufficientPoints,
+		Message: "Not enough points. Please purchase more.",
+		Details: details,
 	})
 }
 
 // responseWriter wraps http.ResponseWriter to capture response
 type responseWriter struct {
 	http.ResponseWriter
-	statusCode int
-	body       []byte
+	statusCode  int
+	wroteHeader bool
+	// capture keeps the ends of the body to read usage and errors from;
+	// nil until the first write of a response that isn't a stream
+	capture *bodyCapture
+	// captureLimit is the bytes capture keeps from each end, zero for
+	// the default
+	captureLimit int
+	// size counts the body bytes written
+	size int64
+	// stream reads usage from successful event stream responses as
+	// they're written, so nothing of them is kept; nil for other responses
+	stream *streamUsageParser
+	// contentType is the Content-Type the handler set, before any sniffing
+	contentType string
+	// opaque is set for bodies that are neither JSON nor an event stream,
+	// which are counted but not kept
+	opaque bool
+	// clientCtx is the request's context, cancelled when the client goes
+	// away; see CloseNotify
+	clientCtx context.Context
+	// hijacked is set once the handler takes over the connection
+	hijacked bool
+	// sentFile is set when a file was sent with ReadFrom, uncaptured
+	sentFile bool
 }
 
 func (rw *responseWriter) WriteHeader(code int) {
 	rw.statusCode = code
+	if !rw.wroteHeader {
+		rw.detectContent()
+	}
+	rw.wroteHeader = true
 	rw.ResponseWriter.WriteHeader(code)
 }
 
 func (rw *responseWriter) Write(b []byte) (int, error) {
-	rw.body = append(rw.body, b...)
+	if !rw.wroteHeader {
+		rw.detectContent()
+	}
+	rw.wroteHeader = true
+	rw.size += int64(len(b))
+	if rw.stream != nil {
+		rw.stream.Write(b)
+	} else if !rw.opaque {
+		if rw.capture == nil {
+			rw.capture = newBodyCapture(rw.bodyCaptureLimit())
+		}
+		rw.capture.Write(b)
+	}
 	return rw.ResponseWriter.Write(b)
 }
 
+// detectContent decides how the body is read once the headers are final.
+// Usage is read from successful event streams as they are written; encoded
+// streams are decoded and read once complete instead. Bodies other than
+// JSON and event streams carry no usage and are only counted.
+func (rw *responseWriter) detectContent() {
+	rw.contentType = rw.Header().Get("Content-Type")
+	if !hasUsageContentType(rw.contentType) {
+		rw.opaque = true
+		return
+	}
+	success := rw.statusCode >= 200 && rw.statusCode < 300
+	if success && isEventStream(rw.contentType) && !isEncoded(rw.Header().Get("Content-Encoding")) {
+		rw.stream = &streamUsageParser{}
+	}
+}
+
+// bodyCaptureLimit returns the bytes to keep from each end of the body.
+// Compressed bodies can only be decoded from the start, so they are kept
+// whole up to the most decodeBody accepts.
+func (rw *responseWriter) bodyCaptureLimit() int {
+	if isEncoded(rw.Header().Get("Content-Encoding")) {
+		return maxDecodedBodySize / 2
+	}
+	if rw.captureLimit <= 0 {
+		return defaultResponseCaptureBytes
+	}
+	return rw.captureLimit
+}
+
+// Flush passes flushes through so streamed responses aren't held back,
+// including when the writer underneath is compressing
+func (rw *responseWriter) Flush() {
+	_ = http.NewResponseController(rw.ResponseWriter).Flush()
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (rw *responseWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
+
+// Hijack hands the connection to handlers that take it over, e.g. to
+// upgrade to a WebSocket. TrackUsage then logs the request unbilled.
+func (rw *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, brw, err := http.NewResponseController(rw.ResponseWriter).Hijack()
+	if err == nil {
+		rw.hijacked = true
+	}
+	return conn, brw, err
+}
+
+// ReadFrom lets files be sent with sendfile when the underlying writer
+// supports it. Those bytes aren't captured, since files carry no usage;
+// anything else is copied through Write so its usage is still read.
+func (rw *responseWriter) ReadFrom(src io.Reader) (int64, error) {
+	if rf, ok := rw.ResponseWriter.(io.ReaderFrom); ok && isFile(src) {
+		if !rw.wroteHeader {
+			rw.WriteHeader(rw.statusCode)
+		}
+		rw.sentFile = true
+		return rf.ReadFrom(src)
+	}
+	return io.Copy(writerOnly{rw}, src)
+}
+
+// Push passes HTTP/2 server pushes through to the underlying writer
+func (rw *responseWriter) Push(target string, opts *http.PushOptions) error {
+	if pusher, ok := rw.ResponseWriter.(http.Pusher); ok {
+		return pusher.Push(target, opts)
+	}
+	return http.ErrNotSupported
+}
+
+// writerOnly hides ReadFrom so io.Copy falls back to Write
+type writerOnly struct {
+	io.Writer
+}
+
+// isFile reports whether src is a file, or a section of one, that the
+// server could send with sendfile
+func isFile(src io.Reader) bool {
+	if lr, ok := src.(*io.LimitedReader); ok {
+		src = lr.R
+	}
+	_, ok := src.(*os.File)
+	return ok
+}
+
+// CloseNotify serves handlers still written against http.CloseNotifier,
+// which the wrapper would otherwise hide. The channel fires when the request
+// context is cancelled, which the server does when the client goes away.
+func (rw *responseWriter) CloseNotify() <-chan bool {
+	closed := make(chan bool, 1)
+	if rw.clientCtx != nil {
+		go func() {
+			<-rw.clientCtx.Done()
+			closed <- true
+		}()
+	}
+	return closed
+}
+
 // TrackUsage middleware logs API usage and deducts points
 func (m *UsageMiddleware) TrackUsage(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// Skip if usage tracking is disabled
-		if !m.enabled {
-			next.ServeHTTP(w, r)
-			return
-		}
+		m.trackUsage(w, r, next.ServeHTTP)
+	})
+}
 
-		// Get user ID from context (set by CheckAuth)
-		userID, ok := r.Context().Value("user_id").(string)
-		if !ok {
-			// User not authenticated, skip tracking
-			next.ServeHTTP(w, r)
-			return
-		}
+// trackUsage serves r with next, then bills and logs the usage the response
+// reports. next is only called if the request is let through; when it isn't
+// the error response has been written.
+func (m *UsageMiddleware) trackUsage(w http.ResponseWriter, r *http.Request, next func(http.ResponseWriter, *http.Request)) {
+	// Skip if usage tracking is disabled or the route is allowlisted
+	if !m.enabled || m.shouldSkip(r) {
+		next(w, r)
+		return
+	}
+	r = m.logSampler.apply(r)
+	log := requestLogger(r.Context())
 
-		// Read request body to extract model and token info
-		bodyBytes, err := io.ReadAll(r.Body)
-		if err != nil {
-			http.Error(w, "Failed to read request", http.StatusBadRequest)
-			return
-		}
-		
-		// Parse request
-		var reqBody map[string]interface{}
-		if err := json.Unmarshal(bodyBytes, &reqBody); err != nil {
-			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+	// Get user ID from context (set by CheckAuth)
+	userID, ok := r.Context().Value("user_id").(string)
+	if !ok {
+		// User not authenticated, skip tracking
+		next(w, r)
+		return
+	}
+
+	// Points reserved by CheckAuth, settled once the cost is known
+	holdID, _ := r.Context().Value("points_hold").(string)
+	if claim, ok := r.Context().Value("points_hold_claim").(*holdClaim); ok {
+		claim.take()
+	}
+
+	// Read request body to extract model and token info, refusing bodies
+	// too large to buffer
+	bodyBytes, err := io.ReadAll(http.MaxBytesReader(w, r.Body, m.bodyLimit()))
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		m.releaseHold(r.Context(), userID, holdID)
+		writeError(w, http.StatusRequestEntityTooLarge, APIError{
+			Code:    apierror.CodeRequestTooLarge,
+			Message: "Request body is too large",
+			Details: map[string]interface{}{"max_bytes": tooLarge.Limit},
+		})
+		return
+	}
+	if err != nil {
+		m.releaseHold(r.Context(), userID, holdID)
+		writeError(w, http.StatusBadRequest, APIError{Code: apierror.CodeInvalidRequest, Message: "Failed to read request"})
+		return
+	}
+	// Restore the body for the wrapped handler
+	restoreBody(r, bodyBytes)
+	
+	// Parse request. Upgrade requests, e.g. for a WebSocket, may have no
+	// body.
+	var reqBody map[string]interface{}
+	// Only Messages requests must be JSON; other routes may take uploads
+	// and forms, and are billed at the default model.
+	if len(bodyBytes) > 0 || (r.Header.Get("Upgrade") == "" && isMessagesRequest(r)) {
+		if err := json.Unmarshal(bodyBytes, &reqBody); err != nil && isMessagesRequest(r) {
+			m.releaseHold(r.Context(), userID, holdID)
+			writeError(w, http.StatusBadRequest, APIError{Code: apierror.CodeInvalidJSON, Message: "Request body must be valid JSON"})
 			return
 		}
+	}
 
-		// Get model from request
-		model, _ := reqBody["model"].(string)
-		if model == "" {
-			model = "claude-3-5-sonnet-20241022" // default
-		}
+	// Get model from request, falling back to the user's or plan's default.
+	// Aliases are resolved so usage is logged and priced by canonical ID.
+	model, _ := reqBody["model"].(string)
+	if model == "" {
+		model = m.defaultModel(r.Context(), userID)
+	}
+	model = firebase.ResolveModelAlias(model)
 
-		// Extract session ID from URL path
-		sessionID := "unknown"
-		parts := strings.Split(r.URL.Path, "/")
-		if len(parts) > 0 {
-			sessionID = parts[len(parts)-1]
-		}
+	// Extract session ID from URL path
+	sessionID := sessionIDFromPath(r.URL.Path)
 
-		// Start timing
-		startTime := time.Now()
+	// Service accounts aren't billed, so their sessions aren't charged
+	service := isServiceRequest(r)
 
-		// Wrap response writer to capture response
-		rw := &responseWriter{
-			ResponseWriter: w,
-			statusCode:     http.StatusOK,
-		}
+	// Sessions with a point budget are refused once it is spent,
+	// whatever the account balance
+	var session *firebase.SessionRecord
+	if !service {
+		session = m.sessionForBudget(r.Context(), userID, sessionID)
+	}
+	if session != nil && session.BudgetExhausted() {
+		m.releaseHold(r.Context(), userID, holdID)
+		log.Warn("session point budget exhausted",
+			"user_id", userID,
+			"session_id", sessionID,
+			"point_budget", *session.PointBudget,
+			"points_spent", session.PointsSpent)
+		writeSessionBudgetExhausted(w, sessionID, session)
+		return
+	}
 
-		// Call next handler
-		next.ServeHTTP(rw, r)
+	// Start timing
+	startTime := time.Now()
 
-		duration := time.Since(startTime)
+	// Wrap response writer to capture response
+	rw := &responseWriter{
+		ResponseWriter: w,
+		statusCode:     http.StatusOK,
+		captureLimit:   m.responseCaptureLimit(),
+		clientCtx:      r.Context(),
+	}
 
-		// Extract token usage from response
-		inputTokens := 0
-		outputTokens := 0
-		success := rw.statusCode >= 200 && rw.statusCode < 300
-		errorMsg := ""
+	// Call next handler with a deadline so a hung upstream can't hold
+	// this goroutine indefinitely
+	upstreamCtx, cancel := context.WithTimeout(r.Context(), m.upstreamTimeout)
+	m.serveHeld(rw, r.WithContext(upstreamCtx), next, userID, holdID)
+	timedOut := errors.Is(upstreamCtx.Err(), context.DeadlineExceeded)
+	cancel()
 
-		if success && len(rw.body) > 0 {
-			// Try to parse response to get token counts
-			var respBody map[string]interface{}
-			if err := json.Unmarshal(rw.body, &respBody); err == nil {
-				if usage, ok := respBody["usage"].(map[string]interface{}); ok {
-					if input, ok := usage["input_tokens"].(float64); ok {
-						inputTokens = int(input)
-					}
-					if output, ok := usage["output_tokens"].(float64); ok {
-						outputTokens = int(output)
-					}
-				}
-			}
-		} else if !success {
-			errorMsg = string(rw.body)
-		}
+	duration := time.Since(startTime)
+	m.latency.Observe(latencyEndpoint(r), model, duration)
+
+	// Extract token usage from response
+	inputTokens := 0
+	outputTokens := 0
+	// reported is the usage read from the response, with its prompt cache
+	// tokens
+	var reported tokenUsage
+	success := rw.statusCode >= 200 && rw.statusCode < 300 && !timedOut
+	errorMsg := ""
 
-		// Calculate points cost
-		pointsCost := firebase.CalculatePointsCost(model, inputTokens, outputTokens)
+	if timedOut {
+		// Timed out requests aren't billed; their hold is released below
+		log.Warn("upstream request timed out",
+			"user_id", userID,
+			"session_id", sessionID,
+			"timeout", m.upstreamTimeout,
+			"headers_sent", rw.wroteHeader)
+		errorMsg = "upstream timeout"
+		if !rw.wroteHeader && !rw.hijacked {
+			writeError(w, http.StatusGatewayTimeout, APIError{
+				Code:    apierror.CodeUpstreamTimeout,
+				Message: "The upstream request timed out",
+			})
+		}
+	}
 
-		// Deduct points
-		if success && pointsCost > 0 {
-			if err := m.firebaseClient.DeductPoints(r.Context(), userID, pointsCost); err != nil {
-				slog.Error("failed to deduct points", 
+	usageParsed := true
+	usageEstimated := false
+	// body is the response as read for usage, decoded if it was compressed;
+	// only the start of responses too large to keep whole
+	body := rw.capture.body()
+	bodySize := rw.size
+	// complete is the whole response, decoded, when it was kept; usage
+	// estimates fall back to its size otherwise
+	var complete []byte
+	streamIncomplete := false
+	// Responses replayed from the proxy's response cache used no tokens
+	cacheHit := success && rw.Header().Get(headerResponseCache) == "hit"
+	// Hijacked connections and sent files have no response to read usage
+	// from, so they aren't billed for tokens
+	unread := rw.hijacked || rw.sentFile
+	// Responses that are neither JSON nor event streams, such as file
+	// downloads, carry no usage and are billed a flat charge
+	opaque := rw.opaque && !unread
+	// Cached responses carry their original usage, read to price the
+	// replay at the cache rate
+	if success && rw.statusCode != http.StatusNoContent && !unread && !opaque {
+		if rw.stream != nil {
+			// Streams cut short are billed for the usage they reported
+			reported, usageParsed = rw.stream.usage()
+			inputTokens, outputTokens = reported.input, reported.output
+			if streamIncomplete = rw.stream.incomplete(); streamIncomplete {
+				log.Warn("event stream ended early or was malformed",
 					"user_id", userID,
-					"points", pointsCost,
-					"error", err)
-				// Don't fail the request, just log the error
+					"model", model,
+					"input_tokens", inputTokens,
+					"output_tokens", outputTokens,
+					"usage_seen", usageParsed)
+			}
+		} else if !rw.capture.complete() {
+			if isEncoded(rw.Header().Get("Content-Encoding")) {
+				log.Warn("compressed response too large to read usage",
+					"user_id", userID,
+					"model", model,
+					"body_bytes", rw.size)
+				usageParsed = false
+			} else {
+				reported, usageParsed = truncatedUsage(rw.capture.tail)
+				inputTokens, outputTokens = reported.input, reported.output
+			}
+		} else if decoded, err := decodeBody(rw.Header().Get("Content-Encoding"), body); err != nil {
+			// Handled like a response without usage. Only the copy is
+			// decoded; the client gets the bytes as sent.
+			log.Warn("could not decode response to read usage",
+				"user_id", userID,
+				"model", model,
+				"content_encoding", rw.Header().Get("Content-Encoding"),
+				"error", err)
+			usageParsed = false
+		} else {
+			body, bodySize = decoded, int64(len(decoded))
+			complete = body
+			reported, usageParsed = responseUsage(body)
+			inputTokens, outputTokens = reported.input, reported.output
+		}
+		if !usageParsed && !cacheHit {
+			m.reportUnparsedUsage(r.Context(), rw.Header().Get("Content-Type"), body, userID, model)
+			if in, out := m.usageEstimator.estimate(model, bodyBytes, complete, bodySize); in > 0 || out > 0 {
+				inputTokens, outputTokens, usageEstimated = in, out, true
+			}
+		}
+	} else if !success && !timedOut && opaque {
+		// Error pages from proxies and binary payloads aren't stored
+		errorMsg = fmt.Sprintf("%d %s (%s, %d bytes)", rw.statusCode, http.StatusText(rw.statusCode), rw.contentType, rw.size)
+	} else if !success && !timedOut {
+		errorMsg = errorMessage(body)
+		if rw.capture.complete() {
+			if decoded, err := decodeBody(rw.Header().Get("Content-Encoding"), body); err == nil {
+				errorMsg = errorMessage(decoded)
 			}
 		}
+	}
 
-		// Log usage
-		usageLog := firebase.UsageLog{
-			UserID:       userID,
-			SessionID:    sessionID,
-			Model:        model,
-			InputTokens:  inputTokens,
-			OutputTokens: outputTokens,
-			PointsCost:   pointsCost,
-			Timestamp:    startTime,
-			IPAddress:    getClientIP(r),
-			DurationMS:   duration.Milliseconds(),
-			Success:      success,
-			ErrorMessage: errorMsg,
+	// Failed requests are free unless CHARGE_ON_ERROR bills their class,
+	// e.g. for the prompt an overloaded upstream consumed before failing
+	billed := success
+	errClass := ""
+	if !success && !timedOut && !unread {
+		errClass = errorClass(rw.statusCode)
+		if mode := m.errorCharges.mode(errClass); mode != ErrorChargeNone {
+			inputTokens, outputTokens = errorUsage(mode, model, []byte(errorMsg), bodyBytes)
+			billed = true
 		}
+	}
+
+	// Calculate points cost at the user's contracted rates if they have
+	// them, charging the configured fallback when the usage couldn't be
+	// read or estimated
+	var pricing *firebase.PricingOverride
+	if !service {
+		pricing = m.pricingOverride(r.Context(), userID)
+	}
+	_, appliedPricing := firebase.PricingFor(model, pricing)
+	pointsCost := firebase.CalculatePointsCostFor(model, inputTokens, outputTokens, pricing)
+	if !usageParsed && !usageEstimated && !opaque && m.unparsedUsageCharge > 0 {
+		pointsCost = m.unparsedUsageCharge
+	}
+	if opaque && success {
+		pointsCost = m.opaqueResponseCost(model, pricing)
+	}
+
+	// Some routes cost extra on top of the token math
+	basePoints := pointsCost
+	surchargePoints := m.requestSurcharge(r, basePoints)
+	pointsCost += surchargePoints
+	if cacheHit {
+		// The replay used no tokens; only the cache rate is charged
+		pointsCost = m.cacheHitCost(pointsCost)
+		basePoints, surchargePoints = pointsCost, 0
+		inputTokens, outputTokens = 0, 0
+		reported = tokenUsage{}
+	}
+	if service || unread || (cacheHit && pointsCost == 0) {
+		pointsCost, basePoints, surchargePoints = 0, 0, 0
+		appliedPricing = nil
+	}
 
-		if err := m.firebaseClient.LogUsage(r.Context(), usageLog); err != nil {
-			slog.Error("failed to log usage", "error", err)
-			// Don't fail the request
+	// Deduct points
+	balanceUnverified, _ := r.Context().Value("balance_unverified").(bool)
+	deductionDeferred := false
+	if holdID != "" {
+		// Capture the actual cost, or release the hold for unbilled requests
+		charge := 0
+		if billed {
+			charge = pointsCost
+		}
+		if err := m.settleHold(r.Context(), userID, holdID, charge); err != nil {
+			log.Error("failed to settle points hold",
+				"user_id", userID,
+				"points", charge,
+				"error", err)
+		}
+	} else if billed && pointsCost > 0 {
+		if err := m.client(r.Context()).DeductPoints(r.Context(), userID, pointsCost); err != nil {
+			log.Error("failed to deduct points", 
+				"user_id", userID,
+				"points", pointsCost,
+				"error", err)
+			// Don't fail the request, just log the error. Requests let
+			// through by fail-open are flagged for reconciliation.
+			deductionDeferred = balanceUnverified
 		}
+	}
 
-		slog.Info("request completed",
-			"user_id", userID,
-			"model", model,
-			"input_tokens", inputTokens,
-			"output_tokens", outputTokens,
-			"points_cost", pointsCost,
-			"duration_ms", duration.Milliseconds(),
-			"success", success)
-	})
-}
+	if session != nil && billed {
+		m.chargeSession(r.Context(), sessionID, pointsCost)
+	}
+	if success && !balanceUnverified && !deductionDeferred && !service && !rw.hijacked {
+		m.setQuotaTrailers(r.Context(), w, userID)
+	}
+	if success && !rw.hijacked {
+		m.setPointsBreakdownTrailer(w, basePoints, surchargePoints)
+	}
+	if success {
+		m.instruments.usage(model, inputTokens, outputTokens, pointsCost)
+	}
+
+	// Log usage
+	usageLog := firebase.UsageLog{
+		UserID:       userID,
+		SessionID:    sessionID,
+		Model:        model,
+		InputTokens:  inputTokens,
+		OutputTokens: outputTokens,
+		PointsCost:   pointsCost,
+		Timestamp:    startTime,
+		IPAddress:    m.privacy.RedactIP(getClientIP(r)),
+		DurationMS:   duration.Milliseconds(),
+		Success:      success,
+		ErrorMessage: errorMsg,
+		Metadata:     usageMetadataFromHeaders(r.Header),
+
+		BasePoints:        basePoints,
+		SurchargePoints:   surchargePoints,
+		DeductionDeferred: deductionDeferred,
+		RequestID:         requestid.FromContext(r.Context()),
+		Anonymous:         firebase.IsAnonymousUser(userID),
+		TokensEstimated:   usageEstimated,
+		StreamIncomplete:  streamIncomplete,
+		Service:           service,
+		Pricing:           appliedPricing,
+		ErrorClass:        errClass,
 
-// getClientIP extracts the client's IP address from the request
-func getClientIP(r *http.Request) string {
-	// Check X-Forwarded-For header first (for proxies)
-	if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
-		ips := strings.Split(xff, ",")
-		return strings.TrimSpace(ips[0])
+		CacheCreationTokens: reported.cacheCreation,
+		CacheReadTokens:     reported.cacheRead,
 	}
-	
-	// Check X-Real-IP header
-	if xri := r.Header.Get("X-Real-IP"); xri != "" {
-		return xri
+	if opaque {
+		usageLog.ContentType, usageLog.ResponseBytes = rw.contentType, rw.size
 	}
-	
-	// Fall back to RemoteAddr
-	ip := r.RemoteAddr
-	if colon := strings.LastIndex(ip, ":"); colon != -1 {
-		ip = ip[:colon]
+	if holdID != "" {
+		usageLog.HoldID = holdID
+		usageLog.EstimatedCost, _ = r.Context().Value("points_held").(int)
 	}
-	
-	return ip
+	if impersonator := impersonatorID(r.Context()); impersonator != "" {
+		usageLog.Impersonated, usageLog.ImpersonatorID = true, impersonator
+	}
+	switch {
+	case cacheHit:
+		usageLog.CacheHit = true
+		usageLog.Reason = firebase.UsageReasonCacheHit
+	case rw.hijacked:
+		usageLog.Reason = firebase.UsageReasonConnectionHijacked
+	}
+
+	// Queue for background write so the response isn't held up by Firebase
+	m.usageLogger.EnqueueTo(usageStoreFromContext(r.Context(), m.client(r.Context())), usageLog)
+
+	log.Info("request completed",
+		"user_id", userID,
+		"model", model,
+		"input_tokens", inputTokens,
+		"output_tokens", outputTokens,
+		"points_cost", pointsCost,
+		"duration_ms", duration.Milliseconds(),
+		"success", success)
+}
+
+// serveHeld calls next for a request holding points. If next panics, the
+// hold is released before the panic continues, rather than keeping the
+// points from the user until it expires.
+func (m *UsageMiddleware) serveHeld(w http.ResponseWriter, r *http.Request, next func(http.ResponseWriter, *http.Request), userID, holdID string) {
+	defer func() {
+		if p := recover(); p != nil {
+			m.releaseHold(r.Context(), userID, holdID)
+			panic(p)
+		}
+	}()
+	next(w, r)
 }
 
+// releaseHold returns a request's held points when it won't be billed
+func (m *UsageMiddleware) releaseHold(ctx context.Context, userID, holdID string) {
+	if holdID == "" {
+		return
+	}
+	if err := m.settleHold(ctx, userID, holdID, 0); err != nil {
+		requestLogger(ctx).Error("failed to release points hold", "user_id", userID, "error", err)
+	}
+}
+
+// defaultModel resolves the model for a request that didn't name one: the
+// user's preference, then their plan's default, then firebase.DefaultModel
+func (m *UsageMiddleware) defaultModel(ctx context.Context, userID string) string {
+	model, err := m.client(ctx).GetUserDefaultModel(ctx, userID)
+	if err != nil {
+		logger().Warn("failed to get user default model", "user_id", userID, "error", err)
+	}
+	if model != "" {
+		return model
+	}
+
+	if len(m.plans) > 0 {
+		plan, err := m.client(ctx).GetUserPlan(ctx, userID)
+		if err != nil {
+			logger().Warn("failed to get user plan for default model", "user_id", userID, "error", err)
+		} else if p, ok := m.plans[plan]; ok && p.DefaultModel != "" {
+			return p.DefaultModel
+		}
+	}
 
+	return firebase.DefaultModel
+}
 
+// tenantClient resolves the request's tenant to its Firebase client. On
+// failure it writes the error response and returns ok=false.
+func (m *UsageMiddleware) tenantClient(w http.ResponseWriter, r *http.Request) (*firebase.Client, bool) {
+	tenantID, valid := m.tenants.resolve(r)
+	if !valid {
+		writeError(w, http.StatusBadRequest, APIError{
+			Code:    apierror.CodeInvalidTenant,
+			Message: "Malformed tenant ID",
+		})
+		return nil, false
+	}
 
+	client, err := m.clients.Get(r.Context(), tenantID)
+	if errors.Is(err, firebase.ErrUnknownTenant) {
+		writeError(w, http.StatusNotFound, APIError{
+			Code:    apierror.CodeUnknownTenant,
+			Message: "Unknown tenant",
+			Details: map[string]interface{}{"tenant_id": tenantID},
+		})
+		return nil, false
+	}
+	if err != nil {
+		logger().Error("failed to initialize tenant client", "tenant_id", tenantID, "error", err)
+		writeError(w, http.StatusServiceUnavailable, APIError{
+			Code:    apierror.CodeTenantUnavailable,
+			Message: "Failed to connect to tenant project",
+		})
+		return nil, false
+	}
+	return client, true
+}
@@ -0,0 +1,202 @@
+package middleware
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+
+	"your-project/hld/firebase"
+)
+
+// defaultBytesPerToken approximates how many response bytes make up an
+// output token for models without a configured ratio
+const defaultBytesPerToken = 4.0
+
+// TokenEstimator counts the tokens of text for model. It replaces the
+// built-in approximation used to estimate usage; see SetTokenEstimator.
+// Implementations must be safe for concurrent use.
+type TokenEstimator interface {
+	EstimateTokens(model string, text []byte) int
+}
+
+// usageEstimator estimates the usage of successful responses that don't
+// report it, so they aren't billed as zero tokens: input tokens from the
+// request's text and output tokens from the response's text, or from its
+// size at the bytes per token ratios when the text wasn't kept
+type usageEstimator struct {
+	defaultRatio float64
+	// ratios are bytes per token by resolved model name
+	ratios map[string]float64
+	// tokenizer counts text tokens; nil uses countTextTokens
+	tokenizer TokenEstimator
+}
+
+// SetTokenEstimator counts the text of estimated usage with t instead of
+// the built-in approximation, e.g. with a real tokenizer. It has no effect unless
+// USAGE_ESTIMATION is on. Must be called before the middleware starts
+// serving requests.
+func (m *UsageMiddleware) SetTokenEstimator(t TokenEstimator) {
+	if m.usageEstimator != nil {
+		m.usageEstimator.tokenizer = t
+	}
+}
+
+// usageEstimatorFromEnv reads USAGE_ESTIMATION and
+// USAGE_ESTIMATION_BYTES_PER_TOKEN, a comma separated list of model=ratio
+// pairs where the model "default" sets the ratio for unlisted models, e.g.
+// "default=4,claude-3-haiku=3.5". It returns nil unless USAGE_ESTIMATION is
+// "true".
+func usageEstimatorFromEnv() (*usageEstimator, error) {
+	if os.Getenv("USAGE_ESTIMATION") != "true" {
+		return nil, nil
+	}
+
+	e := &usageEstimator{defaultRatio: defaultBytesPerToken, ratios: make(map[string]float64)}
+	for _, item := range splitList(os.Getenv("USAGE_ESTIMATION_BYTES_PER_TOKEN")) {
+		model, raw, ok := strings.Cut(item, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid USAGE_ESTIMATION_BYTES_PER_TOKEN entry %q: expected model=ratio", item)
+		}
+		ratio, err := strconv.ParseFloat(strings.TrimSpace(raw), 64)
+		if err != nil || ratio <= 0 {
+			return nil, fmt.Errorf("invalid USAGE_ESTIMATION_BYTES_PER_TOKEN entry %q: ratio must be a positive number", item)
+		}
+		if model = strings.TrimSpace(model); model == "default" {
+			e.defaultRatio = ratio
+		} else {
+			e.ratios[firebase.ResolveModelAlias(model)] = ratio
+		}
+	}
+	return e, nil
+}
+
+// outputTokens estimates the output tokens of a response body of size
+// bytes from model. It returns 0 when estimation is off or the body is
+// empty.
+func (e *usageEstimator) outputTokens(model string, size int64) int {
+	if e == nil || size <= 0 {
+		return 0
+	}
+	ratio, ok := e.ratios[firebase.ResolveModelAlias(model)]
+	if !ok {
+		ratio = e.defaultRatio
+	}
+	return int(math.Ceil(float64(size) / ratio))
+}
+
+// textCounter returns the token count for model's text: the configured
+// tokenizer's, or the approximation CheckAuth sizes holds with
+func (e *usageEstimator) textCounter(model string) func(string) int {
+	if e.tokenizer == nil {
+		return countTextTokens
+	}
+	return func(s string) int {
+		return e.tokenizer.EstimateTokens(model, []byte(s))
+	}
+}
+
+// estimate estimates the usage of a request whose response didn't report
+// it. respBody is the complete response, or nil when only its size is
+// known. It returns zeros when estimation is off.
+func (e *usageEstimator) estimate(model string, reqBody, respBody []byte, respSize int64) (inputTokens, outputTokens int) {
+	if e == nil {
+		return 0, 0
+	}
+	inputTokens = e.inputTokens(model, reqBody)
+	if text := responseText(respBody); len(text) > 0 {
+		outputTokens = e.textCounter(model)(string(text))
+	} else {
+		outputTokens = e.outputTokens(model, respSize)
+	}
+	return inputTokens, outputTokens
+}
+
+// inputTokens estimates the input tokens of a Messages or chat request the
+// way its hold was estimated, with the text counted by textCounter. Bodies
+// that aren't requests are counted whole.
+func (e *usageEstimator) inputTokens(model string, body []byte) int {
+	if len(body) == 0 {
+		return 0
+	}
+	count := e.textCounter(model)
+	var req struct {
+		System   json.RawMessage `json:"system"`
+		Messages []Message       `json:"messages"`
+		Tools    json.RawMessage `json:"tools"`
+	}
+	if err := json.Unmarshal(body, &req); err != nil || req.Messages == nil {
+		return count(string(body))
+	}
+	return countRequestTokens(model, req.System, req.Messages, req.Tools, len(body), count)
+}
+
+// responseText returns the generated text of a JSON response or event
+// stream, in Anthropic or OpenAI form, or nil if it has none
+func responseText(body []byte) []byte {
+	if len(body) == 0 {
+		return nil
+	}
+	var resp struct {
+		Content []struct {
+			Text  string          `json:"text"`
+			Input json.RawMessage `json:"input"`
+		} `json:"content"`
+		Choices []struct {
+			Message struct {
+				Content string `json:"content"`
+			} `json:"message"`
+			Text string `json:"text"`
+		} `json:"choices"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return streamText(body)
+	}
+
+	var text []byte
+	for _, block := range resp.Content {
+		text = append(text, block.Text...)
+		if len(block.Input) > 0 {
+			text = append(text, block.Input...)
+		}
+	}
+	for _, choice := range resp.Choices {
+		text = append(append(text, choice.Message.Content...), choice.Text...)
+	}
+	return text
+}
+
+// streamText returns the text deltas of an event stream
+func streamText(body []byte) []byte {
+	var text []byte
+	for len(body) > 0 {
+		var line []byte
+		line, body, _ = bytes.Cut(body, []byte("\n"))
+		data, found := bytes.CutPrefix(bytes.TrimSpace(line), []byte("data:"))
+		if !found {
+			continue
+		}
+		var event struct {
+			Delta struct {
+				Text        string `json:"text"`
+				PartialJSON string `json:"partial_json"`
+			} `json:"delta"`
+			Choices []struct {
+				Delta struct {
+					Content string `json:"content"`
+				} `json:"delta"`
+			} `json:"choices"`
+		}
+		if json.Unmarshal(bytes.TrimSpace(data), &event) != nil {
+			continue
+		}
+		text = append(append(text, event.Delta.Text...), event.Delta.PartialJSON...)
+		for _, choice := range event.Choices {
+			text = append(text, choice.Delta.Content...)
+		}
+	}
+	return text
+}
@@ -0,0 +1,164 @@
+package middleware
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"your-project/hld/firebase"
+)
+
+func TestUsageEstimatorFromEnv(t *testing.T) {
+	t.Setenv("USAGE_ESTIMATION", "")
+	e, err := usageEstimatorFromEnv()
+	require.NoError(t, err)
+	assert.Nil(t, e)
+
+	t.Setenv("USAGE_ESTIMATION", "true")
+	t.Setenv("USAGE_ESTIMATION_BYTES_PER_TOKEN", "default=5, claude-3-haiku-20240307=2.5")
+	e, err = usageEstimatorFromEnv()
+	require.NoError(t, err)
+	assert.Equal(t, 5.0, e.defaultRatio)
+	assert.Equal(t, 2.5, e.ratios["claude-3-haiku-20240307"])
+
+	for _, raw := range []string{"default", "default=0", "claude=abc"} {
+		t.Setenv("USAGE_ESTIMATION_BYTES_PER_TOKEN", raw)
+		_, err = usageEstimatorFromEnv()
+		assert.Error(t, err, raw)
+	}
+}
+
+func TestUsageEstimatorOutputTokens(t *testing.T) {
+	e := &usageEstimator{
+		defaultRatio: defaultBytesPerToken,
+		ratios:       map[string]float64{"claude-3-haiku-20240307": 2},
+	}
+
+	// Rounded up
+	assert.Equal(t, 3, e.outputTokens("claude-3-opus-20240229", 10))
+	assert.Equal(t, 5, e.outputTokens("claude-3-haiku-20240307", 10))
+	assert.Zero(t, e.outputTokens("claude-3-haiku-20240307", 0))
+
+	var off *usageEstimator
+	assert.Zero(t, off.outputTokens("claude-3-opus-20240229", 10))
+}
+
+func TestUsageEstimatorInputTokens(t *testing.T) {
+	system := json.RawMessage(`"be brief"`)
+	messages := []Message{
+		{Role: "user", Content: json.RawMessage(`[{"type":"text","text":"hello there"},{"type":"image","source":{}}]`)},
+		{Role: "assistant", Content: json.RawMessage(`"hi"`)},
+	}
+	tools := json.RawMessage(`[{"name":"search","input_schema":{"type":"object"}}]`)
+	body, err := json.Marshal(map[string]interface{}{
+		"model": "claude-3-5-haiku-20241022", "system": system, "messages": messages, "tools": tools,
+	})
+	require.NoError(t, err)
+
+	// Without a tokenizer the estimate matches the hold's
+	e := &usageEstimator{defaultRatio: defaultBytesPerToken}
+	hold := estimateInputTokens("claude-3-5-haiku-20241022", system, messages, tools, len(body))
+	assert.Equal(t, hold, e.inputTokens("claude-3-5-haiku-20241022", body))
+
+	// A tokenizer only replaces the text count
+	e.tokenizer = wordTokenizer{}
+	want := requestOverheadTokens + 2*messageOverheadTokens + imageTokens + len([]string{"be", "brief", "hello", "there", "hi"}) + 1
+	assert.Equal(t, want, e.inputTokens("claude-3-5-haiku-20241022", body))
+
+	// Bodies that aren't requests are counted whole
+	assert.Equal(t, 2, e.inputTokens("claude-3-5-haiku-20241022", []byte("plain text")))
+	assert.Zero(t, e.inputTokens("claude-3-5-haiku-20241022", nil))
+}
+
+func TestResponseText(t *testing.T) {
+	assert.Equal(t, `Hi there{"q":1}`, string(responseText([]byte(
+		`{"content":[{"type":"text","text":"Hi there"},{"type":"tool_use","input":{"q":1}}]}`))))
+	assert.Equal(t, "Hello", string(responseText([]byte(`{"choices":[{"message":{"content":"Hello"}}]}`))))
+	assert.Equal(t, "Hi", string(responseText([]byte(testStream))))
+	assert.Empty(t, responseText([]byte(`{"id":"msg_1"}`)))
+	assert.Empty(t, responseText(nil))
+}
+
+// wordTokenizer counts space separated words, standing in for a real
+// tokenizer
+type wordTokenizer struct{}
+
+func (wordTokenizer) EstimateTokens(_ string, text []byte) int {
+	return len(strings.Fields(string(text)))
+}
+
+func TestTrackUsageEstimatesMissingUsage(t *testing.T) {
+	m := newTestTrackingMiddleware()
+	m.usageEstimator = &usageEstimator{defaultRatio: defaultBytesPerToken}
+	m.SetTokenEstimator(wordTokenizer{})
+	store := &usageRecorder{}
+	m.usageLogger = firebase.NewAsyncLogger(store)
+	handler := m.TrackUsage(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"content":[{"type":"text","text":"one two three"}]}`))
+	}))
+
+	req := authenticatedRequest(`{"model":"claude-3-5-haiku-20241022","messages":[{"role":"user","content":"four five"}]}`)
+	ctx := context.WithValue(req.Context(), "service_account", true)
+	ctx = context.WithValue(ctx, "usage_store", firebase.UsageStore(store))
+	handler.ServeHTTP(httptest.NewRecorder(), req.WithContext(ctx))
+
+	require.NoError(t, m.usageLogger.Shutdown(context.Background()))
+	require.Len(t, store.logs, 1)
+	assert.True(t, store.logs[0].TokensEstimated)
+	assert.Equal(t, requestOverheadTokens+messageOverheadTokens+2, store.logs[0].InputTokens)
+	assert.Equal(t, 3, store.logs[0].OutputTokens)
+
+	data, err := json.Marshal(store.logs[0])
+	require.NoError(t, err)
+	assert.Contains(t, string(data), `"tokens_estimated":true`)
+}
+
+func TestTrackUsageEstimationOff(t *testing.T) {
+	m := newTestTrackingMiddleware()
+	m.SetTokenEstimator(wordTokenizer{})
+	store := &usageRecorder{}
+	m.usageLogger = firebase.NewAsyncLogger(store)
+	handler := m.TrackUsage(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"content":[{"type":"text","text":"one two three"}]}`))
+	}))
+
+	req := authenticatedRequest(`{"model":"claude-3-5-haiku-20241022","messages":[{"role":"user","content":"four five"}]}`)
+	ctx := context.WithValue(req.Context(), "service_account", true)
+	ctx = context.WithValue(ctx, "usage_store", firebase.UsageStore(store))
+	handler.ServeHTTP(httptest.NewRecorder(), req.WithContext(ctx))
+
+	require.NoError(t, m.usageLogger.Shutdown(context.Background()))
+	require.Len(t, store.logs, 1)
+	assert.False(t, store.logs[0].TokensEstimated)
+	assert.Zero(t, store.logs[0].InputTokens)
+	assert.Zero(t, store.logs[0].OutputTokens)
+}
+
+// BenchmarkUsageEstimatorInputTokens estimates a 100KB prompt, which must
+// stay within a few milliseconds
+func BenchmarkUsageEstimatorInputTokens(b *testing.B) {
+	e := &usageEstimator{defaultRatio: defaultBytesPerToken}
+	var messages []Message
+	for size := 0; size < 100<<10; size += 1 << 10 {
+		content, _ := json.Marshal(strings.Repeat("lorem ipsum ", 85))
+		messages = append(messages, Message{Role: "user", Content: content})
+	}
+	body, _ := json.Marshal(map[string]interface{}{"model": "claude-3-5-haiku-20241022", "messages": messages})
+
+	b.SetBytes(int64(len(body)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if e.inputTokens("claude-3-5-haiku-20241022", body) == 0 {
+			b.Fatal("no tokens estimated")
+		}
+	}
+}
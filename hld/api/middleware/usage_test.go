@@ -0,0 +1,331 @@
+package middleware
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"your-project/hld/firebase"
+)
+
+// newTestTrackingMiddleware returns an enabled middleware whose usage logs are
+// queued but never written
+func newTestTrackingMiddleware() *UsageMiddleware {
+	return &UsageMiddleware{
+		enabled:         true,
+		usageLogger:     firebase.NewAsyncLogger(nil),
+		metrics:         NewMetrics(),
+		upstreamTimeout: defaultUpstreamTimeout,
+	}
+}
+
+// authenticatedRequest builds a messages request as if CheckAuth had run
+func authenticatedRequest(body string) *http.Request {
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/anthropic_proxy/sess-1/v1/messages", strings.NewReader(body))
+	return req.WithContext(context.WithValue(req.Context(), "user_id", "user-1"))
+}
+
+func TestTrackUsageUpstreamTimeout(t *testing.T) {
+	m := newTestTrackingMiddleware()
+	m.upstreamTimeout = 20 * time.Millisecond
+
+	cancelled := make(chan struct{})
+	handler := m.TrackUsage(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Simulate a hung upstream that honours cancellation
+		<-r.Context().Done()
+		close(cancelled)
+	}))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, authenticatedRequest(`{"model":"claude-3-5-haiku-20241022"}`))
+
+	select {
+	case <-cancelled:
+	default:
+		t.Fatal("context cancellation did not reach the wrapped handler")
+	}
+	assert.Equal(t, http.StatusGatewayTimeout, w.Code)
+	assert.Contains(t, w.Body.String(), "upstream_timeout")
+}
+
+func TestTrackUsageWithinTimeout(t *testing.T) {
+	m := newTestTrackingMiddleware()
+
+	handler := m.TrackUsage(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, hasDeadline := r.Context().Deadline()
+		require.True(t, hasDeadline)
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(`{"error":"bad"}`))
+	}))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, authenticatedRequest(`{"model":"claude-3-5-haiku-20241022"}`))
+
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestAuthenticateHeaderTakesPrecedenceOverSessionCookie(t *testing.T) {
+	m := newTestTrackingMiddleware()
+
+	// The cookie is ignored when an Authorization header is sent
+	req := httptest.NewRequest(http.MethodGet, "/v1/me", nil)
+	req.Header.Set("Authorization", "Basic dXNlcjpwYXNz")
+	req.AddCookie(&http.Cookie{Name: sessionCookieName, Value: "cookie"})
+	w := httptest.NewRecorder()
+	_, ok := m.authenticate(w, req)
+	assert.False(t, ok)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Contains(t, w.Body.String(), "invalid_authorization")
+
+	// Without either, the header is reported missing
+	w = httptest.NewRecorder()
+	_, ok = m.authenticate(w, httptest.NewRequest(http.MethodGet, "/v1/me", nil))
+	assert.False(t, ok)
+	assert.Contains(t, w.Body.String(), "missing_authorization")
+}
+
+func TestTrackUsageDoesNotBillCacheHits(t *testing.T) {
+	m := newTestTrackingMiddleware()
+
+	// A billed request would deduct through the (nil) Firebase client
+	handler := m.TrackUsage(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(headerResponseCache, "hit")
+		_, _ = w.Write([]byte(`{"usage":{"input_tokens":100,"output_tokens":50}}`))
+	}))
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, authenticatedRequest(`{"model":"claude-3-5-haiku-20241022"}`))
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "hit", w.Header().Get(headerResponseCache))
+}
+
+func TestTrackUsageLogsCacheHits(t *testing.T) {
+	m := newTestTrackingMiddleware()
+	store := &usageRecorder{}
+	m.usageLogger = firebase.NewAsyncLogger(store)
+
+	handler := m.TrackUsage(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(headerResponseCache, "hit")
+		_, _ = w.Write([]byte(`{"usage":{"input_tokens":100,"output_tokens":50}}`))
+	}))
+	req := authenticatedRequest(`{"model":"claude-3-5-haiku-20241022"}`)
+	req = req.WithContext(context.WithValue(req.Context(), "usage_store", firebase.UsageStore(store)))
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	require.NoError(t, m.usageLogger.Shutdown(context.Background()))
+	require.Len(t, store.logs, 1)
+	assert.True(t, store.logs[0].CacheHit)
+	assert.Equal(t, firebase.UsageReasonCacheHit, store.logs[0].Reason)
+	assert.Zero(t, store.logs[0].InputTokens)
+	assert.Zero(t, store.logs[0].OutputTokens)
+	assert.Zero(t, store.logs[0].PointsCost)
+}
+
+func TestCacheHitCost(t *testing.T) {
+	m := &UsageMiddleware{}
+	assert.Zero(t, m.cacheHitCost(40))
+
+	m.cacheHitRate = 0.25
+	assert.Equal(t, 10, m.cacheHitCost(40))
+	// Rounded up, so a replay is never free at a non-zero rate
+	assert.Equal(t, 1, m.cacheHitCost(1))
+
+	t.Setenv("RESPONSE_CACHE_HIT_RATE", "2")
+	assert.Equal(t, 1.0, cacheHitRateFromEnv())
+}
+
+func TestTrackUsageStreamsEventsAsWritten(t *testing.T) {
+	t.Setenv("METRICS_ENABLED", "true")
+	m := newTestTrackingMiddleware()
+	m.instruments = instrumentsFromEnv(m.metrics)
+
+	// The handler holds the stream open after its first event until the
+	// client has received it
+	received := make(chan struct{})
+	sse := m.TrackUsage(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		events := strings.SplitAfter(testStream, "\n\n")
+		_, _ = w.Write([]byte(events[0]))
+		w.(http.Flusher).Flush()
+		select {
+		case <-received:
+		case <-time.After(5 * time.Second):
+			t.Error("first event was not delivered before the handler returned")
+		}
+		for _, event := range events[1:] {
+			_, _ = w.Write([]byte(event))
+			w.(http.Flusher).Flush()
+		}
+	}))
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Stand in for CheckAuth; service accounts are logged but not billed
+		ctx := context.WithValue(r.Context(), "user_id", "user-1")
+		ctx = context.WithValue(ctx, "service_account", true)
+		sse.ServeHTTP(w, r.WithContext(ctx))
+	}))
+	defer server.Close()
+
+	resp, err := http.Post(server.URL+"/v1/messages", "application/json",
+		strings.NewReader(`{"model":"claude-3-5-haiku-20241022"}`))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	reader := bufio.NewReader(resp.Body)
+	line, err := reader.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "event: message_start\n", line)
+	close(received)
+
+	// Drain the rest so the handler finishes and usage is recorded
+	for err == nil {
+		_, err = reader.ReadString('\n')
+	}
+	assert.Eventually(t, func() bool {
+		return m.instruments.tokens.Value("claude-3-5-haiku-20241022", "output") == 15
+	}, time.Second, 10*time.Millisecond)
+	assert.EqualValues(t, 25, m.instruments.tokens.Value("claude-3-5-haiku-20241022", "input"))
+}
+
+func TestResponseWriterCloseNotify(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	rw := &responseWriter{ResponseWriter: httptest.NewRecorder(), statusCode: http.StatusOK, clientCtx: ctx}
+	notify := rw.CloseNotify()
+
+	select {
+	case <-notify:
+		t.Fatal("notified before the client went away")
+	default:
+	}
+	cancel()
+	select {
+	case closed := <-notify:
+		assert.True(t, closed)
+	case <-time.After(time.Second):
+		t.Fatal("not notified when the request context was cancelled")
+	}
+}
+
+// usageRecorder is a UsageStore that keeps the logs written to it
+type usageRecorder struct {
+	firebase.UsageStore
+	logs []firebase.UsageLog
+}
+
+func (s *usageRecorder) LogUsageBatch(ctx context.Context, logs []firebase.UsageLog) error {
+	s.logs = append(s.logs, logs...)
+	return nil
+}
+
+func TestTrackUsageHijackedConnection(t *testing.T) {
+	m := newTestTrackingMiddleware()
+	store := &usageRecorder{}
+	m.usageLogger = firebase.NewAsyncLogger(store)
+
+	ws := m.TrackUsage(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, brw, err := http.NewResponseController(w).Hijack()
+		if !assert.NoError(t, err) {
+			return
+		}
+		defer conn.Close()
+		_, _ = brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+		_ = brw.Flush()
+	}))
+	served := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer close(served)
+		ctx := context.WithValue(r.Context(), "user_id", "user-1")
+		ctx = context.WithValue(ctx, "usage_store", firebase.UsageStore(store))
+		ws.ServeHTTP(w, r.WithContext(ctx))
+	}))
+	defer server.Close()
+
+	req, err := http.NewRequest(http.MethodPost, server.URL+"/ws", strings.NewReader(`{"model":"claude-3-5-haiku-20241022"}`))
+	require.NoError(t, err)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+
+	<-served
+	require.NoError(t, m.usageLogger.Shutdown(context.Background()))
+	require.Len(t, store.logs, 1)
+	assert.Equal(t, firebase.UsageReasonConnectionHijacked, store.logs[0].Reason)
+	assert.Zero(t, store.logs[0].PointsCost)
+	assert.True(t, store.logs[0].Success)
+}
+
+// readerFromRecorder is a recorder that can send files like the server's
+// own writer
+type readerFromRecorder struct {
+	*httptest.ResponseRecorder
+}
+
+func (r readerFromRecorder) ReadFrom(src io.Reader) (int64, error) {
+	return io.Copy(r.ResponseRecorder, src)
+}
+
+func TestResponseWriterReadFrom(t *testing.T) {
+	// Anything but a file is captured so its usage can be read
+	rec := readerFromRecorder{httptest.NewRecorder()}
+	rw := &responseWriter{ResponseWriter: rec, statusCode: http.StatusOK}
+	_, err := io.Copy(rw, strings.NewReader(`{"usage":{}}`))
+	require.NoError(t, err)
+	assert.Equal(t, `{"usage":{}}`, string(rw.capture.body()))
+	assert.False(t, rw.sentFile)
+
+	// Files go to the underlying writer so sendfile can be used, as when
+	// http.ServeContent copies a section of one
+	f, err := os.CreateTemp(t.TempDir(), "download")
+	require.NoError(t, err)
+	defer f.Close()
+	_, err = f.WriteString("file contents")
+	require.NoError(t, err)
+	_, err = f.Seek(0, io.SeekStart)
+	require.NoError(t, err)
+
+	rec = readerFromRecorder{httptest.NewRecorder()}
+	rw = &responseWriter{ResponseWriter: rec, statusCode: http.StatusOK}
+	_, err = io.CopyN(rw, f, int64(len("file contents")))
+	require.NoError(t, err)
+	assert.Empty(t, rw.capture.body())
+	assert.True(t, rw.sentFile)
+	assert.Equal(t, "file contents", rec.Body.String())
+}
+
+func TestTrackUsageHandlerPanic(t *testing.T) {
+	m, db, _ := newTestBillingMiddleware(t, 100)
+	holdID, err := m.firebaseClient.HoldPoints(context.Background(), "user-1", 10)
+	require.NoError(t, err)
+
+	ops := make(map[string]int)
+	m.firebaseClient.SetOpObserver(func(op string, err error, d time.Duration) {
+		ops[op]++
+	})
+
+	handler := m.TrackUsage(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic(http.ErrAbortHandler)
+	}))
+	req := authenticatedRequest(`{"model":"claude-3-5-haiku-20241022"}`)
+	req = req.WithContext(context.WithValue(req.Context(), "points_hold", holdID))
+
+	// The panic still reaches the server, which aborts the response
+	assert.PanicsWithValue(t, http.ErrAbortHandler, func() {
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	})
+
+	assert.Equal(t, 1, ops["ReleaseHold"], "the hold is released")
+	assert.Zero(t, ops["CapturePoints"], "nothing is billed")
+	points, holds := userBalance(t, db)
+	assert.Equal(t, 100, points)
+	assert.Zero(t, holds)
+}
@@ -0,0 +1,77 @@
+package middleware
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"your-project/hld/firebase"
+	"your-project/hld/internal/apierror"
+)
+
+// ListSessionsResponse is a page of a user's sessions
+type ListSessionsResponse struct {
+	Sessions []firebase.SessionRecord `json:"sessions"`
+	Total    int64                    `json:"total"`
+	Offset   int                      `json:"offset"`
+	Limit    int                      `json:"limit"`
+}
+
+// ListSessions handles GET /users/:id/sessions, listing the user's sessions
+// most recently active first. Users may list their own sessions and admins
+// anyone's.
+// Query params: status (active or expired), offset, limit.
+func (h *UserHandlers) ListSessions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, APIError{Code: apierror.CodeMethodNotAllowed, Message: "GET required"})
+		return
+	}
+
+	userID := r.PathValue("id")
+	if callerID, _ := r.Context().Value("user_id").(string); callerID != userID && !isAdmin(r.Context(), h.admins) {
+		writeError(w, http.StatusForbidden, APIError{
+			Code:    apierror.CodeForbidden,
+			Message: "Cannot list another user's sessions",
+		})
+		return
+	}
+
+	q := r.URL.Query()
+	filter := firebase.SessionFilter{Status: q.Get("status"), Limit: defaultListLimit}
+	switch filter.Status {
+	case "", firebase.SessionStatusActive, firebase.SessionStatusExpired:
+	default:
+		writeBadParam(w, "status", fmt.Errorf("must be active or expired"))
+		return
+	}
+	var err error
+	if raw := q.Get("offset"); raw != "" {
+		if filter.Offset, err = strconv.Atoi(raw); err != nil || filter.Offset < 0 {
+			writeBadParam(w, "offset", fmt.Errorf("must be a non-negative integer"))
+			return
+		}
+	}
+	if raw := q.Get("limit"); raw != "" {
+		if filter.Limit, err = strconv.Atoi(raw); err != nil || filter.Limit < 1 || filter.Limit > maxListLimit {
+			writeBadParam(w, "limit", fmt.Errorf("must be between 1 and %d", maxListLimit))
+			return
+		}
+	}
+
+	sessions, total, err := h.client(r).ListSessionsByUser(r.Context(), userID, filter)
+	if err != nil {
+		logger().Error("failed to list sessions", "user_id", userID, "error", err)
+		writeError(w, http.StatusInternalServerError, APIError{
+			Code:    apierror.CodeInternalError,
+			Message: "Failed to list sessions",
+		})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, ListSessionsResponse{
+		Sessions: sessions,
+		Total:    total,
+		Offset:   filter.Offset,
+		Limit:    filter.Limit,
+	})
+}
@@ -0,0 +1,53 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"your-project/hld/firebase"
+	"your-project/hld/internal/apierror"
+)
+
+func sessionsRequest(target, pathID, callerID string) *http.Request {
+	req := httptest.NewRequest(http.MethodGet, target, nil)
+	req.SetPathValue("id", pathID)
+	return req.WithContext(context.WithValue(req.Context(), "user_id", callerID))
+}
+
+func TestListSessionsOwnOrAdmin(t *testing.T) {
+	h := NewUserHandlers(nil)
+
+	w := httptest.NewRecorder()
+	h.ListSessions(w, sessionsRequest("/users/user-2/sessions", "user-2", "user-1"))
+	assertEnvelope(t, w, http.StatusForbidden, apierror.CodeForbidden)
+
+	// Admins get past the ownership check to parameter validation
+	req := sessionsRequest("/users/user-2/sessions?status=bogus", "user-2", "admin-1")
+	req = req.WithContext(context.WithValue(req.Context(), "admin_claim", true))
+	w = httptest.NewRecorder()
+	h.ListSessions(w, req)
+	assertEnvelope(t, w, http.StatusBadRequest, apierror.CodeInvalidParameter)
+
+	// but not through an API key
+	req = req.WithContext(context.WithValue(req.Context(), "api_key", &firebase.APIKey{}))
+	w = httptest.NewRecorder()
+	h.ListSessions(w, req)
+	assertEnvelope(t, w, http.StatusForbidden, apierror.CodeForbidden)
+
+	w = httptest.NewRecorder()
+	h.ListSessions(w, httptest.NewRequest(http.MethodPost, "/users/user-1/sessions", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+}
+
+func TestListSessionsRejectsBadPaging(t *testing.T) {
+	h := NewUserHandlers(nil)
+	for _, query := range []string{"offset=-1", "limit=0", "limit=abc"} {
+		w := httptest.NewRecorder()
+		h.ListSessions(w, sessionsRequest("/users/user-1/sessions?"+query, "user-1", "user-1"))
+		assertEnvelope(t, w, http.StatusBadRequest, apierror.CodeInvalidParameter)
+	}
+}
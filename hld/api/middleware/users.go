@@ -0,0 +1,85 @@
+package middleware
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"your-project/hld/firebase"
+	"your-project/hld/internal/apierror"
+)
+
+// UserHandlers exposes self-service endpoints for authenticated users
+type UserHandlers struct {
+	firebaseClient *firebase.Client
+	// admins are the ADMIN_UIDS allowed to read any user's data, besides
+	// holders of the admin claim
+	admins map[string]bool
+}
+
+// NewUserHandlers creates user handlers for the given Firebase client
+func NewUserHandlers(fbClient *firebase.Client) *UserHandlers {
+	return &UserHandlers{firebaseClient: fbClient, admins: adminUIDsFromEnv()}
+}
+
+// client returns the Firebase client for the request's tenant
+func (h *UserHandlers) client(r *http.Request) *firebase.Client {
+	return clientFromContext(r.Context(), h.firebaseClient)
+}
+
+// RegisterRoutes mounts the user endpoints on mux
+func (h *UserHandlers) RegisterRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("/users/{id}/preferences", h.UpdatePreferences)
+	mux.HandleFunc("/users/{id}/ledger", h.Ledger)
+	mux.HandleFunc("/users/{id}/sessions", h.ListSessions)
+	mux.HandleFunc("/sessions/{id}/budget", h.SetSessionBudget)
+	mux.HandleFunc("/api-keys", h.APIKeys)
+	mux.HandleFunc("/api-keys/{id}", h.RevokeAPIKey)
+}
+
+// UpdatePreferences handles PATCH /users/:id/preferences. Users may only
+// update their own preferences.
+func (h *UserHandlers) UpdatePreferences(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPatch {
+		writeError(w, http.StatusMethodNotAllowed, APIError{Code: apierror.CodeMethodNotAllowed, Message: "PATCH required"})
+		return
+	}
+
+	userID := r.PathValue("id")
+	if callerID, _ := r.Context().Value("user_id").(string); callerID != userID {
+		writeError(w, http.StatusForbidden, APIError{
+			Code:    apierror.CodeForbidden,
+			Message: "Cannot update another user's preferences",
+		})
+		return
+	}
+
+	var prefs firebase.UserPreferences
+	if err := json.NewDecoder(r.Body).Decode(&prefs); err != nil {
+		writeError(w, http.StatusBadRequest, APIError{
+			Code:    apierror.CodeInvalidRequest,
+			Message: "Invalid JSON body",
+		})
+		return
+	}
+	if prefs.DefaultModel != "" && !firebase.IsKnownModel(prefs.DefaultModel) {
+		writeError(w, http.StatusBadRequest, APIError{
+			Code:    apierror.CodeUnknownModel,
+			Message: "default_model is not a supported model",
+			Details: map[string]interface{}{"model": prefs.DefaultModel},
+		})
+		return
+	}
+	prefs.DefaultModel = firebase.ResolveModelAlias(prefs.DefaultModel)
+
+	if err := h.client(r).SetUserPreferences(r.Context(), userID, prefs); err != nil {
+		logger().Error("failed to update preferences", "user_id", userID, "error", err)
+		writeError(w, http.StatusInternalServerError, APIError{
+			Code:    apierror.CodeInternalError,
+			Message: "Failed to update preferences",
+		})
+		return
+	}
+
+	logger().Info("user preferences updated", "user_id", userID, "default_model", prefs.DefaultModel)
+	writeJSON(w, http.StatusOK, prefs)
+}
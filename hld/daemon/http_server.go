@@ -142,6 +142,12 @@ func (s *HTTPServer) Start(ctx context.Context) error {
 
 	// Register lightweight API-only session endpoint (no Claude CLI launch)
 	v1.POST("/api_sessions", s.apiSessionHandlers.CreateAPISession)
+	v1.POST("/sessions/batch", s.apiSessionHandlers.BatchCreateAPISessions)
+	v1.POST("/api_sessions/:id/finalize", s.apiSessionHandlers.FinalizeAPISession)
+
+	// Register session clone and fork endpoints
+	v1.POST("/sessions/:id/clone", s.sessionHandlers.CloneSession)
+	v1.POST("/sessions/:id/fork", s.sessionHandlers.ForkSession)
 
 	// MCP endpoint (Phase 5: with event-driven approvals)
 	mcpServer := mcp.NewMCPServer(s.approvalManager, s.eventBus)
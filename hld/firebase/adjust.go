@@ -0,0 +1,139 @@
+package firebase
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/humanlayer/humanlayer/hld/internal/requestid"
+)
+
+// AdjustmentTypeAdminSet marks an adjustment that set the balance to an
+// exact value rather than applying a delta
+const AdjustmentTypeAdminSet = "admin_set"
+
+// PointsAdjustment records a manual credit or debit in the
+// admin_adjustments node
+type PointsAdjustment struct {
+	// ID is the adjustment's key, populated when returned. Type is
+	// AdjustmentTypeAdminSet for SetPoints, and empty for deltas.
+	ID            string    `json:"id,omitempty"`
+	Type          string    `json:"type,omitempty"`
+	UserID        string    `json:"user_id"`
+	ActorID       string    `json:"actor_id"`
+	Delta         int       `json:"delta"`
+	Reason        string    `json:"reason"`
+	BalanceBefore int       `json:"balance_before"`
+	BalanceAfter  int       `json:"balance_after"`
+	CreatedAt     time.Time `json:"created_at"`
+	// RequestID is the admin request that made the adjustment
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// adjust applies delta to u. Credits are non-expiring; debits use up the
+// soonest-to-expire grants first, like spending. A debit may take the
+// balance as low as -overdraftLimit but no lower. Callers expire grants
+// first.
+func (u *UserData) adjust(delta, overdraftLimit int) error {
+	if delta >= 0 {
+		u.Points += delta
+		return nil
+	}
+	if u.Points+delta < -overdraftLimit {
+		return fmt.Errorf("%w: balance %d, adjustment %d, limit %d", ErrOverdraftLimit, u.Points, delta, overdraftLimit)
+	}
+	u.consumePoints(-delta)
+	return nil
+}
+
+// AdjustPoints credits (positive delta) or debits (negative delta) a user's
+// balance on behalf of actorID and records the change, with reason and the
+// balances either side of it, in admin_adjustments. Debits past
+// POINTS_OVERDRAFT_LIMIT fail with ErrOverdraftLimit; unknown users with
+// ErrUserNotFound.
+//
+// The balance change is atomic. If only the adjustment record fails to
+// write, the applied adjustment is returned along with the error.
+func (c *Client) AdjustPoints(ctx context.Context, userID string, delta int, actorID, reason string) (_ *PointsAdjustment, err error) {
+	defer c.observe("AdjustPoints", c.opStart(), &err)
+	now := time.Now()
+	adj := &PointsAdjustment{
+		UserID:    userID,
+		ActorID:   actorID,
+		Delta:     delta,
+		Reason:    reason,
+		CreatedAt: now,
+		RequestID: requestid.FromContext(ctx),
+	}
+
+	balance, err := c.updateUser(ctx, userID, func(user *UserData) error {
+		// Expire first so before and after differ by exactly delta. The
+		// transaction may retry, so take the starting balance each time.
+		user.expireGrants(now)
+		adj.BalanceBefore = user.Points
+		return user.adjust(delta, c.overdraftLimit)
+	})
+	if err != nil {
+		return nil, err
+	}
+	adj.BalanceAfter = balance
+	c.cache.setPoints(userID, balance)
+	c.recordGrant(ctx, userID, "", PointGrant{Amount: delta, Source: GrantSourceAdjustment, GrantedAt: now})
+
+	if err := c.recordAdjustment(ctx, adj); err != nil {
+		return adj, err
+	}
+	return adj, nil
+}
+
+// SetPoints overwrites a user's balance with newBalance on behalf of
+// adminID, e.g. to correct an account for customer support, and records the
+// change as an AdjustmentTypeAdminSet adjustment with reason and the old and
+// new balances. Points added are non-expiring; points removed use up the
+// soonest-to-expire grants first. Unknown users fail with ErrUserNotFound.
+//
+// The balance change is atomic. If only the adjustment record fails to
+// write, the error is returned with the new balance in place.
+func (c *Client) SetPoints(ctx context.Context, userID string, newBalance int, adminID, reason string) (err error) {
+	defer c.observe("SetPoints", c.opStart(), &err)
+	if newBalance < 0 {
+		return fmt.Errorf("invalid balance: %d", newBalance)
+	}
+
+	now := time.Now()
+	adj := &PointsAdjustment{
+		Type:      AdjustmentTypeAdminSet,
+		UserID:    userID,
+		ActorID:   adminID,
+		Reason:    reason,
+		CreatedAt: now,
+		RequestID: requestid.FromContext(ctx),
+	}
+
+	balance, err := c.updateUser(ctx, userID, func(user *UserData) error {
+		user.expireGrants(now)
+		adj.BalanceBefore = user.Points
+		adj.Delta = newBalance - user.Points
+		return user.adjust(adj.Delta, c.overdraftLimit)
+	})
+	if err != nil {
+		return err
+	}
+	adj.BalanceAfter = balance
+	c.cache.setPoints(userID, balance)
+	c.recordGrant(ctx, userID, "", PointGrant{Amount: adj.Delta, Source: GrantSourceAdjustment, GrantedAt: now})
+
+	return c.recordAdjustment(ctx, adj)
+}
+
+// recordAdjustment writes adj to admin_adjustments under a new push ID,
+// which is set on adj
+func (c *Client) recordAdjustment(ctx context.Context, adj *PointsAdjustment) error {
+	adj.ID = newPushID(adj.CreatedAt)
+	record := *adj
+	record.ID = ""
+	if err := c.db.NewRef("admin_adjustments/"+adj.ID).Set(ctx, record); err != nil {
+		return fmt.Errorf("error recording adjustment: %w", err)
+	}
+	return nil
+}
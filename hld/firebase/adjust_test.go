@@ -0,0 +1,72 @@
+package firebase
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/humanlayer/humanlayer/hld/internal/requestid"
+)
+
+func TestAdjust(t *testing.T) {
+	now := time.Now()
+	user := &UserData{
+		Points: 100,
+		PointGrants: map[string]PointGrant{
+			"g1": {Amount: 30, Remaining: 30, GrantedAt: now, ExpiresAt: now.Add(time.Hour)},
+		},
+	}
+
+	require.NoError(t, user.adjust(50, 0))
+	assert.Equal(t, 150, user.Points)
+	assert.Equal(t, 30, user.PointGrants["g1"].Remaining, "credits don't expire")
+
+	// Debits spend grants first
+	require.NoError(t, user.adjust(-40, 0))
+	assert.Equal(t, 110, user.Points)
+	assert.Equal(t, 0, user.PointGrants["g1"].Remaining)
+
+	// The overdraft limit bounds how far below zero a debit may go
+	err := user.adjust(-120, 0)
+	assert.ErrorIs(t, err, ErrOverdraftLimit)
+	assert.Equal(t, 110, user.Points)
+
+	require.NoError(t, user.adjust(-120, 10))
+	assert.Equal(t, -10, user.Points)
+}
+
+func TestSetPointsRejectsNegativeBalance(t *testing.T) {
+	c := &Client{}
+	assert.Error(t, c.SetPoints(context.Background(), "u1", -1, "admin-1", "correction"))
+}
+
+func TestAdjustmentsRecordRequestID(t *testing.T) {
+	c, db := newTestClient(t)
+	db.Set(t, "users/u1", UserData{Points: 100, CreatedAt: time.Now()})
+	ctx := requestid.NewContext(context.Background(), "req-adjust")
+
+	adj, err := c.AdjustPoints(ctx, "u1", 25, "admin-1", "goodwill")
+	require.NoError(t, err)
+	assert.Equal(t, "req-adjust", adj.RequestID)
+	require.NoError(t, c.SetPoints(requestid.NewContext(ctx, "req-set"), "u1", 50, "admin-1", "correction"))
+
+	var adjustments map[string]PointsAdjustment
+	db.Get(t, "admin_adjustments", &adjustments)
+	require.Len(t, adjustments, 2)
+	assert.Equal(t, "req-adjust", adjustments[adj.ID].RequestID)
+	delete(adjustments, adj.ID)
+	for _, set := range adjustments {
+		assert.Equal(t, AdjustmentTypeAdminSet, set.Type)
+		assert.Equal(t, "req-set", set.RequestID)
+	}
+
+	// Each adjustment is also a ledger entry; the set lowered the balance,
+	// which isn't a credit
+	grants, err := c.GetPointGrants(ctx, "u1", time.Time{}, time.Time{})
+	require.NoError(t, err)
+	require.Len(t, grants, 1)
+	assert.Equal(t, "req-adjust", grants[0].RequestID)
+}
@@ -0,0 +1,48 @@
+package firebase
+
+import (
+	"context"
+	"fmt"
+)
+
+// adminClaim is the custom claim marking a user as an administrator
+const adminClaim = "admin"
+
+// hasAdminClaim reports whether token claims grant admin access, either as
+// "admin": true or "role": "admin"
+func hasAdminClaim(claims map[string]interface{}) bool {
+	if admin, _ := claims[adminClaim].(bool); admin {
+		return true
+	}
+	role, _ := claims["role"].(string)
+	return role == "admin"
+}
+
+// SetAdminClaim grants or revokes the admin custom claim, keeping the user's
+// other claims. The change applies once the user's ID token is refreshed,
+// which clients can force with getIdToken(true).
+func (c *Client) SetAdminClaim(ctx context.Context, userID string, admin bool) (err error) {
+	defer c.observe("SetAdminClaim", c.opStart(), &err)
+	user, err := c.auth.GetUser(ctx, userID)
+	if err != nil {
+		return fmt.Errorf("error getting user: %w", err)
+	}
+
+	claims := make(map[string]interface{}, len(user.CustomClaims)+1)
+	for k, v := range user.CustomClaims {
+		claims[k] = v
+	}
+	if admin {
+		claims[adminClaim] = true
+	} else {
+		delete(claims, adminClaim)
+		if claims["role"] == "admin" {
+			delete(claims, "role")
+		}
+	}
+
+	if err := c.auth.SetCustomUserClaims(ctx, userID, claims); err != nil {
+		return fmt.Errorf("error setting custom claims: %w", err)
+	}
+	return nil
+}
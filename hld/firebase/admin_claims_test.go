@@ -0,0 +1,15 @@
+package firebase
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHasAdminClaim(t *testing.T) {
+	assert.True(t, hasAdminClaim(map[string]interface{}{"admin": true}))
+	assert.True(t, hasAdminClaim(map[string]interface{}{"role": "admin"}))
+	assert.False(t, hasAdminClaim(map[string]interface{}{"admin": "true"}))
+	assert.False(t, hasAdminClaim(map[string]interface{}{"role": "support"}))
+	assert.False(t, hasAdminClaim(nil))
+}
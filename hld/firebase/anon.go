@@ -0,0 +1,181 @@
+package firebase
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"firebase.google.com/go/v4/db"
+)
+
+// AnonymousUserPrefix marks the user IDs of anonymous trial users. Their
+// records live under anon_users/{id} instead of users/{id} but are otherwise
+// ordinary user records, so holds and deductions work on them unchanged.
+const AnonymousUserPrefix = "anon:"
+
+// AnonymousPlan is the plan name recorded for anonymous trial users
+const AnonymousPlan = "anonymous"
+
+// AnonymousUserID returns the user ID of the anonymous trial for a device
+func AnonymousUserID(deviceID string) string {
+	return AnonymousUserPrefix + deviceID
+}
+
+// IsAnonymousUser reports whether userID belongs to an anonymous trial
+func IsAnonymousUser(userID string) bool {
+	return strings.HasPrefix(userID, AnonymousUserPrefix)
+}
+
+// userPath returns the database path of a user's record
+func userPath(userID string) string {
+	if deviceID, ok := strings.CutPrefix(userID, AnonymousUserPrefix); ok {
+		return "anon_users/" + deviceID
+	}
+	return "users/" + userID
+}
+
+// AnonymousTrial limits what an anonymous user may spend
+type AnonymousTrial struct {
+	// Requests is the total number of requests the trial admits
+	Requests int
+	// Points is the starting balance, charged like any other user's
+	Points int
+}
+
+// AdmitAnonymousRequest counts a request against an anonymous trial,
+// creating the trial record with trial.Points on first use. Fails with
+// ErrTrialExhausted once trial.Requests have been admitted or the trial has
+// been converted to an account.
+func (c *Client) AdmitAnonymousRequest(ctx context.Context, userID string, trial AnonymousTrial) (_ *UserData, err error) {
+	defer c.observe("AdmitAnonymousRequest", c.opStart(), &err)
+	if !IsAnonymousUser(userID) {
+		return nil, fmt.Errorf("not an anonymous user: %s", userID)
+	}
+
+	ref := c.db.NewRef(userPath(userID))
+	var admitted UserData
+	err = ref.Transaction(ctx, func(tn db.TransactionNode) (interface{}, error) {
+		var user *UserData
+		if err := tn.Unmarshal(&user); err != nil {
+			return nil, fmt.Errorf("error decoding user: %w", err)
+		}
+		if user == nil {
+			user = &UserData{
+				Points:    trial.Points,
+				Plan:      AnonymousPlan,
+				CreatedAt: time.Now(),
+			}
+		}
+		if err := user.admitTrialRequest(trial.Requests); err != nil {
+			return nil, err
+		}
+
+		admitted = *user
+		return user, nil
+	})
+	if err != nil {
+		c.cache.invalidate(userID)
+		return nil, err
+	}
+	return &admitted, nil
+}
+
+// admitTrialRequest counts one more trial request, up to limit
+func (u *UserData) admitTrialRequest(limit int) error {
+	if u.MigratedTo != "" {
+		return fmt.Errorf("%w: converted to an account", ErrTrialExhausted)
+	}
+	if u.TrialRequests >= limit {
+		return fmt.Errorf("%w: %d of %d requests used", ErrTrialExhausted, u.TrialRequests, limit)
+	}
+	u.TrialRequests++
+	return nil
+}
+
+// claimTrial empties an anonymous trial's balance for migration to userID
+// and returns the points taken. Points held by in-flight requests stay with
+// the trial. A trial can only be claimed once.
+func (u *UserData) claimTrial(userID string) int {
+	if u.MigratedTo != "" {
+		return 0
+	}
+	remaining := max(u.Points, 0)
+	u.Points = 0
+	u.MigratedTo = userID
+	return remaining
+}
+
+// MigrateAnonymousTrial moves the remaining balance of an anonymous trial to
+// the account userID and closes the trial, returning the points moved. A
+// trial already converted moves nothing.
+//
+// The two records can't share a transaction, so the trial is emptied first;
+// if crediting the account then fails, the points are lost and the error
+// reports how many.
+func (c *Client) MigrateAnonymousTrial(ctx context.Context, anonUserID, userID string) (_ int, err error) {
+	defer c.observe("MigrateAnonymousTrial", c.opStart(), &err)
+	if !IsAnonymousUser(anonUserID) || IsAnonymousUser(userID) {
+		return 0, fmt.Errorf("cannot migrate trial %s to %s", anonUserID, userID)
+	}
+
+	var moved int
+	if _, err := c.updateUser(ctx, anonUserID, func(user *UserData) error {
+		// The transaction may retry, so take the balance each time
+		moved = user.claimTrial(userID)
+		return nil
+	}); err != nil {
+		return 0, fmt.Errorf("error claiming trial %s: %w", anonUserID, err)
+	}
+	c.cache.setPoints(anonUserID, 0)
+	if moved == 0 {
+		return 0, nil
+	}
+
+	balance, err := c.updateUser(ctx, userID, func(user *UserData) error {
+		user.Points += moved
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("error crediting %d trial points to %s: %w", moved, userID, err)
+	}
+	c.cache.setPoints(userID, balance)
+	c.recordGrant(ctx, userID, "", PointGrant{Amount: moved, Source: GrantSourceTrial, GrantedAt: time.Now()})
+	return moved, nil
+}
+
+// InitOption changes how InitializeUser creates a user
+type InitOption func(*initOptions)
+
+type initOptions struct {
+	anonUserID string
+}
+
+// WithAnonymousTrial has InitializeUser convert the given anonymous trial
+// into the new account, moving its remaining points over
+func WithAnonymousTrial(anonUserID string) InitOption {
+	return func(o *initOptions) {
+		o.anonUserID = anonUserID
+	}
+}
+
+// migrateTrialOnInit runs the trial migration requested by opts for a newly
+// created user. A failed migration is logged rather than returned, since the
+// account itself was created.
+func (c *Client) migrateTrialOnInit(ctx context.Context, userID string, opts []InitOption) {
+	var o initOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.anonUserID == "" {
+		return
+	}
+
+	moved, err := c.MigrateAnonymousTrial(ctx, o.anonUserID, userID)
+	if err != nil {
+		slog.Error("failed to migrate anonymous trial", "user_id", userID, "anon_user_id", o.anonUserID, "error", err)
+		return
+	}
+	slog.Info("migrated anonymous trial", "user_id", userID, "anon_user_id", o.anonUserID, "points", moved)
+}
@@ -0,0 +1,50 @@
+package firebase
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUserPath(t *testing.T) {
+	assert.Equal(t, "users/abc", userPath("abc"))
+	assert.Equal(t, "anon_users/0123abcd", userPath(AnonymousUserID("0123abcd")))
+	assert.True(t, IsAnonymousUser(AnonymousUserID("0123abcd")))
+	assert.False(t, IsAnonymousUser("abc"))
+}
+
+func TestAdmitTrialRequest(t *testing.T) {
+	user := &UserData{}
+	require.NoError(t, user.admitTrialRequest(2))
+	require.NoError(t, user.admitTrialRequest(2))
+	assert.ErrorIs(t, user.admitTrialRequest(2), ErrTrialExhausted)
+	assert.Equal(t, 2, user.TrialRequests)
+
+	// Converted trials admit nothing more
+	converted := &UserData{MigratedTo: "user-1"}
+	assert.ErrorIs(t, converted.admitTrialRequest(2), ErrTrialExhausted)
+}
+
+func TestClaimTrial(t *testing.T) {
+	user := &UserData{Points: 30}
+	assert.Equal(t, 30, user.claimTrial("user-1"))
+	assert.Equal(t, 0, user.Points)
+	assert.Equal(t, "user-1", user.MigratedTo)
+
+	// A trial can only be claimed once
+	user.Points = 5
+	assert.Equal(t, 0, user.claimTrial("user-2"))
+	assert.Equal(t, "user-1", user.MigratedTo)
+}
+
+func TestCheapestModel(t *testing.T) {
+	assert.Equal(t, "claude-3-haiku-20240307", CheapestModel())
+}
+
+func TestUsageFilterExcludesAnonymous(t *testing.T) {
+	log := UsageLog{UserID: AnonymousUserID("d1"), Timestamp: time.Now(), Anonymous: true}
+	assert.False(t, UsageFilter{}.matches(log))
+	assert.True(t, UsageFilter{IncludeAnonymous: true}.matches(log))
+}
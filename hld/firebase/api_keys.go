@@ -0,0 +1,171 @@
+package firebase
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"firebase.google.com/go/v4/db"
+)
+
+// apiKeyPrefix identifies keys issued by this service
+const apiKeyPrefix = "ofk_"
+
+// apiKeyDisplayLength is how many characters of a key are kept in plain text
+// so users can tell their keys apart
+const apiKeyDisplayLength = len(apiKeyPrefix) + 8
+
+// apiKeyTouchInterval limits how often last_used_at is written, so busy keys
+// don't cost a database write per request
+const apiKeyTouchInterval = time.Minute
+
+// APIKey is the stored record for an API key. Only the SHA-256 hash of the
+// key is persisted; it doubles as the key ID under the api_keys node.
+type APIKey struct {
+	ID        string     `json:"id"`
+	UserID    string     `json:"user_id"`
+	Name      string     `json:"name,omitempty"`
+	Prefix    string     `json:"prefix"`
+	Scopes    []string   `json:"scopes,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	Revoked   bool       `json:"revoked"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+	// LastUsedAt is refreshed at most once per apiKeyTouchInterval
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+}
+
+// APIKeyOptions configures a newly generated API key
+type APIKeyOptions struct {
+	Name string
+	// Scopes restricts the key to the listed scopes; empty allows everything
+	Scopes []string
+	// TTL sets an expiry relative to creation; zero means the key never expires
+	TTL time.Duration
+}
+
+// GenerateAPIKey creates a new API key for a user. The plaintext key is only
+// returned here and cannot be recovered later.
+func (c *Client) GenerateAPIKey(ctx context.Context, userID string, opts APIKeyOptions) (_ string, _ *APIKey, err error) {
+	defer c.observe("GenerateAPIKey", c.opStart(), &err)
+	secret := make([]byte, 24)
+	if _, err := rand.Read(secret); err != nil {
+		return "", nil, fmt.Errorf("error generating api key: %w", err)
+	}
+	plaintext := apiKeyPrefix + hex.EncodeToString(secret)
+
+	key := &APIKey{
+		ID:        hashAPIKey(plaintext),
+		UserID:    userID,
+		Name:      opts.Name,
+		Prefix:    plaintext[:apiKeyDisplayLength],
+		Scopes:    opts.Scopes,
+		CreatedAt: time.Now(),
+	}
+	if opts.TTL > 0 {
+		expiresAt := key.CreatedAt.Add(opts.TTL)
+		key.ExpiresAt = &expiresAt
+	}
+
+	ref := c.db.NewRef(fmt.Sprintf("api_keys/%s", key.ID))
+	if err := ref.Set(ctx, key); err != nil {
+		return "", nil, fmt.Errorf("error storing api key: %w", err)
+	}
+
+	return plaintext, key, nil
+}
+
+// VerifyAPIKey resolves a plaintext API key to its stored record, rejecting
+// unknown, revoked and expired keys
+func (c *Client) VerifyAPIKey(ctx context.Context, plaintext string) (_ *APIKey, err error) {
+	defer c.observe("VerifyAPIKey", c.opStart(), &err)
+	ref := c.db.NewRef(fmt.Sprintf("api_keys/%s", hashAPIKey(plaintext)))
+
+	var key APIKey
+	if err := ref.Get(ctx, &key); err != nil {
+		return nil, fmt.Errorf("error getting api key: %w", err)
+	}
+	if key.UserID == "" {
+		return nil, ErrAPIKeyNotFound
+	}
+	if key.Revoked {
+		return nil, ErrAPIKeyRevoked
+	}
+	if key.ExpiresAt != nil && time.Now().After(*key.ExpiresAt) {
+		return nil, ErrAPIKeyExpired
+	}
+
+	now := time.Now()
+	if key.LastUsedAt == nil || now.Sub(*key.LastUsedAt) >= apiKeyTouchInterval {
+		// Usage tracking is best effort and must not fail authentication
+		if err := ref.Update(ctx, map[string]interface{}{"last_used_at": now}); err != nil {
+			slog.Warn("failed to update api key last_used_at", "key_prefix", key.Prefix, "error", err)
+		} else {
+			key.LastUsedAt = &now
+		}
+	}
+
+	return &key, nil
+}
+
+// ListAPIKeys returns all keys belonging to a user, including revoked ones.
+// Requires an ".indexOn": ["user_id"] rule on the api_keys node.
+func (c *Client) ListAPIKeys(ctx context.Context, userID string) (_ []APIKey, err error) {
+	defer c.observe("ListAPIKeys", c.opStart(), &err)
+	var keys map[string]APIKey
+	if err := c.db.NewRef("api_keys").OrderByChild("user_id").EqualTo(userID).Get(ctx, &keys); err != nil {
+		return nil, fmt.Errorf("error listing api keys: %w", err)
+	}
+
+	result := make([]APIKey, 0, len(keys))
+	for _, key := range keys {
+		result = append(result, key)
+	}
+	return result, nil
+}
+
+// RevokeAPIKey marks a user's key as revoked so it can no longer authenticate
+func (c *Client) RevokeAPIKey(ctx context.Context, userID, keyID string) (err error) {
+	defer c.observe("RevokeAPIKey", c.opStart(), &err)
+	ref := c.db.NewRef(fmt.Sprintf("api_keys/%s", keyID))
+
+	return ref.Transaction(ctx, func(tn db.TransactionNode) (interface{}, error) {
+		var key APIKey
+		if err := tn.Unmarshal(&key); err != nil || key.UserID == "" {
+			return nil, ErrAPIKeyNotFound
+		}
+		if key.UserID != userID {
+			// Don't reveal that the key exists for another user
+			return nil, ErrAPIKeyNotFound
+		}
+
+		now := time.Now()
+		key.Revoked = true
+		key.RevokedAt = &now
+		return key, nil
+	})
+}
+
+// HasScope reports whether the key grants scope. Keys without scopes are
+// unrestricted.
+func (k *APIKey) HasScope(scope string) bool {
+	if len(k.Scopes) == 0 {
+		return true
+	}
+	for _, s := range k.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// hashAPIKey returns the hex SHA-256 digest used to store and look up a key
+func hashAPIKey(plaintext string) string {
+	sum := sha256.Sum256([]byte(plaintext))
+	return hex.EncodeToString(sum[:])
+}
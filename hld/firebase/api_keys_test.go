@@ -0,0 +1,22 @@
+package firebase
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAPIKeyHasScope(t *testing.T) {
+	unscoped := &APIKey{}
+	assert.True(t, unscoped.HasScope("messages"))
+
+	scoped := &APIKey{Scopes: []string{"messages"}}
+	assert.True(t, scoped.HasScope("messages"))
+	assert.False(t, scoped.HasScope("admin"))
+}
+
+func TestHashAPIKeyIsStable(t *testing.T) {
+	assert.Equal(t, hashAPIKey("ofk_abc"), hashAPIKey("ofk_abc"))
+	assert.NotEqual(t, hashAPIKey("ofk_abc"), hashAPIKey("ofk_abd"))
+	assert.Len(t, hashAPIKey("ofk_abc"), 64)
+}
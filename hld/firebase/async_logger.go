@@ -0,0 +1,414 @@
+package firebase
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Defaults for the async usage logger, overridable via environment
+const (
+	defaultUsageLogBufferSize    = 1000
+	defaultUsageLogBatchSize     = 50
+	defaultUsageLogFlushInterval = time.Second
+	defaultUsageLogWorkers       = 1
+	defaultUsageLogRetries       = 3
+	usageLogRetryBaseDelay       = 100 * time.Millisecond
+	usageLogShutdownTimeout      = 10 * time.Second
+)
+
+// Overflow policies for a full usage log queue
+const (
+	// UsageLogOverflowDrop drops the entry and counts it in Dropped
+	UsageLogOverflowDrop = "drop"
+	// UsageLogOverflowBlock makes Enqueue wait for room in the queue
+	UsageLogOverflowBlock = "block"
+)
+
+// AsyncLogger buffers usage logs in memory and writes them to a UsageStore
+// in batches so that request handlers never wait on a database round trip.
+// Storing a batch also updates the users' daily request counters, so those
+// writes are off the request path too. A pool of workers drains the queue,
+// retrying failed batches with exponential backoff.
+type AsyncLogger struct {
+	store         UsageStore
+	queue         chan queuedLog
+	batchSize     int
+	flushInterval time.Duration
+	done          chan struct{}
+
+	// overflow is UsageLogOverflowDrop or UsageLogOverflowBlock
+	overflow string
+	// retries is how many times a failed batch is retried, waiting
+	// retryDelay before the first retry and doubling it after each
+	retries    int
+	retryDelay time.Duration
+	// flushReqs has one channel per worker for Flush requests
+	flushReqs []chan flushRequest
+
+	// dropped counts entries refused because the queue was full or the
+	// logger shut down; onDrop is called for each
+	dropped atomic.Int64
+	onDrop  func()
+
+	// mu guards closed; Enqueue holds it for reading so Shutdown can't close
+	// the queue to new entries while one is being added
+	mu       sync.RWMutex
+	closed   bool
+	started  bool
+	stop     chan struct{}
+	stopOnce sync.Once
+	// drainCtx bounds the final flush requested by Shutdown
+	drainCtx context.Context
+	// drainFailed counts entries the final flush could not write
+	drainFailed atomic.Int64
+}
+
+// flushRequest asks a worker to write its batch and the queue, reporting
+// the number of entries that could not be written on failed
+type flushRequest struct {
+	ctx    context.Context
+	failed chan int
+}
+
+// NewAsyncLogger creates an async logger configured from environment:
+// USAGE_LOG_BUFFER_SIZE, USAGE_LOG_BATCH_SIZE, USAGE_LOG_FLUSH_INTERVAL,
+// USAGE_LOG_WORKERS, USAGE_LOG_RETRIES and USAGE_LOG_OVERFLOW (drop or
+// block, default drop)
+func NewAsyncLogger(store UsageStore) *AsyncLogger {
+	l := &AsyncLogger{
+		store:         store,
+		queue:         make(chan queuedLog, envInt("USAGE_LOG_BUFFER_SIZE", defaultUsageLogBufferSize)),
+		batchSize:     envInt("USAGE_LOG_BATCH_SIZE", defaultUsageLogBatchSize),
+		flushInterval: envDuration("USAGE_LOG_FLUSH_INTERVAL", defaultUsageLogFlushInterval),
+		overflow:      usageLogOverflowFromEnv(),
+		retries:       envNonNegInt("USAGE_LOG_RETRIES", defaultUsageLogRetries),
+		retryDelay:    usageLogRetryBaseDelay,
+		done:          make(chan struct{}),
+		stop:          make(chan struct{}),
+	}
+	l.flushReqs = make([]chan flushRequest, envInt("USAGE_LOG_WORKERS", defaultUsageLogWorkers))
+	for i := range l.flushReqs {
+		l.flushReqs[i] = make(chan flushRequest)
+	}
+	return l
+}
+
+// usageLogOverflowFromEnv reads USAGE_LOG_OVERFLOW, defaulting to drop
+func usageLogOverflowFromEnv() string {
+	switch raw := os.Getenv("USAGE_LOG_OVERFLOW"); raw {
+	case "", UsageLogOverflowDrop:
+		return UsageLogOverflowDrop
+	case UsageLogOverflowBlock:
+		return UsageLogOverflowBlock
+	default:
+		slog.Warn("invalid USAGE_LOG_OVERFLOW, dropping entries when the queue is full", "value", raw)
+		return UsageLogOverflowDrop
+	}
+}
+
+// OnDrop registers fn to be called for every dropped entry, e.g. to count
+// drops in a metric. It must be called before Start.
+func (l *AsyncLogger) OnDrop(fn func()) {
+	l.onDrop = fn
+}
+
+// Dropped returns the number of entries dropped so far
+func (l *AsyncLogger) Dropped() int64 {
+	return l.dropped.Load()
+}
+
+// queuedLog is a usage log along with the store it must be written to
+type queuedLog struct {
+	store UsageStore
+	log   UsageLog
+}
+
+// Enqueue adds a usage log to the queue. If the queue is full it drops the
+// entry and returns false, or with the block overflow policy waits for a
+// worker to make room.
+func (l *AsyncLogger) Enqueue(log UsageLog) bool {
+	return l.EnqueueTo(l.store, log)
+}
+
+// EnqueueTo is like Enqueue but writes the log to store, so one logger can
+// serve every tenant of a ClientPool
+func (l *AsyncLogger) EnqueueTo(store UsageStore, log UsageLog) bool {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.closed {
+		l.drop("usage logger shut down, dropping entry", log)
+		return false
+	}
+
+	entry := queuedLog{store: store, log: log}
+	select {
+	case l.queue <- entry:
+		return true
+	default:
+	}
+	// Without running workers nothing would make room
+	if l.overflow == UsageLogOverflowBlock && l.started {
+		select {
+		case l.queue <- entry:
+			return true
+		case <-l.done:
+		}
+	}
+	l.drop("usage log queue full, dropping entry", log)
+	return false
+}
+
+// drop counts and logs a refused entry
+func (l *AsyncLogger) drop(msg string, log UsageLog) {
+	l.dropped.Add(1)
+	if l.onDrop != nil {
+		l.onDrop()
+	}
+	slog.Error(msg,
+		"user_id", log.UserID,
+		"session_id", log.SessionID,
+		"points_cost", log.PointsCost)
+}
+
+// Start launches the background workers. When ctx is cancelled the
+// remaining queued entries are flushed before Wait returns.
+func (l *AsyncLogger) Start(ctx context.Context) {
+	l.mu.Lock()
+	l.started = true
+	l.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, flushReq := range l.flushReqs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			l.run(ctx, flushReq)
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(l.done)
+	}()
+}
+
+// Wait blocks until the workers have stopped and flushed the queue
+func (l *AsyncLogger) Wait() {
+	<-l.done
+}
+
+// Shutdown stops accepting new entries and flushes everything still queued
+// within ctx's deadline. It returns an error if the deadline passes first or
+// any entries could not be written.
+func (l *AsyncLogger) Shutdown(ctx context.Context) error {
+	l.mu.Lock()
+	l.closed = true
+	started := l.started
+	l.mu.Unlock()
+
+	if !started {
+		// No writer is running, so flush on the caller's goroutine
+		if failed := l.drain(ctx, nil); failed > 0 {
+			return fmt.Errorf("%d usage logs could not be written", failed)
+		}
+		return nil
+	}
+
+	l.stopOnce.Do(func() {
+		l.drainCtx = ctx
+		close(l.stop)
+	})
+
+	select {
+	case <-l.done:
+	case <-ctx.Done():
+		return fmt.Errorf("usage log queue not drained before deadline: %w", ctx.Err())
+	}
+
+	if failed := l.drainFailed.Load(); failed > 0 {
+		return fmt.Errorf("%d usage logs could not be written", failed)
+	}
+	return nil
+}
+
+// Flush writes everything queued so far, including batches the workers are
+// still filling, and returns once it is stored or ctx is done. It returns an
+// error if any entries could not be written.
+func (l *AsyncLogger) Flush(ctx context.Context) error {
+	l.mu.RLock()
+	started, closed := l.started, l.closed
+	l.mu.RUnlock()
+
+	if !started {
+		if failed := l.drain(ctx, nil); failed > 0 {
+			return fmt.Errorf("%d usage logs could not be written", failed)
+		}
+		return nil
+	}
+
+	failed := 0
+	for _, flushReq := range l.flushReqs {
+		if closed {
+			break
+		}
+		req := flushRequest{ctx: ctx, failed: make(chan int, 1)}
+		select {
+		case flushReq <- req:
+			failed += <-req.failed
+		case <-l.done:
+			// Shut down meanwhile; Shutdown drained the queue
+			closed = true
+		case <-ctx.Done():
+			return fmt.Errorf("usage log queue not flushed before deadline: %w", ctx.Err())
+		}
+	}
+	if closed {
+		// Shutdown is draining the queue, so wait for it
+		select {
+		case <-l.done:
+		case <-ctx.Done():
+			return fmt.Errorf("usage log queue not flushed before deadline: %w", ctx.Err())
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d usage logs could not be written", failed)
+	}
+	return nil
+}
+
+func (l *AsyncLogger) run(ctx context.Context, flushReq <-chan flushRequest) {
+	ticker := time.NewTicker(l.flushInterval)
+	defer ticker.Stop()
+
+	batch := make([]queuedLog, 0, l.batchSize)
+	for {
+		select {
+		case entry := <-l.queue:
+			batch = append(batch, entry)
+			if len(batch) >= l.batchSize {
+				l.flush(ctx, batch)
+				batch = batch[:0]
+			}
+		case <-ticker.C:
+			if len(batch) > 0 {
+				l.flush(ctx, batch)
+				batch = batch[:0]
+			}
+		case req := <-flushReq:
+			req.failed <- l.drain(req.ctx, batch)
+			batch = batch[:0]
+		case <-l.stop:
+			l.drainFailed.Add(int64(l.drain(l.drainCtx, batch)))
+			return
+		case <-ctx.Done():
+			// The run context is already cancelled, so drain with a fresh one
+			drainCtx, cancel := context.WithTimeout(context.Background(), usageLogShutdownTimeout)
+			l.drain(drainCtx, batch)
+			cancel()
+			return
+		}
+	}
+}
+
+// drain flushes batch and everything still queued, returning the number of
+// entries that could not be written
+func (l *AsyncLogger) drain(ctx context.Context, batch []queuedLog) int {
+	failed := 0
+	for {
+		select {
+		case entry := <-l.queue:
+			batch = append(batch, entry)
+			if len(batch) >= l.batchSize {
+				failed += l.flush(ctx, batch)
+				batch = batch[:0]
+			}
+		default:
+			if len(batch) > 0 {
+				failed += l.flush(ctx, batch)
+			}
+			slog.Info("usage log queue drained", "failed", failed)
+			return failed
+		}
+	}
+}
+
+// flush writes a batch, grouped by the store each entry belongs to, and
+// returns the number of entries that could not be written
+func (l *AsyncLogger) flush(ctx context.Context, batch []queuedLog) int {
+	byStore := make(map[UsageStore][]UsageLog)
+	for _, entry := range batch {
+		byStore[entry.store] = append(byStore[entry.store], entry.log)
+	}
+
+	failed := 0
+	for store, logs := range byStore {
+		if err := l.writeBatch(ctx, store, logs); err != nil {
+			if errors.Is(err, ErrUsageRecorded) {
+				// Stored, only the bookkeeping failed
+				slog.Error("failed to record usage log batch", "count", len(logs), "error", err)
+				continue
+			}
+			slog.Error("failed to write usage log batch", "count", len(logs), "error", err)
+			failed += len(logs)
+		}
+	}
+	return failed
+}
+
+// writeBatch writes logs to store, retrying failures with exponential
+// backoff. Once the logs are stored they are never written again.
+func (l *AsyncLogger) writeBatch(ctx context.Context, store UsageStore, logs []UsageLog) error {
+	delay := l.retryDelay
+	for attempt := 0; ; attempt++ {
+		err := store.LogUsageBatch(ctx, logs)
+		if err == nil || errors.Is(err, ErrUsageRecorded) || attempt >= l.retries {
+			return err
+		}
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return err
+		}
+		delay *= 2
+	}
+}
+
+// envInt reads a positive integer from the environment, falling back to def
+func envInt(key string, def int) int {
+	if raw := os.Getenv(key); raw != "" {
+		if v, err := strconv.Atoi(raw); err == nil && v > 0 {
+			return v
+		}
+		slog.Warn("invalid integer in environment, using default", "key", key, "value", raw, "default", def)
+	}
+	return def
+}
+
+// envNonNegInt is envInt for settings where zero is meaningful, such as
+// USAGE_LOG_RETRIES=0 to turn retries off
+func envNonNegInt(key string, def int) int {
+	if raw := os.Getenv(key); raw != "" {
+		if v, err := strconv.Atoi(raw); err == nil && v >= 0 {
+			return v
+		}
+		slog.Warn("invalid integer in environment, using default", "key", key, "value", raw, "default", def)
+	}
+	return def
+}
+
+// envDuration reads a positive duration from the environment, falling back to def
+func envDuration(key string, def time.Duration) time.Duration {
+	if raw := os.Getenv(key); raw != "" {
+		if v, err := time.ParseDuration(raw); err == nil && v > 0 {
+			return v
+		}
+		slog.Warn("invalid duration in environment, using default", "key", key, "value", raw, "default", def)
+	}
+	return def
+}
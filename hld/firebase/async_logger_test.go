@@ -0,0 +1,163 @@
+package firebase
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAsyncLoggerShutdown(t *testing.T) {
+	l := NewAsyncLogger(nil)
+	l.Start(context.Background())
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	require.NoError(t, l.Shutdown(ctx))
+
+	// The writer has stopped and new entries are refused
+	l.Wait()
+	assert.False(t, l.Enqueue(UsageLog{UserID: "u1"}))
+
+	// Repeated shutdowns are harmless
+	assert.NoError(t, l.Shutdown(ctx))
+}
+
+func TestAsyncLoggerShutdownWithoutStart(t *testing.T) {
+	l := NewAsyncLogger(nil)
+	assert.NoError(t, l.Shutdown(context.Background()))
+	assert.False(t, l.Enqueue(UsageLog{UserID: "u1"}))
+}
+
+// recordingStore is a UsageStore that records the batches written to it
+type recordingStore struct {
+	UsageStore
+	batches [][]UsageLog
+}
+
+func (s *recordingStore) LogUsageBatch(ctx context.Context, logs []UsageLog) error {
+	s.batches = append(s.batches, logs)
+	return nil
+}
+
+func TestAsyncLoggerWritesToEachStore(t *testing.T) {
+	primary, other := &recordingStore{}, &recordingStore{}
+	l := NewAsyncLogger(primary)
+
+	assert.True(t, l.Enqueue(UsageLog{UserID: "u1"}))
+	assert.True(t, l.EnqueueTo(other, UsageLog{UserID: "u2"}))
+	assert.True(t, l.Enqueue(UsageLog{UserID: "u3"}))
+	require.NoError(t, l.Shutdown(context.Background()))
+
+	require.Len(t, primary.batches, 1)
+	assert.Equal(t, []UsageLog{{UserID: "u1"}, {UserID: "u3"}}, primary.batches[0])
+	require.Len(t, other.batches, 1)
+	assert.Equal(t, []UsageLog{{UserID: "u2"}}, other.batches[0])
+}
+
+// flakyStore fails its first failures batch writes with err
+type flakyStore struct {
+	recordingStore
+	failures int
+	err      error
+	attempts int
+}
+
+func (s *flakyStore) LogUsageBatch(ctx context.Context, logs []UsageLog) error {
+	s.attempts++
+	if s.attempts <= s.failures {
+		return s.err
+	}
+	return s.recordingStore.LogUsageBatch(ctx, logs)
+}
+
+func TestAsyncLoggerRetries(t *testing.T) {
+	store := &flakyStore{failures: 2, err: errors.New("unavailable")}
+	l := NewAsyncLogger(store)
+	l.retryDelay = time.Millisecond
+
+	assert.True(t, l.Enqueue(UsageLog{UserID: "u1"}))
+	require.NoError(t, l.Flush(context.Background()))
+	assert.Equal(t, 3, store.attempts)
+	require.Len(t, store.batches, 1)
+
+	// Logs already stored are never written twice
+	store = &flakyStore{failures: 1, err: fmt.Errorf("%w: counter", ErrUsageRecorded)}
+	l = NewAsyncLogger(store)
+	assert.True(t, l.Enqueue(UsageLog{UserID: "u1"}))
+	require.NoError(t, l.Flush(context.Background()))
+	assert.Equal(t, 1, store.attempts)
+
+	// Give up after the configured retries
+	store = &flakyStore{failures: 10, err: errors.New("unavailable")}
+	l = NewAsyncLogger(store)
+	l.retryDelay = time.Millisecond
+	assert.True(t, l.Enqueue(UsageLog{UserID: "u1"}))
+	assert.Error(t, l.Flush(context.Background()))
+	assert.Equal(t, defaultUsageLogRetries+1, store.attempts)
+}
+
+func TestAsyncLoggerRetriesDisabled(t *testing.T) {
+	t.Setenv("USAGE_LOG_RETRIES", "0")
+	store := &flakyStore{failures: 1, err: errors.New("unavailable")}
+	l := NewAsyncLogger(store)
+	assert.Equal(t, 0, l.retries)
+
+	assert.True(t, l.Enqueue(UsageLog{UserID: "u1"}))
+	assert.Error(t, l.Flush(context.Background()))
+	assert.Equal(t, 1, store.attempts)
+
+	// Negative values fall back to the default
+	t.Setenv("USAGE_LOG_RETRIES", "-1")
+	assert.Equal(t, defaultUsageLogRetries, NewAsyncLogger(nil).retries)
+}
+
+func TestAsyncLoggerFlushWhileRunning(t *testing.T) {
+	t.Setenv("USAGE_LOG_FLUSH_INTERVAL", "1h")
+	t.Setenv("USAGE_LOG_WORKERS", "2")
+	store := &recordingStore{}
+	l := NewAsyncLogger(store)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	l.Start(ctx)
+
+	assert.True(t, l.Enqueue(UsageLog{UserID: "u1"}))
+	require.NoError(t, l.Flush(context.Background()))
+	var written []UsageLog
+	for _, batch := range store.batches {
+		written = append(written, batch...)
+	}
+	assert.Equal(t, []UsageLog{{UserID: "u1"}}, written)
+
+	require.NoError(t, l.Shutdown(context.Background()))
+	assert.NoError(t, l.Flush(context.Background()))
+}
+
+func TestAsyncLoggerOverflow(t *testing.T) {
+	t.Setenv("USAGE_LOG_BUFFER_SIZE", "1")
+	l := NewAsyncLogger(&recordingStore{})
+	drops := 0
+	l.OnDrop(func() { drops++ })
+
+	assert.True(t, l.Enqueue(UsageLog{UserID: "u1"}))
+	assert.False(t, l.Enqueue(UsageLog{UserID: "u2"}))
+	assert.Equal(t, int64(1), l.Dropped())
+	assert.Equal(t, 1, drops)
+
+	t.Setenv("USAGE_LOG_OVERFLOW", UsageLogOverflowBlock)
+	t.Setenv("USAGE_LOG_FLUSH_INTERVAL", "1ms")
+	store := &recordingStore{}
+	l = NewAsyncLogger(store)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	l.Start(ctx)
+	for i := 0; i < 5; i++ {
+		assert.True(t, l.Enqueue(UsageLog{UserID: "u1"}))
+	}
+	require.NoError(t, l.Shutdown(context.Background()))
+	assert.Zero(t, l.Dropped())
+}
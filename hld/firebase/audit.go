@@ -0,0 +1,232 @@
+package firebase
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/googleapi"
+)
+
+const (
+	// defaultAuditFlushInterval is how often buffered audit records are
+	// appended to the bucket
+	defaultAuditFlushInterval = 60
+	// maxAuditPendingBytes bounds the records buffered while the bucket is
+	// unreachable; records past it are dropped and logged
+	maxAuditPendingBytes = 64 << 20
+	// auditAppendAttempts bounds the retries of an append that raced
+	// another instance appending to the same object
+	auditAppendAttempts = 5
+	// auditFinalFlushTimeout bounds the flush after Run's context ends
+	auditFinalFlushTimeout = 10 * time.Second
+)
+
+// auditSink appends data to a named object
+type auditSink interface {
+	appendObject(ctx context.Context, name string, data []byte) error
+}
+
+// AuditExporter archives usage logs for compliance as newline-delimited JSON
+// in a GCS bucket, in addition to usage_logs in Firebase. Records are
+// buffered and appended every flush interval to
+// audit/<year>/<month>/<day>/<hour>.ndjson by the UTC hour of their
+// timestamp. A nil AuditExporter archives nothing.
+type AuditExporter struct {
+	sink     auditSink
+	interval time.Duration
+
+	mu           sync.Mutex
+	pending      map[string][]byte
+	pendingBytes int
+}
+
+// NewAuditExporterFromEnv creates an exporter writing to the bucket named by
+// AUDIT_GCS_BUCKET with application default credentials, flushing every
+// AUDIT_FLUSH_INTERVAL_SECONDS (default 60). It returns nil when no bucket
+// is configured.
+func NewAuditExporterFromEnv(ctx context.Context) (*AuditExporter, error) {
+	bucket := os.Getenv("AUDIT_GCS_BUCKET")
+	if bucket == "" {
+		return nil, nil
+	}
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error initializing audit storage client: %w", err)
+	}
+
+	interval := time.Duration(envInt("AUDIT_FLUSH_INTERVAL_SECONDS", defaultAuditFlushInterval)) * time.Second
+	slog.Info("usage audit export enabled", "bucket", bucket, "flush_interval", interval)
+	return newAuditExporter(&gcsAuditSink{bucket: client.Bucket(bucket)}, interval), nil
+}
+
+// SetAuditExporter archives the usage this client logs with e, or stops
+// archiving when e is nil. It must be set before the client is shared.
+func (c *Client) SetAuditExporter(e *AuditExporter) {
+	c.audit = e
+}
+
+func newAuditExporter(sink auditSink, interval time.Duration) *AuditExporter {
+	return &AuditExporter{sink: sink, interval: interval, pending: make(map[string][]byte)}
+}
+
+// auditObjectName returns the object holding records logged at t
+func auditObjectName(t time.Time) string {
+	return t.UTC().Format("audit/2006/01/02/15.ndjson")
+}
+
+// Add buffers a usage log, stored under id, for the next flush
+func (e *AuditExporter) Add(id string, log UsageLog) {
+	if e == nil {
+		return
+	}
+	line, err := json.Marshal(struct {
+		ID string `json:"id"`
+		UsageLog
+	}{ID: id, UsageLog: log})
+	if err != nil {
+		slog.Error("failed to encode audit record", "id", id, "error", err)
+		return
+	}
+	line = append(line, '\n')
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.pendingBytes+len(line) > maxAuditPendingBytes {
+		slog.Error("audit buffer full, dropping usage record", "id", id, "user_id", log.UserID)
+		return
+	}
+	name := auditObjectName(log.Timestamp)
+	e.pending[name] = append(e.pending[name], line...)
+	e.pendingBytes += len(line)
+}
+
+// Flush appends the buffered records to their objects. Records that fail to
+// upload are kept for the next flush; the first error is returned.
+func (e *AuditExporter) Flush(ctx context.Context) error {
+	if e == nil {
+		return nil
+	}
+	e.mu.Lock()
+	batch := e.pending
+	e.pending = make(map[string][]byte)
+	e.pendingBytes = 0
+	e.mu.Unlock()
+
+	names := make([]string, 0, len(batch))
+	for name := range batch {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var firstErr error
+	for _, name := range names {
+		err := e.sink.appendObject(ctx, name, batch[name])
+		if err == nil {
+			continue
+		}
+		if firstErr == nil {
+			firstErr = fmt.Errorf("error appending to %s: %w", name, err)
+		}
+		e.requeue(name, batch[name])
+	}
+	return firstErr
+}
+
+// requeue puts records that failed to upload back ahead of any added since
+func (e *AuditExporter) requeue(name string, data []byte) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.pendingBytes+len(data) > maxAuditPendingBytes {
+		slog.Error("audit buffer full, dropping usage records", "object", name, "bytes", len(data))
+		return
+	}
+	e.pending[name] = append(data, e.pending[name]...)
+	e.pendingBytes += len(data)
+}
+
+// Run flushes every flush interval until ctx is cancelled, then flushes once
+// more
+func (e *AuditExporter) Run(ctx context.Context) {
+	if e == nil {
+		return
+	}
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := e.Flush(ctx); err != nil {
+				slog.Error("failed to flush usage audit records", "error", err)
+			}
+		case <-ctx.Done():
+			flushCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), auditFinalFlushTimeout)
+			if err := e.Flush(flushCtx); err != nil {
+				slog.Error("failed to flush usage audit records on shutdown", "error", err)
+			}
+			cancel()
+			return
+		}
+	}
+}
+
+// gcsAuditSink appends to GCS objects. Objects can't be modified, so data is
+// uploaded as a part object and composed onto the end of the target. The
+// compose is conditional on the target's generation, so concurrent appends
+// from several instances retry instead of overwriting each other.
+type gcsAuditSink struct {
+	bucket *storage.BucketHandle
+}
+
+func (s *gcsAuditSink) appendObject(ctx context.Context, name string, data []byte) error {
+	part := s.bucket.Object(name + ".part-" + newPushID(time.Now()))
+	w := part.NewWriter(ctx)
+	w.ContentType = "application/x-ndjson"
+	if _, err := w.Write(data); err != nil {
+		_ = w.Close()
+		return fmt.Errorf("error uploading part: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("error uploading part: %w", err)
+	}
+	defer func() {
+		if err := part.Delete(context.WithoutCancel(ctx)); err != nil {
+			slog.Warn("failed to delete audit part", "object", part.ObjectName(), "error", err)
+		}
+	}()
+
+	target := s.bucket.Object(name)
+	for attempt := 0; attempt < auditAppendAttempts; attempt++ {
+		attrs, err := target.Attrs(ctx)
+		switch {
+		case errors.Is(err, storage.ErrObjectNotExist):
+			_, err = target.If(storage.Conditions{DoesNotExist: true}).CopierFrom(part).Run(ctx)
+		case err != nil:
+			return fmt.Errorf("error reading object: %w", err)
+		default:
+			composer := target.If(storage.Conditions{GenerationMatch: attrs.Generation}).ComposerFrom(target, part)
+			composer.ContentType = "application/x-ndjson"
+			_, err = composer.Run(ctx)
+		}
+		if !isPreconditionFailed(err) {
+			return err
+		}
+	}
+	return fmt.Errorf("object kept changing after %d attempts", auditAppendAttempts)
+}
+
+// isPreconditionFailed reports whether a GCS call lost a race with another
+// writer
+func isPreconditionFailed(err error) bool {
+	var apiErr *googleapi.Error
+	return errors.As(err, &apiErr) && apiErr.Code == http.StatusPreconditionFailed
+}
@@ -0,0 +1,108 @@
+package firebase
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/api/googleapi"
+)
+
+// memorySink collects appended data in memory, failing while fail is set
+type memorySink struct {
+	objects map[string]*bytes.Buffer
+	fail    error
+}
+
+func (s *memorySink) appendObject(ctx context.Context, name string, data []byte) error {
+	if s.fail != nil {
+		return s.fail
+	}
+	if s.objects == nil {
+		s.objects = make(map[string]*bytes.Buffer)
+	}
+	if s.objects[name] == nil {
+		s.objects[name] = &bytes.Buffer{}
+	}
+	s.objects[name].Write(data)
+	return nil
+}
+
+func auditIDs(t *testing.T, data string) []string {
+	t.Helper()
+	var ids []string
+	scanner := bufio.NewScanner(strings.NewReader(data))
+	for scanner.Scan() {
+		var record struct {
+			ID     string `json:"id"`
+			UserID string `json:"user_id"`
+		}
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &record))
+		ids = append(ids, record.ID)
+	}
+	return ids
+}
+
+func TestAuditObjectName(t *testing.T) {
+	ts := time.Date(2026, 3, 7, 9, 45, 0, 0, time.FixedZone("EST", -5*3600))
+	assert.Equal(t, "audit/2026/03/07/14.ndjson", auditObjectName(ts))
+}
+
+func TestAuditExporterFlush(t *testing.T) {
+	sink := &memorySink{}
+	e := newAuditExporter(sink, time.Minute)
+	hour := time.Date(2026, 3, 7, 14, 0, 0, 0, time.UTC)
+
+	e.Add("a", UsageLog{UserID: "user-1", Timestamp: hour.Add(time.Minute)})
+	e.Add("b", UsageLog{UserID: "user-2", Timestamp: hour.Add(2 * time.Minute)})
+	e.Add("c", UsageLog{UserID: "user-1", Timestamp: hour.Add(time.Hour)})
+	require.NoError(t, e.Flush(context.Background()))
+
+	require.Len(t, sink.objects, 2)
+	assert.Equal(t, []string{"a", "b"}, auditIDs(t, sink.objects["audit/2026/03/07/14.ndjson"].String()))
+	assert.Equal(t, []string{"c"}, auditIDs(t, sink.objects["audit/2026/03/07/15.ndjson"].String()))
+
+	// Later flushes append
+	e.Add("d", UsageLog{UserID: "user-3", Timestamp: hour.Add(3 * time.Minute)})
+	require.NoError(t, e.Flush(context.Background()))
+	assert.Equal(t, []string{"a", "b", "d"}, auditIDs(t, sink.objects["audit/2026/03/07/14.ndjson"].String()))
+}
+
+func TestAuditExporterKeepsFailedRecords(t *testing.T) {
+	sink := &memorySink{fail: errors.New("bucket unavailable")}
+	e := newAuditExporter(sink, time.Minute)
+	hour := time.Date(2026, 3, 7, 14, 0, 0, 0, time.UTC)
+
+	e.Add("a", UsageLog{Timestamp: hour})
+	assert.Error(t, e.Flush(context.Background()))
+
+	e.Add("b", UsageLog{Timestamp: hour})
+	sink.fail = nil
+	require.NoError(t, e.Flush(context.Background()))
+	assert.Equal(t, []string{"a", "b"}, auditIDs(t, sink.objects["audit/2026/03/07/14.ndjson"].String()))
+}
+
+func TestAuditExporterNil(t *testing.T) {
+	var e *AuditExporter
+	e.Add("a", UsageLog{})
+	assert.NoError(t, e.Flush(context.Background()))
+
+	t.Setenv("AUDIT_GCS_BUCKET", "")
+	e, err := NewAuditExporterFromEnv(context.Background())
+	assert.NoError(t, err)
+	assert.Nil(t, e)
+}
+
+func TestIsPreconditionFailed(t *testing.T) {
+	assert.True(t, isPreconditionFailed(&googleapi.Error{Code: http.StatusPreconditionFailed}))
+	assert.False(t, isPreconditionFailed(&googleapi.Error{Code: http.StatusNotFound}))
+	assert.False(t, isPreconditionFailed(nil))
+}
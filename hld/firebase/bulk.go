@@ -0,0 +1,142 @@
+package firebase
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"firebase.google.com/go/v4/db"
+)
+
+// bulkInitConcurrency bounds the number of concurrent Firebase transactions
+// issued by BulkInitializeUsers
+const bulkInitConcurrency = 8
+
+// UserInit describes a single user to provision during bulk import
+type UserInit struct {
+	UserID string `json:"user_id"`
+	Email  string `json:"email"`
+	Plan   string `json:"plan,omitempty"`
+	// Points is the starting balance; nil falls back to DEFAULT_USER_POINTS
+	Points *int `json:"points,omitempty"`
+}
+
+// UserInitResult reports the outcome for a single row of a bulk import
+type UserInitResult struct {
+	UserID  string `json:"user_id"`
+	Created bool   `json:"created"`
+	Skipped bool   `json:"skipped"`
+	Error   string `json:"error,omitempty"`
+}
+
+// BulkInitializeUsers provisions many users at once. Existing users are left
+// untouched, so the call is idempotent and can be safely re-run with only the
+// failed rows. Rows with a malformed user ID or negative points fail without
+// being written. Results are returned in the same order as the input.
+func (c *Client) BulkInitializeUsers(ctx context.Context, users []UserInit) (_ []UserInitResult, err error) {
+	defer c.observe("BulkInitializeUsers", c.opStart(), &err)
+	results := make([]UserInitResult, len(users))
+	defaultPoints := defaultUserPoints()
+
+	sem := make(chan struct{}, bulkInitConcurrency)
+	var wg sync.WaitGroup
+
+	for i, u := range users {
+		results[i].UserID = u.UserID
+
+		if err := validateUserInit(u); err != nil {
+			results[i].Error = err.Error()
+			continue
+		}
+
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			wg.Wait()
+			return results, ctx.Err()
+		}
+
+		wg.Add(1)
+		go func(i int, u UserInit) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			points := defaultPoints
+			if u.Points != nil {
+				points = *u.Points
+			}
+			plan := u.Plan
+			if plan == "" {
+				plan = "free"
+			}
+
+			user := UserData{
+				Email:     u.Email,
+				Points:    points,
+				TotalUsed: 0,
+				Plan:      plan,
+				CreatedAt: time.Now(),
+			}
+			created, err := c.createUserIfAbsent(ctx, u.UserID, user)
+			if err != nil {
+				results[i].Error = err.Error()
+				return
+			}
+			if created {
+				c.recordGrant(ctx, u.UserID, "", PointGrant{Amount: points, Source: GrantSourceImport, GrantedAt: user.CreatedAt})
+			}
+			results[i].Created = created
+			results[i].Skipped = !created
+		}(i, u)
+	}
+
+	wg.Wait()
+	return results, nil
+}
+
+// validateUserInit checks a row before anything is written. User IDs become
+// database keys, so an ID containing a path separator would address a node
+// inside another user's record.
+func validateUserInit(u UserInit) error {
+	if u.UserID == "" {
+		return errors.New("user_id is required")
+	}
+	if strings.ContainsAny(u.UserID, ".$#[]/") || strings.IndexFunc(u.UserID, unicode.IsControl) >= 0 {
+		return fmt.Errorf("user_id %q contains characters not allowed in database keys", u.UserID)
+	}
+	if u.Points != nil && *u.Points < 0 {
+		return fmt.Errorf("points must not be negative, got %d", *u.Points)
+	}
+	return nil
+}
+
+// createUserIfAbsent writes user only when no record exists for userID.
+// It reports whether a new record was created.
+func (c *Client) createUserIfAbsent(ctx context.Context, userID string, user UserData) (bool, error) {
+	ref := c.db.NewRef(userPath(userID))
+
+	created := false
+	err := ref.Transaction(ctx, func(tn db.TransactionNode) (interface{}, error) {
+		var existing map[string]interface{}
+		if err := tn.Unmarshal(&existing); err == nil && len(existing) > 0 {
+			// User already exists, keep the record unchanged
+			created = false
+			return existing, nil
+		}
+
+		created = true
+		return user, nil
+	})
+	if err != nil {
+		return false, fmt.Errorf("error initializing user %s: %w", userID, err)
+	}
+
+	if created {
+		c.cache.invalidate(userID)
+	}
+	return created, nil
+}
@@ -0,0 +1,62 @@
+package firebase
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBulkInitializeUsers(t *testing.T) {
+	c, db := newTestClient(t)
+	db.Set(t, "users/existing", UserData{Points: 7, Plan: "pro", CreatedAt: time.Now()})
+	db.Set(t, "users/victim", UserData{Points: 40, Plan: "free", CreatedAt: time.Now()})
+
+	points, negative := 250, -10
+	results, err := c.BulkInitializeUsers(context.Background(), []UserInit{
+		{UserID: "new", Email: "new@example.com", Plan: "team", Points: &points},
+		{UserID: "existing", Email: "existing@example.com", Points: &points},
+		{UserID: "victim/points", Points: &points},
+		{UserID: "bad.id"},
+		{UserID: "tab\tid"},
+		{UserID: "negative", Points: &negative},
+		{UserID: ""},
+	})
+	require.NoError(t, err)
+	require.Len(t, results, 7)
+
+	assert.Equal(t, UserInitResult{UserID: "new", Created: true}, results[0])
+	assert.Equal(t, UserInitResult{UserID: "existing", Skipped: true}, results[1])
+	for _, res := range results[2:] {
+		assert.NotEmpty(t, res.Error, res.UserID)
+		assert.False(t, res.Created || res.Skipped, res.UserID)
+	}
+
+	var created UserData
+	db.Get(t, "users/new", &created)
+	assert.Equal(t, 250, created.Points)
+	assert.Equal(t, "team", created.Plan)
+
+	var existing UserData
+	db.Get(t, "users/existing", &existing)
+	assert.Equal(t, 7, existing.Points, "existing users are left untouched")
+	assert.Equal(t, "pro", existing.Plan)
+
+	var victim UserData
+	db.Get(t, "users/victim", &victim)
+	assert.Equal(t, 40, victim.Points, "malformed IDs don't write into other records")
+
+	// Only the created user's starting balance is in the ledger
+	var ledger map[string]map[string]PointGrant
+	db.Get(t, "point_ledger", &ledger)
+	require.Len(t, ledger, 1)
+	for _, grant := range ledger["new"] {
+		assert.Equal(t, 250, grant.Amount)
+		assert.Equal(t, GrantSourceImport, grant.Source)
+	}
+	var negativeUser map[string]interface{}
+	db.Get(t, "users/negative", &negativeUser)
+	assert.Nil(t, negativeUser)
+}
@@ -0,0 +1,234 @@
+package firebase
+
+import (
+	"os"
+	"sync"
+	"time"
+)
+
+// defaultBalanceCacheTTL is how long a cached balance is trusted
+const defaultBalanceCacheTTL = 5 * time.Second
+
+// maxBalanceCacheEntries triggers a sweep of expired entries when exceeded
+const maxBalanceCacheEntries = 100000
+
+// balanceCache keeps recently read points balances and plans in memory so
+// CheckAuth doesn't hit the Realtime Database on every request.
+//
+// Writes made through this Client update the cache immediately, so a user who
+// runs out of points here is blocked on their next request. Writes made by
+// other processes are only observed once the entry expires: in the worst case
+// a user whose balance reached zero elsewhere can keep passing the balance
+// check for up to one TTL, overspending by at most the cost of the requests
+// they make in that window. DeductPoints itself stays transactional, so the
+// stored balance never goes negative.
+type balanceCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	entries map[string]*balanceEntry
+}
+
+// balanceEntry caches the points, plan and status for a user. They may be
+// fetched by separate reads, so each carries its own timestamp.
+type balanceEntry struct {
+	points       int
+	pointsAt     time.Time
+	plan         string
+	planAt       time.Time
+	status       string
+	statusReason string
+	statusAt     time.Time
+	// reserved, requestsToday and avgPoints are read with the status and
+	// share its timestamp
+	reserved      int
+	requestsToday int
+	avgPoints     float64
+	// pricing is the user's pricing override, nil when they have none
+	pricing   *PricingOverride
+	pricingAt time.Time
+}
+
+// newBalanceCacheFromEnv configures the cache from BALANCE_CACHE_TTL (a
+// duration) or USER_POINTS_CACHE_TTL_SECONDS (whole seconds), the former
+// taking precedence. Setting BALANCE_CACHE_DISABLED=true (useful for
+// single-writer correctness tests) returns nil, which disables caching.
+func newBalanceCacheFromEnv() *balanceCache {
+	if os.Getenv("BALANCE_CACHE_DISABLED") == "true" {
+		return nil
+	}
+
+	ttl := time.Duration(envInt("USER_POINTS_CACHE_TTL_SECONDS", int(defaultBalanceCacheTTL/time.Second))) * time.Second
+	return &balanceCache{
+		ttl:     envDuration("BALANCE_CACHE_TTL", ttl),
+		entries: make(map[string]*balanceEntry),
+	}
+}
+
+// getPoints returns a cached balance that hasn't expired
+func (c *balanceCache) getPoints(userID string) (int, bool) {
+	if c == nil {
+		return 0, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[userID]
+	if !ok || e.pointsAt.IsZero() || time.Since(e.pointsAt) > c.ttl {
+		return 0, false
+	}
+	return e.points, true
+}
+
+// getPlan returns a cached plan that hasn't expired
+func (c *balanceCache) getPlan(userID string) (string, bool) {
+	if c == nil {
+		return "", false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[userID]
+	if !ok || e.planAt.IsZero() || time.Since(e.planAt) > c.ttl {
+		return "", false
+	}
+	return e.plan, true
+}
+
+// getAccount returns a cached account if its points, plan and status are all
+// fresh
+func (c *balanceCache) getAccount(userID string) (*UserAccount, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[userID]
+	if !ok || !c.fresh(e.pointsAt) || !c.fresh(e.planAt) || !c.fresh(e.statusAt) {
+		return nil, false
+	}
+	return &UserAccount{
+		Points:              e.points,
+		Plan:                e.plan,
+		Status:              e.status,
+		StatusReason:        e.statusReason,
+		ReservedPoints:      e.reserved,
+		RequestsToday:       e.requestsToday,
+		AvgPointsPerRequest: e.avgPoints,
+	}, true
+}
+
+// setAccount records a freshly read account
+func (c *balanceCache) setAccount(userID string, account *UserAccount) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	e := c.entry(userID)
+	e.points, e.pointsAt = account.Points, now
+	e.plan, e.planAt = account.Plan, now
+	e.status, e.statusReason, e.statusAt = account.Status, account.StatusReason, now
+	e.reserved = account.ReservedPoints
+	e.requestsToday = account.RequestsToday
+	e.avgPoints = account.AvgPointsPerRequest
+}
+
+// fresh reports whether a value cached at t is still within the TTL. Callers
+// must hold c.mu.
+func (c *balanceCache) fresh(t time.Time) bool {
+	return !t.IsZero() && time.Since(t) <= c.ttl
+}
+
+// setPoints records a freshly read or written balance
+func (c *balanceCache) setPoints(userID string, points int) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e := c.entry(userID)
+	e.points = points
+	e.pointsAt = time.Now()
+}
+
+// setPlan records a freshly read or written plan
+func (c *balanceCache) setPlan(userID, plan string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e := c.entry(userID)
+	e.plan = plan
+	e.planAt = time.Now()
+}
+
+// getPricing returns a cached pricing override, which may be nil, that
+// hasn't expired
+func (c *balanceCache) getPricing(userID string) (*PricingOverride, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[userID]
+	if !ok || !c.fresh(e.pricingAt) {
+		return nil, false
+	}
+	return e.pricing, true
+}
+
+// setPricing records a freshly read or written pricing override
+func (c *balanceCache) setPricing(userID string, override *PricingOverride) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e := c.entry(userID)
+	e.pricing = override
+	e.pricingAt = time.Now()
+}
+
+// invalidate drops the cached entry so the next read goes to Firebase
+func (c *balanceCache) invalidate(userID string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, userID)
+}
+
+// entry returns the entry for userID, creating it if needed. Callers must
+// hold c.mu.
+func (c *balanceCache) entry(userID string) *balanceEntry {
+	if e, ok := c.entries[userID]; ok {
+		return e
+	}
+
+	if len(c.entries) >= maxBalanceCacheEntries {
+		c.sweep()
+	}
+
+	e := &balanceEntry{}
+	c.entries[userID] = e
+	return e
+}
+
+// sweep removes entries whose points, plan and status have all expired.
+// Callers must hold c.mu.
+func (c *balanceCache) sweep() {
+	for userID, e := range c.entries {
+		if !c.fresh(e.pointsAt) && !c.fresh(e.planAt) && !c.fresh(e.statusAt) {
+			delete(c.entries, userID)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package firebase
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBalanceCache(t *testing.T) {
+	c := &balanceCache{ttl: time.Minute, entries: make(map[string]*balanceEntry)}
+
+	_, ok := c.getPoints("u1")
+	assert.False(t, ok)
+
+	c.setPoints("u1", 42)
+	points, ok := c.getPoints("u1")
+	assert.True(t, ok)
+	assert.Equal(t, 42, points)
+
+	// Plan is cached independently of points
+	_, ok = c.getPlan("u1")
+	assert.False(t, ok)
+	c.setPlan("u1", "pro")
+	plan, ok := c.getPlan("u1")
+	assert.True(t, ok)
+	assert.Equal(t, "pro", plan)
+
+	c.invalidate("u1")
+	_, ok = c.getPoints("u1")
+	assert.False(t, ok)
+}
+
+func TestBalanceCacheExpires(t *testing.T) {
+	c := &balanceCache{ttl: time.Millisecond, entries: make(map[string]*balanceEntry)}
+	c.setPoints("u1", 42)
+	time.Sleep(5 * time.Millisecond)
+
+	_, ok := c.getPoints("u1")
+	assert.False(t, ok)
+}
+
+func TestBalanceCacheDisabled(t *testing.T) {
+	t.Setenv("BALANCE_CACHE_DISABLED", "true")
+	c := newBalanceCacheFromEnv()
+	assert.Nil(t, c)
+
+	// A nil cache is a no-op
+	c.setPoints("u1", 42)
+	_, ok := c.getPoints("u1")
+	assert.False(t, ok)
+}
+
+func TestBalanceCacheAccount(t *testing.T) {
+	c := &balanceCache{ttl: time.Minute, entries: make(map[string]*balanceEntry)}
+
+	// Points alone don't make a complete account
+	c.setPoints("u1", 42)
+	_, ok := c.getAccount("u1")
+	assert.False(t, ok)
+
+	c.setAccount("u1", &UserAccount{Points: 42, Plan: "pro", Status: UserStatusSuspended, StatusReason: "abuse", ReservedPoints: 10})
+	account, ok := c.getAccount("u1")
+	assert.True(t, ok)
+	assert.Equal(t, &UserAccount{Points: 42, Plan: "pro", Status: UserStatusSuspended, StatusReason: "abuse", ReservedPoints: 10}, account)
+
+	// Deductions keep the cached status
+	c.setPoints("u1", 40)
+	account, ok = c.getAccount("u1")
+	assert.True(t, ok)
+	assert.Equal(t, 40, account.Points)
+	assert.Equal(t, UserStatusSuspended, account.Status)
+	assert.Equal(t, 10, account.ReservedPoints)
+}
+
+func TestBalanceCacheTTLFromEnv(t *testing.T) {
+	assert.Equal(t, defaultBalanceCacheTTL, newBalanceCacheFromEnv().ttl)
+
+	t.Setenv("USER_POINTS_CACHE_TTL_SECONDS", "5")
+	assert.Equal(t, 5*time.Second, newBalanceCacheFromEnv().ttl)
+
+	// The duration form wins when both are set
+	t.Setenv("BALANCE_CACHE_TTL", "250ms")
+	assert.Equal(t, 250*time.Millisecond, newBalanceCacheFromEnv().ttl)
+}
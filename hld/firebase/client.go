@@ -3,20 +3,68 @@ package firebase
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
 	"os"
+	"strings"
+	"syscall"
 	"time"
 
 	firebase "firebase.google.com/go/v4"
 	"firebase.google.com/go/v4/auth"
 	"firebase.google.com/go/v4/db"
+	"firebase.google.com/go/v4/errorutils"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
 	"google.golang.org/api/option"
 )
 
 // Client handles Firebase operations
 type Client struct {
-	auth *auth.Client
-	db   *db.Client
+	auth  *auth.Client
+	db    *db.Client
+	cache *balanceCache
+
+	// flagger spots suspiciously large requests as usage is logged
+	flagger *usageFlagger
+	// overdraftLimit is how far below zero an admin adjustment may take a
+	// balance
+	overdraftLimit int
+	// stalePoints sets how long each plan's points last without activity
+	stalePoints StalePointsPolicy
+	// velocityCap is the most points a user may spend per VelocityWindow
+	velocityCap int
+	// serviceLogNode keeps service account usage out of usage_logs when
+	// set
+	serviceLogNode string
+
+	// dbURL and tokenSource back the REST streaming API, which the Admin
+	// SDK doesn't expose
+	dbURL       string
+	tokenSource oauth2.TokenSource
+
+	// observer is told about every operation; nil unless metrics are on
+	observer OpObserver
+	// audit archives usage logs to GCS; nil unless AUDIT_GCS_BUCKET is set
+	audit *AuditExporter
+	// counter batches requests_by_day increments; nil unless
+	// REQUEST_COUNTER_FLUSH_INTERVAL is set
+	counter *RequestCounter
+
+	// projectID is the audience of the project's own ID tokens. verifier
+	// replaces the SDK's ID token verification when VerifyOptions need it,
+	// and requiredClaim must be set on every token; see SetVerifyOptions.
+	projectID     string
+	verifier      *idTokenVerifier
+	requiredClaim string
+
+	// retry configures how reads are retried; see SetRetryOptions
+	retry []RetryOption
 }
 
 // UsageLog represents a single API usage record
@@ -32,10 +80,82 @@ type UsageLog struct {
 	DurationMS       int64     `json:"duration_ms"`
 	Success          bool      `json:"success"`
 	ErrorMessage     string    `json:"error_message,omitempty"`
+	// Metadata holds application-layer tags such as experiment IDs.
+	// At most 10 keys are kept and values are truncated to 256 characters.
+	Metadata map[string]string `json:"metadata,omitempty"`
+	// DeductionDeferred marks usage served while Firebase was unreachable
+	// whose points still need to be deducted
+	DeductionDeferred bool `json:"deduction_deferred,omitempty"`
+	// RequestID correlates the entry with log lines and the X-Request-ID
+	// response header
+	RequestID string `json:"request_id,omitempty"`
+	// BasePoints is the token cost and SurchargePoints the route surcharge
+	// making up PointsCost
+	BasePoints      int `json:"base_points,omitempty"`
+	SurchargePoints int `json:"surcharge_points,omitempty"`
+	// Anonymous marks trial usage by an anonymous user, which is excluded
+	// from revenue reporting
+	Anonymous bool `json:"anonymous,omitempty"`
+	// Estimated is set on logs written before TokensEstimated, whose
+	// output tokens were estimated from the response size
+	Estimated bool `json:"estimated,omitempty"`
+	// TokensEstimated marks usage the response didn't report, whose tokens
+	// were estimated from the request and response
+	TokensEstimated bool `json:"tokens_estimated,omitempty"`
+	// ErrorClass classifies a failed upstream response: client_error,
+	// rate_limited, server_error or overloaded
+	ErrorClass string `json:"error_class,omitempty"`
+	// CacheCreationTokens and CacheReadTokens are the prompt tokens the
+	// response reported writing to and reading from the prompt cache
+	CacheCreationTokens int `json:"cache_creation_tokens,omitempty"`
+	CacheReadTokens     int `json:"cache_read_tokens,omitempty"`
+	// ContentType and ResponseBytes describe a response that was neither
+	// JSON nor an event stream, whose body wasn't read for usage
+	ContentType   string `json:"content_type,omitempty"`
+	ResponseBytes int64  `json:"response_bytes,omitempty"`
+	// CacheHit marks a response replayed from the proxy's response cache,
+	// billed at the cache rate
+	CacheHit bool `json:"cache_hit,omitempty"`
+	// HoldID is the points hold taken before the request was served and
+	// EstimatedCost the points it held; PointsCost was captured against it
+	// and the rest refunded. A hold left by a crash can be matched to its
+	// log, or found unsettled, by this ID.
+	HoldID        string `json:"hold_id,omitempty"`
+	EstimatedCost int    `json:"estimated_cost,omitempty"`
+	// StreamIncomplete marks a streamed response that ended before
+	// message_stop or had undecodable events; it was billed for the usage
+	// its events reported up to that point
+	StreamIncomplete bool `json:"stream_incomplete,omitempty"`
+	// Service marks unbilled usage by an internal service account, which
+	// is left out of request counts and usage reporting
+	Service bool `json:"service,omitempty"`
+	// Reason explains an unbilled successful request, e.g.
+	// UsageReasonCacheHit
+	Reason string `json:"reason,omitempty"`
+	// Impersonated marks usage by an admin acting as the user with an
+	// impersonation token; ImpersonatorID is the admin
+	Impersonated   bool   `json:"is_impersonated,omitempty"`
+	ImpersonatorID string `json:"impersonator_id,omitempty"`
+	// Pricing is the contracted rates the request was charged at, for users
+	// with a PricingOverride
+	Pricing *AppliedPricing `json:"pricing_override,omitempty"`
 }
 
+// Reasons recorded on successful requests that used no tokens
+const (
+	// UsageReasonCacheHit marks a request answered from the response
+	// cache, which used no tokens
+	UsageReasonCacheHit = "cache_hit"
+	// UsageReasonConnectionHijacked marks a request whose handler took over
+	// the connection, e.g. for a WebSocket, so no response was read
+	UsageReasonConnectionHijacked = "connection_hijacked"
+)
+
 // UserData represents user information
 type UserData struct {
+	// ID is the user's key, populated only when listing users or looking
+	// them up by email
+	ID            string    `json:"id,omitempty"`
 	Email         string    `json:"email"`
 	Points        int       `json:"points"`
 	TotalUsed     int       `json:"total_used"`
@@ -43,32 +163,103 @@ type UserData struct {
 	Plan          string    `json:"plan"`
 	CreatedAt     time.Time `json:"created_at"`
 	LastRequest   time.Time `json:"last_request"`
+	// DefaultModel is used when a request doesn't name a model
+	DefaultModel string `json:"default_model,omitempty"`
+	// Holds are points reserved for in-flight requests, keyed by push ID
+	Holds map[string]PointsHold `json:"holds,omitempty"`
+	// Status is active, suspended or banned; empty means active
+	Status       string `json:"status,omitempty"`
+	StatusReason string `json:"status_reason,omitempty"`
+	// StatusUpdatedAt is when Status was last changed by an admin
+	StatusUpdatedAt *time.Time `json:"status_updated_at,omitempty"`
+	// PointGrants are expiring blocks of points, keyed by push ID
+	PointGrants map[string]PointGrant `json:"point_grants,omitempty"`
+	// NextGrantExpiryMS is the earliest grant expiry in Unix milliseconds,
+	// or zero without grants
+	NextGrantExpiryMS int64 `json:"next_grant_expiry_ms,omitempty"`
+	// ReservedPoints can only be spent by forced deductions, see ForceDeduct
+	ReservedPoints int `json:"reserved_points,omitempty"`
+	// RequestsByDay counts logged requests per YYYY-MM-DD day
+	RequestsByDay map[string]int `json:"requests_by_day,omitempty"`
+	// TrialRequests counts requests admitted for an anonymous trial user
+	TrialRequests int `json:"trial_requests,omitempty"`
+	// MigratedTo is the account an anonymous trial was converted into
+	MigratedTo string `json:"migrated_to,omitempty"`
+	// ExpiresAt is when the balance is zeroed if the user stays inactive,
+	// per their plan's StalePointsPolicy; nil when it doesn't expire
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	// AvgPointsPerRequest is a rolling average of the points charged per
+	// request, see recordCharge
+	AvgPointsPerRequest float64 `json:"avg_points_per_request,omitempty"`
+}
+
+// UserPreferences holds user-editable settings
+type UserPreferences struct {
+	DefaultModel string `json:"default_model"`
+}
+
+// DefaultModel is the fallback model when neither the request, the user nor
+// their plan specifies one
+const DefaultModel = "claude-3-5-sonnet-20241022"
+
+// Config holds the credentials and database location of a Firebase project
+type Config struct {
+	ProjectID   string `json:"project_id"`
+	PrivateKey  string `json:"private_key"`
+	ClientEmail string `json:"client_email"`
+	// DatabaseURL defaults to https://<project_id>.firebaseio.com
+	DatabaseURL string `json:"database_url,omitempty"`
 }
 
-// NewClient creates a new Firebase client
-func NewClient(ctx context.Context) (*Client, error) {
-	// Get Firebase config from environment
-	projectID := os.Getenv("FIREBASE_PROJECT_ID")
-	if projectID == "" {
-		return nil, fmt.Errorf("FIREBASE_PROJECT_ID environment variable not set")
+// ConfigFromEnv reads the project configuration from FIREBASE_PROJECT_ID,
+// FIREBASE_PRIVATE_KEY, FIREBASE_CLIENT_EMAIL and the optional
+// FIREBASE_DATABASE_URL
+func ConfigFromEnv() (Config, error) {
+	return configFromLookup(os.Getenv)
+}
+
+// configFromLookup builds a project configuration from the FIREBASE_*
+// variables as resolved by lookup
+func configFromLookup(lookup func(key string) string) (Config, error) {
+	cfg := Config{
+		ProjectID:   lookup("FIREBASE_PROJECT_ID"),
+		PrivateKey:  lookup("FIREBASE_PRIVATE_KEY"),
+		ClientEmail: lookup("FIREBASE_CLIENT_EMAIL"),
+		DatabaseURL: lookup("FIREBASE_DATABASE_URL"),
+	}
+	if cfg.ProjectID == "" {
+		return Config{}, fmt.Errorf("FIREBASE_PROJECT_ID environment variable not set")
 	}
+	if cfg.PrivateKey == "" {
+		return Config{}, fmt.Errorf("FIREBASE_PRIVATE_KEY environment variable not set")
+	}
+	if cfg.ClientEmail == "" {
+		return Config{}, fmt.Errorf("FIREBASE_CLIENT_EMAIL environment variable not set")
+	}
+	return cfg, nil
+}
 
-	privateKey := os.Getenv("FIREBASE_PRIVATE_KEY")
-	if privateKey == "" {
-		return nil, fmt.Errorf("FIREBASE_PRIVATE_KEY environment variable not set")
+// NewClientFromEnv creates a single-tenant client configured from environment
+func NewClientFromEnv(ctx context.Context) (*Client, error) {
+	cfg, err := ConfigFromEnv()
+	if err != nil {
+		return nil, err
 	}
+	return NewClient(ctx, cfg)
+}
 
-	clientEmail := os.Getenv("FIREBASE_CLIENT_EMAIL")
-	if clientEmail == "" {
-		return nil, fmt.Errorf("FIREBASE_CLIENT_EMAIL environment variable not set")
+// NewClient creates a new Firebase client for the given project
+func NewClient(ctx context.Context, cfg Config) (*Client, error) {
+	if cfg.ProjectID == "" || cfg.PrivateKey == "" || cfg.ClientEmail == "" {
+		return nil, fmt.Errorf("firebase config requires project_id, private_key and client_email")
 	}
 
 	// Create service account credentials
 	credentials := map[string]interface{}{
 		"type":                        "service_account",
-		"project_id":                  projectID,
-		"private_key":                 privateKey,
-		"client_email":                clientEmail,
+		"project_id":                  cfg.ProjectID,
+		"private_key":                 cfg.PrivateKey,
+		"client_email":                cfg.ClientEmail,
 		"token_uri":                   "https://oauth2.googleapis.com/token",
 	}
 
@@ -90,45 +281,212 @@ func NewClient(ctx context.Context) (*Client, error) {
 		return nil, fmt.Errorf("error initializing Auth client: %w", err)
 	}
 
-	// Initialize Realtime Database client
-	dbURL := fmt.Sprintf("https://%s.firebaseio.com", projectID)
-	dbClient, err := app.DatabaseWithURL(ctx, dbURL)
+	// Initialize Realtime Database client. The Database emulator takes no
+	// credentials, and the SDK refuses to combine its own with ours.
+	dbURL := cfg.DatabaseURL
+	if dbURL == "" {
+		dbURL = fmt.Sprintf("https://%s.firebaseio.com", cfg.ProjectID)
+	}
+	dbApp := app
+	if usesDatabaseEmulator(dbURL) {
+		dbApp, err = firebase.NewApp(ctx, &firebase.Config{ProjectID: cfg.ProjectID}, option.WithTokenSource(oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "owner"})))
+		if err != nil {
+			return nil, fmt.Errorf("error initializing Firebase app: %w", err)
+		}
+	}
+	dbClient, err := dbApp.DatabaseWithURL(ctx, dbURL)
 	if err != nil {
 		return nil, fmt.Errorf("error initializing Database client: %w", err)
 	}
 
+	creds, err := google.CredentialsFromJSON(ctx, credentialsJSON, databaseScopes...)
+	if err != nil {
+		return nil, fmt.Errorf("error initializing database credentials: %w", err)
+	}
+
 	return &Client{
-		auth: authClient,
-		db:   dbClient,
+		auth:           authClient,
+		db:             dbClient,
+		cache:          newBalanceCacheFromEnv(),
+		flagger:        newUsageFlaggerFromEnv(),
+		overdraftLimit: envInt("POINTS_OVERDRAFT_LIMIT", 0),
+		stalePoints:    stalePointsPolicyFromEnv(),
+		velocityCap:    envInt("VELOCITY_CAP_POINTS", defaultVelocityCap),
+		serviceLogNode: serviceUsageNodeFromEnv(),
+		dbURL:          strings.TrimRight(dbURL, "/"),
+		projectID:      cfg.ProjectID,
+		tokenSource:    creds.TokenSource,
 	}, nil
 }
 
-// VerifyToken validates a Firebase ID token and returns the user ID
-func (c *Client) VerifyToken(ctx context.Context, idToken string) (string, error) {
-	token, err := c.auth.VerifyIDToken(ctx, idToken)
+// usesDatabaseEmulator reports whether the SDK treats dbURL as the
+// Database emulator: any URL that isn't https, or any URL at all while
+// FIREBASE_DATABASE_EMULATOR_HOST is set
+func usesDatabaseEmulator(dbURL string) bool {
+	if os.Getenv("FIREBASE_DATABASE_EMULATOR_HOST") != "" {
+		return true
+	}
+	u, err := url.ParseRequestURI(dbURL)
+	return err == nil && u.Scheme != "https"
+}
+
+// TokenInfo holds the verified claims of a Firebase ID token
+type TokenInfo struct {
+	UID           string
+	Email         string
+	EmailVerified bool
+	// SignInProvider is the Firebase provider ID, e.g. "password" or "google.com"
+	SignInProvider string
+	// Admin is set by the admin custom claim; see SetAdminClaim
+	Admin bool
+	// ServiceAccount is set by the service_account custom claim
+	ServiceAccount bool
+}
+
+// VerifyToken validates a Firebase ID token, as adjusted by SetVerifyOptions,
+// and returns its claims
+func (c *Client) VerifyToken(ctx context.Context, idToken string) (_ *TokenInfo, err error) {
+	defer c.observe("VerifyToken", c.opStart(), &err)
+	var token *auth.Token
+	if c.verifier != nil {
+		token, err = c.verifier.verify(ctx, idToken)
+	} else {
+		token, err = c.auth.VerifyIDToken(ctx, idToken)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error verifying token: %w", err)
+	}
+	if err := c.checkRequiredClaim(token.Claims); err != nil {
+		return nil, err
+	}
+	return tokenInfo(token), nil
+}
+
+// VerifySessionCookie validates a Firebase session cookie, as created by
+// createSessionCookie, and returns the same claims as VerifyToken. Cookies
+// are rejected once the user's sessions have been revoked.
+func (c *Client) VerifySessionCookie(ctx context.Context, cookie string) (_ *TokenInfo, err error) {
+	defer c.observe("VerifySessionCookie", c.opStart(), &err)
+	token, err := c.auth.VerifySessionCookieAndCheckRevoked(ctx, cookie)
 	if err != nil {
-		return "", fmt.Errorf("error verifying token: %w", err)
+		return nil, fmt.Errorf("error verifying session cookie: %w", err)
+	}
+	if err := c.checkRequiredClaim(token.Claims); err != nil {
+		return nil, err
 	}
-	return token.UID, nil
+	return tokenInfo(token), nil
 }
 
-// GetUserPoints retrieves the current points balance for a user
-func (c *Client) GetUserPoints(ctx context.Context, userID string) (int, error) {
-	ref := c.db.NewRef(fmt.Sprintf("users/%s/points", userID))
+// tokenInfo extracts the claims used for authorization from a verified token
+func tokenInfo(token *auth.Token) *TokenInfo {
+	email, _ := token.Claims["email"].(string)
+	emailVerified, _ := token.Claims["email_verified"].(bool)
+	return &TokenInfo{
+		UID:            token.UID,
+		Email:          email,
+		EmailVerified:  emailVerified,
+		SignInProvider: token.Firebase.SignInProvider,
+		Admin:          hasAdminClaim(token.Claims),
+		ServiceAccount: hasServiceAccountClaim(token.Claims),
+	}
+}
+
+// GetUserPoints retrieves the current points balance for a user, served
+// from the balance cache when a fresh entry exists
+func (c *Client) GetUserPoints(ctx context.Context, userID string) (_ int, err error) {
+	defer c.observe("GetUserPoints", c.opStart(), &err)
+	if points, ok := c.cache.getPoints(userID); ok {
+		return points, nil
+	}
+
+	ref := c.db.NewRef(userPath(userID)+"/points")
 	
 	var points int
-	if err := ref.Get(ctx, &points); err != nil {
+	if err := withRetry(ctx, func() error { return ref.Get(ctx, &points) }, c.retry...); err != nil {
 		return 0, fmt.Errorf("error getting user points: %w", err)
 	}
 	
+	c.cache.setPoints(userID, points)
 	return points, nil
 }
 
-// DeductPoints removes points from a user's balance (atomic transaction)
-func (c *Client) DeductPoints(ctx context.Context, userID string, amount int) error {
-	ref := c.db.NewRef(fmt.Sprintf("users/%s", userID))
+// GetUserPlan retrieves the plan name for a user, defaulting to "free"
+func (c *Client) GetUserPlan(ctx context.Context, userID string) (_ string, err error) {
+	defer c.observe("GetUserPlan", c.opStart(), &err)
+	if plan, ok := c.cache.getPlan(userID); ok {
+		return plan, nil
+	}
+
+	ref := c.db.NewRef(userPath(userID)+"/plan")
+
+	var plan string
+	if err := withRetry(ctx, func() error { return ref.Get(ctx, &plan) }, c.retry...); err != nil {
+		return "", fmt.Errorf("error getting user plan: %w", err)
+	}
+	if plan == "" {
+		plan = "free"
+	}
+
+	c.cache.setPlan(userID, plan)
+	return plan, nil
+}
+
+// GetUserDefaultModel retrieves the user's preferred default model, or an
+// empty string if none is set
+func (c *Client) GetUserDefaultModel(ctx context.Context, userID string) (_ string, err error) {
+	defer c.observe("GetUserDefaultModel", c.opStart(), &err)
+	ref := c.db.NewRef(userPath(userID)+"/default_model")
+
+	var model string
+	if err := withRetry(ctx, func() error { return ref.Get(ctx, &model) }, c.retry...); err != nil {
+		return "", fmt.Errorf("error getting user default model: %w", err)
+	}
+
+	return model, nil
+}
+
+// SetUserPreferences updates user-editable settings. An empty default model
+// clears the preference.
+func (c *Client) SetUserPreferences(ctx context.Context, userID string, prefs UserPreferences) (err error) {
+	defer c.observe("SetUserPreferences", c.opStart(), &err)
+	ref := c.db.NewRef(userPath(userID))
+
+	var defaultModel interface{}
+	if prefs.DefaultModel != "" {
+		defaultModel = prefs.DefaultModel
+	}
+
+	if err := ref.Update(ctx, map[string]interface{}{"default_model": defaultModel}); err != nil {
+		return fmt.Errorf("error updating user preferences: %w", err)
+	}
+
+	return nil
+}
+
+// DeductPoints removes points from a user's balance (atomic transaction).
+// Reserved points are only spent when ForceDeduct is passed; otherwise
+// ErrInsufficientPoints is returned once the unreserved balance runs out.
+// Unforced deductions count towards the user's spending velocity and fail
+// with ErrVelocityExceeded once more than VELOCITY_CAP_POINTS (default 500)
+// have been spent within VelocityWindow.
+func (c *Client) DeductPoints(ctx context.Context, userID string, amount int, opts ...DeductOption) (err error) {
+	defer c.observe("DeductPoints", c.opStart(), &err)
+	var o deductOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	// Forced deductions are exempt from the spending velocity cap
+	if !o.force {
+		if err := c.takeVelocity(ctx, userID, amount); err != nil {
+			return err
+		}
+	}
+
+	ref := c.db.NewRef(userPath(userID))
 	
-	return ref.Transaction(ctx, func(tn db.TransactionNode) (interface{}, error) {
+	var balance int
+	err = ref.Transaction(ctx, func(tn db.TransactionNode) (interface{}, error) {
 		var user UserData
 		if err := tn.Unmarshal(&user); err != nil {
 			// User doesn't exist, initialize
@@ -140,25 +498,35 @@ func (c *Client) DeductPoints(ctx context.Context, userID string, amount int) er
 			}
 		}
 		
-		// Check if user has enough points
-		if user.Points < amount {
-			return nil, fmt.Errorf("insufficient points: has %d, needs %d", user.Points, amount)
+		if err := user.deduct(amount, o, time.Now()); err != nil {
+			return nil, err
 		}
+		c.stalePoints.refreshExpiry(&user)
 		
-		// Deduct points
-		user.Points -= amount
-		user.TotalUsed += amount
-		user.LastRequest = time.Now()
-		
+		balance = user.Points
 		return user, nil
 	})
+	if err != nil {
+		if !o.force {
+			c.refundVelocity(ctx, userID, amount)
+		}
+		// Force a fresh read so an exhausted balance is seen on the next check
+		c.cache.invalidate(userID)
+		return err
+	}
+
+	c.cache.setPoints(userID, balance)
+	return nil
 }
 
-// AddPoints adds points to a user's balance
-func (c *Client) AddPoints(ctx context.Context, userID string, amount int) error {
-	ref := c.db.NewRef(fmt.Sprintf("users/%s", userID))
+// AddPoints adds purchased points to a user's balance and records the
+// purchase in the grant ledger
+func (c *Client) AddPoints(ctx context.Context, userID string, amount int) (err error) {
+	defer c.observe("AddPoints", c.opStart(), &err)
+	ref := c.db.NewRef(userPath(userID))
 	
-	return ref.Transaction(ctx, func(tn db.TransactionNode) (interface{}, error) {
+	var balance int
+	err = ref.Transaction(ctx, func(tn db.TransactionNode) (interface{}, error) {
 		var user UserData
 		if err := tn.Unmarshal(&user); err != nil {
 			// User doesn't exist, initialize
@@ -169,104 +537,275 @@ func (c *Client) AddPoints(ctx context.Context, userID string, amount int) error
 			}
 		}
 		
+		user.expireGrants(time.Now())
 		user.Points += amount
 		user.LastRequest = time.Now()
+		c.stalePoints.refreshExpiry(&user)
 		
+		balance = user.Points
 		return user, nil
 	})
+	if err != nil {
+		c.cache.invalidate(userID)
+		return err
+	}
+
+	c.cache.setPoints(userID, balance)
+	c.recordGrant(ctx, userID, "", PointGrant{Amount: amount, Source: GrantSourcePurchase, GrantedAt: time.Now()})
+	return nil
 }
 
 // LogUsage records an API usage event
-func (c *Client) LogUsage(ctx context.Context, log UsageLog) error {
-	ref := c.db.NewRef("usage_logs").Push(ctx)
-	
-	if err := ref.Set(ctx, log); err != nil {
+func (c *Client) LogUsage(ctx context.Context, log UsageLog) (err error) {
+	defer c.observe("LogUsage", c.opStart(), &err)
+	ref, err := c.db.NewRef(c.usageLogNode(log)).Push(ctx, log)
+	if err != nil {
 		return fmt.Errorf("error logging usage: %w", err)
 	}
+	c.audit.Add(ref.Key, log)
+	// Service account usage isn't flagged or counted
+	if log.Service {
+		return nil
+	}
+	// The usage is already recorded, so a failed flag must not fail the call
+	if err := c.flagUsage(ctx, map[string]UsageLog{ref.Key: log}); err != nil {
+		slog.Error("failed to flag usage", "user_id", log.UserID, "error", err)
+	}
 	
 	// Update user's requests today counter
 	today := time.Now().Format("2006-01-02")
-	requestsRef := c.db.NewRef(fmt.Sprintf("users/%s/requests_by_day/%s", log.UserID, today))
+	return c.countRequests(ctx, log.UserID, today, 1)
+}
+
+// LogUsageBatch records several usage events with a single multi-path write
+func (c *Client) LogUsageBatch(ctx context.Context, logs []UsageLog) (err error) {
+	defer c.observe("LogUsageBatch", c.opStart(), &err)
+	if len(logs) == 0 {
+		return nil
+	}
+
+	updates := make(map[string]interface{}, len(logs))
+	keys := make([]string, len(logs))
+	for i, log := range logs {
+		// Generate push-style keys locally to avoid a round trip per entry
+		key := newPushID(log.Timestamp)
+		keys[i] = key
+		updates[c.usageLogNode(log)+"/"+key] = log
+	}
+
+	if err := c.db.NewRef("/").Update(ctx, updates); err != nil {
+		return fmt.Errorf("error logging usage batch: %w", err)
+	}
+	return c.usageLogged(ctx, keys, logs)
+}
+
+// usageLogged archives, flags and counts usage once its logs are stored
+// under keys, whichever UsageStore holds them
+func (c *Client) usageLogged(ctx context.Context, keys []string, logs []UsageLog) error {
+	keyed := make(map[string]UsageLog, len(logs))
+	for i, log := range logs {
+		c.audit.Add(keys[i], log)
+		if !log.Service {
+			keyed[keys[i]] = log
+		}
+	}
+	if err := c.flagUsage(ctx, keyed); err != nil {
+		slog.Error("failed to flag usage batch", "error", err)
+	}
+
+	// Collapse request counters so each user/day pair is a single transaction
+	today := time.Now().Format("2006-01-02")
+	counts := make(map[string]int)
+	for _, log := range logs {
+		if !log.Service {
+			counts[log.UserID]++
+		}
+	}
+
+	var firstErr error
+	for userID, n := range counts {
+		if err := c.countRequests(ctx, userID, today, n); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("%w: error updating request counter for %s: %w", ErrUsageRecorded, userID, err)
+		}
+	}
+	return firstErr
+}
+
+// incrementRequestsByDay adds n to the user's request counter for day
+func (c *Client) incrementRequestsByDay(ctx context.Context, userID, day string, n int) error {
+	requestsRef := c.db.NewRef(userPath(userID)+"/requests_by_day/"+day)
 	
 	return requestsRef.Transaction(ctx, func(tn db.TransactionNode) (interface{}, error) {
 		var count int
 		if err := tn.Unmarshal(&count); err != nil {
 			count = 0
 		}
-		return count + 1, nil
+		return count + n, nil
 	})
 }
 
 // GetUserData retrieves complete user data
-func (c *Client) GetUserData(ctx context.Context, userID string) (*UserData, error) {
-	ref := c.db.NewRef(fmt.Sprintf("users/%s", userID))
+func (c *Client) GetUserData(ctx context.Context, userID string) (_ *UserData, err error) {
+	defer c.observe("GetUserData", c.opStart(), &err)
+	ref := c.db.NewRef(userPath(userID))
 	
 	var user UserData
-	if err := ref.Get(ctx, &user); err != nil {
+	if err := withRetry(ctx, func() error { return ref.Get(ctx, &user) }, c.retry...); err != nil {
 		return nil, fmt.Errorf("error getting user data: %w", err)
 	}
 	
 	return &user, nil
 }
 
-// InitializeUser creates a new user with default points
-func (c *Client) InitializeUser(ctx context.Context, userID string, email string) error {
-	ref := c.db.NewRef(fmt.Sprintf("users/%s", userID))
-	
-	// Check if user already exists
-	var existing UserData
-	if err := ref.Get(ctx, &existing); err == nil && existing.CreatedAt.Unix() > 0 {
-		// User already exists
-		return nil
+// Defaults for withRetry
+const (
+	defaultRetries    = 3
+	defaultRetryDelay = 100 * time.Millisecond
+)
+
+// RetryOption changes how failed database reads are retried
+type RetryOption func(*retryOptions)
+
+type retryOptions struct {
+	retries int
+	delay   time.Duration
+}
+
+// WithRetries sets how many times a failed call is retried; zero disables
+// retries
+func WithRetries(n int) RetryOption {
+	return func(o *retryOptions) {
+		o.retries = max(n, 0)
 	}
-	
-	// Get default points from env or use 100
-	defaultPoints := 100
-	if envPoints := os.Getenv("DEFAULT_USER_POINTS"); envPoints != "" {
-		fmt.Sscanf(envPoints, "%d", &defaultPoints)
+}
+
+// WithRetryDelay sets the delay before the first retry, which doubles
+// after each
+func WithRetryDelay(d time.Duration) RetryOption {
+	return func(o *retryOptions) {
+		o.delay = d
 	}
-	
+}
+
+// SetRetryOptions changes how reads are retried from the default of three
+// retries starting 100ms apart. It must be called before the client is
+// shared.
+func (c *Client) SetRetryOptions(opts ...RetryOption) {
+	c.retry = opts
+}
+
+// withRetry runs op, retrying it with exponential backoff while it fails
+// with a transient error. Permanent errors are returned at once, and the
+// last error once retries run out or ctx is done. op must be safe to
+// repeat.
+func withRetry(ctx context.Context, op func() error, opts ...RetryOption) error {
+	o := retryOptions{retries: defaultRetries, delay: defaultRetryDelay}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	delay := o.delay
+	for attempt := 0; ; attempt++ {
+		err := op()
+		if err == nil || attempt >= o.retries || !isRetriable(err) {
+			return err
+		}
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return err
+		}
+		delay *= 2
+	}
+}
+
+// isRetriable reports whether err is transient: the database unavailable,
+// overloaded or failing internally, or the connection failing. Cancelled
+// and timed out contexts aren't retried.
+func isRetriable(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	if errorutils.IsUnavailable(err) || errorutils.IsInternal(err) || errorutils.IsResourceExhausted(err) ||
+		errorutils.IsDeadlineExceeded(err) || errorutils.IsAborted(err) {
+		return true
+	}
+	if resp := errorutils.HTTPResponse(err); resp != nil &&
+		(resp.StatusCode == http.StatusBadGateway || resp.StatusCode == http.StatusGatewayTimeout) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, syscall.ECONNRESET)
+}
+
+// InitializeUser creates a new user with default points. The existence check
+// and write happen in one transaction, so concurrent first requests grant the
+// starting balance only once. It reports whether a new record was created.
+// WithAnonymousTrial additionally moves a trial's remaining points to a
+// newly created user.
+func (c *Client) InitializeUser(ctx context.Context, userID string, email string, opts ...InitOption) (_ bool, err error) {
+	defer c.observe("InitializeUser", c.opStart(), &err)
 	user := UserData{
 		Email:     email,
-		Points:    defaultPoints,
+		Points:    defaultUserPoints(),
 		TotalUsed: 0,
 		Plan:      "free",
 		CreatedAt: time.Now(),
 	}
-	
-	return ref.Set(ctx, user)
+	created, err := c.createUserIfAbsent(ctx, userID, user)
+	if err != nil || !created {
+		return created, err
+	}
+
+	c.recordGrant(ctx, userID, "", PointGrant{Amount: user.Points, Source: GrantSourceSignup, GrantedAt: user.CreatedAt})
+	c.migrateTrialOnInit(ctx, userID, opts)
+	return true, nil
 }
 
-// CalculatePointsCost calculates the points cost for a request
-func CalculatePointsCost(model string, inputTokens, outputTokens int) int {
-	// Pricing per 1K tokens (in points)
-	pricing := map[string]struct{ input, output float64 }{
-		"claude-3-opus-20240229":      {input: 15.0, output: 75.0},
-		"claude-3-5-sonnet-20241022":  {input: 3.0, output: 15.0},
-		"claude-3-5-haiku-20241022":   {input: 0.8, output: 4.0},
-		"claude-3-sonnet-20240229":    {input: 3.0, output: 15.0},
-		"claude-3-haiku-20240307":     {input: 0.25, output: 1.25},
-	}
-	
-	// Default to Sonnet pricing if model not found
-	rates, ok := pricing[model]
-	if !ok {
-		rates = pricing["claude-3-5-sonnet-20241022"]
+// defaultUserPoints returns the starting balance for new users from
+// DEFAULT_USER_POINTS, falling back to 100
+func defaultUserPoints() int {
+	defaultPoints := 100
+	if envPoints := os.Getenv("DEFAULT_USER_POINTS"); envPoints != "" {
+		fmt.Sscanf(envPoints, "%d", &defaultPoints)
 	}
-	
-	// Calculate cost
-	inputCost := (float64(inputTokens) / 1000.0) * rates.input
-	outputCost := (float64(outputTokens) / 1000.0) * rates.output
-	
-	// Round up to nearest point
-	totalCost := int(inputCost + outputCost + 0.99)
-	
-	// Minimum 1 point per request
-	if totalCost < 1 {
-		totalCost = 1
+	return defaultPoints
+}
+
+// modelPricing is the points cost per 1K tokens for each known model
+var modelPricing = map[string]struct{ input, output float64 }{
+	"claude-3-opus-20240229":      {input: 15.0, output: 75.0},
+	"claude-3-5-sonnet-20241022":  {input: 3.0, output: 15.0},
+	"claude-3-5-haiku-20241022":   {input: 0.8, output: 4.0},
+	"claude-3-sonnet-20240229":    {input: 3.0, output: 15.0},
+	"claude-3-haiku-20240307":     {input: 0.25, output: 1.25},
+}
+
+// IsKnownModel reports whether model, or the model it is an alias for, has
+// pricing configured
+func IsKnownModel(model string) bool {
+	_, ok := modelPricing[ResolveModelAlias(model)]
+	return ok
+}
+
+// CheapestModel returns the known model with the lowest combined input and
+// output rate
+func CheapestModel() string {
+	cheapest := ""
+	for model, rates := range modelPricing {
+		best := modelPricing[cheapest]
+		if cheapest == "" || rates.input+rates.output < best.input+best.output ||
+			(rates.input+rates.output == best.input+best.output && model < cheapest) {
+			cheapest = model
+		}
 	}
-	
-	return totalCost
+	return cheapest
+}
+
+// CalculatePointsCost calculates the points cost for a request at the
+// public rates; see CalculatePointsCostFor for users with contracted pricing
+func CalculatePointsCost(model string, inputTokens, outputTokens int) int {
+	return CalculatePointsCostFor(model, inputTokens, outputTokens, nil)
 }
 
 
@@ -0,0 +1,147 @@
+package firebase
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/humanlayer/humanlayer/hld/internal/testutil"
+)
+
+// newTestClient returns a client backed by an in-memory database
+func newTestClient(t *testing.T) (*Client, *testutil.RealtimeDatabase) {
+	t.Helper()
+	db := testutil.NewRealtimeDatabase(t)
+	c, err := NewClient(context.Background(), Config{
+		ProjectID:   "test-project",
+		PrivateKey:  testutil.PrivateKeyPEM(t),
+		ClientEmail: "test@test-project.iam.gserviceaccount.com",
+		DatabaseURL: db.DatabaseURL(),
+	})
+	require.NoError(t, err)
+	return c, db
+}
+
+func TestWithRetry(t *testing.T) {
+	transient := &net.OpError{Op: "read", Net: "tcp", Err: errors.New("connection reset by peer")}
+	fast := WithRetryDelay(time.Millisecond)
+
+	t.Run("recovers from transient errors", func(t *testing.T) {
+		calls := 0
+		err := withRetry(context.Background(), func() error {
+			if calls++; calls < 3 {
+				return transient
+			}
+			return nil
+		}, fast)
+		assert.NoError(t, err)
+		assert.Equal(t, 3, calls)
+	})
+
+	t.Run("gives up after the retries", func(t *testing.T) {
+		calls := 0
+		err := withRetry(context.Background(), func() error {
+			calls++
+			return transient
+		}, fast)
+		assert.ErrorIs(t, err, transient)
+		assert.Equal(t, 1+defaultRetries, calls)
+
+		calls = 0
+		_ = withRetry(context.Background(), func() error {
+			calls++
+			return transient
+		}, fast, WithRetries(1))
+		assert.Equal(t, 2, calls)
+	})
+
+	t.Run("returns permanent errors at once", func(t *testing.T) {
+		calls := 0
+		err := withRetry(context.Background(), func() error {
+			calls++
+			return ErrUserNotFound
+		}, fast)
+		assert.ErrorIs(t, err, ErrUserNotFound)
+		assert.Equal(t, 1, calls)
+	})
+
+	t.Run("stops when the context is done", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		calls := 0
+		err := withRetry(ctx, func() error {
+			calls++
+			cancel()
+			return transient
+		}, WithRetryDelay(time.Hour))
+		assert.ErrorIs(t, err, transient)
+		assert.Equal(t, 1, calls)
+	})
+}
+
+func TestIsRetriable(t *testing.T) {
+	assert.True(t, isRetriable(&net.OpError{Op: "dial", Err: errors.New("refused")}))
+	assert.True(t, isRetriable(fmt.Errorf("reading: %w", &net.DNSError{IsTemporary: true})))
+	assert.False(t, isRetriable(errors.New("permission denied")))
+	assert.False(t, isRetriable(context.Canceled))
+	assert.False(t, isRetriable(fmt.Errorf("get: %w", context.DeadlineExceeded)))
+}
+
+func TestInitializeUser(t *testing.T) {
+	t.Run("concurrent calls grant the starting balance once", func(t *testing.T) {
+		c, db := newTestClient(t)
+
+		const callers = 8
+		var wg sync.WaitGroup
+		created := make(chan bool, callers)
+		for i := 0; i < callers; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				ok, err := c.InitializeUser(context.Background(), "u1", "u1@example.com")
+				assert.NoError(t, err)
+				created <- ok
+			}()
+		}
+		wg.Wait()
+		close(created)
+
+		count := 0
+		for ok := range created {
+			if ok {
+				count++
+			}
+		}
+		assert.Equal(t, 1, count)
+
+		var user UserData
+		db.Get(t, "users/u1", &user)
+		assert.Equal(t, defaultUserPoints(), user.Points)
+		var ledger map[string]PointGrant
+		db.Get(t, grantLedgerPath("u1"), &ledger)
+		assert.Len(t, ledger, 1, "one signup grant")
+	})
+
+	t.Run("existing balance is kept", func(t *testing.T) {
+		c, db := newTestClient(t)
+		db.Set(t, "users/u1", UserData{Points: 7, Plan: "pro", CreatedAt: time.Now()})
+
+		created, err := c.InitializeUser(context.Background(), "u1", "u1@example.com")
+		require.NoError(t, err)
+		assert.False(t, created)
+
+		var user UserData
+		db.Get(t, "users/u1", &user)
+		assert.Equal(t, 7, user.Points)
+		assert.Equal(t, "pro", user.Plan)
+		var ledger map[string]PointGrant
+		db.Get(t, grantLedgerPath("u1"), &ledger)
+		assert.Empty(t, ledger)
+	})
+}
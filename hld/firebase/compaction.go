@@ -0,0 +1,256 @@
+package firebase
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"firebase.google.com/go/v4/db"
+)
+
+// compactionBatchSize is the number of usage logs folded into the rollups
+// and deleted per atomic update
+const compactionBatchSize = 500
+
+// compactionLeaseTTL bounds how long a crashed compaction blocks others
+const compactionLeaseTTL = 30 * time.Minute
+
+// ErrCompactionRunning is returned when another instance holds the
+// compaction lease
+var ErrCompactionRunning = errors.New("usage log compaction already running")
+
+// UsageRollup aggregates one user's usage logs for a month. Rollups live at
+// usage_rollups/{YYYY-MM}/{userID}.
+type UsageRollup struct {
+	Requests       int `json:"requests"`
+	FailedRequests int `json:"failed_requests"`
+	InputTokens    int `json:"input_tokens"`
+	OutputTokens   int `json:"output_tokens"`
+	// PointsCost only counts successful requests, as failed ones aren't
+	// charged
+	PointsCost int `json:"points_cost"`
+	// CacheCreationTokens and CacheReadTokens total the prompt cache
+	// tokens of successful requests
+	CacheCreationTokens int `json:"cache_creation_tokens,omitempty"`
+	CacheReadTokens     int `json:"cache_read_tokens,omitempty"`
+}
+
+// add folds a usage log into the rollup
+func (r *UsageRollup) add(log UsageLog) {
+	r.Requests++
+	if !log.Success {
+		r.FailedRequests++
+		return
+	}
+	r.InputTokens += log.InputTokens
+	r.OutputTokens += log.OutputTokens
+	r.PointsCost += log.PointsCost
+	r.CacheCreationTokens += log.CacheCreationTokens
+	r.CacheReadTokens += log.CacheReadTokens
+}
+
+// rollupPath returns the database path of the rollup a log belongs in. Logs
+// without a user are rolled up under "unknown" rather than at the month node.
+func rollupPath(log UsageLog) string {
+	userID := log.UserID
+	if userID == "" {
+		userID = "unknown"
+	}
+	return fmt.Sprintf("usage_rollups/%s/%s", log.Timestamp.UTC().Format("2006-01"), userID)
+}
+
+// CompactionReport describes a usage log compaction
+type CompactionReport struct {
+	DryRun bool `json:"dry_run"`
+	// Cutoff is the age boundary; only logs written before it are compacted
+	Cutoff time.Time `json:"cutoff"`
+	// LogsCompacted counts the raw logs folded into rollups and deleted, or
+	// that would be in a dry run
+	LogsCompacted int `json:"logs_compacted"`
+	// Rollups counts the distinct month and user rollups touched
+	Rollups int `json:"rollups"`
+	// Oldest and Newest are the timestamps of the compacted logs
+	Oldest time.Time `json:"oldest,omitempty"`
+	Newest time.Time `json:"newest,omitempty"`
+}
+
+// CompactOption changes how CompactUsageLogs runs
+type CompactOption func(*compactOptions)
+
+type compactOptions struct {
+	dryRun bool
+}
+
+// CompactDryRun makes CompactUsageLogs report what it would compact without
+// writing or deleting anything
+func CompactDryRun() CompactOption {
+	return func(o *compactOptions) {
+		o.dryRun = true
+	}
+}
+
+// CompactUsageLogs folds usage logs older than olderThan into monthly
+// per-user rollups and deletes them. Each batch is applied as a single
+// multi-path update that adds to the rollups and deletes the raw logs
+// together, so a compaction stopped midway neither loses nor double counts
+// usage. Only one instance compacts at a time; others get
+// ErrCompactionRunning.
+func (c *Client) CompactUsageLogs(ctx context.Context, olderThan time.Duration, opts ...CompactOption) (_ *CompactionReport, err error) {
+	defer c.observe("CompactUsageLogs", c.opStart(), &err)
+	var o compactOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if olderThan <= 0 {
+		return nil, fmt.Errorf("invalid retention: %s", olderThan)
+	}
+
+	now := time.Now()
+	report := &CompactionReport{DryRun: o.dryRun, Cutoff: now.Add(-olderThan)}
+
+	if !o.dryRun {
+		lease, err := c.acquireCompactionLease(ctx, now)
+		if err != nil {
+			return nil, err
+		}
+		defer c.releaseCompactionLease(context.WithoutCancel(ctx), lease)
+	}
+
+	touched := make(map[string]struct{})
+	endKey := pushIDTimePrefix(report.Cutoff)
+	lastKey := ""
+	for {
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+
+		query := c.db.NewRef("usage_logs").OrderByKey().EndAt(endKey)
+		limit := compactionBatchSize
+		if lastKey != "" && o.dryRun {
+			// Dry runs delete nothing, so page past the previous batch,
+			// which is returned again
+			query = query.StartAt(lastKey)
+			limit++
+		}
+		nodes, err := query.LimitToFirst(limit).GetOrdered(ctx)
+		if err != nil {
+			return report, fmt.Errorf("error reading usage logs: %w", err)
+		}
+
+		batch := make(map[string]UsageLog, len(nodes))
+		for _, node := range nodes {
+			if node.Key() == lastKey {
+				continue
+			}
+			var log UsageLog
+			if err := node.Unmarshal(&log); err != nil {
+				return report, fmt.Errorf("error decoding usage log %s: %w", node.Key(), err)
+			}
+			batch[node.Key()] = log
+		}
+		if len(batch) == 0 {
+			break
+		}
+
+		if !o.dryRun {
+			if err := c.compactBatch(ctx, batch); err != nil {
+				return report, err
+			}
+		}
+		report.addBatch(batch, touched)
+		lastKey = nodes[len(nodes)-1].Key()
+
+		if len(batch) < compactionBatchSize {
+			break
+		}
+	}
+
+	return report, nil
+}
+
+// addBatch counts a compacted batch in the report
+func (r *CompactionReport) addBatch(batch map[string]UsageLog, touched map[string]struct{}) {
+	for _, log := range batch {
+		r.LogsCompacted++
+		touched[rollupPath(log)] = struct{}{}
+		if r.Oldest.IsZero() || log.Timestamp.Before(r.Oldest) {
+			r.Oldest = log.Timestamp
+		}
+		if log.Timestamp.After(r.Newest) {
+			r.Newest = log.Timestamp
+		}
+	}
+	r.Rollups = len(touched)
+}
+
+// compactBatch adds a batch of logs to their rollups and deletes them in one
+// atomic multi-path update. The rollups are read first; the compaction lease
+// keeps other compactions from writing them in between.
+func (c *Client) compactBatch(ctx context.Context, batch map[string]UsageLog) error {
+	rollups := make(map[string]*UsageRollup)
+	for _, log := range batch {
+		path := rollupPath(log)
+		if _, ok := rollups[path]; ok {
+			continue
+		}
+		var current UsageRollup
+		if err := c.db.NewRef(path).Get(ctx, &current); err != nil {
+			return fmt.Errorf("error reading rollup %s: %w", path, err)
+		}
+		rollups[path] = &current
+	}
+
+	updates := make(map[string]interface{}, len(batch)+len(rollups))
+	for key, log := range batch {
+		rollups[rollupPath(log)].add(log)
+		updates["usage_logs/"+key] = nil
+	}
+	for path, rollup := range rollups {
+		updates[path] = rollup
+	}
+
+	if err := c.db.NewRef("/").Update(ctx, updates); err != nil {
+		return fmt.Errorf("error compacting usage logs: %w", err)
+	}
+	return nil
+}
+
+// compactionLease is the lock node held while compacting
+type compactionLease struct {
+	ID        string    `json:"id"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// acquireCompactionLease takes the compaction lock unless another instance
+// holds an unexpired lease, returning the lease ID
+func (c *Client) acquireCompactionLease(ctx context.Context, now time.Time) (string, error) {
+	lease := compactionLease{ID: newPushID(now), ExpiresAt: now.Add(compactionLeaseTTL)}
+	err := c.db.NewRef("usage_compaction_lease").Transaction(ctx, func(tn db.TransactionNode) (interface{}, error) {
+		var current *compactionLease
+		if err := tn.Unmarshal(&current); err == nil && current != nil && now.Before(current.ExpiresAt) {
+			return nil, ErrCompactionRunning
+		}
+		return lease, nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return lease.ID, nil
+}
+
+// releaseCompactionLease drops the compaction lock if it is still ours
+func (c *Client) releaseCompactionLease(ctx context.Context, id string) {
+	err := c.db.NewRef("usage_compaction_lease").Transaction(ctx, func(tn db.TransactionNode) (interface{}, error) {
+		var current *compactionLease
+		if err := tn.Unmarshal(&current); err != nil || current == nil || current.ID != id {
+			return current, nil
+		}
+		return nil, nil
+	})
+	if err != nil {
+		// The lease expires on its own
+		slog.Warn("failed to release compaction lease", "error", err)
+	}
+}
@@ -0,0 +1,67 @@
+package firebase
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUsageRollupAdd(t *testing.T) {
+	var rollup UsageRollup
+	rollup.add(UsageLog{Success: true, InputTokens: 100, OutputTokens: 20, PointsCost: 3})
+	rollup.add(UsageLog{Success: true, InputTokens: 50, OutputTokens: 10, PointsCost: 2, CacheCreationTokens: 2048, CacheReadTokens: 512})
+	// Failed requests are counted but not charged
+	rollup.add(UsageLog{Success: false, InputTokens: 10, PointsCost: 1, CacheReadTokens: 4096})
+
+	assert.Equal(t, UsageRollup{
+		Requests:            3,
+		FailedRequests:      1,
+		InputTokens:         150,
+		OutputTokens:        30,
+		PointsCost:          5,
+		CacheCreationTokens: 2048,
+		CacheReadTokens:     512,
+	}, rollup)
+}
+
+func TestRollupPath(t *testing.T) {
+	ts := time.Date(2026, 3, 31, 23, 30, 0, 0, time.FixedZone("", -2*60*60))
+	// Months are taken in UTC
+	assert.Equal(t, "usage_rollups/2026-04/user-1", rollupPath(UsageLog{UserID: "user-1", Timestamp: ts}))
+	assert.Equal(t, "usage_rollups/2026-04/unknown", rollupPath(UsageLog{Timestamp: ts}))
+}
+
+func TestCompactionReportAddBatch(t *testing.T) {
+	jan := time.Date(2026, 1, 10, 0, 0, 0, 0, time.UTC)
+	feb := time.Date(2026, 2, 10, 0, 0, 0, 0, time.UTC)
+
+	report := &CompactionReport{}
+	touched := make(map[string]struct{})
+	report.addBatch(map[string]UsageLog{
+		"a": {UserID: "u1", Timestamp: jan},
+		"b": {UserID: "u1", Timestamp: jan.Add(time.Hour)},
+		"c": {UserID: "u2", Timestamp: feb},
+	}, touched)
+	report.addBatch(map[string]UsageLog{"d": {UserID: "u1", Timestamp: feb}}, touched)
+
+	assert.Equal(t, 4, report.LogsCompacted)
+	assert.Equal(t, 3, report.Rollups)
+	assert.Equal(t, jan, report.Oldest)
+	assert.Equal(t, feb, report.Newest)
+}
+
+func TestUsageLogWithoutCacheTokens(t *testing.T) {
+	// Logs written before cache tokens were recorded decode as zero, and
+	// zero counts aren't written
+	var log UsageLog
+	require.NoError(t, json.Unmarshal([]byte(`{"user_id":"u1","input_tokens":5,"output_tokens":6}`), &log))
+	assert.Zero(t, log.CacheCreationTokens)
+	assert.Zero(t, log.CacheReadTokens)
+
+	data, err := json.Marshal(log)
+	require.NoError(t, err)
+	assert.NotContains(t, string(data), "cache_")
+}
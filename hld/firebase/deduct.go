@@ -0,0 +1,85 @@
+package firebase
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// DeductPreview is the outcome DeductPoints would have for a user
+type DeductPreview struct {
+	// Cost is the number of points that would be deducted
+	Cost int `json:"cost"`
+	// Balance and SpendableBalance are the user's points before the deduction
+	Balance          int `json:"balance"`
+	SpendableBalance int `json:"spendable_balance"`
+	// NewBalance is the balance left afterwards; it equals Balance when the
+	// user can't afford the deduction
+	NewBalance int `json:"new_balance"`
+}
+
+// deduct applies a deduction of amount at now, failing with
+// ErrInsufficientPoints if the user can't afford it. It is the transaction
+// body shared by DeductPoints and DryRunDeductPoints.
+func (u *UserData) deduct(amount int, o deductOptions, now time.Time) error {
+	// Points from expired grants can't be spent
+	u.expireGrants(now)
+
+	// Check if user has enough points, leaving the reserve untouched
+	// unless forced
+	available := u.spendablePoints()
+	if o.force {
+		available = u.Points
+	}
+	if available < amount {
+		return fmt.Errorf("%w: has %d spendable, needs %d", ErrInsufficientPoints, available, amount)
+	}
+
+	// Deduct points, using up the soonest-to-expire grants first
+	u.consumePoints(amount)
+	u.TotalUsed += amount
+	u.recordCharge(amount)
+	u.LastRequest = now
+	return nil
+}
+
+// DryRunDeductPoints runs DeductPoints' logic against the user's current
+// record without writing anything, returning the would-be balance. When the
+// user can't afford amount the preview is returned along with an error
+// wrapping ErrInsufficientPoints. Concurrent requests may still change the
+// balance before a real deduction.
+func (c *Client) DryRunDeductPoints(ctx context.Context, userID string, amount int, opts ...DeductOption) (_ *DeductPreview, err error) {
+	defer c.observe("DryRunDeductPoints", c.opStart(), &err)
+	var o deductOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	user, err := c.GetUserData(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	return user.previewDeduct(amount, o, time.Now())
+}
+
+// previewDeduct applies deduct to u and reports the outcome. u is modified,
+// so callers must pass a record they won't write back.
+func (u *UserData) previewDeduct(amount int, o deductOptions, now time.Time) (*DeductPreview, error) {
+	// Expire first so the starting balance matches what deduct sees
+	u.expireGrants(now)
+
+	preview := &DeductPreview{
+		Cost:             amount,
+		Balance:          u.Points,
+		SpendableBalance: u.spendablePoints(),
+		NewBalance:       u.Points,
+	}
+	if o.force {
+		preview.SpendableBalance = u.Points
+	}
+	if err := u.deduct(amount, o, now); err != nil {
+		return preview, err
+	}
+	preview.NewBalance = u.Points
+	return preview, nil
+}
@@ -0,0 +1,56 @@
+package firebase
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPreviewDeduct(t *testing.T) {
+	now := time.Now()
+
+	t.Run("affordable", func(t *testing.T) {
+		user := userWithGrants(now)
+		preview, err := user.previewDeduct(40, deductOptions{}, now)
+		require.NoError(t, err)
+		assert.Equal(t, &DeductPreview{Cost: 40, Balance: 100, SpendableBalance: 100, NewBalance: 60}, preview)
+	})
+
+	t.Run("expired grants don't count", func(t *testing.T) {
+		user := userWithGrants(now)
+		preview, err := user.previewDeduct(40, deductOptions{}, now.Add(36*time.Hour))
+		require.NoError(t, err)
+		assert.Equal(t, 70, preview.Balance)
+		assert.Equal(t, 30, preview.NewBalance)
+	})
+
+	t.Run("reserve needs force", func(t *testing.T) {
+		user := &UserData{Points: 100, ReservedPoints: 80}
+		preview, err := user.previewDeduct(50, deductOptions{}, now)
+		assert.ErrorIs(t, err, ErrInsufficientPoints)
+		assert.Equal(t, &DeductPreview{Cost: 50, Balance: 100, SpendableBalance: 20, NewBalance: 100}, preview)
+
+		user = &UserData{Points: 100, ReservedPoints: 80}
+		preview, err = user.previewDeduct(50, deductOptions{force: true}, now)
+		require.NoError(t, err)
+		assert.Equal(t, 100, preview.SpendableBalance)
+		assert.Equal(t, 50, preview.NewBalance)
+	})
+}
+
+func TestDeductRecordsAverageCharge(t *testing.T) {
+	now := time.Now()
+	user := &UserData{Points: 1000}
+
+	require.NoError(t, user.deduct(20, deductOptions{}, now))
+	assert.Equal(t, 20.0, user.AvgPointsPerRequest)
+
+	require.NoError(t, user.deduct(120, deductOptions{}, now))
+	assert.InDelta(t, 30.0, user.AvgPointsPerRequest, 1e-9)
+
+	// Failed deductions leave the average alone
+	require.ErrorIs(t, user.deduct(5000, deductOptions{}, now), ErrInsufficientPoints)
+	assert.InDelta(t, 30.0, user.AvgPointsPerRequest, 1e-9)
+}
@@ -0,0 +1,74 @@
+package firebase
+
+import "errors"
+
+// Sentinel errors for common Firebase operations
+var (
+	// ErrAPIKeyNotFound is returned when an API key does not match any stored key
+	ErrAPIKeyNotFound = errors.New("api key not found")
+
+	// ErrAPIKeyRevoked is returned when an API key has been revoked
+	ErrAPIKeyRevoked = errors.New("api key revoked")
+
+	// ErrAPIKeyExpired is returned when an API key is past its expiry
+	ErrAPIKeyExpired = errors.New("api key expired")
+
+	// ErrSessionNotFound is returned when a session does not exist
+	ErrSessionNotFound = errors.New("session not found")
+
+	// ErrSessionOwnerChanged is returned when a session's owner changed
+	// concurrently with a transfer
+	ErrSessionOwnerChanged = errors.New("session owner changed")
+
+	// ErrSessionStatusChanged is returned when a session's status changed
+	// concurrently with a status transition
+	ErrSessionStatusChanged = errors.New("session status changed")
+
+	// ErrUnknownTenant is returned when a tenant has no Firebase project
+	// configured
+	ErrUnknownTenant = errors.New("unknown tenant")
+
+	// ErrUsageRecorded wraps failures after usage logs were stored, such as
+	// updating request counters, so a retry would duplicate the logs
+	ErrUsageRecorded = errors.New("usage already recorded")
+
+	// ErrUserNotFound is returned when a user record does not exist
+	ErrUserNotFound = errors.New("user not found")
+
+	// ErrInsufficientPoints is returned when a balance can't cover a hold
+	ErrInsufficientPoints = errors.New("insufficient points")
+
+	// ErrHoldNotFound is returned when a points hold was already settled or
+	// has expired
+	ErrHoldNotFound = errors.New("points hold not found")
+
+	// ErrOverdraftLimit is returned when an adjustment would take a balance
+	// below the overdraft limit
+	ErrOverdraftLimit = errors.New("overdraft limit exceeded")
+
+	// ErrTrialExhausted is returned when an anonymous trial has used all its
+	// requests or has been converted to an account
+	ErrTrialExhausted = errors.New("anonymous trial exhausted")
+
+	// ErrVelocityExceeded is returned when a user has spent more points
+	// than VELOCITY_CAP_POINTS allows within VelocityWindow
+	ErrVelocityExceeded = errors.New("spending velocity exceeded")
+
+	// ErrImpersonationNotFound is returned when an impersonation token does
+	// not match any stored token
+	ErrImpersonationNotFound = errors.New("impersonation token not found")
+
+	// ErrImpersonationExpired is returned when an impersonation token is
+	// past its expiry
+	ErrImpersonationExpired = errors.New("impersonation token expired")
+
+	// ErrNonceNotFound is returned when a nonce doesn't match one issued to
+	// the caller
+	ErrNonceNotFound = errors.New("nonce not found")
+
+	// ErrNonceExpired is returned when a nonce is past its expiry
+	ErrNonceExpired = errors.New("nonce expired")
+
+	// ErrNonceUsed is returned when a nonce was already consumed
+	ErrNonceUsed = errors.New("nonce already used")
+)
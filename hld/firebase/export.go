@@ -0,0 +1,232 @@
+package firebase
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+)
+
+// Supported export formats
+const (
+	ExportFormatCSV   = "csv"
+	ExportFormatJSONL = "jsonl"
+)
+
+// exportPageSize is the number of usage logs fetched per query while
+// exporting, which bounds memory use regardless of export size
+const exportPageSize = 1000
+
+// usageCSVHeader lists the CSV columns written by ExportUsage
+var usageCSVHeader = []string{
+	"id", "timestamp", "user_id", "session_id", "model",
+	"input_tokens", "output_tokens", "points_cost", "duration_ms",
+	"success", "error_message", "ip_address", "metadata", "estimated",
+	"cache_creation_tokens", "cache_read_tokens",
+}
+
+// UsageFilter selects usage logs for export
+type UsageFilter struct {
+	UserID    string
+	SessionID string
+	Model     string
+	// From and To bound the log timestamp; zero values are unbounded
+	From        time.Time
+	To          time.Time
+	SuccessOnly bool
+	// IncludeAnonymous keeps anonymous trial usage, which is left out by
+	// default as it earns no revenue
+	IncludeAnonymous bool
+	// IncludeService keeps service account usage, which is left out by
+	// default as it isn't billed
+	IncludeService bool
+}
+
+// matches reports whether a usage log passes the filter
+func (f UsageFilter) matches(log UsageLog) bool {
+	if f.UserID != "" && log.UserID != f.UserID {
+		return false
+	}
+	if f.SessionID != "" && log.SessionID != f.SessionID {
+		return false
+	}
+	if f.Model != "" && log.Model != f.Model {
+		return false
+	}
+	if f.SuccessOnly && !log.Success {
+		return false
+	}
+	if log.Anonymous && !f.IncludeAnonymous {
+		return false
+	}
+	if log.Service && !f.IncludeService {
+		return false
+	}
+	if !f.From.IsZero() && log.Timestamp.Before(f.From) {
+		return false
+	}
+	if !f.To.IsZero() && log.Timestamp.After(f.To) {
+		return false
+	}
+	return true
+}
+
+// ExportUsage streams usage logs matching filter to w as CSV or JSON Lines.
+// Logs are paged by key, which is chronological, so memory stays bounded by
+// the page size no matter how many logs match.
+func (c *Client) ExportUsage(ctx context.Context, filter UsageFilter, w io.Writer, format string) (err error) {
+	defer c.observe("ExportUsage", c.opStart(), &err)
+	enc, err := newUsageEncoder(w, format)
+	if err != nil {
+		return err
+	}
+	return c.eachUsageLog(ctx, filter, enc.write, enc.flush)
+}
+
+// usageEncoder writes usage logs in an export format
+type usageEncoder struct {
+	// write encodes a log; flush pushes written logs on to the writer
+	write func(id string, log UsageLog) error
+	flush func() error
+}
+
+// newUsageEncoder returns an encoder writing format to w
+func newUsageEncoder(w io.Writer, format string) (*usageEncoder, error) {
+	switch format {
+	case ExportFormatCSV:
+		cw := csv.NewWriter(w)
+		if err := cw.Write(usageCSVHeader); err != nil {
+			return nil, fmt.Errorf("error writing CSV header: %w", err)
+		}
+		return &usageEncoder{
+			write: func(id string, log UsageLog) error {
+				if err := cw.Write(usageCSVRecord(id, log)); err != nil {
+					return fmt.Errorf("error writing usage log: %w", err)
+				}
+				return nil
+			},
+			flush: func() error {
+				cw.Flush()
+				if err := cw.Error(); err != nil {
+					return fmt.Errorf("error flushing export: %w", err)
+				}
+				return nil
+			},
+		}, nil
+	case ExportFormatJSONL:
+		enc := json.NewEncoder(w)
+		return &usageEncoder{
+			write: func(id string, log UsageLog) error {
+				if err := enc.Encode(UsageRecord{ID: id, UsageLog: log}); err != nil {
+					return fmt.Errorf("error writing usage log: %w", err)
+				}
+				return nil
+			},
+			flush: func() error { return nil },
+		}, nil
+	default:
+		return nil, fmt.Errorf("unsupported export format: %s", format)
+	}
+}
+
+// eachUsageLog calls fn with every usage log matching filter, oldest first,
+// and pageDone after each page of logs. Logs are paged by key, which is
+// chronological, so memory stays bounded by the page size.
+func (c *Client) eachUsageLog(ctx context.Context, filter UsageFilter, fn func(id string, log UsageLog) error, pageDone func() error) error {
+	// Push ID keys start with an encoded timestamp, so the date range maps
+	// onto a key range
+	startKey := ""
+	if !filter.From.IsZero() {
+		startKey = pushIDTimePrefix(filter.From)
+	}
+	endKey := ""
+	if !filter.To.IsZero() {
+		endKey = pushIDTimePrefix(filter.To) + "zzzzzzzzzzzz"
+	}
+
+	ref := c.db.NewRef("usage_logs")
+	lastKey := ""
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		query := ref.OrderByKey()
+		limit := exportPageSize
+		if lastKey != "" {
+			// The previous page's last key is returned again, so fetch one extra
+			query = query.StartAt(lastKey)
+			limit++
+		} else if startKey != "" {
+			query = query.StartAt(startKey)
+		}
+		if endKey != "" {
+			query = query.EndAt(endKey)
+		}
+
+		nodes, err := query.LimitToFirst(limit).GetOrdered(ctx)
+		if err != nil {
+			return fmt.Errorf("error reading usage logs: %w", err)
+		}
+
+		fetched := 0
+		for _, node := range nodes {
+			if node.Key() == lastKey {
+				continue
+			}
+			fetched++
+
+			var log UsageLog
+			if err := node.Unmarshal(&log); err != nil {
+				return fmt.Errorf("error decoding usage log %s: %w", node.Key(), err)
+			}
+			if !filter.matches(log) {
+				continue
+			}
+			if err := fn(node.Key(), log); err != nil {
+				return err
+			}
+		}
+
+		if err := pageDone(); err != nil {
+			return err
+		}
+
+		if fetched < exportPageSize || len(nodes) == 0 {
+			return nil
+		}
+		lastKey = nodes[len(nodes)-1].Key()
+	}
+}
+
+// usageCSVRecord flattens a usage log into a CSV row matching usageCSVHeader
+func usageCSVRecord(id string, log UsageLog) []string {
+	metadata := ""
+	if len(log.Metadata) > 0 {
+		if data, err := json.Marshal(log.Metadata); err == nil {
+			metadata = string(data)
+		}
+	}
+
+	return []string{
+		id,
+		log.Timestamp.UTC().Format(time.RFC3339),
+		log.UserID,
+		log.SessionID,
+		log.Model,
+		strconv.Itoa(log.InputTokens),
+		strconv.Itoa(log.OutputTokens),
+		strconv.Itoa(log.PointsCost),
+		strconv.FormatInt(log.DurationMS, 10),
+		strconv.FormatBool(log.Success),
+		log.ErrorMessage,
+		log.IPAddress,
+		metadata,
+		strconv.FormatBool(log.Estimated || log.TokensEstimated),
+		strconv.Itoa(log.CacheCreationTokens),
+		strconv.Itoa(log.CacheReadTokens),
+	}
+}
@@ -0,0 +1,159 @@
+package firebase
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"sort"
+	"time"
+)
+
+const (
+	// defaultSuspiciousTokenThreshold is the per-request token count above
+	// which usage is flagged for review
+	defaultSuspiciousTokenThreshold = 100000
+	// flaggedUsageAlertTimeout bounds each alert webhook delivery
+	flaggedUsageAlertTimeout = 5 * time.Second
+)
+
+// FlaggedUsage records a request whose token count looked anomalous. It is
+// stored in the flagged_usage node under the same key as its usage log.
+type FlaggedUsage struct {
+	// ID is the usage log key, populated only when listing
+	ID           string    `json:"id,omitempty"`
+	UserID       string    `json:"user_id"`
+	SessionID    string    `json:"session_id"`
+	Model        string    `json:"model"`
+	InputTokens  int       `json:"input_tokens"`
+	OutputTokens int       `json:"output_tokens"`
+	TotalTokens  int       `json:"total_tokens"`
+	Threshold    int       `json:"threshold"`
+	PointsCost   int       `json:"points_cost"`
+	RequestID    string    `json:"request_id,omitempty"`
+	Timestamp    time.Time `json:"timestamp"`
+}
+
+// usageFlagger decides which usage logs are suspicious and sends alerts
+// for them
+type usageFlagger struct {
+	threshold  int
+	alertURL   string
+	httpClient *http.Client
+}
+
+// newUsageFlaggerFromEnv reads SUSPICIOUS_TOKEN_THRESHOLD and the optional
+// SUSPICIOUS_USAGE_WEBHOOK_URL, which receives each flagged entry as JSON
+func newUsageFlaggerFromEnv() *usageFlagger {
+	return &usageFlagger{
+		threshold:  envInt("SUSPICIOUS_TOKEN_THRESHOLD", defaultSuspiciousTokenThreshold),
+		alertURL:   os.Getenv("SUSPICIOUS_USAGE_WEBHOOK_URL"),
+		httpClient: &http.Client{Timeout: flaggedUsageAlertTimeout},
+	}
+}
+
+// flag returns the flagged entry for log if its token count exceeds the
+// threshold
+func (f *usageFlagger) flag(log UsageLog) (FlaggedUsage, bool) {
+	total := log.InputTokens + log.OutputTokens
+	if f == nil || total <= f.threshold {
+		return FlaggedUsage{}, false
+	}
+	return FlaggedUsage{
+		UserID:       log.UserID,
+		SessionID:    log.SessionID,
+		Model:        log.Model,
+		InputTokens:  log.InputTokens,
+		OutputTokens: log.OutputTokens,
+		TotalTokens:  total,
+		Threshold:    f.threshold,
+		PointsCost:   log.PointsCost,
+		RequestID:    log.RequestID,
+		Timestamp:    log.Timestamp,
+	}, true
+}
+
+// alert posts entry to the alert webhook in the background, if one is
+// configured. Failures are logged; the flag itself is already stored.
+func (f *usageFlagger) alert(entry FlaggedUsage) {
+	if f == nil || f.alertURL == "" {
+		return
+	}
+	go func() {
+		body, err := json.Marshal(entry)
+		if err != nil {
+			return
+		}
+		resp, err := f.httpClient.Post(f.alertURL, "application/json", bytes.NewReader(body))
+		if err != nil {
+			slog.Error("failed to send flagged usage alert", "user_id", entry.UserID, "error", err)
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			slog.Error("flagged usage alert rejected", "user_id", entry.UserID, "status", resp.StatusCode)
+		}
+	}()
+}
+
+// flagUsage stores flagged entries for logs keyed by their usage log keys
+// and sends their alerts
+func (c *Client) flagUsage(ctx context.Context, logs map[string]UsageLog) error {
+	updates := make(map[string]interface{})
+	var flagged []FlaggedUsage
+	for key, log := range logs {
+		if entry, ok := c.flagger.flag(log); ok {
+			updates[key] = entry
+			flagged = append(flagged, entry)
+		}
+	}
+	if len(updates) == 0 {
+		return nil
+	}
+
+	if err := c.db.NewRef("flagged_usage").Update(ctx, updates); err != nil {
+		return fmt.Errorf("error flagging usage: %w", err)
+	}
+	for _, entry := range flagged {
+		slog.Warn("suspicious usage flagged",
+			"user_id", entry.UserID,
+			"session_id", entry.SessionID,
+			"total_tokens", entry.TotalTokens,
+			"threshold", entry.Threshold)
+		c.flagger.alert(entry)
+	}
+	return nil
+}
+
+// ListFlaggedUsage returns up to limit flagged entries, newest first,
+// optionally only those of userID. Filtering by user requires an
+// ".indexOn": ["user_id"] rule on the flagged_usage node.
+func (c *Client) ListFlaggedUsage(ctx context.Context, userID string, limit int) (_ []FlaggedUsage, err error) {
+	defer c.observe("ListFlaggedUsage", c.opStart(), &err)
+	ref := c.db.NewRef("flagged_usage")
+	var query interface {
+		Get(context.Context, interface{}) error
+	}
+	if userID != "" {
+		query = ref.OrderByChild("user_id").EqualTo(userID).LimitToLast(limit)
+	} else {
+		query = ref.OrderByKey().LimitToLast(limit)
+	}
+
+	var entries map[string]FlaggedUsage
+	if err := query.Get(ctx, &entries); err != nil {
+		return nil, fmt.Errorf("error listing flagged usage: %w", err)
+	}
+
+	result := make([]FlaggedUsage, 0, len(entries))
+	for id, entry := range entries {
+		entry.ID = id
+		result = append(result, entry)
+	}
+	// Keys are push IDs, so they sort chronologically
+	sort.Slice(result, func(i, j int) bool { return result[i].ID > result[j].ID })
+	return result, nil
+}
@@ -0,0 +1,53 @@
+package firebase
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUsageFlaggerFlag(t *testing.T) {
+	f := &usageFlagger{threshold: 1000}
+	log := UsageLog{UserID: "u1", Model: "m", InputTokens: 600, OutputTokens: 400, RequestID: "req-1"}
+
+	_, ok := f.flag(log)
+	assert.False(t, ok, "total at the threshold is not flagged")
+
+	log.OutputTokens = 401
+	entry, ok := f.flag(log)
+	require.True(t, ok)
+	assert.Equal(t, 1001, entry.TotalTokens)
+	assert.Equal(t, 1000, entry.Threshold)
+	assert.Equal(t, "u1", entry.UserID)
+	assert.Equal(t, "req-1", entry.RequestID)
+
+	var nilFlagger *usageFlagger
+	_, ok = nilFlagger.flag(log)
+	assert.False(t, ok)
+}
+
+func TestUsageFlaggerAlert(t *testing.T) {
+	received := make(chan FlaggedUsage, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var entry FlaggedUsage
+		_ = json.NewDecoder(r.Body).Decode(&entry)
+		received <- entry
+	}))
+	defer srv.Close()
+
+	f := &usageFlagger{threshold: 10, alertURL: srv.URL, httpClient: srv.Client()}
+	f.alert(FlaggedUsage{UserID: "u1", TotalTokens: 50})
+
+	select {
+	case entry := <-received:
+		assert.Equal(t, "u1", entry.UserID)
+		assert.Equal(t, 50, entry.TotalTokens)
+	case <-time.After(2 * time.Second):
+		t.Fatal("alert webhook was not called")
+	}
+}
@@ -0,0 +1,226 @@
+package firebase
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sort"
+	"time"
+)
+
+// PointGrant is a block of points that expires, such as a promotion. Grants
+// live in users/{id}/point_grants so that consuming and expiring them happens
+// in the same transaction as the balance change. Points not covered by a
+// grant (purchases, the signup balance) never expire.
+//
+// The balance always covers the unexpired remainder of every grant:
+// deductions consume grants soonest-to-expire first and only then the
+// non-expiring balance.
+//
+// Every credit, expiring or not, is also recorded as a PointGrant in the
+// grant ledger; see GetPointGrants. Ledger entries have no expiry unless they
+// record an expiring grant, and don't track Remaining.
+type PointGrant struct {
+	// ID is the grant's key, populated when returned by GetPointGrants
+	ID        string    `json:"id,omitempty"`
+	Amount    int       `json:"amount"`
+	Remaining int       `json:"remaining"`
+	Source    string    `json:"source,omitempty"`
+	GrantedAt time.Time `json:"granted_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+	// RequestID is the request that made the credit, set on ledger entries
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// GrantPoints adds amount points to the user's balance that expire after
+// ttl, unless spent first. It returns the grant ID.
+func (c *Client) GrantPoints(ctx context.Context, userID string, amount int, ttl time.Duration, source string) (_ string, err error) {
+	defer c.observe("GrantPoints", c.opStart(), &err)
+	if amount <= 0 || ttl <= 0 {
+		return "", fmt.Errorf("invalid grant: amount=%d ttl=%s", amount, ttl)
+	}
+
+	now := time.Now()
+	grantID := newPushID(now)
+	grant := PointGrant{
+		Amount:    amount,
+		Remaining: amount,
+		Source:    source,
+		GrantedAt: now,
+		ExpiresAt: now.Add(ttl),
+	}
+	balance, err := c.updateUser(ctx, userID, func(user *UserData) error {
+		user.expireGrants(now)
+		if user.PointGrants == nil {
+			user.PointGrants = make(map[string]PointGrant)
+		}
+		user.PointGrants[grantID] = grant
+		user.Points += amount
+		user.updateNextGrantExpiry()
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	c.cache.setPoints(userID, balance)
+	if grant.Source == "" {
+		grant.Source = GrantSourceGrant
+	}
+	c.recordGrant(ctx, userID, grantID, grant)
+	return grantID, nil
+}
+
+// ExpirePoints removes the unspent remainder of every expired grant from the
+// owning user's balance and returns the total number of points expired. Run
+// it periodically; expired grants are also settled whenever a user's balance
+// changes.
+// Requires an ".indexOn": ["next_grant_expiry_ms"] rule on the users node.
+func (c *Client) ExpirePoints(ctx context.Context) (_ int, err error) {
+	defer c.observe("ExpirePoints", c.opStart(), &err)
+	now := time.Now()
+
+	var due map[string]struct{}
+	err = c.db.NewRef("users").
+		OrderByChild("next_grant_expiry_ms").
+		StartAt(1).
+		EndAt(now.UnixMilli()).
+		Get(ctx, &due)
+	if err != nil {
+		return 0, fmt.Errorf("error querying expiring grants: %w", err)
+	}
+
+	total := 0
+	var firstErr error
+	for userID := range due {
+		if err := ctx.Err(); err != nil {
+			return total, err
+		}
+
+		expired := 0
+		balance, err := c.updateUser(ctx, userID, func(user *UserData) error {
+			expired = user.expireGrants(now)
+			return nil
+		})
+		if err != nil {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("error expiring points for %s: %w", userID, err)
+			}
+			continue
+		}
+
+		c.cache.setPoints(userID, balance)
+		if expired > 0 {
+			slog.Info("expired points", "user_id", userID, "points", expired, "balance", balance)
+		}
+		total += expired
+	}
+
+	return total, firstErr
+}
+
+// sortedGrantIDs returns grant IDs ordered soonest-to-expire first. Ties are
+// broken by ID, which is chronological.
+func (u *UserData) sortedGrantIDs() []string {
+	ids := make([]string, 0, len(u.PointGrants))
+	for id := range u.PointGrants {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		a, b := u.PointGrants[ids[i]], u.PointGrants[ids[j]]
+		if !a.ExpiresAt.Equal(b.ExpiresAt) {
+			return a.ExpiresAt.Before(b.ExpiresAt)
+		}
+		return ids[i] < ids[j]
+	})
+	return ids
+}
+
+// consumePoints removes amount from the balance, drawing on grants
+// soonest-to-expire first and then on the non-expiring balance. It returns
+// how much was taken from each grant. Callers must check the balance covers
+// amount.
+func (u *UserData) consumePoints(amount int) map[string]int {
+	u.Points -= amount
+
+	var taken map[string]int
+	for _, id := range u.sortedGrantIDs() {
+		if amount == 0 {
+			break
+		}
+		grant := u.PointGrants[id]
+		if grant.Remaining == 0 {
+			continue
+		}
+
+		take := min(amount, grant.Remaining)
+		grant.Remaining -= take
+		u.PointGrants[id] = grant
+		amount -= take
+
+		if taken == nil {
+			taken = make(map[string]int)
+		}
+		taken[id] = take
+	}
+
+	return taken
+}
+
+// restorePoints returns amount points of an earlier consumption of total
+// points, of which taken came from grants. Restoration reverses consumption:
+// the non-expiring part first, then grants latest-to-expire first. Points
+// belonging to grants that have since been removed are not restored, as they
+// have expired.
+func (u *UserData) restorePoints(amount, total int, taken map[string]int) {
+	fromGrants := 0
+	for _, n := range taken {
+		fromGrants += n
+	}
+
+	untracked := min(amount, total-fromGrants)
+	u.Points += untracked
+	amount -= untracked
+
+	ids := u.sortedGrantIDs()
+	for i := len(ids) - 1; i >= 0 && amount > 0; i-- {
+		id := ids[i]
+		give := min(amount, taken[id])
+		if give == 0 {
+			continue
+		}
+		grant := u.PointGrants[id]
+		grant.Remaining += give
+		u.PointGrants[id] = grant
+		u.Points += give
+		amount -= give
+	}
+}
+
+// expireGrants removes grants that expired before now, deducting their
+// unspent remainder from the balance, and returns the points expired
+func (u *UserData) expireGrants(now time.Time) int {
+	expired := 0
+	for id, grant := range u.PointGrants {
+		if now.Before(grant.ExpiresAt) {
+			continue
+		}
+		take := min(grant.Remaining, u.Points)
+		u.Points -= take
+		expired += take
+		delete(u.PointGrants, id)
+	}
+	u.updateNextGrantExpiry()
+	return expired
+}
+
+// updateNextGrantExpiry records the earliest grant expiry so ExpirePoints can
+// find due users with an indexed query
+func (u *UserData) updateNextGrantExpiry() {
+	u.NextGrantExpiryMS = 0
+	for _, grant := range u.PointGrants {
+		if ms := grant.ExpiresAt.UnixMilli(); u.NextGrantExpiryMS == 0 || ms < u.NextGrantExpiryMS {
+			u.NextGrantExpiryMS = ms
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package firebase
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/humanlayer/humanlayer/hld/internal/requestid"
+)
+
+// userWithGrants returns a user holding 20 non-expiring points plus two
+// grants: 30 points expiring in one day and 50 expiring in two
+func userWithGrants(now time.Time) *UserData {
+	user := &UserData{
+		Points: 100,
+		PointGrants: map[string]PointGrant{
+			"late":  {Amount: 50, Remaining: 50, ExpiresAt: now.Add(48 * time.Hour)},
+			"early": {Amount: 30, Remaining: 30, ExpiresAt: now.Add(24 * time.Hour)},
+		},
+	}
+	user.updateNextGrantExpiry()
+	return user
+}
+
+func TestConsumePointsFIFO(t *testing.T) {
+	now := time.Now()
+
+	t.Run("partial consumption of the soonest grant", func(t *testing.T) {
+		user := userWithGrants(now)
+		taken := user.consumePoints(10)
+
+		assert.Equal(t, 90, user.Points)
+		assert.Equal(t, map[string]int{"early": 10}, taken)
+		assert.Equal(t, 20, user.PointGrants["early"].Remaining)
+		assert.Equal(t, 50, user.PointGrants["late"].Remaining)
+	})
+
+	t.Run("spans grants before the non-expiring balance", func(t *testing.T) {
+		user := userWithGrants(now)
+		taken := user.consumePoints(90)
+
+		assert.Equal(t, 10, user.Points)
+		assert.Equal(t, map[string]int{"early": 30, "late": 50}, taken)
+		assert.Equal(t, 0, user.PointGrants["early"].Remaining)
+		assert.Equal(t, 0, user.PointGrants["late"].Remaining)
+	})
+}
+
+func TestExpireGrants(t *testing.T) {
+	now := time.Now()
+
+	t.Run("grant expiring mid-balance removes only its remainder", func(t *testing.T) {
+		user := userWithGrants(now)
+		user.consumePoints(10) // early: 20 left
+
+		expired := user.expireGrants(now.Add(36 * time.Hour))
+		assert.Equal(t, 20, expired)
+		assert.Equal(t, 70, user.Points)
+		assert.NotContains(t, user.PointGrants, "early")
+		assert.Equal(t, now.Add(48*time.Hour).UnixMilli(), user.NextGrantExpiryMS)
+	})
+
+	t.Run("fully spent grant expires without touching the balance", func(t *testing.T) {
+		user := userWithGrants(now)
+		user.consumePoints(30)
+
+		assert.Equal(t, 0, user.expireGrants(now.Add(36*time.Hour)))
+		assert.Equal(t, 70, user.Points)
+	})
+
+	t.Run("all grants expired leaves the non-expiring balance", func(t *testing.T) {
+		user := userWithGrants(now)
+		user.consumePoints(40) // early spent, late: 40 left
+
+		assert.Equal(t, 40, user.expireGrants(now.Add(72*time.Hour)))
+		assert.Equal(t, 20, user.Points)
+		assert.Empty(t, user.PointGrants)
+		assert.Zero(t, user.NextGrantExpiryMS)
+	})
+
+	t.Run("nothing due", func(t *testing.T) {
+		user := userWithGrants(now)
+		assert.Equal(t, 0, user.expireGrants(now))
+		assert.Equal(t, 100, user.Points)
+	})
+}
+
+func TestRestorePoints(t *testing.T) {
+	now := time.Now()
+
+	t.Run("refund reverses consumption order", func(t *testing.T) {
+		user := userWithGrants(now)
+		taken := user.consumePoints(95) // early 30, late 50, untracked 15
+
+		user.restorePoints(25, 95, taken)
+		assert.Equal(t, 30, user.Points)
+		// Non-expiring points come back first, then the latest-expiring grant
+		assert.Equal(t, 10, user.PointGrants["late"].Remaining)
+		assert.Equal(t, 0, user.PointGrants["early"].Remaining)
+	})
+
+	t.Run("points from a removed grant stay expired", func(t *testing.T) {
+		user := userWithGrants(now)
+		taken := user.consumePoints(40) // early 30, late 10
+		user.expireGrants(now.Add(36 * time.Hour))
+
+		user.restorePoints(40, 40, taken)
+		assert.Equal(t, 70, user.Points, "only the late grant's 10 is restored")
+		assert.Equal(t, 50, user.PointGrants["late"].Remaining)
+	})
+}
+
+func TestHoldConsumesGrants(t *testing.T) {
+	now := time.Now()
+	user := userWithGrants(now)
+	user.Holds = map[string]PointsHold{}
+
+	grants := user.consumePoints(40)
+	user.Holds["h1"] = PointsHold{Amount: 40, ExpiresAt: now.Add(time.Hour), Grants: grants}
+
+	// Capturing 35 refunds 5 to the late grant it came from
+	require.NoError(t, user.settleHold("h1", 35, now))
+	assert.Equal(t, 65, user.Points)
+	assert.Equal(t, 0, user.PointGrants["early"].Remaining)
+	assert.Equal(t, 45, user.PointGrants["late"].Remaining)
+	assert.Equal(t, 35, user.TotalUsed)
+}
+
+func TestGrantPointsRecordsRequestID(t *testing.T) {
+	c, db := newTestClient(t)
+	db.Set(t, "users/u1", UserData{Points: 10, CreatedAt: time.Now()})
+	ctx := requestid.NewContext(context.Background(), "req-grant")
+
+	grantID, err := c.GrantPoints(ctx, "u1", 40, time.Hour, "promo")
+	require.NoError(t, err)
+
+	grants, err := c.GetPointGrants(ctx, "u1", time.Time{}, time.Time{})
+	require.NoError(t, err)
+	require.Len(t, grants, 1)
+	assert.Equal(t, grantID, grants[0].ID)
+	assert.Equal(t, "req-grant", grants[0].RequestID)
+
+	// Requests without an ID leave it off
+	grantID, err = c.GrantPoints(context.Background(), "u1", 5, time.Hour, "promo")
+	require.NoError(t, err)
+	var entry PointGrant
+	db.Get(t, grantLedgerPath("u1")+"/"+grantID, &entry)
+	assert.Equal(t, 5, entry.Amount)
+	assert.Empty(t, entry.RequestID)
+}
@@ -0,0 +1,214 @@
+package firebase
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"firebase.google.com/go/v4/db"
+)
+
+// defaultPointsHoldTTL is how long a hold reserves points before it expires.
+// It must comfortably exceed the upstream timeout so that a slow request is
+// captured before its hold lapses.
+const defaultPointsHoldTTL = time.Hour
+
+// pushIDLength is the length of keys generated by newPushID
+const pushIDLength = 20
+
+// PointsHold is points reserved from a user's balance for an in-flight
+// request. Holds live under users/{id}/holds so that reserving, capturing and
+// expiring them are single transactions on the user record.
+type PointsHold struct {
+	Amount    int       `json:"amount"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+	// Grants records how much of Amount came from each point grant, so
+	// refunds return points to the grants they were taken from
+	Grants map[string]int `json:"grants,omitempty"`
+}
+
+// HoldPoints reserves amount points for an in-flight request and returns a
+// hold ID to pass to CapturePoints or ReleaseHold. The points are removed
+// from the balance immediately, so concurrent requests can't spend them.
+// Holds expire after POINTS_HOLD_TTL (default one hour); expired holds are
+// refunded the next time the user's holds are touched. Returns
+// ErrInsufficientPoints if the balance, less the user's reserved points,
+// can't cover amount, or ErrVelocityExceeded if holding it would exceed the
+// user's spending velocity cap (see DeductPoints).
+func (c *Client) HoldPoints(ctx context.Context, userID string, amount int) (_ string, err error) {
+	defer c.observe("HoldPoints", c.opStart(), &err)
+	if amount <= 0 {
+		return "", fmt.Errorf("invalid hold amount: %d", amount)
+	}
+
+	now := time.Now()
+	key := newPushID(now)
+	hold := PointsHold{
+		Amount:    amount,
+		CreatedAt: now,
+		ExpiresAt: now.Add(envDuration("POINTS_HOLD_TTL", defaultPointsHoldTTL)),
+	}
+
+	if err := c.takeVelocity(ctx, userID, amount); err != nil {
+		return "", err
+	}
+
+	balance, err := c.updateUser(ctx, userID, func(user *UserData) error {
+		user.releaseExpiredHolds(now)
+		user.expireGrants(now)
+		if spendable := user.spendablePoints(); spendable < amount {
+			return fmt.Errorf("%w: has %d spendable, needs %d", ErrInsufficientPoints, spendable, amount)
+		}
+
+		hold.Grants = user.consumePoints(amount)
+		if user.Holds == nil {
+			user.Holds = make(map[string]PointsHold)
+		}
+		user.Holds[key] = hold
+		return nil
+	})
+	if err != nil {
+		c.refundVelocity(ctx, userID, amount)
+		return "", err
+	}
+
+	c.cache.setPoints(userID, balance)
+	return key + userID, nil
+}
+
+// CapturePoints settles a hold at the actual cost of the request, returning
+// the unused remainder to the balance. If actual exceeds the hold, the
+// overage is taken from the balance, which never goes below zero. Returns
+// ErrHoldNotFound if the hold was already settled or has expired.
+func (c *Client) CapturePoints(ctx context.Context, holdID string, actual int) (err error) {
+	defer c.observe("CapturePoints", c.opStart(), &err)
+	return c.settleHold(ctx, holdID, actual)
+}
+
+// ReleaseHold returns all of a hold's points to the balance, for requests
+// that failed and shouldn't be billed. Returns ErrHoldNotFound if the hold
+// was already settled or has expired.
+func (c *Client) ReleaseHold(ctx context.Context, holdID string) (err error) {
+	defer c.observe("ReleaseHold", c.opStart(), &err)
+	return c.settleHold(ctx, holdID, 0)
+}
+
+// ReleaseExpiredHolds refunds the user's expired holds and returns the
+// resulting balance. CheckAuth calls this before rejecting a user for
+// insufficient points, so points held by crashed requests don't lock the
+// user out.
+func (c *Client) ReleaseExpiredHolds(ctx context.Context, userID string) (_ int, err error) {
+	defer c.observe("ReleaseExpiredHolds", c.opStart(), &err)
+	balance, err := c.updateUser(ctx, userID, func(user *UserData) error {
+		user.releaseExpiredHolds(time.Now())
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	c.cache.setPoints(userID, balance)
+	return balance, nil
+}
+
+func (c *Client) settleHold(ctx context.Context, holdID string, actual int) error {
+	key, userID, err := parseHoldID(holdID)
+	if err != nil {
+		return err
+	}
+
+	balance, err := c.updateUser(ctx, userID, func(user *UserData) error {
+		now := time.Now()
+		user.releaseExpiredHolds(now)
+		if err := user.settleHold(key, actual, now); err != nil {
+			return err
+		}
+		user.expireGrants(now)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	c.cache.setPoints(userID, balance)
+	return nil
+}
+
+// updateUser applies fn to the user record in a transaction and returns the
+// resulting balance. The cached balance is invalidated on failure.
+func (c *Client) updateUser(ctx context.Context, userID string, fn func(user *UserData) error) (int, error) {
+	ref := c.db.NewRef(userPath(userID))
+
+	var balance int
+	err := ref.Transaction(ctx, func(tn db.TransactionNode) (interface{}, error) {
+		var user *UserData
+		if err := tn.Unmarshal(&user); err != nil {
+			return nil, fmt.Errorf("error decoding user: %w", err)
+		}
+		if user == nil {
+			return nil, ErrUserNotFound
+		}
+		if err := fn(user); err != nil {
+			return nil, err
+		}
+		c.stalePoints.refreshExpiry(user)
+
+		balance = user.Points
+		return user, nil
+	})
+	if err != nil {
+		c.cache.invalidate(userID)
+		return 0, err
+	}
+
+	return balance, nil
+}
+
+// releaseExpiredHolds refunds and removes holds that expired before now,
+// returning how many were released
+func (u *UserData) releaseExpiredHolds(now time.Time) int {
+	released := 0
+	for key, hold := range u.Holds {
+		if now.After(hold.ExpiresAt) {
+			u.restorePoints(hold.Amount, hold.Amount, hold.Grants)
+			delete(u.Holds, key)
+			released++
+		}
+	}
+	return released
+}
+
+// settleHold removes the hold, charging actual points against it and
+// refunding the rest. An overage is taken from the spendable balance as far
+// as it goes, leaving the reserve intact.
+func (u *UserData) settleHold(key string, actual int, now time.Time) error {
+	hold, ok := u.Holds[key]
+	if !ok {
+		return ErrHoldNotFound
+	}
+	delete(u.Holds, key)
+
+	if actual <= hold.Amount {
+		u.restorePoints(hold.Amount-actual, hold.Amount, hold.Grants)
+	} else {
+		overage := min(actual-hold.Amount, u.spendablePoints())
+		u.consumePoints(overage)
+		actual = hold.Amount + overage
+	}
+
+	if actual > 0 {
+		u.TotalUsed += actual
+		u.recordCharge(actual)
+		u.LastRequest = now
+	}
+	return nil
+}
+
+// parseHoldID splits a hold ID into the hold's key and the owning user ID
+func parseHoldID(holdID string) (key, userID string, err error) {
+	if len(holdID) <= pushIDLength {
+		return "", "", ErrHoldNotFound
+	}
+	return holdID[:pushIDLength], holdID[pushIDLength:], nil
+}
@@ -0,0 +1,78 @@
+package firebase
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSettleHold(t *testing.T) {
+	now := time.Now()
+	newUser := func() *UserData {
+		return &UserData{
+			Points: 50,
+			Holds: map[string]PointsHold{
+				"h1": {Amount: 20, CreatedAt: now, ExpiresAt: now.Add(time.Hour)},
+			},
+		}
+	}
+
+	t.Run("capture refunds remainder", func(t *testing.T) {
+		user := newUser()
+		require.NoError(t, user.settleHold("h1", 5, now))
+		assert.Equal(t, 65, user.Points)
+		assert.Equal(t, 5, user.TotalUsed)
+		assert.Empty(t, user.Holds)
+	})
+
+	t.Run("release refunds everything", func(t *testing.T) {
+		user := newUser()
+		require.NoError(t, user.settleHold("h1", 0, now))
+		assert.Equal(t, 70, user.Points)
+		assert.Equal(t, 0, user.TotalUsed)
+		assert.True(t, user.LastRequest.IsZero())
+	})
+
+	t.Run("overage is taken from balance without going negative", func(t *testing.T) {
+		user := newUser()
+		require.NoError(t, user.settleHold("h1", 100, now))
+		assert.Equal(t, 0, user.Points)
+		assert.Equal(t, 70, user.TotalUsed)
+	})
+
+	t.Run("unknown hold", func(t *testing.T) {
+		user := newUser()
+		assert.ErrorIs(t, user.settleHold("missing", 5, now), ErrHoldNotFound)
+		assert.Equal(t, 50, user.Points)
+	})
+}
+
+func TestReleaseExpiredHolds(t *testing.T) {
+	now := time.Now()
+	user := &UserData{
+		Points: 10,
+		Holds: map[string]PointsHold{
+			"expired": {Amount: 30, ExpiresAt: now.Add(-time.Minute)},
+			"active":  {Amount: 5, ExpiresAt: now.Add(time.Minute)},
+		},
+	}
+
+	assert.Equal(t, 1, user.releaseExpiredHolds(now))
+	assert.Equal(t, 40, user.Points)
+	assert.Contains(t, user.Holds, "active")
+	assert.NotContains(t, user.Holds, "expired")
+}
+
+func TestParseHoldID(t *testing.T) {
+	key := newPushID(time.Now())
+
+	gotKey, userID, err := parseHoldID(key + "user-1")
+	require.NoError(t, err)
+	assert.Equal(t, key, gotKey)
+	assert.Equal(t, "user-1", userID)
+
+	_, _, err = parseHoldID(key)
+	assert.ErrorIs(t, err, ErrHoldNotFound)
+}
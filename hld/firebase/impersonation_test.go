@@ -0,0 +1,13 @@
+package firebase
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsImpersonationToken(t *testing.T) {
+	assert.True(t, IsImpersonationToken("ofi_0123abcd"))
+	assert.False(t, IsImpersonationToken("ofk_0123abcd"))
+	assert.False(t, IsImpersonationToken("eyJhbGciOiJSUzI1NiJ9.e30.sig"))
+}
@@ -0,0 +1,176 @@
+package firebase
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sort"
+	"time"
+
+	"github.com/humanlayer/humanlayer/hld/internal/requestid"
+)
+
+// Sources of the credits recorded in the grant ledger. GrantPoints records
+// the source its caller gives.
+const (
+	GrantSourcePurchase   = "purchase"
+	GrantSourceSignup     = "signup"
+	GrantSourceImport     = "import"
+	GrantSourceTrial      = "trial"
+	GrantSourceAdjustment = "admin_adjustment"
+	GrantSourceGrant      = "grant"
+)
+
+// Ledger entry types
+const (
+	LedgerCredit = "credit"
+	LedgerDebit  = "debit"
+)
+
+// grantLedgerPath is the node holding a user's grant ledger. Entries are
+// keyed by push ID, so key order is chronological.
+func grantLedgerPath(userID string) string {
+	return "point_ledger/" + userID
+}
+
+// recordGrant appends a credit of amount points from source to the user's
+// grant ledger. Expiring grants share the ID of their entry in
+// users/{id}/point_grants. A failed write is logged rather than returned,
+// since the balance change it records has already been applied.
+func (c *Client) recordGrant(ctx context.Context, userID, id string, grant PointGrant) {
+	if grant.Amount <= 0 {
+		return
+	}
+	if id == "" {
+		id = newPushID(grant.GrantedAt)
+	}
+	grant.ID, grant.Remaining = "", 0
+	grant.RequestID = requestid.FromContext(ctx)
+	if err := c.db.NewRef(grantLedgerPath(userID)+"/"+id).Set(ctx, grant); err != nil {
+		slog.Error("failed to record point grant",
+			"user_id", userID,
+			"source", grant.Source,
+			"points", grant.Amount,
+			"error", err)
+	}
+}
+
+// GetPointGrants returns the credits to a user's balance granted between
+// from and to, oldest first: purchases, signup balances, admin credits,
+// converted trials and expiring grants. Zero times are unbounded. Credits
+// made before the ledger was introduced aren't listed.
+func (c *Client) GetPointGrants(ctx context.Context, userID string, from, to time.Time) (_ []PointGrant, err error) {
+	defer c.observe("GetPointGrants", c.opStart(), &err)
+	query := c.db.NewRef(grantLedgerPath(userID)).OrderByKey()
+	if !from.IsZero() {
+		query = query.StartAt(pushIDTimePrefix(from))
+	}
+	if !to.IsZero() {
+		query = query.EndAt(pushIDTimePrefix(to) + "zzzzzzzzzzzz")
+	}
+
+	nodes, err := query.GetOrdered(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error reading point grants: %w", err)
+	}
+
+	grants := make([]PointGrant, 0, len(nodes))
+	for _, node := range nodes {
+		var grant PointGrant
+		if err := node.Unmarshal(&grant); err != nil {
+			return nil, fmt.Errorf("error decoding point grant %s: %w", node.Key(), err)
+		}
+		grant.ID = node.Key()
+		grants = append(grants, grant)
+	}
+	return grants, nil
+}
+
+// PointDebit is a billed request, as listed in a points statement
+type PointDebit struct {
+	ID        string    `json:"id"`
+	Points    int       `json:"points"`
+	Model     string    `json:"model"`
+	SessionID string    `json:"session_id,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// GetPointDebits returns the user's billed requests between from and to from
+// usage_logs, oldest first. Zero times are unbounded. Usage that has been
+// compacted into daily summaries isn't listed.
+// Requires an ".indexOn": ["user_id"] rule on the usage_logs node.
+func (c *Client) GetPointDebits(ctx context.Context, userID string, from, to time.Time) (_ []PointDebit, err error) {
+	defer c.observe("GetPointDebits", c.opStart(), &err)
+	var logs map[string]UsageLog
+	if err := c.db.NewRef("usage_logs").OrderByChild("user_id").EqualTo(userID).Get(ctx, &logs); err != nil {
+		return nil, fmt.Errorf("error reading usage logs: %w", err)
+	}
+
+	filter := UsageFilter{UserID: userID, From: from, To: to, SuccessOnly: true, IncludeAnonymous: true}
+	debits := make([]PointDebit, 0, len(logs))
+	for id, log := range logs {
+		if log.PointsCost <= 0 || !filter.matches(log) {
+			continue
+		}
+		debits = append(debits, PointDebit{
+			ID:        id,
+			Points:    log.PointsCost,
+			Model:     log.Model,
+			SessionID: log.SessionID,
+			Timestamp: log.Timestamp,
+		})
+	}
+	sort.Slice(debits, func(i, j int) bool {
+		if !debits[i].Timestamp.Equal(debits[j].Timestamp) {
+			return debits[i].Timestamp.Before(debits[j].Timestamp)
+		}
+		return debits[i].ID < debits[j].ID
+	})
+	return debits, nil
+}
+
+// LedgerEntry is one line of a points statement: a credit from the grant
+// ledger or a debit from usage_logs. Points are negative for debits.
+type LedgerEntry struct {
+	ID        string     `json:"id"`
+	Type      string     `json:"type"`
+	Points    int        `json:"points"`
+	Timestamp time.Time  `json:"timestamp"`
+	Source    string     `json:"source,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	Model     string     `json:"model,omitempty"`
+	SessionID string     `json:"session_id,omitempty"`
+}
+
+// BuildLedger merges credits and debits into one statement, oldest first
+func BuildLedger(grants []PointGrant, debits []PointDebit) []LedgerEntry {
+	entries := make([]LedgerEntry, 0, len(grants)+len(debits))
+	for _, g := range grants {
+		entry := LedgerEntry{
+			ID:        g.ID,
+			Type:      LedgerCredit,
+			Points:    g.Amount,
+			Timestamp: g.GrantedAt,
+			Source:    g.Source,
+		}
+		if !g.ExpiresAt.IsZero() {
+			expiresAt := g.ExpiresAt
+			entry.ExpiresAt = &expiresAt
+		}
+		entries = append(entries, entry)
+	}
+	for _, d := range debits {
+		entries = append(entries, LedgerEntry{
+			ID:        d.ID,
+			Type:      LedgerDebit,
+			Points:    -d.Points,
+			Timestamp: d.Timestamp,
+			Model:     d.Model,
+			SessionID: d.SessionID,
+		})
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Timestamp.Before(entries[j].Timestamp)
+	})
+	return entries
+}
@@ -0,0 +1,36 @@
+package firebase
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBuildLedger(t *testing.T) {
+	base := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	grants := []PointGrant{
+		{ID: "g1", Amount: 100, Source: GrantSourceSignup, GrantedAt: base},
+		{ID: "g2", Amount: 50, Source: "promo", GrantedAt: base.Add(2 * time.Hour), ExpiresAt: base.Add(48 * time.Hour)},
+	}
+	debits := []PointDebit{
+		{ID: "u1", Points: 7, Model: "claude-3-5-haiku-20241022", Timestamp: base.Add(time.Hour)},
+		{ID: "u2", Points: 3, Model: "claude-3-5-haiku-20241022", SessionID: "sess-1", Timestamp: base.Add(3 * time.Hour)},
+	}
+
+	entries := BuildLedger(grants, debits)
+	require.Len(t, entries, 4)
+	assert.Equal(t, []string{"g1", "u1", "g2", "u2"}, []string{entries[0].ID, entries[1].ID, entries[2].ID, entries[3].ID})
+
+	assert.Equal(t, LedgerCredit, entries[0].Type)
+	assert.Equal(t, 100, entries[0].Points)
+	assert.Nil(t, entries[0].ExpiresAt)
+
+	assert.Equal(t, LedgerDebit, entries[1].Type)
+	assert.Equal(t, -7, entries[1].Points)
+
+	require.NotNil(t, entries[2].ExpiresAt)
+	assert.Equal(t, base.Add(48*time.Hour), *entries[2].ExpiresAt)
+	assert.Equal(t, "sess-1", entries[3].SessionID)
+}
@@ -0,0 +1,25 @@
+package firebase
+
+import "strings"
+
+// modelAliases maps short model names to the canonical IDs priced in
+// modelPricing
+var modelAliases = map[string]string{
+	"opus":                     "claude-3-opus-20240229",
+	"sonnet":                   "claude-3-5-sonnet-20241022",
+	"sonnet-latest":            "claude-3-5-sonnet-20241022",
+	"haiku":                    "claude-3-5-haiku-20241022",
+	"claude-3-opus-latest":     "claude-3-opus-20240229",
+	"claude-3-5-sonnet-latest": "claude-3-5-sonnet-20241022",
+	"claude-3-5-haiku-latest":  "claude-3-5-haiku-20241022",
+}
+
+// ResolveModelAlias returns the canonical model ID for a short alias such as
+// "opus" or "sonnet-latest". Aliases match case-insensitively; any other
+// name is returned unchanged.
+func ResolveModelAlias(alias string) string {
+	if model, ok := modelAliases[strings.ToLower(strings.TrimSpace(alias))]; ok {
+		return model
+	}
+	return alias
+}
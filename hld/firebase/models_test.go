@@ -0,0 +1,22 @@
+package firebase
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResolveModelAlias(t *testing.T) {
+	assert.Equal(t, "claude-3-opus-20240229", ResolveModelAlias("opus"))
+	assert.Equal(t, "claude-3-5-sonnet-20241022", ResolveModelAlias(" Sonnet-Latest "))
+	assert.Equal(t, "claude-3-5-haiku-20241022", ResolveModelAlias("haiku"))
+	assert.Equal(t, "claude-3-haiku-20240307", ResolveModelAlias("claude-3-haiku-20240307"))
+	assert.Equal(t, "unknown-model", ResolveModelAlias("unknown-model"))
+}
+
+func TestCalculatePointsCostResolvesAliases(t *testing.T) {
+	// Opus pricing, not the Sonnet fallback
+	assert.Equal(t, 90, CalculatePointsCost("opus", 1000, 1000))
+	assert.Equal(t, CalculatePointsCost("claude-3-opus-20240229", 1000, 1000), CalculatePointsCost("opus", 1000, 1000))
+	assert.True(t, IsKnownModel("haiku"))
+}
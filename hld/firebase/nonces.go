@@ -0,0 +1,104 @@
+package firebase
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"firebase.google.com/go/v4/db"
+)
+
+// NonceTTL is how long an issued nonce can be used
+const NonceTTL = 5 * time.Minute
+
+// Nonce is a server-issued one-time token authorizing a single privileged
+// mutation, so a replayed request can't apply a balance change twice. Only
+// the SHA-256 hash of the token is stored, under nonces/{hash}. A consumed
+// nonce is kept until it expires so reuse can be told apart from a forged
+// token.
+type Nonce struct {
+	ActorID     string     `json:"actor_id"`
+	CreatedAt   time.Time  `json:"created_at"`
+	ExpiresAt   time.Time  `json:"expires_at"`
+	ExpiresAtMS int64      `json:"expires_at_ms"`
+	ConsumedAt  *time.Time `json:"consumed_at,omitempty"`
+}
+
+// CreateNonce issues a nonce, valid for NonceTTL, that only actorID can
+// consume. The plaintext token is only returned here.
+func (c *Client) CreateNonce(ctx context.Context, actorID string) (_ string, _ *Nonce, err error) {
+	defer c.observe("CreateNonce", c.opStart(), &err)
+	secret := make([]byte, 16)
+	if _, err := rand.Read(secret); err != nil {
+		return "", nil, fmt.Errorf("error generating nonce: %w", err)
+	}
+	plaintext := hex.EncodeToString(secret)
+
+	now := time.Now()
+	nonce := &Nonce{
+		ActorID:     actorID,
+		CreatedAt:   now,
+		ExpiresAt:   now.Add(NonceTTL),
+		ExpiresAtMS: now.Add(NonceTTL).UnixMilli(),
+	}
+	if err := c.db.NewRef("nonces/"+hashAPIKey(plaintext)).Set(ctx, nonce); err != nil {
+		return "", nil, fmt.Errorf("error storing nonce: %w", err)
+	}
+	return plaintext, nonce, nil
+}
+
+// ConsumeNonce marks a nonce used by actorID in a transaction, so of two
+// requests carrying it only one succeeds. It returns ErrNonceNotFound for
+// unknown nonces and those issued to another actor, ErrNonceExpired once
+// NonceTTL has passed, and ErrNonceUsed if it was already consumed.
+func (c *Client) ConsumeNonce(ctx context.Context, plaintext, actorID string) (err error) {
+	defer c.observe("ConsumeNonce", c.opStart(), &err)
+	ref := c.db.NewRef("nonces/" + hashAPIKey(plaintext))
+	return ref.Transaction(ctx, func(tn db.TransactionNode) (interface{}, error) {
+		var nonce *Nonce
+		if err := tn.Unmarshal(&nonce); err != nil {
+			return nil, fmt.Errorf("error decoding nonce: %w", err)
+		}
+		if nonce == nil || nonce.ActorID != actorID {
+			return nil, ErrNonceNotFound
+		}
+		now := time.Now()
+		if !now.Before(nonce.ExpiresAt) {
+			return nil, ErrNonceExpired
+		}
+		if nonce.ConsumedAt != nil {
+			return nil, ErrNonceUsed
+		}
+		nonce.ConsumedAt = &now
+		return nonce, nil
+	})
+}
+
+// DeleteExpiredNonces removes nonces past their expiry, consumed or not,
+// and returns how many were removed.
+// Requires an ".indexOn": ["expires_at_ms"] rule on the nonces node.
+func (c *Client) DeleteExpiredNonces(ctx context.Context) (_ int, err error) {
+	defer c.observe("DeleteExpiredNonces", c.opStart(), &err)
+	var expired map[string]struct{}
+	err = c.db.NewRef("nonces").
+		OrderByChild("expires_at_ms").
+		EndAt(time.Now().UnixMilli()).
+		Get(ctx, &expired)
+	if err != nil {
+		return 0, fmt.Errorf("error querying expired nonces: %w", err)
+	}
+	if len(expired) == 0 {
+		return 0, nil
+	}
+
+	updates := make(map[string]interface{}, len(expired))
+	for key := range expired {
+		updates[key] = nil
+	}
+	if err := c.db.NewRef("nonces").Update(ctx, updates); err != nil {
+		return 0, fmt.Errorf("error deleting expired nonces: %w", err)
+	}
+	return len(expired), nil
+}
@@ -0,0 +1,31 @@
+package firebase
+
+import "time"
+
+// OpObserver is told the outcome and duration of every exported Client
+// operation, e.g. to export latency metrics. op is the method name.
+type OpObserver func(op string, err error, d time.Duration)
+
+// SetOpObserver sets the observer told about every operation, or clears it
+// when fn is nil. It must be set before the client is shared.
+func (c *Client) SetOpObserver(fn OpObserver) {
+	c.observer = fn
+}
+
+// opStart returns the start time of an operation, or the zero time when
+// nothing is observing so unobserved calls skip the clock read
+func (c *Client) opStart() time.Time {
+	if c == nil || c.observer == nil {
+		return time.Time{}
+	}
+	return time.Now()
+}
+
+// observe reports an operation started at start to the observer. It is
+// deferred by every exported method with a pointer to its named error.
+func (c *Client) observe(op string, start time.Time, err *error) {
+	if c == nil || c.observer == nil {
+		return
+	}
+	c.observer(op, *err, time.Since(start))
+}
@@ -0,0 +1,48 @@
+package firebase
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestObserve(t *testing.T) {
+	// Unobserved clients, nil ones included, skip the clock
+	var none *Client
+	assert.True(t, none.opStart().IsZero())
+	assert.True(t, (&Client{}).opStart().IsZero())
+	var err error
+	none.observe("GetUserAccount", time.Time{}, &err)
+
+	var gotOp string
+	var gotErr error
+	c := &Client{}
+	c.SetOpObserver(func(op string, err error, d time.Duration) {
+		gotOp, gotErr = op, err
+	})
+
+	start := c.opStart()
+	assert.False(t, start.IsZero())
+	err = errors.New("unavailable")
+	c.observe("HoldPoints", start, &err)
+	assert.Equal(t, "HoldPoints", gotOp)
+	assert.Equal(t, err, gotErr)
+}
+
+func TestObservedMethodReportsError(t *testing.T) {
+	var gotOp string
+	var gotErr error
+	c := &Client{}
+	c.SetOpObserver(func(op string, err error, d time.Duration) {
+		gotOp, gotErr = op, err
+	})
+
+	// Invalid amounts are refused before touching Firebase
+	_, err := c.HoldPoints(context.Background(), "user-1", 0)
+	assert.Error(t, err)
+	assert.Equal(t, "HoldPoints", gotOp)
+	assert.Equal(t, err, gotErr)
+}
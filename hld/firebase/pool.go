@@ -0,0 +1,117 @@
+package firebase
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// ClientPool holds one Client per tenant for deployments where tenants keep
+// their data in their own Firebase project. Clients are constructed lazily on
+// a tenant's first request and reused afterwards.
+type ClientPool struct {
+	defaultClient *Client
+	configs       map[string]Config
+	observer      OpObserver
+
+	mu      sync.Mutex
+	clients map[string]*poolEntry
+}
+
+// poolEntry lets concurrent first requests for a tenant share one
+// construction
+type poolEntry struct {
+	once   sync.Once
+	client *Client
+	err    error
+}
+
+// NewClientPool creates a pool serving the given tenant configs. Requests
+// without a tenant use defaultClient, which may be nil in tenant-only
+// deployments.
+func NewClientPool(defaultClient *Client, configs map[string]Config) *ClientPool {
+	return &ClientPool{
+		defaultClient: defaultClient,
+		configs:       configs,
+		clients:       make(map[string]*poolEntry),
+	}
+}
+
+// LoadTenantConfigs reads per-tenant project configs from the JSON file named
+// by FIREBASE_TENANTS_FILE, a map of tenant ID to config. Missing
+// configuration yields no tenants.
+func LoadTenantConfigs() (map[string]Config, error) {
+	path := os.Getenv("FIREBASE_TENANTS_FILE")
+	if path == "" {
+		return map[string]Config{}, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read tenants file: %w", err)
+	}
+
+	var configs map[string]Config
+	if err := json.Unmarshal(data, &configs); err != nil {
+		return nil, fmt.Errorf("failed to parse tenants file: %w", err)
+	}
+	return configs, nil
+}
+
+// Get returns the client for tenantID, constructing it on first use. An empty
+// tenant ID selects the default client. Returns ErrUnknownTenant for tenants
+// without a config.
+func (p *ClientPool) Get(ctx context.Context, tenantID string) (*Client, error) {
+	if tenantID == "" {
+		if p.defaultClient == nil {
+			return nil, ErrUnknownTenant
+		}
+		return p.defaultClient, nil
+	}
+
+	cfg, ok := p.configs[tenantID]
+	if !ok {
+		return nil, ErrUnknownTenant
+	}
+
+	p.mu.Lock()
+	entry, ok := p.clients[tenantID]
+	if !ok {
+		entry = &poolEntry{}
+		p.clients[tenantID] = entry
+	}
+	p.mu.Unlock()
+
+	entry.once.Do(func() {
+		// The client outlives the request that triggered its construction
+		entry.client, entry.err = NewClient(context.WithoutCancel(ctx), cfg)
+		if entry.err == nil {
+			entry.client.SetOpObserver(p.observer)
+		}
+	})
+
+	if entry.err != nil {
+		// Drop the failed entry so a later request can retry
+		p.mu.Lock()
+		if p.clients[tenantID] == entry {
+			delete(p.clients, tenantID)
+		}
+		p.mu.Unlock()
+		return nil, fmt.Errorf("error initializing client for tenant %s: %w", tenantID, entry.err)
+	}
+
+	return entry.client, nil
+}
+
+// SetOpObserver sets the observer of tenant clients constructed afterwards.
+// The default client is observed through its own SetOpObserver.
+func (p *ClientPool) SetOpObserver(fn OpObserver) {
+	p.observer = fn
+}
+
+// Default returns the default client, or nil if there is none
+func (p *ClientPool) Default() *Client {
+	return p.defaultClient
+}
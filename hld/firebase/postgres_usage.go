@@ -0,0 +1,298 @@
+package firebase
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Usage store backends selectable with USAGE_STORE
+const (
+	UsageStoreFirebase = "firebase"
+	UsageStorePostgres = "postgres"
+)
+
+// defaultUsageStoreDriver is the database/sql driver name used for
+// Postgres unless USAGE_STORE_DRIVER names another
+const defaultUsageStoreDriver = "postgres"
+
+// postgresUsageSchema creates the usage_logs table. The filtered and summed
+// fields have their own columns; data holds the complete log.
+const postgresUsageSchema = `
+CREATE TABLE IF NOT EXISTS usage_logs (
+	id            TEXT PRIMARY KEY,
+	user_id       TEXT NOT NULL,
+	model         TEXT NOT NULL,
+	logged_at     TIMESTAMPTZ NOT NULL,
+	success       BOOLEAN NOT NULL,
+	anonymous     BOOLEAN NOT NULL DEFAULT FALSE,
+	service       BOOLEAN NOT NULL DEFAULT FALSE,
+	input_tokens  INTEGER NOT NULL,
+	output_tokens INTEGER NOT NULL,
+	points_cost   INTEGER NOT NULL,
+	data          JSONB NOT NULL
+);
+CREATE INDEX IF NOT EXISTS usage_logs_user_logged_at ON usage_logs (user_id, logged_at);
+CREATE INDEX IF NOT EXISTS usage_logs_logged_at ON usage_logs (logged_at);
+`
+
+// PostgresUsageStore keeps usage logs in a Postgres usage_logs table
+// instead of Firebase. Logged usage is still archived, flagged and counted
+// towards requests_by_day through its Firebase client, so quotas and the
+// audit trail work as with the Firebase backend.
+//
+// Logs already in Firebase aren't moved. To migrate them, export them with
+// ExportUsage in JSON Lines format from a Firebase-backed deployment and
+// insert each line's id and fields into usage_logs, with the line itself as
+// data, before switching USAGE_STORE; the IDs are the same push IDs, so
+// flagged usage entries keep pointing at their logs.
+type PostgresUsageStore struct {
+	db     *sql.DB
+	client *Client
+}
+
+var _ UsageStore = PostgresUsageStore{}
+
+// NewPostgresUsageStoreFromEnv opens the Postgres usage store when
+// USAGE_STORE is "postgres", connecting to USAGE_STORE_DSN with the
+// database/sql driver named by USAGE_STORE_DRIVER (default "postgres"),
+// which the binary must register by importing it. It returns nil for the
+// Firebase backend, the default.
+func NewPostgresUsageStoreFromEnv(ctx context.Context, client *Client) (*PostgresUsageStore, error) {
+	switch backend := os.Getenv("USAGE_STORE"); backend {
+	case "", UsageStoreFirebase:
+		return nil, nil
+	case UsageStorePostgres:
+	default:
+		return nil, fmt.Errorf("unknown USAGE_STORE %q, want %s or %s", backend, UsageStoreFirebase, UsageStorePostgres)
+	}
+
+	dsn := os.Getenv("USAGE_STORE_DSN")
+	if dsn == "" {
+		return nil, fmt.Errorf("USAGE_STORE_DSN is required when USAGE_STORE is %s", UsageStorePostgres)
+	}
+	driver := os.Getenv("USAGE_STORE_DRIVER")
+	if driver == "" {
+		driver = defaultUsageStoreDriver
+	}
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, fmt.Errorf("error opening usage store: %w", err)
+	}
+	store, err := NewPostgresUsageStore(ctx, db, client)
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	slog.Info("usage logs stored in postgres", "driver", driver)
+	return store, nil
+}
+
+// NewPostgresUsageStore creates the usage_logs table in db if needed and
+// returns a store whose logged usage is counted through client
+func NewPostgresUsageStore(ctx context.Context, db *sql.DB, client *Client) (*PostgresUsageStore, error) {
+	if _, err := db.ExecContext(ctx, postgresUsageSchema); err != nil {
+		return nil, fmt.Errorf("error creating usage_logs table: %w", err)
+	}
+	return &PostgresUsageStore{db: db, client: client}, nil
+}
+
+// Close closes the database
+func (s PostgresUsageStore) Close() error {
+	return s.db.Close()
+}
+
+// LogUsage records one usage event
+func (s PostgresUsageStore) LogUsage(ctx context.Context, log UsageLog) error {
+	return s.LogUsageBatch(ctx, []UsageLog{log})
+}
+
+// LogUsageBatch inserts the logs in one transaction, then archives, flags
+// and counts them through the Firebase client
+func (s PostgresUsageStore) LogUsageBatch(ctx context.Context, logs []UsageLog) error {
+	if len(logs) == 0 {
+		return nil
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("error logging usage batch: %w", err)
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	stmt, err := tx.PrepareContext(ctx, `INSERT INTO usage_logs
+		(id, user_id, model, logged_at, success, anonymous, service, input_tokens, output_tokens, points_cost, data)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)`)
+	if err != nil {
+		return fmt.Errorf("error logging usage batch: %w", err)
+	}
+	defer stmt.Close()
+
+	keys := make([]string, len(logs))
+	for i, log := range logs {
+		keys[i] = newPushID(log.Timestamp)
+		data, err := json.Marshal(log)
+		if err != nil {
+			return fmt.Errorf("error encoding usage log: %w", err)
+		}
+		_, err = stmt.ExecContext(ctx, keys[i], log.UserID, log.Model, log.Timestamp.UTC(),
+			log.Success, log.Anonymous, log.Service, log.InputTokens, log.OutputTokens, log.PointsCost, data)
+		if err != nil {
+			return fmt.Errorf("error logging usage batch: %w", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("error logging usage batch: %w", err)
+	}
+
+	if s.client == nil {
+		return nil
+	}
+	return s.client.usageLogged(ctx, keys, logs)
+}
+
+// GetUsageHistory returns up to limit usage logs matching filter, newest
+// first
+func (s PostgresUsageStore) GetUsageHistory(ctx context.Context, filter UsageFilter, limit int) ([]UsageRecord, error) {
+	where, args := postgresUsageWhere(filter)
+	query := "SELECT id, data FROM usage_logs" + where + " ORDER BY logged_at DESC, id DESC"
+	if limit > 0 {
+		args = append(args, limit)
+		query += " LIMIT $" + strconv.Itoa(len(args))
+	}
+
+	var records []UsageRecord
+	err := s.eachRow(ctx, query, args, func(id string, log UsageLog) error {
+		records = append(records, UsageRecord{ID: id, UsageLog: log})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+// GetUsageSummary totals the usage logs matching filter. Tokens and points
+// only count successful requests, as with UsageRollup.
+func (s PostgresUsageStore) GetUsageSummary(ctx context.Context, filter UsageFilter) (*UsageRollup, error) {
+	where, args := postgresUsageWhere(filter)
+	query := `SELECT
+		COUNT(*),
+		COUNT(*) FILTER (WHERE NOT success),
+		COALESCE(SUM(input_tokens) FILTER (WHERE success), 0),
+		COALESCE(SUM(output_tokens) FILTER (WHERE success), 0),
+		COALESCE(SUM(points_cost) FILTER (WHERE success), 0),
+		COALESCE(SUM((data->>'cache_creation_tokens')::INTEGER) FILTER (WHERE success), 0),
+		COALESCE(SUM((data->>'cache_read_tokens')::INTEGER) FILTER (WHERE success), 0)
+		FROM usage_logs` + where
+
+	var summary UsageRollup
+	err := s.db.QueryRowContext(ctx, query, args...).Scan(&summary.Requests, &summary.FailedRequests,
+		&summary.InputTokens, &summary.OutputTokens, &summary.PointsCost,
+		&summary.CacheCreationTokens, &summary.CacheReadTokens)
+	if err != nil {
+		return nil, fmt.Errorf("error summarizing usage logs: %w", err)
+	}
+	return &summary, nil
+}
+
+// ExportUsage streams the usage logs matching filter to w as CSV or JSON
+// Lines, oldest first
+func (s PostgresUsageStore) ExportUsage(ctx context.Context, filter UsageFilter, w io.Writer, format string) error {
+	enc, err := newUsageEncoder(w, format)
+	if err != nil {
+		return err
+	}
+	where, args := postgresUsageWhere(filter)
+	query := "SELECT id, data FROM usage_logs" + where + " ORDER BY logged_at, id"
+
+	written := 0
+	err = s.eachRow(ctx, query, args, func(id string, log UsageLog) error {
+		if err := enc.write(id, log); err != nil {
+			return err
+		}
+		if written++; written%exportPageSize == 0 {
+			return enc.flush()
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return enc.flush()
+}
+
+// eachRow runs a query selecting id and data and calls fn with each log
+func (s PostgresUsageStore) eachRow(ctx context.Context, query string, args []interface{}, fn func(id string, log UsageLog) error) error {
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return fmt.Errorf("error reading usage logs: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id string
+		var data []byte
+		if err := rows.Scan(&id, &data); err != nil {
+			return fmt.Errorf("error reading usage logs: %w", err)
+		}
+		var log UsageLog
+		if err := json.Unmarshal(data, &log); err != nil {
+			return fmt.Errorf("error decoding usage log %s: %w", id, err)
+		}
+		if err := fn(id, log); err != nil {
+			return err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error reading usage logs: %w", err)
+	}
+	return nil
+}
+
+// postgresUsageWhere translates filter into a WHERE clause and its
+// arguments, matching UsageFilter.matches
+func postgresUsageWhere(filter UsageFilter) (string, []interface{}) {
+	var conds []string
+	var args []interface{}
+	add := func(cond string, arg interface{}) {
+		args = append(args, arg)
+		conds = append(conds, strings.ReplaceAll(cond, "?", "$"+strconv.Itoa(len(args))))
+	}
+
+	if filter.UserID != "" {
+		add("user_id = ?", filter.UserID)
+	}
+	if filter.SessionID != "" {
+		add("data->>'session_id' = ?", filter.SessionID)
+	}
+	if filter.Model != "" {
+		add("model = ?", filter.Model)
+	}
+	if !filter.From.IsZero() {
+		add("logged_at >= ?", filter.From.UTC())
+	}
+	if !filter.To.IsZero() {
+		add("logged_at <= ?", filter.To.UTC())
+	}
+	if filter.SuccessOnly {
+		conds = append(conds, "success")
+	}
+	if !filter.IncludeAnonymous {
+		conds = append(conds, "NOT anonymous")
+	}
+	if !filter.IncludeService {
+		conds = append(conds, "NOT service")
+	}
+
+	if len(conds) == 0 {
+		return "", nil
+	}
+	return " WHERE " + strings.Join(conds, " AND "), args
+}
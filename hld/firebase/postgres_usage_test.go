@@ -0,0 +1,62 @@
+package firebase
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPostgresUsageWhere(t *testing.T) {
+	where, args := postgresUsageWhere(UsageFilter{IncludeAnonymous: true, IncludeService: true})
+	assert.Empty(t, where)
+	assert.Empty(t, args)
+
+	from := time.Date(2026, 1, 1, 0, 0, 0, 0, time.FixedZone("CET", 3600))
+	to := time.Date(2026, 2, 1, 0, 0, 0, 0, time.UTC)
+	where, args = postgresUsageWhere(UsageFilter{
+		UserID:      "u1",
+		Model:       "claude-sonnet",
+		From:        from,
+		To:          to,
+		SuccessOnly: true,
+	})
+	assert.Equal(t, " WHERE user_id = $1 AND model = $2 AND logged_at >= $3 AND logged_at <= $4"+
+		" AND success AND NOT anonymous AND NOT service", where)
+	assert.Equal(t, []interface{}{"u1", "claude-sonnet", from.UTC(), to}, args)
+
+	where, args = postgresUsageWhere(UsageFilter{SessionID: "sess-1", IncludeAnonymous: true, IncludeService: true})
+	assert.Equal(t, " WHERE data->>'session_id' = $1", where)
+	assert.Equal(t, []interface{}{"sess-1"}, args)
+}
+
+func TestPostgresUsageStoreFromEnv(t *testing.T) {
+	ctx := context.Background()
+
+	t.Setenv("USAGE_STORE", "")
+	store, err := NewPostgresUsageStoreFromEnv(ctx, &Client{})
+	require.NoError(t, err)
+	assert.Nil(t, store)
+
+	t.Setenv("USAGE_STORE", UsageStoreFirebase)
+	store, err = NewPostgresUsageStoreFromEnv(ctx, &Client{})
+	require.NoError(t, err)
+	assert.Nil(t, store)
+
+	t.Setenv("USAGE_STORE", "mysql")
+	_, err = NewPostgresUsageStoreFromEnv(ctx, &Client{})
+	assert.ErrorContains(t, err, "unknown USAGE_STORE")
+
+	t.Setenv("USAGE_STORE", UsageStorePostgres)
+	t.Setenv("USAGE_STORE_DSN", "")
+	_, err = NewPostgresUsageStoreFromEnv(ctx, &Client{})
+	assert.ErrorContains(t, err, "USAGE_STORE_DSN is required")
+
+	// The driver has to be compiled into the binary
+	t.Setenv("USAGE_STORE_DSN", "postgres://localhost/usage")
+	t.Setenv("USAGE_STORE_DRIVER", "unregistered")
+	_, err = NewPostgresUsageStoreFromEnv(ctx, &Client{})
+	assert.ErrorContains(t, err, "error opening usage store")
+}
@@ -0,0 +1,239 @@
+package firebase
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ModelRates is a model's price in points per 1K tokens
+type ModelRates struct {
+	Input  float64 `json:"input"`
+	Output float64 `json:"output"`
+}
+
+// PricingOverride is a user's contracted pricing, stored under
+// pricing_overrides/{userID}. Rates replaces the public rates of the models
+// it names, keyed by canonical model ID; every other model is charged its
+// public rate times Multiplier, or the public rate when Multiplier is zero.
+type PricingOverride struct {
+	Rates      map[string]ModelRates `json:"rates,omitempty"`
+	Multiplier float64               `json:"multiplier,omitempty"`
+	// ContractID identifies the agreement the override implements
+	ContractID string    `json:"contract_id,omitempty"`
+	UpdatedAt  time.Time `json:"updated_at"`
+	UpdatedBy  string    `json:"updated_by,omitempty"`
+}
+
+// AppliedPricing records the contracted rates a request was charged at, so
+// usage logs show how each cost was reached
+type AppliedPricing struct {
+	ContractID string  `json:"contract_id,omitempty"`
+	Input      float64 `json:"input"`
+	Output     float64 `json:"output"`
+	// Multiplier is set when the rates are the public rates scaled by it
+	Multiplier float64 `json:"multiplier,omitempty"`
+}
+
+// Validate checks the override's rates and multiplier are usable
+func (p *PricingOverride) Validate() error {
+	if p.Multiplier < 0 || math.IsNaN(p.Multiplier) || math.IsInf(p.Multiplier, 0) {
+		return fmt.Errorf("multiplier must be a non-negative number")
+	}
+	if len(p.Rates) == 0 && p.Multiplier == 0 {
+		return fmt.Errorf("rates or a multiplier is required")
+	}
+	for model, rates := range p.Rates {
+		if model == "" || strings.ContainsAny(model, ".$#[]/") {
+			return fmt.Errorf("invalid model %q", model)
+		}
+		if rates.Input < 0 || rates.Output < 0 {
+			return fmt.Errorf("rates for %s must be non-negative", model)
+		}
+	}
+	return nil
+}
+
+// PricingFor returns the rates model is charged at under override, which
+// may be nil, along with the record of any contracted rates applied. Models
+// without pricing are charged as DefaultModel.
+func PricingFor(model string, override *PricingOverride) (ModelRates, *AppliedPricing) {
+	model = ResolveModelAlias(model)
+	if override == nil {
+		return publicRates(model), nil
+	}
+
+	applied := &AppliedPricing{ContractID: override.ContractID}
+	rates, ok := override.Rates[model]
+	if !ok {
+		rates = publicRates(model)
+		if override.Multiplier > 0 {
+			rates.Input *= override.Multiplier
+			rates.Output *= override.Multiplier
+			applied.Multiplier = override.Multiplier
+		}
+	}
+	applied.Input, applied.Output = rates.Input, rates.Output
+	return rates, applied
+}
+
+// CalculatePointsCostFor calculates the points cost for a request under a
+// user's pricing override, or at the public rates when override is nil
+func CalculatePointsCostFor(model string, inputTokens, outputTokens int, override *PricingOverride) int {
+	rates, _ := PricingFor(model, override)
+	return pointsCost(rates, inputTokens, outputTokens)
+}
+
+// publicRates returns the published rates for a canonical model ID,
+// falling back to DefaultModel's
+func publicRates(model string) ModelRates {
+	rates, ok := modelPricing[model]
+	if !ok {
+		rates = modelPricing[DefaultModel]
+	}
+	return ModelRates{Input: rates.input, Output: rates.output}
+}
+
+// RoundingMode is how a fractional points cost is rounded to whole points
+type RoundingMode string
+
+const (
+	// RoundCeil charges any fraction of a point as a whole point
+	RoundCeil RoundingMode = "ceil"
+	// RoundHalfUp rounds to the nearest point, halves up
+	RoundHalfUp RoundingMode = "half_up"
+	// RoundFloor drops the fraction; the one-point minimum still applies
+	RoundFloor RoundingMode = "floor"
+	// RoundHalfEven rounds to the nearest point, halves to the even point
+	RoundHalfEven RoundingMode = "half_even"
+)
+
+// ratePrecision is the fixed-point scale of rates: they are honored to a
+// millionth of a point per 1K tokens, which absorbs float drift from
+// multiplied contract rates
+const ratePrecision = 1_000_000
+
+// pointsRounding is the rounding mode from POINTS_ROUNDING, read once
+var pointsRounding = sync.OnceValue(roundingModeFromEnv)
+
+// roundingModeFromEnv reads POINTS_ROUNDING, falling back to RoundCeil
+// when it is unset or invalid
+func roundingModeFromEnv() RoundingMode {
+	raw := os.Getenv("POINTS_ROUNDING")
+	if raw == "" {
+		return RoundCeil
+	}
+	mode, err := ParseRoundingMode(raw)
+	if err != nil {
+		slog.Warn("invalid POINTS_ROUNDING, rounding up", "value", raw, "error", err)
+		return RoundCeil
+	}
+	return mode
+}
+
+// ParseRoundingMode parses ceil, half_up, floor or half_even
+func ParseRoundingMode(raw string) (RoundingMode, error) {
+	switch mode := RoundingMode(strings.ToLower(strings.TrimSpace(raw))); mode {
+	case RoundCeil, RoundHalfUp, RoundFloor, RoundHalfEven:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("unknown rounding mode %q", raw)
+	}
+}
+
+// pointsCost prices token counts at rates, rounded by POINTS_ROUNDING
+// with a minimum of one point per request
+func pointsCost(rates ModelRates, inputTokens, outputTokens int) int {
+	return pointsCostRounded(rates, inputTokens, outputTokens, pointsRounding())
+}
+
+// pointsCostRounded prices token counts at rates in fixed point, so the
+// only rounding is the final one to whole points by mode, with a minimum
+// of one point per request
+func pointsCostRounded(rates ModelRates, inputTokens, outputTokens int, mode RoundingMode) int {
+	// cost is in billionths of a point: tokens times millionths of a
+	// point per 1K tokens
+	const unit = ratePrecision * 1000
+	cost := int64(inputTokens)*fixedRate(rates.Input) + int64(outputTokens)*fixedRate(rates.Output)
+
+	points, rem := cost/unit, cost%unit
+	switch mode {
+	case RoundHalfUp:
+		if 2*rem >= unit {
+			points++
+		}
+	case RoundFloor:
+	case RoundHalfEven:
+		if 2*rem > unit || (2*rem == unit && points%2 == 1) {
+			points++
+		}
+	default:
+		if rem > 0 {
+			points++
+		}
+	}
+	if points < 1 {
+		points = 1
+	}
+	return int(points)
+}
+
+// fixedRate converts a rate to millionths of a point per 1K tokens
+func fixedRate(rate float64) int64 {
+	return int64(math.Round(rate * ratePrecision))
+}
+
+// GetPricingOverride returns the user's pricing override, or nil if they
+// pay the public rates. Results, including the absence of an override, are
+// cached with balances.
+func (c *Client) GetPricingOverride(ctx context.Context, userID string) (_ *PricingOverride, err error) {
+	defer c.observe("GetPricingOverride", c.opStart(), &err)
+	if override, ok := c.cache.getPricing(userID); ok {
+		return override, nil
+	}
+
+	var override *PricingOverride
+	if err := c.db.NewRef("pricing_overrides/"+userID).Get(ctx, &override); err != nil {
+		return nil, fmt.Errorf("error getting pricing override: %w", err)
+	}
+	c.cache.setPricing(userID, override)
+	return override, nil
+}
+
+// SetPricingOverride stores the user's pricing override, or removes it when
+// override is nil so the user pays the public rates. Unknown users fail with
+// ErrUserNotFound.
+func (c *Client) SetPricingOverride(ctx context.Context, userID string, override *PricingOverride) (err error) {
+	defer c.observe("SetPricingOverride", c.opStart(), &err)
+	var user *UserData
+	if err := c.db.NewRef(userPath(userID)).Get(ctx, &user); err != nil {
+		return fmt.Errorf("error getting user: %w", err)
+	}
+	if user == nil {
+		return ErrUserNotFound
+	}
+
+	ref := c.db.NewRef("pricing_overrides/" + userID)
+	if override == nil {
+		if err := ref.Delete(ctx); err != nil {
+			return fmt.Errorf("error removing pricing override: %w", err)
+		}
+	} else {
+		if err := override.Validate(); err != nil {
+			return fmt.Errorf("invalid pricing override: %w", err)
+		}
+		if override.UpdatedAt.IsZero() {
+			override.UpdatedAt = time.Now()
+		}
+		if err := ref.Set(ctx, override); err != nil {
+			return fmt.Errorf("error storing pricing override: %w", err)
+		}
+	}
+	c.cache.setPricing(userID, override)
+	return nil
+}
@@ -0,0 +1,122 @@
+package firebase
+
+import (
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCalculatePointsCostForOverride(t *testing.T) {
+	override := &PricingOverride{
+		Rates:      map[string]ModelRates{"claude-3-opus-20240229": {Input: 10, Output: 50}},
+		Multiplier: 0.5,
+		ContractID: "acme-2026",
+	}
+
+	// Contracted rates apply to the models they name, aliases included
+	assert.Equal(t, 60, CalculatePointsCostFor("opus", 1000, 1000, override))
+	rates, applied := PricingFor("opus", override)
+	assert.Equal(t, ModelRates{Input: 10, Output: 50}, rates)
+	assert.Equal(t, &AppliedPricing{ContractID: "acme-2026", Input: 10, Output: 50}, applied)
+
+	// Other models get the multiplier on the public rates
+	assert.Equal(t, 9, CalculatePointsCostFor("claude-3-5-sonnet-20241022", 1000, 1000, override))
+	_, applied = PricingFor("claude-3-5-sonnet-20241022", override)
+	assert.Equal(t, &AppliedPricing{ContractID: "acme-2026", Input: 1.5, Output: 7.5, Multiplier: 0.5}, applied)
+
+	// Unknown models fall back to the default model's rates
+	assert.Equal(t,
+		CalculatePointsCostFor(DefaultModel, 1000, 1000, override),
+		CalculatePointsCostFor("unreleased-model", 1000, 1000, override))
+
+	// The minimum charge still applies
+	assert.Equal(t, 1, CalculatePointsCostFor("opus", 0, 0, override))
+
+	// Without an override the public rates apply
+	assert.Equal(t, CalculatePointsCost("opus", 1000, 1000), CalculatePointsCostFor("opus", 1000, 1000, nil))
+	_, applied = PricingFor("opus", nil)
+	assert.Nil(t, applied)
+
+	// Rates alone leave other models at the public rates
+	ratesOnly := &PricingOverride{Rates: override.Rates}
+	assert.Equal(t, CalculatePointsCost("haiku", 5000, 5000), CalculatePointsCostFor("haiku", 5000, 5000, ratesOnly))
+}
+
+func TestPricingOverrideValidate(t *testing.T) {
+	assert.NoError(t, (&PricingOverride{Multiplier: 0.8}).Validate())
+	assert.NoError(t, (&PricingOverride{Rates: map[string]ModelRates{"claude-3-5-haiku-20241022": {Input: 0.5, Output: 2}}}).Validate())
+
+	assert.Error(t, (&PricingOverride{}).Validate())
+	assert.Error(t, (&PricingOverride{Multiplier: -1}).Validate())
+	assert.Error(t, (&PricingOverride{Multiplier: math.Inf(1)}).Validate())
+	assert.Error(t, (&PricingOverride{Rates: map[string]ModelRates{"claude-3.5": {Input: 1, Output: 1}}}).Validate())
+	assert.Error(t, (&PricingOverride{Rates: map[string]ModelRates{"haiku": {Input: -1, Output: 1}}}).Validate())
+}
+
+func TestBalanceCachePricing(t *testing.T) {
+	cache := &balanceCache{ttl: defaultBalanceCacheTTL, entries: make(map[string]*balanceEntry)}
+	_, ok := cache.getPricing("u1")
+	assert.False(t, ok)
+
+	// Users without an override are cached too
+	cache.setPricing("u1", nil)
+	override, ok := cache.getPricing("u1")
+	assert.True(t, ok)
+	assert.Nil(t, override)
+
+	cache.setPricing("u1", &PricingOverride{Multiplier: 0.5})
+	override, ok = cache.getPricing("u1")
+	assert.True(t, ok)
+	assert.Equal(t, 0.5, override.Multiplier)
+}
+
+func TestPointsCostRounding(t *testing.T) {
+	haiku := ModelRates{Input: 0.8, Output: 4}
+	sonnet := ModelRates{Input: 3, Output: 15}
+	opus := ModelRates{Input: 15, Output: 75}
+
+	tests := []struct {
+		name                          string
+		rates                         ModelRates
+		input, output                 int
+		ceil, halfUp, floor, halfEven int
+	}{
+		{"exact", sonnet, 1500, 100, 6, 6, 6, 6},
+		{"below minimum", haiku, 1000, 0, 1, 1, 1, 1},
+		{"nothing", opus, 0, 0, 1, 1, 1, 1},
+		{"quarter", opus, 100, 10, 3, 2, 2, 2},
+		{"just under half", sonnet, 833, 0, 3, 2, 2, 2},
+		{"half to even", haiku, 0, 2125, 9, 9, 8, 8},
+		{"half to odd", sonnet, 0, 500, 8, 8, 7, 8},
+		{"just over a point", opus, 1000, 1, 16, 15, 15, 15},
+		{"large", opus, 200_000, 4096, 3308, 3307, 3307, 3307},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.ceil, pointsCostRounded(tt.rates, tt.input, tt.output, RoundCeil))
+			assert.Equal(t, tt.halfUp, pointsCostRounded(tt.rates, tt.input, tt.output, RoundHalfUp))
+			assert.Equal(t, tt.floor, pointsCostRounded(tt.rates, tt.input, tt.output, RoundFloor))
+			assert.Equal(t, tt.halfEven, pointsCostRounded(tt.rates, tt.input, tt.output, RoundHalfEven))
+		})
+	}
+
+	// Multiplied rates carry float error, e.g. 0.1*3 = 0.30000000000000004,
+	// which fixed point drops instead of rounding up a whole point
+	multiplier := 3.0
+	drifted := ModelRates{Input: 0.1 * multiplier}
+	assert.Equal(t, 3, pointsCostRounded(drifted, 10_000, 0, RoundCeil))
+}
+
+func TestParseRoundingMode(t *testing.T) {
+	mode, err := ParseRoundingMode(" Half_Even ")
+	assert.NoError(t, err)
+	assert.Equal(t, RoundHalfEven, mode)
+	_, err = ParseRoundingMode("bankers")
+	assert.Error(t, err)
+
+	t.Setenv("POINTS_ROUNDING", "floor")
+	assert.Equal(t, RoundFloor, roundingModeFromEnv())
+	t.Setenv("POINTS_ROUNDING", "sideways")
+	assert.Equal(t, RoundCeil, roundingModeFromEnv())
+}
@@ -0,0 +1,38 @@
+package firebase
+
+import (
+	"crypto/rand"
+	"time"
+)
+
+// pushIDChars is the alphabet Firebase uses for push IDs, in ASCII order so
+// that keys sort chronologically
+const pushIDChars = "-0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZ_abcdefghijklmnopqrstuvwxyz"
+
+// newPushID generates a key in the same format as Firebase push IDs: eight
+// characters of millisecond timestamp followed by twelve random characters.
+// Keys created locally therefore order alongside server-generated ones.
+func newPushID(t time.Time) string {
+	id := make([]byte, 20)
+	copy(id, pushIDTimePrefix(t))
+
+	random := make([]byte, 12)
+	_, _ = rand.Read(random)
+	for i, b := range random {
+		id[8+i] = pushIDChars[b%64]
+	}
+
+	return string(id)
+}
+
+// pushIDTimePrefix encodes t as the eight character timestamp prefix of a
+// push ID, usable as a key range bound
+func pushIDTimePrefix(t time.Time) string {
+	prefix := make([]byte, 8)
+	ms := t.UnixMilli()
+	for i := 7; i >= 0; i-- {
+		prefix[i] = pushIDChars[ms%64]
+		ms /= 64
+	}
+	return string(prefix)
+}
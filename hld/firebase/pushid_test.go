@@ -0,0 +1,34 @@
+package firebase
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewPushIDOrdersChronologically(t *testing.T) {
+	earlier := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	later := earlier.Add(time.Millisecond)
+
+	a := newPushID(earlier)
+	b := newPushID(later)
+
+	assert.Len(t, a, 20)
+	assert.Less(t, a, b)
+	assert.Equal(t, pushIDTimePrefix(earlier), a[:8])
+}
+
+func TestUsageFilterMatches(t *testing.T) {
+	now := time.Now()
+	log := UsageLog{UserID: "u1", Model: "m1", Success: true, Timestamp: now}
+
+	assert.True(t, UsageFilter{}.matches(log))
+	assert.True(t, UsageFilter{UserID: "u1", Model: "m1", SuccessOnly: true}.matches(log))
+	assert.False(t, UsageFilter{UserID: "u2"}.matches(log))
+	assert.False(t, UsageFilter{From: now.Add(time.Second)}.matches(log))
+	assert.False(t, UsageFilter{To: now.Add(-time.Second)}.matches(log))
+
+	log.Success = false
+	assert.False(t, UsageFilter{SuccessOnly: true}.matches(log))
+}
@@ -0,0 +1,183 @@
+package firebase
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"firebase.google.com/go/v4/db"
+)
+
+const (
+	// defaultRequestCounterThreshold is how many buffered increments trigger
+	// a flush ahead of the interval
+	defaultRequestCounterThreshold = 500
+	// requestCounterFinalFlushTimeout bounds the flush after Run's context
+	// ends
+	requestCounterFinalFlushTimeout = 10 * time.Second
+)
+
+// requestCountWriter adds buffered per-day counts to a user's counters
+type requestCountWriter func(ctx context.Context, userID string, days map[string]int) error
+
+// RequestCounter batches requests_by_day increments in memory and writes
+// them every flush interval, or sooner once threshold increments are
+// buffered, with one transaction per user. Counts read back may lag by up
+// to an interval. A nil RequestCounter buffers nothing.
+type RequestCounter struct {
+	write     requestCountWriter
+	interval  time.Duration
+	threshold int
+	// full wakes Run when the threshold is reached
+	full chan struct{}
+
+	mu       sync.Mutex
+	pending  map[string]map[string]int
+	buffered int
+}
+
+// NewRequestCounterFromEnv creates a counter for client when
+// REQUEST_COUNTER_FLUSH_INTERVAL is set, flushing at that interval or every
+// REQUEST_COUNTER_FLUSH_THRESHOLD increments (default 500). It returns nil,
+// leaving every request to write its own increment, otherwise.
+func NewRequestCounterFromEnv(client *Client) *RequestCounter {
+	if os.Getenv("REQUEST_COUNTER_FLUSH_INTERVAL") == "" {
+		return nil
+	}
+	interval := envDuration("REQUEST_COUNTER_FLUSH_INTERVAL", defaultUsageLogFlushInterval)
+	threshold := envInt("REQUEST_COUNTER_FLUSH_THRESHOLD", defaultRequestCounterThreshold)
+	slog.Info("request counter batching enabled", "flush_interval", interval, "flush_threshold", threshold)
+	return newRequestCounter(client.addRequestsByDay, interval, threshold)
+}
+
+func newRequestCounter(write requestCountWriter, interval time.Duration, threshold int) *RequestCounter {
+	return &RequestCounter{
+		write:     write,
+		interval:  interval,
+		threshold: threshold,
+		full:      make(chan struct{}, 1),
+		pending:   make(map[string]map[string]int),
+	}
+}
+
+// SetRequestCounter buffers the request counts this client logs in rc, or
+// writes each one immediately when rc is nil. It must be set before the
+// client is shared.
+func (c *Client) SetRequestCounter(rc *RequestCounter) {
+	c.counter = rc
+}
+
+// countRequests adds n to the user's request counter for day, through the
+// request counter when one is set
+func (c *Client) countRequests(ctx context.Context, userID, day string, n int) error {
+	if c.counter != nil {
+		c.counter.Add(userID, day, n)
+		return nil
+	}
+	return c.incrementRequestsByDay(ctx, userID, day, n)
+}
+
+// addRequestsByDay adds each day's count to the user's request counters in
+// a single transaction
+func (c *Client) addRequestsByDay(ctx context.Context, userID string, days map[string]int) error {
+	ref := c.db.NewRef(userPath(userID) + "/requests_by_day")
+	return ref.Transaction(ctx, func(tn db.TransactionNode) (interface{}, error) {
+		var counts map[string]int
+		if err := tn.Unmarshal(&counts); err != nil || counts == nil {
+			counts = make(map[string]int, len(days))
+		}
+		for day, n := range days {
+			counts[day] += n
+		}
+		return counts, nil
+	})
+}
+
+// Add buffers n requests by userID on day for the next flush
+func (rc *RequestCounter) Add(userID, day string, n int) {
+	if rc == nil || n <= 0 {
+		return
+	}
+	rc.mu.Lock()
+	rc.merge(userID, day, n)
+	full := rc.buffered >= rc.threshold
+	rc.mu.Unlock()
+
+	if full {
+		select {
+		case rc.full <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// merge adds to the buffered counts; rc.mu must be held
+func (rc *RequestCounter) merge(userID, day string, n int) {
+	days := rc.pending[userID]
+	if days == nil {
+		days = make(map[string]int)
+		rc.pending[userID] = days
+	}
+	days[day] += n
+	rc.buffered += n
+}
+
+// Flush writes the buffered counts. Counts that fail to write are kept for
+// the next flush; the first error is returned.
+func (rc *RequestCounter) Flush(ctx context.Context) error {
+	if rc == nil {
+		return nil
+	}
+	rc.mu.Lock()
+	batch := rc.pending
+	rc.pending = make(map[string]map[string]int)
+	rc.buffered = 0
+	rc.mu.Unlock()
+
+	var firstErr error
+	for userID, days := range batch {
+		err := rc.write(ctx, userID, days)
+		if err == nil {
+			continue
+		}
+		if firstErr == nil {
+			firstErr = fmt.Errorf("error updating request counter for %s: %w", userID, err)
+		}
+		rc.mu.Lock()
+		for day, n := range days {
+			rc.merge(userID, day, n)
+		}
+		rc.mu.Unlock()
+	}
+	return firstErr
+}
+
+// Run flushes every flush interval, and whenever the threshold is reached,
+// until ctx is cancelled, then flushes once more
+func (rc *RequestCounter) Run(ctx context.Context) {
+	if rc == nil {
+		return
+	}
+	ticker := time.NewTicker(rc.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-rc.full:
+		case <-ctx.Done():
+			flushCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), requestCounterFinalFlushTimeout)
+			if err := rc.Flush(flushCtx); err != nil {
+				slog.Error("failed to flush request counters on shutdown", "error", err)
+			}
+			cancel()
+			return
+		}
+		if err := rc.Flush(ctx); err != nil {
+			slog.Error("failed to flush request counters", "error", err)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package firebase
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// memoryCounts collects flushed request counts, failing while fail is set
+type memoryCounts struct {
+	mu     sync.Mutex
+	counts map[string]map[string]int
+	writes int
+	fail   error
+}
+
+func (m *memoryCounts) write(ctx context.Context, userID string, days map[string]int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.fail != nil {
+		return m.fail
+	}
+	if m.counts == nil {
+		m.counts = make(map[string]map[string]int)
+	}
+	if m.counts[userID] == nil {
+		m.counts[userID] = make(map[string]int)
+	}
+	for day, n := range days {
+		m.counts[userID][day] += n
+	}
+	m.writes++
+	return nil
+}
+
+func (m *memoryCounts) get(userID, day string) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.counts[userID][day]
+}
+
+func TestRequestCounterFlushWritesOncePerUser(t *testing.T) {
+	store := &memoryCounts{}
+	rc := newRequestCounter(store.write, time.Hour, 1000)
+
+	rc.Add("u1", "2026-01-01", 1)
+	rc.Add("u1", "2026-01-01", 2)
+	rc.Add("u1", "2026-01-02", 1)
+	rc.Add("u2", "2026-01-02", 4)
+	rc.Add("u2", "2026-01-02", 0)
+
+	require.NoError(t, rc.Flush(context.Background()))
+	assert.Equal(t, 2, store.writes)
+	assert.Equal(t, 3, store.get("u1", "2026-01-01"))
+	assert.Equal(t, 1, store.get("u1", "2026-01-02"))
+	assert.Equal(t, 4, store.get("u2", "2026-01-02"))
+
+	// Nothing is written twice
+	require.NoError(t, rc.Flush(context.Background()))
+	assert.Equal(t, 2, store.writes)
+}
+
+func TestRequestCounterKeepsCountsAfterFailedFlush(t *testing.T) {
+	store := &memoryCounts{fail: errors.New("unavailable")}
+	rc := newRequestCounter(store.write, time.Hour, 1000)
+
+	rc.Add("u1", "2026-01-01", 2)
+	assert.Error(t, rc.Flush(context.Background()))
+	rc.Add("u1", "2026-01-01", 1)
+
+	store.fail = nil
+	require.NoError(t, rc.Flush(context.Background()))
+	assert.Equal(t, 3, store.get("u1", "2026-01-01"))
+}
+
+func TestRequestCounterConcurrentAdds(t *testing.T) {
+	store := &memoryCounts{}
+	rc := newRequestCounter(store.write, time.Millisecond, 7)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		rc.Run(ctx)
+		close(done)
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				rc.Add("u1", "2026-01-01", 1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Cancelling Run flushes whatever is still buffered
+	cancel()
+	<-done
+	assert.Equal(t, 1000, store.get("u1", "2026-01-01"))
+}
+
+func TestRequestCounterFlushesAtThreshold(t *testing.T) {
+	store := &memoryCounts{}
+	rc := newRequestCounter(store.write, time.Hour, 3)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go rc.Run(ctx)
+
+	rc.Add("u1", "2026-01-01", 3)
+	assert.Eventually(t, func() bool {
+		return store.get("u1", "2026-01-01") == 3
+	}, time.Second, time.Millisecond)
+}
+
+func TestRequestCounterFromEnv(t *testing.T) {
+	t.Setenv("REQUEST_COUNTER_FLUSH_INTERVAL", "")
+	assert.Nil(t, NewRequestCounterFromEnv(&Client{}))
+
+	t.Setenv("REQUEST_COUNTER_FLUSH_INTERVAL", "5s")
+	t.Setenv("REQUEST_COUNTER_FLUSH_THRESHOLD", "20")
+	rc := NewRequestCounterFromEnv(&Client{})
+	require.NotNil(t, rc)
+	assert.Equal(t, 5*time.Second, rc.interval)
+	assert.Equal(t, 20, rc.threshold)
+
+	// A nil counter buffers nothing
+	var none *RequestCounter
+	none.Add("u1", "2026-01-01", 1)
+	assert.NoError(t, none.Flush(context.Background()))
+}
@@ -0,0 +1,50 @@
+package firebase
+
+import (
+	"context"
+	"fmt"
+)
+
+// DeductOption changes how DeductPoints spends a balance
+type DeductOption func(*deductOptions)
+
+type deductOptions struct {
+	force bool
+}
+
+// ForceDeduct lets DeductPoints spend the user's reserved points. Only
+// explicit high-priority callers should use it; normal API traffic must not.
+func ForceDeduct() DeductOption {
+	return func(o *deductOptions) {
+		o.force = true
+	}
+}
+
+// spendablePoints returns the points normal traffic may spend: the balance
+// minus the user's reserve, never below zero
+func (u *UserData) spendablePoints() int {
+	return max(u.Points-u.ReservedPoints, 0)
+}
+
+// SetReservedPoints sets how many of the user's points are earmarked for
+// forced deductions. The reserve may exceed the balance, in which case none
+// of it is spendable by normal traffic. Returns ErrUserNotFound for unknown
+// users.
+func (c *Client) SetReservedPoints(ctx context.Context, userID string, reserved int) (err error) {
+	defer c.observe("SetReservedPoints", c.opStart(), &err)
+	if reserved < 0 {
+		return fmt.Errorf("invalid reserved points: %d", reserved)
+	}
+
+	_, err = c.updateUser(ctx, userID, func(user *UserData) error {
+		user.ReservedPoints = reserved
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// The cached account carries the old reserve
+	c.cache.invalidate(userID)
+	return nil
+}
@@ -0,0 +1,34 @@
+package firebase
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSpendablePoints(t *testing.T) {
+	assert.Equal(t, 30, (&UserData{Points: 100, ReservedPoints: 70}).spendablePoints())
+	assert.Equal(t, 100, (&UserData{Points: 100}).spendablePoints())
+
+	// A reserve larger than the balance leaves nothing spendable
+	assert.Equal(t, 0, (&UserData{Points: 50, ReservedPoints: 70}).spendablePoints())
+	assert.Equal(t, 0, (&UserAccount{Points: 50, ReservedPoints: 70}).SpendablePoints())
+}
+
+func TestSettleHoldKeepsReserve(t *testing.T) {
+	now := time.Now()
+	user := &UserData{
+		Points:         50,
+		ReservedPoints: 40,
+		Holds: map[string]PointsHold{
+			"h1": {Amount: 20, CreatedAt: now, ExpiresAt: now.Add(time.Hour)},
+		},
+	}
+
+	// Only the 10 unreserved points cover the overage
+	require.NoError(t, user.settleHold("h1", 100, now))
+	assert.Equal(t, 40, user.Points)
+	assert.Equal(t, 30, user.TotalUsed)
+}
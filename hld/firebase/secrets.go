@@ -0,0 +1,114 @@
+package firebase
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+
+	secretmanager "google.golang.org/api/secretmanager/v1"
+)
+
+// secretVars are the variables that may be read from Secret Manager
+var secretVars = map[string]bool{
+	"FIREBASE_PRIVATE_KEY":  true,
+	"FIREBASE_CLIENT_EMAIL": true,
+	"FIREBASE_PROJECT_ID":   true,
+}
+
+// secretFetcher returns the payload of a Secret Manager secret version
+type secretFetcher func(ctx context.Context, name string) (string, error)
+
+// NewClientFromSecretManager creates a single-tenant client whose
+// credentials are read from GCP Secret Manager rather than the process
+// environment, where they would show up in process listings.
+//
+// FIREBASE_SECRET_NAMES_JSON maps variable names to secret resource names,
+// e.g. {"FIREBASE_PRIVATE_KEY": "projects/p/secrets/firebase-key"}; names
+// without a version read the latest one. FIREBASE_PRIVATE_KEY,
+// FIREBASE_CLIENT_EMAIL and FIREBASE_PROJECT_ID may be mapped. Secret
+// Manager is reached with Application Default Credentials. Variables that
+// aren't mapped, or whose secret can't be read, fall back to the
+// environment, as does everything if Secret Manager is unavailable.
+func NewClientFromSecretManager(ctx context.Context) (*Client, error) {
+	names, err := secretNamesFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	if len(names) == 0 {
+		return NewClientFromEnv(ctx)
+	}
+
+	svc, err := secretmanager.NewService(ctx)
+	if err != nil {
+		slog.Warn("secret manager unavailable, using environment variables", "error", err)
+		return NewClientFromEnv(ctx)
+	}
+	fetch := func(ctx context.Context, name string) (string, error) {
+		resp, err := svc.Projects.Secrets.Versions.Access(name).Context(ctx).Do()
+		if err != nil {
+			return "", err
+		}
+		data, err := base64.StdEncoding.DecodeString(resp.Payload.Data)
+		if err != nil {
+			return "", fmt.Errorf("error decoding secret payload: %w", err)
+		}
+		return string(data), nil
+	}
+
+	cfg, err := configFromSecrets(ctx, names, fetch)
+	if err != nil {
+		return nil, err
+	}
+	return NewClient(ctx, cfg)
+}
+
+// secretNamesFromEnv parses FIREBASE_SECRET_NAMES_JSON, rejecting variables
+// that can't be read from Secret Manager
+func secretNamesFromEnv() (map[string]string, error) {
+	raw := os.Getenv("FIREBASE_SECRET_NAMES_JSON")
+	if raw == "" {
+		return nil, nil
+	}
+
+	var names map[string]string
+	if err := json.Unmarshal([]byte(raw), &names); err != nil {
+		return nil, fmt.Errorf("error parsing FIREBASE_SECRET_NAMES_JSON: %w", err)
+	}
+	for key, name := range names {
+		if !secretVars[key] {
+			return nil, fmt.Errorf("FIREBASE_SECRET_NAMES_JSON: %s can't be read from Secret Manager", key)
+		}
+		if !strings.Contains(name, "/versions/") {
+			names[key] = name + "/versions/latest"
+		}
+	}
+	return names, nil
+}
+
+// configFromSecrets builds a project configuration from the secrets in
+// names, falling back to the environment for anything they don't provide
+func configFromSecrets(ctx context.Context, names map[string]string, fetch secretFetcher) (Config, error) {
+	values := make(map[string]string, len(names))
+	for key, name := range names {
+		value, err := fetch(ctx, name)
+		if err != nil {
+			slog.Warn("failed to read secret, using environment variable",
+				"variable", key,
+				"secret", name,
+				"error", err)
+			continue
+		}
+		values[key] = strings.TrimSpace(value)
+	}
+
+	return configFromLookup(func(key string) string {
+		if value, ok := values[key]; ok {
+			return value
+		}
+		return os.Getenv(key)
+	})
+}
@@ -0,0 +1,56 @@
+package firebase
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSecretNamesFromEnv(t *testing.T) {
+	t.Setenv("FIREBASE_SECRET_NAMES_JSON", `{
+		"FIREBASE_PRIVATE_KEY": "projects/p/secrets/key",
+		"FIREBASE_CLIENT_EMAIL": "projects/p/secrets/email/versions/3"
+	}`)
+	names, err := secretNamesFromEnv()
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"FIREBASE_PRIVATE_KEY":  "projects/p/secrets/key/versions/latest",
+		"FIREBASE_CLIENT_EMAIL": "projects/p/secrets/email/versions/3",
+	}, names)
+
+	t.Setenv("FIREBASE_SECRET_NAMES_JSON", `{"FIREBASE_DATABASE_URL": "projects/p/secrets/url"}`)
+	_, err = secretNamesFromEnv()
+	assert.Error(t, err)
+
+	t.Setenv("FIREBASE_SECRET_NAMES_JSON", "")
+	names, err = secretNamesFromEnv()
+	require.NoError(t, err)
+	assert.Empty(t, names)
+}
+
+func TestConfigFromSecretsFallsBackToEnv(t *testing.T) {
+	t.Setenv("FIREBASE_PROJECT_ID", "env-project")
+	t.Setenv("FIREBASE_PRIVATE_KEY", "env-key")
+	t.Setenv("FIREBASE_CLIENT_EMAIL", "env@example.com")
+
+	names := map[string]string{
+		"FIREBASE_PRIVATE_KEY":  "projects/p/secrets/key/versions/latest",
+		"FIREBASE_CLIENT_EMAIL": "projects/p/secrets/email/versions/latest",
+	}
+	fetch := func(_ context.Context, name string) (string, error) {
+		if name == names["FIREBASE_PRIVATE_KEY"] {
+			return "secret-key\n", nil
+		}
+		return "", errors.New("permission denied")
+	}
+
+	cfg, err := configFromSecrets(context.Background(), names, fetch)
+	require.NoError(t, err)
+	assert.Equal(t, "secret-key", cfg.PrivateKey)
+	// The unreadable secret and the unmapped variable come from the environment
+	assert.Equal(t, "env@example.com", cfg.ClientEmail)
+	assert.Equal(t, "env-project", cfg.ProjectID)
+}
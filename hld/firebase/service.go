@@ -0,0 +1,28 @@
+package firebase
+
+import "os"
+
+// serviceAccountClaim is the custom claim marking a user as an internal
+// service account, such as a monitoring probe, that is never billed
+const serviceAccountClaim = "service_account"
+
+// hasServiceAccountClaim reports whether token claims mark a service account
+func hasServiceAccountClaim(claims map[string]interface{}) bool {
+	service, _ := claims[serviceAccountClaim].(bool)
+	return service
+}
+
+// serviceUsageNodeFromEnv reads SERVICE_USAGE_LOG_NODE, the node service
+// account usage is logged to instead of usage_logs
+func serviceUsageNodeFromEnv() string {
+	return os.Getenv("SERVICE_USAGE_LOG_NODE")
+}
+
+// usageLogNode returns the node a usage log is written to. Service account
+// usage goes to its own node when one is configured.
+func (c *Client) usageLogNode(log UsageLog) string {
+	if log.Service && c.serviceLogNode != "" {
+		return c.serviceLogNode
+	}
+	return "usage_logs"
+}
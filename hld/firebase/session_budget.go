@@ -0,0 +1,108 @@
+package firebase
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"firebase.google.com/go/v4/db"
+)
+
+// BudgetExhausted reports whether the session has a point budget and has
+// spent all of it
+func (s *SessionRecord) BudgetExhausted() bool {
+	return s.PointBudget != nil && s.PointsSpent >= *s.PointBudget
+}
+
+// SetSessionBudget sets the point budget of a session owned by userID, or
+// removes it when budget is nil. Points already spent are kept, so lowering
+// the budget below them stops the session at once. Fails with
+// ErrSessionNotFound or, if userID doesn't own the session,
+// ErrSessionOwnerChanged.
+func (c *Client) SetSessionBudget(ctx context.Context, sessionID, userID string, budget *int) (_ *SessionRecord, err error) {
+	defer c.observe("SetSessionBudget", c.opStart(), &err)
+	if budget != nil && *budget < 0 {
+		return nil, fmt.Errorf("invalid point budget: %d", *budget)
+	}
+
+	var updated SessionRecord
+	err = c.updateSession(ctx, sessionID, func(session map[string]interface{}) error {
+		if owner, _ := session["user_id"].(string); owner != userID {
+			return ErrSessionOwnerChanged
+		}
+		if budget == nil {
+			delete(session, "point_budget")
+		} else {
+			session["point_budget"] = *budget
+		}
+		return nil
+	}, &updated)
+	if err != nil {
+		return nil, err
+	}
+	return &updated, nil
+}
+
+// AddSessionSpend adds points to a session's spend and returns the updated
+// record. Fails with ErrSessionNotFound for unknown sessions.
+func (c *Client) AddSessionSpend(ctx context.Context, sessionID string, points int) (_ *SessionRecord, err error) {
+	defer c.observe("AddSessionSpend", c.opStart(), &err)
+	var updated SessionRecord
+	err = c.updateSession(ctx, sessionID, func(session map[string]interface{}) error {
+		addSpend(session, points)
+		return nil
+	}, &updated)
+	if err != nil {
+		return nil, err
+	}
+	return &updated, nil
+}
+
+// addSpend adds points to a raw session node's points_spent
+func addSpend(session map[string]interface{}, points int) {
+	var spent int
+	switch v := session["points_spent"].(type) {
+	case float64:
+		// As decoded from the database
+		spent = int(v)
+	case int:
+		spent = v
+	}
+	session["points_spent"] = spent + points
+}
+
+// updateSession applies fn to a session in a transaction and decodes the
+// result into out. The session is handled as a map so fields this package
+// doesn't know about are kept.
+func (c *Client) updateSession(ctx context.Context, sessionID string, fn func(session map[string]interface{}) error, out *SessionRecord) error {
+	ref := c.db.NewRef(fmt.Sprintf("sessions/%s", sessionID))
+
+	var result map[string]interface{}
+	err := ref.Transaction(ctx, func(tn db.TransactionNode) (interface{}, error) {
+		var session map[string]interface{}
+		if err := tn.Unmarshal(&session); err != nil || session == nil {
+			return nil, ErrSessionNotFound
+		}
+		if err := fn(session); err != nil {
+			return nil, err
+		}
+		result = session
+		return session, nil
+	})
+	if err != nil {
+		return err
+	}
+	return decodeSession(result, out)
+}
+
+// decodeSession converts a raw session node into a SessionRecord
+func decodeSession(raw map[string]interface{}, out *SessionRecord) error {
+	data, err := json.Marshal(raw)
+	if err != nil {
+		return fmt.Errorf("error encoding session: %w", err)
+	}
+	if err := json.Unmarshal(data, out); err != nil {
+		return fmt.Errorf("error decoding session: %w", err)
+	}
+	return nil
+}
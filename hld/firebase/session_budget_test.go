@@ -0,0 +1,38 @@
+package firebase
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSessionBudgetReachesCap(t *testing.T) {
+	// A session node as read from the database, with a budget of 10
+	raw := map[string]interface{}{
+		"user_id":      "user-1",
+		"status":       "active",
+		"point_budget": float64(10),
+		"title":        "kept as is",
+	}
+
+	var session SessionRecord
+	for i := 0; i < 3; i++ {
+		addSpend(raw, 3)
+		require.NoError(t, decodeSession(raw, &session))
+		assert.False(t, session.BudgetExhausted(), "spent %d", session.PointsSpent)
+	}
+
+	addSpend(raw, 3)
+	require.NoError(t, decodeSession(raw, &session))
+	assert.Equal(t, 12, session.PointsSpent)
+	assert.True(t, session.BudgetExhausted())
+	assert.Equal(t, "kept as is", raw["title"])
+}
+
+func TestBudgetExhaustedWithoutBudget(t *testing.T) {
+	assert.False(t, (&SessionRecord{PointsSpent: 1000}).BudgetExhausted())
+
+	zero := 0
+	assert.True(t, (&SessionRecord{PointBudget: &zero}).BudgetExhausted())
+}
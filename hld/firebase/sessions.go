@@ -0,0 +1,246 @@
+package firebase
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"time"
+
+	"firebase.google.com/go/v4/db"
+)
+
+// Session statuses
+const (
+	SessionStatusActive  = "active"
+	SessionStatusExpired = "expired"
+)
+
+// activeSessionWindow is how recently a session must have been active to be
+// counted by GetActiveSessionCount
+const activeSessionWindow = 5 * time.Minute
+
+// SessionRecord represents a session entry in the sessions node
+type SessionRecord struct {
+	// ID is the session's key, populated only when listing sessions
+	ID             string    `json:"id,omitempty"`
+	UserID         string    `json:"user_id"`
+	Status         string    `json:"status"`
+	LastActivityAt time.Time `json:"last_activity_at"`
+	// PointBudget optionally caps the points the session may spend
+	PointBudget *int `json:"point_budget,omitempty"`
+	// PointsSpent is the points charged to the session so far
+	PointsSpent int `json:"points_spent,omitempty"`
+}
+
+// GetActiveSessionCount returns the number of sessions with status "active"
+// that have seen activity within the last five minutes.
+// Requires an ".indexOn": ["status"] rule on the sessions node.
+func (c *Client) GetActiveSessionCount(ctx context.Context) (_ int, err error) {
+	defer c.observe("GetActiveSessionCount", c.opStart(), &err)
+	var sessions map[string]SessionRecord
+	if err := c.db.NewRef("sessions").OrderByChild("status").EqualTo(SessionStatusActive).Get(ctx, &sessions); err != nil {
+		return 0, fmt.Errorf("error querying active sessions: %w", err)
+	}
+
+	cutoff := time.Now().Add(-activeSessionWindow)
+	count := 0
+	for _, s := range sessions {
+		if s.LastActivityAt.After(cutoff) {
+			count++
+		}
+	}
+
+	return count, nil
+}
+
+// SessionTransfer records a change of session ownership
+type SessionTransfer struct {
+	SessionID     string    `json:"session_id"`
+	FromUserID    string    `json:"from_user_id"`
+	ToUserID      string    `json:"to_user_id"`
+	TransferredBy string    `json:"transferred_by,omitempty"`
+	TransferredAt time.Time `json:"transferred_at"`
+}
+
+// GetSession retrieves a session record
+func (c *Client) GetSession(ctx context.Context, sessionID string) (_ *SessionRecord, err error) {
+	defer c.observe("GetSession", c.opStart(), &err)
+	ref := c.db.NewRef(fmt.Sprintf("sessions/%s", sessionID))
+
+	var session SessionRecord
+	if err := ref.Get(ctx, &session); err != nil {
+		return nil, fmt.Errorf("error getting session: %w", err)
+	}
+	if session.UserID == "" && session.Status == "" {
+		return nil, ErrSessionNotFound
+	}
+
+	return &session, nil
+}
+
+// TransferSession moves a session from one user to another and records the
+// transfer in the session_transfers node. Usage already logged against the
+// session stays billed to the previous owner; only future requests are
+// charged to the new owner. The transfer fails with ErrSessionOwnerChanged if
+// the session no longer belongs to fromUserID.
+func (c *Client) TransferSession(ctx context.Context, sessionID, fromUserID, toUserID, transferredBy string) (_ *SessionTransfer, err error) {
+	defer c.observe("TransferSession", c.opStart(), &err)
+	ref := c.db.NewRef(fmt.Sprintf("sessions/%s", sessionID))
+
+	err = ref.Transaction(ctx, func(tn db.TransactionNode) (interface{}, error) {
+		var session map[string]interface{}
+		if err := tn.Unmarshal(&session); err != nil || session == nil {
+			return nil, ErrSessionNotFound
+		}
+		if owner, _ := session["user_id"].(string); owner != fromUserID {
+			return nil, ErrSessionOwnerChanged
+		}
+
+		session["user_id"] = toUserID
+		return session, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	transfer := &SessionTransfer{
+		SessionID:     sessionID,
+		FromUserID:    fromUserID,
+		ToUserID:      toUserID,
+		TransferredBy: transferredBy,
+		TransferredAt: time.Now(),
+	}
+	if _, err := c.db.NewRef("session_transfers").Push(ctx, transfer); err != nil {
+		return transfer, fmt.Errorf("session transferred but failed to record transfer: %w", err)
+	}
+
+	return transfer, nil
+}
+
+// TransitionSessionStatus moves a session from status from to status to in a
+// transaction. It fails with ErrSessionStatusChanged if the session's status
+// is no longer from.
+func (c *Client) TransitionSessionStatus(ctx context.Context, sessionID, from, to string) (err error) {
+	defer c.observe("TransitionSessionStatus", c.opStart(), &err)
+	ref := c.db.NewRef(fmt.Sprintf("sessions/%s", sessionID))
+
+	return ref.Transaction(ctx, func(tn db.TransactionNode) (interface{}, error) {
+		var session map[string]interface{}
+		if err := tn.Unmarshal(&session); err != nil || session == nil {
+			return nil, ErrSessionNotFound
+		}
+		if err := transitionStatus(session, from, to); err != nil {
+			return nil, err
+		}
+		return session, nil
+	})
+}
+
+// transitionStatus sets a raw session node's status to to if it is from
+func transitionStatus(session map[string]interface{}, from, to string) error {
+	if status, _ := session["status"].(string); status != from {
+		return ErrSessionStatusChanged
+	}
+	session["status"] = to
+	return nil
+}
+
+// ExpireInactiveSessions moves active sessions that have seen no activity
+// for idle to "expired", and returns how many were expired. Sessions whose
+// status changed in the meantime are left alone.
+// Requires an ".indexOn": ["status"] rule on the sessions node.
+func (c *Client) ExpireInactiveSessions(ctx context.Context, idle time.Duration) (_ int, err error) {
+	defer c.observe("ExpireInactiveSessions", c.opStart(), &err)
+	var sessions map[string]SessionRecord
+	if err := c.db.NewRef("sessions").OrderByChild("status").EqualTo(SessionStatusActive).Get(ctx, &sessions); err != nil {
+		return 0, fmt.Errorf("error querying active sessions: %w", err)
+	}
+
+	expired := 0
+	var firstErr error
+	for _, sessionID := range inactiveSessions(sessions, time.Now().Add(-idle)) {
+		if err := ctx.Err(); err != nil {
+			return expired, err
+		}
+
+		err := c.TransitionSessionStatus(ctx, sessionID, SessionStatusActive, SessionStatusExpired)
+		if errors.Is(err, ErrSessionStatusChanged) || errors.Is(err, ErrSessionNotFound) {
+			continue
+		}
+		if err != nil {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("error expiring session %s: %w", sessionID, err)
+			}
+			continue
+		}
+
+		slog.Debug("session expired", "session_id", sessionID, "last_activity_at", sessions[sessionID].LastActivityAt)
+		expired++
+	}
+
+	return expired, firstErr
+}
+
+// inactiveSessions returns the IDs of sessions last active before cutoff
+func inactiveSessions(sessions map[string]SessionRecord, cutoff time.Time) []string {
+	var ids []string
+	for id, s := range sessions {
+		if s.LastActivityAt.Before(cutoff) {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// SessionFilter selects and pages sessions for ListSessionsByUser
+type SessionFilter struct {
+	// Status keeps only sessions with this status when set
+	Status string
+	Offset int
+	Limit  int
+}
+
+// ListSessionsByUser returns a page of userID's sessions matching filter,
+// most recently active first, along with the total number of matches.
+// Requires an ".indexOn": ["user_id"] rule on the sessions node.
+func (c *Client) ListSessionsByUser(ctx context.Context, userID string, filter SessionFilter) (_ []SessionRecord, _ int64, err error) {
+	defer c.observe("ListSessionsByUser", c.opStart(), &err)
+	if filter.Offset < 0 || filter.Limit <= 0 {
+		return nil, 0, fmt.Errorf("invalid pagination: offset=%d limit=%d", filter.Offset, filter.Limit)
+	}
+
+	var records map[string]SessionRecord
+	if err := c.db.NewRef("sessions").OrderByChild("user_id").EqualTo(userID).Get(ctx, &records); err != nil {
+		return nil, 0, fmt.Errorf("error listing sessions: %w", err)
+	}
+
+	sessions := filterSessions(records, filter.Status)
+	total := int64(len(sessions))
+	if filter.Offset >= len(sessions) {
+		return []SessionRecord{}, total, nil
+	}
+	end := min(filter.Offset+filter.Limit, len(sessions))
+	return sessions[filter.Offset:end], total, nil
+}
+
+// filterSessions returns the sessions with status, or all of them when
+// status is empty, most recently active first
+func filterSessions(records map[string]SessionRecord, status string) []SessionRecord {
+	sessions := make([]SessionRecord, 0, len(records))
+	for id, s := range records {
+		if status != "" && s.Status != status {
+			continue
+		}
+		s.ID = id
+		sessions = append(sessions, s)
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		if !sessions[i].LastActivityAt.Equal(sessions[j].LastActivityAt) {
+			return sessions[i].LastActivityAt.After(sessions[j].LastActivityAt)
+		}
+		return sessions[i].ID < sessions[j].ID
+	})
+	return sessions
+}
@@ -0,0 +1,49 @@
+package firebase
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInactiveSessions(t *testing.T) {
+	now := time.Now()
+	sessions := map[string]SessionRecord{
+		"idle":   {Status: SessionStatusActive, LastActivityAt: now.Add(-2 * time.Hour)},
+		"recent": {Status: SessionStatusActive, LastActivityAt: now.Add(-time.Minute)},
+	}
+
+	assert.Equal(t, []string{"idle"}, inactiveSessions(sessions, now.Add(-time.Hour)))
+	assert.Empty(t, inactiveSessions(sessions, now.Add(-3*time.Hour)))
+}
+
+func TestTransitionStatus(t *testing.T) {
+	session := map[string]interface{}{"user_id": "user-1", "status": SessionStatusActive}
+	assert.NoError(t, transitionStatus(session, SessionStatusActive, SessionStatusExpired))
+	assert.Equal(t, SessionStatusExpired, session["status"])
+	assert.Equal(t, "user-1", session["user_id"])
+
+	// A session that already moved on is left alone
+	assert.ErrorIs(t, transitionStatus(session, SessionStatusActive, SessionStatusExpired), ErrSessionStatusChanged)
+	assert.Equal(t, SessionStatusExpired, session["status"])
+}
+
+func TestFilterSessions(t *testing.T) {
+	now := time.Now()
+	records := map[string]SessionRecord{
+		"old":     {Status: SessionStatusActive, LastActivityAt: now.Add(-time.Hour)},
+		"new":     {Status: SessionStatusActive, LastActivityAt: now},
+		"expired": {Status: SessionStatusExpired, LastActivityAt: now.Add(-time.Minute)},
+	}
+
+	var ids []string
+	for _, s := range filterSessions(records, "") {
+		ids = append(ids, s.ID)
+	}
+	assert.Equal(t, []string{"new", "expired", "old"}, ids)
+
+	active := filterSessions(records, SessionStatusActive)
+	assert.Len(t, active, 2)
+	assert.Equal(t, "new", active[0].ID)
+}
@@ -0,0 +1,184 @@
+package firebase
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+)
+
+// stalePointsActor is the ActorID recorded on inactivity expiries
+const stalePointsActor = "system:stale_points"
+
+// StalePointsPolicy maps a plan name to how long its users' points last
+// without activity. Plans that aren't listed, or map to zero, never expire.
+type StalePointsPolicy map[string]time.Duration
+
+// defaultStalePointsPolicy expires free points after 90 idle days
+var defaultStalePointsPolicy = StalePointsPolicy{"free": 90 * 24 * time.Hour}
+
+// stalePointsPolicyFromEnv reads STALE_POINTS_POLICY, a JSON object of plan
+// name to idle days, e.g. {"free": 90}. Invalid values fall back to the
+// default policy.
+func stalePointsPolicyFromEnv() StalePointsPolicy {
+	raw := os.Getenv("STALE_POINTS_POLICY")
+	if raw == "" {
+		return defaultStalePointsPolicy
+	}
+
+	policy, err := parseStalePointsPolicy(raw)
+	if err != nil {
+		slog.Warn("invalid STALE_POINTS_POLICY, using default", "value", raw, "error", err)
+		return defaultStalePointsPolicy
+	}
+	return policy
+}
+
+// parseStalePointsPolicy parses a JSON object of plan name to idle days
+func parseStalePointsPolicy(raw string) (StalePointsPolicy, error) {
+	var days map[string]int
+	if err := json.Unmarshal([]byte(raw), &days); err != nil {
+		return nil, err
+	}
+
+	policy := make(StalePointsPolicy, len(days))
+	for plan, d := range days {
+		if d < 0 {
+			return nil, fmt.Errorf("negative days for plan %s", plan)
+		}
+		if d > 0 {
+			policy[plan] = time.Duration(d) * 24 * time.Hour
+		}
+	}
+	return policy, nil
+}
+
+// ttl returns how long points on plan last without activity, or zero if
+// they don't expire. Users without a plan are on the free plan.
+func (p StalePointsPolicy) ttl(plan string) time.Duration {
+	if plan == "" {
+		plan = "free"
+	}
+	return p[plan]
+}
+
+// shortest returns the shortest idle time after which any plan's points
+// expire, or zero if none do
+func (p StalePointsPolicy) shortest() time.Duration {
+	var shortest time.Duration
+	for _, ttl := range p {
+		if ttl > 0 && (shortest == 0 || ttl < shortest) {
+			shortest = ttl
+		}
+	}
+	return shortest
+}
+
+// refreshExpiry sets u.ExpiresAt from the user's last activity and plan
+func (p StalePointsPolicy) refreshExpiry(u *UserData) {
+	ttl := p.ttl(u.Plan)
+	if ttl <= 0 || u.Points <= 0 {
+		u.ExpiresAt = nil
+		return
+	}
+	expiresAt := u.lastActivity().Add(ttl)
+	u.ExpiresAt = &expiresAt
+}
+
+// lastActivity is the user's last request, or their signup if they have
+// never made one
+func (u *UserData) lastActivity() time.Time {
+	if u.LastRequest.IsZero() {
+		return u.CreatedAt
+	}
+	return u.LastRequest
+}
+
+// expireStalePoints zeroes the balance if the user has been inactive for
+// longer than ttl and returns the points removed. Grants go with it.
+func (u *UserData) expireStalePoints(ttl time.Duration, now time.Time) int {
+	if ttl <= 0 || u.Points <= 0 || now.Sub(u.lastActivity()) < ttl {
+		return 0
+	}
+
+	expired := u.Points
+	u.Points = 0
+	u.PointGrants = nil
+	u.updateNextGrantExpiry()
+	return expired
+}
+
+// ExpireStalePoints zeroes the balance of users who haven't made a request
+// for longer than their plan's StalePointsPolicy allows, recording each
+// expiry in admin_adjustments, and returns the total number of points
+// expired. Run it periodically alongside ExpirePoints.
+// Requires an ".indexOn": ["last_request"] rule on the users node.
+func (c *Client) ExpireStalePoints(ctx context.Context) (_ int, err error) {
+	defer c.observe("ExpireStalePoints", c.opStart(), &err)
+	shortest := c.stalePoints.shortest()
+	if shortest <= 0 {
+		return 0, nil
+	}
+	now := time.Now()
+
+	// Timestamps are stored as RFC 3339 strings, which sort chronologically
+	// in UTC. Users that haven't reached their own plan's limit are
+	// skipped below.
+	var candidates map[string]struct {
+		Points      int       `json:"points"`
+		Plan        string    `json:"plan"`
+		CreatedAt   time.Time `json:"created_at"`
+		LastRequest time.Time `json:"last_request"`
+	}
+	err = c.db.NewRef("users").
+		OrderByChild("last_request").
+		EndAt(now.Add(-shortest).UTC().Format(time.RFC3339Nano)).
+		Get(ctx, &candidates)
+	if err != nil {
+		return 0, fmt.Errorf("error querying inactive users: %w", err)
+	}
+
+	total := 0
+	var firstErr error
+	for userID, candidate := range candidates {
+		if err := ctx.Err(); err != nil {
+			return total, err
+		}
+		stale := UserData{Points: candidate.Points, CreatedAt: candidate.CreatedAt, LastRequest: candidate.LastRequest}
+		if stale.expireStalePoints(c.stalePoints.ttl(candidate.Plan), now) == 0 {
+			continue
+		}
+
+		adj := &PointsAdjustment{UserID: userID, ActorID: stalePointsActor, CreatedAt: now}
+		balance, err := c.updateUser(ctx, userID, func(user *UserData) error {
+			// Re-check in the transaction, as the user may have just
+			// made a request
+			ttl := c.stalePoints.ttl(user.Plan)
+			adj.BalanceBefore = user.Points
+			adj.Delta = -user.expireStalePoints(ttl, now)
+			adj.Reason = fmt.Sprintf("points unused for %d days", int(ttl.Hours()/24))
+			return nil
+		})
+		if err != nil {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("error expiring stale points for %s: %w", userID, err)
+			}
+			continue
+		}
+		c.cache.setPoints(userID, balance)
+		if adj.Delta == 0 {
+			continue
+		}
+
+		adj.BalanceAfter = balance
+		total -= adj.Delta
+		slog.Info("expired stale points", "user_id", userID, "points", -adj.Delta)
+		if err := c.recordAdjustment(ctx, adj); err != nil {
+			slog.Error("stale points expiry not recorded", "user_id", userID, "points", -adj.Delta, "error", err)
+		}
+	}
+
+	return total, firstErr
+}
@@ -0,0 +1,60 @@
+package firebase
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseStalePointsPolicy(t *testing.T) {
+	policy, err := parseStalePointsPolicy(`{"free": 30, "pro": 0}`)
+	require.NoError(t, err)
+	assert.Equal(t, 30*24*time.Hour, policy.ttl("free"))
+	assert.Equal(t, 30*24*time.Hour, policy.ttl(""))
+	assert.Zero(t, policy.ttl("pro"))
+	assert.Equal(t, 30*24*time.Hour, policy.shortest())
+
+	_, err = parseStalePointsPolicy(`{"free": -1}`)
+	assert.Error(t, err)
+}
+
+func TestExpireStalePoints(t *testing.T) {
+	now := time.Now()
+	ttl := 90 * 24 * time.Hour
+
+	active := &UserData{Points: 40, LastRequest: now.Add(-89 * 24 * time.Hour)}
+	assert.Zero(t, active.expireStalePoints(ttl, now))
+	assert.Equal(t, 40, active.Points)
+
+	idle := &UserData{
+		Points:      40,
+		LastRequest: now.Add(-91 * 24 * time.Hour),
+		PointGrants: map[string]PointGrant{"g1": {Amount: 10, Remaining: 10, ExpiresAt: now.Add(time.Hour)}},
+	}
+	assert.Equal(t, 40, idle.expireStalePoints(ttl, now))
+	assert.Zero(t, idle.Points)
+	assert.Empty(t, idle.PointGrants)
+
+	// Users who never made a request are idle since signup
+	neverUsed := &UserData{Points: 100, CreatedAt: now.Add(-100 * 24 * time.Hour)}
+	assert.Equal(t, 100, neverUsed.expireStalePoints(ttl, now))
+
+	// Plans without expiry keep their points
+	assert.Zero(t, (&UserData{Points: 5}).expireStalePoints(0, now))
+}
+
+func TestRefreshExpiry(t *testing.T) {
+	policy := StalePointsPolicy{"free": 90 * 24 * time.Hour}
+	last := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	user := &UserData{Plan: "free", Points: 10, LastRequest: last}
+	policy.refreshExpiry(user)
+	require.NotNil(t, user.ExpiresAt)
+	assert.Equal(t, last.Add(90*24*time.Hour), *user.ExpiresAt)
+
+	user.Plan = "pro"
+	policy.refreshExpiry(user)
+	assert.Nil(t, user.ExpiresAt)
+}
@@ -0,0 +1,48 @@
+package firebase
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSetUserStatus(t *testing.T) {
+	c, db := newTestClient(t)
+	ctx := context.Background()
+	db.Set(t, "users/u1", UserData{Points: 30, Plan: "pro", CreatedAt: time.Now()})
+
+	require.NoError(t, c.SetUserStatus(ctx, "u1", UserStatusSuspended, "abuse"))
+	var user UserData
+	db.Get(t, "users/u1", &user)
+	assert.Equal(t, UserStatusSuspended, user.Status)
+	assert.Equal(t, "abuse", user.StatusReason)
+	assert.NotNil(t, user.StatusUpdatedAt)
+	assert.Equal(t, 30, user.Points)
+
+	// Reactivating clears the reason
+	require.NoError(t, c.SetUserStatus(ctx, "u1", UserStatusActive, "abuse"))
+	user = UserData{}
+	db.Get(t, "users/u1", &user)
+	assert.Equal(t, UserStatusActive, user.Status)
+	assert.Empty(t, user.StatusReason)
+}
+
+func TestSetUserStatusUnknownUser(t *testing.T) {
+	c, db := newTestClient(t)
+	ctx := context.Background()
+
+	err := c.SetUserStatus(ctx, "nobody", UserStatusBanned, "")
+	assert.ErrorIs(t, err, ErrUserNotFound)
+
+	var record map[string]interface{}
+	db.Get(t, "users/nobody", &record)
+	assert.Nil(t, record, "no partial record is written")
+
+	// The user can still be initialized later
+	created, err := c.InitializeUser(ctx, "nobody", "nobody@example.com")
+	require.NoError(t, err)
+	assert.True(t, created)
+}
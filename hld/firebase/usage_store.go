@@ -0,0 +1,93 @@
+package firebase
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// UsageStore keeps the billing-grade usage log for reporting, statements
+// and export. The Client is the Firebase backend and PostgresUsageStore
+// another. Balances, holds and request counters stay in Firebase whichever
+// backend is used.
+type UsageStore interface {
+	// LogUsage records one usage event
+	LogUsage(ctx context.Context, log UsageLog) error
+	// LogUsageBatch records several usage events at once
+	LogUsageBatch(ctx context.Context, logs []UsageLog) error
+	// GetUsageHistory returns up to limit usage logs matching filter,
+	// newest first
+	GetUsageHistory(ctx context.Context, filter UsageFilter, limit int) ([]UsageRecord, error)
+	// GetUsageSummary totals the usage logs matching filter
+	GetUsageSummary(ctx context.Context, filter UsageFilter) (*UsageRollup, error)
+	// ExportUsage streams the usage logs matching filter to w as CSV or
+	// JSON Lines, oldest first
+	ExportUsage(ctx context.Context, filter UsageFilter, w io.Writer, format string) error
+}
+
+var _ UsageStore = (*Client)(nil)
+
+// UsageRecord is a stored usage log with its ID
+type UsageRecord struct {
+	ID string `json:"id"`
+	UsageLog
+}
+
+// GetUsageHistory returns up to limit usage logs matching filter, newest
+// first. With a UserID the user_id index narrows the read; otherwise every
+// log in the filter's time range is scanned.
+// Requires an ".indexOn": ["user_id"] rule on the usage_logs node.
+func (c *Client) GetUsageHistory(ctx context.Context, filter UsageFilter, limit int) (_ []UsageRecord, err error) {
+	defer c.observe("GetUsageHistory", c.opStart(), &err)
+	var records []UsageRecord
+	if filter.UserID != "" {
+		var logs map[string]UsageLog
+		if err := c.db.NewRef("usage_logs").OrderByChild("user_id").EqualTo(filter.UserID).Get(ctx, &logs); err != nil {
+			return nil, fmt.Errorf("error reading usage logs: %w", err)
+		}
+		for id, log := range logs {
+			if filter.matches(log) {
+				records = append(records, UsageRecord{ID: id, UsageLog: log})
+			}
+		}
+	} else {
+		err := c.eachUsageLog(ctx, filter, func(id string, log UsageLog) error {
+			records = append(records, UsageRecord{ID: id, UsageLog: log})
+			// Only the newest logs are kept, so trim as pages arrive
+			if limit > 0 && len(records) > 2*limit {
+				records = append(records[:0], records[len(records)-limit:]...)
+			}
+			return nil
+		}, func() error { return nil })
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	sort.Slice(records, func(i, j int) bool {
+		if !records[i].Timestamp.Equal(records[j].Timestamp) {
+			return records[i].Timestamp.After(records[j].Timestamp)
+		}
+		return records[i].ID > records[j].ID
+	})
+	if limit > 0 && len(records) > limit {
+		records = records[:limit]
+	}
+	return records, nil
+}
+
+// GetUsageSummary totals the usage logs matching filter. Usage already
+// compacted into rollups isn't included.
+func (c *Client) GetUsageSummary(ctx context.Context, filter UsageFilter) (_ *UsageRollup, err error) {
+	defer c.observe("GetUsageSummary", c.opStart(), &err)
+	var summary UsageRollup
+	err = c.eachUsageLog(ctx, filter, func(_ string, log UsageLog) error {
+		summary.add(log)
+		return nil
+	}, func() error { return nil })
+	if err != nil {
+		return nil, err
+	}
+	return &summary, nil
+}
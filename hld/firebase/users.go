@@ -0,0 +1,184 @@
+package firebase
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"firebase.google.com/go/v4/auth"
+	"firebase.google.com/go/v4/db"
+)
+
+// Fields ListUsers can sort by
+const (
+	SortByTotalUsed   = "total_used"
+	SortByCreatedAt   = "created_at"
+	SortByLastRequest = "last_request"
+)
+
+// UserFilter selects and orders users for ListUsers
+type UserFilter struct {
+	Plan      string
+	MinPoints *int
+	MaxPoints *int
+	// SortBy is one of total_used, created_at or last_request (default total_used)
+	SortBy string
+	// Descending sorts highest/newest first
+	Descending bool
+	Offset     int
+	Limit      int
+}
+
+// ListUsers returns a page of users matching filter along with the total
+// number of matches. The Realtime Database only supports a single orderBy per
+// query, so the most selective filter is applied server-side and the rest in
+// memory. Unfiltered listings use limitToFirst/limitToLast so only the
+// requested page is fetched.
+// Requires ".indexOn": ["plan", "points", "total_used", "created_at", "last_request"]
+// on the users node.
+func (c *Client) ListUsers(ctx context.Context, filter UserFilter) (_ []UserData, _ int64, err error) {
+	defer c.observe("ListUsers", c.opStart(), &err)
+	if filter.SortBy == "" {
+		filter.SortBy = SortByTotalUsed
+	}
+	switch filter.SortBy {
+	case SortByTotalUsed, SortByCreatedAt, SortByLastRequest:
+	default:
+		return nil, 0, fmt.Errorf("invalid sort field: %s", filter.SortBy)
+	}
+	if filter.Offset < 0 || filter.Limit <= 0 {
+		return nil, 0, fmt.Errorf("invalid pagination: offset=%d limit=%d", filter.Offset, filter.Limit)
+	}
+
+	ref := c.db.NewRef("users")
+
+	if filter.Plan == "" && filter.MinPoints == nil && filter.MaxPoints == nil {
+		return c.listUsersPage(ctx, ref, filter)
+	}
+
+	// Apply the most selective filter server-side
+	var query *db.Query
+	switch {
+	case filter.Plan != "":
+		query = ref.OrderByChild("plan").EqualTo(filter.Plan)
+	default:
+		query = ref.OrderByChild("points")
+		if filter.MinPoints != nil {
+			query = query.StartAt(*filter.MinPoints)
+		}
+		if filter.MaxPoints != nil {
+			query = query.EndAt(*filter.MaxPoints)
+		}
+	}
+
+	var records map[string]UserData
+	if err := query.Get(ctx, &records); err != nil {
+		return nil, 0, fmt.Errorf("error listing users: %w", err)
+	}
+
+	users := make([]UserData, 0, len(records))
+	for id, user := range records {
+		if filter.MinPoints != nil && user.Points < *filter.MinPoints {
+			continue
+		}
+		if filter.MaxPoints != nil && user.Points > *filter.MaxPoints {
+			continue
+		}
+		user.ID = id
+		users = append(users, user)
+	}
+
+	sort.SliceStable(users, func(i, j int) bool {
+		if filter.Descending {
+			return userLess(users[j], users[i], filter.SortBy)
+		}
+		return userLess(users[i], users[j], filter.SortBy)
+	})
+
+	total := int64(len(users))
+	return paginateUsers(users, filter.Offset, filter.Limit), total, nil
+}
+
+// listUsersPage fetches one page of an unfiltered listing directly in sorted
+// order, counting the total with a shallow read
+func (c *Client) listUsersPage(ctx context.Context, ref *db.Ref, filter UserFilter) ([]UserData, int64, error) {
+	var keys map[string]interface{}
+	if err := ref.GetShallow(ctx, &keys); err != nil {
+		return nil, 0, fmt.Errorf("error counting users: %w", err)
+	}
+
+	query := ref.OrderByChild(filter.SortBy)
+	if filter.Descending {
+		query = query.LimitToLast(filter.Offset + filter.Limit)
+	} else {
+		query = query.LimitToFirst(filter.Offset + filter.Limit)
+	}
+
+	nodes, err := query.GetOrdered(ctx)
+	if err != nil {
+		return nil, 0, fmt.Errorf("error listing users: %w", err)
+	}
+
+	users := make([]UserData, 0, len(nodes))
+	for _, node := range nodes {
+		var user UserData
+		if err := node.Unmarshal(&user); err != nil {
+			return nil, 0, fmt.Errorf("error decoding user %s: %w", node.Key(), err)
+		}
+		user.ID = node.Key()
+		users = append(users, user)
+	}
+
+	if filter.Descending {
+		for i, j := 0, len(users)-1; i < j; i, j = i+1, j-1 {
+			users[i], users[j] = users[j], users[i]
+		}
+	}
+
+	return paginateUsers(users, filter.Offset, filter.Limit), int64(len(keys)), nil
+}
+
+// userLess orders two users by the given sort field
+func userLess(a, b UserData, sortBy string) bool {
+	switch sortBy {
+	case SortByCreatedAt:
+		return a.CreatedAt.Before(b.CreatedAt)
+	case SortByLastRequest:
+		return a.LastRequest.Before(b.LastRequest)
+	default:
+		return a.TotalUsed < b.TotalUsed
+	}
+}
+
+// paginateUsers returns the slice of users for the given offset and limit
+func paginateUsers(users []UserData, offset, limit int) []UserData {
+	if offset >= len(users) {
+		return []UserData{}
+	}
+	end := offset + limit
+	if end > len(users) {
+		end = len(users)
+	}
+	return users[offset:end]
+}
+
+// GetUserByEmail looks up a user's record by the email address on their
+// Firebase Auth account. Fails with ErrUserNotFound when no account has
+// that email.
+func (c *Client) GetUserByEmail(ctx context.Context, email string) (_ *UserData, err error) {
+	defer c.observe("GetUserByEmail", c.opStart(), &err)
+	record, err := c.auth.GetUserByEmail(ctx, email)
+	if err != nil {
+		if auth.IsUserNotFound(err) {
+			return nil, ErrUserNotFound
+		}
+		return nil, fmt.Errorf("error looking up user by email: %w", err)
+	}
+
+	user, err := c.GetUserData(ctx, record.UID)
+	if err != nil {
+		return nil, err
+	}
+	user.ID = record.UID
+	return user, nil
+}
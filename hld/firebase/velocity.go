@@ -0,0 +1,100 @@
+package firebase
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"firebase.google.com/go/v4/db"
+)
+
+// VelocityWindow is the rolling window the spending velocity cap applies to
+const VelocityWindow = 60 * time.Second
+
+// defaultVelocityCap is the most points a user may spend per VelocityWindow
+const defaultVelocityCap = 500
+
+// spendVelocity is a user's spending token bucket, stored at
+// spend_velocity/{userID}. The bucket holds up to the cap and refills at the
+// cap per VelocityWindow, so no more than the cap is spent in any window.
+type spendVelocity struct {
+	Tokens    float64   `json:"tokens"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// refill tops the bucket up for the time elapsed since it was last updated.
+// A bucket that was never used starts full.
+func (v *spendVelocity) refill(limit int, now time.Time) {
+	if v.UpdatedAt.IsZero() {
+		v.Tokens = float64(limit)
+	} else if elapsed := now.Sub(v.UpdatedAt); elapsed > 0 {
+		v.Tokens += float64(limit) * elapsed.Seconds() / VelocityWindow.Seconds()
+		if v.Tokens > float64(limit) {
+			v.Tokens = float64(limit)
+		}
+	}
+	v.UpdatedAt = now
+}
+
+// take spends amount from the bucket, failing with ErrVelocityExceeded if it
+// doesn't hold enough. A single spend larger than the cap is let through
+// once the bucket is full, leaving it in debt for the overage.
+func (v *spendVelocity) take(amount, limit int, now time.Time) error {
+	v.refill(limit, now)
+	needed := float64(amount)
+	if needed > float64(limit) {
+		needed = float64(limit)
+	}
+	if v.Tokens < needed {
+		return fmt.Errorf("%w: %d points requested, %d available", ErrVelocityExceeded, amount, int(v.Tokens))
+	}
+	v.Tokens -= float64(amount)
+	return nil
+}
+
+// takeVelocity charges amount to the user's spending velocity, returning
+// ErrVelocityExceeded if they have spent their cap in the last
+// VelocityWindow
+func (c *Client) takeVelocity(ctx context.Context, userID string, amount int) error {
+	if c.velocityCap <= 0 || amount <= 0 {
+		return nil
+	}
+	now := time.Now()
+	return c.db.NewRef("spend_velocity/"+userID).Transaction(ctx, func(tn db.TransactionNode) (interface{}, error) {
+		var v spendVelocity
+		if err := tn.Unmarshal(&v); err != nil {
+			v = spendVelocity{}
+		}
+		if err := v.take(amount, c.velocityCap, now); err != nil {
+			return nil, err
+		}
+		return v, nil
+	})
+}
+
+// refundVelocity returns amount to the user's spending velocity after the
+// spend it was taken for failed
+func (c *Client) refundVelocity(ctx context.Context, userID string, amount int) {
+	if c.velocityCap <= 0 || amount <= 0 {
+		return
+	}
+	now := time.Now()
+	err := c.db.NewRef("spend_velocity/"+userID).Transaction(ctx, func(tn db.TransactionNode) (interface{}, error) {
+		var v spendVelocity
+		if err := tn.Unmarshal(&v); err != nil || v.UpdatedAt.IsZero() {
+			// Nothing to refund into; a missing bucket starts full
+			return nil, nil
+		}
+		v.refill(c.velocityCap, now)
+		v.Tokens += float64(amount)
+		if v.Tokens > float64(c.velocityCap) {
+			v.Tokens = float64(c.velocityCap)
+		}
+		return v, nil
+	})
+	if err != nil {
+		// The bucket refills on its own
+		slog.Warn("failed to refund spend velocity", "user_id", userID, "points", amount, "error", err)
+	}
+}
@@ -0,0 +1,48 @@
+package firebase
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSpendVelocityCapsWindow(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	var v spendVelocity
+
+	// A new bucket starts full
+	require.NoError(t, v.take(300, 500, now))
+	require.NoError(t, v.take(200, 500, now.Add(time.Second)))
+	assert.ErrorIs(t, v.take(100, 500, now.Add(2*time.Second)), ErrVelocityExceeded)
+
+	// Refills at the cap per window
+	require.NoError(t, v.take(200, 500, now.Add(30*time.Second)))
+	assert.ErrorIs(t, v.take(100, 500, now.Add(31*time.Second)), ErrVelocityExceeded)
+}
+
+func TestSpendVelocityRefillCapped(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	v := spendVelocity{Tokens: 0, UpdatedAt: now}
+
+	v.refill(500, now.Add(time.Hour))
+	assert.Equal(t, 500.0, v.Tokens)
+}
+
+func TestSpendVelocityOversizedSpend(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	var v spendVelocity
+
+	// Let through from a full bucket, which is left in debt
+	require.NoError(t, v.take(800, 500, now))
+	assert.Equal(t, -300.0, v.Tokens)
+	assert.ErrorIs(t, v.take(1, 500, now.Add(30*time.Second)), ErrVelocityExceeded)
+	require.NoError(t, v.take(1, 500, now.Add(37*time.Second)))
+}
+
+func TestTakeVelocityDisabled(t *testing.T) {
+	c := &Client{}
+	assert.NoError(t, c.takeVelocity(context.Background(), "u1", 1000))
+}
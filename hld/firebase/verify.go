@@ -0,0 +1,290 @@
+package firebase
+
+import (
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"firebase.google.com/go/v4/auth"
+)
+
+const (
+	// idTokenCertURL serves the certificates Firebase signs ID tokens with
+	idTokenCertURL = "https://www.googleapis.com/robot/v1/metadata/x509/securetoken@system.gserviceaccount.com"
+	// idTokenIssuerPrefix precedes the project ID in an ID token's issuer
+	idTokenIssuerPrefix = "https://securetoken.google.com/"
+	// baseClockSkew is the clock skew Firebase token verification always
+	// tolerates; VerifyOptions.Leeway adds to it
+	baseClockSkew = 5 * time.Minute
+	// MaxVerifyLeeway bounds VerifyOptions.Leeway
+	MaxVerifyLeeway = 10 * time.Minute
+)
+
+// ErrMissingRequiredClaim is returned for tokens without the claim set by
+// VerifyOptions.RequiredClaim
+var ErrMissingRequiredClaim = errors.New("token is missing a required claim")
+
+// VerifyOptions adjust how VerifyToken validates ID tokens. The zero value
+// verifies tokens as the Firebase Admin SDK does.
+type VerifyOptions struct {
+	// Audiences are further project IDs whose tokens are accepted, e.g.
+	// while migrating users from another project. Tokens from the client's
+	// own project are always accepted.
+	Audiences []string
+	// Leeway is how much clock skew is tolerated on the iat, exp and
+	// auth_time claims on top of the five minutes Firebase allows; at most
+	// MaxVerifyLeeway
+	Leeway time.Duration
+	// RequiredClaim, when set, names a custom claim that must be present
+	// and not false or empty. It also applies to session cookies.
+	RequiredClaim string
+}
+
+// SetVerifyOptions changes how ID tokens are verified. It must be called
+// before the client is shared.
+func (c *Client) SetVerifyOptions(opts VerifyOptions) error {
+	if opts.Leeway < 0 || opts.Leeway > MaxVerifyLeeway {
+		return fmt.Errorf("token leeway must be between 0 and %s, got %s", MaxVerifyLeeway, opts.Leeway)
+	}
+
+	c.requiredClaim = opts.RequiredClaim
+	c.verifier = nil
+	audiences := slices.DeleteFunc(slices.Clone(opts.Audiences), func(aud string) bool {
+		return aud == "" || aud == c.projectID
+	})
+	if len(audiences) == 0 && opts.Leeway == 0 {
+		// The SDK verifies these tokens; only the required claim is added
+		return nil
+	}
+	c.verifier = &idTokenVerifier{
+		audiences: append([]string{c.projectID}, audiences...),
+		leeway:    baseClockSkew + opts.Leeway,
+		keys:      &certKeySource{url: idTokenCertURL, client: http.DefaultClient},
+		emulator:  os.Getenv("FIREBASE_AUTH_EMULATOR_HOST") != "",
+		now:       time.Now,
+	}
+	return nil
+}
+
+// checkRequiredClaim enforces VerifyOptions.RequiredClaim
+func (c *Client) checkRequiredClaim(claims map[string]interface{}) error {
+	if c.requiredClaim == "" {
+		return nil
+	}
+	switch v := claims[c.requiredClaim].(type) {
+	case nil:
+	case bool:
+		if v {
+			return nil
+		}
+	case string:
+		if v != "" {
+			return nil
+		}
+	default:
+		return nil
+	}
+	return fmt.Errorf("%w: %s", ErrMissingRequiredClaim, c.requiredClaim)
+}
+
+// keySource provides the public keys ID tokens are signed with, by key ID
+type keySource interface {
+	keys(ctx context.Context) (map[string]*rsa.PublicKey, error)
+}
+
+// idTokenVerifier verifies Firebase ID tokens from any of several projects
+// with a configurable clock skew, which the Admin SDK doesn't support. It
+// performs the SDK's checks otherwise, including skipping the signature
+// when FIREBASE_AUTH_EMULATOR_HOST is set, as the emulator doesn't sign
+// tokens.
+type idTokenVerifier struct {
+	audiences []string
+	leeway    time.Duration
+	keys      keySource
+	emulator  bool
+	now       func() time.Time
+}
+
+// verify checks an ID token and returns its claims
+func (v *idTokenVerifier) verify(ctx context.Context, idToken string) (*auth.Token, error) {
+	segments := strings.Split(idToken, ".")
+	if len(segments) != 3 {
+		return nil, errors.New("ID token has an incorrect number of segments")
+	}
+
+	var header struct {
+		Algorithm string `json:"alg"`
+		KeyID     string `json:"kid"`
+	}
+	if err := decodeSegment(segments[0], &header); err != nil {
+		return nil, fmt.Errorf("error decoding ID token header: %w", err)
+	}
+	var token auth.Token
+	if err := decodeSegment(segments[1], &token); err != nil {
+		return nil, fmt.Errorf("error decoding ID token: %w", err)
+	}
+	var claims map[string]interface{}
+	if err := decodeSegment(segments[1], &claims); err != nil {
+		return nil, fmt.Errorf("error decoding ID token: %w", err)
+	}
+
+	if !v.emulator {
+		if header.Algorithm != "RS256" {
+			return nil, fmt.Errorf("ID token has invalid algorithm %q", header.Algorithm)
+		}
+		if header.KeyID == "" {
+			return nil, errors.New("ID token has no 'kid' header")
+		}
+	}
+	if !slices.Contains(v.audiences, token.Audience) {
+		return nil, fmt.Errorf("ID token has unexpected audience %q", token.Audience)
+	}
+	if token.Issuer != idTokenIssuerPrefix+token.Audience {
+		return nil, fmt.Errorf("ID token has invalid issuer %q", token.Issuer)
+	}
+	if token.Subject == "" || len(token.Subject) > 128 {
+		return nil, errors.New("ID token has an invalid 'sub' claim")
+	}
+
+	now := v.now()
+	skew := int64(v.leeway.Seconds())
+	if token.IssuedAt-skew > now.Unix() {
+		return nil, fmt.Errorf("ID token issued in the future: %d", token.IssuedAt)
+	}
+	if token.AuthTime-skew > now.Unix() {
+		return nil, fmt.Errorf("ID token authenticated in the future: %d", token.AuthTime)
+	}
+	if token.Expires+skew < now.Unix() {
+		return nil, fmt.Errorf("ID token expired at %d", token.Expires)
+	}
+
+	if !v.emulator {
+		if err := v.verifySignature(ctx, segments, header.KeyID); err != nil {
+			return nil, err
+		}
+	}
+
+	token.UID = token.Subject
+	for _, standard := range []string{"iss", "aud", "exp", "iat", "sub", "uid"} {
+		delete(claims, standard)
+	}
+	token.Claims = claims
+	return &token, nil
+}
+
+// verifySignature checks the RS256 signature of a token's segments
+func (v *idTokenVerifier) verifySignature(ctx context.Context, segments []string, keyID string) error {
+	keys, err := v.keys.keys(ctx)
+	if err != nil {
+		return fmt.Errorf("error fetching ID token certificates: %w", err)
+	}
+	key, ok := keys[keyID]
+	if !ok {
+		return fmt.Errorf("ID token signed with unknown key %q", keyID)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(segments[2])
+	if err != nil {
+		return fmt.Errorf("error decoding ID token signature: %w", err)
+	}
+	digest := sha256.Sum256([]byte(segments[0] + "." + segments[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature); err != nil {
+		return errors.New("failed to verify ID token signature")
+	}
+	return nil
+}
+
+// decodeSegment decodes a base64url JWT segment as JSON into v
+func decodeSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// certKeySource fetches X.509 certificates, keyed by key ID, from url and
+// caches them for as long as the response's Cache-Control allows
+type certKeySource struct {
+	url    string
+	client *http.Client
+
+	mu        sync.Mutex
+	cached    map[string]*rsa.PublicKey
+	expiresAt time.Time
+}
+
+func (s *certKeySource) keys(ctx context.Context) (map[string]*rsa.PublicKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cached != nil && time.Now().Before(s.expiresAt) {
+		return s.cached, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %d fetching certificates", resp.StatusCode)
+	}
+
+	var certs map[string]string
+	if err := json.Unmarshal(body, &certs); err != nil {
+		return nil, fmt.Errorf("error decoding certificates: %w", err)
+	}
+	keys := make(map[string]*rsa.PublicKey, len(certs))
+	for kid, certPEM := range certs {
+		block, _ := pem.Decode([]byte(certPEM))
+		if block == nil {
+			return nil, fmt.Errorf("certificate %s is not PEM", kid)
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing certificate %s: %w", kid, err)
+		}
+		key, ok := cert.PublicKey.(*rsa.PublicKey)
+		if !ok {
+			return nil, fmt.Errorf("certificate %s is not an RSA key", kid)
+		}
+		keys[kid] = key
+	}
+
+	s.cached, s.expiresAt = keys, time.Now().Add(cacheMaxAge(resp.Header.Get("Cache-Control")))
+	return keys, nil
+}
+
+// cacheMaxAge returns the max-age of a Cache-Control header, or zero
+func cacheMaxAge(cacheControl string) time.Duration {
+	for _, directive := range strings.Split(cacheControl, ",") {
+		if raw, ok := strings.CutPrefix(strings.TrimSpace(directive), "max-age="); ok {
+			if seconds, err := strconv.Atoi(raw); err == nil && seconds > 0 {
+				return time.Duration(seconds) * time.Second
+			}
+		}
+	}
+	return 0
+}
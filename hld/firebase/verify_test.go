@@ -0,0 +1,169 @@
+package firebase
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// staticKeys serves fixed ID token signing keys
+type staticKeys map[string]*rsa.PublicKey
+
+func (k staticKeys) keys(ctx context.Context) (map[string]*rsa.PublicKey, error) {
+	return k, nil
+}
+
+// craftToken builds an ID token with the given claims, signed with key
+// under kid, or unsigned as the auth emulator issues them when key is nil
+func craftToken(t *testing.T, claims map[string]interface{}, kid string, key *rsa.PrivateKey) string {
+	t.Helper()
+	header := map[string]string{"alg": "none", "typ": "JWT"}
+	if key != nil {
+		header = map[string]string{"alg": "RS256", "typ": "JWT", "kid": kid}
+	}
+	encode := func(v interface{}) string {
+		data, err := json.Marshal(v)
+		require.NoError(t, err)
+		return base64.RawURLEncoding.EncodeToString(data)
+	}
+	unsigned := encode(header) + "." + encode(claims)
+	if key == nil {
+		return unsigned + "."
+	}
+	digest := sha256.Sum256([]byte(unsigned))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	require.NoError(t, err)
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func idTokenClaims(project, uid string, issuedAt time.Time) map[string]interface{} {
+	return map[string]interface{}{
+		"iss":       idTokenIssuerPrefix + project,
+		"aud":       project,
+		"sub":       uid,
+		"iat":       issuedAt.Unix(),
+		"auth_time": issuedAt.Unix(),
+		"exp":       issuedAt.Add(time.Hour).Unix(),
+		"email":     uid + "@example.com",
+		"firebase":  map[string]interface{}{"sign_in_provider": "password"},
+	}
+}
+
+func emulatorClient(t *testing.T, opts VerifyOptions) *Client {
+	t.Helper()
+	t.Setenv("FIREBASE_AUTH_EMULATOR_HOST", "127.0.0.1:9099")
+	c := &Client{projectID: "primary-project"}
+	require.NoError(t, c.SetVerifyOptions(opts))
+	require.NotNil(t, c.verifier)
+	return c
+}
+
+func TestVerifyTokenAudiences(t *testing.T) {
+	c := emulatorClient(t, VerifyOptions{Audiences: []string{"secondary-project"}})
+	now := time.Now()
+
+	for _, project := range []string{"primary-project", "secondary-project"} {
+		info, err := c.VerifyToken(context.Background(), craftToken(t, idTokenClaims(project, "user-1", now), "", nil))
+		require.NoError(t, err, project)
+		assert.Equal(t, "user-1", info.UID)
+		assert.Equal(t, "user-1@example.com", info.Email)
+		assert.Equal(t, "password", info.SignInProvider)
+	}
+
+	_, err := c.VerifyToken(context.Background(), craftToken(t, idTokenClaims("other-project", "user-1", now), "", nil))
+	assert.Error(t, err)
+
+	// The issuer must match the audience
+	claims := idTokenClaims("secondary-project", "user-1", now)
+	claims["iss"] = idTokenIssuerPrefix + "other-project"
+	_, err = c.VerifyToken(context.Background(), craftToken(t, claims, "", nil))
+	assert.Error(t, err)
+}
+
+func TestVerifyTokenLeeway(t *testing.T) {
+	c := emulatorClient(t, VerifyOptions{Leeway: 2 * time.Minute})
+	now := time.Now()
+
+	// Five minutes of skew are always allowed, plus the leeway
+	_, err := c.VerifyToken(context.Background(), craftToken(t, idTokenClaims("primary-project", "user-1", now.Add(6*time.Minute)), "", nil))
+	assert.NoError(t, err)
+	_, err = c.VerifyToken(context.Background(), craftToken(t, idTokenClaims("primary-project", "user-1", now.Add(8*time.Minute)), "", nil))
+	assert.Error(t, err)
+
+	// Expired an hour after issue
+	_, err = c.VerifyToken(context.Background(), craftToken(t, idTokenClaims("primary-project", "user-1", now.Add(-66*time.Minute)), "", nil))
+	assert.NoError(t, err)
+	_, err = c.VerifyToken(context.Background(), craftToken(t, idTokenClaims("primary-project", "user-1", now.Add(-68*time.Minute)), "", nil))
+	assert.Error(t, err)
+}
+
+func TestVerifyTokenRequiredClaim(t *testing.T) {
+	c := emulatorClient(t, VerifyOptions{Audiences: []string{"secondary-project"}, RequiredClaim: "beta"})
+	claims := idTokenClaims("primary-project", "user-1", time.Now())
+
+	_, err := c.VerifyToken(context.Background(), craftToken(t, claims, "", nil))
+	assert.ErrorIs(t, err, ErrMissingRequiredClaim)
+
+	claims["beta"] = false
+	_, err = c.VerifyToken(context.Background(), craftToken(t, claims, "", nil))
+	assert.ErrorIs(t, err, ErrMissingRequiredClaim)
+
+	claims["beta"] = true
+	_, err = c.VerifyToken(context.Background(), craftToken(t, claims, "", nil))
+	assert.NoError(t, err)
+}
+
+func TestVerifyTokenSignature(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	t.Setenv("FIREBASE_AUTH_EMULATOR_HOST", "")
+	c := &Client{projectID: "primary-project"}
+	require.NoError(t, c.SetVerifyOptions(VerifyOptions{Audiences: []string{"secondary-project"}}))
+	c.verifier.keys = staticKeys{"key-1": &key.PublicKey}
+	claims := idTokenClaims("secondary-project", "user-1", time.Now())
+
+	_, err = c.VerifyToken(context.Background(), craftToken(t, claims, "key-1", key))
+	assert.NoError(t, err)
+
+	_, err = c.VerifyToken(context.Background(), craftToken(t, claims, "key-1", other))
+	assert.Error(t, err)
+	_, err = c.VerifyToken(context.Background(), craftToken(t, claims, "key-2", key))
+	assert.Error(t, err)
+	// Unsigned tokens are only accepted from the emulator
+	_, err = c.VerifyToken(context.Background(), craftToken(t, claims, "", nil))
+	assert.Error(t, err)
+}
+
+func TestSetVerifyOptions(t *testing.T) {
+	c := &Client{projectID: "primary-project"}
+	assert.Error(t, c.SetVerifyOptions(VerifyOptions{Leeway: MaxVerifyLeeway + time.Second}))
+	assert.Error(t, c.SetVerifyOptions(VerifyOptions{Leeway: -time.Second}))
+
+	// Options the SDK handles keep its verification
+	require.NoError(t, c.SetVerifyOptions(VerifyOptions{Audiences: []string{"primary-project"}, RequiredClaim: "beta"}))
+	assert.Nil(t, c.verifier)
+	assert.Equal(t, "beta", c.requiredClaim)
+
+	require.NoError(t, c.SetVerifyOptions(VerifyOptions{Leeway: time.Minute}))
+	require.NotNil(t, c.verifier)
+	assert.Equal(t, []string{"primary-project"}, c.verifier.audiences)
+	assert.Equal(t, 6*time.Minute, c.verifier.leeway)
+}
+
+func TestCacheMaxAge(t *testing.T) {
+	assert.Equal(t, 3600*time.Second, cacheMaxAge("public, max-age=3600, must-revalidate"))
+	assert.Zero(t, cacheMaxAge("no-cache"))
+	assert.Zero(t, cacheMaxAge(""))
+}
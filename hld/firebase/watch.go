@@ -0,0 +1,112 @@
+package firebase
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+// databaseScopes are the OAuth scopes needed for Realtime Database REST calls
+var databaseScopes = []string{
+	"https://www.googleapis.com/auth/firebase.database",
+	"https://www.googleapis.com/auth/userinfo.email",
+}
+
+// streamEvent is the payload of a Realtime Database put or patch event
+type streamEvent struct {
+	Path string          `json:"path"`
+	Data json.RawMessage `json:"data"`
+}
+
+// WatchUserPoints streams the user's balance, starting with its current
+// value and then on every change, using the Realtime Database REST streaming
+// API. The channel is closed when ctx is cancelled or the stream ends, e.g.
+// because the server revoked the credentials; callers should resubscribe if
+// they still need updates.
+func (c *Client) WatchUserPoints(ctx context.Context, userID string) (_ <-chan int, err error) {
+	defer c.observe("WatchUserPoints", c.opStart(), &err)
+	token, err := c.tokenSource.Token()
+	if err != nil {
+		return nil, fmt.Errorf("error getting database token: %w", err)
+	}
+
+	url := fmt.Sprintf("%s/%s/points.json", c.dbURL, userPath(userID))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error creating stream request: %w", err)
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	token.SetAuthHeader(req)
+
+	// Streams are long lived, so rely on ctx rather than a client timeout
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error opening points stream: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("error opening points stream: status %d", resp.StatusCode)
+	}
+
+	updates := make(chan int, 1)
+	go func() {
+		defer close(updates)
+		defer resp.Body.Close()
+
+		err := readPointsStream(resp.Body, func(points int) {
+			c.cache.setPoints(userID, points)
+			select {
+			case updates <- points:
+			case <-ctx.Done():
+			}
+		})
+		if err != nil && ctx.Err() == nil {
+			slog.Warn("points stream ended", "user_id", userID, "error", err)
+		}
+	}()
+
+	return updates, nil
+}
+
+// readPointsStream parses server-sent events from a stream on a points node
+// and calls emit with each new value. It returns when the stream ends or the
+// server cancels it.
+func readPointsStream(r io.Reader, emit func(points int)) error {
+	scanner := bufio.NewScanner(r)
+	var event string
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "event:"):
+			event = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+		case strings.HasPrefix(line, "data:"):
+			data := strings.TrimSpace(strings.TrimPrefix(line, "data:"))
+			switch event {
+			case "put", "patch":
+				var ev streamEvent
+				if err := json.Unmarshal([]byte(data), &ev); err != nil {
+					return fmt.Errorf("error decoding stream event: %w", err)
+				}
+				if ev.Path != "/" {
+					continue
+				}
+				// A missing node streams null, which is a zero balance
+				var points int
+				if err := json.Unmarshal(ev.Data, &points); err != nil && string(ev.Data) != "null" {
+					return fmt.Errorf("error decoding points: %w", err)
+				}
+				emit(points)
+			case "cancel", "auth_revoked":
+				return fmt.Errorf("stream %s: %s", event, data)
+			}
+		case line == "":
+			event = ""
+		}
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,44 @@
+package firebase
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadPointsStream(t *testing.T) {
+	stream := strings.Join([]string{
+		"event: put",
+		`data: {"path":"/","data":100}`,
+		"",
+		"event: keep-alive",
+		"data: null",
+		"",
+		"event: put",
+		`data: {"path":"/","data":85}`,
+		"",
+		"event: put",
+		`data: {"path":"/","data":null}`,
+		"",
+	}, "\n")
+
+	var got []int
+	err := readPointsStream(strings.NewReader(stream), func(points int) {
+		got = append(got, points)
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []int{100, 85, 0}, got)
+}
+
+func TestReadPointsStreamRevoked(t *testing.T) {
+	stream := "event: put\ndata: {\"path\":\"/\",\"data\":7}\n\nevent: auth_revoked\ndata: \"credential is no longer valid\"\n\n"
+
+	var got []int
+	err := readPointsStream(strings.NewReader(stream), func(points int) {
+		got = append(got, points)
+	})
+	assert.ErrorContains(t, err, "auth_revoked")
+	assert.Equal(t, []int{7}, got)
+}
@@ -0,0 +1,120 @@
+// Package apierror defines the JSON error envelope shared by the usage
+// middleware and the daemon's handlers, so clients can handle failures from
+// either the same way: switch on Code, show Message, and quote RequestID
+// when reporting a problem.
+package apierror
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// requestIDHeader is the response header the request ID middleware sets;
+// it matches requestid.Header
+const requestIDHeader = "X-Request-ID"
+
+// Error codes. They are part of the API contract: add new ones freely but
+// never rename or reuse an existing code.
+const (
+	// Authentication
+	CodeMissingAuthorization = "missing_authorization"
+	CodeInvalidAuthorization = "invalid_authorization"
+	CodeInvalidToken         = "invalid_token"
+	CodeInvalidAPIKey        = "invalid_api_key"
+	CodeInvalidSession       = "invalid_session"
+	CodeInvalidSignature     = "invalid_signature"
+	CodeTooManyAuthFailures  = "too_many_auth_failures"
+	CodeTokenRequired        = "token_required"
+	CodeNonceRequired        = "nonce_required"
+	CodeInvalidNonce         = "invalid_nonce"
+
+	// Authorization and account state
+	CodeForbidden         = "forbidden"
+	CodeAdminRequired     = "admin_required"
+	CodeInsufficientScope = "insufficient_scope"
+	CodeEmailNotVerified  = "email_not_verified"
+	CodePlanTierTooLow    = "plan_tier_too_low"
+	CodeAccountSuspended  = "account_suspended"
+	CodeAccountBanned     = "account_banned"
+	CodeModelNotAllowed   = "model_not_allowed"
+	CodeGeoBlocked        = "geo_blocked"
+
+	// Request validation
+	CodeInvalidRequest   = "invalid_request"
+	CodeRequestTooLarge  = "request_too_large"
+	CodeInvalidJSON      = "invalid_json"
+	CodeInvalidParameter = "invalid_parameter"
+	CodeInvalidImport    = "invalid_import"
+	CodeMethodNotAllowed = "method_not_allowed"
+	CodeUnknownModel     = "unknown_model"
+	CodeInvalidTenant    = "invalid_tenant"
+	CodeUnknownTenant    = "unknown_tenant"
+
+	// Points and limits
+	CodeInsufficientPoints        = "insufficient_points"
+	CodeOverdraftLimitExceeded    = "overdraft_limit_exceeded"
+	CodeRateLimited               = "rate_limited"
+	CodeTooManyConcurrentRequests = "too_many_concurrent_requests"
+	CodeTooManyConnections        = "too_many_connections"
+	CodeSessionBudgetExhausted    = "session_budget_exhausted"
+	CodeTrialExhausted            = "trial_exhausted"
+	CodeVelocityExceeded          = "velocity_exceeded"
+	CodeDailyRequestLimit         = "daily_request_limit"
+	CodePlanLimitExceeded         = "plan_limit_exceeded"
+
+	// Resources
+	CodeNotFound         = "not_found"
+	CodeUserNotFound     = "user_not_found"
+	CodeSessionNotFound  = "session_not_found"
+	CodeSessionCompleted = "session_completed"
+	CodeAlreadyOwner     = "already_owner"
+	CodeOwnerChanged     = "owner_changed"
+	CodeNonceReused      = "nonce_reused"
+
+	// Server and upstream failures
+	CodeInternalError      = "internal_error"
+	CodeBalanceUnavailable = "balance_unavailable"
+	CodeTenantUnavailable  = "tenant_unavailable"
+	CodeUpstreamTimeout    = "upstream_timeout"
+	CodeCompactionRunning  = "compaction_running"
+	CodeMaintenance        = "maintenance"
+)
+
+// Envelope is the JSON body of every error response
+type Envelope struct {
+	Code      string                 `json:"code"`
+	Message   string                 `json:"message"`
+	Details   map[string]interface{} `json:"details,omitempty"`
+	RequestID string                 `json:"request_id,omitempty"`
+}
+
+// WriteError writes an envelope with code and msg
+func WriteError(w http.ResponseWriter, status int, code, msg string) {
+	Write(w, status, Envelope{Code: code, Message: msg})
+}
+
+// Write writes env with the given status. An empty RequestID is filled in
+// from the response's X-Request-ID header.
+func Write(w http.ResponseWriter, status int, env Envelope) {
+	if env.RequestID == "" {
+		env.RequestID = w.Header().Get(requestIDHeader)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(env)
+}
+
+// AbortWithError aborts a gin request with an envelope with code and msg
+func AbortWithError(c *gin.Context, status int, code, msg string) {
+	Abort(c, status, Envelope{Code: code, Message: msg})
+}
+
+// Abort aborts a gin request with env, filling in RequestID like Write
+func Abort(c *gin.Context, status int, env Envelope) {
+	if env.RequestID == "" {
+		env.RequestID = c.Writer.Header().Get(requestIDHeader)
+	}
+	c.AbortWithStatusJSON(status, env)
+}
@@ -0,0 +1,45 @@
+package apierror
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteError(t *testing.T) {
+	w := httptest.NewRecorder()
+	w.Header().Set(requestIDHeader, "req-1")
+	WriteError(w, http.StatusUnauthorized, CodeMissingAuthorization, "Authorization header required")
+
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	assert.JSONEq(t, `{"code":"missing_authorization","message":"Authorization header required","request_id":"req-1"}`, w.Body.String())
+}
+
+func TestWriteKeepsDetails(t *testing.T) {
+	w := httptest.NewRecorder()
+	Write(w, http.StatusPaymentRequired, Envelope{
+		Code:    CodeInsufficientPoints,
+		Message: "Not enough points",
+		Details: map[string]interface{}{"balance": 3},
+	})
+
+	// Without a request ID header the field is omitted
+	assert.JSONEq(t, `{"code":"insufficient_points","message":"Not enough points","details":{"balance":3}}`, w.Body.String())
+}
+
+func TestAbortWithError(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Header(requestIDHeader, "req-2")
+
+	AbortWithError(c, http.StatusInternalServerError, CodeInternalError, "Failed")
+
+	assert.True(t, c.IsAborted())
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	assert.JSONEq(t, `{"code":"internal_error","message":"Failed","request_id":"req-2"}`, w.Body.String())
+}
@@ -0,0 +1,44 @@
+// Package requestid carries a per-request correlation ID through contexts,
+// so log lines, usage records and responses for one request can be matched
+// up with what the client saw.
+package requestid
+
+import (
+	"context"
+	"regexp"
+
+	"github.com/google/uuid"
+)
+
+// Header is the request and response header carrying the ID
+const Header = "X-Request-ID"
+
+// validID accepts client-supplied IDs that are safe to log and echo back:
+// up to 128 letters, digits and the separators - _ . :
+var validID = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+type contextKey struct{}
+
+// New returns a fresh random request ID
+func New() string {
+	return uuid.New().String()
+}
+
+// FromHeader returns the client's ID if it is well formed, or a fresh one
+func FromHeader(value string) string {
+	if validID.MatchString(value) {
+		return value
+	}
+	return New()
+}
+
+// NewContext returns a copy of ctx carrying id
+func NewContext(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, contextKey{}, id)
+}
+
+// FromContext returns the request ID stored in ctx, or ""
+func FromContext(ctx context.Context) string {
+	id, _ := ctx.Value(contextKey{}).(string)
+	return id
+}
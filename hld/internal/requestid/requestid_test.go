@@ -0,0 +1,28 @@
+package requestid
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFromHeader(t *testing.T) {
+	assert.Equal(t, "abc-123", FromHeader("abc-123"))
+	assert.Equal(t, "trace:9f.1_x", FromHeader("trace:9f.1_x"))
+
+	// Missing, oversized or unsafe IDs are replaced
+	for _, bad := range []string{"", strings.Repeat("a", 129), "id with spaces", "id\nInjected: 1", "<script>"} {
+		got := FromHeader(bad)
+		assert.NotEqual(t, bad, got)
+		assert.Len(t, got, 36)
+	}
+}
+
+func TestContext(t *testing.T) {
+	assert.Empty(t, FromContext(context.Background()))
+
+	ctx := NewContext(context.Background(), "req-1")
+	assert.Equal(t, "req-1", FromContext(ctx))
+}
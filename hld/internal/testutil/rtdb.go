@@ -0,0 +1,394 @@
+package testutil
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// RealtimeDatabase is an in-memory Firebase Realtime Database serving the
+// REST protocol used by the Admin SDK: reads, writes, updates, pushes,
+// deletes and ETag transactions, plus orderBy queries with range filters
+// and limits. Point a client at it with DatabaseURL, which the SDK treats as
+// an emulator and so sends no credentials.
+type RealtimeDatabase struct {
+	srv *httptest.Server
+
+	mu        sync.Mutex
+	root      interface{}
+	pushes    int
+	failWrite func(path string) bool
+}
+
+// NewRealtimeDatabase starts an empty database that is shut down when the
+// test finishes
+func NewRealtimeDatabase(t *testing.T) *RealtimeDatabase {
+	t.Helper()
+	d := &RealtimeDatabase{}
+	d.srv = httptest.NewServer(http.HandlerFunc(d.serveHTTP))
+	t.Cleanup(d.srv.Close)
+	return d
+}
+
+// DatabaseURL returns the URL to configure the client with
+func (d *RealtimeDatabase) DatabaseURL() string {
+	return "localhost" + strings.TrimPrefix(d.srv.URL, "http://127.0.0.1") + "?ns=test"
+}
+
+// Set stores v at path, as the client's Set would
+func (d *RealtimeDatabase) Set(t *testing.T, path string, v interface{}) {
+	t.Helper()
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatalf("encoding %s: %v", path, err)
+	}
+	var value interface{}
+	if err := json.Unmarshal(data, &value); err != nil {
+		t.Fatalf("decoding %s: %v", path, err)
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.root = setNode(d.root, splitPath(path), value)
+}
+
+// Get decodes the value at path into v, leaving v untouched when the path
+// is empty
+func (d *RealtimeDatabase) Get(t *testing.T, path string, v interface{}) {
+	t.Helper()
+	d.mu.Lock()
+	data, err := json.Marshal(getNode(d.root, splitPath(path)))
+	d.mu.Unlock()
+	if err != nil {
+		t.Fatalf("encoding %s: %v", path, err)
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		t.Fatalf("decoding %s: %v", path, err)
+	}
+}
+
+// FailWrites makes writes to paths matching fail fail with a permission
+// error, which the SDK doesn't retry. Pass nil to allow all writes again.
+func (d *RealtimeDatabase) FailWrites(fail func(path string) bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.failWrite = fail
+}
+
+func (d *RealtimeDatabase) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimSuffix(r.URL.Path, ".json")
+	segs := splitPath(path)
+
+	var body interface{}
+	if r.Method != http.MethodGet && r.Method != http.MethodDelete {
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeDatabaseError(w, http.StatusBadRequest, "Invalid data; couldn't parse JSON object")
+			return
+		}
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	current := getNode(d.root, segs)
+	if r.Method != http.MethodGet && d.failWrite != nil && d.failWrite(strings.Trim(path, "/")) {
+		writeDatabaseError(w, http.StatusForbidden, "Permission denied")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		if r.URL.Query().Has("orderBy") {
+			result, err := query(current, r.URL.Query())
+			if err != nil {
+				writeDatabaseError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			writeNode(w, http.StatusOK, result)
+			return
+		}
+		if r.Header.Get("X-Firebase-ETag") == "true" {
+			w.Header().Set("ETag", etag(current))
+		}
+		writeNode(w, http.StatusOK, current)
+
+	case http.MethodPut:
+		if match := r.Header.Get("If-Match"); match != "" && match != etag(current) {
+			w.Header().Set("ETag", etag(current))
+			writeNode(w, http.StatusPreconditionFailed, current)
+			return
+		}
+		d.root = setNode(d.root, segs, body)
+		d.writeResult(w, r, body)
+
+	case http.MethodPatch:
+		children, ok := body.(map[string]interface{})
+		if !ok {
+			writeDatabaseError(w, http.StatusBadRequest, "Invalid data; update must be an object")
+			return
+		}
+		for key, value := range children {
+			d.root = setNode(d.root, append(append([]string{}, segs...), splitPath(key)...), value)
+		}
+		d.writeResult(w, r, body)
+
+	case http.MethodPost:
+		d.pushes++
+		name := fmt.Sprintf("-%019d", d.pushes)
+		d.root = setNode(d.root, append(append([]string{}, segs...), name), body)
+		writeNode(w, http.StatusOK, map[string]string{"name": name})
+
+	case http.MethodDelete:
+		d.root = setNode(d.root, segs, nil)
+		d.writeResult(w, r, nil)
+
+	default:
+		writeDatabaseError(w, http.StatusMethodNotAllowed, "Method not allowed")
+	}
+}
+
+// writeResult answers a write, which echoes the written data unless the
+// client asked for print=silent
+func (d *RealtimeDatabase) writeResult(w http.ResponseWriter, r *http.Request, body interface{}) {
+	if r.URL.Query().Get("print") == "silent" {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	writeNode(w, http.StatusOK, body)
+}
+
+func writeNode(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeDatabaseError(w http.ResponseWriter, status int, msg string) {
+	writeNode(w, status, map[string]string{"error": msg})
+}
+
+func etag(v interface{}) string {
+	data, _ := json.Marshal(v)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func splitPath(path string) []string {
+	var segs []string
+	for _, s := range strings.Split(path, "/") {
+		if s != "" {
+			segs = append(segs, s)
+		}
+	}
+	return segs
+}
+
+func getNode(node interface{}, segs []string) interface{} {
+	for _, s := range segs {
+		children, ok := node.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		node = children[s]
+	}
+	return node
+}
+
+// setNode returns node with the value at segs replaced. As in the real
+// database, nulls delete and empty objects don't exist.
+func setNode(node interface{}, segs []string, value interface{}) interface{} {
+	if len(segs) == 0 {
+		return prune(value)
+	}
+
+	children, ok := node.(map[string]interface{})
+	if !ok {
+		children = make(map[string]interface{})
+	}
+	if child := setNode(children[segs[0]], segs[1:], value); child != nil {
+		children[segs[0]] = child
+	} else {
+		delete(children, segs[0])
+	}
+	if len(children) == 0 {
+		return nil
+	}
+	return children
+}
+
+func prune(value interface{}) interface{} {
+	children, ok := value.(map[string]interface{})
+	if !ok {
+		return value
+	}
+	for key, child := range children {
+		if child = prune(child); child != nil {
+			children[key] = child
+		} else {
+			delete(children, key)
+		}
+	}
+	if len(children) == 0 {
+		return nil
+	}
+	return children
+}
+
+// query applies orderBy, startAt, endAt, equalTo, limitToFirst and
+// limitToLast to the children of node. Keys and child values are compared
+// as strings or numbers; children missing the ordered value sort first.
+func query(node interface{}, params map[string][]string) (interface{}, error) {
+	children, _ := node.(map[string]interface{})
+	param := func(name string) (interface{}, bool, error) {
+		raw, ok := params[name]
+		if !ok {
+			return nil, false, nil
+		}
+		var v interface{}
+		if err := json.Unmarshal([]byte(raw[0]), &v); err != nil {
+			return nil, false, fmt.Errorf("%s must be JSON: %w", name, err)
+		}
+		return v, true, nil
+	}
+
+	orderBy, _, err := param("orderBy")
+	if err != nil {
+		return nil, err
+	}
+	by, _ := orderBy.(string)
+	orderValue := func(key string) interface{} {
+		switch by {
+		case "$key":
+			return key
+		case "$value":
+			return children[key]
+		default:
+			return getNode(children[key], splitPath(by))
+		}
+	}
+
+	keys := make([]string, 0, len(children))
+	for key := range children {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if c := compareValues(orderValue(keys[i]), orderValue(keys[j])); c != 0 {
+			return c < 0
+		}
+		return keys[i] < keys[j]
+	})
+
+	var filters []func(interface{}) bool
+	for name, keep := range map[string]func(int) bool{
+		"startAt": func(c int) bool { return c >= 0 },
+		"endAt":   func(c int) bool { return c <= 0 },
+		"equalTo": func(c int) bool { return c == 0 },
+	} {
+		bound, ok, err := param(name)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			keep := keep
+			filters = append(filters, func(v interface{}) bool { return v != nil && keep(compareValues(v, bound)) })
+		}
+	}
+	matched := keys[:0]
+	for _, key := range keys {
+		keep := true
+		for _, filter := range filters {
+			keep = keep && filter(orderValue(key))
+		}
+		if keep {
+			matched = append(matched, key)
+		}
+	}
+
+	if raw, ok := params["limitToFirst"]; ok {
+		if n, err := strconv.Atoi(raw[0]); err == nil && n < len(matched) {
+			matched = matched[:n]
+		}
+	}
+	if raw, ok := params["limitToLast"]; ok {
+		if n, err := strconv.Atoi(raw[0]); err == nil && n < len(matched) {
+			matched = matched[len(matched)-n:]
+		}
+	}
+
+	result := make(map[string]interface{}, len(matched))
+	for _, key := range matched {
+		result[key] = children[key]
+	}
+	return result, nil
+}
+
+// compareValues orders nulls, then numbers, then strings, then anything
+// else, which compares equal
+func compareValues(a, b interface{}) int {
+	rank := func(v interface{}) int {
+		switch v.(type) {
+		case nil:
+			return 0
+		case float64:
+			return 1
+		case string:
+			return 2
+		default:
+			return 3
+		}
+	}
+	if ra, rb := rank(a), rank(b); ra != rb {
+		return ra - rb
+	}
+	switch a := a.(type) {
+	case float64:
+		b := b.(float64)
+		switch {
+		case a < b:
+			return -1
+		case a > b:
+			return 1
+		}
+	case string:
+		return strings.Compare(a, b.(string))
+	}
+	return 0
+}
+
+var (
+	privateKeyOnce sync.Once
+	privateKeyPEM  string
+)
+
+// PrivateKeyPEM returns a throwaway RSA key in the PEM form of a service
+// account's private_key, for building clients that never reach Google
+func PrivateKeyPEM(t *testing.T) string {
+	t.Helper()
+	privateKeyOnce.Do(func() {
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			return
+		}
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return
+		}
+		privateKeyPEM = string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+	})
+	if privateKeyPEM == "" {
+		t.Fatal("failed to generate private key")
+	}
+	return privateKeyPEM
+}